@@ -19,11 +19,13 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/tidb-lightning/lightning/config"
-	"github.com/pingcap/tidb-lightning/lightning/kv"
 	"github.com/pingcap/tidb-lightning/lightning/restore"
 )
 
@@ -42,12 +44,17 @@ func run() error {
 	fs.StringVar(&cfg.ConfigFile, "config", "tidb-lightning.toml", "tidb-lightning configuration file")
 
 	compact := fs.Bool("compact", false, "do manual compaction on the target cluster")
+	compactLevel := fs.String("compact-level", "full", "the level of the manual compaction, values can be ['full', '1']")
 	mode := fs.String("switch-mode", "", "switch tikv into import mode or normal mode, values can be ['import', 'normal']")
+	fetchMode := fs.Bool("fetch-mode", false, "print the mode tikv was last switched to by lightning or lightning-ctl, as recorded in the checkpoints")
 
 	cpRemove := fs.String("checkpoint-remove", "", "remove the checkpoint associated with the given table (value can be 'all' or '`db`.`table`')")
 	cpErrIgnore := fs.String("checkpoint-error-ignore", "", "ignore errors encoutered previously on the given table (value can be 'all' or '`db`.`table`'); may corrupt this table if used incorrectly")
 	cpErrDestroy := fs.String("checkpoint-error-destroy", "", "deletes imported data with table which has an error before (value can be 'all' or '`db`.`table`')")
+	cpEngineRetry := fs.String("engine-retry", "", "reset the checkpoint of a single engine and clean up its importer data, so only this engine is imported again (value is '`db`.`table`:engineID')")
+	cpChunkRetry := fs.String("chunk-retry", "", "import the quarantined chunks of the given table again on the next run (value can be 'all' or '`db`.`table`')")
 	cpDump := fs.String("checkpoint-dump", "", "dump the checkpoint information as two CSV files in the given folder")
+	cleanupEngines := fs.Bool("cleanup-engines", false, "close and clean up the engines left in the importer by crashed runs, except those needed to resume from the checkpoints")
 
 	err := fs.Parse(os.Args[1:])
 	if err == nil {
@@ -60,11 +67,14 @@ func run() error {
 	ctx := context.Background()
 
 	if *compact {
-		return errors.Trace(compactCluster(ctx, cfg))
+		return errors.Trace(compactCluster(ctx, cfg, *compactLevel))
 	}
 	if len(*mode) != 0 {
 		return errors.Trace(switchMode(ctx, cfg, *mode))
 	}
+	if *fetchMode {
+		return errors.Trace(fetchTiKVMode(ctx, cfg))
+	}
 	if len(*cpRemove) != 0 {
 		return errors.Trace(checkpointRemove(ctx, cfg, *cpRemove))
 	}
@@ -74,25 +84,74 @@ func run() error {
 	if len(*cpErrDestroy) != 0 {
 		return errors.Trace(checkpointErrorDestroy(ctx, cfg, *cpErrDestroy))
 	}
+	if len(*cpEngineRetry) != 0 {
+		return errors.Trace(engineRetry(ctx, cfg, *cpEngineRetry))
+	}
+	if len(*cpChunkRetry) != 0 {
+		return errors.Trace(chunkRetry(ctx, cfg, *cpChunkRetry))
+	}
 	if len(*cpDump) != 0 {
 		return errors.Trace(checkpointDump(ctx, cfg, *cpDump))
 	}
+	if *cleanupEngines {
+		return errors.Trace(cleanupOrphanEngines(ctx, cfg))
+	}
 
 	fs.Usage()
 	return nil
 }
 
-func compactCluster(ctx context.Context, cfg *config.Config) error {
-	importer, err := kv.NewImporter(ctx, cfg.TikvImporter.Addr, cfg.TiDB.PdAddr)
+// compactProgressInterval is how often the elapsed time is printed while
+// the compaction is running.
+const compactProgressInterval = 30 * time.Second
+
+func parseCompactLevel(level string) (int32, error) {
+	switch level {
+	case "full":
+		return restore.FullLevelCompact, nil
+	case "1":
+		return restore.Level1Compact, nil
+	default:
+		return 0, errors.Errorf("invalid compact level %s, must use full or 1", level)
+	}
+}
+
+func compactCluster(ctx context.Context, cfg *config.Config, level string) error {
+	compactLevel, err := parseCompactLevel(level)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	defer importer.Close()
 
-	if err := importer.Compact(ctx, restore.FullLevelCompact); err != nil {
+	importer, err := restore.NewImporter(ctx, cfg)
+	if err != nil {
 		return errors.Trace(err)
 	}
+	defer importer.Close()
 
+	// TiKV does not report the progress of a compaction, so show that it is
+	// still running instead.
+	fmt.Printf("start %s compaction\n", level)
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(compactProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fmt.Printf("still compacting, elapsed %v\n", time.Since(start).Round(time.Second))
+			}
+		}
+	}()
+	err = importer.Compact(ctx, compactLevel)
+	close(done)
+	if err != nil {
+		return errors.Annotatef(err, "%s compaction failed after %v", level, time.Since(start).Round(time.Second))
+	}
+
+	fmt.Printf("%s compaction finished, takes %v\n", level, time.Since(start).Round(time.Second))
 	return nil
 }
 
@@ -107,7 +166,7 @@ func switchMode(ctx context.Context, cfg *config.Config, mode string) error {
 		return errors.Errorf("invalid mode %s, must use %s or %s", mode, config.ImportMode, config.NormalMode)
 	}
 
-	importer, err := kv.NewImporter(ctx, cfg.TikvImporter.Addr, cfg.TiDB.PdAddr)
+	importer, err := restore.NewImporter(ctx, cfg)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -116,9 +175,48 @@ func switchMode(ctx context.Context, cfg *config.Config, mode string) error {
 	if err := importer.SwitchMode(ctx, m); err != nil {
 		return errors.Trace(err)
 	}
+	if err := restore.RecordTiKVMode(ctx, cfg, m); err != nil {
+		fmt.Fprintf(os.Stderr, "TiKV is switched to %s mode, but the mode cannot be recorded: %v\n", mode, err)
+	}
+	fmt.Printf("TiKV is switched to %s mode\n", mode)
+	return nil
+}
+
+func fetchTiKVMode(ctx context.Context, cfg *config.Config) error {
+	if !cfg.Checkpoint.Enable {
+		return errors.New("the TiKV mode is recorded in the checkpoints, which are disabled")
+	}
+	cpdb, err := restore.OpenCheckpointsDB(ctx, cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer cpdb.Close()
+
+	record, err := restore.LoadTiKVModeRecord(ctx, cpdb)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Println(describeTiKVMode(cfg, record, time.Now()))
 	return nil
 }
 
+func describeTiKVMode(cfg *config.Config, record *restore.TiKVModeRecord, now time.Time) string {
+	if record == nil {
+		return "TiKV mode: unknown, TiKV has not been switched by lightning or lightning-ctl with these checkpoints"
+	}
+	desc := fmt.Sprintf(
+		"TiKV mode: %s (switched at %s, %v ago)",
+		record.Mode, record.SwitchedAt.Format(time.RFC3339), now.Sub(record.SwitchedAt).Round(time.Second),
+	)
+	if record.PdAddr != cfg.TiDB.PdAddr {
+		desc += fmt.Sprintf(", but the mode was switched through PD %s rather than %s", record.PdAddr, cfg.TiDB.PdAddr)
+	}
+	if record.Mode == config.ImportMode {
+		desc += "\nrun `tidb-lightning-ctl -switch-mode=normal` if no lightning is importing into the cluster"
+	}
+	return desc
+}
+
 func checkpointRemove(ctx context.Context, cfg *config.Config, tableName string) error {
 	cpdb, err := restore.OpenCheckpointsDB(ctx, cfg)
 	if err != nil {
@@ -146,13 +244,17 @@ func checkpointErrorDestroy(ctx context.Context, cfg *config.Config, tableName s
 	}
 	defer cpdb.Close()
 
-	target, err := restore.NewTiDBManager(cfg.TiDB)
+	tls, err := cfg.Security.ToTLS()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	target, err := restore.NewTiDBManager(cfg.TiDB, tls)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	defer target.Close()
 
-	importer, err := kv.NewImporter(ctx, cfg.TikvImporter.Addr, cfg.TiDB.PdAddr)
+	importer, err := restore.NewImporter(ctx, cfg)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -190,6 +292,84 @@ func checkpointErrorDestroy(ctx context.Context, cfg *config.Config, tableName s
 	return errors.Trace(lastErr)
 }
 
+func parseEngineTag(tag string) (string, int, error) {
+	index := strings.LastIndexByte(tag, ':')
+	if index < 0 {
+		return "", 0, errors.Errorf("invalid engine %s, must be in the form '`db`.`table`:engineID'", tag)
+	}
+	engineID, err := strconv.Atoi(tag[index+1:])
+	if err != nil || engineID < 0 {
+		return "", 0, errors.Errorf("invalid engine ID in %s", tag)
+	}
+	return tag[:index], engineID, nil
+}
+
+func engineRetry(ctx context.Context, cfg *config.Config, engineTag string) error {
+	tableName, engineID, err := parseEngineTag(engineTag)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	cpdb, err := restore.OpenCheckpointsDB(ctx, cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer cpdb.Close()
+
+	importer, err := restore.NewImporter(ctx, cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer importer.Close()
+
+	if err := cpdb.RetryEngineCheckpoint(ctx, tableName, engineID); err != nil {
+		return errors.Trace(err)
+	}
+
+	fmt.Fprintln(os.Stderr, "Closing and cleaning up engine:", tableName, engineID)
+	closedEngine, err := importer.UnsafeCloseEngine(ctx, tableName, engineID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(closedEngine.Cleanup(ctx))
+}
+
+func cleanupOrphanEngines(ctx context.Context, cfg *config.Config) error {
+	cpdb, err := restore.OpenCheckpointsDB(ctx, cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer cpdb.Close()
+
+	importer, err := restore.NewImporter(ctx, cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer importer.Close()
+
+	cleaned, err := restore.CleanupOrphanEngines(ctx, importer, cpdb)
+	for _, record := range cleaned {
+		fmt.Fprintf(os.Stderr, "Cleaned up engine: %s:%d (%s, opened at %v)\n", record.Table, record.EngineID, record.UUID, record.OpenedAt)
+	}
+	fmt.Fprintln(os.Stderr, "Orphan engines cleaned up:", len(cleaned))
+	return errors.Trace(err)
+}
+
+func chunkRetry(ctx context.Context, cfg *config.Config, tableName string) error {
+	cpdb, err := restore.OpenCheckpointsDB(ctx, cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer cpdb.Close()
+
+	count, err := cpdb.RetryChunkCheckpoints(ctx, tableName)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Fprintln(os.Stderr, "Chunks to be imported again:", count)
+	return nil
+}
+
 func checkpointDump(ctx context.Context, cfg *config.Config, dumpFolder string) error {
 	cpdb, err := restore.OpenCheckpointsDB(ctx, cfg)
 	if err != nil {
@@ -18,6 +18,8 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/pingcap/tidb-lightning/lightning/restore"
+
 	// ensure vendor contains it.
 	_ "github.com/pingcap/gofail/runtime"
 )
@@ -43,3 +45,15 @@ func TestRunMain(t *testing.T) {
 
 	<-waitCh
 }
+
+func TestParseCompactLevel(t *testing.T) {
+	if level, err := parseCompactLevel("full"); err != nil || level != restore.FullLevelCompact {
+		t.Fatalf("full: got %d, %v", level, err)
+	}
+	if level, err := parseCompactLevel("1"); err != nil || level != restore.Level1Compact {
+		t.Fatalf("1: got %d, %v", level, err)
+	}
+	if _, err := parseCompactLevel("2"); err == nil {
+		t.Fatal("expected error for level 2")
+	}
+}
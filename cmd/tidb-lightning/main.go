@@ -15,7 +15,6 @@ package main
 
 import (
 	"flag"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"syscall"
@@ -27,6 +26,61 @@ import (
 	plan "github.com/pingcap/tidb/planner/core"
 )
 
+// exitCodeFailed indicates the task failed for a reason not categorized.
+const exitCodeFailed = 1
+
+// exitCodeConfig indicates the config file or the command line flags are
+// invalid. Retrying is futile until they are fixed.
+const exitCodeConfig = 2
+
+// exitCodeInterrupted indicates Lightning was stopped by a signal before the
+// import is completed. The task can be resumed from the checkpoint.
+const exitCodeInterrupted = 3
+
+// exitCodeTimeout indicates the task was stopped for exceeding one of the
+// configured timeouts. The task can be resumed from the checkpoint.
+const exitCodeTimeout = 4
+
+// exitCodePreCheck indicates the pre-checks found the cluster or the data
+// source unsuitable for the task. Retrying is futile until they are fixed.
+const exitCodePreCheck = 5
+
+// exitCodeSourceData indicates the data source cannot be read or encoded.
+// Retrying is futile until the data files are fixed.
+const exitCodeSourceData = 6
+
+// exitCodeCluster indicates TiDB, PD, TiKV or tikv-importer failed. The task
+// can be retried, and resumed from the checkpoint.
+const exitCodeCluster = 7
+
+// exitCodeChecksumMismatch indicates the imported data differs from the data
+// source. The table needs to be cleaned up and imported again.
+const exitCodeChecksumMismatch = 8
+
+// exitCode returns the exit code telling the cause of the error.
+func exitCode(err error) int {
+	switch {
+	case errors.Cause(err) == common.ErrTimeout:
+		return exitCodeTimeout
+	case common.IsContextCanceledError(err):
+		return exitCodeInterrupted
+	}
+	switch common.CategoryOf(err) {
+	case common.ErrorCategoryConfig:
+		return exitCodeConfig
+	case common.ErrorCategoryPreCheck:
+		return exitCodePreCheck
+	case common.ErrorCategorySourceData:
+		return exitCodeSourceData
+	case common.ErrorCategoryCluster:
+		return exitCodeCluster
+	case common.ErrorCategoryChecksumMismatch:
+		return exitCodeChecksumMismatch
+	default:
+		return exitCodeFailed
+	}
+}
+
 func setGlobalVars() {
 	// hardcode it
 	plan.SetPreparedPlanCache(true)
@@ -42,14 +96,14 @@ func main() {
 	case flag.ErrHelp:
 		os.Exit(0)
 	default:
-		common.AppLogger.Fatalf("parse cmd flags error: %s", err)
+		common.AppLogger.Errorf("parse cmd flags error: %s", err)
+		os.Exit(exitCodeConfig)
 	}
 
 	app := lightning.New(cfg)
 
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc,
-		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
@@ -57,13 +111,36 @@ func main() {
 	go func() {
 		sig := <-sc
 		common.AppLogger.Infof("Got signal %v to exit.", sig)
-		app.Stop()
+		go app.Stop()
+
+		sig = <-sc
+		common.AppLogger.Warnf("Got signal %v again, exit immediately.", sig)
+		os.Exit(exitCodeInterrupted)
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			common.AppLogger.Info("Got signal SIGHUP, reloading the settings.")
+			if err := app.ReloadConfig(); err != nil {
+				common.AppLogger.Errorf("failed to reload the settings: %v", err)
+			}
+		}
 	}()
 
 	err = app.Run()
-	if err != nil {
-		common.AppLogger.Error("tidb lightning encountered error:", errors.ErrorStack(err))
-		os.Exit(1)
+	switch code := exitCode(err); {
+	case err == nil:
+	case code == exitCodeTimeout:
+		common.AppLogger.Errorf("tidb lightning is stopped: %v, run again to resume from the checkpoint.", err)
+		os.Exit(code)
+	case code == exitCodeInterrupted:
+		common.AppLogger.Info("tidb lightning is interrupted, run again to resume from the checkpoint.")
+		os.Exit(code)
+	default:
+		common.AppLogger.Errorf("tidb lightning encountered %s error: %s", common.CategoryOf(err), errors.ErrorStack(err))
+		os.Exit(code)
 	}
 
 	common.AppLogger.Info("tidb lightning exit.")
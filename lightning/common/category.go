@@ -0,0 +1,87 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+// ErrorCategory tells why a task failed, so that the orchestration systems can
+// tell the failures worth retrying from those needing a fix first.
+type ErrorCategory int
+
+const (
+	ErrorCategoryUnknown ErrorCategory = iota
+	// the config file or the command line flags are invalid.
+	ErrorCategoryConfig
+	// the pre-checks found the cluster or the data source unsuitable.
+	ErrorCategoryPreCheck
+	// the data source cannot be read or encoded.
+	ErrorCategorySourceData
+	// TiDB, PD, TiKV or tikv-importer failed.
+	ErrorCategoryCluster
+	// the data in TiKV differs from the data source after importing.
+	ErrorCategoryChecksumMismatch
+)
+
+func (c ErrorCategory) String() string {
+	switch c {
+	case ErrorCategoryConfig:
+		return "config"
+	case ErrorCategoryPreCheck:
+		return "pre-check"
+	case ErrorCategorySourceData:
+		return "source-data"
+	case ErrorCategoryCluster:
+		return "cluster"
+	case ErrorCategoryChecksumMismatch:
+		return "checksum-mismatch"
+	default:
+		return "unknown"
+	}
+}
+
+type categorizedError struct {
+	category ErrorCategory
+	cause    error
+}
+
+func (e *categorizedError) Error() string {
+	return e.cause.Error()
+}
+
+func (e *categorizedError) Cause() error {
+	return e.cause
+}
+
+// WithCategory attaches the category to the error. An error categorized
+// already keeps its category, which is found closer to where it happened.
+func WithCategory(err error, category ErrorCategory) error {
+	if err == nil || CategoryOf(err) != ErrorCategoryUnknown {
+		return err
+	}
+	return &categorizedError{category: category, cause: err}
+}
+
+// CategoryOf returns the category attached to the error or any error it
+// wraps.
+func CategoryOf(err error) ErrorCategory {
+	for err != nil {
+		if e, ok := err.(*categorizedError); ok {
+			return e.category
+		}
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = causer.Cause()
+	}
+	return ErrorCategoryUnknown
+}
@@ -0,0 +1,46 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+var _ = Suite(&categorySuite{})
+
+type categorySuite struct{}
+
+func (s *categorySuite) TestCategory(c *C) {
+	c.Assert(common.WithCategory(nil, common.ErrorCategoryCluster), IsNil)
+	c.Assert(common.CategoryOf(nil), Equals, common.ErrorCategoryUnknown)
+
+	cause := errors.New("bad row")
+	c.Assert(common.CategoryOf(cause), Equals, common.ErrorCategoryUnknown)
+
+	err := common.WithCategory(cause, common.ErrorCategorySourceData)
+	c.Assert(err.Error(), Equals, "bad row")
+	c.Assert(errors.Cause(err), Equals, cause)
+	c.Assert(common.CategoryOf(err), Equals, common.ErrorCategorySourceData)
+
+	// the category is found through the wrapping errors, and kept when
+	// categorized again outside.
+	err = errors.Annotate(common.RedactError(errors.Trace(err)), "failed to encode")
+	c.Assert(common.CategoryOf(err), Equals, common.ErrorCategorySourceData)
+	err = common.WithCategory(err, common.ErrorCategoryCluster)
+	c.Assert(common.CategoryOf(err), Equals, common.ErrorCategorySourceData)
+	c.Assert(common.CategoryOf(err).String(), Equals, "source-data")
+}
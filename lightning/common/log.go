@@ -16,6 +16,7 @@ package common
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"path"
 	"runtime"
 	"strings"
@@ -35,6 +36,19 @@ const (
 	defaultLogMaxSize    = 512 // MB
 )
 
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// the fields identifying what a record is about, shown as the "[table:engine]
+// [chunk]" prefix of the text format.
+const (
+	LogFieldTable  = "table"
+	LogFieldEngine = "engine"
+	LogFieldChunk  = "chunk"
+)
+
 // LogConfig serializes log related config in toml/json.
 type LogConfig struct {
 	// Log level.
@@ -47,6 +61,10 @@ type LogConfig struct {
 	FileMaxDays int `toml:"max-days" json:"max-days"`
 	// Maximum number of old log files to retain.
 	FileMaxBackups int `toml:"max-backups" json:"max-backups"`
+	// Log format, "text" or "json".
+	Format string `toml:"log-format" json:"log-format"`
+	// Error log filename receiving only the error records, leave empty to disable.
+	ErrorFile string `toml:"error-file" json:"error-file"`
 }
 
 func (cfg *LogConfig) Adjust() {
@@ -76,6 +94,27 @@ func stringToLogLevel(level string) log.Level {
 	return defaultLogLevel
 }
 
+// ParseLogLevel parses the level names accepted by `lightning.level`. An empty
+// name means the default level.
+func ParseLogLevel(level string) (log.Level, error) {
+	switch strings.ToLower(level) {
+	case "", "fatal", "error", "warn", "warning", "debug", "info":
+		return stringToLogLevel(level), nil
+	}
+	return defaultLogLevel, errors.Errorf("unknown log level %s", level)
+}
+
+// TableLogger returns the logger attaching the table to every record.
+func TableLogger(tableName string) *log.Entry {
+	return AppLogger.WithField(LogFieldTable, tableName)
+}
+
+// EngineLogger returns the logger attaching the table and the engine to every
+// record.
+func EngineLogger(tableName string, engineID int) *log.Entry {
+	return AppLogger.WithFields(log.Fields{LogFieldTable: tableName, LogFieldEngine: engineID})
+}
+
 type SimpleTextFormater struct{}
 
 func (f *SimpleTextFormater) Format(entry *log.Entry) ([]byte, error) {
@@ -92,12 +131,27 @@ func (f *SimpleTextFormater) Format(entry *log.Entry) ([]byte, error) {
 	if file, ok := entry.Data["file"]; ok {
 		fmt.Fprintf(b, "%s:%v:", file, entry.Data["line"])
 	}
-	// level + message
-	fmt.Fprintf(b, " [%s] %s", entry.Level.String(), entry.Message)
+	// level
+	fmt.Fprintf(b, " [%s] ", entry.Level.String())
+	// [table:engine] [chunk]
+	if table, ok := entry.Data[LogFieldTable]; ok {
+		fmt.Fprintf(b, "[%v", table)
+		if engine, ok := entry.Data[LogFieldEngine]; ok {
+			fmt.Fprintf(b, ":%v", engine)
+		}
+		b.WriteString("] ")
+	}
+	if chunk, ok := entry.Data[LogFieldChunk]; ok {
+		fmt.Fprintf(b, "[%v] ", chunk)
+	}
+	// message
+	b.WriteString(entry.Message)
 
 	// others
 	for k, v := range entry.Data {
-		if k != "file" && k != "line" {
+		switch k {
+		case "file", "line", LogFieldTable, LogFieldEngine, LogFieldChunk:
+		default:
 			fmt.Fprintf(b, " %v=%v", k, v)
 		}
 	}
@@ -134,6 +188,27 @@ func (hook *contextHook) Fire(entry *log.Entry) error {
 	return nil
 }
 
+// errorFileHook copies the error records into a separate file.
+type errorFileHook struct {
+	out       io.Writer
+	formatter log.Formatter
+}
+
+// Levels implements logrus.Hook interface.
+func (hook *errorFileHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+// Fire implements logrus.Hook interface.
+func (hook *errorFileHook) Fire(entry *log.Entry) error {
+	b, err := hook.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	_, err = hook.out.Write(b)
+	return err
+}
+
 func isSkippedPackageName(name string) bool {
 	return strings.Contains(name, "github.com/sirupsen/logrus") ||
 		strings.Contains(name, "github.com/coreos/pkg/capnslog")
@@ -150,28 +225,58 @@ func GetLevel() (level log.Level) {
 	return log.Level(atomic.LoadUint32((*uint32)(&AppLogger.Level)))
 }
 
+// NewLogFormatter creates the formatter of the log format.
+func NewLogFormatter(format string) (log.Formatter, error) {
+	switch strings.ToLower(format) {
+	case "", LogFormatText:
+		return &SimpleTextFormater{}, nil
+	case LogFormatJSON:
+		return &log.JSONFormatter{TimestampFormat: defaultLogTimeFormat}, nil
+	default:
+		return nil, errors.Errorf("unknown log format %s", format)
+	}
+}
+
+// newLogFile opens the log file, which is rotated by size.
+func newLogFile(cfg *LogConfig, filename string) (io.Writer, error) {
+	if IsDirExists(filename) {
+		return nil, errors.Errorf("can't use directory as log file name : %s", filename)
+	}
+	// use lumberjack to logrotate
+	return &lumberjack.Logger{
+		Filename:   filename,
+		MaxAge:     cfg.FileMaxDays,
+		MaxSize:    cfg.FileMaxSize,
+		MaxBackups: cfg.FileMaxBackups,
+		LocalTime:  true,
+	}, nil
+}
+
 func InitLogger(cfg *LogConfig, tidbLoglevel string) error {
+	formatter, err := NewLogFormatter(cfg.Format)
+	if err != nil {
+		return errors.Trace(err)
+	}
 	SetLevel(stringToLogLevel(cfg.Level))
 	AppLogger.Hooks.Add(&contextHook{})
-	AppLogger.Formatter = &SimpleTextFormater{}
+	AppLogger.Formatter = formatter
 
 	logutil.InitLogger(&logutil.LogConfig{Level: tidbLoglevel})
 
 	if len(cfg.File) > 0 {
-		if IsDirExists(cfg.File) {
-			return errors.Errorf("can't use directory as log file name : %s", cfg.File)
+		output, err := newLogFile(cfg, cfg.File)
+		if err != nil {
+			return errors.Trace(err)
 		}
+		AppLogger.Out = output
+	}
 
-		// use lumberjack to logrotate
-		output := &lumberjack.Logger{
-			Filename:   cfg.File,
-			MaxAge:     cfg.FileMaxDays,
-			MaxSize:    cfg.FileMaxSize,
-			MaxBackups: cfg.FileMaxBackups,
-			LocalTime:  true,
+	if len(cfg.ErrorFile) > 0 {
+		output, err := newLogFile(cfg, cfg.ErrorFile)
+		if err != nil {
+			return errors.Trace(err)
 		}
-
-		AppLogger.Out = output
+		AppLogger.Hooks.Add(&errorFileHook{out: output, formatter: formatter})
 	}
 
 	return nil
@@ -0,0 +1,77 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	. "github.com/pingcap/check"
+	log "github.com/sirupsen/logrus"
+)
+
+var _ = Suite(&logSuite{})
+
+type logSuite struct{}
+
+func (s *logSuite) TestTextFormatPrefix(c *C) {
+	logger := log.New()
+	entry := log.NewEntry(logger).WithFields(log.Fields{
+		LogFieldTable:  "`db`.`t`",
+		LogFieldEngine: 1,
+		LogFieldChunk:  "`db`.`t`.1.sql:0",
+		"rows":         10,
+	})
+	entry.Level = log.InfoLevel
+	entry.Message = "restore chunk"
+
+	b, err := (&SimpleTextFormater{}).Format(entry)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Matches, `.* \[info\] \[`+"`db`.`t`"+`:1\] \[`+"`db`.`t`"+`\.1\.sql:0\] restore chunk rows=10\n`)
+}
+
+func (s *logSuite) TestNewLogFormatter(c *C) {
+	formatter, err := NewLogFormatter("")
+	c.Assert(err, IsNil)
+	c.Assert(formatter, FitsTypeOf, &SimpleTextFormater{})
+
+	formatter, err = NewLogFormatter(LogFormatJSON)
+	c.Assert(err, IsNil)
+	entry := log.NewEntry(log.New()).WithField(LogFieldTable, "`db`.`t`")
+	entry.Message = "hello"
+	b, err := formatter.Format(entry)
+	c.Assert(err, IsNil)
+	var record map[string]interface{}
+	c.Assert(json.Unmarshal(b, &record), IsNil)
+	c.Assert(record[LogFieldTable], Equals, "`db`.`t`")
+	c.Assert(record["msg"], Equals, "hello")
+
+	_, err = NewLogFormatter("xml")
+	c.Assert(err, ErrorMatches, "unknown log format xml")
+}
+
+func (s *logSuite) TestErrorFileHook(c *C) {
+	var out, errOut bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	logger.Formatter = &SimpleTextFormater{}
+	logger.Hooks.Add(&errorFileHook{out: &errOut, formatter: logger.Formatter})
+
+	logger.Info("info record")
+	logger.WithField(LogFieldTable, "`db`.`t`").Error("error record")
+
+	c.Assert(strings.Count(out.String(), "\n"), Equals, 2)
+	c.Assert(errOut.String(), Matches, ".*\\[error\\] \\[`db`.`t`\\] error record\n")
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"sync"
+)
+
+// Pauser is a gate which blocks goroutines calling Wait() while it is paused.
+//
+// The zero value is ready for use, and is not paused.
+type Pauser struct {
+	lock    sync.Mutex
+	resumed chan struct{} // non-nil while paused, closed on resume
+}
+
+// Pause closes the gate. Subsequent calls to Wait() will block until Resume()
+// is called.
+func (p *Pauser) Pause() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.resumed == nil {
+		p.resumed = make(chan struct{})
+	}
+}
+
+// Resume opens the gate, waking up all goroutines blocked in Wait().
+func (p *Pauser) Resume() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+	}
+}
+
+// IsPaused returns whether the gate is currently closed.
+func (p *Pauser) IsPaused() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.resumed != nil
+}
+
+// Wait blocks until the gate is opened or the context is canceled.
+func (p *Pauser) Wait(ctx context.Context) error {
+	p.lock.Lock()
+	resumed := p.resumed
+	p.lock.Unlock()
+
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
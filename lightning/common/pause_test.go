@@ -0,0 +1,65 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+var _ = Suite(&pauseSuite{})
+
+type pauseSuite struct{}
+
+func (s *pauseSuite) TestPauseAndResume(c *C) {
+	var p common.Pauser
+	ctx := context.Background()
+
+	c.Assert(p.IsPaused(), IsFalse)
+	c.Assert(p.Wait(ctx), IsNil)
+
+	p.Pause()
+	p.Pause()
+	c.Assert(p.IsPaused(), IsTrue)
+
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- p.Wait(ctx)
+		}()
+	}
+	select {
+	case <-done:
+		c.Fatal("Wait() returned while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.Resume()
+	c.Assert(<-done, IsNil)
+	c.Assert(<-done, IsNil)
+	c.Assert(p.IsPaused(), IsFalse)
+	p.Resume()
+}
+
+func (s *pauseSuite) TestWaitCanceled(c *C) {
+	var p common.Pauser
+	p.Pause()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(p.Wait(ctx), Equals, context.Canceled)
+}
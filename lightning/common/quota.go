@@ -0,0 +1,106 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"sync"
+)
+
+// Quota accounts the number of bytes buffered, e.g. on disk or in memory, and
+// blocks goroutines calling Wait() while the usage has reached the limit.
+//
+// The zero value is ready for use, and has no limit.
+type Quota struct {
+	lock     sync.Mutex
+	limit    int64
+	used     int64
+	released chan struct{} // non-nil while someone is waiting, closed on release
+}
+
+// SetLimit changes the maximum number of bytes allowed. A non-positive limit
+// means unlimited.
+func (q *Quota) SetLimit(limit int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.limit = limit
+	q.wakeUp()
+}
+
+// Consume records that `size` more bytes are buffered.
+func (q *Quota) Consume(size int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.used += size
+}
+
+// Release records that `size` bytes are no longer buffered, waking up all
+// goroutines blocked in Wait().
+func (q *Quota) Release(size int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.used -= size
+	if q.used < 0 {
+		q.used = 0
+	}
+	q.wakeUp()
+}
+
+func (q *Quota) wakeUp() {
+	if q.released != nil {
+		close(q.released)
+		q.released = nil
+	}
+}
+
+// Used returns the number of bytes currently buffered.
+func (q *Quota) Used() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.used
+}
+
+// Exceeded returns whether the usage has reached the limit.
+func (q *Quota) Exceeded() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.exceeded()
+}
+
+func (q *Quota) exceeded() bool {
+	return q.limit > 0 && q.used >= q.limit
+}
+
+// Wait blocks until the usage drops below the limit or the context is
+// canceled.
+func (q *Quota) Wait(ctx context.Context) error {
+	for {
+		q.lock.Lock()
+		if !q.exceeded() {
+			q.lock.Unlock()
+			return nil
+		}
+		if q.released == nil {
+			q.released = make(chan struct{})
+		}
+		released := q.released
+		q.lock.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
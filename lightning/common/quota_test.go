@@ -0,0 +1,72 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+var _ = Suite(&quotaSuite{})
+
+type quotaSuite struct{}
+
+func (s *quotaSuite) TestUnlimited(c *C) {
+	var q common.Quota
+	q.Consume(1 << 40)
+	c.Assert(q.Exceeded(), IsFalse)
+	c.Assert(q.Wait(context.Background()), IsNil)
+}
+
+func (s *quotaSuite) TestWaitUntilReleased(c *C) {
+	var q common.Quota
+	q.SetLimit(100)
+	ctx := context.Background()
+
+	q.Consume(60)
+	c.Assert(q.Wait(ctx), IsNil)
+	q.Consume(60)
+	c.Assert(q.Used(), Equals, int64(120))
+	c.Assert(q.Exceeded(), IsTrue)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Wait(ctx)
+	}()
+
+	// still above the limit after releasing a little.
+	q.Release(10)
+	select {
+	case <-done:
+		c.Fatal("Wait() returned while the quota is exceeded")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.Release(60)
+	c.Assert(<-done, IsNil)
+	c.Assert(q.Used(), Equals, int64(50))
+}
+
+func (s *quotaSuite) TestWaitCanceled(c *C) {
+	var q common.Quota
+	q.SetLimit(1)
+	q.Consume(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(q.Wait(ctx), Equals, context.Canceled)
+}
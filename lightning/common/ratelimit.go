@@ -0,0 +1,108 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting the throughput to a number of bytes
+// per second, allowing bursts of up to one second worth of bytes.
+//
+// A nil *RateLimiter, or one with a zero rate, never blocks.
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter allowing `rate` bytes per second. Returns
+// nil (i.e. unlimited) if the rate is not positive.
+func NewRateLimiter(rate int64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// SetRate changes the limit to `rate` bytes per second, or unlimited if the
+// rate is not positive. It can be called while the limiter is in use.
+func (l *RateLimiter) SetRate(rate int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if rate <= 0 {
+		l.rate = 0
+		return
+	}
+	if l.rate == 0 {
+		// starts with a full bucket, the same as NewRateLimiter.
+		l.tokens = float64(rate)
+		l.last = time.Now()
+	}
+	l.rate = float64(rate)
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+}
+
+// reserve takes `n` bytes from the bucket, and returns how long the caller
+// needs to wait before these bytes are available. The bucket may go into debt,
+// so that a request larger than the burst size can still be fulfilled.
+func (l *RateLimiter) reserve(n int64, now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.rate == 0 {
+		return 0
+	}
+
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WaitN blocks until `n` bytes can be sent, or the context is canceled.
+func (l *RateLimiter) WaitN(ctx context.Context, n int64) error {
+	if l == nil {
+		return nil
+	}
+	delay := l.reserve(n, time.Now())
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
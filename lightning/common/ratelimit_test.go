@@ -0,0 +1,71 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"time"
+
+	. "github.com/pingcap/check"
+)
+
+var _ = Suite(&rateLimitSuite{})
+
+type rateLimitSuite struct{}
+
+func (s *rateLimitSuite) TestUnlimited(c *C) {
+	l := NewRateLimiter(0)
+	c.Assert(l, IsNil)
+	c.Assert(l.WaitN(context.Background(), 1<<40), IsNil)
+}
+
+func (s *rateLimitSuite) TestReserve(c *C) {
+	l := NewRateLimiter(1000)
+	now := l.last
+
+	// the first second worth of bytes is available immediately.
+	c.Assert(l.reserve(600, now), Equals, time.Duration(0))
+	c.Assert(l.reserve(400, now), Equals, time.Duration(0))
+	// then the bucket goes into debt.
+	c.Assert(l.reserve(500, now), Equals, 500*time.Millisecond)
+	// tokens are refilled over time.
+	c.Assert(l.reserve(1000, now.Add(time.Second)), Equals, 500*time.Millisecond)
+	// but never exceeding the burst size.
+	c.Assert(l.reserve(1000, now.Add(10*time.Second)), Equals, time.Duration(0))
+}
+
+func (s *rateLimitSuite) TestSetRate(c *C) {
+	var l RateLimiter
+	c.Assert(l.reserve(1<<40, time.Now()), Equals, time.Duration(0))
+
+	l.SetRate(1000)
+	now := l.last
+	c.Assert(l.reserve(1000, now), Equals, time.Duration(0))
+	c.Assert(l.reserve(500, now), Equals, 500*time.Millisecond)
+
+	// lowering the rate keeps the debt, which takes longer to repay.
+	l.SetRate(100)
+	c.Assert(l.reserve(100, now), Equals, 6*time.Second)
+
+	l.SetRate(0)
+	c.Assert(l.reserve(1<<40, now), Equals, time.Duration(0))
+}
+
+func (s *rateLimitSuite) TestWaitCanceled(c *C) {
+	l := NewRateLimiter(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(l.WaitN(ctx, 1), IsNil)
+	c.Assert(l.WaitN(ctx, 100), Equals, context.Canceled)
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/pingcap/errors"
+)
+
+// RetryPolicy controls how operations failed with a retryable error (see
+// IsRetryableError) are retried.
+type RetryPolicy struct {
+	// Count is the number of retries after the first attempt failed.
+	Count int
+	// Backoff is the time to wait before every retry.
+	Backoff time.Duration
+	// RetryableErrors are the patterns of the error messages which are
+	// retried in addition to those IsRetryableError recognizes.
+	RetryableErrors []*regexp.Regexp
+}
+
+var retryPolicy = RetryPolicy{
+	Count:   defaultMaxRetry - 1,
+	Backoff: retryTimeout,
+}
+
+// SetRetryPolicy changes the policy used by Retry and all the *WithRetry
+// functions. It should be called before any operation starts.
+func SetRetryPolicy(policy RetryPolicy) {
+	retryPolicy = policy
+}
+
+// CompileRetryableErrors compiles the patterns of RetryPolicy.RetryableErrors.
+func CompileRetryableErrors(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Annotatef(err, "invalid pattern %q", pattern)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// Retry executes the action until it succeeds, fails with a non-retryable
+// error, or the retry count is exhausted. The purpose is used for logging.
+func Retry(ctx context.Context, purpose string, action func() error) error {
+	policy := retryPolicy
+
+	var err error
+	for i := 0; i <= policy.Count; i++ {
+		if i > 0 {
+			AppLogger.Warnf("%s retry %d after %v, err %v", purpose, i, policy.Backoff, RedactError(err))
+			select {
+			case <-time.After(policy.Backoff):
+			case <-ctx.Done():
+				return errors.Trace(ctx.Err())
+			}
+		}
+
+		err = action()
+		if !IsRetryableError(err) {
+			return errors.Trace(err)
+		}
+	}
+
+	return errors.Annotatef(err, "%s failed after %d retries", purpose, policy.Count)
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+var _ = Suite(&retrySuite{})
+
+type retrySuite struct{}
+
+func (s *retrySuite) SetUpSuite(c *C) {
+	common.SetRetryPolicy(common.RetryPolicy{Count: 2, Backoff: time.Millisecond})
+}
+
+func (s *retrySuite) TearDownSuite(c *C) {
+	common.SetRetryPolicy(common.RetryPolicy{Count: 2, Backoff: 3 * time.Second})
+}
+
+func (s *retrySuite) TestRetry(c *C) {
+	ctx := context.Background()
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+
+	// succeeds after a transient error.
+	attempts := 0
+	err := common.Retry(ctx, "test", func() error {
+		attempts++
+		if attempts == 1 {
+			return unavailable
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(attempts, Equals, 2)
+
+	// the retry count is exhausted.
+	attempts = 0
+	err = common.Retry(ctx, "test", func() error {
+		attempts++
+		return unavailable
+	})
+	c.Assert(err, ErrorMatches, "test failed after 2 retries: .*connection refused")
+	c.Assert(errors.Cause(err), Equals, unavailable)
+	c.Assert(attempts, Equals, 3)
+
+	// irrecoverable errors are not retried.
+	attempts = 0
+	err = common.Retry(ctx, "test", func() error {
+		attempts++
+		return context.Canceled
+	})
+	c.Assert(errors.Cause(err), Equals, context.Canceled)
+	c.Assert(attempts, Equals, 1)
+}
+
+func (s *retrySuite) TestRetryCanceled(c *C) {
+	common.SetRetryPolicy(common.RetryPolicy{Count: 2, Backoff: time.Hour})
+	defer common.SetRetryPolicy(common.RetryPolicy{Count: 2, Backoff: time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := common.Retry(ctx, "test", func() error {
+		attempts++
+		cancel()
+		return status.Error(codes.DeadlineExceeded, "timed out")
+	})
+	c.Assert(errors.Cause(err), Equals, context.Canceled)
+	c.Assert(attempts, Equals, 1)
+}
+
+func (s *retrySuite) TestRetryDDLConflict(c *C) {
+	// the statements conflicting with the concurrent DDL jobs are retried.
+	attempts := 0
+	err := common.Retry(context.Background(), "create table", func() error {
+		attempts++
+		if attempts == 1 {
+			return &mysql.MySQLError{Number: 8028, Message: "Information schema is changed."}
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(attempts, Equals, 2)
+
+	c.Assert(common.IsRetryableError(&mysql.MySQLError{Number: 8027}), IsTrue)
+	c.Assert(common.IsRetryableError(&mysql.MySQLError{Number: 1050}), IsFalse)
+	c.Assert(common.IsRetryableError(errors.Annotate(mysql.ErrInvalidConn, "checksum")), IsTrue)
+}
+
+func (s *retrySuite) TestRetryRegionErrors(c *C) {
+	// the regions changed while ingesting or executing.
+	c.Assert(common.IsRetryableError(status.Error(codes.Internal, "ImportJobFailed: EpochNotMatch current epoch of region 2 is conf_ver: 1 version: 3")), IsTrue)
+	c.Assert(common.IsRetryableError(status.Error(codes.Internal, "stale_epoch {}")), IsTrue)
+	c.Assert(common.IsRetryableError(status.Error(codes.FailedPrecondition, "not leader")), IsTrue)
+	c.Assert(common.IsRetryableError(&mysql.MySQLError{Number: 1105, Message: "region epoch not match"}), IsTrue)
+	c.Assert(common.IsRetryableError(&mysql.MySQLError{Number: 8004, Message: "StaleEpoch"}), IsTrue)
+
+	c.Assert(common.IsRetryableError(status.Error(codes.Internal, "corrupted SST file")), IsFalse)
+	c.Assert(common.IsRetryableError(status.Error(codes.Canceled, "epoch not match")), IsFalse)
+}
+
+func (s *retrySuite) TestRetryableErrors(c *C) {
+	conflict := &mysql.MySQLError{Number: 9007, Message: "Write conflict, txnStartTS=1"}
+	c.Assert(common.IsRetryableError(conflict), IsFalse)
+
+	patterns, err := common.CompileRetryableErrors([]string{"(?i)write conflict"})
+	c.Assert(err, IsNil)
+	common.SetRetryPolicy(common.RetryPolicy{Count: 2, Backoff: time.Millisecond, RetryableErrors: patterns})
+	defer common.SetRetryPolicy(common.RetryPolicy{Count: 2, Backoff: time.Millisecond})
+
+	c.Assert(common.IsRetryableError(errors.Annotate(conflict, "checksum")), IsTrue)
+	c.Assert(common.IsRetryableError(&mysql.MySQLError{Number: 1050, Message: "Table exists"}), IsFalse)
+	c.Assert(common.IsRetryableError(nil), IsFalse)
+
+	attempts := 0
+	err = common.Retry(context.Background(), "test", func() error {
+		attempts++
+		if attempts == 1 {
+			return conflict
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(attempts, Equals, 2)
+
+	_, err = common.CompileRetryableErrors([]string{"("})
+	c.Assert(err, ErrorMatches, `invalid pattern "\(".*`)
+}
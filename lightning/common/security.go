@@ -0,0 +1,139 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	pd "github.com/pingcap/pd/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// MySQLTLSConfigName is the name of the TLS config registered into the MySQL
+// driver by NewTLS, to be used as the `tls` parameter of the DSN.
+const MySQLTLSConfigName = "cluster"
+
+// TLS is the TLS configuration used to connect to the cluster, i.e. TiDB, PD,
+// TiKV and tikv-importer. Without a CA, the connections are in plain text.
+type TLS struct {
+	caPath   string
+	certPath string
+	keyPath  string
+	inner    *tls.Config
+	client   *http.Client
+}
+
+// NewTLS loads the CA, and optionally the client certificate and key, from the
+// given paths. If the CA path is empty, a TLS object with plain text
+// connections is returned.
+func NewTLS(caPath, certPath, keyPath string) (*TLS, error) {
+	if len(caPath) == 0 {
+		return &TLS{client: &http.Client{}}, nil
+	}
+
+	ca, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, errors.Annotatef(err, "could not read CA certificate %s", caPath)
+	}
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(ca) {
+		return nil, errors.Errorf("failed to append CA certificate %s", caPath)
+	}
+	inner := &tls.Config{RootCAs: certPool}
+
+	if len(certPath) != 0 || len(keyPath) != 0 {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, errors.Annotatef(err, "could not load client key pair %s, %s", certPath, keyPath)
+		}
+		inner.Certificates = []tls.Certificate{cert}
+	}
+
+	if err := mysql.RegisterTLSConfig(MySQLTLSConfigName, inner); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &TLS{
+		caPath:   caPath,
+		certPath: certPath,
+		keyPath:  keyPath,
+		inner:    inner,
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: inner},
+		},
+	}, nil
+}
+
+// Enabled returns whether the connections are secured by TLS.
+func (tc *TLS) Enabled() bool {
+	return tc.inner != nil
+}
+
+// TLSConfig returns the client TLS config, or nil if TLS is not enabled.
+func (tc *TLS) TLSConfig() *tls.Config {
+	return tc.inner
+}
+
+// ServerTLSConfig returns the TLS config of the status server of Lightning,
+// which presents the client certificate of Lightning, and only accepts the
+// clients presenting a certificate signed by the CA. It returns nil if TLS is
+// not enabled or there is no certificate.
+func (tc *TLS) ServerTLSConfig() *tls.Config {
+	if tc.inner == nil || len(tc.inner.Certificates) == 0 {
+		return nil
+	}
+	return &tls.Config{
+		Certificates: tc.inner.Certificates,
+		ClientCAs:    tc.inner.RootCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+// HTTPClient returns the HTTP client for the status APIs of TiDB and PD.
+func (tc *TLS) HTTPClient() *http.Client {
+	return tc.client
+}
+
+// URL returns the URL of the path on the HTTP server at `host`, with the scheme
+// being https if TLS is enabled.
+func (tc *TLS) URL(host string, path string) string {
+	if tc.Enabled() {
+		return fmt.Sprintf("https://%s%s", host, path)
+	}
+	return fmt.Sprintf("http://%s%s", host, path)
+}
+
+// ToGRPCDialOption returns the dial option for the gRPC connections.
+func (tc *TLS) ToGRPCDialOption() grpc.DialOption {
+	if tc.Enabled() {
+		return grpc.WithTransportCredentials(credentials.NewTLS(tc.inner))
+	}
+	return grpc.WithInsecure()
+}
+
+// ToPDSecurityOption returns the security option for the PD client.
+func (tc *TLS) ToPDSecurityOption() pd.SecurityOption {
+	return pd.SecurityOption{
+		CAPath:   tc.caPath,
+		CertPath: tc.certPath,
+		KeyPath:  tc.keyPath,
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/pingcap/check"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+var _ = Suite(&securitySuite{})
+
+type securitySuite struct{}
+
+func (s *securitySuite) TestPlainText(c *C) {
+	tls, err := common.NewTLS("", "", "")
+	c.Assert(err, IsNil)
+	c.Assert(tls.Enabled(), IsFalse)
+	c.Assert(tls.TLSConfig(), IsNil)
+	c.Assert(tls.ServerTLSConfig(), IsNil)
+	c.Assert(tls.URL("127.0.0.1:2379", "/pd/api/v1/stores"), Equals, "http://127.0.0.1:2379/pd/api/v1/stores")
+}
+
+func (s *securitySuite) TestHTTPS(c *C) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"version": "v3.0.0"}`))
+	}))
+	defer server.Close()
+
+	caPath := filepath.Join(c.MkDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	c.Assert(ioutil.WriteFile(caPath, ca, 0644), IsNil)
+
+	tls, err := common.NewTLS(caPath, "", "")
+	c.Assert(err, IsNil)
+	c.Assert(tls.Enabled(), IsTrue)
+	// the status server cannot use TLS without a certificate.
+	c.Assert(tls.ServerTLSConfig(), IsNil)
+
+	url := tls.URL(strings.TrimPrefix(server.URL, "https://"), "/status")
+	c.Assert(url, Equals, server.URL+"/status")
+	var status struct {
+		Version string `json:"version"`
+	}
+	c.Assert(common.GetJSON(tls.HTTPClient(), url, &status), IsNil)
+	c.Assert(status.Version, Equals, "v3.0.0")
+}
+
+// writeSelfSignedCert writes a certificate of 127.0.0.1 which is its own CA.
+func writeSelfSignedCert(c *C, dir string) (certPath string, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "lightning"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+
+	certPath = filepath.Join(dir, "cert.pem")
+	keyPath = filepath.Join(dir, "key.pem")
+	c.Assert(ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), IsNil)
+	return certPath, keyPath
+}
+
+func (s *securitySuite) TestServerTLS(c *C) {
+	certPath, keyPath := writeSelfSignedCert(c, c.MkDir())
+	tls, err := common.NewTLS(certPath, certPath, keyPath)
+	c.Assert(err, IsNil)
+	c.Assert(tls.ServerTLSConfig(), NotNil)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"version": "v3.0.0"}`))
+	}))
+	server.TLS = tls.ServerTLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	var status struct {
+		Version string `json:"version"`
+	}
+	c.Assert(common.GetJSON(tls.HTTPClient(), server.URL, &status), IsNil)
+	c.Assert(status.Version, Equals, "v3.0.0")
+
+	// the clients without a certificate are rejected.
+	noCertTLS, err := common.NewTLS(certPath, "", "")
+	c.Assert(err, IsNil)
+	c.Assert(common.GetJSON(noCertTLS.HTTPClient(), server.URL, &status), NotNil)
+}
+
+func (s *securitySuite) TestInvalidCertificates(c *C) {
+	dir := c.MkDir()
+	_, err := common.NewTLS(filepath.Join(dir, "missing.pem"), "", "")
+	c.Assert(err, ErrorMatches, "could not read CA certificate .*missing.pem.*")
+
+	caPath := filepath.Join(dir, "ca.pem")
+	c.Assert(ioutil.WriteFile(caPath, []byte("not a certificate"), 0644), IsNil)
+	_, err = common.NewTLS(caPath, "", "")
+	c.Assert(err, ErrorMatches, "failed to append CA certificate .*")
+}
@@ -0,0 +1,305 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/uber/jaeger-client-go"
+	jaegerthrift "github.com/uber/jaeger-client-go/thrift-gen/jaeger"
+)
+
+const (
+	otlpFlushInterval = time.Second
+	otlpMaxBatchSize  = 512
+	// the spans are dropped when the collector falls behind this much.
+	otlpMaxQueueSize = 8192
+
+	otlpSpanKindInternal = 1
+	otlpStatusCodeError  = 2
+)
+
+// The JSON encoding of the ExportTraceServiceRequest of OTLP/HTTP. The 64-bit
+// integers are strings, and the IDs are hex strings.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    string   `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BytesValue  []byte   `json:"bytesValue,omitempty"`
+}
+
+func otlpAttributes(tags []*jaegerthrift.Tag) []otlpKeyValue {
+	attrs := make([]otlpKeyValue, 0, len(tags))
+	for _, tag := range tags {
+		kv := otlpKeyValue{Key: tag.Key}
+		switch tag.VType {
+		case jaegerthrift.TagType_STRING:
+			kv.Value.StringValue = tag.VStr
+		case jaegerthrift.TagType_BOOL:
+			kv.Value.BoolValue = tag.VBool
+		case jaegerthrift.TagType_LONG:
+			if tag.VLong != nil {
+				kv.Value.IntValue = strconv.FormatInt(*tag.VLong, 10)
+			}
+		case jaegerthrift.TagType_DOUBLE:
+			kv.Value.DoubleValue = tag.VDouble
+		case jaegerthrift.TagType_BINARY:
+			kv.Value.BytesValue = tag.VBinary
+		}
+		attrs = append(attrs, kv)
+	}
+	return attrs
+}
+
+func microsToNanos(micros int64) string {
+	return strconv.FormatInt(micros*int64(time.Microsecond), 10)
+}
+
+// toOTLPSpan converts the finished span, which is in microseconds.
+func toOTLPSpan(span *jaegerthrift.Span) otlpSpan {
+	s := otlpSpan{
+		TraceID:           fmt.Sprintf("%016x%016x", uint64(span.TraceIdHigh), uint64(span.TraceIdLow)),
+		SpanID:            fmt.Sprintf("%016x", uint64(span.SpanId)),
+		Name:              span.OperationName,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: microsToNanos(span.StartTime),
+		EndTimeUnixNano:   microsToNanos(span.StartTime + span.Duration),
+		Attributes:        otlpAttributes(span.Tags),
+	}
+	if span.ParentSpanId != 0 {
+		s.ParentSpanID = fmt.Sprintf("%016x", uint64(span.ParentSpanId))
+	}
+	for _, tag := range span.Tags {
+		if tag.Key == "error" && tag.VBool != nil && *tag.VBool {
+			s.Status = &otlpStatus{Code: otlpStatusCodeError}
+		}
+	}
+	for _, log := range span.Logs {
+		event := otlpEvent{
+			TimeUnixNano: microsToNanos(log.Timestamp),
+			Name:         "log",
+			Attributes:   otlpAttributes(log.Fields),
+		}
+		for _, field := range log.Fields {
+			if field.VStr == nil {
+				continue
+			}
+			switch field.Key {
+			case "event":
+				event.Name = *field.VStr
+			case "error":
+				if s.Status != nil {
+					s.Status.Message = *field.VStr
+				}
+			}
+		}
+		s.Events = append(s.Events, event)
+	}
+	return s
+}
+
+// OTLPReporter is a reporter of the Jaeger tracer, which exports the finished
+// spans to an OpenTelemetry collector in batches, in the JSON encoding of
+// OTLP/HTTP.
+type OTLPReporter struct {
+	url         string
+	client      *http.Client
+	serviceName string
+
+	mu       sync.Mutex
+	resource []otlpKeyValue
+	spans    []otlpSpan
+	dropped  int
+
+	flushCh chan struct{}
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewOTLPReporter creates a reporter sending to the OTLP/HTTP endpoint, e.g.
+// "http://127.0.0.1:4318".
+func NewOTLPReporter(endpoint string, serviceName string) *OTLPReporter {
+	r := &OTLPReporter{
+		url:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client:      &http.Client{Timeout: 10 * time.Second},
+		serviceName: serviceName,
+		flushCh:     make(chan struct{}, 1),
+		closeCh:     make(chan struct{}),
+	}
+	r.wg.Add(1)
+	go r.run()
+	return r
+}
+
+// Report implements jaeger.Reporter.
+func (r *OTLPReporter) Report(span *jaeger.Span) {
+	s := toOTLPSpan(jaeger.BuildJaegerThrift(span))
+
+	r.mu.Lock()
+	if r.resource == nil {
+		process := jaeger.BuildJaegerProcessThrift(span)
+		serviceName := process.ServiceName
+		r.resource = append([]otlpKeyValue{{Key: "service.name", Value: otlpAnyValue{StringValue: &serviceName}}}, otlpAttributes(process.Tags)...)
+	}
+	if len(r.spans) >= otlpMaxQueueSize {
+		r.dropped++
+	} else {
+		r.spans = append(r.spans, s)
+	}
+	full := len(r.spans) >= otlpMaxBatchSize
+	r.mu.Unlock()
+
+	if full {
+		select {
+		case r.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close implements jaeger.Reporter. The pending spans are sent before
+// returning.
+func (r *OTLPReporter) Close() {
+	close(r.closeCh)
+	r.wg.Wait()
+}
+
+func (r *OTLPReporter) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.flushCh:
+		case <-r.closeCh:
+			r.flush()
+			return
+		}
+		r.flush()
+	}
+}
+
+// flush sends the pending spans. They are dropped if the collector cannot
+// receive them, so the restore is not blocked by tracing.
+func (r *OTLPReporter) flush() {
+	r.mu.Lock()
+	spans := r.spans
+	r.spans = nil
+	resource := r.resource
+	dropped := r.dropped
+	r.dropped = 0
+	r.mu.Unlock()
+
+	if dropped > 0 {
+		AppLogger.Warnf("[tracing] dropped %d spans, the collector is too slow", dropped)
+	}
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > otlpMaxBatchSize {
+			n = otlpMaxBatchSize
+		}
+		if err := r.export(resource, spans[:n]); err != nil {
+			AppLogger.Warnf("[tracing] cannot export %d spans: %v", n, err)
+		}
+		spans = spans[n:]
+	}
+}
+
+func (r *OTLPReporter) export(resource []otlpKeyValue, spans []otlpSpan) error {
+	body, err := json.Marshal(otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: resource},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: r.serviceName},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	resp, err := r.client.Post(r.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("collector returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
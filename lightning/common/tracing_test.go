@@ -0,0 +1,113 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/uber/jaeger-client-go"
+)
+
+var _ = Suite(&tracingSuite{})
+
+type tracingSuite struct{}
+
+func (s *tracingSuite) TestOTLPReporter(c *C) {
+	var mu sync.Mutex
+	var requests []otlpTraces
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(req.URL.Path, Equals, "/v1/traces")
+		c.Assert(req.Header.Get("Content-Type"), Equals, "application/json")
+		var traces otlpTraces
+		c.Assert(json.NewDecoder(req.Body).Decode(&traces), IsNil)
+		mu.Lock()
+		requests = append(requests, traces)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	reporter := NewOTLPReporter(server.URL+"/", "lightning-test")
+	tracer, closer := jaeger.NewTracer("lightning-test", jaeger.NewConstSampler(true), reporter)
+
+	start := time.Unix(1500000000, 0)
+	parent := tracer.StartSpan("table", opentracing.StartTime(start), opentracing.Tags{"table": "`db`.`t`"})
+	child := tracer.StartSpan("chunk", opentracing.ChildOf(parent.Context()), opentracing.StartTime(start.Add(time.Second)), opentracing.Tags{
+		"rows":    5,
+		"seconds": 1.5,
+	})
+	ext.Error.Set(child, true)
+	child.LogFields(tracelog.Error(errors.New("oops")))
+	child.FinishWithOptions(opentracing.FinishOptions{FinishTime: start.Add(2 * time.Second)})
+	parent.FinishWithOptions(opentracing.FinishOptions{FinishTime: start.Add(3 * time.Second)})
+	// sends the pending spans.
+	c.Assert(closer.Close(), IsNil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(requests, HasLen, 1)
+	c.Assert(requests[0].ResourceSpans, HasLen, 1)
+	resourceSpans := requests[0].ResourceSpans[0]
+	c.Assert(resourceSpans.Resource.Attributes[0].Key, Equals, "service.name")
+	c.Assert(*resourceSpans.Resource.Attributes[0].Value.StringValue, Equals, "lightning-test")
+	c.Assert(resourceSpans.ScopeSpans, HasLen, 1)
+	spans := resourceSpans.ScopeSpans[0].Spans
+	c.Assert(spans, HasLen, 2)
+
+	chunk, table := spans[0], spans[1]
+	c.Assert(table.Name, Equals, "table")
+	c.Assert(table.TraceID, HasLen, 32)
+	c.Assert(table.SpanID, HasLen, 16)
+	c.Assert(table.ParentSpanID, Equals, "")
+	c.Assert(table.StartTimeUnixNano, Equals, "1500000000000000000")
+	c.Assert(table.EndTimeUnixNano, Equals, "1500000003000000000")
+	c.Assert(table.Status, IsNil)
+
+	c.Assert(chunk.Name, Equals, "chunk")
+	c.Assert(chunk.TraceID, Equals, table.TraceID)
+	c.Assert(chunk.ParentSpanID, Equals, table.SpanID)
+	c.Assert(chunk.StartTimeUnixNano, Equals, "1500000001000000000")
+	c.Assert(chunk.EndTimeUnixNano, Equals, "1500000002000000000")
+	c.Assert(chunk.Status, DeepEquals, &otlpStatus{Code: otlpStatusCodeError, Message: "oops"})
+	c.Assert(chunk.Events, HasLen, 1)
+	attrs := make(map[string]otlpAnyValue)
+	for _, attr := range chunk.Attributes {
+		attrs[attr.Key] = attr.Value
+	}
+	c.Assert(attrs["rows"].IntValue, Equals, "5")
+	c.Assert(*attrs["seconds"].DoubleValue, Equals, 1.5)
+	c.Assert(*attrs["error"].BoolValue, IsTrue)
+}
+
+func (s *tracingSuite) TestOTLPReporterUnavailable(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// the spans are dropped without blocking.
+	reporter := NewOTLPReporter(server.URL, "lightning-test")
+	tracer, closer := jaeger.NewTracer("lightning-test", jaeger.NewConstSampler(true), reporter)
+	tracer.StartSpan("table").Finish()
+	c.Assert(closer.Close(), IsNil)
+	c.Assert(reporter.spans, HasLen, 0)
+}
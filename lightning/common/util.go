@@ -16,13 +16,16 @@ package common
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
@@ -43,12 +46,18 @@ func Percent(a int, b int) string {
 	return fmt.Sprintf("%.2f %%", float64(a)/float64(b)*100)
 }
 
-func ToDSN(host string, port int, user string, psw string) string {
-	return fmt.Sprintf("%s:%s@tcp(%s:%d)/?charset=utf8", user, psw, host, port)
+// ToDSN returns the DSN of the MySQL driver. `tls` is the name of the TLS
+// config, e.g. MySQLTLSConfigName, or empty to connect in plain text.
+func ToDSN(host string, port int, user string, psw string, tls string) string {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/?charset=utf8", user, psw, host, port)
+	if len(tls) != 0 {
+		dsn += "&tls=" + url.QueryEscape(tls)
+	}
+	return dsn
 }
 
-func ConnectDB(host string, port int, user string, psw string) (*sql.DB, error) {
-	dbDSN := ToDSN(host, port, user, psw)
+func ConnectDB(host string, port int, user string, psw string, tls string) (*sql.DB, error) {
+	dbDSN := ToDSN(host, port, user, psw, tls)
 	db, err := sql.Open("mysql", dbDSN)
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -66,55 +75,22 @@ func IsDirExists(name string) bool {
 	return f != nil && f.IsDir()
 }
 
-func QueryRowWithRetry(ctx context.Context, db *sql.DB, query string, dest ...interface{}) (err error) {
-	maxRetry := defaultMaxRetry
-	for i := 0; i < maxRetry; i++ {
-		if i > 0 {
-			AppLogger.Warnf("query %s retry %d", query, i)
-			time.Sleep(retryTimeout)
-		}
-
-		err = db.QueryRowContext(ctx, query).Scan(dest...)
-		if err != nil {
-			if !IsRetryableError(err) {
-				return errors.Trace(err)
-			}
-			AppLogger.Warnf("query %s [error] %v", query, err)
-			continue
-		}
-
-		return nil
-	}
-
-	return errors.Errorf("query sql [%s] failed", query)
+func QueryRowWithRetry(ctx context.Context, db *sql.DB, query string, dest ...interface{}) error {
+	return Retry(ctx, "query "+query, func() error {
+		return db.QueryRowContext(ctx, query).Scan(dest...)
+	})
 }
 
 // TransactWithRetry executes an action in a transaction, and retry if the
 // action failed with a retryable error.
 func TransactWithRetry(ctx context.Context, db *sql.DB, purpose string, action func(context.Context, *sql.Tx) error) error {
-	maxRetry := defaultMaxRetry
-
-	var err error
-	for i := 0; i < maxRetry; i++ {
-		if i > 0 {
-			AppLogger.Warnf("transaction %s retry %d", purpose, i)
-			time.Sleep(retryTimeout)
-		}
-
-		if err = transactImpl(ctx, db, purpose, action); err != nil {
-			if IsRetryableError(err) {
-				continue
-			}
-			if !IsContextCanceledError(err) {
-				AppLogger.Errorf("transaction %s [error] %v", purpose, err)
-			}
-			return errors.Trace(err)
-		}
-
-		return nil
+	err := Retry(ctx, "transaction "+purpose, func() error {
+		return transactImpl(ctx, db, purpose, action)
+	})
+	if err != nil && !IsRetryableError(err) && !IsContextCanceledError(err) {
+		AppLogger.Errorf("transaction %s [error] %v", purpose, RedactError(err))
 	}
-
-	return errors.Annotatef(err, "transaction %s failed", purpose)
+	return errors.Trace(err)
 }
 
 func transactImpl(ctx context.Context, db *sql.DB, purpose string, action func(context.Context, *sql.Tx) error) error {
@@ -125,7 +101,7 @@ func transactImpl(ctx context.Context, db *sql.DB, purpose string, action func(c
 
 	err = action(ctx, txn)
 	if err != nil {
-		AppLogger.Warnf("transaction %s [error]%v", purpose, err)
+		AppLogger.Warnf("transaction %s [error]%v", purpose, RedactError(err))
 		rerr := txn.Rollback()
 		if rerr != nil {
 			if !IsContextCanceledError(rerr) {
@@ -152,15 +128,46 @@ func ExecWithRetry(ctx context.Context, db *sql.DB, purpose string, query string
 	}))
 }
 
+// The errors of the statements conflicting with the concurrent DDL jobs, which
+// the vendored parser does not know. Older TiDB reports them as ErrUnknown.
+const (
+	errInfoSchemaExpired = 8027
+	errInfoSchemaChanged = 8028
+)
+
+// regionErrorRegexp matches the region errors of TiKV, e.g. the region split
+// or merged while ingesting, as they are reported by tikv-importer and TiDB
+// in the messages.
+var regionErrorRegexp = regexp.MustCompile(`(?i)epoch[ _]?not[ _]?match|stale[ _]?epoch|not[ _]?leader|region[ _]?not[ _]?found`)
+
 // IsRetryableError returns whether the error is transient (e.g. network
 // connection dropped) or irrecoverable (e.g. user pressing Ctrl+C). This
-// function returns `false` (irrecoverable) if `err == nil`.
+// function returns `false` (irrecoverable) if `err == nil`. The errors
+// matching the RetryableErrors of the retry policy are also transient.
 func IsRetryableError(err error) bool {
 	err = errors.Cause(err)
+	if err == nil {
+		return false
+	}
+	if isRetryableError(err) {
+		return true
+	}
+	for _, re := range retryPolicy.RetryableErrors {
+		if re.MatchString(err.Error()) {
+			return true
+		}
+	}
+	return false
+}
 
+func isRetryableError(err error) bool {
 	switch err {
-	case nil, context.Canceled, context.DeadlineExceeded, io.EOF:
+	case context.Canceled, context.DeadlineExceeded, io.EOF:
 		return false
+	case mysql.ErrInvalidConn, driver.ErrBadConn:
+		// the connection is dropped (e.g. TiDB restarted) and discarded from
+		// the pool, so retrying reconnects.
+		return true
 	}
 
 	switch nerr := err.(type) {
@@ -169,21 +176,31 @@ func IsRetryableError(err error) bool {
 	case *mysql.MySQLError:
 		switch nerr.Number {
 		// ErrLockDeadlock can retry to commit while meet deadlock
-		case tmysql.ErrUnknown, tmysql.ErrLockDeadlock, tmysql.ErrPDServerTimeout, tmysql.ErrTiKVServerTimeout, tmysql.ErrTiKVServerBusy, tmysql.ErrResolveLockTimeout, tmysql.ErrRegionUnavailable:
+		case tmysql.ErrUnknown, tmysql.ErrLockDeadlock, tmysql.ErrPDServerTimeout, tmysql.ErrTiKVServerTimeout, tmysql.ErrTiKVServerBusy, tmysql.ErrResolveLockTimeout, tmysql.ErrRegionUnavailable,
+			errInfoSchemaExpired, errInfoSchemaChanged:
 			return true
 		default:
-			return false
+			return regionErrorRegexp.MatchString(nerr.Message)
 		}
 	default:
-		switch status.Code(err) {
+		st, _ := status.FromError(err)
+		switch st.Code() {
 		case codes.Unknown, codes.DeadlineExceeded, codes.NotFound, codes.AlreadyExists, codes.PermissionDenied, codes.ResourceExhausted, codes.Aborted, codes.OutOfRange, codes.Unavailable, codes.DataLoss:
 			return true
-		default:
+		case codes.Canceled, codes.OK:
 			return false
+		default:
+			// e.g. tikv-importer reports the failed ingestion as an internal
+			// error, which is transient if the region changed meanwhile.
+			return regionErrorRegexp.MatchString(st.Message())
 		}
 	}
 }
 
+// ErrTimeout is the cause of the error returned when the task is stopped for
+// running longer than a configured timeout.
+var ErrTimeout = errors.New("timed out")
+
 // IsContextCanceledError returns whether the error is caused by context
 // cancellation. This function returns `false` (not a context-canceled error) if
 // `err == nil`.
@@ -14,8 +14,11 @@
 package common
 
 import (
+	"encoding/json"
 	"fmt"
 
+	"github.com/pingcap/errors"
+	gofail "github.com/pingcap/gofail/runtime"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -39,6 +42,47 @@ func GetRawInfo() string {
 	return info
 }
 
+// VersionInfo is the build information of the binary, for the tools checking
+// its provenance.
+type VersionInfo struct {
+	ReleaseVersion string   `json:"release_version"`
+	GitHash        string   `json:"git_hash"`
+	GitBranch      string   `json:"git_branch"`
+	BuildTS        string   `json:"utc_build_time"`
+	GoVersion      string   `json:"go_version"`
+	Features       []string `json:"features"`
+}
+
+// GetVersionInfo returns the build information of the binary.
+func GetVersionInfo() *VersionInfo {
+	return &VersionInfo{
+		ReleaseVersion: ReleaseVersion,
+		GitHash:        GitHash,
+		GitBranch:      GitBranch,
+		BuildTS:        BuildTS,
+		GoVersion:      GoVersion,
+		Features:       enabledFeatures(),
+	}
+}
+
+// GetJSONInfo is GetRawInfo in JSON.
+func GetJSONInfo() (string, error) {
+	content, err := json.Marshal(GetVersionInfo())
+	return string(content), errors.Trace(err)
+}
+
+// enabledFeatures lists the optional features the binary is built with.
+func enabledFeatures() []string {
+	features := []string{}
+	if raceEnabled {
+		features = append(features, "race")
+	}
+	if len(gofail.List()) > 0 {
+		features = append(features, "failpoint")
+	}
+	return features
+}
+
 // PrintInfo prints some information of the app, like git hash, binary build time, etc.
 func PrintInfo(app string, callback func()) {
 	oriLevel := GetLevel()
@@ -51,6 +95,19 @@ func PrintInfo(app string, callback func()) {
 }
 
 func printInfo(app string) {
+	if _, ok := AppLogger.Formatter.(*log.JSONFormatter); ok {
+		// a single record is easier to pick up from the JSON logs.
+		info := GetVersionInfo()
+		AppLogger.WithFields(log.Fields{
+			"release_version": info.ReleaseVersion,
+			"git_hash":        info.GitHash,
+			"git_branch":      info.GitBranch,
+			"utc_build_time":  info.BuildTS,
+			"go_version":      info.GoVersion,
+			"features":        info.Features,
+		}).Infof("Welcome to %s", app)
+		return
+	}
 	AppLogger.Infof("Welcome to %s", app)
 	AppLogger.Infof("Release Version: %s", ReleaseVersion)
 	AppLogger.Infof("Git Commit Hash: %s", GitHash)
@@ -0,0 +1,41 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+
+	. "github.com/pingcap/check"
+)
+
+var _ = Suite(&versionSuite{})
+
+type versionSuite struct{}
+
+func (s *versionSuite) TestGetJSONInfo(c *C) {
+	defer func(version, hash string) {
+		ReleaseVersion, GitHash = version, hash
+	}(ReleaseVersion, GitHash)
+	ReleaseVersion = "v3.0.0"
+	GitHash = "0123456789abcdef"
+
+	content, err := GetJSONInfo()
+	c.Assert(err, IsNil)
+	var info VersionInfo
+	c.Assert(json.Unmarshal([]byte(content), &info), IsNil)
+	c.Assert(info.ReleaseVersion, Equals, "v3.0.0")
+	c.Assert(info.GitHash, Equals, "0123456789abcdef")
+	c.Assert(info.BuildTS, Equals, BuildTS)
+	c.Assert(info.Features, NotNil)
+}
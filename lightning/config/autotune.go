@@ -0,0 +1,157 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// estimated memory used by every region worker, including the read
+	// buffer, the SQL statement and the queued KV pairs.
+	memoryPerRegionWorker = 512 * _M
+
+	// maximum number of bytes read from the data source when measuring the
+	// storage throughput.
+	throughputSampleSize = 64 * _M
+
+	// below this read throughput (in bytes per second) the storage is
+	// considered a spinning disk, which prefers fewer and larger reads.
+	slowStorageThroughput = 150 * _M
+)
+
+// availableMemory returns the memory available for new processes in bytes,
+// or 0 if it cannot be detected.
+func availableMemory() int64 {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// the line looks like "MemAvailable:   12345678 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * _K
+		}
+	}
+	return 0
+}
+
+// measureReadThroughput reads up to throughputSampleSize bytes of the SQL
+// files in `dir`, and returns the speed in bytes per second, or 0 if nothing
+// can be read.
+func measureReadThroughput(dir string) float64 {
+	buf := make([]byte, ReadBlockSize)
+	var total int64
+	start := time.Now()
+
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || total >= throughputSampleSize {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".sql") {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil
+		}
+		defer file.Close()
+		for total < throughputSampleSize {
+			n, err := file.Read(buf)
+			total += int64(n)
+			if err != nil {
+				break
+			}
+		}
+		return nil
+	})
+
+	elapsed := time.Since(start).Seconds()
+	if total == 0 || elapsed <= 0 {
+		return 0
+	}
+	return float64(total) / elapsed
+}
+
+// autoTune sets the concurrency and read block size from the host resources,
+// unless they are explicitly given in the config file or overridden.
+func (cfg *Config) autoTune(isDefined func(key ...string) bool) {
+	cpus := runtime.NumCPU()
+	memory := availableMemory()
+	throughput := measureReadThroughput(cfg.Mydumper.SourceDir)
+
+	regionConcurrency := cpus
+	if memory > 0 {
+		if byMemory := int(memory / memoryPerRegionWorker); byMemory < regionConcurrency {
+			regionConcurrency = byMemory
+		}
+	}
+	if regionConcurrency < 1 {
+		regionConcurrency = 1
+	}
+
+	tableConcurrency := regionConcurrency / 2
+	if tableConcurrency < 2 {
+		tableConcurrency = 2
+	} else if tableConcurrency > 8 {
+		tableConcurrency = 8
+	}
+
+	ioConcurrency := 5
+	readBlockSize := ReadBlockSize
+	if throughput > 0 && throughput < float64(slowStorageThroughput) {
+		ioConcurrency = 2
+		readBlockSize = 256 * _K
+	}
+
+	if !isDefined("lightning", "region-concurrency") {
+		cfg.App.RegionConcurrency = regionConcurrency
+	}
+	if !isDefined("lightning", "table-concurrency") {
+		cfg.App.TableConcurrency = tableConcurrency
+	}
+	if !isDefined("lightning", "io-concurrency") {
+		cfg.App.IOConcurrency = ioConcurrency
+	}
+	if !isDefined("mydumper", "read-block-size") {
+		cfg.Mydumper.ReadBlockSize = ByteSize(readBlockSize)
+	}
+
+	cfg.autoTuneReport = fmt.Sprintf(
+		"detected %d CPUs, %d bytes available memory, storage read speed %.0f bytes/s; using table-concurrency = %d, region-concurrency = %d, io-concurrency = %d, read-block-size = %d",
+		cpus, memory, throughput,
+		cfg.App.TableConcurrency, cfg.App.RegionConcurrency, cfg.App.IOConcurrency, cfg.Mydumper.ReadBlockSize,
+	)
+}
+
+// AutoTuneReport describes the detected host resources and the tuned values,
+// or returns an empty string if auto-tune is disabled.
+func (cfg *Config) AutoTuneReport() string {
+	return cfg.autoTuneReport
+}
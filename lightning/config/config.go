@@ -18,11 +18,19 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/charset"
+	tmysql "github.com/pingcap/parser/mysql"
 	"github.com/pingcap/tidb-lightning/lightning/common"
 	"github.com/pingcap/tidb-tools/pkg/filter"
 )
@@ -34,6 +42,107 @@ const (
 	NormalMode = "normal"
 )
 
+const (
+	// OnTableErrorAbort stops the whole task when any table failed.
+	OnTableErrorAbort = "abort"
+	// OnTableErrorContinue keeps importing the other tables when a table failed.
+	OnTableErrorContinue = "continue"
+)
+
+const (
+	// ImportOrderDefault starts the tables in the order they are found in the data source.
+	ImportOrderDefault = "default"
+	// ImportOrderLargestFirst starts the tables with the largest data files first.
+	ImportOrderLargestFirst = "largest-first"
+	// ImportOrderSmallestFirst starts the tables with the smallest data files first.
+	ImportOrderSmallestFirst = "smallest-first"
+	// ImportOrderAlphabetical starts the tables in alphabetical order of "db.table".
+	ImportOrderAlphabetical = "alphabetical"
+)
+
+const (
+	// BackendImporter writes the KV pairs into tikv-importer, which sorts
+	// and ingests them into TiKV.
+	BackendImporter = "importer"
+	// BackendLocal sorts the KV pairs on the local disk and ingests them into
+	// TiKV directly.
+	BackendLocal = "local"
+	// BackendTiDB executes the rows as INSERT statements in TiDB, without
+	// encoding them into KV pairs.
+	BackendTiDB = "tidb"
+)
+
+// PostOpLevel tells whether a post-restore operation is done, and whether its
+// failure stops the table. For compatibility, it can be deserialized from a
+// TOML boolean too, true being "required" and false being "off".
+type PostOpLevel string
+
+const (
+	// PostOpLevelOff skips the operation.
+	PostOpLevelOff PostOpLevel = "off"
+	// PostOpLevelOptional does the operation, but only logs its failure.
+	PostOpLevelOptional PostOpLevel = "optional"
+	// PostOpLevelRequired does the operation, and fails the table if the
+	// operation fails.
+	PostOpLevelRequired PostOpLevel = "required"
+)
+
+func (l *PostOpLevel) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			*l = PostOpLevelRequired
+		} else {
+			*l = PostOpLevelOff
+		}
+	case string:
+		*l = PostOpLevel(v)
+	default:
+		return errors.Errorf("invalid level %v, must be a boolean or a string", v)
+	}
+	return nil
+}
+
+const (
+	// ChecksumMethodAdmin compares the checksum of the KV pairs by ADMIN
+	// CHECKSUM TABLE, which reads every KV pair of the table.
+	ChecksumMethodAdmin = "admin"
+	// ChecksumMethodRowCount only compares the number of rows by SELECT
+	// COUNT(*), which is much cheaper on the cluster but misses the corrupted
+	// values.
+	ChecksumMethodRowCount = "row-count"
+)
+
+const (
+	// ReadEngineSync reads the data files with plain synchronous reads.
+	ReadEngineSync = "sync"
+	// ReadEngineReadahead asks the kernel to read the data files ahead of the
+	// parser with posix_fadvise. It is the same as ReadEngineSync except on
+	// Linux.
+	ReadEngineReadahead = "readahead"
+	// ReadEngineIOURing reads the data files ahead of the parser through
+	// io_uring. It needs Linux 5.1 or above on amd64 or arm64.
+	ReadEngineIOURing = "io_uring"
+)
+
+const (
+	// OnDuplicateReplace replaces the existing rows with the same keys.
+	OnDuplicateReplace = "replace"
+	// OnDuplicateIgnore keeps the existing rows with the same keys.
+	OnDuplicateIgnore = "ignore"
+	// OnDuplicateError fails the task when a row with the same keys exists.
+	OnDuplicateError = "error"
+)
+
+const (
+	// CheckLevelStrict stops the task when the pre-check failed.
+	CheckLevelStrict = "strict"
+	// CheckLevelWarn only logs a warning when the pre-check failed.
+	CheckLevelWarn = "warn"
+	// CheckLevelOff skips the pre-check.
+	CheckLevelOff = "off"
+)
+
 type DBStore struct {
 	Host       string `toml:"host" json:"host"`
 	Port       int    `toml:"port" json:"port"`
@@ -42,7 +151,28 @@ type DBStore struct {
 	StatusPort int    `toml:"status-port" json:"status-port"`
 	PdAddr     string `toml:"pd-addr" json:"pd-addr"`
 	SQLMode    string `toml:"sql-mode" json:"sql-mode"`
+	TimeZone   string `toml:"time-zone" json:"time-zone"`
 	LogLevel   string `toml:"log-level" json:"log-level"`
+	TLS        string `toml:"tls" json:"tls"`
+
+	// the SQL modes overriding SQLMode for the tables in the form "db.table".
+	TableSQLMode map[string]string `toml:"table-sql-mode" json:"table-sql-mode"`
+	// whether the rows are encoded by executing prepared INSERT statements.
+	UsePrepareStmt bool `toml:"use-prepare-stmt" json:"use-prepare-stmt"`
+	// the maximum number of CREATE TABLE statements executed at the same time.
+	DDLConcurrency int `toml:"ddl-concurrency" json:"ddl-concurrency"`
+	// the maximum number of CREATE TABLE statements sent in one query.
+	DDLBatchSize int `toml:"ddl-batch-size" json:"ddl-batch-size"`
+
+	PausePDSchedulers bool `toml:"pause-pd-schedulers" json:"pause-pd-schedulers"`
+
+	// the session variables set on the connections for checksum and analyze.
+	SessionVars map[string]string `toml:"session-vars" json:"session-vars"`
+
+	// the limits of the connection pool for DDL, checksum and analyze.
+	MaxOpenConns    int      `toml:"max-open-conns" json:"max-open-conns"`
+	MaxIdleConns    int      `toml:"max-idle-conns" json:"max-idle-conns"`
+	ConnMaxLifetime Duration `toml:"conn-max-lifetime" json:"conn-max-lifetime"`
 
 	DistSQLScanConcurrency     int `toml:"distsql-scan-concurrency" json:"distsql-scan-concurrency"`
 	BuildStatsConcurrency      int `toml:"build-stats-concurrency" json:"build-stats-concurrency"`
@@ -50,6 +180,18 @@ type DBStore struct {
 	ChecksumTableConcurrency   int `toml:"checksum-table-concurrency" json:"checksum-table-concurrency"`
 }
 
+// SQLModeOf returns the SQL mode in which the rows of the table are encoded,
+// i.e. the `table-sql-mode` of the table if set, otherwise `sql-mode`.
+func (dsn *DBStore) SQLModeOf(schema string, table string) string {
+	uniqueName := schema + "." + table
+	for name, sqlMode := range dsn.TableSQLMode {
+		if strings.EqualFold(name, uniqueName) {
+			return sqlMode
+		}
+	}
+	return dsn.SQLMode
+}
+
 type Config struct {
 	*flag.FlagSet `json:"-"`
 
@@ -64,12 +206,27 @@ type Config struct {
 	TikvImporter TikvImporter    `toml:"tikv-importer" json:"tikv-importer"`
 	PostRestore  PostRestore     `toml:"post-restore" json:"post-restore"`
 	Cron         Cron            `toml:"cron" json:"cron"`
+	PreCheck     PreCheck        `toml:"pre-check" json:"pre-check"`
+	Coordination Coordination    `toml:"coordination" json:"coordination"`
+	Security     Security        `toml:"security" json:"security"`
+	Tracing      Tracing         `toml:"tracing" json:"tracing"`
+	Notification Notification    `toml:"notification" json:"notification"`
 
 	// command line flags
 	ConfigFile   string `json:"config-file"`
 	DoCompact    bool   `json:"-"`
 	SwitchMode   string `json:"-"`
+	DryRun       bool   `json:"-"`
+	CheckConfig  bool   `json:"-"`
+	Subset       Subset `json:"-"`
 	printVersion bool
+
+	versionFormat          string
+	checkRequirementsLevel string
+	autoTuneReport         string
+	overrides              overrides
+	profile                string
+	taskContent            string // the TOML content of a task submitted in server mode
 }
 
 func (c *Config) String() string {
@@ -82,44 +239,243 @@ func (c *Config) String() string {
 
 type Lightning struct {
 	common.LogConfig
-	TableConcurrency  int  `toml:"table-concurrency" json:"table-concurrency"`
-	RegionConcurrency int  `toml:"region-concurrency" json:"region-concurrency"`
-	IOConcurrency     int  `toml:"io-concurrency" json:"io-concurrency"`
-	ProfilePort       int  `toml:"pprof-port" json:"pprof-port"`
-	CheckRequirements bool `toml:"check-requirements" json:"check-requirements"`
+	TableConcurrency  int      `toml:"table-concurrency" json:"table-concurrency"`
+	RegionConcurrency int      `toml:"region-concurrency" json:"region-concurrency"`
+	IOConcurrency     int      `toml:"io-concurrency" json:"io-concurrency"`
+	EncodeConcurrency int      `toml:"encode-concurrency" json:"encode-concurrency"`
+	ProfilePort       int      `toml:"pprof-port" json:"pprof-port"`
+	StatusAddr        string   `toml:"status-addr" json:"status-addr"`
+	AutoTune          bool     `toml:"auto-tune" json:"auto-tune"`
+	CheckRequirements bool     `toml:"check-requirements" json:"check-requirements"`
+	OnTableError      string   `toml:"on-table-error" json:"on-table-error"`
+	Incremental       bool     `toml:"incremental" json:"incremental"`
+	RetryCount        int      `toml:"retry-count" json:"retry-count"`
+	RetryBackoff      Duration `toml:"retry-backoff" json:"retry-backoff"`
+	RetryableErrors   []string `toml:"retryable-errors" json:"retryable-errors"`
+	MaxChunkFailures  int      `toml:"max-chunk-failures" json:"max-chunk-failures"`
+	TaskTimeout       Duration `toml:"task-timeout" json:"task-timeout"`
+	ResultFile        string   `toml:"result-file" json:"result-file"`
+	TableMetrics      bool     `toml:"table-metrics" json:"table-metrics"`
+	TableMetricsLimit int      `toml:"table-metrics-limit" json:"table-metrics-limit"`
+	StallTimeout      Duration `toml:"stall-timeout" json:"stall-timeout"`
+	StallDumpDir      string   `toml:"stall-dump-dir" json:"stall-dump-dir"`
+	TerminalProgress  bool     `toml:"terminal-progress" json:"terminal-progress"`
+	KVMemoryQuota     ByteSize `toml:"kv-memory-quota" json:"kv-memory-quota"`
+
+	// the task waits until the window opens before restoring anything.
+	MaintenanceWindow TimeWindow `toml:"maintenance-window" json:"maintenance-window"`
+
+	// in server mode, the tasks are submitted to the status server instead
+	// of read from the config file, and queued in the task queue file.
+	ServerMode    bool   `toml:"server-mode" json:"server-mode"`
+	TaskQueueFile string `toml:"task-queue-file" json:"task-queue-file"`
+
+	// the maximum number of closed engines waiting for or being imported,
+	// before the next engines stop being written. 0 means no limit.
+	MaxInflightImports int `toml:"max-inflight-imports" json:"max-inflight-imports"`
 }
 
 // PostRestore has some options which will be executed after kv restored.
 type PostRestore struct {
-	Compact  bool `toml:"compact" json:"compact"`
-	Checksum bool `toml:"checksum" json:"checksum"`
-	Analyze  bool `toml:"analyze" json:"analyze"`
+	Compact  bool        `toml:"compact" json:"compact"`
+	Checksum PostOpLevel `toml:"checksum" json:"checksum"`
+	Analyze  bool        `toml:"analyze" json:"analyze"`
+
+	ChecksumMethod string `toml:"checksum-method" json:"checksum-method"`
+
+	// the directory the diagnostics are written into when the checksum
+	// mismatches, or the temporary directory if empty.
+	ChecksumReportDir string `toml:"checksum-report-dir" json:"checksum-report-dir"`
+
+	// SpotCheck compares the rows sampled from the data source with the rows
+	// in TiDB, which catches the encoding bugs the checksum cannot.
+	SpotCheck     PostOpLevel `toml:"spot-check" json:"spot-check"`
+	SpotCheckRows int         `toml:"spot-check-rows" json:"spot-check-rows"`
+
+	ChecksumConcurrency int `toml:"checksum-concurrency" json:"checksum-concurrency"`
+	CompactConcurrency  int `toml:"compact-concurrency" json:"compact-concurrency"`
+
+	AnalyzeSkipTables  []string `toml:"analyze-skip-tables" json:"analyze-skip-tables"`
+	AnalyzeSamples     int      `toml:"analyze-samples" json:"analyze-samples"`
+	AnalyzeSampleRate  float64  `toml:"analyze-sample-rate" json:"analyze-sample-rate"`
+	AnalyzeConcurrency int      `toml:"analyze-concurrency" json:"analyze-concurrency"`
+
+	ChecksumTimeout Duration `toml:"checksum-timeout" json:"checksum-timeout"`
+	AnalyzeTimeout  Duration `toml:"analyze-timeout" json:"analyze-timeout"`
+
+	WaitTiFlash        bool     `toml:"wait-tiflash" json:"wait-tiflash"`
+	WaitTiFlashTimeout Duration `toml:"wait-tiflash-timeout" json:"wait-tiflash-timeout"`
+
+	// KeepImportMode leaves TiKV in import mode without the full compaction
+	// when the task is finished, so the next task can start importing
+	// immediately. The last task of the batch should have it unset.
+	KeepImportMode bool `toml:"keep-import-mode" json:"keep-import-mode"`
+}
+
+// Coordination lets several Lightning instances import the same data source
+// together, sharing the work through etcd.
+type Coordination struct {
+	Enable     bool   `toml:"enable" json:"enable"`
+	Endpoints  string `toml:"endpoints" json:"endpoints"`
+	Task       string `toml:"task" json:"task"`
+	InstanceID string `toml:"instance-id" json:"instance-id"`
+	Instances  int    `toml:"instances" json:"instances"`
+}
+
+// Tracing exports the spans of the restore pipeline to an OpenTelemetry
+// collector via OTLP/HTTP.
+type Tracing struct {
+	Enable      bool    `toml:"enable" json:"enable"`
+	ServiceName string  `toml:"service-name" json:"service-name"`
+	SampleRate  float64 `toml:"sample-rate" json:"sample-rate"`
+	Endpoint    string  `toml:"endpoint" json:"endpoint"`
+}
+
+// Notification posts the heartbeats and the outcome of the task to the
+// webhooks, so the unattended tasks can be watched. The URLs may contain
+// tokens, don't expose them to JSON.
+type Notification struct {
+	WebhookURL        string   `toml:"webhook-url" json:"-"`
+	SlackWebhookURL   string   `toml:"slack-webhook-url" json:"-"`
+	HeartbeatInterval Duration `toml:"heartbeat-interval" json:"heartbeat-interval"`
+	Timeout           Duration `toml:"timeout" json:"timeout"`
+}
+
+// Security is the TLS configuration of the connections to the cluster.
+type Security struct {
+	CAPath   string `toml:"ca-path" json:"ca-path"`
+	CertPath string `toml:"cert-path" json:"cert-path"`
+	KeyPath  string `toml:"key-path" json:"key-path"`
+	// mask the row values, the passwords in the DSN and the SQL in the logs
+	// and the errors.
+	RedactInfoLog bool `toml:"redact-info-log" json:"redact-info-log"`
+}
+
+// ToTLS loads the certificates. The connections are in plain text if the CA is
+// not given.
+func (sec *Security) ToTLS() (*common.TLS, error) {
+	tls, err := common.NewTLS(sec.CAPath, sec.CertPath, sec.KeyPath)
+	return tls, errors.Trace(err)
 }
 
 type MydumperRuntime struct {
-	ReadBlockSize    int64   `toml:"read-block-size" json:"read-block-size"`
-	BatchSize        int64   `toml:"batch-size" json:"batch-size"`
+	ReadBlockSize ByteSize `toml:"read-block-size" json:"read-block-size"`
+	ReadEngine    string   `toml:"read-engine" json:"read-engine"`
+	BatchSize     ByteSize `toml:"batch-size" json:"batch-size"`
+	SourceDir     string   `toml:"data-source-dir" json:"data-source-dir"`
+	NoSchema      bool     `toml:"no-schema" json:"no-schema"`
+	CharacterSet  string   `toml:"character-set" json:"character-set"`
+
+	// scale up the first engines of a table when positive, 0 for balanced
+	// engines.
 	BatchImportRatio float64 `toml:"batch-import-ratio" json:"batch-import-ratio"`
-	SourceDir        string  `toml:"data-source-dir" json:"data-source-dir"`
-	NoSchema         bool    `toml:"no-schema" json:"no-schema"`
-	CharacterSet     string  `toml:"character-set" json:"character-set"`
+
+	// grow or shrink the blocks of each chunk from read-block-size according
+	// to the row sizes and the encoding time.
+	AdaptiveReadBlockSize bool `toml:"adaptive-read-block-size" json:"adaptive-read-block-size"`
+
+	// the charset and collation of the created databases and tables,
+	// overriding those in the schema files.
+	TargetCharset   string `toml:"target-charset" json:"target-charset"`
+	TargetCollation string `toml:"target-collation" json:"target-collation"`
+
+	ImportOrder     string   `toml:"import-order" json:"import-order"`
+	ImportOrderList []string `toml:"import-order-list" json:"import-order-list"`
+
+	RenameSchema map[string]string `toml:"rename-schema" json:"rename-schema"`
+	RenameTable  map[string]string `toml:"rename-table" json:"rename-table"`
 }
 
 type TikvImporter struct {
-	Addr string `toml:"addr" json:"addr"`
+	Backend           string   `toml:"backend" json:"backend"`
+	Addr              string   `toml:"addr" json:"addr"`
+	SortedKVDir       string   `toml:"sorted-kv-dir" json:"sorted-kv-dir"`
+	OnDuplicate       string   `toml:"on-duplicate" json:"on-duplicate"`
+	DiskQuota         ByteSize `toml:"disk-quota" json:"disk-quota"`
+	DiskHighWatermark float64  `toml:"disk-high-watermark" json:"disk-high-watermark"`
+	StoreWriteBWLimit ByteSize `toml:"store-write-bwlimit" json:"store-write-bwlimit"`
+	PreSplitRegions   bool     `toml:"pre-split-regions" json:"pre-split-regions"`
+
+	GRPCKeepaliveTime    Duration `toml:"grpc-keepalive-time" json:"grpc-keepalive-time"`
+	GRPCKeepaliveTimeout Duration `toml:"grpc-keepalive-timeout" json:"grpc-keepalive-timeout"`
+	GRPCMaxMsgSize       ByteSize `toml:"grpc-max-msg-size" json:"grpc-max-msg-size"`
+	GRPCCompression      string   `toml:"grpc-compression" json:"grpc-compression"`
+	WriteStreams         int      `toml:"write-streams" json:"write-streams"`
+	ImportTimeout        Duration `toml:"import-timeout" json:"import-timeout"`
 }
 
 type Checkpoint struct {
-	Enable           bool   `toml:"enable" json:"enable"`
-	Schema           string `toml:"schema" json:"schema"`
-	DSN              string `toml:"dsn" json:"-"` // DSN may contain password, don't expose this to JSON.
-	Driver           string `toml:"driver" json:"driver"`
-	KeepAfterSuccess bool   `toml:"keep-after-success" json:"keep-after-success"`
+	Enable              bool   `toml:"enable" json:"enable"`
+	Schema              string `toml:"schema" json:"schema"`
+	DSN                 string `toml:"dsn" json:"-"` // DSN may contain password, don't expose this to JSON.
+	Driver              string `toml:"driver" json:"driver"`
+	KeepAfterSuccess    bool   `toml:"keep-after-success" json:"keep-after-success"`
+	ArchiveAfterSuccess bool   `toml:"archive-after-success" json:"archive-after-success"`
+	VerifyOnResume      bool   `toml:"verify-on-resume" json:"verify-on-resume"`
+}
+
+// PreCheck sets the level of every check run before importing, which is one
+// of CheckLevelStrict, CheckLevelWarn and CheckLevelOff.
+type PreCheck struct {
+	Version            string `toml:"version" json:"version"`
+	Importer           string `toml:"importer" json:"importer"`
+	SourceFiles        string `toml:"source-files" json:"source-files"`
+	Checkpoints        string `toml:"checkpoints" json:"checkpoints"`
+	ClusterEmpty       string `toml:"cluster-empty" json:"cluster-empty"`
+	Schema             string `toml:"schema" json:"schema"`
+	FreeSpace          string `toml:"free-space" json:"free-space"`
+	RegionDistribution string `toml:"region-distribution" json:"region-distribution"`
+}
+
+func (pc *PreCheck) levels() []*string {
+	return []*string{
+		&pc.Version,
+		&pc.Importer,
+		&pc.SourceFiles,
+		&pc.Checkpoints,
+		&pc.ClusterEmpty,
+		&pc.Schema,
+		&pc.FreeSpace,
+		&pc.RegionDistribution,
+	}
 }
 
 type Cron struct {
-	SwitchMode  Duration `toml:"switch-mode" json:"switch-mode"`
-	LogProgress Duration `toml:"log-progress" json:"log-progress"`
+	SwitchMode        Duration `toml:"switch-mode" json:"switch-mode"`
+	LogProgress       Duration `toml:"log-progress" json:"log-progress"`
+	FlushCheckpoint   Duration `toml:"flush-checkpoint" json:"flush-checkpoint"`
+	CheckpointMetrics Duration `toml:"checkpoint-metrics" json:"checkpoint-metrics"`
+	SaveAllocBase     Duration `toml:"save-alloc-base" json:"save-alloc-base"`
+}
+
+// Settings are the parts of the config which can be changed while running, by
+// re-reading the config file on SIGHUP or through the `/settings` API.
+type Settings struct {
+	LogLevel          string   `json:"level"`
+	LogProgress       Duration `json:"log-progress"`
+	SwitchMode        Duration `json:"switch-mode"`
+	StoreWriteBWLimit ByteSize `json:"store-write-bwlimit"`
+}
+
+// Settings returns the settings in the config.
+func (cfg *Config) Settings() Settings {
+	return Settings{
+		LogLevel:          cfg.App.Level,
+		LogProgress:       cfg.Cron.LogProgress,
+		SwitchMode:        cfg.Cron.SwitchMode,
+		StoreWriteBWLimit: cfg.TikvImporter.StoreWriteBWLimit,
+	}
+}
+
+// Validate checks the settings can be applied.
+func (s *Settings) Validate() error {
+	if _, err := common.ParseLogLevel(s.LogLevel); err != nil {
+		return errors.Annotate(err, "invalid settings: `level`")
+	}
+	if s.LogProgress.Duration <= 0 || s.SwitchMode.Duration <= 0 {
+		return errors.New("invalid settings: `log-progress` and `switch-mode` must be positive")
+	}
+	return nil
 }
 
 // A duration which can be deserialized from a TOML string.
@@ -138,28 +494,123 @@ func (d *Duration) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf(`"%s"`, d.Duration)), nil
 }
 
+// ByteSize is a number of bytes which can be deserialized from a TOML integer,
+// or a string with a unit like "64KiB" or "1.5GB". The units are all binary,
+// i.e. "1KB" is the same as "1KiB" and "1K", which is 1024 bytes.
+type ByteSize int64
+
+var byteSizeRegexp = regexp.MustCompile(`^\s*(\d+(?:\.\d*)?)\s*([KMGTP]?)(?:I?B)?\s*$`)
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	matches := byteSizeRegexp.FindStringSubmatch(strings.ToUpper(string(text)))
+	if matches == nil {
+		return errors.Errorf("invalid size %q, must be an integer or a number with a unit like \"64KiB\"", text)
+	}
+	value, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if unit := matches[2]; len(unit) > 0 {
+		value *= float64(int64(1) << (10 * uint(strings.Index("KMGTP", unit)+1)))
+	}
+	if value >= math.MaxInt64 {
+		return errors.Errorf("invalid size %q, too large", text)
+	}
+	*b = ByteSize(value)
+	return nil
+}
+
+// UnmarshalJSON accepts the number of bytes, in which the size is encoded, as
+// well as a string with a unit.
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(b.UnmarshalText([]byte(text)))
+	}
+	var value int64
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.Errorf("invalid size %s, must be an integer or a string like \"64KiB\"", data)
+	}
+	*b = ByteSize(value)
+	return nil
+}
+
 func NewConfig() *Config {
 	return &Config{
 		App: Lightning{
 			RegionConcurrency: runtime.NumCPU(),
 			TableConcurrency:  8,
 			IOConcurrency:     5,
+			EncodeConcurrency: 1,
 			CheckRequirements: true,
+			RetryCount:        2,
+			RetryBackoff:      Duration{Duration: 3 * time.Second},
+			TableMetricsLimit: 100,
+			StallTimeout:      Duration{Duration: 10 * time.Minute},
+			TerminalProgress:  true,
 		},
 		TiDB: DBStore{
 			SQLMode:                    "STRICT_TRANS_TABLES,NO_ENGINE_SUBSTITUTION",
+			DDLConcurrency:             8,
+			DDLBatchSize:               1,
+			MaxIdleConns:               2,
 			BuildStatsConcurrency:      20,
 			DistSQLScanConcurrency:     100,
 			IndexSerialScanConcurrency: 20,
 			ChecksumTableConcurrency:   16,
 		},
+		TikvImporter: TikvImporter{
+			DiskHighWatermark:    0.9,
+			GRPCKeepaliveTimeout: Duration{Duration: 20 * time.Second},
+			WriteStreams:         1,
+		},
+		PostRestore: PostRestore{
+			ChecksumConcurrency: 2,
+			CompactConcurrency:  4,
+			SpotCheckRows:       10,
+			WaitTiFlashTimeout:  Duration{Duration: time.Hour},
+		},
 		Cron: Cron{
-			SwitchMode:  Duration{Duration: 5 * time.Minute},
-			LogProgress: Duration{Duration: 5 * time.Minute},
+			SwitchMode:        Duration{Duration: 5 * time.Minute},
+			LogProgress:       Duration{Duration: 5 * time.Minute},
+			FlushCheckpoint:   Duration{Duration: 10 * time.Second},
+			CheckpointMetrics: Duration{Duration: time.Minute},
+			SaveAllocBase:     Duration{Duration: time.Minute},
+		},
+		PreCheck: PreCheck{
+			Version:            CheckLevelStrict,
+			Importer:           CheckLevelStrict,
+			SourceFiles:        CheckLevelStrict,
+			Checkpoints:        CheckLevelStrict,
+			ClusterEmpty:       CheckLevelWarn,
+			Schema:             CheckLevelStrict,
+			FreeSpace:          CheckLevelWarn,
+			RegionDistribution: CheckLevelWarn,
+		},
+		Tracing: Tracing{
+			ServiceName: "tidb-lightning",
+			SampleRate:  1,
+			Endpoint:    "http://127.0.0.1:4318",
+		},
+		Notification: Notification{
+			HeartbeatInterval: Duration{Duration: 5 * time.Minute},
+			Timeout:           Duration{Duration: 10 * time.Second},
 		},
 	}
 }
 
+// isHTTPURL checks the URL, if given, is an http or https one.
+func isHTTPURL(rawURL string) bool {
+	if len(rawURL) == 0 {
+		return true
+	}
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) > 0
+}
+
 func LoadConfig(args []string) (*Config, error) {
 	cfg := NewConfig()
 
@@ -173,7 +624,16 @@ func LoadConfig(args []string) (*Config, error) {
 	fs.StringVar(&cfg.ConfigFile, "config", "tidb-lightning.toml", "tidb-lightning configuration file")
 	fs.BoolVar(&cfg.DoCompact, "compact", false, "do manual compaction on the target cluster, run then exit")
 	fs.StringVar(&cfg.SwitchMode, "switch-mode", "", "switch tikv into import mode or normal mode, values can be ['import', 'normal'], run then exit")
+	fs.BoolVar(&cfg.DryRun, "dry-run", false, "read and encode all data files and report the estimated KV size, without writing anything into tikv-importer or TiDB")
+	fs.BoolVar(&cfg.CheckConfig, "check-config", false, "validate the config, and verify the data source and every component it refers to are reachable, without importing anything")
+	fs.StringVar(&cfg.profile, "profile", "", "preset the concurrency, batch size and read block size for the topology, values can be ['small-cluster', 'large-cluster', 'low-memory']. the keys given in the config file take precedence")
+	fs.Var(&cfg.overrides, "set", "override the config key, e.g. `tikv-importer.backend=local`, can be repeated. the TIDB_LIGHTNING_* environment variables are applied before")
 	fs.BoolVar(&cfg.printVersion, "V", false, "print version of lightning")
+	fs.BoolVar(&cfg.printVersion, "version", false, "print version of lightning")
+	fs.StringVar(&cfg.versionFormat, "format", common.LogFormatText, "the format of the version printed by -V, values can be ['text', 'json']")
+	fs.Var(&cfg.Subset.Tables, "table", "restore only the table `db.tbl`, can be repeated. the checkpoints of the other tables are kept")
+	fs.Var(&cfg.Subset.Engines, "engine", "restore only the data engine `id` of the table given by -table, can be repeated. the table is post-processed only once all its engines are imported")
+	fs.StringVar(&cfg.checkRequirementsLevel, "check-requirements", "", "override the level of all enabled pre-checks, values can be ['strict', 'warn', 'off']")
 
 	if err := fs.Parse(args); err != nil {
 		return nil, errors.Trace(err)
@@ -185,33 +645,350 @@ func LoadConfig(args []string) (*Config, error) {
 	return cfg, nil
 }
 
+// Reload loads the config file again, with the same overrides from the command
+// line.
+func (cfg *Config) Reload() (*Config, error) {
+	return cfg.reload("")
+}
+
+// LoadTask loads the config of a task submitted in server mode, i.e. the TOML
+// content of the task on top of the reloaded config file.
+func (cfg *Config) LoadTask(content string) (*Config, error) {
+	return cfg.reload(content)
+}
+
+func (cfg *Config) reload(taskContent string) (*Config, error) {
+	newCfg := NewConfig()
+	newCfg.ConfigFile = cfg.ConfigFile
+	newCfg.overrides = cfg.overrides
+	newCfg.profile = cfg.profile
+	newCfg.Subset = cfg.Subset
+	newCfg.taskContent = taskContent
+	if err := newCfg.Load(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return newCfg, nil
+}
+
 func (cfg *Config) Load() error {
 	if cfg.printVersion {
-		fmt.Println(common.GetRawInfo())
+		switch cfg.versionFormat {
+		case common.LogFormatText:
+			fmt.Println(common.GetRawInfo())
+		case common.LogFormatJSON:
+			info, err := common.GetJSONInfo()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			fmt.Println(info)
+		default:
+			return errors.Errorf("invalid flag: unknown format %s, must use %s or %s", cfg.versionFormat, common.LogFormatText, common.LogFormatJSON)
+		}
 		return flag.ErrHelp
 	}
 
+	modes := 0
+	for _, enabled := range []bool{cfg.DoCompact, len(cfg.SwitchMode) > 0, cfg.DryRun, cfg.CheckConfig} {
+		if enabled {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return errors.New("invalid flag: `-compact`, `-switch-mode`, `-dry-run` and `-check-config` cannot be used together")
+	}
+	if err := cfg.Subset.adjust(); err != nil {
+		return errors.Trace(err)
+	}
+
 	data, err := ioutil.ReadFile(cfg.ConfigFile)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	if err = toml.Unmarshal(data, cfg); err != nil {
+	preset, err := cfg.applyProfile()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	meta, err := toml.Decode(string(data), cfg)
+	if err != nil {
+		return annotateDecodeError(string(data), err)
+	}
+	overridden, err := cfg.applyOverrides()
+	if err != nil {
 		return errors.Trace(err)
 	}
+	// the task takes precedence over the config file and the overrides.
+	var taskMeta toml.MetaData
+	if len(cfg.taskContent) > 0 {
+		if taskMeta, err = toml.Decode(cfg.taskContent, cfg); err != nil {
+			return annotateDecodeError(cfg.taskContent, err)
+		}
+	}
+	for key := range preset {
+		overridden[key] = struct{}{}
+	}
 
 	// handle mydumper
-	if cfg.Mydumper.BatchSize <= 0 {
-		cfg.Mydumper.BatchSize = 100 * _G
+	if cfg.Mydumper.BatchSize < 0 {
+		return errors.New("invalid config: `mydumper.batch-size` must not be negative")
 	}
 	if cfg.Mydumper.BatchImportRatio < 0.0 || cfg.Mydumper.BatchImportRatio >= 1.0 {
-		cfg.Mydumper.BatchImportRatio = 0.75
+		return errors.New("invalid config: `mydumper.batch-import-ratio` must be in the range [0, 1)")
+	}
+	if cfg.App.KVMemoryQuota < 0 {
+		return errors.New("invalid config: `lightning.kv-memory-quota` must not be negative")
+	}
+	if cfg.App.MaxInflightImports < 0 {
+		return errors.New("invalid config: `lightning.max-inflight-imports` must not be negative")
+	}
+	// the pprof port is the old way to start the status server.
+	if len(cfg.App.StatusAddr) == 0 && cfg.App.ProfilePort > 0 {
+		cfg.App.StatusAddr = fmt.Sprintf(":%d", cfg.App.ProfilePort)
+	}
+	if cfg.App.ServerMode {
+		if len(cfg.App.StatusAddr) == 0 {
+			return errors.New("invalid config: `lightning.status-addr` must be set in server mode")
+		}
+		if cfg.DryRun || cfg.CheckConfig {
+			return errors.New("invalid flag: `-dry-run` and `-check-config` cannot be used in server mode")
+		}
+		if len(cfg.App.TaskQueueFile) == 0 {
+			cfg.App.TaskQueueFile = "/tmp/tidb_lightning_task_queue.json"
+		}
 	}
 	if cfg.Mydumper.ReadBlockSize <= 0 {
-		cfg.Mydumper.ReadBlockSize = ReadBlockSize
+		cfg.Mydumper.ReadBlockSize = ByteSize(ReadBlockSize)
+	}
+	switch cfg.Mydumper.ReadEngine {
+	case "":
+		cfg.Mydumper.ReadEngine = ReadEngineSync
+	case ReadEngineSync, ReadEngineReadahead, ReadEngineIOURing:
+	default:
+		return errors.Errorf("invalid config: unsupported `mydumper.read-engine` (%s)", cfg.Mydumper.ReadEngine)
 	}
 	if len(cfg.Mydumper.CharacterSet) == 0 {
 		cfg.Mydumper.CharacterSet = "auto"
 	}
+	cfg.Mydumper.TargetCharset = strings.ToLower(cfg.Mydumper.TargetCharset)
+	cfg.Mydumper.TargetCollation = strings.ToLower(cfg.Mydumper.TargetCollation)
+	switch {
+	case len(cfg.Mydumper.TargetCharset) == 0:
+		if len(cfg.Mydumper.TargetCollation) > 0 {
+			return errors.New("invalid config: `mydumper.target-collation` requires `mydumper.target-charset`")
+		}
+	case len(cfg.Mydumper.TargetCollation) == 0:
+		collation, err := charset.GetDefaultCollation(cfg.Mydumper.TargetCharset)
+		if err != nil {
+			return errors.Errorf("invalid config: unsupported `mydumper.target-charset` (%s)", cfg.Mydumper.TargetCharset)
+		}
+		cfg.Mydumper.TargetCollation = collation
+	case !charset.ValidCharsetAndCollation(cfg.Mydumper.TargetCharset, cfg.Mydumper.TargetCollation):
+		return errors.Errorf("invalid config: `mydumper.target-collation` (%s) does not belong to `mydumper.target-charset` (%s)",
+			cfg.Mydumper.TargetCollation, cfg.Mydumper.TargetCharset)
+	}
+	switch cfg.TikvImporter.Backend {
+	case "":
+		cfg.TikvImporter.Backend = BackendImporter
+	case BackendImporter:
+	case BackendLocal:
+		if len(cfg.TikvImporter.SortedKVDir) == 0 {
+			return errors.New("invalid config: `tikv-importer.sorted-kv-dir` must be set for the local backend")
+		}
+	case BackendTiDB:
+	default:
+		return errors.Errorf("invalid config: unsupported `tikv-importer.backend` (%s)", cfg.TikvImporter.Backend)
+	}
+	if (len(cfg.Security.CertPath) == 0) != (len(cfg.Security.KeyPath) == 0) {
+		return errors.New("invalid config: `security.cert-path` and `security.key-path` must be set together")
+	}
+	if len(cfg.Security.CAPath) != 0 {
+		if _, err := cfg.Security.ToTLS(); err != nil {
+			return errors.Annotate(err, "invalid config: cannot load the certificates in `security`")
+		}
+		if len(cfg.TiDB.TLS) == 0 {
+			cfg.TiDB.TLS = common.MySQLTLSConfigName
+		}
+	} else if len(cfg.Security.CertPath) != 0 {
+		return errors.New("invalid config: `security.ca-path` must be set with the client certificate")
+	}
+	switch cfg.TikvImporter.GRPCCompression {
+	case "", "none":
+		cfg.TikvImporter.GRPCCompression = ""
+	case "gzip":
+	default:
+		return errors.Errorf("invalid config: unsupported `tikv-importer.grpc-compression` (%s)", cfg.TikvImporter.GRPCCompression)
+	}
+	if cfg.TikvImporter.GRPCKeepaliveTime.Duration < 0 || cfg.TikvImporter.GRPCKeepaliveTimeout.Duration < 0 || cfg.TikvImporter.GRPCMaxMsgSize < 0 {
+		return errors.New("invalid config: the gRPC options of `tikv-importer` must not be negative")
+	}
+	if cfg.TikvImporter.DiskHighWatermark < 0 || cfg.TikvImporter.DiskHighWatermark >= 1 {
+		return errors.New("invalid config: `tikv-importer.disk-high-watermark` must be between 0 and 1")
+	}
+	if cfg.TikvImporter.WriteStreams <= 0 {
+		cfg.TikvImporter.WriteStreams = 1
+	}
+	switch cfg.TikvImporter.OnDuplicate {
+	case "":
+		cfg.TikvImporter.OnDuplicate = OnDuplicateReplace
+	case OnDuplicateReplace, OnDuplicateIgnore, OnDuplicateError:
+	default:
+		return errors.Errorf("invalid config: unsupported `tikv-importer.on-duplicate` (%s)", cfg.TikvImporter.OnDuplicate)
+	}
+	switch cfg.App.OnTableError {
+	case "":
+		cfg.App.OnTableError = OnTableErrorAbort
+	case OnTableErrorAbort, OnTableErrorContinue:
+	default:
+		return errors.Errorf("invalid config: unsupported `lightning.on-table-error` (%s)", cfg.App.OnTableError)
+	}
+	for name, sqlMode := range cfg.TiDB.TableSQLMode {
+		if !strings.Contains(name, ".") {
+			return errors.Errorf("invalid config: `tidb.table-sql-mode` key should be in the form \"db.table\" (%s)", name)
+		}
+		if _, err := tmysql.GetSQLMode(sqlMode); err != nil {
+			return errors.Errorf("invalid config: `tidb.table-sql-mode` of %s (%s): %v", name, sqlMode, err)
+		}
+	}
+	if len(cfg.TiDB.TableSQLMode) > 0 && cfg.TikvImporter.Backend == BackendTiDB {
+		return errors.New("invalid config: `tidb.table-sql-mode` is not supported by the TiDB backend")
+	}
+	if len(cfg.TiDB.TimeZone) > 0 && !ValidTimeZone(cfg.TiDB.TimeZone) {
+		return errors.Errorf("invalid config: unknown `tidb.time-zone` (%s)", cfg.TiDB.TimeZone)
+	}
+	if _, err := common.NewLogFormatter(cfg.App.Format); err != nil {
+		return errors.Errorf("invalid config: unknown `lightning.log-format` (%s), values can be [%s, %s]", cfg.App.Format, common.LogFormatText, common.LogFormatJSON)
+	}
+	if cfg.App.RetryCount < 0 {
+		return errors.New("invalid config: `lightning.retry-count` must not be negative")
+	}
+	if cfg.App.TaskTimeout.Duration < 0 || cfg.TikvImporter.ImportTimeout.Duration < 0 ||
+		cfg.PostRestore.ChecksumTimeout.Duration < 0 || cfg.PostRestore.AnalyzeTimeout.Duration < 0 {
+		return errors.New("invalid config: `lightning.task-timeout`, `tikv-importer.import-timeout`, `post-restore.checksum-timeout` and `post-restore.analyze-timeout` must not be negative")
+	}
+	if cfg.App.RetryBackoff.Duration < 0 {
+		return errors.New("invalid config: `lightning.retry-backoff` must not be negative")
+	}
+	if _, err := common.CompileRetryableErrors(cfg.App.RetryableErrors); err != nil {
+		return errors.Annotate(err, "invalid config: `lightning.retryable-errors`")
+	}
+	if cfg.Cron.FlushCheckpoint.Duration < 0 {
+		return errors.New("invalid config: `cron.flush-checkpoint` must not be negative")
+	}
+	if cfg.App.StallTimeout.Duration < 0 {
+		return errors.New("invalid config: `lightning.stall-timeout` must not be negative")
+	}
+	if cfg.TiDB.DDLConcurrency <= 0 {
+		return errors.New("invalid config: `tidb.ddl-concurrency` must be positive")
+	}
+	if cfg.TiDB.MaxOpenConns < 0 || cfg.TiDB.MaxIdleConns < 0 || cfg.TiDB.ConnMaxLifetime.Duration < 0 {
+		return errors.New("invalid config: `tidb.max-open-conns`, `tidb.max-idle-conns` and `tidb.conn-max-lifetime` must not be negative")
+	}
+	for name := range cfg.TiDB.SessionVars {
+		if !sessionVarNameRegexp.MatchString(name) {
+			return errors.Errorf("invalid config: invalid variable name in `tidb.session-vars` (%s)", name)
+		}
+	}
+	if cfg.TiDB.DDLBatchSize <= 0 {
+		return errors.New("invalid config: `tidb.ddl-batch-size` must be positive")
+	}
+	if cfg.App.EncodeConcurrency <= 0 {
+		return errors.New("invalid config: `lightning.encode-concurrency` must be positive")
+	}
+	if cfg.App.MaxChunkFailures < 0 {
+		return errors.New("invalid config: `lightning.max-chunk-failures` must not be negative")
+	}
+	if cfg.App.TableMetricsLimit < 0 {
+		return errors.New("invalid config: `lightning.table-metrics-limit` must not be negative")
+	}
+	switch cfg.PostRestore.Checksum {
+	case "":
+		cfg.PostRestore.Checksum = PostOpLevelOff
+	case PostOpLevelOff, PostOpLevelOptional, PostOpLevelRequired:
+	default:
+		return errors.Errorf("invalid config: unsupported `post-restore.checksum` (%s)", cfg.PostRestore.Checksum)
+	}
+	switch cfg.PostRestore.SpotCheck {
+	case "":
+		cfg.PostRestore.SpotCheck = PostOpLevelOff
+	case PostOpLevelOff, PostOpLevelOptional, PostOpLevelRequired:
+	default:
+		return errors.Errorf("invalid config: unsupported `post-restore.spot-check` (%s)", cfg.PostRestore.SpotCheck)
+	}
+	if cfg.PostRestore.SpotCheck != PostOpLevelOff && cfg.PostRestore.SpotCheckRows <= 0 {
+		return errors.New("invalid config: `post-restore.spot-check-rows` must be positive")
+	}
+	switch cfg.PostRestore.ChecksumMethod {
+	case "":
+		cfg.PostRestore.ChecksumMethod = ChecksumMethodAdmin
+	case ChecksumMethodAdmin, ChecksumMethodRowCount:
+	default:
+		return errors.Errorf("invalid config: unsupported `post-restore.checksum-method` (%s)", cfg.PostRestore.ChecksumMethod)
+	}
+	if cfg.PostRestore.ChecksumConcurrency <= 0 {
+		return errors.New("invalid config: `post-restore.checksum-concurrency` must be positive")
+	}
+	if cfg.PostRestore.CompactConcurrency <= 0 {
+		return errors.New("invalid config: `post-restore.compact-concurrency` must be positive")
+	}
+	if cfg.PostRestore.AnalyzeSamples < 0 {
+		return errors.New("invalid config: `post-restore.analyze-samples` must not be negative")
+	}
+	if cfg.PostRestore.AnalyzeSampleRate < 0 || cfg.PostRestore.AnalyzeSampleRate > 1 {
+		return errors.New("invalid config: `post-restore.analyze-sample-rate` must be between 0 and 1")
+	}
+	if cfg.PostRestore.AnalyzeSamples > 0 && cfg.PostRestore.AnalyzeSampleRate > 0 {
+		return errors.New("invalid config: `post-restore.analyze-samples` and `post-restore.analyze-sample-rate` cannot be both set")
+	}
+	if cfg.PostRestore.AnalyzeConcurrency <= 0 {
+		cfg.PostRestore.AnalyzeConcurrency = cfg.App.TableConcurrency
+	}
+	for _, name := range cfg.PostRestore.AnalyzeSkipTables {
+		if !strings.Contains(name, ".") {
+			return errors.Errorf("invalid config: `post-restore.analyze-skip-tables` entry should be in the form \"db.table\" (%s)", name)
+		}
+	}
+
+	for _, level := range cfg.PreCheck.levels() {
+		switch *level {
+		case CheckLevelStrict, CheckLevelWarn, CheckLevelOff:
+		default:
+			return errors.Errorf("invalid config: unsupported check level in `pre-check` (%s)", *level)
+		}
+	}
+	switch cfg.checkRequirementsLevel {
+	case "":
+	case CheckLevelOff:
+		cfg.App.CheckRequirements = false
+	case CheckLevelStrict, CheckLevelWarn:
+		cfg.App.CheckRequirements = true
+		for _, level := range cfg.PreCheck.levels() {
+			if *level != CheckLevelOff {
+				*level = cfg.checkRequirementsLevel
+			}
+		}
+	default:
+		return errors.Errorf("invalid flag: unsupported `-check-requirements` (%s)", cfg.checkRequirementsLevel)
+	}
+
+	switch cfg.Mydumper.ImportOrder {
+	case "":
+		cfg.Mydumper.ImportOrder = ImportOrderDefault
+	case ImportOrderDefault, ImportOrderLargestFirst, ImportOrderSmallestFirst, ImportOrderAlphabetical:
+	default:
+		return errors.Errorf("invalid config: unsupported `mydumper.import-order` (%s)", cfg.Mydumper.ImportOrder)
+	}
+	for source, target := range cfg.Mydumper.RenameSchema {
+		if len(target) == 0 {
+			return errors.Errorf("invalid config: empty target of `mydumper.rename-schema` (%s)", source)
+		}
+	}
+	for source, target := range cfg.Mydumper.RenameTable {
+		if !strings.Contains(source, ".") {
+			return errors.Errorf("invalid config: `mydumper.rename-table` must be in the form \"db.table\" (%s)", source)
+		}
+		if len(target) == 0 {
+			return errors.Errorf("invalid config: empty target of `mydumper.rename-table` (%s)", source)
+		}
+	}
 
 	if len(cfg.Checkpoint.Schema) == 0 {
 		cfg.Checkpoint.Schema = "tidb_lightning_checkpoint"
@@ -222,11 +999,78 @@ func (cfg *Config) Load() error {
 	if len(cfg.Checkpoint.DSN) == 0 {
 		switch cfg.Checkpoint.Driver {
 		case "mysql":
-			cfg.Checkpoint.DSN = common.ToDSN(cfg.TiDB.Host, cfg.TiDB.Port, cfg.TiDB.User, cfg.TiDB.Psw)
+			cfg.Checkpoint.DSN = common.ToDSN(cfg.TiDB.Host, cfg.TiDB.Port, cfg.TiDB.User, cfg.TiDB.Psw, cfg.TiDB.TLS)
 		case "file":
 			cfg.Checkpoint.DSN = "/tmp/" + cfg.Checkpoint.Schema + ".pb"
+		case "etcd":
+			cfg.Checkpoint.DSN = cfg.TiDB.PdAddr
+		}
+	}
+
+	if cfg.Coordination.Enable {
+		if cfg.Coordination.Instances <= 0 {
+			return errors.New("invalid config: `coordination.instances` must be positive")
+		}
+		if len(cfg.Coordination.Endpoints) == 0 {
+			cfg.Coordination.Endpoints = cfg.TiDB.PdAddr
+		}
+		if len(cfg.Coordination.Task) == 0 {
+			cfg.Coordination.Task = cfg.Checkpoint.Schema
+		}
+		if len(cfg.Coordination.InstanceID) == 0 {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return errors.Annotate(err, "cannot use the host name as `coordination.instance-id`")
+			}
+			cfg.Coordination.InstanceID = hostname
 		}
 	}
 
+	if cfg.Tracing.Enable {
+		if cfg.Tracing.SampleRate < 0 || cfg.Tracing.SampleRate > 1 {
+			return errors.New("invalid config: `tracing.sample-rate` must be between 0 and 1")
+		}
+		if len(cfg.Tracing.Endpoint) == 0 {
+			return errors.New("invalid config: `tracing.endpoint` must not be empty")
+		}
+	}
+
+	if !isHTTPURL(cfg.Notification.WebhookURL) {
+		return errors.New("invalid config: `notification.webhook-url` must be an http or https URL")
+	}
+	if !isHTTPURL(cfg.Notification.SlackWebhookURL) {
+		return errors.New("invalid config: `notification.slack-webhook-url` must be an http or https URL")
+	}
+	if cfg.Notification.HeartbeatInterval.Duration < 0 {
+		return errors.New("invalid config: `notification.heartbeat-interval` must not be negative")
+	}
+	if cfg.Notification.Timeout.Duration <= 0 {
+		return errors.New("invalid config: `notification.timeout` must be positive")
+	}
+
+	if cfg.App.AutoTune {
+		cfg.autoTune(func(key ...string) bool {
+			_, ok := overridden[strings.Join(key, ".")]
+			return ok || meta.IsDefined(key...) || taskMeta.IsDefined(key...)
+		})
+	}
+
 	return nil
 }
+
+var timeZoneOffsetRegexp = regexp.MustCompile(`^[+-]\d{1,2}:\d{2}$`)
+
+// ValidTimeZone returns whether the time zone is accepted by the time_zone
+// variable of TiDB: "SYSTEM", an offset like "+08:00", or a location name like
+// "Asia/Shanghai".
+func ValidTimeZone(timeZone string) bool {
+	if strings.EqualFold(timeZone, "SYSTEM") || timeZoneOffsetRegexp.MatchString(timeZone) {
+		return true
+	}
+	_, err := time.LoadLocation(timeZone)
+	return err == nil
+}
+
+// sessionVarNameRegexp matches the names of the system variables, which are
+// put into the SET statement unquoted.
+var sessionVarNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
@@ -0,0 +1,228 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/pingcap/check"
+)
+
+func TestConfig(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&configSuite{})
+
+type configSuite struct{}
+
+func (s *configSuite) TestByteSizeUnmarshalText(c *C) {
+	cases := []struct {
+		text     string
+		expected ByteSize
+	}{
+		{"0", 0},
+		{"65536", 65536},
+		{"64KiB", 64 << 10},
+		{"64kb", 64 << 10},
+		{"64 K", 64 << 10},
+		{"1.5GB", 3 << 29},
+		{"100GiB", 100 << 30},
+		{"2P", 2 << 50},
+	}
+	for _, tc := range cases {
+		var size ByteSize
+		c.Assert(size.UnmarshalText([]byte(tc.text)), IsNil, Commentf("%s", tc.text))
+		c.Assert(size, Equals, tc.expected, Commentf("%s", tc.text))
+	}
+
+	for _, text := range []string{"", "-1", "64XB", "KiB", "1.5.5G", "10000000P"} {
+		var size ByteSize
+		c.Assert(size.UnmarshalText([]byte(text)), NotNil, Commentf("%s", text))
+	}
+}
+
+func (s *configSuite) TestByteSizeJSON(c *C) {
+	settings := Settings{
+		LogLevel:          "info",
+		LogProgress:       Duration{Duration: time.Minute},
+		SwitchMode:        Duration{Duration: 5 * time.Minute},
+		StoreWriteBWLimit: 128 << 20,
+	}
+	data, err := json.Marshal(&settings)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, `.*"store-write-bwlimit":134217728.*`)
+
+	// the settings returned by GET can be sent back by PATCH.
+	var decoded Settings
+	c.Assert(json.Unmarshal(data, &decoded), IsNil)
+	c.Assert(decoded, Equals, settings)
+
+	c.Assert(json.Unmarshal([]byte(`{"store-write-bwlimit": "64MiB"}`), &decoded), IsNil)
+	c.Assert(decoded.StoreWriteBWLimit, Equals, ByteSize(64<<20))
+	c.Assert(json.Unmarshal([]byte(`{"store-write-bwlimit": 1.5}`), &decoded), ErrorMatches, "invalid size 1.5.*")
+	c.Assert(json.Unmarshal([]byte(`{"store-write-bwlimit": "64XB"}`), &decoded), ErrorMatches, `invalid size "64XB".*`)
+}
+
+func (s *configSuite) TestAnnotateDecodeError(c *C) {
+	load := func(content string) error {
+		path := filepath.Join(c.MkDir(), "config.toml")
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+		cfg := NewConfig()
+		cfg.ConfigFile = path
+		return cfg.Load()
+	}
+
+	c.Assert(load("[mydumper]\nread-block-size = \"64XB\"\n"), ErrorMatches, "invalid config: `mydumper.read-block-size`: invalid size \"64XB\".*")
+	c.Assert(load("[cron]\nswitch-mode = 5\n"), ErrorMatches, "invalid config: `cron.switch-mode`: .*")
+	c.Assert(load("[lightning]\ntable-concurrency = \"8\"\n"), ErrorMatches, "invalid config: `lightning.table-concurrency`: expected int but found string")
+	c.Assert(load("[tikv-importer]\nbackend = 1\n"), ErrorMatches, "invalid config: `tikv-importer.backend`: expected string but found int64")
+	// the syntax errors tell the line.
+	c.Assert(load("[lightning]\nlevel = \n"), ErrorMatches, ".*line 2.*")
+}
+
+func (s *configSuite) TestBatchImportRatio(c *C) {
+	load := func(content string) (*Config, error) {
+		path := filepath.Join(c.MkDir(), "config.toml")
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+		cfg := NewConfig()
+		cfg.ConfigFile = path
+		return cfg, cfg.Load()
+	}
+
+	cfg, err := load("[mydumper]\nbatch-import-ratio = 0.75\n")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Mydumper.BatchImportRatio, Equals, 0.75)
+	_, err = load("[mydumper]\nbatch-import-ratio = 1.0\n")
+	c.Assert(err, ErrorMatches, "invalid config: `mydumper.batch-import-ratio` must be in the range \\[0, 1\\)")
+	_, err = load("[mydumper]\nbatch-import-ratio = -0.5\n")
+	c.Assert(err, ErrorMatches, "invalid config: `mydumper.batch-import-ratio` .*")
+}
+
+func (s *configSuite) TestDDLBatchSize(c *C) {
+	load := func(content string) (*Config, error) {
+		path := filepath.Join(c.MkDir(), "config.toml")
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+		cfg := NewConfig()
+		cfg.ConfigFile = path
+		return cfg, cfg.Load()
+	}
+
+	cfg, err := load("")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.TiDB.DDLBatchSize, Equals, 1)
+	cfg, err = load("[tidb]\nddl-batch-size = 50\n")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.TiDB.DDLBatchSize, Equals, 50)
+	_, err = load("[tidb]\nddl-batch-size = 0\n")
+	c.Assert(err, ErrorMatches, "invalid config: `tidb.ddl-batch-size` must be positive")
+}
+
+func (s *configSuite) TestRetryableErrors(c *C) {
+	load := func(content string) (*Config, error) {
+		path := filepath.Join(c.MkDir(), "config.toml")
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+		cfg := NewConfig()
+		cfg.ConfigFile = path
+		return cfg, cfg.Load()
+	}
+
+	cfg, err := load("[lightning]\nretryable-errors = [\"(?i)write conflict\"]\n")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.App.RetryableErrors, DeepEquals, []string{"(?i)write conflict"})
+	_, err = load("[lightning]\nretryable-errors = [\"(\"]\n")
+	c.Assert(err, ErrorMatches, "invalid config: `lightning.retryable-errors`: invalid pattern.*")
+}
+
+func (s *configSuite) TestServerMode(c *C) {
+	path := filepath.Join(c.MkDir(), "config.toml")
+	load := func(content string) (*Config, error) {
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+		cfg := NewConfig()
+		cfg.ConfigFile = path
+		return cfg, cfg.Load()
+	}
+
+	_, err := load("[lightning]\nserver-mode = true\n")
+	c.Assert(err, ErrorMatches, "invalid config: `lightning.status-addr` must be set in server mode")
+	// the pprof port starts the status server too.
+	cfg, err := load("[lightning]\nserver-mode = true\npprof-port = 8289\n")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.App.StatusAddr, Equals, ":8289")
+	cfg, err = load("[lightning]\nserver-mode = true\nstatus-addr = ':8290'\npprof-port = 8289\n[mydumper]\nbatch-size = 100\n")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.App.StatusAddr, Equals, ":8290")
+	c.Assert(cfg.App.TaskQueueFile, Equals, "/tmp/tidb_lightning_task_queue.json")
+
+	// the task is applied on top of the config file.
+	taskCfg, err := cfg.LoadTask("[mydumper]\ndata-source-dir = '/data/task'\n")
+	c.Assert(err, IsNil)
+	c.Assert(taskCfg.Mydumper.SourceDir, Equals, "/data/task")
+	c.Assert(taskCfg.Mydumper.BatchSize, Equals, ByteSize(100))
+	_, err = cfg.LoadTask("[lightning]\nmax-inflight-imports = -1\n")
+	c.Assert(err, ErrorMatches, "invalid config: `lightning.max-inflight-imports` must not be negative")
+	_, err = cfg.LoadTask("[mydumper\n")
+	c.Assert(err, NotNil)
+}
+
+func (s *configSuite) TestPostOpLevel(c *C) {
+	load := func(content string) (*Config, error) {
+		path := filepath.Join(c.MkDir(), "config.toml")
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+		cfg := NewConfig()
+		cfg.ConfigFile = path
+		return cfg, cfg.Load()
+	}
+
+	// the booleans of the old configs.
+	cfg, err := load("[post-restore]\nchecksum = true\n")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.PostRestore.Checksum, Equals, PostOpLevelRequired)
+	cfg, err = load("[post-restore]\nchecksum = false\n")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.PostRestore.Checksum, Equals, PostOpLevelOff)
+
+	cfg, err = load("[post-restore]\nchecksum = \"optional\"\n")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.PostRestore.Checksum, Equals, PostOpLevelOptional)
+	_, err = load("[post-restore]\nchecksum = 1\n")
+	c.Assert(err, ErrorMatches, "invalid config: `post-restore.checksum`: .*")
+	var level PostOpLevel
+	c.Assert(level.UnmarshalTOML(int64(1)), ErrorMatches, "invalid level 1, must be a boolean or a string")
+	_, err = load("[post-restore]\nchecksum = \"sometimes\"\n")
+	c.Assert(err, ErrorMatches, "invalid config: unsupported `post-restore.checksum` \\(sometimes\\)")
+}
+
+func (s *configSuite) TestReadEngine(c *C) {
+	load := func(content string) (*Config, error) {
+		path := filepath.Join(c.MkDir(), "config.toml")
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+		cfg := NewConfig()
+		cfg.ConfigFile = path
+		return cfg, cfg.Load()
+	}
+
+	cfg, err := load("")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Mydumper.ReadEngine, Equals, ReadEngineSync)
+	cfg, err = load("[mydumper]\nread-engine = \"io_uring\"\n")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Mydumper.ReadEngine, Equals, ReadEngineIOURing)
+	_, err = load("[mydumper]\nread-engine = \"aio\"\n")
+	c.Assert(err, ErrorMatches, "invalid config: unsupported `mydumper.read-engine` \\(aio\\)")
+}
@@ -0,0 +1,237 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding the config
+// keys. The rest of the name is the key in upper case, with the dots and
+// dashes replaced by underscores, e.g. `TIDB_LIGHTNING_TIKV_IMPORTER_BACKEND`
+// overrides `tikv-importer.backend`.
+const EnvPrefix = "TIDB_LIGHTNING_"
+
+// overrides collects the repeated `-set key=value` flags.
+type overrides []string
+
+func (o *overrides) String() string {
+	return strings.Join(*o, " ")
+}
+
+func (o *overrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.Errorf("%q is not in the form key=value", value)
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// configKeys maps the dotted keys of all config items, e.g.
+// "tikv-importer.backend", to the types of their values.
+var configKeys = func() map[string]reflect.Type {
+	keys := make(map[string]reflect.Type)
+	collectConfigKeys(reflect.TypeOf(Config{}), "", keys)
+	return keys
+}()
+
+func collectConfigKeys(tp reflect.Type, prefix string, keys map[string]reflect.Type) {
+	for i := 0; i < tp.NumField(); i++ {
+		field := tp.Field(i)
+		name := strings.Split(field.Tag.Get("toml"), ",")[0]
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		isTable := fieldType.Kind() == reflect.Struct && !reflect.PtrTo(fieldType).Implements(textUnmarshalerType)
+		switch {
+		case field.Anonymous && len(name) == 0 && field.Type.Kind() == reflect.Struct:
+			// embedded structs are flattened, e.g. the LogConfig in [lightning].
+			collectConfigKeys(fieldType, prefix, keys)
+		case len(name) == 0 || name == "-":
+		case isTable:
+			collectConfigKeys(fieldType, prefix+name+".", keys)
+		default:
+			keys[prefix+name] = field.Type
+		}
+	}
+}
+
+// annotateDecodeError tells which key has the invalid value when the config
+// file cannot be decoded, as the errors of the TOML decoder only describe the
+// value.
+func annotateDecodeError(data string, err error) error {
+	var raw map[string]interface{}
+	if _, e := toml.Decode(data, &raw); e != nil {
+		// a syntax error, which tells the line already.
+		return errors.Trace(err)
+	}
+
+	keys := make([]string, 0, len(configKeys))
+	for key := range configKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, ok := lookupRawValue(raw, key)
+		if !ok {
+			continue
+		}
+		if e := checkRawValue(configKeys[key], value); e != nil {
+			return errors.Errorf("invalid config: `%s`: %v", key, e)
+		}
+	}
+	return errors.Trace(err)
+}
+
+func lookupRawValue(raw map[string]interface{}, key string) (interface{}, bool) {
+	path := strings.Split(key, ".")
+	for _, name := range path[:len(path)-1] {
+		table, ok := raw[name].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		raw = table
+	}
+	value, ok := raw[path[len(path)-1]]
+	return value, ok
+}
+
+// checkRawValue checks the decoded TOML value can be assigned to the type.
+func checkRawValue(tp reflect.Type, value interface{}) error {
+	if reflect.PtrTo(tp).Implements(textUnmarshalerType) {
+		var text string
+		switch v := value.(type) {
+		case string:
+			text = v
+		case int64, float64, bool:
+			text = fmt.Sprint(v)
+		default:
+			return errors.Errorf("expected a string but found %T", value)
+		}
+		return reflect.New(tp).Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+	}
+
+	var ok bool
+	switch tp.Kind() {
+	case reflect.String:
+		_, ok = value.(string)
+	case reflect.Bool:
+		_, ok = value.(bool)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		_, ok = value.(int64)
+	case reflect.Float32, reflect.Float64:
+		switch value.(type) {
+		case int64, float64:
+			ok = true
+		}
+	default:
+		// the arrays and tables are left to the decoder.
+		return nil
+	}
+	if !ok {
+		return errors.Errorf("expected %s but found %T", tp.Kind(), value)
+	}
+	return nil
+}
+
+// envNameOf returns the environment variable overriding the config key.
+func envNameOf(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// envOverrides returns the overrides given by the environment variables, in
+// the form key=value, sorted by the keys. The variables with the prefix but
+// not naming any config key are ignored with a warning, as they may be meant
+// for another version of Lightning sharing the environment.
+func envOverrides(environ []string) []string {
+	envKeys := make(map[string]string, len(configKeys))
+	for key := range configKeys {
+		envKeys[envNameOf(key)] = key
+	}
+
+	var result []string
+	for _, env := range environ {
+		if !strings.HasPrefix(env, EnvPrefix) {
+			continue
+		}
+		parts := strings.SplitN(env, "=", 2)
+		key, ok := envKeys[parts[0]]
+		if !ok {
+			common.AppLogger.Warnf("ignored environment variable %s, which overrides no config key", parts[0])
+			continue
+		}
+		value := ""
+		if len(parts) > 1 {
+			value = parts[1]
+		}
+		result = append(result, key+"="+value)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// applyOverride sets the config key to the value. String values are taken
+// literally, and the others are parsed as TOML values, e.g. `true`, `4` or
+// `["a", "b"]`. Returns the key being overridden.
+func (cfg *Config) applyOverride(override string) (string, error) {
+	parts := strings.SplitN(override, "=", 2)
+	key, value := strings.TrimSpace(parts[0]), parts[1]
+	tp, ok := configKeys[key]
+	if !ok {
+		return "", errors.Errorf("invalid override: unknown config key `%s`", key)
+	}
+	if tp.Kind() == reflect.String || reflect.PtrTo(tp).Implements(textUnmarshalerType) {
+		value = strconv.Quote(value)
+	}
+
+	var doc string
+	if dot := strings.LastIndexByte(key, '.'); dot >= 0 {
+		doc = "[" + key[:dot] + "]\n" + key[dot+1:] + " = " + value
+	} else {
+		doc = key + " = " + value
+	}
+	if _, err := toml.Decode(doc, cfg); err != nil {
+		return "", errors.Annotatef(err, "invalid override of `%s`", key)
+	}
+	return key, nil
+}
+
+// applyOverrides applies the environment variables and then the `-set` flags
+// on top of the config file. Returns the set of keys being overridden.
+func (cfg *Config) applyOverrides() (map[string]struct{}, error) {
+	keys := make(map[string]struct{})
+	for _, override := range append(envOverrides(os.Environ()), cfg.overrides...) {
+		key, err := cfg.applyOverride(override)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		keys[key] = struct{}{}
+	}
+	return keys, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/pingcap/check"
+)
+
+var _ = Suite(&overrideSuite{})
+
+type overrideSuite struct{}
+
+func (s *overrideSuite) TestEnvNameOf(c *C) {
+	c.Assert(envNameOf("tikv-importer.backend"), Equals, "TIDB_LIGHTNING_TIKV_IMPORTER_BACKEND")
+	c.Assert(envNameOf("lightning.level"), Equals, "TIDB_LIGHTNING_LIGHTNING_LEVEL")
+	// the keys of the embedded log config are in [lightning].
+	_, ok := configKeys["lightning.level"]
+	c.Assert(ok, IsTrue)
+}
+
+func (s *overrideSuite) TestEnvOverrides(c *C) {
+	overrides := envOverrides([]string{
+		"PATH=/usr/bin",
+		"TIDB_LIGHTNING_TIKV_IMPORTER_BACKEND=local",
+		"TIDB_LIGHTNING_NO_SUCH_KEY=1",
+		"TIDB_LIGHTNING_LIGHTNING_TABLE_CONCURRENCY=4",
+		"TIDB_LIGHTNING_TIDB_PASSWORD=",
+	})
+	c.Assert(overrides, DeepEquals, []string{
+		"lightning.table-concurrency=4",
+		"tidb.password=",
+		"tikv-importer.backend=local",
+	})
+}
+
+func (s *overrideSuite) TestApplyOverride(c *C) {
+	cfg := NewConfig()
+	apply := func(override string) error {
+		key, err := cfg.applyOverride(override)
+		if err == nil {
+			c.Assert(override, Matches, key+"=.*")
+		}
+		return err
+	}
+
+	c.Assert(apply("tikv-importer.backend=local"), IsNil)
+	c.Assert(cfg.TikvImporter.Backend, Equals, "local")
+	// the strings are taken literally.
+	c.Assert(apply("tidb.password=a\"b=c"), IsNil)
+	c.Assert(cfg.TiDB.Psw, Equals, "a\"b=c")
+	c.Assert(apply("lightning.table-concurrency=4"), IsNil)
+	c.Assert(cfg.App.TableConcurrency, Equals, 4)
+	c.Assert(apply("lightning.check-requirements=false"), IsNil)
+	c.Assert(cfg.App.CheckRequirements, IsFalse)
+	c.Assert(apply("mydumper.read-block-size=64KiB"), IsNil)
+	c.Assert(cfg.Mydumper.ReadBlockSize, Equals, ByteSize(64<<10))
+	c.Assert(apply("cron.switch-mode=90s"), IsNil)
+	c.Assert(cfg.Cron.SwitchMode.Duration, Equals, 90*time.Second)
+	c.Assert(apply(`post-restore.analyze-skip-tables=["db.a", "db.b"]`), IsNil)
+	c.Assert(cfg.PostRestore.AnalyzeSkipTables, DeepEquals, []string{"db.a", "db.b"})
+
+	c.Assert(apply("no-such.key=1"), ErrorMatches, "invalid override: unknown config key `no-such.key`")
+	c.Assert(apply("lightning.table-concurrency=many"), ErrorMatches, "invalid override of `lightning.table-concurrency`.*")
+	c.Assert(apply("mydumper.read-block-size=64XB"), ErrorMatches, "invalid override of `mydumper.read-block-size`.*")
+
+	var flags overrides
+	c.Assert(flags.Set("tidb.port=4000"), IsNil)
+	c.Assert(flags.Set("tidb.port"), ErrorMatches, ".*not in the form key=value")
+	c.Assert(flags.String(), Equals, "tidb.port=4000")
+}
+
+func (s *overrideSuite) TestOverridePrecedence(c *C) {
+	path := filepath.Join(c.MkDir(), "config.toml")
+	content := "[lightning]\ntable-concurrency = 6\nio-concurrency = 3\nregion-concurrency = 2\n"
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+
+	c.Assert(os.Setenv("TIDB_LIGHTNING_LIGHTNING_TABLE_CONCURRENCY", "7"), IsNil)
+	defer os.Unsetenv("TIDB_LIGHTNING_LIGHTNING_TABLE_CONCURRENCY")
+	c.Assert(os.Setenv("TIDB_LIGHTNING_LIGHTNING_IO_CONCURRENCY", "4"), IsNil)
+	defer os.Unsetenv("TIDB_LIGHTNING_LIGHTNING_IO_CONCURRENCY")
+	c.Assert(os.Setenv("TIDB_LIGHTNING_UNKNOWN", "1"), IsNil)
+	defer os.Unsetenv("TIDB_LIGHTNING_UNKNOWN")
+
+	// the file < the environment variables < `-set`.
+	cfg, err := LoadConfig([]string{"-config", path, "-set", "lightning.table-concurrency=8"})
+	c.Assert(err, IsNil)
+	c.Assert(cfg.App.TableConcurrency, Equals, 8)
+	c.Assert(cfg.App.IOConcurrency, Equals, 4)
+	c.Assert(cfg.App.RegionConcurrency, Equals, 2)
+
+	// the overrides are kept on reload.
+	c.Assert(ioutil.WriteFile(path, []byte("[lightning]\nregion-concurrency = 3\n"), 0644), IsNil)
+	cfg, err = cfg.Reload()
+	c.Assert(err, IsNil)
+	c.Assert(cfg.App.TableConcurrency, Equals, 8)
+	c.Assert(cfg.App.RegionConcurrency, Equals, 3)
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+const (
+	ProfileSmallCluster = "small-cluster"
+	ProfileLargeCluster = "large-cluster"
+	ProfileLowMemory    = "low-memory"
+)
+
+// profiles are the built-in presets chosen by `-profile`, in the form of
+// overrides. They are applied before the config file, so every key given in
+// the file, the environment variables or the `-set` flags takes precedence.
+var profiles = map[string][]string{
+	// a few TiKV stores, which cannot ingest many engines at the same time.
+	ProfileSmallCluster: {
+		"lightning.table-concurrency=4",
+		"lightning.io-concurrency=5",
+		"mydumper.batch-size=50GiB",
+		"mydumper.read-block-size=64KiB",
+		"tikv-importer.write-streams=1",
+	},
+	// dozens of TiKV stores, and a host with plenty of CPUs and memory.
+	ProfileLargeCluster: {
+		"lightning.table-concurrency=16",
+		"lightning.io-concurrency=10",
+		"mydumper.batch-size=200GiB",
+		"mydumper.read-block-size=256KiB",
+		"tikv-importer.write-streams=4",
+		"post-restore.checksum-concurrency=4",
+	},
+	// a host shared with other services, keeping few rows in memory.
+	ProfileLowMemory: {
+		"lightning.table-concurrency=2",
+		"lightning.region-concurrency=2",
+		"lightning.io-concurrency=2",
+		"lightning.encode-concurrency=1",
+		"mydumper.batch-size=10GiB",
+		"mydumper.read-block-size=16KiB",
+		"tikv-importer.write-streams=1",
+	},
+}
+
+// profileNames returns the names of the built-in profiles, sorted.
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile applies the built-in profile, if any. Returns the set of keys
+// being preset.
+func (cfg *Config) applyProfile() (map[string]struct{}, error) {
+	keys := make(map[string]struct{})
+	if len(cfg.profile) == 0 {
+		return keys, nil
+	}
+	presets, ok := profiles[cfg.profile]
+	if !ok {
+		return nil, errors.Errorf("invalid flag: unknown `-profile` (%s), values can be [%s]", cfg.profile, strings.Join(profileNames(), ", "))
+	}
+	for _, preset := range presets {
+		key, err := cfg.applyOverride(preset)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		keys[key] = struct{}{}
+	}
+	return keys, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/pingcap/check"
+)
+
+var _ = Suite(&profileSuite{})
+
+type profileSuite struct{}
+
+func (s *profileSuite) TestProfilesValid(c *C) {
+	c.Assert(profileNames(), DeepEquals, []string{ProfileLargeCluster, ProfileLowMemory, ProfileSmallCluster})
+	for _, name := range profileNames() {
+		cfg := NewConfig()
+		cfg.profile = name
+		keys, err := cfg.applyProfile()
+		c.Assert(err, IsNil, Commentf("profile %s", name))
+		c.Assert(keys, HasLen, len(profiles[name]))
+	}
+
+	cfg := NewConfig()
+	keys, err := cfg.applyProfile()
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 0)
+	c.Assert(cfg, DeepEquals, NewConfig())
+
+	cfg.profile = "huge-cluster"
+	_, err = cfg.applyProfile()
+	c.Assert(err, ErrorMatches, "invalid flag: unknown `-profile` \\(huge-cluster\\), values can be \\[large-cluster, low-memory, small-cluster\\]")
+}
+
+func (s *profileSuite) TestProfilePrecedence(c *C) {
+	path := filepath.Join(c.MkDir(), "config.toml")
+	c.Assert(ioutil.WriteFile(path, []byte("[lightning]\ntable-concurrency = 6\n"), 0644), IsNil)
+
+	cfg, err := LoadConfig([]string{"-config", path, "-profile", ProfileLowMemory, "-set", "lightning.io-concurrency=3"})
+	c.Assert(err, IsNil)
+	// the file and the overrides take precedence over the profile.
+	c.Assert(cfg.App.TableConcurrency, Equals, 6)
+	c.Assert(cfg.App.IOConcurrency, Equals, 3)
+	c.Assert(cfg.App.RegionConcurrency, Equals, 2)
+	c.Assert(cfg.Mydumper.BatchSize, Equals, ByteSize(10<<30))
+	c.Assert(cfg.Mydumper.ReadBlockSize, Equals, ByteSize(16<<10))
+
+	// the profile is kept on reload.
+	cfg, err = cfg.Reload()
+	c.Assert(err, IsNil)
+	c.Assert(cfg.App.RegionConcurrency, Equals, 2)
+}
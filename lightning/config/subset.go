@@ -0,0 +1,107 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+// Subset restricts the task to the tables given by the repeated `-table`
+// flags, and further to the engines given by the repeated `-engine` flags,
+// which requires exactly one table. The checkpoints are still respected, so
+// the finished parts are not restored again.
+type Subset struct {
+	Tables  tableList
+	Engines engineList
+}
+
+// tableList collects the repeated `-table db.tbl` flags, as the unique table
+// names, e.g. "`db`.`tbl`".
+type tableList []string
+
+func (l *tableList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *tableList) Set(value string) error {
+	dot := strings.IndexByte(value, '.')
+	if dot <= 0 || dot == len(value)-1 {
+		return errors.Errorf("%q is not in the form db.tbl", value)
+	}
+	*l = append(*l, common.UniqueTable(value[:dot], value[dot+1:]))
+	return nil
+}
+
+// engineList collects the repeated `-engine id` flags.
+type engineList []int
+
+func (l *engineList) String() string {
+	ids := make([]string, 0, len(*l))
+	for _, id := range *l {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	return strings.Join(ids, ",")
+}
+
+func (l *engineList) Set(value string) error {
+	id, err := strconv.Atoi(value)
+	if err != nil || id < 0 {
+		return errors.Errorf("%q is not a valid engine ID", value)
+	}
+	*l = append(*l, id)
+	return nil
+}
+
+// Enabled returns whether only a subset of the tables is restored.
+func (s *Subset) Enabled() bool {
+	return len(s.Tables) > 0
+}
+
+// HasTable returns whether the table, given by its unique name, is restored.
+func (s *Subset) HasTable(tableName string) bool {
+	if !s.Enabled() {
+		return true
+	}
+	for _, t := range s.Tables {
+		if t == tableName {
+			return true
+		}
+	}
+	return false
+}
+
+// HasEngine returns whether the data engine of a restored table is restored.
+func (s *Subset) HasEngine(engineID int) bool {
+	if len(s.Engines) == 0 {
+		return true
+	}
+	for _, id := range s.Engines {
+		if id == engineID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Subset) adjust() error {
+	if len(s.Engines) > 0 && len(s.Tables) != 1 {
+		return errors.New("invalid flag: `-engine` requires exactly one `-table`")
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+)
+
+// TimeWindow is a period of every day in the local time, like "22:00-06:00",
+// which may span midnight. The zero value is open all the time.
+type TimeWindow struct {
+	start time.Duration // since midnight
+	end   time.Duration
+	set   bool
+}
+
+func parseTimeOfDay(text string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(text))
+	if err != nil {
+		return 0, errors.Errorf("invalid time of day %q, must be in the form HH:MM", text)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w *TimeWindow) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*w = TimeWindow{}
+		return nil
+	}
+	parts := strings.Split(string(text), "-")
+	if len(parts) != 2 {
+		return errors.Errorf("invalid time window %q, must be in the form HH:MM-HH:MM", text)
+	}
+	start, err := parseTimeOfDay(parts[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	end, err := parseTimeOfDay(parts[1])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	*w = TimeWindow{start: start, end: end, set: true}
+	return nil
+}
+
+func (w *TimeWindow) String() string {
+	if !w.set {
+		return ""
+	}
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", int(w.start.Hours()), int(w.start.Minutes())%60, int(w.end.Hours()), int(w.end.Minutes())%60)
+}
+
+func (w *TimeWindow) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, w)), nil
+}
+
+// Next returns when the window is open next, which is `now` if it is open
+// already.
+func (w *TimeWindow) Next(now time.Time) time.Time {
+	if !w.set || w.start == w.end {
+		return now
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	var open bool
+	if w.start < w.end {
+		open = offset >= w.start && offset < w.end
+	} else {
+		open = offset >= w.start || offset < w.end
+	}
+	switch {
+	case open:
+		return now
+	case offset < w.start:
+		return midnight.Add(w.start)
+	default:
+		return midnight.AddDate(0, 0, 1).Add(w.start)
+	}
+}
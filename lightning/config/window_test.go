@@ -0,0 +1,78 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	. "github.com/pingcap/check"
+)
+
+var _ = Suite(&windowSuite{})
+
+type windowSuite struct{}
+
+func (s *windowSuite) TestParseTimeWindow(c *C) {
+	var w TimeWindow
+	c.Assert(w.UnmarshalText([]byte("22:00-06:30")), IsNil)
+	c.Assert(w.String(), Equals, "22:00-06:30")
+	c.Assert(w.UnmarshalText([]byte(" 9:05 - 17:00 ")), IsNil)
+	c.Assert(w.String(), Equals, "09:05-17:00")
+	data, err := json.Marshal(&w)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `"09:05-17:00"`)
+	c.Assert(w.UnmarshalText(nil), IsNil)
+	c.Assert(w.String(), Equals, "")
+
+	for _, text := range []string{"22:00", "22:00-06:00-08:00", "25:00-06:00", "22:00-6pm"} {
+		c.Assert(w.UnmarshalText([]byte(text)), NotNil, Commentf("%s", text))
+	}
+
+	var cfg struct {
+		App Lightning `toml:"lightning"`
+	}
+	_, err = toml.Decode("[lightning]\nmaintenance-window = \"01:00-05:00\"\n", &cfg)
+	c.Assert(err, IsNil)
+	c.Assert(cfg.App.MaintenanceWindow.String(), Equals, "01:00-05:00")
+}
+
+func (s *windowSuite) TestNextTimeWindow(c *C) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2019, time.June, 10, hour, minute, 0, 0, time.Local)
+	}
+	window := func(text string) *TimeWindow {
+		var w TimeWindow
+		c.Assert(w.UnmarshalText([]byte(text)), IsNil)
+		return &w
+	}
+
+	// always open without a window, or with an empty one.
+	c.Assert(window("").Next(at(12, 0)), Equals, at(12, 0))
+	c.Assert(window("08:00-08:00").Next(at(12, 0)), Equals, at(12, 0))
+
+	daytime := window("09:00-17:00")
+	c.Assert(daytime.Next(at(8, 59)), Equals, at(9, 0))
+	c.Assert(daytime.Next(at(9, 0)), Equals, at(9, 0))
+	c.Assert(daytime.Next(at(16, 59)), Equals, at(16, 59))
+	c.Assert(daytime.Next(at(17, 0)), Equals, at(9, 0).AddDate(0, 0, 1))
+
+	// spanning midnight.
+	night := window("22:00-06:00")
+	c.Assert(night.Next(at(23, 30)), Equals, at(23, 30))
+	c.Assert(night.Next(at(5, 59)), Equals, at(5, 59))
+	c.Assert(night.Next(at(6, 0)), Equals, at(22, 0))
+	c.Assert(night.Next(at(21, 0)), Equals, at(22, 0))
+}
@@ -15,24 +15,26 @@ package kv
 
 import "sync/atomic"
 
-// PanickingAllocator is an ID allocator which panics on all operations except Rebase
-type PanickingAllocator struct {
+// IDAllocator is an ID allocator kept in memory, which panics on all operations
+// except Alloc, Rebase and Base. The IDs are allocated one by one above the
+// base, which is moved past every ID given explicitly by Rebase.
+type IDAllocator struct {
 	base int64
 }
 
-func NewPanickingAllocator(base int64) *PanickingAllocator {
-	return &PanickingAllocator{base: base}
+func NewIDAllocator(base int64) *IDAllocator {
+	return &IDAllocator{base: base}
 }
 
-func (alloc *PanickingAllocator) Alloc(int64) (int64, error) {
-	panic("unexpected Alloc() call")
+func (alloc *IDAllocator) Alloc(int64) (int64, error) {
+	return atomic.AddInt64(&alloc.base, 1), nil
 }
 
-func (alloc *PanickingAllocator) Reset(newBase int64) {
+func (alloc *IDAllocator) Reset(newBase int64) {
 	panic("unexpected Reset() call")
 }
 
-func (alloc *PanickingAllocator) Rebase(tableID, newBase int64, allocIDs bool) error {
+func (alloc *IDAllocator) Rebase(tableID, newBase int64, allocIDs bool) error {
 	// CAS
 	for {
 		oldBase := atomic.LoadInt64(&alloc.base)
@@ -46,14 +48,14 @@ func (alloc *PanickingAllocator) Rebase(tableID, newBase int64, allocIDs bool) e
 	return nil
 }
 
-func (alloc *PanickingAllocator) Base() int64 {
+func (alloc *IDAllocator) Base() int64 {
 	return atomic.LoadInt64(&alloc.base)
 }
 
-func (alloc *PanickingAllocator) End() int64 {
+func (alloc *IDAllocator) End() int64 {
 	panic("unexpected End() call")
 }
 
-func (alloc *PanickingAllocator) NextGlobalAutoID(tableID int64) (int64, error) {
+func (alloc *IDAllocator) NextGlobalAutoID(tableID int64) (int64, error) {
 	panic("unexpected NextGlobalAutoID() call")
 }
@@ -0,0 +1,153 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"context"
+
+	sst "github.com/pingcap/kvproto/pkg/import_sstpb"
+	kvec "github.com/pingcap/tidb/util/kvencoder"
+	"github.com/satori/go.uuid"
+)
+
+// RowsFormat is the form of the rows taken by a backend.
+type RowsFormat int
+
+const (
+	// RowsFormatKV means the backend takes KVRows, the KV pairs encoded from
+	// the rows.
+	RowsFormatKV RowsFormat = iota
+	// RowsFormatSQL means the backend takes SQLRows, the INSERT statement of
+	// the rows, and writes them through TiDB. TiKV is left alone, so it is
+	// neither switched into import mode nor compacted.
+	RowsFormatSQL
+)
+
+// Rows is a batch of rows written into an engine, either KVRows or SQLRows
+// according to the RowsFormat of the backend.
+type Rows interface {
+	// Size returns the number of bytes of the rows.
+	Size() int
+}
+
+// KVRows is the KV pairs encoded from the rows.
+type KVRows []kvec.KvPair
+
+// Size implements Rows.
+func (rows KVRows) Size() int {
+	size := 0
+	for _, pair := range rows {
+		size += len(pair.Key) + len(pair.Val)
+	}
+	return size
+}
+
+// SQLRows is an INSERT (or REPLACE) statement of the rows.
+type SQLRows string
+
+// Size implements Rows.
+func (rows SQLRows) Size() int {
+	return len(rows)
+}
+
+// Backend writes the rows into the TiKV cluster. The rows are written into
+// engines identified by UUIDs, each going through
+// OpenEngine -> WriteRows -> CloseEngine -> ImportEngine -> CleanupEngine.
+//
+// The importer, local and TiDB backends are provided by NewImporter,
+// NewLocalImporter and NewTiDBImporter. Other implementations can be used via
+// NewBackendImporter. All methods must be goroutine safe.
+type Backend interface {
+	// Close releases the resources of the backend.
+	Close()
+
+	// RowsFormat returns the form of the rows taken by WriteRows.
+	RowsFormat() RowsFormat
+
+	// CheckRequirements verifies the backend is ready to import.
+	CheckRequirements(ctx context.Context) error
+
+	// SwitchMode switches the TiKV cluster to another operation mode.
+	SwitchMode(ctx context.Context, mode sst.SwitchMode) error
+
+	// Compact the TiKV cluster to the given level.
+	Compact(ctx context.Context, level int32) error
+
+	// OpenEngine prepares the engine for writing. Opening an engine which has
+	// been opened or closed before should succeed, which happens when
+	// resuming from a checkpoint.
+	OpenEngine(ctx context.Context, engineUUID uuid.UUID) error
+
+	// WriteRows writes the rows into the opened engine. They are durable
+	// once WriteRows returns, unless the backend is an EngineFlusher. The KV
+	// pairs are committed at `commitTs` if the backend does not allocate it.
+	// The memory of the rows is reused after WriteRows returns, so the backend
+	// must not retain them.
+	WriteRows(ctx context.Context, engineUUID uuid.UUID, commitTs uint64, rows Rows) error
+
+	// CloseEngine stops writing into the engine. ErrEngineLost is returned
+	// if the data written into the engine is gone.
+	CloseEngine(ctx context.Context, engineUUID uuid.UUID) error
+
+	// ImportEngine ingests the closed engine into TiKV. It may be retried
+	// after failure.
+	ImportEngine(ctx context.Context, engineUUID uuid.UUID) error
+
+	// CleanupEngine removes the data of the imported engine.
+	CleanupEngine(ctx context.Context, engineUUID uuid.UUID) error
+}
+
+// EngineAssigner is implemented by the backends distributing the engines
+// among several servers. The data of an engine stay on its server until it is
+// cleaned up, so the assignment is saved into the checkpoint, and given back
+// to the backend when resuming.
+type EngineAssigner interface {
+	// AssignEngine binds the engine to the server `addr`, or to a server
+	// chosen by the backend if `addr` is empty and the engine is not yet
+	// assigned. It returns the assigned server, or ErrEngineLost if `addr` is
+	// no longer used by the backend.
+	AssignEngine(engineUUID uuid.UUID, addr string) (string, error)
+}
+
+// RangeCompactor is implemented by the backends which can compact a key range
+// of the TiKV cluster, so a long compaction can be split into parts.
+type RangeCompactor interface {
+	// CompactRange compacts the keys in [start, end) to the given level.
+	CompactRange(ctx context.Context, level int32, start, end []byte) error
+}
+
+// EngineFlusher is implemented by the backends which buffer the written rows,
+// so that they are made durable in batches rather than by every WriteRows.
+type EngineFlusher interface {
+	// FlushEngine makes the rows written into the opened engine durable.
+	FlushEngine(ctx context.Context, engineUUID uuid.UUID) error
+}
+
+// DiskUsageReporter is implemented by the backends which can tell the usage of
+// the disk storing the engines, so that new engines are not written while the
+// disk is almost full.
+type DiskUsageReporter interface {
+	// DiskUsage returns the number of used bytes and the capacity of the disk.
+	DiskUsage(ctx context.Context) (used uint64, capacity uint64, err error)
+}
+
+// EngineStatsReporter is implemented by the backends which can count the KV
+// pairs stored in an engine, so a resumed engine can be checked against the
+// checkpoint.
+type EngineStatsReporter interface {
+	// EngineStats returns the number and the total size of the distinct KV
+	// pairs in the engine. ErrEngineLost is returned if the engine does not
+	// exist.
+	EngineStats(ctx context.Context, engineUUID uuid.UUID) (kvs uint64, size uint64, err error)
+}
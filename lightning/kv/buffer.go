@@ -0,0 +1,80 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"sync"
+
+	"github.com/pingcap/tidb-lightning/lightning/metric"
+)
+
+const (
+	// kvBufferSize is the size of the pooled buffers holding the KV pairs.
+	// the KV pairs of a block are usually a few hundred KB.
+	kvBufferSize = 256 << 10
+	// pairs larger than this are allocated on their own, so a few huge
+	// values won't waste most of the pooled buffers.
+	maxPooledPairSize = kvBufferSize / 4
+)
+
+type kvBuffer struct {
+	data []byte
+	used int
+}
+
+var kvBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &kvBuffer{data: make([]byte, kvBufferSize)}
+	},
+}
+
+// KVBuffers is the memory holding the KV pairs encoded by Datums2KV. Instead of
+// allocating every pair separately, the pairs are packed into buffers taken
+// from a pool, which are returned by Recycle once the pairs are delivered.
+// The pairs must not be used after recycling.
+type KVBuffers struct {
+	bufs []*kvBuffer
+}
+
+// alloc returns a slice of `size` bytes for a KV pair.
+func (b *KVBuffers) alloc(size int) []byte {
+	if size > maxPooledPairSize {
+		return make([]byte, size)
+	}
+	if len(b.bufs) == 0 || b.bufs[len(b.bufs)-1].used+size > kvBufferSize {
+		b.bufs = append(b.bufs, kvBufferPool.Get().(*kvBuffer))
+		metric.KVBufferBytesGauge.Add(kvBufferSize)
+	}
+	buf := b.bufs[len(b.bufs)-1]
+	start := buf.used
+	buf.used += size
+	return buf.data[start:buf.used:buf.used]
+}
+
+// Merge moves the buffers of `other` into b, so that they are recycled
+// together.
+func (b *KVBuffers) Merge(other *KVBuffers) {
+	b.bufs = append(b.bufs, other.bufs...)
+	other.bufs = nil
+}
+
+// Recycle returns the buffers to the pool.
+func (b *KVBuffers) Recycle() {
+	for _, buf := range b.bufs {
+		buf.used = 0
+		kvBufferPool.Put(buf)
+	}
+	metric.KVBufferBytesGauge.Sub(float64(len(b.bufs) * kvBufferSize))
+	b.bufs = nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	. "github.com/pingcap/check"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/pingcap/tidb-lightning/lightning/metric"
+)
+
+var _ = Suite(&bufferSuite{})
+
+type bufferSuite struct{}
+
+func readKVBufferBytes(c *C) float64 {
+	var m dto.Metric
+	c.Assert(metric.KVBufferBytesGauge.Write(&m), IsNil)
+	return m.Gauge.GetValue()
+}
+
+func (s *bufferSuite) TestKVBuffers(c *C) {
+	base := readKVBufferBytes(c)
+
+	var buffers KVBuffers
+	a := buffers.alloc(10)
+	b := buffers.alloc(20)
+	c.Assert(a, HasLen, 10)
+	c.Assert(cap(a), Equals, 10) // appending to a won't overwrite b
+	c.Assert(b, HasLen, 20)
+	c.Assert(buffers.bufs, HasLen, 1)
+	c.Assert(readKVBufferBytes(c), Equals, base+kvBufferSize)
+
+	// a new buffer is taken when the last one is full.
+	for i := 0; i < kvBufferSize/maxPooledPairSize; i++ {
+		buffers.alloc(maxPooledPairSize)
+	}
+	c.Assert(buffers.bufs, HasLen, 2)
+	// the huge pairs are allocated separately.
+	c.Assert(buffers.alloc(maxPooledPairSize+1), HasLen, maxPooledPairSize+1)
+	c.Assert(buffers.bufs, HasLen, 2)
+
+	var merged KVBuffers
+	merged.Merge(&buffers)
+	c.Assert(buffers.bufs, HasLen, 0)
+	c.Assert(merged.bufs, HasLen, 2)
+	merged.Recycle()
+	c.Assert(merged.bufs, HasLen, 0)
+	c.Assert(readKVBufferBytes(c), Equals, base)
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/charset"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/table/tables"
+	"github.com/pingcap/tidb/types"
+	kvec "github.com/pingcap/tidb/util/kvencoder"
+)
+
+// With the new collation framework enabled, TiDB encodes the index keys of
+// string columns by their collation keys instead of the raw bytes. The binary
+// collation keeps the raw bytes, and the other `_bin` collations only trim the
+// trailing spaces (PAD SPACE). The keys of the case-insensitive collations
+// (utf8mb4_general_ci, utf8mb4_unicode_ci, ...) are weights from the tables of
+// TiDB which the vendored version does not have, so tables indexing such
+// columns cannot be encoded, and have to be imported by the TiDB backend.
+var paddingBinCollations = map[string]struct{}{
+	"utf8mb4_bin": {},
+	"utf8_bin":    {},
+	"ascii_bin":   {},
+	"latin1_bin":  {},
+}
+
+// columnCollation returns the collation of the column, or the default one of
+// its charset if unspecified.
+func columnCollation(col *model.ColumnInfo) string {
+	if len(col.Collate) > 0 {
+		return strings.ToLower(col.Collate)
+	}
+	collation, err := charset.GetDefaultCollation(col.Charset)
+	if err != nil {
+		return col.Charset
+	}
+	return collation
+}
+
+// isStringColumn returns whether the column is encoded as a string in the
+// index, to which the collation applies.
+func isStringColumn(col *model.ColumnInfo) bool {
+	return types.IsString(col.Tp)
+}
+
+// CheckNewCollation checks whether the indices of the table can be encoded
+// under the new collation framework.
+func CheckNewCollation(tableInfo *model.TableInfo) error {
+	_, err := paddedIndices(tableInfo)
+	return errors.Trace(err)
+}
+
+// paddedIndices returns whether each index of the table, in the order of
+// tableInfo.Indices, contains columns with PAD SPACE `_bin` collations, whose
+// keys need to be trimmed under the new collation framework.
+func paddedIndices(tableInfo *model.TableInfo) ([]bool, error) {
+	padded := make([]bool, len(tableInfo.Indices))
+	for i, idx := range tableInfo.Indices {
+		for _, ic := range idx.Columns {
+			col := tableInfo.Columns[ic.Offset]
+			if !isStringColumn(col) {
+				continue
+			}
+			collation := columnCollation(col)
+			if collation == charset.CollationBin {
+				continue
+			}
+			if _, ok := paddingBinCollations[collation]; !ok {
+				return nil, errors.Errorf(
+					"index %s of table %s uses column %s with collation %s, which is not supported when new collation is enabled",
+					idx.Name.O, tableInfo.Name.O, col.Name.O, collation,
+				)
+			}
+			padded[i] = true
+		}
+	}
+	return padded, nil
+}
+
+// EnableNewCollation makes the encoder produce the index keys the same as a
+// TiDB cluster with the new collation framework enabled. It returns an error
+// if the table indexes a column whose collation is not supported.
+func (kvcodec *TableKVEncoder) EnableNewCollation() error {
+	padded, err := paddedIndices(kvcodec.tbl.Meta())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	kvcodec.paddedIndices = nil
+	for i, idx := range kvcodec.tbl.WritableIndices() {
+		for j, idxInfo := range kvcodec.tbl.Meta().Indices {
+			if idxInfo.ID == idx.Meta().ID && padded[j] {
+				kvcodec.paddedIndices = append(kvcodec.paddedIndices, i)
+			}
+		}
+	}
+	return nil
+}
+
+// trimPaddedIndexKeys regenerates the keys of the indices containing PAD SPACE
+// columns with the trailing spaces trimmed. tables.AddRecord writes the index
+// entries first, in the order of WritableIndices, and then the record.
+func (kvcodec *TableKVEncoder) trimPaddedIndexKeys(kvPairs []kvec.KvPair, row []types.Datum, handle int64) error {
+	indices := kvcodec.tbl.WritableIndices()
+	if len(kvPairs) != len(indices)+1 {
+		return errors.Errorf("unexpected %d KV pairs for a row of table %s", len(kvPairs), kvcodec.table)
+	}
+	meta := kvcodec.tbl.Meta()
+	sc := kvcodec.se.GetSessionVars().StmtCtx
+	for _, i := range kvcodec.paddedIndices {
+		idx := indices[i]
+		vals, err := idx.FetchValues(row, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		// the prefix is cut before trimming, the same as TiDB.
+		vals = tables.TruncateIndexValuesIfNeeded(meta, idx.Meta(), vals)
+		for j, ic := range idx.Meta().Columns {
+			col := meta.Columns[ic.Offset]
+			if !isStringColumn(col) || columnCollation(col) == charset.CollationBin {
+				continue
+			}
+			switch vals[j].Kind() {
+			case types.KindString:
+				vals[j].SetString(strings.TrimRight(vals[j].GetString(), " "))
+			case types.KindBytes:
+				vals[j].SetBytes([]byte(strings.TrimRight(string(vals[j].GetBytes()), " ")))
+			}
+		}
+		key, _, err := idx.GenIndexKey(sc, vals, handle, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		kvPairs[i].Key = key
+	}
+	return nil
+}
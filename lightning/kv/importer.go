@@ -22,19 +22,28 @@ import (
 
 	"github.com/pingcap/errors"
 	"github.com/satori/go.uuid"
-	"google.golang.org/grpc"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
-	kv "github.com/pingcap/kvproto/pkg/import_kvpb"
 	sst "github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/tidb-lightning/lightning/common"
 	"github.com/pingcap/tidb-lightning/lightning/metric"
-	kvec "github.com/pingcap/tidb/util/kvencoder"
 )
 
-const (
-	maxRetryTimes    int = 3 // tikv-importer has done retry internally. so we don't retry many times.
-	retryBackoffTime     = time.Second * 3
-)
+// ErrEngineLost means the engine is no longer opened in tikv-importer, which
+// happens when tikv-importer restarts while the engine is being written. An
+// unclosed engine is removed when tikv-importer restarts, so everything
+// written into it is lost, and it must be written again from the beginning.
+var ErrEngineLost = errors.New("engine not found in tikv-importer, probably because tikv-importer has restarted")
+
+// IsEngineLostError checks whether the error is caused by losing the engine
+// or the connection to tikv-importer, so that the engine should be written
+// again after tikv-importer comes back.
+func IsEngineLostError(err error) bool {
+	err = errors.Cause(err)
+	return err == ErrEngineLost || status.Code(err) == codes.Unavailable
+}
 
 /*
 
@@ -50,13 +59,9 @@ Usual workflow:
 
 		a. Create an `OpenedEngine` via `importer.OpenEngine()`
 
-		b. For each chunk,
-
-			i. Create a `WriteStream` via `engine.NewWriteStream()`
-			ii. Deliver data into the stream via `stream.Put()`
-			iii. Close the stream via `stream.Close()`
+		b. For each chunk, deliver the rows into the engine via `engine.WriteRows()`
 
-		c. When all chunks are written, obtain a `ClosedEngine` via `engine.CloseEngine()`
+		c. When all chunks are written, obtain a `ClosedEngine` via `engine.Close()`
 
 		d. Import data via `engine.Import()`
 
@@ -66,45 +71,118 @@ Usual workflow:
 
 */
 
-// Importer represents a gRPC connection to tikv-importer. This type is
-// goroutine safe: you can share this instance and execute any method anywhere.
+// Importer drives a Backend to import the rows into the TiKV cluster. This
+// type is goroutine safe: you can share this instance and execute any method
+// anywhere.
 type Importer struct {
-	conn   *grpc.ClientConn
-	cli    kv.ImportKVClient
-	pdAddr string
+	backend  Backend
+	limiter  common.RateLimiter // limits the bytes written into all engines
+	registry *EngineRegistry    // nil if the engines are not recorded
+}
+
+// NewBackendImporter creates an importer using the given backend.
+func NewBackendImporter(backend Backend) *Importer {
+	return &Importer{backend: backend}
 }
 
 // NewImporter creates a new connection to tikv-importer. A single connection
 // per tidb-lightning instance is enough.
-func NewImporter(ctx context.Context, importServerAddr string, pdAddr string) (*Importer, error) {
-	conn, err := grpc.DialContext(ctx, importServerAddr, grpc.WithInsecure())
+func NewImporter(ctx context.Context, tls *common.TLS, importServerAddr string, pdAddr string, opts ImporterOptions) (*Importer, error) {
+	backend, err := newImporterBackend(ctx, tls, importServerAddr, pdAddr, opts)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	return NewBackendImporter(backend), nil
+}
 
-	return &Importer{
-		conn:   conn,
-		cli:    kv.NewImportKVClient(conn),
-		pdAddr: pdAddr,
-	}, nil
+// NewLocalImporter creates an importer which sorts the KV pairs in
+// `sortedKVDir`, and ingests them into the TiKV cluster managed by the PD at
+// `pdAddr` directly.
+func NewLocalImporter(ctx context.Context, tls *common.TLS, pdAddr string, sortedKVDir string) (*Importer, error) {
+	backend, err := newLocalBackend(tls, pdAddr, sortedKVDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return NewBackendImporter(backend), nil
+}
+
+// CanCompactRange returns whether CompactRange is supported by the backend.
+func (importer *Importer) CanCompactRange() bool {
+	_, ok := importer.backend.(RangeCompactor)
+	return ok
+}
+
+// CompactRange compacts the keys in [start, end) of the target cluster. It
+// must not be called unless CanCompactRange returns true.
+func (importer *Importer) CompactRange(ctx context.Context, level int32, start, end []byte) error {
+	return errors.Trace(importer.backend.(RangeCompactor).CompactRange(ctx, level, start, end))
+}
+
+// CanReportDiskUsage returns whether DiskUsage is supported by the backend.
+func (importer *Importer) CanReportDiskUsage() bool {
+	_, ok := importer.backend.(DiskUsageReporter)
+	return ok
+}
+
+// DiskUsage returns the number of used bytes and the capacity of the disk
+// storing the engines, or zeros if the backend cannot tell.
+func (importer *Importer) DiskUsage(ctx context.Context) (used uint64, capacity uint64, err error) {
+	reporter, ok := importer.backend.(DiskUsageReporter)
+	if !ok {
+		return 0, 0, nil
+	}
+	used, capacity, err = reporter.DiskUsage(ctx)
+	return used, capacity, errors.Trace(err)
+}
+
+// CanReportEngineStats returns whether EngineStats is supported by the
+// backend.
+func (importer *Importer) CanReportEngineStats() bool {
+	_, ok := importer.backend.(EngineStatsReporter)
+	return ok
+}
+
+// EngineStats returns the number and the total size of the KV pairs in the
+// engine. It must not be called unless CanReportEngineStats returns true.
+func (importer *Importer) EngineStats(ctx context.Context, tableName string, engineID int) (kvs uint64, size uint64, err error) {
+	engineUUID := uuid.NewV5(engineNamespace, makeTag(tableName, engineID))
+	kvs, size, err = importer.backend.(EngineStatsReporter).EngineStats(ctx, engineUUID)
+	return kvs, size, errors.Trace(err)
 }
 
-// Close the importer connection.
+// SetEngineRegistry records the engines opened by this importer into the
+// registry until they are cleaned up. This must be called before any engine is
+// opened.
+func (importer *Importer) SetEngineRegistry(registry *EngineRegistry) {
+	importer.registry = registry
+}
+
+// SetWriteBandwidthLimit limits the total number of bytes per second written
+// into all engines. A non-positive limit means unlimited. This can be called
+// while the rows are being written.
+func (importer *Importer) SetWriteBandwidthLimit(bytesPerSecond int64) {
+	importer.limiter.SetRate(bytesPerSecond)
+}
+
+// Close the backend.
 func (importer *Importer) Close() {
-	importer.conn.Close()
+	importer.backend.Close()
+}
+
+// RowsFormat returns the form of the rows taken by the backend.
+func (importer *Importer) RowsFormat() RowsFormat {
+	return importer.backend.RowsFormat()
+}
+
+// CheckRequirements verifies the backend is ready to import.
+func (importer *Importer) CheckRequirements(ctx context.Context) error {
+	return errors.Trace(importer.backend.CheckRequirements(ctx))
 }
 
 // SwitchMode switches the TiKV cluster to another operation mode.
 func (importer *Importer) SwitchMode(ctx context.Context, mode sst.SwitchMode) error {
-	req := &kv.SwitchModeRequest{
-		PdAddr: importer.pdAddr,
-		Request: &sst.SwitchModeRequest{
-			Mode: mode,
-		},
-	}
 	timer := time.Now()
-
-	_, err := importer.cli.SwitchMode(ctx, req)
+	err := importer.backend.SwitchMode(ctx, mode)
 	if err != nil {
 		if strings.Contains(err.Error(), "status: Unimplemented") {
 			fmt.Fprintln(os.Stderr, "Error: The TiKV instance does not support mode switching. Please make sure the TiKV version is 2.0.4 or above.")
@@ -119,42 +197,35 @@ func (importer *Importer) SwitchMode(ctx context.Context, mode sst.SwitchMode) e
 // Compact the target cluster for better performance.
 func (importer *Importer) Compact(ctx context.Context, level int32) error {
 	common.AppLogger.Infof("compact level %d", level)
-
-	req := &kv.CompactClusterRequest{
-		PdAddr: importer.pdAddr,
-		Request: &sst.CompactRequest{
-			// No need to set Range here.
-			OutputLevel: level,
-		},
-	}
 	timer := time.Now()
-	_, err := importer.cli.CompactCluster(ctx, req)
+	err := importer.backend.Compact(ctx, level)
 	common.AppLogger.Infof("compact level %d takes %v", level, time.Since(timer))
-
 	return errors.Trace(err)
 }
 
-// OpenedEngine is an opened importer engine file, allowing data to be written
-// to it via WriteStream instances.
+// AssignEngine binds the engine to the server `addr` of the backend, or to
+// any server if `addr` is empty, and returns the assigned server. It returns
+// an empty string if the backend does not distribute the engines.
+func (importer *Importer) AssignEngine(tableName string, engineID int, addr string) (string, error) {
+	assigner, ok := importer.backend.(EngineAssigner)
+	if !ok {
+		return "", nil
+	}
+	engineUUID := uuid.NewV5(engineNamespace, makeTag(tableName, engineID))
+	assigned, err := assigner.AssignEngine(engineUUID, addr)
+	return assigned, errors.Trace(err)
+}
+
+// OpenedEngine is an opened engine, allowing data to be written to it via
+// WriteRows.
 type OpenedEngine struct {
 	importer *Importer
+	logger   *log.Entry
 	tag      string
 	uuid     uuid.UUID
 	ts       uint64
 }
 
-// isIgnorableOpenCloseEngineError checks if the error from
-// OpenEngine/CloseEngine can be safely ignored.
-func isIgnorableOpenCloseEngineError(err error) bool {
-	// We allow "FileExists" error. This happens when the engine has been opened
-	// and closed before. This error typically arise when resuming from a
-	// checkpoint with a partially-imported engine.
-	//
-	// If the error is legit in a no-checkpoints settings, the later WriteEngine
-	// API will bail us out to keep us safe.
-	return err == nil || strings.Contains(err.Error(), "FileExists")
-}
-
 func makeTag(tableName string, engineID int) string {
 	return fmt.Sprintf("%s:%d", tableName, engineID)
 }
@@ -170,17 +241,23 @@ func (importer *Importer) OpenEngine(
 ) (*OpenedEngine, error) {
 	tag := makeTag(tableName, engineID)
 	engineUUID := uuid.NewV5(engineNamespace, tag)
-	req := &kv.OpenEngineRequest{
-		Uuid: engineUUID.Bytes(),
+	logger := common.EngineLogger(tableName, engineID)
+	// record the engine before opening it, so it is never left untracked.
+	if importer.registry != nil {
+		if err := importer.registry.add(tableName, engineID, engineUUID); err != nil {
+			logger.Warnf("cannot record engine %s into the registry: %v", engineUUID, err)
+		}
 	}
-	_, err := importer.cli.OpenEngine(ctx, req)
-	if !isIgnorableOpenCloseEngineError(err) {
+	err := common.Retry(ctx, fmt.Sprintf("[%s] open engine", tag), func() error {
+		return importer.backend.OpenEngine(ctx, engineUUID)
+	})
+	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
 	openCounter := metric.EngineCounter.WithLabelValues("open")
 	openCounter.Inc()
-	common.AppLogger.Infof("[%s] open engine %s", tag, engineUUID)
+	logger.Infof("open engine %s", engineUUID)
 
 	// gofail: var FailIfEngineCountExceeds int
 	// {
@@ -197,112 +274,58 @@ func (importer *Importer) OpenEngine(
 
 	return &OpenedEngine{
 		importer: importer,
+		logger:   logger,
 		tag:      tag,
 		ts:       uint64(time.Now().Unix()), // TODO ... set outside ? from pd ?
 		uuid:     engineUUID,
 	}, nil
 }
 
-// WriteStream is a single write stream into an opened engine. This type is
-// **NOT** goroutine safe, all operations must be executed in the same
-// goroutine.
-type WriteStream struct {
-	engine  *OpenedEngine
-	wstream kv.ImportKV_WriteEngineClient
-}
-
-// NewWriteStream creates a new write engine associated with
-func (engine *OpenedEngine) NewWriteStream(ctx context.Context) (*WriteStream, error) {
-	wstream, err := engine.importer.cli.WriteEngine(ctx)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-
-	// Bind uuid for this write request
-	req := &kv.WriteEngineRequest{
-		Chunk: &kv.WriteEngineRequest_Head{
-			Head: &kv.WriteHead{
-				Uuid: engine.uuid.Bytes(),
-			},
-		},
+// WriteRows delivers the rows into the engine. The rows must be in the
+// RowsFormat of the backend. The rows are durable once Flush returns.
+func (engine *OpenedEngine) WriteRows(ctx context.Context, rows Rows) error {
+	if err := engine.importer.limiter.WaitN(ctx, int64(rows.Size())); err != nil {
+		return errors.Trace(err)
 	}
-	if err = wstream.Send(req); err != nil {
-		if _, closeErr := wstream.CloseAndRecv(); closeErr != nil {
-			// just log the close error, we need to propagate the send error instead
-			common.AppLogger.Warnf("[%s] close write stream cause failed : %v", engine.tag, closeErr)
-		}
-		return nil, errors.Trace(err)
+	err := engine.importer.backend.WriteRows(ctx, engine.uuid, engine.ts, rows)
+	if err != nil && !common.IsContextCanceledError(err) {
+		engine.logger.Errorf("write rows failed : %v", err)
 	}
-
-	return &WriteStream{
-		engine:  engine,
-		wstream: wstream,
-	}, nil
+	return errors.Trace(err)
 }
 
-// Put delivers some KV pairs to importer via this write stream.
-func (stream *WriteStream) Put(kvs []kvec.KvPair) error {
-	// Send kv paris as write request content
-	mutations := make([]*kv.Mutation, len(kvs))
-	for i, pair := range kvs {
-		mutations[i] = &kv.Mutation{
-			Op:    kv.Mutation_Put,
-			Key:   pair.Key,
-			Value: pair.Val,
-		}
-	}
-
-	req := &kv.WriteEngineRequest{
-		Chunk: &kv.WriteEngineRequest_Batch{
-			Batch: &kv.WriteBatch{
-				CommitTs:  stream.engine.ts,
-				Mutations: mutations,
-			},
-		},
+// Flush makes the rows written into the engine durable, so the delivered
+// position can be saved into the checkpoint.
+func (engine *OpenedEngine) Flush(ctx context.Context) error {
+	flusher, ok := engine.importer.backend.(EngineFlusher)
+	if !ok {
+		return nil
 	}
-
-	var sendErr error
-	for i := 0; i < maxRetryTimes; i++ {
-		sendErr = stream.wstream.Send(req)
-		if !common.IsRetryableError(sendErr) {
-			break
-		}
-		common.AppLogger.Errorf("[%s] write stream failed to send: %s", stream.engine.tag, sendErr.Error())
-		time.Sleep(retryBackoffTime)
-	}
-	return errors.Trace(sendErr)
-}
-
-// Close the write stream.
-func (stream *WriteStream) Close() error {
-	if _, err := stream.wstream.CloseAndRecv(); err != nil {
-		if !common.IsContextCanceledError(err) {
-			common.AppLogger.Errorf("[%s] close write stream cause failed : %v", stream.engine.tag, err)
-		}
-		return errors.Trace(err)
+	err := flusher.FlushEngine(ctx, engine.uuid)
+	if err != nil && !common.IsContextCanceledError(err) {
+		engine.logger.Errorf("flush engine failed : %v", err)
 	}
-	return nil
+	return errors.Trace(err)
 }
 
-// ClosedEngine is a closed importer engine file, allowing ingestion into TiKV.
-// This type is goroutine safe: you can share this instance and execute any
-// method anywhere.
+// ClosedEngine is a closed engine, allowing ingestion into TiKV. This type is
+// goroutine safe: you can share this instance and execute any method anywhere.
 type ClosedEngine struct {
 	importer *Importer
+	logger   *log.Entry
 	tag      string
 	uuid     uuid.UUID
 }
 
-// Close the opened engine to prepare it for importing. This method will return
-// error if any associated WriteStream is still not closed.
+// Close the opened engine to prepare it for importing.
 func (engine *OpenedEngine) Close(ctx context.Context) (*ClosedEngine, error) {
-	common.AppLogger.Infof("[%s] [%s] engine close", engine.tag, engine.uuid)
+	engine.logger.Infof("[%s] engine close", engine.uuid)
 	timer := time.Now()
-	closedEngine, err := engine.importer.unsafeCloseEngine(ctx, engine.tag, engine.uuid)
+	closedEngine, err := engine.importer.unsafeCloseEngine(ctx, engine.logger, engine.tag, engine.uuid)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	common.AppLogger.Infof("[%s] [%s] engine close takes %v", engine.tag, engine.uuid, time.Since(timer))
+	engine.logger.Infof("[%s] engine close takes %v", engine.uuid, time.Since(timer))
 	metric.EngineCounter.WithLabelValues("closed").Inc()
 	return closedEngine, nil
 }
@@ -315,20 +338,16 @@ func (engine *OpenedEngine) Close(ctx context.Context) (*ClosedEngine, error) {
 func (importer *Importer) UnsafeCloseEngine(ctx context.Context, tableName string, engineID int) (*ClosedEngine, error) {
 	tag := makeTag(tableName, engineID)
 	engineUUID := uuid.NewV5(engineNamespace, tag)
-	return importer.unsafeCloseEngine(ctx, tag, engineUUID)
+	return importer.unsafeCloseEngine(ctx, common.EngineLogger(tableName, engineID), tag, engineUUID)
 }
 
-func (importer *Importer) unsafeCloseEngine(ctx context.Context, tag string, engineUUID uuid.UUID) (*ClosedEngine, error) {
-	req := &kv.CloseEngineRequest{
-		Uuid: engineUUID.Bytes(),
-	}
-	_, err := importer.cli.CloseEngine(ctx, req)
-	if !isIgnorableOpenCloseEngineError(err) {
+func (importer *Importer) unsafeCloseEngine(ctx context.Context, logger *log.Entry, tag string, engineUUID uuid.UUID) (*ClosedEngine, error) {
+	if err := importer.backend.CloseEngine(ctx, engineUUID); err != nil {
 		return nil, errors.Trace(err)
 	}
-
 	return &ClosedEngine{
 		importer: importer,
+		logger:   logger,
 		tag:      tag,
 		uuid:     engineUUID,
 	}, nil
@@ -336,39 +355,72 @@ func (importer *Importer) unsafeCloseEngine(ctx context.Context, tag string, eng
 
 // Import the data into the TiKV cluster via SST ingestion.
 func (engine *ClosedEngine) Import(ctx context.Context) error {
-	var err error
-
-	for i := 0; i < maxRetryTimes; i++ {
-		common.AppLogger.Infof("[%s] [%s] import", engine.tag, engine.uuid)
-		req := &kv.ImportEngineRequest{
-			Uuid:   engine.uuid.Bytes(),
-			PdAddr: engine.importer.pdAddr,
-		}
+	err := common.Retry(ctx, fmt.Sprintf("[%s] [%s] import", engine.tag, engine.uuid), func() error {
+		engine.logger.Infof("[%s] import", engine.uuid)
 		timer := time.Now()
-		_, err = engine.importer.cli.ImportEngine(ctx, req)
-		if !common.IsRetryableError(err) {
-			if err == nil {
-				common.AppLogger.Infof("[%s] [%s] import takes %v", engine.tag, engine.uuid, time.Since(timer))
-			} else if !common.IsContextCanceledError(err) {
-				common.AppLogger.Errorf("[%s] [%s] import failed and cannot retry, err %v", engine.tag, engine.uuid, err)
-			}
-			return errors.Trace(err)
+		err := engine.importer.backend.ImportEngine(ctx, engine.uuid)
+		if err == nil {
+			engine.logger.Infof("[%s] import takes %v", engine.uuid, time.Since(timer))
 		}
-		common.AppLogger.Warnf("[%s] [%s] import failed and retry %d time, err %v", engine.tag, engine.uuid, i+1, err)
-		time.Sleep(retryBackoffTime)
+		return err
+	})
+	if err != nil && !common.IsContextCanceledError(err) {
+		engine.logger.Errorf("[%s] import failed, err %v", engine.uuid, err)
 	}
-
-	return errors.Annotatef(err, "[%s] [%s] import reach max retry %d and still failed", engine.tag, engine.uuid, maxRetryTimes)
+	return errors.Trace(err)
 }
 
-// Cleanup deletes the imported data from importer.
+// Cleanup deletes the imported data from the backend.
 func (engine *ClosedEngine) Cleanup(ctx context.Context) error {
-	common.AppLogger.Infof("[%s] [%s] cleanup ", engine.tag, engine.uuid)
-	req := &kv.CleanupEngineRequest{
-		Uuid: engine.uuid.Bytes(),
-	}
+	engine.logger.Infof("[%s] cleanup ", engine.uuid)
 	timer := time.Now()
-	_, err := engine.importer.cli.CleanupEngine(ctx, req)
-	common.AppLogger.Infof("[%s] [%s] cleanup takes %v", engine.tag, engine.uuid, time.Since(timer))
-	return errors.Trace(err)
+	err := engine.importer.backend.CleanupEngine(ctx, engine.uuid)
+	engine.logger.Infof("[%s] cleanup takes %v", engine.uuid, time.Since(timer))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	engine.importer.unregisterEngine(engine.logger, engine.uuid)
+	return nil
+}
+
+func (importer *Importer) unregisterEngine(logger *log.Entry, engineUUID uuid.UUID) {
+	if importer.registry != nil {
+		if err := importer.registry.remove(engineUUID); err != nil {
+			logger.Warnf("cannot remove engine %s from the registry: %v", engineUUID, err)
+		}
+	}
+}
+
+// CleanupOrphanEngines closes and cleans up the engines in the registry which
+// are not kept, e.g. those left behind by crashed runs and no longer needed
+// for resuming, to reclaim the disk space of the backend. The cleaned engines
+// are returned, which are removed from the registry.
+func (importer *Importer) CleanupOrphanEngines(
+	ctx context.Context,
+	keep func(tableName string, engineID int) bool,
+) ([]EngineRecord, error) {
+	if importer.registry == nil {
+		return nil, nil
+	}
+
+	var cleaned []EngineRecord
+	for _, record := range importer.registry.Engines() {
+		if keep(record.Table, record.EngineID) {
+			continue
+		}
+		tag := makeTag(record.Table, record.EngineID)
+		logger := common.EngineLogger(record.Table, record.EngineID)
+		logger.Infof("[%s] cleanup orphan engine opened at %v", record.UUID, record.OpenedAt)
+		// the engine may be left opened or closed, or already cleaned up
+		// before the crash. cleaning up requires it to be closed.
+		if err := importer.backend.CloseEngine(ctx, record.UUID); err != nil && !IsEngineLostError(err) {
+			logger.Warnf("[%s] cannot close orphan engine: %v", record.UUID, err)
+		}
+		if err := importer.backend.CleanupEngine(ctx, record.UUID); err != nil {
+			return cleaned, errors.Annotatef(err, "[%s] cannot cleanup orphan engine %s", tag, record.UUID)
+		}
+		importer.unregisterEngine(logger, record.UUID)
+		cleaned = append(cleaned, record)
+	}
+	return cleaned, nil
 }
@@ -0,0 +1,203 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	sst "github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/satori/go.uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+var _ = Suite(&importerSuite{})
+
+type importerSuite struct{}
+
+func (s *importerSuite) TestIsEngineLostError(c *C) {
+	c.Assert(IsEngineLostError(nil), IsFalse)
+	c.Assert(IsEngineLostError(errors.Trace(ErrEngineLost)), IsTrue)
+	c.Assert(IsEngineLostError(status.Error(codes.Unavailable, "transport is closing")), IsTrue)
+	c.Assert(IsEngineLostError(errors.Trace(status.Error(codes.Unavailable, "connection refused"))), IsTrue)
+	c.Assert(IsEngineLostError(status.Error(codes.Canceled, "context canceled")), IsFalse)
+	c.Assert(IsEngineLostError(context.Canceled), IsFalse)
+	c.Assert(IsEngineLostError(errors.New("engine is corrupted")), IsFalse)
+}
+
+type recordingBackend struct {
+	calls []string
+}
+
+func (b *recordingBackend) record(call string, engineUUID uuid.UUID) error {
+	b.calls = append(b.calls, call+" "+engineUUID.String())
+	return nil
+}
+
+func (b *recordingBackend) Close()                                           {}
+func (b *recordingBackend) RowsFormat() RowsFormat                           { return RowsFormatKV }
+func (b *recordingBackend) CheckRequirements(context.Context) error          { return nil }
+func (b *recordingBackend) SwitchMode(context.Context, sst.SwitchMode) error { return nil }
+func (b *recordingBackend) Compact(context.Context, int32) error             { return nil }
+func (b *recordingBackend) OpenEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	return b.record("open", engineUUID)
+}
+func (b *recordingBackend) WriteRows(ctx context.Context, engineUUID uuid.UUID, commitTs uint64, rows Rows) error {
+	return b.record(fmt.Sprintf("write %d", rows.Size()), engineUUID)
+}
+func (b *recordingBackend) CloseEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	return b.record("close", engineUUID)
+}
+func (b *recordingBackend) ImportEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	return b.record("import", engineUUID)
+}
+func (b *recordingBackend) CleanupEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	return b.record("cleanup", engineUUID)
+}
+
+func (s *importerSuite) TestBackendImporter(c *C) {
+	ctx := context.Background()
+	backend := new(recordingBackend)
+	importer := NewBackendImporter(backend)
+
+	engine, err := importer.OpenEngine(ctx, "`db`.`t`", 1)
+	c.Assert(err, IsNil)
+	rows := KVRows{{Key: []byte("k1"), Val: []byte("v1")}, {Key: []byte("k2"), Val: []byte("value2")}}
+	c.Assert(engine.WriteRows(ctx, rows), IsNil)
+	closedEngine, err := engine.Close(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(closedEngine.Import(ctx), IsNil)
+	c.Assert(closedEngine.Cleanup(ctx), IsNil)
+
+	engineUUID := uuid.NewV5(engineNamespace, "`db`.`t`:1").String()
+	c.Assert(backend.calls, DeepEquals, []string{
+		"open " + engineUUID,
+		"write 12 " + engineUUID,
+		"close " + engineUUID,
+		"import " + engineUUID,
+		"cleanup " + engineUUID,
+	})
+}
+
+func (s *importerSuite) TestRowsSize(c *C) {
+	c.Assert(KVRows(nil).Size(), Equals, 0)
+	c.Assert(SQLRows("INSERT INTO t VALUES (1);").Size(), Equals, 25)
+}
+
+func (s *importerSuite) TestAssignEngine(c *C) {
+	// dialing is non-blocking, so the addresses need not be reachable.
+	tls, err := common.NewTLS("", "", "")
+	c.Assert(err, IsNil)
+	importer, err := NewImporter(context.Background(), tls, "127.0.0.1:1, 127.0.0.1:2", "127.0.0.1:3", ImporterOptions{})
+	c.Assert(err, IsNil)
+	defer importer.Close()
+
+	// new engines go to the least loaded instance.
+	addr, err := importer.AssignEngine("`db`.`t`", 0, "")
+	c.Assert(err, IsNil)
+	c.Assert(addr, Equals, "127.0.0.1:1")
+	addr, err = importer.AssignEngine("`db`.`t`", 1, "")
+	c.Assert(err, IsNil)
+	c.Assert(addr, Equals, "127.0.0.1:2")
+	addr, err = importer.AssignEngine("`db`.`t`", 0, "")
+	c.Assert(err, IsNil)
+	c.Assert(addr, Equals, "127.0.0.1:1")
+
+	// the assignment from the checkpoint is kept.
+	addr, err = importer.AssignEngine("`db`.`t`", 2, "127.0.0.1:2")
+	c.Assert(err, IsNil)
+	c.Assert(addr, Equals, "127.0.0.1:2")
+	addr, err = importer.AssignEngine("`db`.`t`", 3, "")
+	c.Assert(err, IsNil)
+	c.Assert(addr, Equals, "127.0.0.1:1")
+
+	_, err = importer.AssignEngine("`db`.`t`", 4, "127.0.0.1:4")
+	c.Assert(IsEngineLostError(err), IsTrue)
+
+	// backends without multiple instances assign nothing.
+	addr, err = NewBackendImporter(new(recordingBackend)).AssignEngine("`db`.`t`", 0, "")
+	c.Assert(err, IsNil)
+	c.Assert(addr, Equals, "")
+}
+
+func (s *importerSuite) TestCleanupOrphanEngines(c *C) {
+	ctx := context.Background()
+	path := filepath.Join(c.MkDir(), "engines.json")
+	registry, err := LoadEngineRegistry(path)
+	c.Assert(err, IsNil)
+
+	importer := NewBackendImporter(new(recordingBackend))
+	importer.SetEngineRegistry(registry)
+	for engineID := 0; engineID < 3; engineID++ {
+		_, err := importer.OpenEngine(ctx, "`db`.`t`", engineID)
+		c.Assert(err, IsNil)
+	}
+	closedEngine, err := importer.UnsafeCloseEngine(ctx, "`db`.`t`", 2)
+	c.Assert(err, IsNil)
+	c.Assert(closedEngine.Cleanup(ctx), IsNil)
+
+	// the registry survives restarts.
+	registry, err = LoadEngineRegistry(path)
+	c.Assert(err, IsNil)
+	records := registry.Engines()
+	c.Assert(records, HasLen, 2)
+	c.Assert(records[0].Table, Equals, "`db`.`t`")
+	c.Assert(records[0].EngineID, Equals, 0)
+	c.Assert(records[1].EngineID, Equals, 1)
+
+	backend := new(recordingBackend)
+	importer = NewBackendImporter(backend)
+	importer.SetEngineRegistry(registry)
+	cleaned, err := importer.CleanupOrphanEngines(ctx, func(tableName string, engineID int) bool {
+		return engineID == 0
+	})
+	c.Assert(err, IsNil)
+	c.Assert(cleaned, HasLen, 1)
+	c.Assert(cleaned[0].EngineID, Equals, 1)
+	engineUUID := uuid.NewV5(engineNamespace, "`db`.`t`:1").String()
+	c.Assert(backend.calls, DeepEquals, []string{"close " + engineUUID, "cleanup " + engineUUID})
+
+	registry, err = LoadEngineRegistry(path)
+	c.Assert(err, IsNil)
+	c.Assert(registry.Engines(), HasLen, 1)
+}
+
+func (s *importerSuite) TestEngineRegistryShared(c *C) {
+	path := filepath.Join(c.MkDir(), "sub", "engines.json")
+	first, err := LoadEngineRegistry(path)
+	c.Assert(err, IsNil)
+	second, err := LoadEngineRegistry(path)
+	c.Assert(err, IsNil)
+
+	// the records added by the other process are kept.
+	uuid1 := uuid.NewV5(engineNamespace, "`db`.`t`:1")
+	uuid2 := uuid.NewV5(engineNamespace, "`db`.`t`:2")
+	c.Assert(first.add("`db`.`t`", 1, uuid1), IsNil)
+	c.Assert(second.add("`db`.`t`", 2, uuid2), IsNil)
+	c.Assert(second.Engines(), HasLen, 2)
+	c.Assert(first.remove(uuid2), IsNil)
+	c.Assert(first.Engines(), HasLen, 1)
+
+	registry, err := LoadEngineRegistry(path)
+	c.Assert(err, IsNil)
+	records := registry.Engines()
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].UUID, Equals, uuid1)
+}
@@ -0,0 +1,624 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/goleveldb/leveldb"
+	"github.com/pingcap/goleveldb/leveldb/opt"
+	"github.com/pingcap/goleveldb/leveldb/util"
+	sst "github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	pd "github.com/pingcap/pd/client"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"github.com/pingcap/tidb/util/codec"
+	kvec "github.com/pingcap/tidb/util/kvencoder"
+	"github.com/satori/go.uuid"
+	"google.golang.org/grpc"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+const (
+	// maximum size of the KV pairs ingested into a region at once. It is kept
+	// below the region-split-size of TiKV, so the region isn't split right
+	// after the ingestion.
+	maxIngestSize = 96 << 20
+
+	// values up to this length are stored inside the write CF, like TiKV does,
+	// rather than in the default CF.
+	shortValueMaxLen = 64
+
+	uploadChunkSize = 1 << 20
+
+	cfDefault = "default"
+	cfWrite   = "write"
+
+	// the prefix of all keys of the region data in TiKV.
+	dataKeyPrefix = 'z'
+
+	writeTypePut     = 'P'
+	shortValuePrefix = 'v'
+)
+
+// localBackend sorts the KV pairs of every engine in a LevelDB database on the
+// local disk, then ingests them into TiKV as SST files region by region, doing
+// the job of tikv-importer within Lightning.
+type localBackend struct {
+	dir   string
+	tls   *common.TLS
+	pdCli pd.Client
+
+	mu      sync.Mutex
+	engines map[uuid.UUID]*leveldb.DB
+	conns   map[uint64]*grpc.ClientConn
+}
+
+func newLocalBackend(tls *common.TLS, pdAddr string, dir string) (*localBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	pdCli, err := pd.NewClient([]string{pdAddr}, tls.ToPDSecurityOption())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &localBackend{
+		dir:     dir,
+		tls:     tls,
+		pdCli:   pdCli,
+		engines: make(map[uuid.UUID]*leveldb.DB),
+		conns:   make(map[uint64]*grpc.ClientConn),
+	}, nil
+}
+
+func (local *localBackend) Close() {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	for _, db := range local.engines {
+		db.Close()
+	}
+	for _, conn := range local.conns {
+		conn.Close()
+	}
+	local.pdCli.Close()
+}
+
+func (local *localBackend) RowsFormat() RowsFormat {
+	return RowsFormatKV
+}
+
+// CheckRequirements verifies files can be created in the sorted KV directory.
+func (local *localBackend) CheckRequirements(context.Context) error {
+	file, err := ioutil.TempFile(local.dir, ".lightning-check-")
+	if err != nil {
+		return errors.Annotatef(err, "sorted-kv-dir %s is not writable", local.dir)
+	}
+	file.Close()
+	return errors.Trace(os.Remove(file.Name()))
+}
+
+// DiskUsage implements DiskUsageReporter.
+func (local *localBackend) DiskUsage(context.Context) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(local.dir, &stat); err != nil {
+		return 0, 0, errors.Annotatef(err, "cannot read the disk usage of %s", local.dir)
+	}
+	capacity := stat.Blocks * uint64(stat.Bsize)
+	return capacity - stat.Bavail*uint64(stat.Bsize), capacity, nil
+}
+
+func (local *localBackend) enginePath(engineUUID uuid.UUID) string {
+	return filepath.Join(local.dir, engineUUID.String())
+}
+
+// openEngine opens the database of the engine, creating it if not exists.
+func (local *localBackend) openEngine(engineUUID uuid.UUID) (*leveldb.DB, error) {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	if db, ok := local.engines[engineUUID]; ok {
+		return db, nil
+	}
+	db, err := leveldb.OpenFile(local.enginePath(engineUUID), nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	local.engines[engineUUID] = db
+	return db, nil
+}
+
+// closedEngine returns the database of a closed engine. Unlike openEngine,
+// the database must already exist, which may not be the case when resuming
+// if the sorted KV directory has been removed.
+func (local *localBackend) closedEngine(engineUUID uuid.UUID) (*leveldb.DB, error) {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	if db, ok := local.engines[engineUUID]; ok {
+		return db, nil
+	}
+	path := local.enginePath(engineUUID)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, errors.Annotatef(ErrEngineLost, "%s does not exist", path)
+	}
+	db, err := leveldb.OpenFile(path, &opt.Options{ErrorIfMissing: true})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	local.engines[engineUUID] = db
+	return db, nil
+}
+
+func (local *localBackend) OpenEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	_, err := local.openEngine(engineUUID)
+	return errors.Trace(err)
+}
+
+// WriteRows writes the KV pairs into the database of the engine.
+func (local *localBackend) WriteRows(ctx context.Context, engineUUID uuid.UUID, _ uint64, rows Rows) error {
+	db, err := local.openEngine(engineUUID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	batch := new(leveldb.Batch)
+	appendToBatch(batch, rows.(KVRows))
+	return errors.Trace(writeBatch(db, batch))
+}
+
+// FlushEngine implements EngineFlusher.
+func (local *localBackend) FlushEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	db, err := local.openEngine(engineUUID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(syncEngine(db))
+}
+
+// CloseEngine verifies the engine exists, and makes everything written into it
+// durable.
+func (local *localBackend) CloseEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	db, err := local.closedEngine(engineUUID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(syncEngine(db))
+}
+
+func (local *localBackend) CleanupEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	if db, ok := local.engines[engineUUID]; ok {
+		db.Close()
+		delete(local.engines, engineUUID)
+	}
+	return errors.Trace(os.RemoveAll(local.enginePath(engineUUID)))
+}
+
+// EngineStats counts the KV pairs by scanning the database of the engine.
+func (local *localBackend) EngineStats(ctx context.Context, engineUUID uuid.UUID) (uint64, uint64, error) {
+	db, err := local.closedEngine(engineUUID)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	var kvs, size uint64
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		kvs++
+		size += uint64(len(iter.Key()) + len(iter.Value()))
+		if kvs%4096 == 0 && ctx.Err() != nil {
+			return 0, 0, ctx.Err()
+		}
+	}
+	return kvs, size, errors.Trace(iter.Error())
+}
+
+// writeBatch writes the KV pairs into the engine. They are not durable until
+// the engine is synced, which is done once before the chunk checkpoints are
+// saved rather than for every batch.
+func writeBatch(db *leveldb.DB, batch *leveldb.Batch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	return errors.Trace(db.Write(batch, nil))
+}
+
+// syncEngine makes all the batches written into the engine durable. LevelDB
+// only syncs the journal along with a write, so the empty key, which is never
+// a TiDB key, is deleted for that.
+func syncEngine(db *leveldb.DB) error {
+	batch := new(leveldb.Batch)
+	batch.Delete(nil)
+	return errors.Trace(db.Write(batch, &opt.WriteOptions{Sync: true}))
+}
+
+func appendToBatch(batch *leveldb.Batch, kvs []kvec.KvPair) {
+	for _, pair := range kvs {
+		batch.Put(pair.Key, pair.Val)
+	}
+}
+
+func (local *localBackend) importClient(ctx context.Context, storeID uint64) (sst.ImportSSTClient, error) {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+
+	conn, ok := local.conns[storeID]
+	if !ok {
+		store, err := local.pdCli.GetStore(ctx, storeID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		conn, err = grpc.DialContext(ctx, store.GetAddress(), local.tls.ToGRPCDialOption())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		local.conns[storeID] = conn
+	}
+	return sst.NewImportSSTClient(conn), nil
+}
+
+// forEachStore calls `action` with the import client of every TiKV store.
+func (local *localBackend) forEachStore(ctx context.Context, action func(sst.ImportSSTClient) error) error {
+	stores, err := local.pdCli.GetAllStores(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, store := range stores {
+		if store.GetState() == metapb.StoreState_Tombstone {
+			continue
+		}
+		client, err := local.importClient(ctx, store.GetId())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := action(client); err != nil {
+			return errors.Annotatef(err, "TiKV (at %s)", store.GetAddress())
+		}
+	}
+	return nil
+}
+
+func (local *localBackend) SwitchMode(ctx context.Context, mode sst.SwitchMode) error {
+	return local.forEachStore(ctx, func(client sst.ImportSSTClient) error {
+		_, err := client.SwitchMode(ctx, &sst.SwitchModeRequest{Mode: mode})
+		return errors.Trace(err)
+	})
+}
+
+func (local *localBackend) Compact(ctx context.Context, level int32) error {
+	return local.forEachStore(ctx, func(client sst.ImportSSTClient) error {
+		_, err := client.Compact(ctx, &sst.CompactRequest{OutputLevel: level})
+		return errors.Trace(err)
+	})
+}
+
+// CompactRange implements RangeCompactor.
+func (local *localBackend) CompactRange(ctx context.Context, level int32, start, end []byte) error {
+	return local.forEachStore(ctx, func(client sst.ImportSSTClient) error {
+		_, err := client.Compact(ctx, &sst.CompactRequest{Range: compactKeyRange(start, end), OutputLevel: level})
+		return errors.Trace(err)
+	})
+}
+
+// ImportEngine ingests all KV pairs of the engine into TiKV, committed at a
+// timestamp allocated from PD.
+func (local *localBackend) ImportEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	db, err := local.closedEngine(engineUUID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	physical, logical, err := local.pdCli.GetTS(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ts := oracle.ComposeTS(physical, logical)
+
+	iter := db.NewIterator(nil, nil)
+	var startKey []byte
+	if iter.First() {
+		startKey = append(startKey, iter.Key()...)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return errors.Trace(err)
+	}
+
+	regions := 0
+	for startKey != nil {
+		var nextKey []byte
+		err := common.Retry(ctx, fmt.Sprintf("[%s] ingest from key %q", engineUUID, startKey), func() error {
+			var e error
+			nextKey, e = local.ingestRegion(ctx, db, startKey, ts)
+			return e
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		startKey = nextKey
+		regions++
+	}
+	common.AppLogger.Infof("[%s] ingested %d times at ts %d", engineUUID, regions, ts)
+	return nil
+}
+
+// ingestRegion ingests the KV pairs starting from `startKey` into the region
+// containing it, until the end of the region or maxIngestSize is reached.
+// Returns the first key not ingested, or nil if all KV pairs are ingested.
+//
+// The SST files are uploaded to all peers of the region before ingested by
+// the leader. If the region is changed in between, the ingestion fails and
+// should be retried from the same key.
+func (local *localBackend) ingestRegion(ctx context.Context, db *leveldb.DB, startKey []byte, ts uint64) ([]byte, error) {
+	region, leader, err := local.pdCli.GetRegion(ctx, codec.EncodeBytes(nil, startKey))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if region == nil || leader == nil {
+		return nil, errors.Errorf("region of key %s is not ready", common.RedactString(strconv.Quote(string(startKey))))
+	}
+
+	ssts, nextKey, err := writeRegionSSTs(local.dir, db, startKey, region.GetEndKey(), ts)
+	defer func() {
+		for _, s := range ssts {
+			os.Remove(s.path)
+		}
+	}()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for _, s := range ssts {
+		s.meta.RegionId = region.GetId()
+		s.meta.RegionEpoch = region.GetRegionEpoch()
+		for _, peer := range region.GetPeers() {
+			if err := local.upload(ctx, peer.GetStoreId(), s); err != nil {
+				return nil, errors.Annotatef(err, "cannot upload SST to store %d", peer.GetStoreId())
+			}
+		}
+	}
+
+	client, err := local.importClient(ctx, leader.GetStoreId())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// the default CF goes first, so the values are in place when the write
+	// records referring to them become visible.
+	for _, s := range ssts {
+		resp, err := client.Ingest(ctx, &sst.IngestRequest{
+			Context: &kvrpcpb.Context{
+				RegionId:    region.GetId(),
+				RegionEpoch: region.GetRegionEpoch(),
+				Peer:        leader,
+			},
+			Sst: s.meta,
+		})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if regionErr := resp.GetError(); regionErr != nil {
+			return nil, errors.Errorf("region %d: %s", region.GetId(), regionErr.String())
+		}
+	}
+	return nextKey, nil
+}
+
+func (local *localBackend) upload(ctx context.Context, storeID uint64, s *localSST) error {
+	client, err := local.importClient(ctx, storeID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	file, err := os.Open(s.path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer file.Close()
+
+	stream, err := client.Upload(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := stream.Send(&sst.UploadRequest{Chunk: &sst.UploadRequest_Meta{Meta: s.meta}}); err != nil {
+		return errors.Trace(err)
+	}
+	buf := make([]byte, uploadChunkSize)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			if e := stream.Send(&sst.UploadRequest{Chunk: &sst.UploadRequest_Data{Data: buf[:n]}}); e != nil {
+				return errors.Trace(e)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return errors.Trace(err)
+}
+
+// writeRegionSSTs writes the KV pairs from `startKey` until `regionEnd` (an
+// encoded key, empty for no limit) or maxIngestSize into the SST files of the
+// default and write CFs. Empty SST files are not returned.
+func writeRegionSSTs(dir string, db *leveldb.DB, startKey []byte, regionEnd []byte, ts uint64) ([]*localSST, []byte, error) {
+	defaultWriter, err := newSSTWriter(dir, cfDefault)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer defaultWriter.abort()
+	writeWriter, err := newSSTWriter(dir, cfWrite)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer writeWriter.abort()
+
+	iter := db.NewIterator(&util.Range{Start: startKey}, nil)
+	defer iter.Release()
+
+	var nextKey []byte
+	size := 0
+	for ok := iter.First(); ok; ok = iter.Next() {
+		key := codec.EncodeBytes(nil, iter.Key())
+		if (len(regionEnd) > 0 && bytes.Compare(key, regionEnd) >= 0) || size >= maxIngestSize {
+			nextKey = append(nextKey, iter.Key()...)
+			break
+		}
+		value := iter.Value()
+		size += len(key) + len(value)
+
+		key = codec.EncodeUintDesc(key, ts)
+		if len(value) <= shortValueMaxLen {
+			err = writeWriter.append(key, encodeWriteCFValue(ts, value))
+		} else {
+			err = defaultWriter.append(key, value)
+			if err == nil {
+				err = writeWriter.append(key, encodeWriteCFValue(ts, nil))
+			}
+		}
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	var ssts []*localSST
+	for _, w := range []*sstWriter{defaultWriter, writeWriter} {
+		if w.count == 0 {
+			continue
+		}
+		s, err := w.finish()
+		if err != nil {
+			return ssts, nil, errors.Trace(err)
+		}
+		ssts = append(ssts, s)
+	}
+	return ssts, nextKey, nil
+}
+
+// encodeWriteCFValue encodes the commit record of a PUT started at `startTs`,
+// with the value inlined if it is short.
+func encodeWriteCFValue(startTs uint64, shortValue []byte) []byte {
+	value := make([]byte, 0, 1+binary.MaxVarintLen64+2+len(shortValue))
+	value = append(value, writeTypePut)
+	var buf [binary.MaxVarintLen64]byte
+	value = append(value, buf[:binary.PutUvarint(buf[:], startTs)]...)
+	if len(shortValue) > 0 {
+		value = append(value, shortValuePrefix, byte(len(shortValue)))
+		value = append(value, shortValue...)
+	}
+	return value
+}
+
+type localSST struct {
+	path string
+	meta *sst.SSTMeta
+}
+
+// sstWriter writes the KV pairs of a CF into an SST file ingestible by TiKV.
+// The keys are given as the MVCC keys without the data key prefix.
+type sstWriter struct {
+	cf     string
+	id     uuid.UUID
+	path   string
+	file   *os.File
+	crc    hash.Hash32
+	writer *sstTableWriter
+
+	count       int
+	first, last []byte
+}
+
+func newSSTWriter(dir string, cf string) (*sstWriter, error) {
+	id := uuid.NewV4()
+	path := filepath.Join(dir, fmt.Sprintf("%s.%s.sst", id, cf))
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	crc := crc32.NewIEEE()
+	return &sstWriter{
+		cf:     cf,
+		id:     id,
+		path:   path,
+		file:   file,
+		crc:    crc,
+		writer: newSSTTableWriter(io.MultiWriter(file, crc)),
+	}, nil
+}
+
+func (w *sstWriter) append(key []byte, value []byte) error {
+	dataKey := make([]byte, 0, len(key)+1)
+	dataKey = append(dataKey, dataKeyPrefix)
+	dataKey = append(dataKey, key...)
+	if err := w.writer.Append(dataKey, value); err != nil {
+		return errors.Trace(err)
+	}
+	if w.count == 0 {
+		w.first = key
+	}
+	w.last = key
+	w.count++
+	return nil
+}
+
+func (w *sstWriter) finish() (*localSST, error) {
+	if err := w.writer.Close(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := w.file.Close(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	stat, err := os.Stat(w.path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	w.file = nil
+	return &localSST{
+		path: w.path,
+		meta: &sst.SSTMeta{
+			Uuid:   w.id.Bytes(),
+			Range:  &sst.Range{Start: w.first, End: w.last},
+			Crc32:  w.crc.Sum32(),
+			Length: uint64(stat.Size()),
+			CfName: w.cf,
+		},
+	}, nil
+}
+
+// abort removes the file if the writer is not finished.
+func (w *sstWriter) abort() {
+	if w.file != nil {
+		w.file.Close()
+		os.Remove(w.path)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/goleveldb/leveldb"
+	"github.com/pingcap/tidb/util/codec"
+	kvec "github.com/pingcap/tidb/util/kvencoder"
+	"github.com/satori/go.uuid"
+)
+
+var _ = Suite(&localSuite{})
+
+type localSuite struct{}
+
+func (s *localSuite) TestEncodeWriteCFValue(c *C) {
+	c.Assert(encodeWriteCFValue(5, nil), DeepEquals, []byte{'P', 5})
+	c.Assert(encodeWriteCFValue(300, []byte("ab")), DeepEquals, []byte{'P', 0xac, 0x02, 'v', 2, 'a', 'b'})
+}
+
+func (s *localSuite) TestWriteRegionSSTs(c *C) {
+	dir, err := ioutil.TempDir("", "lightning-local-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	db, err := leveldb.OpenFile(filepath.Join(dir, "db"), nil)
+	c.Assert(err, IsNil)
+	defer db.Close()
+
+	batch := new(leveldb.Batch)
+	appendToBatch(batch, []kvec.KvPair{
+		{Key: []byte("a"), Val: []byte("short")},
+		{Key: []byte("b"), Val: bytes.Repeat([]byte{'x'}, shortValueMaxLen+1)},
+		{Key: []byte("c"), Val: []byte("short")},
+	})
+	c.Assert(writeBatch(db, batch), IsNil)
+	// the deletion syncing the engine is not written into the SSTs.
+	c.Assert(syncEngine(db), IsNil)
+
+	// the region ends before "c".
+	ssts, nextKey, err := writeRegionSSTs(dir, db, nil, codec.EncodeBytes(nil, []byte("c")), 100)
+	c.Assert(err, IsNil)
+	c.Assert(nextKey, DeepEquals, []byte("c"))
+	c.Assert(ssts, HasLen, 2)
+	c.Assert(ssts[0].meta.CfName, Equals, cfDefault)
+	c.Assert(ssts[1].meta.CfName, Equals, cfWrite)
+
+	keyB := codec.EncodeUintDesc(codec.EncodeBytes(nil, []byte("b")), 100)
+	c.Assert(ssts[0].meta.Range.Start, DeepEquals, keyB)
+	c.Assert(ssts[0].meta.Range.End, DeepEquals, keyB)
+	c.Assert(ssts[1].meta.Range.Start, DeepEquals, codec.EncodeUintDesc(codec.EncodeBytes(nil, []byte("a")), 100))
+	c.Assert(ssts[1].meta.Range.End, DeepEquals, keyB)
+	for _, sst := range ssts {
+		stat, err := os.Stat(sst.path)
+		c.Assert(err, IsNil)
+		c.Assert(uint64(stat.Size()), Equals, sst.meta.Length)
+		content, err := ioutil.ReadFile(sst.path)
+		c.Assert(err, IsNil)
+		entries, _ := readSST(c, content)
+		c.Assert(entries[0].key, DeepEquals, append(append([]byte{dataKeyPrefix}, sst.meta.Range.Start...), internalKey(nil)...))
+	}
+
+	// the rest has only short values.
+	ssts, nextKey, err = writeRegionSSTs(dir, db, nextKey, nil, 100)
+	c.Assert(err, IsNil)
+	c.Assert(nextKey, IsNil)
+	c.Assert(ssts, HasLen, 1)
+	c.Assert(ssts[0].meta.CfName, Equals, cfWrite)
+}
+
+func (s *localSuite) TestDiskUsage(c *C) {
+	local := &localBackend{dir: c.MkDir()}
+	used, capacity, err := local.DiskUsage(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(capacity, Not(Equals), uint64(0))
+	c.Assert(used <= capacity, IsTrue)
+}
+
+func (s *localSuite) TestEngineStats(c *C) {
+	ctx := context.Background()
+	local := &localBackend{dir: c.MkDir(), engines: make(map[uuid.UUID]*leveldb.DB)}
+	engineUUID := uuid.NewV4()
+	defer local.CleanupEngine(ctx, engineUUID)
+
+	_, _, err := local.EngineStats(ctx, engineUUID)
+	c.Assert(IsEngineLostError(err), IsTrue)
+
+	c.Assert(local.OpenEngine(ctx, engineUUID), IsNil)
+	rows := KVRows{
+		{Key: []byte("a"), Val: []byte("12")},
+		{Key: []byte("b"), Val: []byte("345")},
+	}
+	c.Assert(local.WriteRows(ctx, engineUUID, 0, rows), IsNil)
+	// writing the same KV pairs again, e.g. after resuming, adds nothing.
+	c.Assert(local.WriteRows(ctx, engineUUID, 0, rows), IsNil)
+	c.Assert(local.FlushEngine(ctx, engineUUID), IsNil)
+	c.Assert(local.CloseEngine(ctx, engineUUID), IsNil)
+
+	kvs, size, err := local.EngineStats(ctx, engineUUID)
+	c.Assert(err, IsNil)
+	c.Assert(kvs, Equals, uint64(2))
+	c.Assert(size, Equals, uint64(7))
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb/table"
+	"github.com/pingcap/tidb/types"
+)
+
+// isNumericOnly returns whether all columns are numeric or temporal, e.g. the
+// fact tables, whose rows are parsed and converted through the fast paths
+// skipping the string escapes and the charsets.
+func isNumericOnly(cols []*table.Column) bool {
+	for _, col := range cols {
+		switch col.Tp {
+		case mysql.TypeTiny, mysql.TypeShort, mysql.TypeInt24, mysql.TypeLong, mysql.TypeLonglong, mysql.TypeYear,
+			mysql.TypeFloat, mysql.TypeDouble, mysql.TypeNewDecimal,
+			mysql.TypeDate, mysql.TypeDatetime, mysql.TypeTimestamp, mysql.TypeDuration:
+		default:
+			return false
+		}
+	}
+	return len(cols) > 0
+}
+
+// castNumeric converts the integers into the integer columns and the floats
+// into the DOUBLE columns without precision, when the value is in the range
+// of the column, which is what table.CastValue gives. It returns false for
+// anything else, which should go through table.CastValue.
+func castNumeric(d types.Datum, col *table.Column) (types.Datum, bool) {
+	switch col.Tp {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeInt24, mysql.TypeLong, mysql.TypeLonglong:
+		if d.Kind() != types.KindInt64 {
+			return d, false
+		}
+		v := d.GetInt64()
+		if mysql.HasUnsignedFlag(col.Flag) {
+			if v < 0 || uint64(v) > types.UnsignedUpperBound[col.Tp] {
+				return d, false
+			}
+			return types.NewUintDatum(uint64(v)), true
+		}
+		if v < types.SignedLowerBound[col.Tp] || v > types.SignedUpperBound[col.Tp] {
+			return d, false
+		}
+		return d, true
+	case mysql.TypeDouble:
+		if d.Kind() != types.KindFloat64 || mysql.HasUnsignedFlag(col.Flag) ||
+			col.Flen != types.UnspecifiedLength || col.Decimal != types.UnspecifiedLength {
+			return d, false
+		}
+		return d, true
+	}
+	return d, false
+}
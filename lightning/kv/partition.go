@@ -0,0 +1,201 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb/expression"
+	"github.com/pingcap/tidb/sessionctx"
+	"github.com/pingcap/tidb/table/tables"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/chunk"
+	"github.com/pingcap/tidb/util/codec"
+	kvec "github.com/pingcap/tidb/util/kvencoder"
+	"github.com/pingcap/tidb/util/mock"
+)
+
+// partitionRouter rewrites the KV pairs encoded against the logical ID of a
+// partitioned table, so that every row and index entry is stored under the
+// physical ID of the partition it belongs to.
+//
+// Row IDs are still allocated from the logical table, which is how TiDB
+// allocates them too, so the handles stay unique across all partitions.
+type partitionRouter struct {
+	ctx         sessionctx.Context
+	tableInfo   *model.TableInfo
+	partitions  []model.PartitionDefinition
+	isHash      bool
+	exprs       []expression.Expression
+	columnTypes map[int64]*types.FieldType
+}
+
+func newPartitionRouter(tableInfo *model.TableInfo) (*partitionRouter, error) {
+	pi := tableInfo.GetPartitionInfo()
+	if pi == nil || len(pi.Definitions) == 0 {
+		return nil, nil
+	}
+
+	// Build the expressions the same way TiDB locates a partition: a HASH
+	// table evaluates the partition expression itself, while a RANGE table
+	// checks "expr < upper bound" of every partition in order.
+	var exprStrs []string
+	switch pi.Type {
+	case model.PartitionTypeHash:
+		exprStrs = []string{pi.Expr}
+	case model.PartitionTypeRange:
+		exprStrs = make([]string, 0, len(pi.Definitions))
+		for _, def := range pi.Definitions {
+			if len(def.LessThan) == 0 || strings.EqualFold(def.LessThan[0], "MAXVALUE") {
+				exprStrs = append(exprStrs, "true")
+			} else {
+				exprStrs = append(exprStrs, fmt.Sprintf("((%s) < (%s))", pi.Expr, def.LessThan[0]))
+			}
+		}
+	default:
+		return nil, errors.Errorf("unsupported partition type %s of table %s", pi.Type, tableInfo.Name)
+	}
+
+	ctx := mock.NewContext()
+	dbName := model.NewCIStr(ctx.GetSessionVars().CurrentDB)
+	columns := expression.ColumnInfos2ColumnsWithDBName(ctx, dbName, tableInfo.Name, tableInfo.Columns)
+	exprs, err := expression.ParseSimpleExprsWithSchema(ctx, strings.Join(exprStrs, ", "), expression.NewSchema(columns...))
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid partition expression of table %s", tableInfo.Name)
+	}
+
+	columnTypes := make(map[int64]*types.FieldType, len(tableInfo.Columns))
+	for _, col := range tableInfo.Columns {
+		columnTypes[col.ID] = &col.FieldType
+	}
+
+	return &partitionRouter{
+		ctx:         ctx,
+		tableInfo:   tableInfo,
+		partitions:  pi.Definitions,
+		isHash:      pi.Type == model.PartitionTypeHash,
+		exprs:       exprs,
+		columnTypes: columnTypes,
+	}, nil
+}
+
+// locate returns the ID of the partition the row belongs to.
+func (r *partitionRouter) locate(handle int64, value []byte) (int64, error) {
+	decoded, err := tablecodec.DecodeRow(value, r.columnTypes, r.ctx.GetSessionVars().Location())
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	datums := make([]types.Datum, len(r.tableInfo.Columns))
+	for i, col := range r.tableInfo.Columns {
+		if r.tableInfo.PKIsHandle && mysql.HasPriKeyFlag(col.Flag) {
+			// the integer primary key is stored as the handle instead of inside the row.
+			if mysql.HasUnsignedFlag(col.Flag) {
+				datums[i].SetUint64(uint64(handle))
+			} else {
+				datums[i].SetInt64(handle)
+			}
+		} else if d, ok := decoded[col.ID]; ok {
+			datums[i] = d
+		}
+	}
+	row := chunk.MutRowFromDatums(datums).ToRow()
+
+	if r.isHash {
+		v, isNull, err := r.exprs[0].EvalInt(r.ctx, row)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if isNull {
+			v = 0
+		}
+		idx := v % int64(len(r.partitions))
+		if idx < 0 {
+			idx = -idx
+		}
+		return r.partitions[idx].ID, nil
+	}
+
+	for i, expr := range r.exprs {
+		v, isNull, err := expr.EvalInt(r.ctx, row)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		// NULL is smaller than any value, so it always goes to the first partition.
+		if isNull || v != 0 {
+			return r.partitions[i].ID, nil
+		}
+	}
+	return 0, errors.Errorf("table %s has no partition for the row with handle %d", r.tableInfo.Name, handle)
+}
+
+// route replaces the table ID in every key of `kvs` by the partition ID. All
+// index entries must come together with the rows they point to, which is
+// always true for the output of a single INSERT statement.
+func (r *partitionRouter) route(kvs []kvec.KvPair) error {
+	partitionOfHandle := make(map[int64]int64)
+
+	for _, pair := range kvs {
+		_, _, isRecord, err := tablecodec.DecodeKeyHead(pair.Key)
+		if err != nil || !isRecord {
+			continue
+		}
+		_, handle, err := tablecodec.DecodeRecordKey(pair.Key)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		partitionID, err := r.locate(handle, pair.Val)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		partitionOfHandle[handle] = partitionID
+		tablecodec.ReplaceRecordKeyTableID(pair.Key, partitionID)
+	}
+
+	for _, pair := range kvs {
+		_, _, isRecord, err := tablecodec.DecodeKeyHead(pair.Key)
+		if err != nil {
+			return errors.Annotatef(err, "unexpected key %x", pair.Key)
+		}
+		if isRecord {
+			continue
+		}
+
+		// a unique index stores the handle as the value, while a non-unique
+		// index (or a unique index with NULL columns) appends it to the key.
+		var handle int64
+		if len(pair.Val) == 8 {
+			handle, err = tables.DecodeHandle(pair.Val)
+		} else if len(pair.Key) >= 8 {
+			_, handle, err = codec.DecodeInt(pair.Key[len(pair.Key)-8:])
+		} else {
+			err = errors.New("key too short")
+		}
+		if err != nil {
+			return errors.Annotatef(err, "cannot find the handle of index key %x", pair.Key)
+		}
+
+		partitionID, ok := partitionOfHandle[handle]
+		if !ok {
+			return errors.Errorf("cannot find the row with handle %d of index key %x", handle, pair.Key)
+		}
+		tablecodec.ReplaceRecordKeyTableID(pair.Key, partitionID)
+	}
+
+	return nil
+}
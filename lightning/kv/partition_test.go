@@ -0,0 +1,195 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"testing"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/table/tables"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	kvec "github.com/pingcap/tidb/util/kvencoder"
+)
+
+func TestKV(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&partitionSuite{})
+
+type partitionSuite struct{}
+
+const partitionedTableID = 100
+
+// makePartitionedTable creates the info of the table
+// "CREATE TABLE t (a INT PRIMARY KEY, b INT, KEY (b))" partitioned by `b`.
+func makePartitionedTable(pi *model.PartitionInfo) *model.TableInfo {
+	pkType := types.NewFieldType(mysql.TypeLong)
+	pkType.Flag |= mysql.PriKeyFlag
+	pi.Enable = true
+	pi.Expr = "`b`"
+	return &model.TableInfo{
+		ID:         partitionedTableID,
+		Name:       model.NewCIStr("t"),
+		PKIsHandle: true,
+		Columns: []*model.ColumnInfo{
+			{ID: 1, Name: model.NewCIStr("a"), Offset: 0, FieldType: *pkType, State: model.StatePublic},
+			{ID: 2, Name: model.NewCIStr("b"), Offset: 1, FieldType: *types.NewFieldType(mysql.TypeLong), State: model.StatePublic},
+		},
+		Partition: pi,
+	}
+}
+
+func encodeRowAndIndex(c *C, handle int64, b types.Datum, unique bool) []kvec.KvPair {
+	sc := &stmtctx.StatementContext{}
+	val, err := tablecodec.EncodeRow(sc, []types.Datum{b}, []int64{2}, nil, nil)
+	c.Assert(err, IsNil)
+	indexValues := []types.Datum{b}
+	indexVal := tables.EncodeHandle(handle)
+	if !unique {
+		indexValues = append(indexValues, types.NewIntDatum(handle))
+		indexVal = []byte{'0'}
+	}
+	encodedIndex, err := codec.EncodeKey(sc, nil, indexValues...)
+	c.Assert(err, IsNil)
+	return []kvec.KvPair{
+		{Key: tablecodec.EncodeIndexSeekKey(partitionedTableID, 1, encodedIndex), Val: indexVal},
+		{Key: tablecodec.EncodeRowKeyWithHandle(partitionedTableID, handle), Val: val},
+	}
+}
+
+func checkRouted(c *C, kvs []kvec.KvPair, expectedIDs ...int64) {
+	c.Assert(kvs, HasLen, len(expectedIDs))
+	for i, pair := range kvs {
+		tableID, _, _, err := tablecodec.DecodeKeyHead(pair.Key)
+		c.Assert(err, IsNil)
+		c.Assert(tableID, Equals, expectedIDs[i], Commentf("pair %d", i))
+	}
+}
+
+func (s *partitionSuite) TestNonPartitionedTable(c *C) {
+	router, err := newPartitionRouter(&model.TableInfo{ID: partitionedTableID})
+	c.Assert(err, IsNil)
+	c.Assert(router, IsNil)
+}
+
+func (s *partitionSuite) TestRangePartition(c *C) {
+	tableInfo := makePartitionedTable(&model.PartitionInfo{
+		Type: model.PartitionTypeRange,
+		Definitions: []model.PartitionDefinition{
+			{ID: 101, Name: model.NewCIStr("p0"), LessThan: []string{"10"}},
+			{ID: 102, Name: model.NewCIStr("p1"), LessThan: []string{"20"}},
+			{ID: 103, Name: model.NewCIStr("p2"), LessThan: []string{"MAXVALUE"}},
+		},
+	})
+	router, err := newPartitionRouter(tableInfo)
+	c.Assert(err, IsNil)
+	c.Assert(router, NotNil)
+
+	var kvs []kvec.KvPair
+	kvs = append(kvs, encodeRowAndIndex(c, 1, types.NewIntDatum(15), false)...)
+	kvs = append(kvs, encodeRowAndIndex(c, 2, types.NewIntDatum(5), true)...)
+	kvs = append(kvs, encodeRowAndIndex(c, 3, types.NewIntDatum(100), false)...)
+	kvs = append(kvs, encodeRowAndIndex(c, 4, types.Datum{}, false)...)
+	c.Assert(router.route(kvs), IsNil)
+	checkRouted(c, kvs, 102, 102, 101, 101, 103, 103, 101, 101)
+}
+
+func (s *partitionSuite) TestRangePartitionOutOfRange(c *C) {
+	tableInfo := makePartitionedTable(&model.PartitionInfo{
+		Type: model.PartitionTypeRange,
+		Definitions: []model.PartitionDefinition{
+			{ID: 101, Name: model.NewCIStr("p0"), LessThan: []string{"10"}},
+		},
+	})
+	router, err := newPartitionRouter(tableInfo)
+	c.Assert(err, IsNil)
+
+	kvs := encodeRowAndIndex(c, 1, types.NewIntDatum(15), false)
+	c.Assert(router.route(kvs), ErrorMatches, "table t has no partition for the row with handle 1")
+}
+
+func (s *partitionSuite) TestHashPartition(c *C) {
+	tableInfo := makePartitionedTable(&model.PartitionInfo{
+		Type: model.PartitionTypeHash,
+		Definitions: []model.PartitionDefinition{
+			{ID: 101, Name: model.NewCIStr("p0")},
+			{ID: 102, Name: model.NewCIStr("p1")},
+			{ID: 103, Name: model.NewCIStr("p2")},
+		},
+	})
+	router, err := newPartitionRouter(tableInfo)
+	c.Assert(err, IsNil)
+
+	var kvs []kvec.KvPair
+	kvs = append(kvs, encodeRowAndIndex(c, 1, types.NewIntDatum(4), true)...)
+	kvs = append(kvs, encodeRowAndIndex(c, 2, types.NewIntDatum(-5), false)...)
+	kvs = append(kvs, encodeRowAndIndex(c, 3, types.NewIntDatum(9), false)...)
+	c.Assert(router.route(kvs), IsNil)
+	checkRouted(c, kvs, 102, 102, 103, 103, 101, 101)
+}
+
+func (s *partitionSuite) TestPartitionedAutoIncrement(c *C) {
+	tableInfo := makePartitionedTable(&model.PartitionInfo{
+		Type: model.PartitionTypeRange,
+		Definitions: []model.PartitionDefinition{
+			{ID: 101, Name: model.NewCIStr("p0"), LessThan: []string{"10"}},
+			{ID: 102, Name: model.NewCIStr("p1"), LessThan: []string{"20"}},
+			{ID: 103, Name: model.NewCIStr("p2"), LessThan: []string{"MAXVALUE"}},
+		},
+	})
+	tableInfo.Columns[0].Flag |= mysql.AutoIncrementFlag
+	tableInfo.State = model.StatePublic
+
+	alloc := NewIDAllocator(0)
+	encoder, err := NewTableKVEncoder("sql2kv", "t", tableInfo, "STRICT_TRANS_TABLES", alloc)
+	c.Assert(err, IsNil)
+	defer encoder.Close()
+	permutation, err := encoder.ColumnPermutation(nil)
+	c.Assert(err, IsNil)
+
+	// the partitions allocate the IDs from the table like TiDB, so the IDs
+	// given to any partition rebase the same allocator.
+	for i, row := range []struct {
+		a           types.Datum
+		b           int64
+		handle      int64
+		partitionID int64
+	}{
+		{types.NewIntDatum(100), 15, 100, 102},
+		{types.Datum{}, 5, 101, 101},
+		{types.NewIntDatum(50), 25, 50, 103},
+		{types.Datum{}, 25, 102, 103},
+	} {
+		kvs, err := encoder.Datums2KV(permutation, []types.Datum{row.a, types.NewIntDatum(row.b)}, int64(i+1))
+		c.Assert(err, IsNil)
+		var record *kvec.KvPair
+		for i := range kvs {
+			if _, _, isRecord, _ := tablecodec.DecodeKeyHead(kvs[i].Key); isRecord {
+				record = &kvs[i]
+			}
+		}
+		c.Assert(record, NotNil)
+		tableID, handle, err := tablecodec.DecodeRecordKey(record.Key)
+		c.Assert(err, IsNil)
+		c.Assert(handle, Equals, row.handle, Commentf("row %d", i))
+		c.Assert(tableID, Equals, row.partitionID, Commentf("row %d", i))
+	}
+	c.Assert(alloc.Base(), Equals, int64(102))
+}
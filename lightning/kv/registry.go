@@ -0,0 +1,167 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/satori/go.uuid"
+)
+
+// EngineRecord describes an engine opened in the backend.
+type EngineRecord struct {
+	UUID     uuid.UUID `json:"uuid"`
+	Table    string    `json:"table"`
+	EngineID int       `json:"engine-id"`
+	OpenedAt time.Time `json:"opened-at"`
+}
+
+// EngineRegistry records the engines opened and not yet cleaned up, so that
+// the engines left behind by crashed runs can be found and cleaned up later,
+// since tikv-importer cannot list its engines. The records are persisted as a
+// JSON file, updated whenever an engine is opened or cleaned up. The file is
+// updated under a lock, so the processes sharing it, e.g. the task and
+// tidb-lightning-ctl, keep the changes of each other.
+type EngineRegistry struct {
+	path string
+
+	mu      sync.Mutex
+	engines map[uuid.UUID]EngineRecord
+}
+
+// LoadEngineRegistry reads the registry saved at `path`, or creates an empty
+// one if the file does not exist.
+func LoadEngineRegistry(path string) (*EngineRegistry, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	engines, err := readEngineRecords(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &EngineRegistry{path: path, engines: engines}, nil
+}
+
+func readEngineRecords(path string) (map[uuid.UUID]EngineRecord, error) {
+	engines := make(map[uuid.UUID]EngineRecord)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return engines, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var records []EngineRecord
+	if err := json.Unmarshal(content, &records); err != nil {
+		return nil, errors.Annotatef(err, "invalid %s", path)
+	}
+	for _, record := range records {
+		engines[record.UUID] = record
+	}
+	return engines, nil
+}
+
+// Engines returns the recorded engines ordered by the table and engine ID.
+func (registry *EngineRegistry) Engines() []EngineRecord {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	return registry.sortedEngines()
+}
+
+func (registry *EngineRegistry) sortedEngines() []EngineRecord {
+	records := make([]EngineRecord, 0, len(registry.engines))
+	for _, record := range registry.engines {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Table != records[j].Table {
+			return records[i].Table < records[j].Table
+		}
+		return records[i].EngineID < records[j].EngineID
+	})
+	return records
+}
+
+func (registry *EngineRegistry) add(tableName string, engineID int, engineUUID uuid.UUID) error {
+	return registry.update(func(engines map[uuid.UUID]EngineRecord) bool {
+		if _, ok := engines[engineUUID]; ok {
+			return false
+		}
+		engines[engineUUID] = EngineRecord{
+			UUID:     engineUUID,
+			Table:    tableName,
+			EngineID: engineID,
+			OpenedAt: time.Now(),
+		}
+		return true
+	})
+}
+
+func (registry *EngineRegistry) remove(engineUUID uuid.UUID) error {
+	return registry.update(func(engines map[uuid.UUID]EngineRecord) bool {
+		if _, ok := engines[engineUUID]; !ok {
+			return false
+		}
+		delete(engines, engineUUID)
+		return true
+	})
+}
+
+// update reloads the records saved by all processes, applies the change, and
+// saves them if changed, under the lock of the file.
+func (registry *EngineRegistry) update(change func(engines map[uuid.UUID]EngineRecord) bool) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	lock, err := os.OpenFile(registry.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return errors.Trace(err)
+	}
+	defer unlockFile(lock)
+
+	engines, err := readEngineRecords(registry.path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	registry.engines = engines
+	if !change(engines) {
+		return nil
+	}
+	return errors.Trace(registry.save())
+}
+
+// save writes the records into the file. The locks must be held.
+func (registry *EngineRegistry) save() error {
+	content, err := json.Marshal(registry.sortedEngines())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// write to a temporary file first, so a crash won't leave a corrupted registry.
+	tmpPath := registry.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmpPath, registry.path))
+}
@@ -0,0 +1,33 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package kv
+
+import (
+	"os"
+
+	"github.com/pingcap/errors"
+	"golang.org/x/sys/unix"
+)
+
+// lockFile blocks until the exclusive advisory lock of the file is acquired.
+func lockFile(file *os.File) error {
+	return errors.Trace(unix.Flock(int(file.Fd()), unix.LOCK_EX))
+}
+
+func unlockFile(file *os.File) error {
+	return errors.Trace(unix.Flock(int(file.Fd()), unix.LOCK_UN))
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/meta/autoid"
+	kvec "github.com/pingcap/tidb/util/kvencoder"
+	"github.com/pingcap/tidb/util/mock"
+)
+
+// kvMemBuf is the transaction of the session, which only records the KV pairs
+// written into it. In lightning mode, tables.AddRecord writes the row and the
+// index entries directly into the transaction without reading anything, so
+// the other methods of kv.Transaction are never called.
+type kvMemBuf struct {
+	kv.Transaction
+	pairs   []kvec.KvPair
+	buffers KVBuffers
+}
+
+// Set implements kv.Mutator. The key and value are copied into the buffers, as
+// AddRecord reuses their memory for the next row.
+func (mb *kvMemBuf) Set(k kv.Key, v []byte) error {
+	buf := mb.buffers.alloc(len(k) + len(v))[:0]
+	buf = append(buf, k...)
+	buf = append(buf, v...)
+	mb.pairs = append(mb.pairs, kvec.KvPair{
+		Key: buf[:len(k):len(k)],
+		Val: buf[len(k):],
+	})
+	return nil
+}
+
+// SetOption implements kv.Transaction.
+func (mb *kvMemBuf) SetOption(kv.Option, interface{}) {}
+
+// DelOption implements kv.Transaction.
+func (mb *kvMemBuf) DelOption(kv.Option) {}
+
+// session is the context for encoding rows via tables.AddRecord, collecting
+// the KV pairs instead of writing them into a store.
+type session struct {
+	*mock.Context
+	txn kvMemBuf
+}
+
+func newSession(sqlMode mysql.SQLMode, alloc autoid.Allocator) *session {
+	se := &session{Context: mock.NewContext()}
+	vars := se.GetSessionVars()
+	vars.IDAllocator = alloc
+	vars.LightningMode = true
+	vars.SkipUTF8Check = true
+	vars.SQLMode = sqlMode
+	vars.StrictSQLMode = sqlMode.HasStrictMode()
+
+	// the same statement context as an INSERT statement.
+	sc := vars.StmtCtx
+	sc.InInsertStmt = true
+	sc.BadNullAsWarning = !vars.StrictSQLMode
+	sc.TruncateAsWarning = !vars.StrictSQLMode
+	sc.DividedByZeroAsWarning = !vars.StrictSQLMode
+	sc.IgnoreZeroInDate = !vars.StrictSQLMode
+	sc.TimeZone = vars.Location()
+	return se
+}
+
+// Txn implements sessionctx.Context.
+func (se *session) Txn(bool) kv.Transaction {
+	return &se.txn
+}
+
+// takePairs returns the KV pairs written since the last call.
+func (se *session) takePairs() []kvec.KvPair {
+	pairs := se.txn.pairs
+	se.txn.pairs = nil
+	// the warnings are not reported, don't let them pile up.
+	se.GetSessionVars().StmtCtx.SetWarnings(nil)
+	return pairs
+}
@@ -14,11 +14,24 @@
 package kv
 
 import (
+	"encoding/binary"
+	"hash/fnv"
+	"strings"
+
 	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
 	"github.com/pingcap/tidb-lightning/lightning/common"
 	"github.com/pingcap/tidb-lightning/lightning/metric"
+	"github.com/pingcap/tidb/expression"
 	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/meta/autoid"
+	plannercore "github.com/pingcap/tidb/planner/core"
+	"github.com/pingcap/tidb/sessionctx/variable"
+	"github.com/pingcap/tidb/table"
+	"github.com/pingcap/tidb/table/tables"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/chunk"
 	kvec "github.com/pingcap/tidb/util/kvencoder"
 )
 
@@ -32,13 +45,63 @@ type TableKVEncoder struct {
 	tableID     int64
 	encoder     kvec.KvEncoder
 	idAllocator autoid.Allocator
+	router      *partitionRouter // nil if the table is not partitioned
+
+	// for encoding the rows directly, see Datums2KV.
+	sqlMode mysql.SQLMode
+	se      *session
+	tbl     table.Table
+	// the expressions of the generated columns, by the column offsets.
+	genExprs map[int]expression.Expression
+	// whether the table contains generated columns whose expressions cannot
+	// be evaluated here, which can only be computed by executing the INSERT
+	// statement.
+	hasGenerated bool
+	// the number of shard bits of the AUTO_RANDOM primary key, 0 if the
+	// primary key is not AUTO_RANDOM.
+	autoRandomBits uint64
+	// the number of shard bits of _tidb_rowid, i.e. SHARD_ROW_ID_BITS.
+	shardRowIDBits uint64
+	// the positions in WritableIndices of the indices whose keys are trimmed
+	// under the new collation framework, see EnableNewCollation.
+	paddedIndices []int
+	// whether all columns are numeric or temporal, see isNumericOnly.
+	numericOnly bool
+
+	// for encoding the rows with prepared statements, see EncodePrepared.
+	usePrepareStmt bool
+	// the IDs of the prepared INSERT statements, by the column lists.
+	stmtIDs map[string]uint32
 }
 
 func NewTableKVEncoder(
 	dbName string,
-	table string, tableID int64,
+	table string, tableInfo *model.TableInfo,
 	sqlMode string, alloc autoid.Allocator) (*TableKVEncoder, error) {
 
+	router, err := newPartitionRouter(tableInfo)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	mode, err := mysql.GetSQLMode(sqlMode)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// the rows are encoded against the logical table, and then moved into the
+	// partitions by the router, the same as the KV pairs from SQL2KV.
+	logicalInfo := *tableInfo
+	logicalInfo.Partition = nil
+	tbl, err := tables.TableFromMeta(alloc, &logicalInfo)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	se := newSession(mode, alloc)
+	genExprs, genErr := buildGeneratedExprs(se, tbl)
+	if genErr != nil {
+		common.TableLogger(table).Warnf("generated columns cannot be computed directly, fallback to SQL: %v", genErr)
+	}
+
 	encoder, err := kvec.New(dbName, alloc)
 	if err != nil {
 		common.AppLogger.Errorf("err %s", errors.ErrorStack(err))
@@ -52,9 +115,20 @@ func NewTableKVEncoder(
 
 	kvcodec := &TableKVEncoder{
 		table:       table,
-		tableID:     tableID,
+		tableID:     tableInfo.ID,
 		encoder:     encoder,
 		idAllocator: alloc,
+		router:      router,
+
+		sqlMode:      mode,
+		se:           se,
+		tbl:          tbl,
+		genExprs:     genExprs,
+		hasGenerated: genErr != nil,
+		numericOnly:  isNumericOnly(tbl.Cols()),
+	}
+	if !tableInfo.PKIsHandle {
+		kvcodec.shardRowIDBits = tableInfo.ShardRowIDBits
 	}
 
 	if err := kvcodec.init(sqlMode); err != nil {
@@ -67,6 +141,29 @@ func NewTableKVEncoder(
 	return kvcodec, nil
 }
 
+// buildGeneratedExprs rewrites the expressions of the generated columns of the
+// table, the same way as the INSERT statement does.
+func buildGeneratedExprs(se *session, tbl table.Table) (map[int]expression.Expression, error) {
+	var genExprs map[int]expression.Expression
+	for _, col := range tbl.Cols() {
+		if !col.IsGenerated() {
+			continue
+		}
+		if col.GeneratedExpr == nil {
+			return nil, errors.Errorf("missing expression of generated column %s", col.Name.O)
+		}
+		expr, err := expression.RewriteSimpleExprWithTableInfo(se, tbl.Meta(), col.GeneratedExpr)
+		if err != nil {
+			return nil, errors.Annotatef(err, "generated column %s", col.Name.O)
+		}
+		if genExprs == nil {
+			genExprs = make(map[int]expression.Expression)
+		}
+		genExprs[col.Offset] = expr
+	}
+	return genExprs, nil
+}
+
 func (kvcodec *TableKVEncoder) init(sqlMode string) error {
 	err := kvcodec.encoder.SetSystemVariable("sql_mode", sqlMode)
 	if err != nil {
@@ -77,17 +174,479 @@ func (kvcodec *TableKVEncoder) init(sqlMode string) error {
 }
 
 func (kvcodec *TableKVEncoder) Close() error {
+	kvcodec.se.txn.buffers.Recycle()
 	metric.KvEncoderCounter.WithLabelValues("closed").Inc()
 	return errors.Trace(kvcodec.encoder.Close())
 }
 
 func (kvcodec *TableKVEncoder) SQL2KV(sql string) ([]kvec.KvPair, uint64, error) {
+	if len(kvcodec.paddedIndices) > 0 {
+		return nil, 0, errors.Errorf("table %s cannot be encoded through SQL when new collation is enabled", kvcodec.table)
+	}
+
 	// via sql execution
 	kvPairs, rowsAffected, err := kvcodec.encoder.Encode(sql, kvcodec.tableID)
 	if err != nil {
-		common.AppLogger.Errorf("[sql2kv] sql encode error = %v", err)
+		common.AppLogger.Errorf("[sql2kv] sql encode error = %v", common.RedactError(err))
 		return nil, 0, errors.Trace(err)
 	}
 
+	if kvcodec.router != nil {
+		if err := kvcodec.router.route(kvPairs); err != nil {
+			common.AppLogger.Errorf("[sql2kv] partition routing error = %v", common.RedactError(err))
+			return nil, 0, errors.Trace(err)
+		}
+	}
+
 	return kvPairs, rowsAffected, nil
 }
+
+// ParseRow parses a row read from the data file into datums for Datums2KV.
+// ErrUnsupportedValue is returned if the row cannot be encoded directly, and
+// needs to go through SQL2KV instead.
+func (kvcodec *TableKVEncoder) ParseRow(row []byte) ([]types.Datum, error) {
+	return parseRowValues(row, kvcodec.sqlMode, kvcodec.numericOnly)
+}
+
+// EnablePrepareStmt makes UsePrepareStmt return true, so the parsed rows are
+// encoded by EncodePrepared instead of Datums2KV.
+func (kvcodec *TableKVEncoder) EnablePrepareStmt() {
+	kvcodec.usePrepareStmt = true
+}
+
+// UsePrepareStmt returns whether the rows parsed by ParseRow should be encoded
+// by EncodePrepared. It is always true if the table has generated columns
+// which cannot be computed by Datums2KV.
+func (kvcodec *TableKVEncoder) UsePrepareStmt() bool {
+	return kvcodec.usePrepareStmt || kvcodec.hasGenerated
+}
+
+// EncodePrepared encodes a row parsed by ParseRow by executing a prepared
+// INSERT statement with the values as the parameters. Like SQL2KV, the row
+// goes through the executor of TiDB, but the statement is only parsed once for
+// each column list, instead of building and parsing a statement of every row.
+// `permutation` and `rowID` are the same as those of Datums2KV, which fills
+// the AUTO_RANDOM values and rebases the allocator by the row IDs in the same
+// way, as the executor knows neither. ErrUnsupportedValue is returned if the
+// row contains decimal or binary literals, which need to go through SQL2KV.
+func (kvcodec *TableKVEncoder) EncodePrepared(permutation []int, values []types.Datum, rowID int64) ([]kvec.KvPair, error) {
+	if len(kvcodec.paddedIndices) > 0 {
+		return nil, errors.Errorf("table %s cannot be encoded through SQL when new collation is enabled", kvcodec.table)
+	}
+	if len(values) != len(permutation) {
+		return nil, errors.Errorf("column count mismatch, expected %d, got %d", len(permutation), len(values))
+	}
+
+	cols := kvcodec.tbl.Cols()
+	names := make([]string, 0, len(permutation)+1)
+	params := make([]interface{}, 0, len(values)+1)
+	hasAutoRandom := false
+	for i, offset := range permutation {
+		value := values[i]
+		switch {
+		case offset == len(cols):
+			names = append(names, model.ExtraHandleName.O)
+			id, err := value.ToInt64(kvcodec.se.GetSessionVars().StmtCtx)
+			if err != nil {
+				return nil, errors.Annotatef(err, "invalid %s", model.ExtraHandleName)
+			}
+			if err := kvcodec.rebaseRowID(id); err != nil {
+				return nil, errors.Trace(err)
+			}
+		case kvcodec.autoRandomBits > 0 && mysql.HasPriKeyFlag(cols[offset].Flag):
+			names = append(names, cols[offset].Name.O)
+			var err error
+			if value, err = kvcodec.autoRandomValue(value, true, cols[offset], rowID); err != nil {
+				return nil, columnError(cols[offset], err)
+			}
+			hasAutoRandom = true
+		default:
+			names = append(names, cols[offset].Name.O)
+		}
+		switch value.Kind() {
+		case types.KindMysqlDecimal, types.KindBinaryLiteral:
+			// TiDB does not accept these as the parameters, and converting
+			// them into strings changes how they are cast.
+			return nil, errors.Annotatef(ErrUnsupportedValue, "parameter %d", i)
+		}
+		params = append(params, value.GetValue())
+	}
+	// the missing AUTO_RANDOM value is generated from the row ID.
+	if kvcodec.autoRandomBits > 0 && !hasAutoRandom {
+		for _, col := range cols {
+			if !mysql.HasPriKeyFlag(col.Flag) {
+				continue
+			}
+			value, err := kvcodec.autoRandomValue(types.Datum{}, false, col, rowID)
+			if err != nil {
+				return nil, columnError(col, err)
+			}
+			names = append(names, col.Name.O)
+			params = append(params, value.GetValue())
+		}
+	}
+
+	stmtID, err := kvcodec.prepareInsert(names)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	kvPairs, _, err := kvcodec.encoder.EncodePrepareStmt(kvcodec.tableID, stmtID, params...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if kvcodec.router != nil {
+		if err := kvcodec.router.route(kvPairs); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return kvPairs, nil
+}
+
+// prepareInsert returns the ID of the INSERT statement of the table with the
+// columns, preparing it on first use.
+func (kvcodec *TableKVEncoder) prepareInsert(names []string) (uint32, error) {
+	var query strings.Builder
+	query.WriteString("INSERT INTO ")
+	common.WriteMySQLIdentifier(&query, kvcodec.table)
+	query.WriteByte('(')
+	for i, name := range names {
+		if i > 0 {
+			query.WriteByte(',')
+		}
+		common.WriteMySQLIdentifier(&query, name)
+	}
+	query.WriteString(") VALUES (")
+	for i := range names {
+		if i > 0 {
+			query.WriteByte(',')
+		}
+		query.WriteByte('?')
+	}
+	query.WriteByte(')')
+
+	if stmtID, ok := kvcodec.stmtIDs[query.String()]; ok {
+		return stmtID, nil
+	}
+	stmtID, err := kvcodec.encoder.PrepareStmt(query.String())
+	if err != nil {
+		return 0, errors.Annotatef(err, "failed to prepare %s", query.String())
+	}
+	if kvcodec.stmtIDs == nil {
+		kvcodec.stmtIDs = make(map[string]uint32)
+	}
+	kvcodec.stmtIDs[query.String()] = stmtID
+	return stmtID, nil
+}
+
+// SetAutoRandomBits declares the integer primary key of the table is
+// AUTO_RANDOM with `bits` shard bits, which the vendored table schema cannot
+// express.
+func (kvcodec *TableKVEncoder) SetAutoRandomBits(bits uint64) error {
+	meta := kvcodec.tbl.Meta()
+	if !meta.PKIsHandle {
+		return errors.Errorf("table %s has AUTO_RANDOM but no integer primary key", kvcodec.table)
+	}
+	if bits == 0 || bits > maxAutoRandomBits {
+		return errors.Errorf("invalid AUTO_RANDOM(%d) of table %s", bits, kvcodec.table)
+	}
+	kvcodec.autoRandomBits = bits
+	return nil
+}
+
+// SetTimeZone sets the time_zone of the encoding session, in which the
+// TIMESTAMP values of the rows are interpreted. The local time zone is used if
+// unset.
+func (kvcodec *TableKVEncoder) SetTimeZone(timeZone string) error {
+	vars := kvcodec.se.GetSessionVars()
+	if err := vars.SetSystemVar(variable.TimeZone, timeZone); err != nil {
+		return errors.Annotatef(err, "invalid time zone %s", timeZone)
+	}
+	vars.StmtCtx.TimeZone = vars.Location()
+	return errors.Trace(kvcodec.encoder.SetSystemVariable(variable.TimeZone, timeZone))
+}
+
+// ShardRowID returns the _tidb_rowid of the row with the given row ID. If the
+// table has SHARD_ROW_ID_BITS, the row ID is prefixed by the shard bits the
+// same way as TiDB does, so the rows are scattered among several ranges
+// instead of making a single hot region.
+func (kvcodec *TableKVEncoder) ShardRowID(rowID int64) int64 {
+	if kvcodec.shardRowIDBits == 0 {
+		return rowID
+	}
+	return shardedID(rowID, kvcodec.shardRowIDBits, 63-kvcodec.shardRowIDBits)
+}
+
+// ColumnPermutation maps the column list `(a, b, c)` of the rows to the
+// offsets of the table columns. The _tidb_rowid column is mapped to the
+// number of columns. An empty column list means all columns in order.
+func (kvcodec *TableKVEncoder) ColumnPermutation(columns []byte) ([]int, error) {
+	cols := kvcodec.tbl.Cols()
+	if len(columns) == 0 {
+		permutation := make([]int, len(cols))
+		for i := range permutation {
+			permutation[i] = i
+		}
+		return permutation, nil
+	}
+
+	names, err := parseColumnNames(columns, kvcodec.sqlMode)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	permutation := make([]int, 0, len(names))
+	for _, name := range names {
+		if strings.EqualFold(name, model.ExtraHandleName.L) {
+			permutation = append(permutation, len(cols))
+			continue
+		}
+		col := table.FindCol(cols, name)
+		if col == nil {
+			return nil, errors.Errorf("unknown column %s in table %s", name, kvcodec.table)
+		}
+		permutation = append(permutation, col.Offset)
+	}
+	return permutation, nil
+}
+
+// AllocatesAutoIncrement returns whether the rows of the column permutation
+// leave the AUTO_INCREMENT column to be allocated. The allocated values depend
+// on the order the rows of all chunks are encoded, so they differ when a chunk
+// is encoded again after resuming.
+func (kvcodec *TableKVEncoder) AllocatesAutoIncrement(permutation []int) bool {
+	for _, col := range kvcodec.tbl.Cols() {
+		if !mysql.HasAutoIncrementFlag(col.Flag) {
+			continue
+		}
+		for _, offset := range permutation {
+			if offset == col.Offset {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Datums2KV encodes a row into KV pairs directly with the tablecodec, without
+// building and executing an INSERT statement. `values[i]` is the value of the
+// column at offset `permutation[i]`. The values are converted, and the missing
+// columns filled, the same way as an INSERT statement does. The generated
+// columns must not be given, their values are computed from the other
+// columns. `rowID` is the ID of the row in the data files, from which the
+// missing AUTO_RANDOM values are generated.
+func (kvcodec *TableKVEncoder) Datums2KV(permutation []int, values []types.Datum, rowID int64) ([]kvec.KvPair, error) {
+	if kvcodec.hasGenerated {
+		return nil, errors.Errorf("table %s has generated columns which cannot be computed directly", kvcodec.table)
+	}
+	if len(values) != len(permutation) {
+		return nil, errors.Errorf("column count mismatch, expected %d, got %d", len(permutation), len(values))
+	}
+
+	se := kvcodec.se
+	sc := se.GetSessionVars().StmtCtx
+	cols := kvcodec.tbl.Cols()
+	row := make([]types.Datum, len(cols), len(cols)+1)
+	hasValue := make([]bool, len(cols))
+	var extraHandle *types.Datum
+	for i, offset := range permutation {
+		if offset == len(cols) {
+			id, err := values[i].ToInt64(sc)
+			if err != nil {
+				return nil, errors.Annotatef(err, "invalid %s", model.ExtraHandleName)
+			}
+			if err := kvcodec.rebaseRowID(id); err != nil {
+				return nil, errors.Trace(err)
+			}
+			d := types.NewIntDatum(id)
+			extraHandle = &d
+			continue
+		}
+		if cols[offset].IsGenerated() {
+			return nil, plannercore.ErrBadGeneratedColumn.GenWithStackByArgs(cols[offset].Name.O, kvcodec.table)
+		}
+		casted, ok := types.Datum{}, false
+		if kvcodec.numericOnly {
+			casted, ok = castNumeric(values[i], cols[offset])
+		}
+		if !ok {
+			var err error
+			if casted, err = table.CastValue(se, values[i], cols[offset].ToInfo()); err != nil {
+				return nil, columnError(cols[offset], err)
+			}
+		}
+		row[offset] = casted
+		hasValue[offset] = true
+	}
+
+	// a generated column may refer to the base columns defined after it, so
+	// the base columns are all filled first.
+	for i, col := range cols {
+		if _, ok := kvcodec.genExprs[i]; ok {
+			continue
+		}
+		var err error
+		if kvcodec.autoRandomBits > 0 && mysql.HasPriKeyFlag(col.Flag) {
+			row[i], err = kvcodec.autoRandomValue(row[i], hasValue[i], col, rowID)
+		} else if mysql.HasAutoIncrementFlag(col.Flag) {
+			row[i], err = kvcodec.autoIncrementValue(row[i], hasValue[i], col)
+		} else if !hasValue[i] {
+			row[i], err = table.GetColDefaultValue(se, col.ToInfo())
+		}
+		if err != nil {
+			return nil, columnError(col, err)
+		}
+		if row[i], err = col.HandleBadNull(row[i], sc); err != nil {
+			return nil, columnError(col, err)
+		}
+	}
+	// the generated columns can only refer to the generated columns defined
+	// before them, so they are evaluated in order.
+	for i, col := range cols {
+		genExpr, ok := kvcodec.genExprs[i]
+		if !ok {
+			continue
+		}
+		val, err := genExpr.Eval(chunk.MutRowFromDatums(row).ToRow())
+		if err != nil {
+			return nil, columnError(col, err)
+		}
+		if row[i], err = table.CastValue(se, val, col.ToInfo()); err != nil {
+			return nil, columnError(col, err)
+		}
+		if row[i], err = col.HandleBadNull(row[i], sc); err != nil {
+			return nil, columnError(col, err)
+		}
+	}
+	if extraHandle != nil {
+		row = append(row, *extraHandle)
+	}
+
+	handle, err := kvcodec.tbl.AddRecord(se, row, true)
+	kvPairs := se.takePairs()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(kvcodec.paddedIndices) > 0 {
+		if err := kvcodec.trimPaddedIndexKeys(kvPairs, row, handle); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if kvcodec.router != nil {
+		if err := kvcodec.router.route(kvPairs); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return kvPairs, nil
+}
+
+// rebaseRowID moves the allocator past the explicit _tidb_rowid. Only the
+// incremental bits are allocated, the shard bits are not.
+func (kvcodec *TableKVEncoder) rebaseRowID(id int64) error {
+	if id <= 0 {
+		return nil
+	}
+	incrementalMask := int64(1)<<(63-kvcodec.shardRowIDBits) - 1
+	return errors.Trace(kvcodec.idAllocator.Rebase(kvcodec.tableID, id&incrementalMask, false))
+}
+
+// TakeKVBuffers returns the buffers holding the KV pairs encoded by Datums2KV
+// so far. The caller should recycle them after the pairs are delivered.
+func (kvcodec *TableKVEncoder) TakeKVBuffers() *KVBuffers {
+	buffers := new(KVBuffers)
+	buffers.Merge(&kvcodec.se.txn.buffers)
+	return buffers
+}
+
+// columnError adds the column name to the error of converting its value, in
+// the same way as the INSERT statement.
+func columnError(col *table.Column, err error) error {
+	if types.ErrDataTooLong.Equal(err) {
+		return types.ErrDataTooLong.GenWithStack("Data too long for column '%s'", col.Name.O)
+	}
+	return errors.Annotatef(err, "column %s", col.Name.O)
+}
+
+// autoIncrementValue fills the AUTO_INCREMENT column like an INSERT statement:
+// a non-zero value rebases the allocator, while NULL (or 0 unless the sql_mode
+// contains NO_AUTO_VALUE_ON_ZERO) is replaced by an ID allocated past all the
+// values given so far. The allocated IDs are not derived from the position of
+// the row, see AllocatesAutoIncrement.
+func (kvcodec *TableKVEncoder) autoIncrementValue(d types.Datum, hasValue bool, col *table.Column) (types.Datum, error) {
+	if !hasValue {
+		d.SetNull()
+	}
+	var id int64
+	if !d.IsNull() {
+		var err error
+		if id, err = d.ToInt64(kvcodec.se.GetSessionVars().StmtCtx); err != nil {
+			return d, errors.Trace(err)
+		}
+	}
+	if id != 0 {
+		if err := kvcodec.tbl.RebaseAutoID(kvcodec.se, id, true); err != nil {
+			return d, errors.Trace(err)
+		}
+		d.SetAutoID(id, col.Flag)
+		return d, nil
+	}
+
+	if d.IsNull() || kvcodec.sqlMode&mysql.ModeNoAutoValueOnZero == 0 {
+		var err error
+		if id, err = kvcodec.idAllocator.Alloc(kvcodec.tableID); err != nil {
+			return d, errors.Trace(err)
+		}
+	}
+	d.SetAutoID(id, col.Flag)
+	// still converted to catch the overflow of the smaller integer types.
+	return table.CastValue(kvcodec.se, d, col.ToInfo())
+}
+
+// maxAutoRandomBits is the maximum number of shard bits of AUTO_RANDOM.
+const maxAutoRandomBits = 15
+
+// autoRandomValue fills the AUTO_RANDOM primary key. An explicit value is kept
+// and rebases the allocator by its incremental bits. Otherwise the value is
+// composed of the shard bits hashed from the row ID, followed by the row ID.
+func (kvcodec *TableKVEncoder) autoRandomValue(d types.Datum, hasValue bool, col *table.Column, rowID int64) (types.Datum, error) {
+	incrementalBits := 64 - kvcodec.autoRandomBits
+	if !mysql.HasUnsignedFlag(col.Flag) {
+		incrementalBits-- // the sign bit
+	}
+	incrementalMask := int64(1)<<incrementalBits - 1
+
+	var id int64
+	if hasValue && !d.IsNull() {
+		var err error
+		if id, err = d.ToInt64(kvcodec.se.GetSessionVars().StmtCtx); err != nil {
+			return d, errors.Trace(err)
+		}
+		if id < 0 && !mysql.HasUnsignedFlag(col.Flag) {
+			return d, errors.Errorf("invalid AUTO_RANDOM value %d, it must be positive", id)
+		}
+	}
+	if id == 0 {
+		if rowID <= 0 || rowID > incrementalMask {
+			return d, errors.Errorf("row ID %d out of the range of AUTO_RANDOM(%d)", rowID, kvcodec.autoRandomBits)
+		}
+		id = shardedID(rowID, kvcodec.autoRandomBits, incrementalBits)
+	}
+
+	if err := kvcodec.idAllocator.Rebase(kvcodec.tableID, id&incrementalMask, false); err != nil {
+		return d, errors.Trace(err)
+	}
+	d.SetAutoID(id, col.Flag)
+	return d, nil
+}
+
+// shardedID composes an ID from the shard bits hashed from `id`, followed by
+// the lowest `incrementalBits` bits of `id`.
+func shardedID(id int64, shardBits uint64, incrementalBits uint64) int64 {
+	hash := fnv.New64a()
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(id))
+	hash.Write(buf[:])
+	shard := int64(hash.Sum64() & (1<<shardBits - 1))
+	return shard<<incrementalBits | id&(1<<incrementalBits-1)
+}
@@ -0,0 +1,571 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb/ddl"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/types"
+	kvec "github.com/pingcap/tidb/util/kvencoder"
+	"github.com/pingcap/tidb/util/mock"
+)
+
+var _ = Suite(&sql2kvSuite{})
+
+type sql2kvSuite struct{}
+
+func (s *sql2kvSuite) TestParseRowValues(c *C) {
+	values, err := ParseRowValues([]byte(`( 1, -2, 18446744073709551615, 1.50, -1e3, 'a''b\n\%', "c", NULL, \N, TRUE, x'0a', 0x0B, b'11', _binary 'd' )`), mysql.ModeNone)
+	c.Assert(err, IsNil)
+	c.Assert(values, HasLen, 14)
+	c.Assert(values[0].GetInt64(), Equals, int64(1))
+	c.Assert(values[1].GetInt64(), Equals, int64(-2))
+	c.Assert(values[2].GetUint64(), Equals, uint64(18446744073709551615))
+	c.Assert(values[3].GetMysqlDecimal().String(), Equals, "1.50")
+	c.Assert(values[4].GetFloat64(), Equals, -1000.0)
+	c.Assert(values[5].GetString(), Equals, "a'b\n\\%")
+	c.Assert(values[6].GetString(), Equals, "c")
+	c.Assert(values[7].IsNull(), IsTrue)
+	c.Assert(values[8].IsNull(), IsTrue)
+	c.Assert(values[9].GetInt64(), Equals, int64(1))
+	c.Assert(values[10].GetBinaryLiteral(), DeepEquals, types.BinaryLiteral{0x0a})
+	c.Assert(values[11].GetBinaryLiteral(), DeepEquals, types.BinaryLiteral{0x0b})
+	c.Assert(values[12].GetBinaryLiteral(), DeepEquals, types.BinaryLiteral{0x03})
+	c.Assert(values[13].GetBytes(), DeepEquals, []byte("d"))
+
+	values, err = ParseRowValues([]byte(`('a\n')`), mysql.ModeNoBackslashEscapes)
+	c.Assert(err, IsNil)
+	c.Assert(values[0].GetString(), Equals, `a\n`)
+
+	for _, row := range []string{"(NOW())", "(1 + 2)", "('a' 'b')", "(_utf8mb4 'a')", "(1", "(1) (2)"} {
+		_, err = ParseRowValues([]byte(row), mysql.ModeNone)
+		c.Assert(errors.Cause(err), Equals, ErrUnsupportedValue, Commentf("row %s", row))
+	}
+}
+
+func (s *sql2kvSuite) TestParseNumericRowValues(c *C) {
+	// the fast paths give the same values as the general parser.
+	for _, row := range []string{
+		`(1, -2, 0, 9223372036854775806, 9223372036854775807, -9223372036854775808, 18446744073709551615)`,
+		`(1.5, -1e3, 2E5, 0x0B, 12ab)`,
+		`('2019-01-02', "03:04:05", '', 'a''b', 'a\nb', 'a' 'b', 'unterminated)`,
+	} {
+		expected, expectedErr := parseRowValues([]byte(row), mysql.ModeNone, false)
+		values, err := parseRowValues([]byte(row), mysql.ModeNone, true)
+		c.Assert(values, DeepEquals, expected, Commentf("row %s", row))
+		c.Assert(errors.Cause(err), DeepEquals, errors.Cause(expectedErr), Commentf("row %s", row))
+	}
+
+	values, err := parseRowValues([]byte(`('a\n')`), mysql.ModeNoBackslashEscapes, true)
+	c.Assert(err, IsNil)
+	c.Assert(values[0].GetString(), Equals, `a\n`)
+}
+
+func (s *sql2kvSuite) TestParseColumnNames(c *C) {
+	names, err := parseColumnNames([]byte("(`a`, b,`c``d`)"), mysql.ModeNone)
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"a", "b", "c`d"})
+
+	_, err = parseColumnNames([]byte("(`a`"), mysql.ModeNone)
+	c.Assert(err, ErrorMatches, "invalid column list.*")
+}
+
+func sortedPairs(kvs []kvec.KvPair) []kvec.KvPair {
+	sort.Slice(kvs, func(i, j int) bool {
+		return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0
+	})
+	return kvs
+}
+
+func (s *sql2kvSuite) TestDatums2KV(c *C) {
+	const createTable = "CREATE TABLE t2kv (a INT, b VARCHAR(8), c DECIMAL(6, 2), d DATETIME, e INT NOT NULL DEFAULT 7, f BIT(4), UNIQUE KEY (a), KEY (b, c))"
+	const sqlMode = "STRICT_TRANS_TABLES"
+
+	stmt, err := parser.New().ParseOneStmt(createTable, "", "")
+	c.Assert(err, IsNil)
+	tableInfo, err := ddl.MockTableInfo(mock.NewContext(), stmt.(*ast.CreateTableStmt), 1000)
+	c.Assert(err, IsNil)
+	tableInfo.State = model.StatePublic
+
+	alloc := NewIDAllocator(0)
+	ddlEncoder, err := kvec.New("sql2kv", alloc)
+	c.Assert(err, IsNil)
+	defer ddlEncoder.Close()
+	c.Assert(ddlEncoder.ExecDDLSQL(createTable), IsNil)
+
+	encoder, err := NewTableKVEncoder("sql2kv", "t2kv", tableInfo, sqlMode, alloc)
+	c.Assert(err, IsNil)
+	defer encoder.Close()
+
+	columns := []byte("(`d`, `a`, `b`, `c`, `f`, `_tidb_rowid`)")
+	permutation, err := encoder.ColumnPermutation(columns)
+	c.Assert(err, IsNil)
+	c.Assert(permutation, DeepEquals, []int{3, 0, 1, 2, 5, 6})
+
+	for i, row := range []string{
+		"('2019-01-02 03:04:05', 1, 'abc', 1.5, 3, 12)",
+		"('2019-01-02', NULL, NULL, '-3.14159', b'101', 13)",
+		"(20190102030405, '7', 'x\\ty', 0, 0x01, 14)",
+	} {
+		expected, _, err := encoder.SQL2KV("INSERT INTO t2kv " + string(columns) + " VALUES " + row)
+		c.Assert(err, IsNil)
+		c.Assert(expected, HasLen, 3)
+
+		values, err := encoder.ParseRow([]byte(row))
+		c.Assert(err, IsNil)
+		kvs, err := encoder.Datums2KV(permutation, values, int64(i+1))
+		c.Assert(err, IsNil)
+		c.Assert(sortedPairs(kvs), DeepEquals, sortedPairs(expected), Commentf("row %d", i))
+	}
+
+	// the values are checked as strictly as an INSERT statement.
+	values, err := encoder.ParseRow([]byte("('2019-01-02', 1, 'too long value', 1, 1, 15)"))
+	c.Assert(err, IsNil)
+	_, err = encoder.Datums2KV(permutation, values, 4)
+	c.Assert(err, ErrorMatches, ".*Data too long for column 'b'.*")
+	_, err = encoder.Datums2KV(permutation, values[:2], 4)
+	c.Assert(err, ErrorMatches, "column count mismatch.*")
+
+	_, err = encoder.ColumnPermutation([]byte("(`a`, `z`)"))
+	c.Assert(err, ErrorMatches, "unknown column z.*")
+}
+
+func (s *sql2kvSuite) TestNumericOnly(c *C) {
+	const createTable = "CREATE TABLE tnum (a TINYINT, b INT UNSIGNED, c BIGINT, d DOUBLE, e FLOAT, f DECIMAL(6, 2), g DATE, h DATETIME, KEY (a, c))"
+	const sqlMode = "STRICT_TRANS_TABLES"
+
+	stmt, err := parser.New().ParseOneStmt(createTable, "", "")
+	c.Assert(err, IsNil)
+	tableInfo, err := ddl.MockTableInfo(mock.NewContext(), stmt.(*ast.CreateTableStmt), 1001)
+	c.Assert(err, IsNil)
+	tableInfo.State = model.StatePublic
+
+	alloc := NewIDAllocator(0)
+	ddlEncoder, err := kvec.New("sql2kv", alloc)
+	c.Assert(err, IsNil)
+	defer ddlEncoder.Close()
+	c.Assert(ddlEncoder.ExecDDLSQL(createTable), IsNil)
+
+	encoder, err := NewTableKVEncoder("sql2kv", "tnum", tableInfo, sqlMode, alloc)
+	c.Assert(err, IsNil)
+	defer encoder.Close()
+	c.Assert(encoder.numericOnly, IsTrue)
+
+	columns := []byte("(`a`, `b`, `c`, `d`, `e`, `f`, `g`, `h`, `_tidb_rowid`)")
+	permutation, err := encoder.ColumnPermutation(columns)
+	c.Assert(err, IsNil)
+
+	for i, row := range []string{
+		"(1, 2, 3, 4.5e0, 6.5e0, 7.25, '2019-01-02', '2019-01-02 03:04:05', 1)",
+		"(-128, 4294967295, -9223372036854775808, -1e300, 1, '8', 20190102, NULL, 2)",
+		"(NULL, 0, 9223372036854775807, 0, NULL, -1, NULL, 20190102030405, 3)",
+	} {
+		expected, _, err := encoder.SQL2KV("INSERT INTO tnum " + string(columns) + " VALUES " + row)
+		c.Assert(err, IsNil)
+
+		values, err := encoder.ParseRow([]byte(row))
+		c.Assert(err, IsNil)
+		kvs, err := encoder.Datums2KV(permutation, values, int64(i+1))
+		c.Assert(err, IsNil)
+		c.Assert(sortedPairs(kvs), DeepEquals, sortedPairs(expected), Commentf("row %d", i))
+	}
+
+	// the values out of range are still checked.
+	for _, row := range []string{
+		"(128, 0, 0, 0, 0, 0, NULL, NULL, 4)",
+		"(0, -1, 0, 0, 0, 0, NULL, NULL, 4)",
+	} {
+		values, err := encoder.ParseRow([]byte(row))
+		c.Assert(err, IsNil)
+		_, err = encoder.Datums2KV(permutation, values, 4)
+		c.Assert(err, NotNil, Commentf("row %s", row))
+	}
+}
+
+func (s *sql2kvSuite) TestAutoRandom(c *C) {
+	stmt, err := parser.New().ParseOneStmt("CREATE TABLE ar (id BIGINT PRIMARY KEY, v INT)", "", "")
+	c.Assert(err, IsNil)
+	tableInfo, err := ddl.MockTableInfo(mock.NewContext(), stmt.(*ast.CreateTableStmt), 1001)
+	c.Assert(err, IsNil)
+	tableInfo.State = model.StatePublic
+
+	alloc := NewIDAllocator(0)
+	encoder, err := NewTableKVEncoder("sql2kv", "ar", tableInfo, "STRICT_TRANS_TABLES", alloc)
+	c.Assert(err, IsNil)
+	defer encoder.Close()
+	c.Assert(encoder.SetAutoRandomBits(16), ErrorMatches, "invalid AUTO_RANDOM.*")
+	c.Assert(encoder.SetAutoRandomBits(5), IsNil)
+	permutation, err := encoder.ColumnPermutation(nil)
+	c.Assert(err, IsNil)
+
+	handleOf := func(kvs []kvec.KvPair) int64 {
+		c.Assert(kvs, HasLen, 1)
+		_, handle, err := tablecodec.DecodeRecordKey(kvs[0].Key)
+		c.Assert(err, IsNil)
+		return handle
+	}
+
+	// the missing ID is generated from the row ID with the shard bits.
+	kvs, err := encoder.Datums2KV(permutation, []types.Datum{types.NewDatum(nil), types.NewIntDatum(1)}, 7)
+	c.Assert(err, IsNil)
+	handle := handleOf(kvs)
+	c.Assert(handle&(1<<58-1), Equals, int64(7))
+	c.Assert(handle >= 0, IsTrue)
+	c.Assert(alloc.Base(), Equals, int64(7))
+
+	// the explicit ID is kept, and rebases the allocator by its incremental bits.
+	explicit := int64(3)<<58 | 100
+	kvs, err = encoder.Datums2KV(permutation, []types.Datum{types.NewIntDatum(explicit), types.NewIntDatum(2)}, 8)
+	c.Assert(err, IsNil)
+	c.Assert(handleOf(kvs), Equals, explicit)
+	c.Assert(alloc.Base(), Equals, int64(100))
+
+	_, err = encoder.Datums2KV(permutation, []types.Datum{types.NewIntDatum(-1), types.NewIntDatum(3)}, 9)
+	c.Assert(err, ErrorMatches, ".*must be positive.*")
+}
+
+func (s *sql2kvSuite) TestShardRowID(c *C) {
+	stmt, err := parser.New().ParseOneStmt("CREATE TABLE sr (v INT)", "", "")
+	c.Assert(err, IsNil)
+	tableInfo, err := ddl.MockTableInfo(mock.NewContext(), stmt.(*ast.CreateTableStmt), 1002)
+	c.Assert(err, IsNil)
+	tableInfo.State = model.StatePublic
+	tableInfo.ShardRowIDBits = 4
+
+	alloc := NewIDAllocator(0)
+	encoder, err := NewTableKVEncoder("sql2kv", "sr", tableInfo, "STRICT_TRANS_TABLES", alloc)
+	c.Assert(err, IsNil)
+	defer encoder.Close()
+
+	// the row IDs are scattered among the shards, keeping the incremental bits.
+	shards := make(map[int64]struct{})
+	for rowID := int64(1); rowID <= 64; rowID++ {
+		handle := encoder.ShardRowID(rowID)
+		c.Assert(handle >= 0, IsTrue)
+		c.Assert(handle&(1<<59-1), Equals, rowID)
+		shards[handle>>59] = struct{}{}
+	}
+	c.Assert(len(shards) > 1, IsTrue)
+
+	// only the incremental bits of the row ID rebase the allocator.
+	permutation, err := encoder.ColumnPermutation([]byte("(`v`,`_tidb_rowid`)"))
+	c.Assert(err, IsNil)
+	_, err = encoder.Datums2KV(permutation, []types.Datum{types.NewIntDatum(1), types.NewIntDatum(encoder.ShardRowID(70))}, 70)
+	c.Assert(err, IsNil)
+	c.Assert(alloc.Base(), Equals, int64(70))
+}
+
+func (s *sql2kvSuite) TestEncodePreparedAutoRandom(c *C) {
+	const createTable = "CREATE TABLE par (id BIGINT PRIMARY KEY, v INT)"
+	stmt, err := parser.New().ParseOneStmt(createTable, "", "")
+	c.Assert(err, IsNil)
+	tableInfo, err := ddl.MockTableInfo(mock.NewContext(), stmt.(*ast.CreateTableStmt), 1009)
+	c.Assert(err, IsNil)
+	tableInfo.State = model.StatePublic
+
+	alloc := NewIDAllocator(0)
+	ddlEncoder, err := kvec.New("sql2kv", alloc)
+	c.Assert(err, IsNil)
+	defer ddlEncoder.Close()
+	c.Assert(ddlEncoder.ExecDDLSQL(createTable), IsNil)
+
+	encoder, err := NewTableKVEncoder("sql2kv", "par", tableInfo, "STRICT_TRANS_TABLES", alloc)
+	c.Assert(err, IsNil)
+	defer encoder.Close()
+	c.Assert(encoder.SetAutoRandomBits(5), IsNil)
+	encoder.EnablePrepareStmt()
+
+	// the prepared statements fill and shard the AUTO_RANDOM values the same
+	// way as Datums2KV.
+	for _, columns := range []string{"", "(`v`)"} {
+		permutation, err := encoder.ColumnPermutation([]byte(columns))
+		c.Assert(err, IsNil)
+		for rowID := int64(1); rowID <= 3; rowID++ {
+			values := []types.Datum{types.NewIntDatum(rowID)}
+			if columns == "" {
+				values = []types.Datum{types.NewDatum(nil), types.NewIntDatum(rowID)}
+			}
+			expected, err := encoder.Datums2KV(permutation, values, rowID)
+			c.Assert(err, IsNil)
+			kvs, err := encoder.EncodePrepared(permutation, values, rowID)
+			c.Assert(err, IsNil)
+			c.Assert(sortedPairs(kvs), DeepEquals, sortedPairs(expected), Commentf("columns %q, row %d", columns, rowID))
+		}
+	}
+
+	// the explicit ID is kept, and rebases the allocator by its incremental bits.
+	permutation, err := encoder.ColumnPermutation(nil)
+	c.Assert(err, IsNil)
+	explicit := int64(3)<<58 | 100
+	kvs, err := encoder.EncodePrepared(permutation, []types.Datum{types.NewIntDatum(explicit), types.NewIntDatum(2)}, 8)
+	c.Assert(err, IsNil)
+	_, handle, err := tablecodec.DecodeRecordKey(kvs[0].Key)
+	c.Assert(err, IsNil)
+	c.Assert(handle, Equals, explicit)
+	c.Assert(alloc.Base(), Equals, int64(100))
+}
+
+func (s *sql2kvSuite) TestNewCollation(c *C) {
+	newEncoder := func(createTable string, tableID int64) *TableKVEncoder {
+		stmt, err := parser.New().ParseOneStmt(createTable, "", "")
+		c.Assert(err, IsNil)
+		tableInfo, err := ddl.MockTableInfo(mock.NewContext(), stmt.(*ast.CreateTableStmt), tableID)
+		c.Assert(err, IsNil)
+		tableInfo.State = model.StatePublic
+		encoder, err := NewTableKVEncoder("sql2kv", "nc", tableInfo, "STRICT_TRANS_TABLES", NewIDAllocator(0))
+		c.Assert(err, IsNil)
+		return encoder
+	}
+	encode := func(encoder *TableKVEncoder, row string) []kvec.KvPair {
+		permutation, err := encoder.ColumnPermutation([]byte("(`a`, `b`, `d`, `_tidb_rowid`)"))
+		c.Assert(err, IsNil)
+		values, err := encoder.ParseRow([]byte(row))
+		c.Assert(err, IsNil)
+		kvs, err := encoder.Datums2KV(permutation, values, 1)
+		c.Assert(err, IsNil)
+		c.Assert(kvs, HasLen, 4)
+		return kvs
+	}
+
+	const createTable = "CREATE TABLE nc (a VARCHAR(8) COLLATE utf8mb4_bin, b VARBINARY(8), d VARCHAR(8) COLLATE utf8mb4_bin, UNIQUE KEY (a), KEY (b), KEY (d(2)))"
+	plain := newEncoder(createTable, 1003)
+	defer plain.Close()
+	collated := newEncoder(createTable, 1003)
+	defer collated.Close()
+	c.Assert(collated.EnableNewCollation(), IsNil)
+
+	// the trailing spaces of the `_bin` columns are trimmed from the index
+	// keys, after cutting the prefix, while the binary column is kept.
+	expected := encode(plain, "('x', 'y  ', 'z', 1)")
+	kvs := encode(collated, "('x  ', 'y  ', 'z yz', 1)")
+	for i := range kvs {
+		c.Assert(kvs[i].Key, DeepEquals, expected[i].Key, Commentf("pair %d", i))
+	}
+
+	_, _, err := collated.SQL2KV("INSERT INTO nc VALUES ('x', 'y', 'z')")
+	c.Assert(err, ErrorMatches, ".*new collation.*")
+
+	// the vendored parser does not know the case-insensitive collations.
+	ci := newEncoder("CREATE TABLE nc (a VARCHAR(8), KEY ia (a))", 1004)
+	defer ci.Close()
+	ci.tbl.Meta().Columns[0].Collate = "utf8mb4_general_ci"
+	c.Assert(ci.EnableNewCollation(), ErrorMatches, "index ia of table nc uses column a with collation utf8mb4_general_ci.*")
+}
+
+func (s *sql2kvSuite) TestTimeZone(c *C) {
+	const createTable = "CREATE TABLE tz (a TIMESTAMP NULL, b DATETIME)"
+	stmt, err := parser.New().ParseOneStmt(createTable, "", "")
+	c.Assert(err, IsNil)
+	tableInfo, err := ddl.MockTableInfo(mock.NewContext(), stmt.(*ast.CreateTableStmt), 1005)
+	c.Assert(err, IsNil)
+	tableInfo.State = model.StatePublic
+
+	alloc := NewIDAllocator(0)
+	ddlEncoder, err := kvec.New("sql2kv", alloc)
+	c.Assert(err, IsNil)
+	defer ddlEncoder.Close()
+	c.Assert(ddlEncoder.ExecDDLSQL(createTable), IsNil)
+
+	encode := func(timeZone string, row string) []kvec.KvPair {
+		encoder, err := NewTableKVEncoder("sql2kv", "tz", tableInfo, "STRICT_TRANS_TABLES", alloc)
+		c.Assert(err, IsNil)
+		defer encoder.Close()
+		c.Assert(encoder.SetTimeZone(timeZone), IsNil)
+
+		columns := "(`a`, `b`, `_tidb_rowid`)"
+		permutation, err := encoder.ColumnPermutation([]byte(columns))
+		c.Assert(err, IsNil)
+		values, err := encoder.ParseRow([]byte(row))
+		c.Assert(err, IsNil)
+		kvs, err := encoder.Datums2KV(permutation, values, 1)
+		c.Assert(err, IsNil)
+
+		// the same as the INSERT statement executed in the time zone.
+		expected, _, err := encoder.SQL2KV("INSERT INTO tz " + columns + " VALUES " + row)
+		c.Assert(err, IsNil)
+		c.Assert(kvs, DeepEquals, expected)
+		return kvs
+	}
+
+	// the TIMESTAMP values are stored in UTC, while the DATETIME values are not converted.
+	utc := encode("UTC", "('2019-01-02 00:00:00', '2019-01-02 08:00:00', 1)")
+	shanghai := encode("+08:00", "('2019-01-02 08:00:00', '2019-01-02 08:00:00', 1)")
+	c.Assert(shanghai, DeepEquals, utc)
+
+	encoder, err := NewTableKVEncoder("sql2kv", "tz", tableInfo, "STRICT_TRANS_TABLES", alloc)
+	c.Assert(err, IsNil)
+	defer encoder.Close()
+	c.Assert(encoder.SetTimeZone("Mars/Olympus_Mons"), ErrorMatches, "invalid time zone Mars/Olympus_Mons.*")
+}
+
+func (s *sql2kvSuite) TestGeneratedColumns(c *C) {
+	// the generated columns refer to the base column `e` defined after them.
+	const createTable = "CREATE TABLE gc (a INT, b VARCHAR(8), c INT AS (a * 2 + e) VIRTUAL, d VARCHAR(24) AS (CONCAT(b, '-', c)) STORED, e INT DEFAULT 5, KEY (c), UNIQUE KEY (d))"
+	stmt, err := parser.New().ParseOneStmt(createTable, "", "")
+	c.Assert(err, IsNil)
+	tableInfo, err := ddl.MockTableInfo(mock.NewContext(), stmt.(*ast.CreateTableStmt), 1006)
+	c.Assert(err, IsNil)
+	tableInfo.State = model.StatePublic
+
+	alloc := NewIDAllocator(0)
+	ddlEncoder, err := kvec.New("sql2kv", alloc)
+	c.Assert(err, IsNil)
+	defer ddlEncoder.Close()
+	c.Assert(ddlEncoder.ExecDDLSQL(createTable), IsNil)
+
+	encoder, err := NewTableKVEncoder("sql2kv", "gc", tableInfo, "STRICT_TRANS_TABLES", alloc)
+	c.Assert(err, IsNil)
+	defer encoder.Close()
+
+	columns := []byte("(`a`, `b`, `_tidb_rowid`)")
+	permutation, err := encoder.ColumnPermutation(columns)
+	c.Assert(err, IsNil)
+	for i, row := range []string{"(1, 'x', 1)", "(NULL, 'y', 2)", "(-7, NULL, 3)"} {
+		values, err := encoder.ParseRow([]byte(row))
+		c.Assert(err, IsNil)
+		kvs, err := encoder.Datums2KV(permutation, values, int64(i+1))
+		c.Assert(err, IsNil)
+
+		// the index entries of the generated columns are the same as TiDB,
+		// which is given the default value of `e` explicitly.
+		expected, _, err := encoder.SQL2KV("INSERT INTO gc (`a`, `b`, `_tidb_rowid`, `e`) VALUES " + strings.Replace(row, ")", ", 5)", 1))
+		c.Assert(err, IsNil)
+		c.Assert(expected, HasLen, 3)
+		c.Assert(sortedPairs(kvs), DeepEquals, sortedPairs(expected), Commentf("row %d", i))
+	}
+
+	// the generated columns cannot be given.
+	permutation, err = encoder.ColumnPermutation([]byte("(`a`, `c`)"))
+	c.Assert(err, IsNil)
+	values, err := encoder.ParseRow([]byte("(1, 2)"))
+	c.Assert(err, IsNil)
+	_, err = encoder.Datums2KV(permutation, values, 4)
+	c.Assert(err, ErrorMatches, ".*The value specified for generated column 'c' in table 'gc' is not allowed.*")
+}
+
+func (s *sql2kvSuite) TestAutoIncrementAlloc(c *C) {
+	const createTable = "CREATE TABLE ai (id TINYINT PRIMARY KEY AUTO_INCREMENT, v INT)"
+	stmt, err := parser.New().ParseOneStmt(createTable, "", "")
+	c.Assert(err, IsNil)
+	tableInfo, err := ddl.MockTableInfo(mock.NewContext(), stmt.(*ast.CreateTableStmt), 1007)
+	c.Assert(err, IsNil)
+	tableInfo.State = model.StatePublic
+
+	alloc := NewIDAllocator(0)
+	encoder, err := NewTableKVEncoder("sql2kv", "ai", tableInfo, "STRICT_TRANS_TABLES", alloc)
+	c.Assert(err, IsNil)
+	defer encoder.Close()
+	encode := func(columns string, row string, rowID int64) ([]kvec.KvPair, error) {
+		permutation, err := encoder.ColumnPermutation([]byte(columns))
+		c.Assert(err, IsNil)
+		values, err := encoder.ParseRow([]byte(row))
+		c.Assert(err, IsNil)
+		return encoder.Datums2KV(permutation, values, rowID)
+	}
+	allocates := func(columns string) bool {
+		permutation, err := encoder.ColumnPermutation([]byte(columns))
+		c.Assert(err, IsNil)
+		return encoder.AllocatesAutoIncrement(permutation)
+	}
+	c.Assert(allocates("(`v`)"), IsTrue)
+	c.Assert(allocates("(`id`, `v`)"), IsFalse)
+	c.Assert(allocates(""), IsFalse)
+
+	kvs, err := encode("(`v`)", "(1)", 5)
+	c.Assert(err, IsNil)
+	c.Assert(kvs, HasLen, 1)
+	c.Assert(kvs[0].Key, DeepEquals, []byte(tablecodec.EncodeRowKeyWithHandle(1007, 1)))
+
+	// the missing values are allocated past the explicit ones, so they never
+	// collide with the rows given before.
+	kvs, err = encode("(`id`, `v`)", "(9, 1)", 6)
+	c.Assert(err, IsNil)
+	c.Assert(kvs[0].Key, DeepEquals, []byte(tablecodec.EncodeRowKeyWithHandle(1007, 9)))
+	kvs, err = encode("(`id`, `v`)", "(NULL, 1)", 7)
+	c.Assert(err, IsNil)
+	c.Assert(kvs[0].Key, DeepEquals, []byte(tablecodec.EncodeRowKeyWithHandle(1007, 10)))
+	c.Assert(alloc.Base(), Equals, int64(10))
+
+	// the allocated ID does not fit into the TINYINT column.
+	c.Assert(alloc.Rebase(1007, 127, false), IsNil)
+	_, err = encode("(`v`)", "(1)", 8)
+	c.Assert(err, ErrorMatches, ".*column id.*")
+}
+
+func (s *sql2kvSuite) TestEncodePrepared(c *C) {
+	const createTable = "CREATE TABLE ps (a INT, b VARCHAR(8), c DECIMAL(6, 2), d DATETIME, e BIT(4), UNIQUE KEY (a), KEY (b, c))"
+	stmt, err := parser.New().ParseOneStmt(createTable, "", "")
+	c.Assert(err, IsNil)
+	tableInfo, err := ddl.MockTableInfo(mock.NewContext(), stmt.(*ast.CreateTableStmt), 1008)
+	c.Assert(err, IsNil)
+	tableInfo.State = model.StatePublic
+
+	alloc := NewIDAllocator(0)
+	ddlEncoder, err := kvec.New("sql2kv", alloc)
+	c.Assert(err, IsNil)
+	defer ddlEncoder.Close()
+	c.Assert(ddlEncoder.ExecDDLSQL(createTable), IsNil)
+
+	encoder, err := NewTableKVEncoder("sql2kv", "ps", tableInfo, "STRICT_TRANS_TABLES", alloc)
+	c.Assert(err, IsNil)
+	defer encoder.Close()
+	c.Assert(encoder.UsePrepareStmt(), IsFalse)
+	encoder.EnablePrepareStmt()
+	c.Assert(encoder.UsePrepareStmt(), IsTrue)
+
+	columns := []byte("(`d`, `a`, `b`, `c`, `e`, `_tidb_rowid`)")
+	permutation, err := encoder.ColumnPermutation(columns)
+	c.Assert(err, IsNil)
+	for _, row := range []string{
+		"('2019-01-02 03:04:05', 1, 'abc', '1.5', 3, 12)",
+		"('2019-01-02', NULL, NULL, '-3.14159', 1e1, 13)",
+		"(20190102030405, '7', 'x\\ty', 0, NULL, 14)",
+	} {
+		expected, _, err := encoder.SQL2KV("INSERT INTO ps " + string(columns) + " VALUES " + row)
+		c.Assert(err, IsNil)
+
+		values, err := encoder.ParseRow([]byte(row))
+		c.Assert(err, IsNil)
+		kvs, err := encoder.EncodePrepared(permutation, values, 0)
+		c.Assert(err, IsNil)
+		c.Assert(sortedPairs(kvs), DeepEquals, sortedPairs(expected), Commentf("row %s", row))
+	}
+	c.Assert(encoder.stmtIDs, HasLen, 1)
+	// the explicit row IDs rebase the allocator like Datums2KV.
+	c.Assert(alloc.Base(), Equals, int64(14))
+
+	// the values are checked as strictly as an INSERT statement.
+	values, err := encoder.ParseRow([]byte("('2019-01-02', 2, 'too long value', 1, 1, 15)"))
+	c.Assert(err, IsNil)
+	_, err = encoder.EncodePrepared(permutation, values, 0)
+	c.Assert(err, ErrorMatches, ".*Data too long for column 'b'.*")
+
+	// the decimal and binary literals cannot be the parameters.
+	for _, row := range []string{"(NULL, 3, NULL, 1.5, 1, 16)", "(NULL, 3, NULL, 1, b'1', 16)"} {
+		values, err := encoder.ParseRow([]byte(row))
+		c.Assert(err, IsNil)
+		_, err = encoder.EncodePrepared(permutation, values, 0)
+		c.Assert(errors.Cause(err), Equals, ErrUnsupportedValue, Commentf("row %s", row))
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/pingcap/errors"
+)
+
+// The SST files ingested by TiKV are in the block based table format of
+// RocksDB, written the same as by the SstFileWriter of RocksDB:
+//
+//	[data block 1] ... [data block N] [index block] [properties block]
+//	[metaindex block] [footer]
+//
+// Every block is followed by a trailer of the compression type (always none
+// here) and the masked CRC32C of the block and the type. The keys are the
+// internal keys of RocksDB, i.e. the user key followed by the sequence number
+// (0 in an external file) and the value type.
+const (
+	sstBlockSize             = 64 << 10
+	sstDataRestartInterval   = 16
+	sstFormatVersion         = 2
+	sstMagicNumber           = 0x88e241b785f4cff7
+	sstFooterLength          = 53
+	sstBlockTrailerLength    = 5
+	sstMaxBlockHandleLength  = 20
+	sstExternalFileVersion   = 2
+	sstNoCompression         = 0
+	sstChecksumCRC32C        = 1
+	sstValueTypeValue        = 1
+	sstComparatorName        = "leveldb.BytewiseComparator"
+	sstPropertiesBlockName   = "rocksdb.properties"
+	sstCompressionName       = "NoCompression"
+	sstCRC32CMaskDelta       = 0xa282ead8
+	sstExternalVersionProp   = "rocksdb.external_sst_file.version"
+	sstExternalGlobalSeqProp = "rocksdb.external_sst_file.global_seqno"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// maskedCRC32C is the checksum of the block contents stored in the trailer.
+func maskedCRC32C(data ...[]byte) uint32 {
+	var crc uint32
+	for _, d := range data {
+		crc = crc32.Update(crc, crc32cTable, d)
+	}
+	return ((crc >> 15) | (crc << 17)) + sstCRC32CMaskDelta
+}
+
+// blockHandle locates a block in the file, excluding the trailer.
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+func (h blockHandle) encode(dst []byte) []byte {
+	var buf [sstMaxBlockHandleLength]byte
+	n := binary.PutUvarint(buf[:], h.offset)
+	n += binary.PutUvarint(buf[n:], h.size)
+	return append(dst, buf[:n]...)
+}
+
+// blockBuilder builds a block of prefix compressed entries. A full key is
+// stored every `restartInterval` entries, which are listed at the end.
+type blockBuilder struct {
+	restartInterval int
+	buf             []byte
+	restarts        []uint32
+	counter         int
+	lastKey         []byte
+}
+
+func newBlockBuilder(restartInterval int) *blockBuilder {
+	return &blockBuilder{restartInterval: restartInterval, restarts: []uint32{0}}
+}
+
+func (b *blockBuilder) add(key []byte, value []byte) {
+	shared := 0
+	if b.counter < b.restartInterval {
+		for shared < len(key) && shared < len(b.lastKey) && key[shared] == b.lastKey[shared] {
+			shared++
+		}
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.counter = 0
+	}
+	var header [3 * binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(header[:], uint64(shared))
+	n += binary.PutUvarint(header[n:], uint64(len(key)-shared))
+	n += binary.PutUvarint(header[n:], uint64(len(value)))
+	b.buf = append(b.buf, header[:n]...)
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, value...)
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.counter++
+}
+
+func (b *blockBuilder) empty() bool {
+	return len(b.buf) == 0
+}
+
+func (b *blockBuilder) estimatedSize() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+// finish appends the restart points, and returns the block contents, which
+// are valid until the next reset.
+func (b *blockBuilder) finish() []byte {
+	var buf [4]byte
+	for _, restart := range b.restarts {
+		binary.LittleEndian.PutUint32(buf[:], restart)
+		b.buf = append(b.buf, buf[:]...)
+	}
+	binary.LittleEndian.PutUint32(buf[:], uint32(len(b.restarts)))
+	return append(b.buf, buf[:]...)
+}
+
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+	b.restarts = append(b.restarts[:0], 0)
+	b.counter = 0
+	b.lastKey = b.lastKey[:0]
+}
+
+// sstTableWriter writes the KV pairs, in strictly increasing order of the
+// keys, into an SST file which can be ingested by RocksDB.
+type sstTableWriter struct {
+	w      io.Writer
+	offset uint64
+
+	data  *blockBuilder
+	index *blockBuilder
+	// the index entry of the last data block is added once the next key is
+	// known, or the file is finished.
+	pendingIndex  bool
+	pendingHandle blockHandle
+	lastKey       []byte // the last internal key
+
+	numEntries    uint64
+	numDataBlocks uint64
+	rawKeySize    uint64
+	rawValueSize  uint64
+	dataSize      uint64
+}
+
+func newSSTTableWriter(w io.Writer) *sstTableWriter {
+	return &sstTableWriter{
+		w:     w,
+		data:  newBlockBuilder(sstDataRestartInterval),
+		index: newBlockBuilder(1),
+	}
+}
+
+// internalKey appends the sequence number 0 and the value type to the key.
+func internalKey(key []byte) []byte {
+	ikey := make([]byte, len(key)+8)
+	copy(ikey, key)
+	binary.LittleEndian.PutUint64(ikey[len(key):], sstValueTypeValue)
+	return ikey
+}
+
+// Append adds a KV pair. The key must be larger than all keys appended.
+func (tw *sstTableWriter) Append(key []byte, value []byte) error {
+	ikey := internalKey(key)
+	if tw.numEntries > 0 && bytes.Compare(ikey, tw.lastKey) <= 0 {
+		return errors.Errorf("the keys of the SST file are not in increasing order")
+	}
+	if tw.pendingIndex {
+		tw.index.add(tw.lastKey, tw.pendingHandle.encode(nil))
+		tw.pendingIndex = false
+	}
+	tw.data.add(ikey, value)
+	tw.lastKey = ikey
+	tw.numEntries++
+	tw.rawKeySize += uint64(len(ikey))
+	tw.rawValueSize += uint64(len(value))
+	if tw.data.estimatedSize() >= sstBlockSize {
+		return errors.Trace(tw.flushData())
+	}
+	return nil
+}
+
+func (tw *sstTableWriter) flushData() error {
+	if tw.data.empty() {
+		return nil
+	}
+	handle, err := tw.writeBlock(tw.data.finish())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tw.data.reset()
+	tw.pendingIndex = true
+	tw.pendingHandle = handle
+	tw.numDataBlocks++
+	tw.dataSize = tw.offset
+	return nil
+}
+
+// writeBlock writes the block contents and the trailer.
+func (tw *sstTableWriter) writeBlock(contents []byte) (blockHandle, error) {
+	handle := blockHandle{offset: tw.offset, size: uint64(len(contents))}
+	var trailer [sstBlockTrailerLength]byte
+	trailer[0] = sstNoCompression
+	binary.LittleEndian.PutUint32(trailer[1:], maskedCRC32C(contents, trailer[:1]))
+	if _, err := tw.w.Write(contents); err != nil {
+		return handle, errors.Trace(err)
+	}
+	if _, err := tw.w.Write(trailer[:]); err != nil {
+		return handle, errors.Trace(err)
+	}
+	tw.offset += uint64(len(contents)) + sstBlockTrailerLength
+	return handle, nil
+}
+
+// properties lists the table properties of the file, with the uint64 values
+// encoded as varints. The external file version and global sequence number
+// are required by RocksDB to ingest the file.
+func (tw *sstTableWriter) properties(indexSize uint64) map[string][]byte {
+	varint := func(v uint64) []byte {
+		var buf [binary.MaxVarintLen64]byte
+		return append([]byte(nil), buf[:binary.PutUvarint(buf[:], v)]...)
+	}
+	version := make([]byte, 4)
+	binary.LittleEndian.PutUint32(version, sstExternalFileVersion)
+	return map[string][]byte{
+		"rocksdb.comparator":       []byte(sstComparatorName),
+		"rocksdb.compression":      []byte(sstCompressionName),
+		"rocksdb.data.size":        varint(tw.dataSize),
+		"rocksdb.deleted.keys":     varint(0),
+		"rocksdb.filter.size":      varint(0),
+		"rocksdb.fixed.key.length": varint(0),
+		"rocksdb.format.version":   varint(sstFormatVersion),
+		"rocksdb.index.size":       varint(indexSize),
+		"rocksdb.merge.operands":   varint(0),
+		"rocksdb.num.data.blocks":  varint(tw.numDataBlocks),
+		"rocksdb.num.entries":      varint(tw.numEntries),
+		"rocksdb.raw.key.size":     varint(tw.rawKeySize),
+		"rocksdb.raw.value.size":   varint(tw.rawValueSize),
+		sstExternalVersionProp:     version,
+		sstExternalGlobalSeqProp:   make([]byte, 8),
+	}
+}
+
+// Close writes the index, the meta blocks and the footer. The writer is not
+// closed.
+func (tw *sstTableWriter) Close() error {
+	if err := tw.flushData(); err != nil {
+		return errors.Trace(err)
+	}
+	if tw.pendingIndex {
+		tw.index.add(tw.lastKey, tw.pendingHandle.encode(nil))
+		tw.pendingIndex = false
+	}
+	indexHandle, err := tw.writeBlock(tw.index.finish())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	props := tw.properties(indexHandle.size)
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	propsBlock := newBlockBuilder(1)
+	for _, name := range names {
+		propsBlock.add([]byte(name), props[name])
+	}
+	propsHandle, err := tw.writeBlock(propsBlock.finish())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	metaIndex := newBlockBuilder(1)
+	metaIndex.add([]byte(sstPropertiesBlockName), propsHandle.encode(nil))
+	metaIndexHandle, err := tw.writeBlock(metaIndex.finish())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	footer := make([]byte, 0, sstFooterLength)
+	footer = append(footer, sstChecksumCRC32C)
+	footer = metaIndexHandle.encode(footer)
+	footer = indexHandle.encode(footer)
+	footer = footer[:1+2*sstMaxBlockHandleLength]
+	var buf [12]byte
+	binary.LittleEndian.PutUint32(buf[0:], sstFormatVersion)
+	binary.LittleEndian.PutUint64(buf[4:], sstMagicNumber)
+	footer = append(footer, buf[:]...)
+	_, err = tw.w.Write(footer)
+	return errors.Trace(err)
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	. "github.com/pingcap/check"
+)
+
+var _ = Suite(&sstSuite{})
+
+type sstSuite struct{}
+
+type sstEntry struct {
+	key   []byte
+	value []byte
+}
+
+// readBlock reads the block of the handle, and verifies the trailer.
+func readBlock(c *C, file []byte, handle blockHandle) []byte {
+	end := handle.offset + handle.size
+	c.Assert(end+sstBlockTrailerLength <= uint64(len(file)), IsTrue)
+	contents := file[handle.offset:end]
+	trailer := file[end : end+sstBlockTrailerLength]
+	c.Assert(trailer[0], Equals, byte(sstNoCompression))
+	c.Assert(binary.LittleEndian.Uint32(trailer[1:]), Equals, maskedCRC32C(contents, trailer[:1]))
+	return contents
+}
+
+// parseBlock decodes the entries of a block, checking every restart point
+// stores the full key.
+func parseBlock(c *C, block []byte) []sstEntry {
+	numRestarts := int(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	restartsOffset := len(block) - 4 - 4*numRestarts
+	restarts := make(map[int]bool)
+	for i := 0; i < numRestarts; i++ {
+		restarts[int(binary.LittleEndian.Uint32(block[restartsOffset+4*i:]))] = true
+	}
+
+	var entries []sstEntry
+	var lastKey []byte
+	for pos := 0; pos < restartsOffset; {
+		shared, n := binary.Uvarint(block[pos:])
+		start := pos
+		pos += n
+		nonShared, n := binary.Uvarint(block[pos:])
+		pos += n
+		valueLen, n := binary.Uvarint(block[pos:])
+		pos += n
+		if restarts[start] {
+			c.Assert(shared, Equals, uint64(0))
+		}
+		key := append(append([]byte(nil), lastKey[:shared]...), block[pos:pos+int(nonShared)]...)
+		pos += int(nonShared)
+		value := block[pos : pos+int(valueLen)]
+		pos += int(valueLen)
+		entries = append(entries, sstEntry{key: key, value: value})
+		lastKey = key
+	}
+	return entries
+}
+
+func decodeBlockHandle(c *C, b []byte) (blockHandle, int) {
+	offset, n := binary.Uvarint(b)
+	c.Assert(n > 0, IsTrue)
+	size, m := binary.Uvarint(b[n:])
+	c.Assert(m > 0, IsTrue)
+	return blockHandle{offset: offset, size: size}, n + m
+}
+
+// readSST parses the file as a RocksDB block based table, and returns the KV
+// pairs with the internal keys, and the properties.
+func readSST(c *C, file []byte) ([]sstEntry, map[string][]byte) {
+	c.Assert(len(file) >= sstFooterLength, IsTrue)
+	footer := file[len(file)-sstFooterLength:]
+	c.Assert(footer[0], Equals, byte(sstChecksumCRC32C))
+	c.Assert(binary.LittleEndian.Uint32(footer[41:]), Equals, uint32(sstFormatVersion))
+	c.Assert(binary.LittleEndian.Uint64(footer[45:]), Equals, uint64(sstMagicNumber))
+	metaIndexHandle, n := decodeBlockHandle(c, footer[1:])
+	indexHandle, _ := decodeBlockHandle(c, footer[1+n:])
+
+	metaIndex := parseBlock(c, readBlock(c, file, metaIndexHandle))
+	c.Assert(metaIndex, HasLen, 1)
+	c.Assert(string(metaIndex[0].key), Equals, sstPropertiesBlockName)
+	propsHandle, _ := decodeBlockHandle(c, metaIndex[0].value)
+	props := make(map[string][]byte)
+	var lastName string
+	for _, entry := range parseBlock(c, readBlock(c, file, propsHandle)) {
+		c.Assert(string(entry.key) > lastName, IsTrue)
+		lastName = string(entry.key)
+		props[lastName] = entry.value
+	}
+
+	var entries []sstEntry
+	for _, index := range parseBlock(c, readBlock(c, file, indexHandle)) {
+		handle, _ := decodeBlockHandle(c, index.value)
+		block := parseBlock(c, readBlock(c, file, handle))
+		c.Assert(block, Not(HasLen), 0)
+		// the index key separates the data blocks.
+		c.Assert(bytes.Compare(block[len(block)-1].key, index.key) <= 0, IsTrue)
+		if len(entries) > 0 {
+			c.Assert(bytes.Compare(entries[len(entries)-1].key, block[0].key) < 0, IsTrue)
+		}
+		entries = append(entries, block...)
+	}
+	return entries, props
+}
+
+func propertyUint(c *C, props map[string][]byte, name string) uint64 {
+	value, ok := props[name]
+	c.Assert(ok, IsTrue, Commentf("missing property %s", name))
+	v, n := binary.Uvarint(value)
+	c.Assert(n, Equals, len(value))
+	return v
+}
+
+func (s *sstSuite) TestWriteSST(c *C) {
+	var buf bytes.Buffer
+	w := newSSTTableWriter(&buf)
+	// large enough for several data blocks.
+	const count = 5000
+	value := bytes.Repeat([]byte{'v'}, 100)
+	for i := 0; i < count; i++ {
+		c.Assert(w.Append([]byte(fmt.Sprintf("zkey%08d", i)), value), IsNil)
+	}
+	c.Assert(w.Close(), IsNil)
+
+	entries, props := readSST(c, buf.Bytes())
+	c.Assert(entries, HasLen, count)
+	for i, entry := range entries {
+		key := []byte(fmt.Sprintf("zkey%08d", i))
+		// sequence number 0 and the value type.
+		c.Assert(entry.key, DeepEquals, append(key, 1, 0, 0, 0, 0, 0, 0, 0))
+		c.Assert(entry.value, DeepEquals, value)
+	}
+
+	c.Assert(propertyUint(c, props, "rocksdb.num.entries"), Equals, uint64(count))
+	c.Assert(propertyUint(c, props, "rocksdb.num.data.blocks") > 1, IsTrue)
+	c.Assert(propertyUint(c, props, "rocksdb.raw.key.size"), Equals, uint64(count*(12+8)))
+	c.Assert(propertyUint(c, props, "rocksdb.raw.value.size"), Equals, uint64(count*100))
+	c.Assert(string(props["rocksdb.comparator"]), Equals, sstComparatorName)
+	c.Assert(props[sstExternalVersionProp], DeepEquals, []byte{2, 0, 0, 0})
+	c.Assert(props[sstExternalGlobalSeqProp], DeepEquals, make([]byte, 8))
+}
+
+func (s *sstSuite) TestWriteSSTUnordered(c *C) {
+	var buf bytes.Buffer
+	w := newSSTTableWriter(&buf)
+	c.Assert(w.Append([]byte("zb"), nil), IsNil)
+	c.Assert(w.Append([]byte("zb"), nil), ErrorMatches, ".*not in increasing order.*")
+	c.Assert(w.Append([]byte("za"), nil), ErrorMatches, ".*not in increasing order.*")
+}
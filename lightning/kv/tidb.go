@@ -0,0 +1,88 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pingcap/errors"
+	sst "github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/satori/go.uuid"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+// tidbBackend executes the rows as INSERT statements in TiDB. Nothing is
+// encoded into KV pairs, so the engines are only the units of checkpoints,
+// and there is nothing to import after closing them.
+type tidbBackend struct {
+	db *sql.DB
+}
+
+// NewTiDBImporter creates an importer which writes the rows into TiDB through
+// the given connection. The connection should be dedicated to the importer,
+// as it will be closed by the importer.
+func NewTiDBImporter(db *sql.DB) *Importer {
+	return NewBackendImporter(&tidbBackend{db: db})
+}
+
+func (tidb *tidbBackend) Close() {
+	tidb.db.Close()
+}
+
+func (tidb *tidbBackend) RowsFormat() RowsFormat {
+	return RowsFormatSQL
+}
+
+func (tidb *tidbBackend) CheckRequirements(ctx context.Context) error {
+	return errors.Trace(tidb.db.PingContext(ctx))
+}
+
+// SwitchMode does nothing, TiKV is never switched to import mode with the TiDB
+// backend.
+func (tidb *tidbBackend) SwitchMode(context.Context, sst.SwitchMode) error {
+	return nil
+}
+
+// Compact does nothing, the data are written through TiDB, and TiKV compacts
+// them as usual.
+func (tidb *tidbBackend) Compact(context.Context, int32) error {
+	return nil
+}
+
+func (tidb *tidbBackend) OpenEngine(context.Context, uuid.UUID) error {
+	return nil
+}
+
+// WriteRows executes the INSERT (or REPLACE) statement of the rows.
+func (tidb *tidbBackend) WriteRows(ctx context.Context, engineUUID uuid.UUID, _ uint64, rows Rows) error {
+	stmt := string(rows.(SQLRows))
+	err := common.ExecWithRetry(ctx, tidb.db, engineUUID.String(), stmt)
+	// the errors of inserting the rows may quote the values.
+	return errors.Trace(common.RedactError(err))
+}
+
+func (tidb *tidbBackend) CloseEngine(context.Context, uuid.UUID) error {
+	return nil
+}
+
+// ImportEngine does nothing, the rows are already in TiDB.
+func (tidb *tidbBackend) ImportEngine(context.Context, uuid.UUID) error {
+	return nil
+}
+
+func (tidb *tidbBackend) CleanupEngine(context.Context, uuid.UUID) error {
+	return nil
+}
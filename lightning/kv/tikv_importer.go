@@ -0,0 +1,441 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	kv "github.com/pingcap/kvproto/pkg/import_kvpb"
+	sst "github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/satori/go.uuid"
+	"google.golang.org/grpc"
+	_ "google.golang.org/grpc/encoding/gzip" // registers the "gzip" compressor
+	"google.golang.org/grpc/keepalive"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+const importerDialTimeout = 5 * time.Second
+
+// ImporterOptions tunes the gRPC connections to tikv-importer. The zero value
+// uses the gRPC defaults.
+type ImporterOptions struct {
+	// KeepaliveTime is the interval of the pings on idle connections, which
+	// are closed if a ping is not answered in KeepaliveTimeout. Zero disables
+	// the pings.
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	// MaxMsgSize is the maximum size of the sent and received messages.
+	MaxMsgSize int
+	// Compression is the name of the compressor of the requests, e.g. "gzip",
+	// or empty for no compression.
+	Compression string
+	// WriteStreams is the number of streams sending a batch of KV pairs into
+	// an engine in parallel.
+	WriteStreams int
+}
+
+func (opts *ImporterOptions) dialOptions() []grpc.DialOption {
+	var dialOpts []grpc.DialOption
+	if opts.KeepaliveTime > 0 {
+		dialOpts = append(dialOpts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                opts.KeepaliveTime,
+			Timeout:             opts.KeepaliveTimeout,
+			PermitWithoutStream: true,
+		}))
+	}
+	var callOpts []grpc.CallOption
+	if opts.MaxMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallSendMsgSize(opts.MaxMsgSize), grpc.MaxCallRecvMsgSize(opts.MaxMsgSize))
+	}
+	if len(opts.Compression) != 0 {
+		callOpts = append(callOpts, grpc.UseCompressor(opts.Compression))
+	}
+	if len(callOpts) != 0 {
+		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(callOpts...))
+	}
+	return dialOpts
+}
+
+type importerClient struct {
+	addr string
+	conn *grpc.ClientConn
+	cli  kv.ImportKVClient
+}
+
+// importerBackend writes the KV pairs into tikv-importer via gRPC, which sorts
+// and ingests them into TiKV.
+//
+// With several tikv-importer instances, every engine is assigned to the one
+// with the fewest engines not yet cleaned up, and all operations of the
+// engine go to that instance.
+type importerBackend struct {
+	clients      []*importerClient
+	pdAddr       string
+	writeStreams int
+
+	mu          sync.Mutex
+	assignments map[uuid.UUID]int // engine UUID -> index of clients
+	load        []int             // number of engines assigned to each client
+}
+
+func newImporterBackend(ctx context.Context, tls *common.TLS, importServerAddrs string, pdAddr string, opts ImporterOptions) (*importerBackend, error) {
+	importer := &importerBackend{
+		pdAddr:       pdAddr,
+		writeStreams: opts.WriteStreams,
+		assignments:  make(map[uuid.UUID]int),
+	}
+	if importer.writeStreams <= 0 {
+		importer.writeStreams = 1
+	}
+	dialOpts := append(opts.dialOptions(), tls.ToGRPCDialOption())
+	for _, addr := range strings.Split(importServerAddrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) == 0 {
+			continue
+		}
+		conn, err := grpc.DialContext(ctx, addr, dialOpts...)
+		if err != nil {
+			importer.Close()
+			return nil, errors.Trace(err)
+		}
+		importer.clients = append(importer.clients, &importerClient{
+			addr: addr,
+			conn: conn,
+			cli:  kv.NewImportKVClient(conn),
+		})
+	}
+	if len(importer.clients) == 0 {
+		return nil, errors.New("no tikv-importer address is given")
+	}
+	importer.load = make([]int, len(importer.clients))
+	return importer, nil
+}
+
+func (importer *importerBackend) Close() {
+	for _, client := range importer.clients {
+		client.conn.Close()
+	}
+}
+
+// AssignEngine implements EngineAssigner.
+func (importer *importerBackend) AssignEngine(engineUUID uuid.UUID, addr string) (string, error) {
+	importer.mu.Lock()
+	defer importer.mu.Unlock()
+
+	if len(addr) == 0 {
+		return importer.clients[importer.assign(engineUUID)].addr, nil
+	}
+	for i, client := range importer.clients {
+		if client.addr == addr {
+			if prev, ok := importer.assignments[engineUUID]; ok {
+				importer.load[prev]--
+			}
+			importer.assignments[engineUUID] = i
+			importer.load[i]++
+			return addr, nil
+		}
+	}
+	return "", errors.Annotatef(ErrEngineLost, "tikv-importer %s is no longer used", addr)
+}
+
+// assign returns the client of the engine, assigning the least loaded one if
+// the engine is new. The lock must be held.
+func (importer *importerBackend) assign(engineUUID uuid.UUID) int {
+	if i, ok := importer.assignments[engineUUID]; ok {
+		return i
+	}
+	best := 0
+	for i, load := range importer.load {
+		if load < importer.load[best] {
+			best = i
+		}
+	}
+	importer.assignments[engineUUID] = best
+	importer.load[best]++
+	return best
+}
+
+func (importer *importerBackend) client(engineUUID uuid.UUID) *importerClient {
+	importer.mu.Lock()
+	defer importer.mu.Unlock()
+	return importer.clients[importer.assign(engineUUID)]
+}
+
+func (importer *importerBackend) release(engineUUID uuid.UUID) {
+	importer.mu.Lock()
+	defer importer.mu.Unlock()
+	if i, ok := importer.assignments[engineUUID]; ok {
+		importer.load[i]--
+		delete(importer.assignments, engineUUID)
+	}
+}
+
+func (importer *importerBackend) RowsFormat() RowsFormat {
+	return RowsFormatKV
+}
+
+func (importer *importerBackend) CheckRequirements(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: importerDialTimeout}
+	for _, client := range importer.clients {
+		conn, err := dialer.DialContext(ctx, "tcp", client.addr)
+		if err != nil {
+			return errors.Annotatef(err, "tikv-importer at %s is unreachable", client.addr)
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+func (importer *importerBackend) SwitchMode(ctx context.Context, mode sst.SwitchMode) error {
+	req := &kv.SwitchModeRequest{
+		PdAddr: importer.pdAddr,
+		Request: &sst.SwitchModeRequest{
+			Mode: mode,
+		},
+	}
+	// every tikv-importer can switch the whole cluster.
+	_, err := importer.clients[0].cli.SwitchMode(ctx, req)
+	return errors.Trace(err)
+}
+
+func (importer *importerBackend) Compact(ctx context.Context, level int32) error {
+	req := &kv.CompactClusterRequest{
+		PdAddr: importer.pdAddr,
+		Request: &sst.CompactRequest{
+			// No need to set Range here.
+			OutputLevel: level,
+		},
+	}
+	_, err := importer.clients[0].cli.CompactCluster(ctx, req)
+	return errors.Trace(err)
+}
+
+// CompactRange implements RangeCompactor.
+func (importer *importerBackend) CompactRange(ctx context.Context, level int32, start, end []byte) error {
+	req := &kv.CompactClusterRequest{
+		PdAddr: importer.pdAddr,
+		Request: &sst.CompactRequest{
+			Range:       compactKeyRange(start, end),
+			OutputLevel: level,
+		},
+	}
+	_, err := importer.clients[0].cli.CompactCluster(ctx, req)
+	return errors.Trace(err)
+}
+
+// compactKeyRange converts the range of raw keys into the range of the keys
+// stored in TiKV.
+func compactKeyRange(start, end []byte) *sst.Range {
+	return &sst.Range{
+		Start: codec.EncodeBytes(nil, start),
+		End:   codec.EncodeBytes(nil, end),
+	}
+}
+
+// isIgnorableOpenCloseEngineError checks if the error from
+// OpenEngine/CloseEngine can be safely ignored.
+func isIgnorableOpenCloseEngineError(err error) bool {
+	// We allow "FileExists" error. This happens when the engine has been opened
+	// and closed before. This error typically arise when resuming from a
+	// checkpoint with a partially-imported engine.
+	//
+	// If the error is legit in a no-checkpoints settings, the later WriteEngine
+	// API will bail us out to keep us safe.
+	return err == nil || strings.Contains(err.Error(), "FileExists")
+}
+
+func (importer *importerBackend) OpenEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	req := &kv.OpenEngineRequest{
+		Uuid: engineUUID.Bytes(),
+	}
+	_, err := importer.client(engineUUID).cli.OpenEngine(ctx, req)
+	if isIgnorableOpenCloseEngineError(err) {
+		return nil
+	}
+	return errors.Trace(err)
+}
+
+// WriteRows sends the KV pairs via new write streams, sharding them among
+// `writeStreams` streams sending in parallel.
+func (importer *importerBackend) WriteRows(ctx context.Context, engineUUID uuid.UUID, commitTs uint64, rows Rows) error {
+	kvs := rows.(KVRows)
+	cli := importer.client(engineUUID).cli
+
+	if importer.writeStreams <= 1 || len(kvs) <= 1 {
+		return errors.Trace(writeStream(ctx, cli, engineUUID, commitTs, kvs))
+	}
+
+	var wg sync.WaitGroup
+	var streamErr common.OnceError
+	for _, part := range shardKVs(kvs, importer.writeStreams) {
+		wg.Add(1)
+		go func(part KVRows) {
+			defer wg.Done()
+			if err := writeStream(ctx, cli, engineUUID, commitTs, part); err != nil {
+				streamErr.Set(engineUUID.String(), err)
+			}
+		}(part)
+	}
+	wg.Wait()
+	return errors.Trace(streamErr.Get())
+}
+
+// shardKVs splits the KV pairs into at most n non-empty continuous parts of
+// about the same size in bytes, rather than the same number of pairs, so the
+// streams sending the large row values and those sending the small index
+// entries finish at about the same time.
+func shardKVs(kvs KVRows, n int) []KVRows {
+	if n > len(kvs) {
+		n = len(kvs)
+	}
+	total := kvs.Size()
+	parts := make([]KVRows, 0, n)
+	start, size := 0, 0
+	for i, pair := range kvs {
+		size += len(pair.Key) + len(pair.Val)
+		// the part is closed once it reaches its share of the size, leaving
+		// at least a pair for each of the following parts.
+		k := len(parts) + 1
+		if k < n && size*n >= total*k && len(kvs)-i-1 >= n-k {
+			parts = append(parts, kvs[start:i+1])
+			start = i + 1
+		}
+	}
+	return append(parts, kvs[start:])
+}
+
+// writeStream sends the KV pairs via a write stream. tikv-importer
+// acknowledges the pairs only when the stream is closed successfully, so if
+// the stream fails, the whole batch is resent via a new stream. This is
+// idempotent, since the same pairs are put into the same engine at the same
+// commit timestamp.
+func writeStream(ctx context.Context, cli kv.ImportKVClient, engineUUID uuid.UUID, commitTs uint64, kvs KVRows) error {
+	// losing the engine cannot be fixed by a new stream.
+	engineLost := false
+	err := common.Retry(ctx, fmt.Sprintf("[%s] write stream", engineUUID), func() error {
+		err := writeStreamOnce(ctx, cli, engineUUID, commitTs, kvs)
+		if errors.Cause(err) == ErrEngineLost {
+			engineLost = true
+			return nil
+		}
+		return err
+	})
+	if engineLost {
+		return errors.Trace(ErrEngineLost)
+	}
+	return errors.Trace(err)
+}
+
+func writeStreamOnce(ctx context.Context, cli kv.ImportKVClient, engineUUID uuid.UUID, commitTs uint64, kvs KVRows) error {
+	wstream, err := cli.WriteEngine(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Bind uuid for this write request
+	req := &kv.WriteEngineRequest{
+		Chunk: &kv.WriteEngineRequest_Head{
+			Head: &kv.WriteHead{
+				Uuid: engineUUID.Bytes(),
+			},
+		},
+	}
+	sendErr := wstream.Send(req)
+
+	if sendErr == nil {
+		// Send kv paris as write request content
+		mutations := make([]*kv.Mutation, len(kvs))
+		for i, pair := range kvs {
+			mutations[i] = &kv.Mutation{
+				Op:    kv.Mutation_Put,
+				Key:   pair.Key,
+				Value: pair.Val,
+			}
+		}
+		req = &kv.WriteEngineRequest{
+			Chunk: &kv.WriteEngineRequest_Batch{
+				Batch: &kv.WriteBatch{
+					CommitTs:  commitTs,
+					Mutations: mutations,
+				},
+			},
+		}
+		sendErr = wstream.Send(req)
+	}
+
+	resp, closeErr := wstream.CloseAndRecv()
+	// Send returns io.EOF if the stream is broken, and the cause is returned
+	// by CloseAndRecv instead.
+	if sendErr != nil && sendErr != io.EOF {
+		if closeErr != nil {
+			// just log the close error, we need to propagate the send error instead
+			common.AppLogger.Warnf("[%s] close write stream cause failed : %v", engineUUID, closeErr)
+		}
+		return errors.Trace(sendErr)
+	}
+	if closeErr != nil {
+		return errors.Trace(closeErr)
+	}
+	if resp.GetError().GetEngineNotFound() != nil {
+		return errors.Trace(ErrEngineLost)
+	}
+	if sendErr != nil {
+		return errors.New("write stream is broken")
+	}
+	return nil
+}
+
+func (importer *importerBackend) CloseEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	req := &kv.CloseEngineRequest{
+		Uuid: engineUUID.Bytes(),
+	}
+	resp, err := importer.client(engineUUID).cli.CloseEngine(ctx, req)
+	if !isIgnorableOpenCloseEngineError(err) {
+		return errors.Trace(err)
+	}
+	if resp.GetError().GetEngineNotFound() != nil {
+		return errors.Trace(ErrEngineLost)
+	}
+	return nil
+}
+
+func (importer *importerBackend) ImportEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	req := &kv.ImportEngineRequest{
+		Uuid:   engineUUID.Bytes(),
+		PdAddr: importer.pdAddr,
+	}
+	_, err := importer.client(engineUUID).cli.ImportEngine(ctx, req)
+	return errors.Trace(err)
+}
+
+func (importer *importerBackend) CleanupEngine(ctx context.Context, engineUUID uuid.UUID) error {
+	req := &kv.CleanupEngineRequest{
+		Uuid: engineUUID.Bytes(),
+	}
+	_, err := importer.client(engineUUID).cli.CleanupEngine(ctx, req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	importer.release(engineUUID)
+	return nil
+}
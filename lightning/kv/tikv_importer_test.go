@@ -0,0 +1,185 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	kv "github.com/pingcap/kvproto/pkg/import_kvpb"
+	kvec "github.com/pingcap/tidb/util/kvencoder"
+	"github.com/satori/go.uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+var _ = Suite(&tikvImporterSuite{})
+
+type tikvImporterSuite struct{}
+
+// mockImportKVClient records the keys received by every write stream.
+type mockImportKVClient struct {
+	kv.ImportKVClient
+
+	mu      sync.Mutex
+	streams [][]string
+	// the next streams fail with these errors, a nil error means the engine
+	// is not found.
+	failures []error
+}
+
+func (cli *mockImportKVClient) WriteEngine(ctx context.Context, opts ...grpc.CallOption) (kv.ImportKV_WriteEngineClient, error) {
+	return &mockWriteStream{cli: cli}, nil
+}
+
+type mockWriteStream struct {
+	kv.ImportKV_WriteEngineClient
+
+	cli  *mockImportKVClient
+	keys []string
+}
+
+func (stream *mockWriteStream) Send(req *kv.WriteEngineRequest) error {
+	for _, mutation := range req.GetBatch().GetMutations() {
+		stream.keys = append(stream.keys, string(mutation.Key))
+	}
+	return nil
+}
+
+func (stream *mockWriteStream) CloseAndRecv() (*kv.WriteEngineResponse, error) {
+	stream.cli.mu.Lock()
+	defer stream.cli.mu.Unlock()
+	if len(stream.cli.failures) > 0 {
+		err := stream.cli.failures[0]
+		stream.cli.failures = stream.cli.failures[1:]
+		if err == nil {
+			return &kv.WriteEngineResponse{Error: &kv.Error{EngineNotFound: &kv.Error_EngineNotFound{}}}, nil
+		}
+		return nil, err
+	}
+	stream.cli.streams = append(stream.cli.streams, stream.keys)
+	return &kv.WriteEngineResponse{}, nil
+}
+
+func (s *tikvImporterSuite) TestParallelWriteStreams(c *C) {
+	cli := new(mockImportKVClient)
+	importer := &importerBackend{
+		clients:      []*importerClient{{addr: "127.0.0.1:8287", cli: cli}},
+		writeStreams: 3,
+		assignments:  make(map[uuid.UUID]int),
+		load:         make([]int, 1),
+	}
+
+	var rows KVRows
+	for i := 0; i < 7; i++ {
+		rows = append(rows, kvec.KvPair{Key: []byte(fmt.Sprintf("k%d", i)), Val: []byte("v")})
+	}
+	c.Assert(importer.WriteRows(context.Background(), uuid.NewV4(), 1, rows), IsNil)
+
+	// the pairs are split evenly among the streams.
+	c.Assert(cli.streams, HasLen, 3)
+	var keys []string
+	for _, stream := range cli.streams {
+		c.Assert(len(stream) >= 2, IsTrue)
+		keys = append(keys, stream...)
+	}
+	sort.Strings(keys)
+	c.Assert(keys, DeepEquals, []string{"k0", "k1", "k2", "k3", "k4", "k5", "k6"})
+
+	// a small batch is never sent by more streams than pairs.
+	cli.streams = nil
+	c.Assert(importer.WriteRows(context.Background(), uuid.NewV4(), 1, rows[:1]), IsNil)
+	c.Assert(cli.streams, DeepEquals, [][]string{{"k0"}})
+}
+
+func (s *tikvImporterSuite) TestReopenWriteStream(c *C) {
+	common.SetRetryPolicy(common.RetryPolicy{Count: 2, Backoff: time.Millisecond})
+	defer common.SetRetryPolicy(common.RetryPolicy{Count: 2, Backoff: 3 * time.Second})
+
+	ctx := context.Background()
+	rows := KVRows{{Key: []byte("k1"), Val: []byte("v1")}, {Key: []byte("k2"), Val: []byte("v2")}}
+
+	// the batch is resent via a new stream after the stream breaks.
+	cli := &mockImportKVClient{failures: []error{status.Error(codes.Unavailable, "connection reset")}}
+	c.Assert(writeStream(ctx, cli, uuid.NewV4(), 1, rows), IsNil)
+	c.Assert(cli.streams, DeepEquals, [][]string{{"k1", "k2"}})
+
+	// a lost engine is not retried.
+	cli = &mockImportKVClient{failures: []error{nil}}
+	err := writeStream(ctx, cli, uuid.NewV4(), 1, rows)
+	c.Assert(errors.Cause(err), Equals, ErrEngineLost)
+	c.Assert(cli.failures, HasLen, 0)
+	c.Assert(cli.streams, HasLen, 0)
+
+	// give up after the retries are exhausted.
+	cli = &mockImportKVClient{failures: []error{
+		status.Error(codes.Unavailable, "1"),
+		status.Error(codes.Unavailable, "2"),
+		status.Error(codes.Unavailable, "3"),
+	}}
+	err = writeStream(ctx, cli, uuid.NewV4(), 1, rows)
+	c.Assert(IsEngineLostError(err), IsTrue)
+	c.Assert(cli.streams, HasLen, 0)
+}
+
+func (s *tikvImporterSuite) TestDialOptions(c *C) {
+	c.Assert((&ImporterOptions{}).dialOptions(), HasLen, 0)
+	opts := &ImporterOptions{
+		KeepaliveTime:    10 * time.Second,
+		KeepaliveTimeout: 3 * time.Second,
+		MaxMsgSize:       1 << 28,
+		Compression:      "gzip",
+	}
+	c.Assert(opts.dialOptions(), HasLen, 2)
+}
+
+func (s *tikvImporterSuite) TestShardKVs(c *C) {
+	pair := func(key string, valueSize int) kvec.KvPair {
+		return kvec.KvPair{Key: []byte(key), Val: make([]byte, valueSize)}
+	}
+	sizes := func(parts []KVRows) []int {
+		var sizes []int
+		for _, part := range parts {
+			sizes = append(sizes, part.Size())
+		}
+		return sizes
+	}
+
+	// a few large row values followed by many small index entries are split
+	// by size instead of the number of pairs.
+	rows := KVRows{pair("r1", 99), pair("r2", 99)}
+	for i := 0; i < 18; i++ {
+		rows = append(rows, pair("i", 10))
+	}
+	parts := shardKVs(rows, 2)
+	c.Assert(sizes(parts), DeepEquals, []int{202, 198})
+	c.Assert(parts[0], HasLen, 2)
+
+	// every part gets at least a pair.
+	parts = shardKVs(KVRows{pair("a", 1000), pair("b", 1), pair("c", 1)}, 3)
+	c.Assert(parts, HasLen, 3)
+	c.Assert(sizes(parts), DeepEquals, []int{1001, 2, 2})
+
+	// never more parts than pairs.
+	c.Assert(shardKVs(rows[:2], 4), HasLen, 2)
+	c.Assert(shardKVs(rows, 1), DeepEquals, []KVRows{rows})
+}
@@ -0,0 +1,443 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb/types"
+)
+
+// ErrUnsupportedValue is returned by ParseRowValues if the row contains
+// anything other than literals, e.g. a function call. Such rows need to be
+// encoded through SQL2KV instead.
+var ErrUnsupportedValue = errors.New("unsupported value in row")
+
+// ParseRowValues parses a row in the form `(1, 'a', NULL, x'ff', ...)`, as read
+// by the mydump.ChunkParser, into datums. The literals are converted the same
+// way as the TiDB parser does, so encoding the datums gives the same KV pairs
+// as executing the INSERT statement.
+func ParseRowValues(row []byte, sqlMode mysql.SQLMode) ([]types.Datum, error) {
+	return parseRowValues(row, sqlMode, false)
+}
+
+// parseRowValues is ParseRowValues, with the fast paths for the plain integers
+// and the strings without escape sequences if `numeric` is set, which are
+// what the rows of the tables with only numeric and temporal columns consist
+// of. The results are the same either way.
+func parseRowValues(row []byte, sqlMode mysql.SQLMode, numeric bool) ([]types.Datum, error) {
+	p := valuesParser{
+		buf:               row,
+		noBackslashEscape: sqlMode.HasNoBackslashEscapesMode(),
+		ansiQuotes:        sqlMode.HasANSIQuotesMode(),
+		numeric:           numeric,
+	}
+
+	p.skipSpaces()
+	if !p.consume('(') {
+		return nil, p.unsupported()
+	}
+	var values []types.Datum
+	for {
+		p.skipSpaces()
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		p.skipSpaces()
+		if p.consume(')') {
+			break
+		}
+		if !p.consume(',') {
+			return nil, p.unsupported()
+		}
+	}
+	p.skipSpaces()
+	if p.pos != len(p.buf) {
+		return nil, p.unsupported()
+	}
+	return values, nil
+}
+
+type valuesParser struct {
+	buf               []byte
+	pos               int
+	noBackslashEscape bool
+	ansiQuotes        bool
+	numeric           bool
+}
+
+func (p *valuesParser) unsupported() error {
+	return errors.Annotatef(ErrUnsupportedValue, "at offset %d", p.pos)
+}
+
+func (p *valuesParser) peek() byte {
+	if p.pos < len(p.buf) {
+		return p.buf[p.pos]
+	}
+	return 0
+}
+
+func (p *valuesParser) consume(c byte) bool {
+	if p.peek() == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *valuesParser) skipSpaces() {
+	for p.pos < len(p.buf) {
+		switch p.buf[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentChar(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$'
+}
+
+// scanWord returns the identifier-like word starting at the current position.
+func (p *valuesParser) scanWord() []byte {
+	start := p.pos
+	for p.pos < len(p.buf) && isIdentChar(p.buf[p.pos]) {
+		p.pos++
+	}
+	return p.buf[start:p.pos]
+}
+
+func (p *valuesParser) parseValue() (types.Datum, error) {
+	c := p.peek()
+	switch {
+	case c == '\'' || c == '"' && !p.ansiQuotes:
+		if p.numeric {
+			if s, ok := p.parsePlainString(); ok {
+				return types.NewStringDatum(s), nil
+			}
+		}
+		s, err := p.parseString()
+		return types.NewStringDatum(s), err
+
+	case c == '-' || c == '+':
+		p.pos++
+		p.skipSpaces()
+		if !isDigit(p.peek()) && p.peek() != '.' {
+			return types.Datum{}, p.unsupported()
+		}
+		return p.parseNumber(c == '-')
+
+	case isDigit(c) || c == '.':
+		if c == '0' && p.pos+1 < len(p.buf) {
+			switch p.buf[p.pos+1] {
+			case 'x', 'X':
+				return p.parseBinaryLiteral(false)
+			case 'b':
+				return p.parseBinaryLiteral(true)
+			}
+		}
+		return p.parseNumber(false)
+
+	case c == '\\':
+		if p.pos+1 < len(p.buf) && p.buf[p.pos+1] == 'N' {
+			p.pos += 2
+			return types.Datum{}, nil
+		}
+
+	case isIdentChar(c):
+		start := p.pos
+		word := p.scanWord()
+		switch {
+		case bytes.EqualFold(word, []byte("NULL")):
+			return types.Datum{}, nil
+		case bytes.EqualFold(word, []byte("TRUE")):
+			return types.NewIntDatum(1), nil
+		case bytes.EqualFold(word, []byte("FALSE")):
+			return types.NewIntDatum(0), nil
+		case (len(word) == 1) && (word[0] == 'x' || word[0] == 'X' || word[0] == 'b' || word[0] == 'B') && p.peek() == '\'':
+			p.pos = start
+			return p.parseBinaryLiteral(word[0] == 'b' || word[0] == 'B')
+		case bytes.EqualFold(word, []byte("_binary")):
+			p.skipSpaces()
+			if c := p.peek(); c == '\'' || c == '"' && !p.ansiQuotes {
+				s, err := p.parseString()
+				return types.NewBytesDatum([]byte(s)), err
+			}
+		}
+		p.pos = start
+	}
+	return types.Datum{}, p.unsupported()
+}
+
+// parseString parses a quoted string, handling the escape sequences the same
+// way as the TiDB lexer.
+func (p *valuesParser) parseString() (string, error) {
+	quote := p.buf[p.pos]
+	p.pos++
+	var buf bytes.Buffer
+	for p.pos < len(p.buf) {
+		c := p.buf[p.pos]
+		p.pos++
+		switch {
+		case c == quote:
+			if p.consume(quote) {
+				buf.WriteByte(quote)
+				continue
+			}
+			// adjacent strings are concatenated, leave them to the TiDB parser.
+			p.skipSpaces()
+			if next := p.peek(); next == '\'' || next == '"' {
+				return "", p.unsupported()
+			}
+			return buf.String(), nil
+		case c == '\\' && !p.noBackslashEscape && p.pos < len(p.buf):
+			c = p.buf[p.pos]
+			p.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case '0':
+				c = 0
+			case 'b':
+				c = 8
+			case 'Z':
+				c = 26
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case '%', '_':
+				buf.WriteByte('\\')
+			}
+		}
+		buf.WriteByte(c)
+	}
+	return "", errors.Errorf("unterminated string at offset %d", p.pos)
+}
+
+// parsePlainString parses a quoted string containing no escape sequence, or
+// returns false to leave the string to parseString.
+func (p *valuesParser) parsePlainString() (string, bool) {
+	quote := p.buf[p.pos]
+	for i := p.pos + 1; i < len(p.buf); i++ {
+		switch c := p.buf[i]; {
+		case c == quote:
+			end := i + 1
+			for end < len(p.buf) && (p.buf[end] == ' ' || p.buf[end] == '\t' || p.buf[end] == '\r' || p.buf[end] == '\n') {
+				end++
+			}
+			// a doubled quote, or adjacent strings.
+			if end < len(p.buf) && (p.buf[end] == '\'' || p.buf[end] == '"') {
+				return "", false
+			}
+			s := string(p.buf[p.pos+1 : i])
+			p.pos = i + 1
+			return s, true
+		case c == '\\' && !p.noBackslashEscape:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// parsePlainInteger parses a decimal integer literal fitting in int64 without
+// converting it to a string first, or returns false to leave the literal to
+// the rest of parseNumber.
+func (p *valuesParser) parsePlainInteger(negative bool) (types.Datum, bool) {
+	var n int64
+	i := p.pos
+	for ; i < len(p.buf) && isDigit(p.buf[i]); i++ {
+		if n > (math.MaxInt64-9)/10 {
+			return types.Datum{}, false
+		}
+		n = n*10 + int64(p.buf[i]-'0')
+	}
+	if i == p.pos || i < len(p.buf) && (p.buf[i] == '.' || isIdentChar(p.buf[i])) {
+		return types.Datum{}, false
+	}
+	p.pos = i
+	if negative {
+		n = -n
+	}
+	return types.NewIntDatum(n), true
+}
+
+// parseNumber parses an integer, decimal or floating point literal.
+func (p *valuesParser) parseNumber(negative bool) (types.Datum, error) {
+	if p.numeric {
+		if d, ok := p.parsePlainInteger(negative); ok {
+			return d, nil
+		}
+	}
+	start := p.pos
+	isInt, isFloat := true, false
+	for p.pos < len(p.buf) && isDigit(p.buf[p.pos]) {
+		p.pos++
+	}
+	if p.consume('.') {
+		isInt = false
+		for p.pos < len(p.buf) && isDigit(p.buf[p.pos]) {
+			p.pos++
+		}
+	}
+	if c := p.peek(); c == 'e' || c == 'E' {
+		isInt, isFloat = false, true
+		p.pos++
+		if c := p.peek(); c == '-' || c == '+' {
+			p.pos++
+		}
+		if !isDigit(p.peek()) {
+			return types.Datum{}, p.unsupported()
+		}
+		for p.pos < len(p.buf) && isDigit(p.buf[p.pos]) {
+			p.pos++
+		}
+	}
+	if isIdentChar(p.peek()) || p.pos == start {
+		return types.Datum{}, p.unsupported()
+	}
+	lit := string(p.buf[start:p.pos])
+
+	switch {
+	case isFloat:
+		f, err := strconv.ParseFloat(lit, 64)
+		if err != nil {
+			return types.Datum{}, errors.Trace(err)
+		}
+		if negative {
+			f = -f
+		}
+		return types.NewFloat64Datum(f), nil
+
+	case isInt:
+		n, err := strconv.ParseUint(lit, 10, 64)
+		if err == nil {
+			switch {
+			case !negative && n < math.MaxInt64:
+				return types.NewIntDatum(int64(n)), nil
+			case !negative:
+				return types.NewUintDatum(n), nil
+			case n <= math.MaxInt64:
+				return types.NewIntDatum(-int64(n)), nil
+			case n == math.MaxInt64+1:
+				return types.NewIntDatum(math.MinInt64), nil
+			}
+		}
+		// too large for an integer, use a decimal instead.
+	}
+
+	if negative {
+		lit = "-" + lit
+	}
+	dec := new(types.MyDecimal)
+	if err := dec.FromString([]byte(lit)); err != nil {
+		return types.Datum{}, errors.Annotatef(err, "invalid decimal %s", lit)
+	}
+	return types.NewDecimalDatum(dec), nil
+}
+
+// parseBinaryLiteral parses the hexadecimal (x'ff' or 0xff) or bit (b'01' or
+// 0b01) literals.
+func (p *valuesParser) parseBinaryLiteral(isBit bool) (types.Datum, error) {
+	start := p.pos
+	p.pos++
+	if p.consume('\'') {
+		for p.pos < len(p.buf) && p.buf[p.pos] != '\'' {
+			p.pos++
+		}
+		if !p.consume('\'') {
+			return types.Datum{}, p.unsupported()
+		}
+	} else {
+		p.pos++
+		p.scanWord()
+	}
+	lit := string(p.buf[start:p.pos])
+
+	var d types.Datum
+	if isBit {
+		b, err := types.NewBitLiteral(lit)
+		if err != nil {
+			return d, errors.Annotatef(err, "invalid bit literal %s", lit)
+		}
+		d.SetBinaryLiteral(types.BinaryLiteral(b))
+	} else {
+		h, err := types.NewHexLiteral(lit)
+		if err != nil {
+			return d, errors.Annotatef(err, "invalid hexadecimal literal %s", lit)
+		}
+		d.SetBinaryLiteral(types.BinaryLiteral(h))
+	}
+	return d, nil
+}
+
+// parseColumnNames parses a column list in the form "(`a`, `b`, c)".
+func parseColumnNames(columns []byte, sqlMode mysql.SQLMode) ([]string, error) {
+	p := valuesParser{buf: columns, ansiQuotes: sqlMode.HasANSIQuotesMode()}
+	invalid := errors.Errorf("invalid column list %s", columns)
+
+	p.skipSpaces()
+	if !p.consume('(') {
+		return nil, invalid
+	}
+	var names []string
+	for {
+		p.skipSpaces()
+		switch c := p.peek(); {
+		case c == '`' || c == '"' && p.ansiQuotes:
+			p.pos++
+			var name bytes.Buffer
+			for {
+				if p.pos >= len(p.buf) {
+					return nil, invalid
+				}
+				if p.buf[p.pos] == c && !(p.pos+1 < len(p.buf) && p.buf[p.pos+1] == c) {
+					p.pos++
+					break
+				}
+				if p.buf[p.pos] == c {
+					p.pos++
+				}
+				name.WriteByte(p.buf[p.pos])
+				p.pos++
+			}
+			names = append(names, name.String())
+		case isIdentChar(c):
+			names = append(names, string(p.scanWord()))
+		default:
+			return nil, invalid
+		}
+
+		p.skipSpaces()
+		if p.consume(')') {
+			return names, nil
+		}
+		if !p.consume(',') {
+			return nil, invalid
+		}
+	}
+}
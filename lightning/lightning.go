@@ -16,17 +16,19 @@ package lightning
 import (
 	"context"
 	"fmt"
-	"net/http"
+	"io"
 	"runtime"
 	"sync"
+	"time"
 
+	"github.com/opentracing/opentracing-go"
 	"github.com/pingcap/errors"
 	sstpb "github.com/pingcap/kvproto/pkg/import_sstpb"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/uber/jaeger-client-go"
+	jaegercfg "github.com/uber/jaeger-client-go/config"
 
 	"github.com/pingcap/tidb-lightning/lightning/common"
 	"github.com/pingcap/tidb-lightning/lightning/config"
-	"github.com/pingcap/tidb-lightning/lightning/kv"
 	"github.com/pingcap/tidb-lightning/lightning/mydump"
 	"github.com/pingcap/tidb-lightning/lightning/restore"
 )
@@ -36,6 +38,11 @@ type Lightning struct {
 	ctx      context.Context
 	shutdown context.CancelFunc
 
+	serverLock sync.Mutex
+	curTask    *restore.RestoreController
+	settings   config.Settings
+	taskQueue  *taskQueue // nil unless in server mode
+
 	wg sync.WaitGroup
 }
 
@@ -43,27 +50,61 @@ func initEnv(cfg *config.Config) error {
 	if err := common.InitLogger(&cfg.App.LogConfig, cfg.TiDB.LogLevel); err != nil {
 		return errors.Trace(err)
 	}
-
-	if cfg.App.ProfilePort > 0 {
-		go func() {
-			http.Handle("/metrics", promhttp.Handler())
-			common.AppLogger.Info(http.ListenAndServe(fmt.Sprintf(":%d", cfg.App.ProfilePort), nil))
-		}()
+	if report := cfg.AutoTuneReport(); report != "" {
+		common.AppLogger.Infof("[auto-tune] %s", report)
+	}
+	common.SetRedactInfoLog(cfg.Security.RedactInfoLog)
+	retryableErrors, err := common.CompileRetryableErrors(cfg.App.RetryableErrors)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	common.SetRetryPolicy(common.RetryPolicy{
+		Count:           cfg.App.RetryCount,
+		Backoff:         cfg.App.RetryBackoff.Duration,
+		RetryableErrors: retryableErrors,
+	})
+	if cfg.App.ProfilePort > 0 && cfg.App.StatusAddr != fmt.Sprintf(":%d", cfg.App.ProfilePort) {
+		common.AppLogger.Warnf("`lightning.pprof-port` is ignored, the profiles are served at the status address %s", cfg.App.StatusAddr)
 	}
 
 	return nil
 }
 
+// initTracer installs the tracer exporting to the OTLP endpoint as the global
+// tracer. The closer flushes the pending spans.
+func initTracer(cfg *config.Tracing) (io.Closer, error) {
+	tracingCfg := jaegercfg.Configuration{
+		ServiceName: cfg.ServiceName,
+		Sampler: &jaegercfg.SamplerConfig{
+			Type:  jaeger.SamplerTypeProbabilistic,
+			Param: cfg.SampleRate,
+		},
+	}
+	reporter := common.NewOTLPReporter(cfg.Endpoint, cfg.ServiceName)
+	tracer, closer, err := tracingCfg.NewTracer(jaegercfg.Reporter(reporter))
+	if err != nil {
+		reporter.Close()
+		return nil, errors.Annotate(err, "cannot initialize the tracer")
+	}
+	opentracing.SetGlobalTracer(tracer)
+	return closer, nil
+}
+
 func New(cfg *config.Config) *Lightning {
 	initEnv(cfg)
 
 	ctx, shutdown := context.WithCancel(context.Background())
 
-	return &Lightning{
+	l := &Lightning{
 		cfg:      cfg,
 		ctx:      ctx,
 		shutdown: shutdown,
+		settings: cfg.Settings(),
 	}
+	if cfg.App.StatusAddr != "" {
+		l.goServe(cfg.App.StatusAddr)
+	}
+	return l
 }
 
 func (l *Lightning) Run() error {
@@ -115,29 +156,128 @@ func (l *Lightning) handleCommandFlagsAndExits() (exits bool) {
 }
 
 func (l *Lightning) run() error {
-	mdl, err := mydump.NewMyDumpLoader(l.cfg)
+	if l.cfg.CheckConfig {
+		return common.WithCategory(errors.Trace(restore.CheckConfig(l.ctx, l.cfg)), common.ErrorCategoryPreCheck)
+	}
+
+	if l.cfg.App.ServerMode {
+		return errors.Trace(l.runServer())
+	}
+	return errors.Trace(l.runTask(l.cfg))
+}
+
+// runServer runs the tasks submitted to the status server one by one, until
+// Lightning is stopped. An interrupted task is kept in the queue, and resumed
+// after restarting.
+func (l *Lightning) runServer() error {
+	queue, err := openTaskQueue(l.cfg.App.TaskQueueFile)
+	if err != nil {
+		return common.WithCategory(errors.Trace(err), common.ErrorCategoryConfig)
+	}
+	l.serverLock.Lock()
+	l.taskQueue = queue
+	l.serverLock.Unlock()
+	common.AppLogger.Infof("running in server mode, submit the tasks to %s/tasks", l.cfg.App.StatusAddr)
+
+	for {
+		task, err := queue.next(l.ctx, &l.cfg.App.MaintenanceWindow)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		common.AppLogger.Infof("starting task %d of priority %d", task.ID, task.Priority)
+		taskCfg, err := l.cfg.LoadTask(task.Config)
+		if err == nil {
+			err = l.runTask(taskCfg)
+		}
+		if l.ctx.Err() != nil {
+			return errors.Trace(l.ctx.Err())
+		}
+		if err != nil {
+			common.AppLogger.Errorf("task %d failed: %s", task.ID, errors.ErrorStack(err))
+		} else {
+			common.AppLogger.Infof("task %d completed", task.ID)
+		}
+		if err := queue.finish(task.ID); err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+// runTask restores the data source of the task config.
+func (l *Lightning) runTask(cfg *config.Config) error {
+	mdl, err := mydump.NewMyDumpLoader(cfg)
 	if err != nil {
 		common.AppLogger.Errorf("failed to load mydumper source : %s", errors.ErrorStack(err))
-		return errors.Trace(err)
+		return common.WithCategory(errors.Trace(err), common.ErrorCategorySourceData)
 	}
 
 	dbMetas := mdl.GetDatabases()
-	procedure, err := restore.NewRestoreController(l.ctx, dbMetas, l.cfg)
+	if cfg.DryRun {
+		return errors.Trace(restore.DryRun(l.ctx, dbMetas, cfg))
+	}
+
+	// the data source is checked above, so it fails early rather than in
+	// the window.
+	if err := l.waitMaintenanceWindow(&cfg.App.MaintenanceWindow); err != nil {
+		return errors.Trace(err)
+	}
+
+	if cfg.Tracing.Enable {
+		closer, err := initTracer(&cfg.Tracing)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer func() {
+			opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+			closer.Close()
+		}()
+	}
+
+	procedure, err := restore.NewRestoreController(l.ctx, dbMetas, cfg)
 	if err != nil {
 		common.AppLogger.Errorf("failed to restore : %s", errors.ErrorStack(err))
 		return errors.Trace(err)
 	}
 	defer procedure.Close()
 
+	l.serverLock.Lock()
+	l.curTask = procedure
+	// the settings may have been changed before the task is created.
+	procedure.UpdateSettings(l.settings)
+	l.serverLock.Unlock()
+	defer func() {
+		l.serverLock.Lock()
+		l.curTask = nil
+		l.serverLock.Unlock()
+	}()
+
 	err = procedure.Run(l.ctx)
-	procedure.Wait()
+	if waitErr := procedure.Wait(); err == nil {
+		err = waitErr
+	}
 	return errors.Trace(err)
 }
 
+// waitMaintenanceWindow blocks until `lightning.maintenance-window` opens.
+func (l *Lightning) waitMaintenanceWindow(window *config.TimeWindow) error {
+	now := time.Now()
+	start := window.Next(now)
+	if !start.After(now) {
+		return nil
+	}
+	common.AppLogger.Infof("waiting for the maintenance window %s, which opens at %v", window, start)
+	select {
+	case <-time.After(start.Sub(now)):
+		return nil
+	case <-l.ctx.Done():
+		return l.ctx.Err()
+	}
+}
+
 func (l *Lightning) doCompact() error {
 	ctx := context.Background()
 
-	importer, err := kv.NewImporter(ctx, l.cfg.TikvImporter.Addr, l.cfg.TiDB.PdAddr)
+	importer, err := restore.NewImporter(ctx, l.cfg)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -153,7 +293,7 @@ func (l *Lightning) doCompact() error {
 func (l *Lightning) switchMode(mode sstpb.SwitchMode) error {
 	ctx := context.Background()
 
-	importer, err := kv.NewImporter(ctx, l.cfg.TikvImporter.Addr, l.cfg.TiDB.PdAddr)
+	importer, err := restore.NewImporter(ctx, l.cfg)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -162,11 +302,57 @@ func (l *Lightning) switchMode(mode sstpb.SwitchMode) error {
 	if err := importer.SwitchMode(ctx, mode); err != nil {
 		return errors.Trace(err)
 	}
+	if err := restore.RecordTiKVMode(ctx, l.cfg, mode); err != nil {
+		common.AppLogger.Warnf("cannot record the TiKV mode into the checkpoints: %v", err)
+	}
+
+	return nil
+}
+
+// Settings returns the settings in effect.
+func (l *Lightning) Settings() config.Settings {
+	l.serverLock.Lock()
+	defer l.serverLock.Unlock()
+	return l.settings
+}
+
+// UpdateSettings changes the log level, and the settings of the running task
+// and the tasks started afterwards.
+func (l *Lightning) UpdateSettings(settings config.Settings) error {
+	if err := settings.Validate(); err != nil {
+		return errors.Trace(err)
+	}
+	level, _ := common.ParseLogLevel(settings.LogLevel)
 
+	l.serverLock.Lock()
+	defer l.serverLock.Unlock()
+	common.SetLevel(level)
+	l.settings = settings
+	if l.curTask != nil {
+		l.curTask.UpdateSettings(settings)
+	}
+	common.AppLogger.Infof("settings updated: level %s, log-progress %s, switch-mode %s, store-write-bwlimit %d",
+		level, settings.LogProgress, settings.SwitchMode, settings.StoreWriteBWLimit)
 	return nil
 }
 
+// ReloadConfig re-reads the config file, and applies its settings. The other
+// parts of the config are ignored until Lightning is restarted.
+func (l *Lightning) ReloadConfig() error {
+	cfg, err := l.cfg.Reload()
+	if err != nil {
+		return errors.Annotatef(err, "cannot reload %s", l.cfg.ConfigFile)
+	}
+	return errors.Trace(l.UpdateSettings(cfg.Settings()))
+}
+
+// Stop interrupts the running task. No new chunks are scheduled, and the
+// progress of the chunks being restored is saved into the checkpoint, so the
+// task can be resumed by running Lightning again.
 func (l *Lightning) Stop() {
+	if curTask := l.currentTask(); curTask != nil {
+		curTask.Pause()
+	}
 	l.shutdown()
 	l.wg.Wait()
 }
@@ -15,6 +15,7 @@ package metric
 
 import (
 	"math"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
@@ -40,6 +41,32 @@ const (
 	ChunkStateRunning   = "running"
 	ChunkStateFinished  = "finished"
 	ChunkStateFailed    = "failed"
+
+	// states used for the ChecksumTablesGauge labels
+	ChecksumStateWaiting = "waiting"
+	ChecksumStateRunning = "running"
+
+	// phases used for the TaskPhaseGauge labels
+	TaskPhaseCheckRequirements = "check-requirements"
+	TaskPhaseRestoreSchema     = "restore-schema"
+	TaskPhaseCleanupEngines    = "cleanup-engines"
+	TaskPhaseRestoreTables     = "restore-tables"
+	TaskPhaseFullCompact       = "full-compact"
+	TaskPhaseSwitchMode        = "switch-mode"
+	TaskPhaseCleanCheckpoints  = "clean-checkpoints"
+	TaskPhaseFinished          = "finished"
+
+	// steps used for the EngineSecondsHistogram and EngineSpeedHistogram labels
+	EngineStepWrite  = "write"
+	EngineStepClose  = "close"
+	EngineStepImport = "import"
+
+	// phases used for the TablePhaseSecondsCounter labels
+	TablePhaseRead    = "read"
+	TablePhaseEncode  = "encode"
+	TablePhaseDeliver = "deliver"
+	TablePhaseClose   = "close"
+	TablePhaseImport  = "import"
 )
 
 var (
@@ -77,7 +104,7 @@ var (
 			Namespace: "lightning",
 			Name:      "chunks",
 			Help:      "count number of chunks processed",
-		}, []string{"state"})
+		}, []string{"state", "table"})
 	// state can be one of:
 	//  - estimated (an estimation derived from the file size)
 	//  - pending
@@ -85,14 +112,45 @@ var (
 	//  - finished
 	//  - failed
 
-	ImportSecondsHistogram = prometheus.NewHistogram(
+	ImportSecondsHistogram = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "lightning",
 			Name:      "import_seconds",
 			Help:      "time needed to import a table",
 			Buckets:   prometheus.ExponentialBuckets(0.125, 2, 6),
+		}, []string{"table"},
+	)
+	EngineKVBytesHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "lightning",
+			Name:      "engine_kv_bytes",
+			Help:      "number of KV bytes written into an engine",
+			Buckets:   prometheus.ExponentialBuckets(1048576, 4, 10),
 		},
 	)
+	EngineSecondsHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "lightning",
+			Name:      "engine_seconds",
+			Help:      "time needed by an engine in each step",
+			Buckets:   prometheus.ExponentialBuckets(0.125, 2, 16),
+		}, []string{"step"},
+	)
+	EngineSpeedHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "lightning",
+			Name:      "engine_speed_bytes_per_second",
+			Help:      "KV bytes of an engine divided by the time of writing or importing it",
+			Buckets:   prometheus.ExponentialBuckets(65536, 2, 14),
+		}, []string{"step"},
+	)
+	TablePhaseSecondsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "lightning",
+			Name:      "table_phase_seconds",
+			Help:      "time spent by the finished tables in each phase, summed over the concurrent chunks and engines",
+		}, []string{"phase", "table"},
+	)
 	BlockReadSecondsHistogram = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Namespace: "lightning",
@@ -125,6 +183,14 @@ var (
 			Buckets:   prometheus.ExponentialBuckets(0.001, 3.1622776601683795, 10),
 		},
 	)
+	CheckpointUpdateSecondsHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "lightning",
+			Name:      "checkpoint_update_seconds",
+			Help:      "time needed to save a batch of checkpoint updates",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 3.1622776601683795, 10),
+		},
+	)
 	ApplyWorkerSecondsHistogram = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "lightning",
@@ -141,22 +207,41 @@ var (
 			Buckets:   prometheus.ExponentialBuckets(0.001, 3.1622776601683795, 10),
 		},
 	)
-	BlockDeliverSecondsHistogram = prometheus.NewHistogram(
+	BlockDeliverSecondsHistogram = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "lightning",
 			Name:      "block_deliver_seconds",
 			Help:      "time needed to deliver a block",
 			Buckets:   prometheus.ExponentialBuckets(0.001, 3.1622776601683795, 10),
-		},
+		}, []string{"table"},
 	)
-	BlockDeliverBytesHistogram = prometheus.NewHistogram(
+	BlockDeliverBytesHistogram = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "lightning",
 			Name:      "block_deliver_bytes",
 			Help:      "number of bytes being sent out to importer",
 			Buckets:   prometheus.ExponentialBuckets(512, 2, 10),
-		},
+		}, []string{"table"},
 	)
+	CheckpointTablesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "lightning",
+			Name:      "checkpoint_tables",
+			Help:      "number of tables in each status according to the checkpoint",
+		}, []string{"state"})
+	CheckpointEnginesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "lightning",
+			Name:      "checkpoint_engines",
+			Help:      "number of engines in each status according to the checkpoint",
+		}, []string{"state"})
+	CheckpointRemainingBytesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "lightning",
+			Name:      "checkpoint_remaining_bytes",
+			Help:      "number of bytes of each table not yet written according to the checkpoint",
+		}, []string{"table"})
+
 	ChecksumSecondsHistogram = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Namespace: "lightning",
@@ -165,6 +250,54 @@ var (
 			Buckets:   prometheus.ExponentialBuckets(1, 2.2679331552660544, 10),
 		},
 	)
+	ChecksumTablesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "lightning",
+			Name:      "checksum_tables",
+			Help:      "number of tables waiting for or running the remote checksum",
+		}, []string{"state"})
+	KVBufferBytesGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "lightning",
+			Name:      "kv_buffer_bytes",
+			Help:      "number of bytes of the pooled buffers holding the KV pairs not yet delivered",
+		})
+	EstimatedRemainingSecondsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "lightning",
+			Name:      "estimated_remaining_seconds",
+			Help:      "estimated time needed to write the remaining chunks, or -1 if unknown",
+		})
+	RemainingBytesGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "lightning",
+			Name:      "remaining_bytes",
+			Help:      "number of bytes of the data source not yet read",
+		})
+	TaskPhaseGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "lightning",
+			Name:      "task_phase",
+			Help:      "the phase the task is running, which is 1 while the others are absent",
+		}, []string{"phase"})
+	StalledChunksGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "lightning",
+			Name:      "stalled_chunks",
+			Help:      "number of chunks which made no delivery progress within the stall timeout",
+		})
+	ChunkStallCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "lightning",
+			Name:      "chunk_stalls",
+			Help:      "number of times a chunk was found stalled",
+		})
+	ChecksumTableCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "lightning",
+			Name:      "checksum_finished_tables",
+			Help:      "number of tables which finished the remote checksum",
+		}, []string{"result"})
 )
 
 func init() {
@@ -180,9 +313,49 @@ func init() {
 	prometheus.MustRegister(BlockDeliverSecondsHistogram)
 	prometheus.MustRegister(BlockDeliverBytesHistogram)
 	prometheus.MustRegister(ChecksumSecondsHistogram)
+	prometheus.MustRegister(ChecksumTablesGauge)
+	prometheus.MustRegister(ChecksumTableCounter)
+	prometheus.MustRegister(KVBufferBytesGauge)
 	prometheus.MustRegister(ChunkParserReadRowSecondsHistogram)
 	prometheus.MustRegister(ChunkParserReadBlockSecondsHistogram)
 	prometheus.MustRegister(ApplyWorkerSecondsHistogram)
+	prometheus.MustRegister(CheckpointUpdateSecondsHistogram)
+	prometheus.MustRegister(CheckpointTablesGauge)
+	prometheus.MustRegister(CheckpointEnginesGauge)
+	prometheus.MustRegister(CheckpointRemainingBytesGauge)
+	prometheus.MustRegister(EstimatedRemainingSecondsGauge)
+	prometheus.MustRegister(RemainingBytesGauge)
+	prometheus.MustRegister(TaskPhaseGauge)
+	prometheus.MustRegister(StalledChunksGauge)
+	prometheus.MustRegister(ChunkStallCounter)
+	prometheus.MustRegister(EngineKVBytesHistogram)
+	prometheus.MustRegister(EngineSecondsHistogram)
+	prometheus.MustRegister(EngineSpeedHistogram)
+	prometheus.MustRegister(TablePhaseSecondsCounter)
+}
+
+// tableLabels is 1 if the metrics having the "table" label are labelled by
+// the table names.
+var tableLabels int32
+
+// EnableTableLabels sets whether ChunkCounter, ImportSecondsHistogram and the
+// BlockDeliver* histograms are labelled by the table names. When disabled, the
+// "table" label is always empty, so the number of series does not grow with
+// the number of tables.
+func EnableTableLabels(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&tableLabels, value)
+}
+
+// TableLabel returns the value of the "table" label for the table.
+func TableLabel(tableName string) string {
+	if atomic.LoadInt32(&tableLabels) == 0 {
+		return ""
+	}
+	return tableName
 }
 
 func RecordTableCount(status string, err error) {
@@ -212,3 +385,39 @@ func ReadHistogramSum(histogram prometheus.Histogram) float64 {
 	}
 	return metric.Histogram.GetSampleSum()
 }
+
+// SumCounterVec reports the sum of the counters in the vector having all the
+// given label values, e.g. the chunks in a state across all tables.
+func SumCounterVec(vec *prometheus.CounterVec, labels prometheus.Labels) float64 {
+	ch := make(chan prometheus.Metric, 16)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+
+	var sum float64
+	for m := range ch {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			sum = math.NaN()
+			continue
+		}
+		if matchLabels(metric.GetLabel(), labels) {
+			sum += metric.Counter.GetValue()
+		}
+	}
+	return sum
+}
+
+func matchLabels(pairs []*dto.LabelPair, labels prometheus.Labels) bool {
+	matched := 0
+	for _, pair := range pairs {
+		if value, ok := labels[pair.GetName()]; ok {
+			if value != pair.GetValue() {
+				return false
+			}
+			matched++
+		}
+	}
+	return matched == len(labels)
+}
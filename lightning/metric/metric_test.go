@@ -46,3 +46,21 @@ func (s *testMetricSuite) TestReadHistogramSum(c *C) {
 	histogram.Observe(15261.0)
 	c.Assert(metric.ReadHistogramSum(histogram), Equals, 26392.5)
 }
+
+func (s *testMetricSuite) TestSumCounterVec(c *C) {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{}, []string{"state", "table"})
+	vec.WithLabelValues("finished", "`db`.`t1`").Add(3)
+	vec.WithLabelValues("finished", "`db`.`t2`").Add(4)
+	vec.WithLabelValues("failed", "`db`.`t2`").Add(5)
+	c.Assert(metric.SumCounterVec(vec, prometheus.Labels{"state": "finished"}), Equals, 7.0)
+	c.Assert(metric.SumCounterVec(vec, prometheus.Labels{"table": "`db`.`t2`"}), Equals, 9.0)
+	c.Assert(metric.SumCounterVec(vec, prometheus.Labels{"state": "failed", "table": "`db`.`t1`"}), Equals, 0.0)
+	c.Assert(metric.SumCounterVec(vec, nil), Equals, 12.0)
+}
+
+func (s *testMetricSuite) TestTableLabel(c *C) {
+	c.Assert(metric.TableLabel("`db`.`t`"), Equals, "")
+	metric.EnableTableLabels(true)
+	defer metric.EnableTableLabels(false)
+	c.Assert(metric.TableLabel("`db`.`t`"), Equals, "`db`.`t`")
+}
@@ -0,0 +1,193 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mydump
+
+import (
+	"sort"
+	"strings"
+)
+
+type sqlToken struct {
+	start, end int
+	text       string // the unquoted text of words and quoted tokens
+	word       bool
+	depth      int // the depth of parentheses the token is in
+}
+
+// scanSQLTokens splits the statement into words, quoted strings or
+// identifiers, and punctuations. The comments are skipped, except the
+// executable comments (`/*!40101 ... */`) whose content is scanned as well.
+func scanSQLTokens(sql string) []sqlToken {
+	var tokens []sqlToken
+	depth := 0
+	inExecComment := false
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '#' || c == '-' && strings.HasPrefix(sql[i:], "-- "):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(sql[i:], "/*!"):
+			inExecComment = true
+			i += 3
+			for i < len(sql) && sql[i] >= '0' && sql[i] <= '9' {
+				i++
+			}
+		case inExecComment && strings.HasPrefix(sql[i:], "*/"):
+			inExecComment = false
+			i += 2
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				return tokens
+			}
+			i += end + 4
+		case c == '\'' || c == '"' || c == '`':
+			start := i
+			var text strings.Builder
+			for i++; i < len(sql); i++ {
+				if sql[i] == '\\' && c != '`' && i+1 < len(sql) {
+					i++
+				} else if sql[i] == c {
+					if i+1 < len(sql) && sql[i+1] == c {
+						i++
+					} else {
+						break
+					}
+				}
+				text.WriteByte(sql[i])
+			}
+			i++
+			tokens = append(tokens, sqlToken{start: start, end: i, text: text.String(), depth: depth})
+		case isWordChar(c):
+			start := i
+			for i < len(sql) && isWordChar(sql[i]) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{start: start, end: i, text: sql[start:i], word: true, depth: depth})
+		default:
+			if c == ')' {
+				depth--
+			}
+			tokens = append(tokens, sqlToken{start: i, end: i + 1, text: sql[i : i+1], depth: depth})
+			if c == '(' {
+				depth++
+			}
+			i++
+		}
+	}
+	return tokens
+}
+
+func isWordChar(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$' || c >= 0x80
+}
+
+// overrideCharset replaces all charsets and collations in the CREATE TABLE
+// statement by the given ones, except the binary charset which makes the
+// column a binary string. If the table has no default charset or collation,
+// they are added to the table options.
+func overrideCharset(createTable string, charset string, collation string) string {
+	tokens := scanSQLTokens(createTable)
+	if len(tokens) == 0 {
+		return createTable
+	}
+
+	type replacement struct {
+		start, end int
+		text       string
+	}
+	var replacements []replacement
+	hasTableCharset, hasTableCollation := false, false
+	bodyEnd := -1
+	optionsEnd := len(createTable)
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.depth == 0 && bodyEnd < 0 && tok.text == ")" {
+			bodyEnd = i
+		}
+		if !tok.word {
+			continue
+		}
+		isTableOption := bodyEnd >= 0 && i > bodyEnd
+		if isTableOption && strings.EqualFold(tok.text, "PARTITION") {
+			optionsEnd = tokens[i-1].end
+			break
+		}
+
+		var value string
+		switch {
+		case strings.EqualFold(tok.text, "CHARSET"):
+			value = charset
+		case strings.EqualFold(tok.text, "CHARACTER") && i+1 < len(tokens) && strings.EqualFold(tokens[i+1].text, "SET"):
+			value = charset
+			i++
+		case strings.EqualFold(tok.text, "COLLATE"):
+			value = collation
+		default:
+			continue
+		}
+		if i+1 < len(tokens) && tokens[i+1].text == "=" {
+			i++
+		}
+		if i+1 >= len(tokens) {
+			break
+		}
+		i++
+		if strings.EqualFold(tokens[i].text, "binary") {
+			if isTableOption {
+				hasTableCharset, hasTableCollation = true, true
+			}
+			continue
+		}
+		replacements = append(replacements, replacement{start: tokens[i].start, end: tokens[i].end, text: value})
+		if isTableOption {
+			if value == charset {
+				hasTableCharset = true
+			} else {
+				hasTableCollation = true
+			}
+		}
+	}
+	if optionsEnd == len(createTable) {
+		// keep the trailing semicolon at the end.
+		last := len(tokens) - 1
+		if tokens[last].text == ";" && last > 0 {
+			last--
+		}
+		optionsEnd = tokens[last].end
+	}
+
+	var options strings.Builder
+	if !hasTableCharset {
+		options.WriteString(" DEFAULT CHARSET=")
+		options.WriteString(charset)
+	}
+	if !hasTableCollation {
+		options.WriteString(" COLLATE=")
+		options.WriteString(collation)
+	}
+	if options.Len() > 0 {
+		replacements = append(replacements, replacement{start: optionsEnd, end: optionsEnd, text: options.String()})
+	}
+
+	sort.Slice(replacements, func(i, j int) bool { return replacements[i].start > replacements[j].start })
+	for _, r := range replacements {
+		createTable = createTable[:r.start] + r.text + createTable[r.end:]
+	}
+	return createTable
+}
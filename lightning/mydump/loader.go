@@ -36,6 +36,22 @@ type MDDatabaseMeta struct {
 	SchemaFile string
 	Tables     []*MDTableMeta
 	charSet    string
+	target     targetCharset
+}
+
+// GetSchema returns the statement creating the database, in the target charset
+// and collation if they are overridden.
+func (m *MDDatabaseMeta) GetSchema() string {
+	var builder strings.Builder
+	builder.WriteString("CREATE DATABASE IF NOT EXISTS ")
+	common.WriteMySQLIdentifier(&builder, m.Name)
+	if len(m.target.charset) > 0 {
+		builder.WriteString(" DEFAULT CHARACTER SET ")
+		builder.WriteString(m.target.charset)
+		builder.WriteString(" COLLATE ")
+		builder.WriteString(m.target.collation)
+	}
+	return builder.String()
 }
 
 type MDTableMeta struct {
@@ -43,7 +59,17 @@ type MDTableMeta struct {
 	Name       string
 	SchemaFile string
 	DataFiles  []string
+	TotalSize  int64 // total size of the data files in bytes
 	charSet    string
+	renamed    bool // whether the table is renamed by rename-schema or rename-table
+	target     targetCharset
+}
+
+// targetCharset is the charset and collation overriding those in the schema
+// files, or empty if not overridden.
+type targetCharset struct {
+	charset   string
+	collation string
 }
 
 func (m *MDTableMeta) GetSchema() string {
@@ -52,18 +78,47 @@ func (m *MDTableMeta) GetSchema() string {
 		common.AppLogger.Errorf("failed to extract table schema (%s) : %s", m.SchemaFile, err.Error())
 		return ""
 	}
-	return string(schema)
+	createTable := string(schema)
+	if m.renamed {
+		createTable = renameCreateTable(createTable, m.Name)
+	}
+	if len(m.target.charset) > 0 {
+		createTable = overrideCharset(createTable, m.target.charset, m.target.collation)
+	}
+	return createTable
+}
+
+var createTableNameRegexp = regexp.MustCompile(
+	"(?i)^\\s*CREATE\\s+TABLE\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?" +
+		"(?:(?:`(?:[^`]|``)+`|[\\w$]+)\\s*\\.\\s*)?(?:`(?:[^`]|``)+`|[\\w$]+)",
+)
+
+// renameCreateTable replaces the (possibly qualified) table name in the CREATE
+// TABLE statement by the given unqualified name.
+func renameCreateTable(createTable string, name string) string {
+	loc := createTableNameRegexp.FindStringIndex(createTable)
+	if loc == nil {
+		return createTable
+	}
+	var builder strings.Builder
+	builder.WriteString("CREATE TABLE ")
+	common.WriteMySQLIdentifier(&builder, name)
+	builder.WriteString(createTable[loc[1]:])
+	return builder.String()
 }
 
 /*
 	Mydumper File Loader
 */
 type MDLoader struct {
-	dir      string
-	noSchema bool
-	dbs      []*MDDatabaseMeta
-	filter   *filter.Filter
-	charSet  string
+	dir          string
+	noSchema     bool
+	dbs          []*MDDatabaseMeta
+	filter       *filter.Filter
+	charSet      string
+	target       targetCharset
+	renameSchema map[string]string
+	renameTable  map[string]string
 }
 
 type mdLoaderSetup struct {
@@ -81,6 +136,13 @@ func NewMyDumpLoader(cfg *config.Config) (*MDLoader, error) {
 		noSchema: cfg.Mydumper.NoSchema,
 		filter:   filter.New(false, cfg.BWList),
 		charSet:  cfg.Mydumper.CharacterSet,
+		target: targetCharset{
+			charset:   cfg.Mydumper.TargetCharset,
+			collation: cfg.Mydumper.TargetCollation,
+		},
+
+		renameSchema: cfg.Mydumper.RenameSchema,
+		renameTable:  cfg.Mydumper.RenameTable,
 	}
 
 	setup := mdLoaderSetup{
@@ -121,6 +183,8 @@ func (ftype fileType) String() string {
 type fileInfo struct {
 	tableName filter.Table
 	path      string
+	size      int64
+	renamed   bool
 }
 
 var tableNameRegexp = regexp.MustCompile(`^([^.]+)\.(.*?)(?:\.[0-9]+)?$`)
@@ -164,12 +228,13 @@ func (s *mdLoaderSetup) setup(dir string) error {
 
 		// setup table schema
 		for _, fileInfo := range s.tableSchemas {
-			_, dbExists, tableExists := s.insertTable(fileInfo.tableName, fileInfo.path)
+			tableMeta, dbExists, tableExists := s.insertTable(fileInfo.tableName, fileInfo.path)
 			if !dbExists {
 				return errors.Errorf("invalid table schema file, cannot find db - %s", fileInfo.path)
 			} else if tableExists {
 				return errors.Errorf("invalid table schema file, duplicated item - %s", fileInfo.path)
 			}
+			tableMeta.renamed = fileInfo.renamed
 		}
 	}
 
@@ -184,6 +249,7 @@ func (s *mdLoaderSetup) setup(dir string) error {
 			}
 		}
 		tableMeta.DataFiles = append(tableMeta.DataFiles, fileInfo.path)
+		tableMeta.TotalSize += fileInfo.size
 	}
 
 	return nil
@@ -203,7 +269,7 @@ func (s *mdLoaderSetup) listFiles(dir string) error {
 		}
 
 		fname := strings.TrimSpace(f.Name())
-		info := fileInfo{path: path}
+		info := fileInfo{path: path, size: f.Size()}
 
 		var (
 			ftype         fileType
@@ -245,6 +311,7 @@ func (s *mdLoaderSetup) listFiles(dir string) error {
 			common.AppLogger.Infof("[filter] ignoring table file %s", path)
 			return nil
 		}
+		info.tableName, info.renamed = s.loader.rename(info.tableName)
 
 		switch ftype {
 		case fileTypeDatabaseSchema:
@@ -264,6 +331,19 @@ func (l *MDLoader) shouldSkip(table *filter.Table) bool {
 	return len(l.filter.ApplyOn([]*filter.Table{table})) == 0
 }
 
+// rename returns the name of the table in the target database, and whether it
+// differs from the name in the data source.
+func (l *MDLoader) rename(table filter.Table) (filter.Table, bool) {
+	target := table
+	if name, ok := l.renameTable[table.Schema+"."+table.Name]; ok && len(table.Name) > 0 {
+		target.Name = name
+	}
+	if schema, ok := l.renameSchema[table.Schema]; ok {
+		target.Schema = schema
+	}
+	return target, target != table
+}
+
 func (s *mdLoaderSetup) insertDB(dbName string, path string) (*MDDatabaseMeta, bool) {
 	dbIndex, ok := s.dbIndexMap[dbName]
 	if ok {
@@ -274,6 +354,7 @@ func (s *mdLoaderSetup) insertDB(dbName string, path string) (*MDDatabaseMeta, b
 			Name:       dbName,
 			SchemaFile: path,
 			charSet:    s.loader.charSet,
+			target:     s.loader.target,
 		}
 		s.loader.dbs = append(s.loader.dbs, ptr)
 		return ptr, false
@@ -293,6 +374,7 @@ func (s *mdLoaderSetup) insertTable(tableName filter.Table, path string) (*MDTab
 			SchemaFile: path,
 			DataFiles:  make([]string, 0, 16),
 			charSet:    s.loader.charSet,
+			target:     s.loader.target,
 		}
 		dbMeta.Tables = append(dbMeta.Tables, ptr)
 		return ptr, dbExists, false
@@ -256,3 +256,97 @@ func (s *testMydumpLoaderSuite) TestTablesWithDots(c *C) {
 		},
 	}})
 }
+
+func (s *testMydumpLoaderSuite) TestRename(c *C) {
+	/*
+		path/
+			prod_db-schema-create.sql
+			prod_db.users-schema.sql
+			prod_db.users.sql
+			prod_db.orders-schema.sql
+			prod_db.orders.sql
+	*/
+
+	dir := s.cfg.Mydumper.SourceDir
+	files := map[string]string{
+		"prod_db-schema-create.sql": "CREATE DATABASE prod_db;",
+		"prod_db.users-schema.sql":  "CREATE TABLE `prod_db`.`users` (id INT);",
+		"prod_db.users.sql":         "INSERT INTO users VALUES (1);",
+		"prod_db.orders-schema.sql": "CREATE TABLE orders (id INT);",
+		"prod_db.orders.sql":        "INSERT INTO orders VALUES (1);",
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644)
+		c.Assert(err, IsNil)
+	}
+
+	s.cfg.Mydumper.CharacterSet = "auto"
+	s.cfg.Mydumper.RenameSchema = map[string]string{"prod_db": "staging_db"}
+	s.cfg.Mydumper.RenameTable = map[string]string{"prod_db.users": "users_copy"}
+	mdl, err := md.NewMyDumpLoader(s.cfg)
+	c.Assert(err, IsNil)
+
+	dbMetas := mdl.GetDatabases()
+	c.Assert(dbMetas, HasLen, 1)
+	c.Assert(dbMetas[0].Name, Equals, "staging_db")
+	c.Assert(dbMetas[0].Tables, HasLen, 2)
+
+	orders := dbMetas[0].Tables[0]
+	c.Assert(orders.DB, Equals, "staging_db")
+	c.Assert(orders.Name, Equals, "orders")
+	c.Assert(orders.DataFiles, HasLen, 1)
+	c.Assert(orders.GetSchema(), Equals, "CREATE TABLE `orders` (id INT);")
+
+	users := dbMetas[0].Tables[1]
+	c.Assert(users.DB, Equals, "staging_db")
+	c.Assert(users.Name, Equals, "users_copy")
+	c.Assert(users.DataFiles, HasLen, 1)
+	c.Assert(users.GetSchema(), Equals, "CREATE TABLE `users_copy` (id INT);")
+}
+
+func (s *testMydumpLoaderSuite) TestTargetCharset(c *C) {
+	dir := s.cfg.Mydumper.SourceDir
+	files := map[string]string{
+		"db-schema-create.sql": "CREATE DATABASE db;",
+		"db.a-schema.sql": "CREATE TABLE `a` (\n" +
+			"`id` int(11) NOT NULL,\n" +
+			"`name` varchar(16) CHARACTER SET latin1 COLLATE latin1_bin DEFAULT 'charset latin1', -- CHARSET gbk\n" +
+			"`data` varbinary(16),\n" +
+			"`raw` varchar(16) CHARACTER SET binary,\n" +
+			"PRIMARY KEY (`id`)\n" +
+			") ENGINE=InnoDB DEFAULT CHARSET=latin1;\n",
+		"db.b-schema.sql": "CREATE TABLE b (c TEXT CHARSET utf8 COLLATE utf8_general_ci) /*!40101 DEFAULT CHARACTER SET = utf8 */;",
+		"db.c-schema.sql": "CREATE TABLE c (id INT, c CHAR(1)) PARTITION BY HASH(id) PARTITIONS 4;",
+		"db.d-schema.sql": "CREATE TABLE d (c CHAR(1)) COLLATE latin1_swedish_ci;",
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644)
+		c.Assert(err, IsNil)
+	}
+
+	s.cfg.Mydumper.CharacterSet = "auto"
+	s.cfg.Mydumper.TargetCharset = "utf8mb4"
+	s.cfg.Mydumper.TargetCollation = "utf8mb4_bin"
+	mdl, err := md.NewMyDumpLoader(s.cfg)
+	c.Assert(err, IsNil)
+
+	dbMetas := mdl.GetDatabases()
+	c.Assert(dbMetas, HasLen, 1)
+	c.Assert(dbMetas[0].GetSchema(), Equals, "CREATE DATABASE IF NOT EXISTS `db` DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_bin")
+
+	tables := dbMetas[0].Tables
+	c.Assert(tables, HasLen, 4)
+	c.Assert(tables[0].GetSchema(), Equals, "CREATE TABLE `a` (\n"+
+		"`id` int(11) NOT NULL,\n"+
+		"`name` varchar(16) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin DEFAULT 'charset latin1', -- CHARSET gbk\n"+
+		"`data` varbinary(16),\n"+
+		"`raw` varchar(16) CHARACTER SET binary,\n"+
+		"PRIMARY KEY (`id`)\n"+
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;")
+	c.Assert(tables[1].GetSchema(), Equals,
+		"CREATE TABLE b (c TEXT CHARSET utf8mb4 COLLATE utf8mb4_bin) /*!40101 DEFAULT CHARACTER SET = utf8mb4 COLLATE=utf8mb4_bin */;")
+	c.Assert(tables[2].GetSchema(), Equals,
+		"CREATE TABLE c (id INT, c CHAR(1)) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin PARTITION BY HASH(id) PARTITIONS 4;")
+	c.Assert(tables[3].GetSchema(), Equals,
+		"CREATE TABLE d (c CHAR(1)) COLLATE utf8mb4_bin DEFAULT CHARSET=utf8mb4;")
+}
@@ -14,7 +14,6 @@
 package mydump
 
 import (
-	"bytes"
 	"io"
 	"time"
 
@@ -30,9 +29,13 @@ import (
 type ChunkParser struct {
 	// states for the lexer
 	reader      io.Reader
-	buf         []byte
-	blockBuf    []byte
+	buf         []byte // the unconsumed part of `block`
+	block       []byte
+	blockSize   int
 	isLastChunk bool
+	// whether the rows read since the last ReleaseRows are still referenced
+	// by the caller, so `block` must not be overwritten.
+	retaining bool
 
 	lastRow Row
 	// Current file offset.
@@ -44,9 +47,6 @@ type ChunkParser struct {
 	// Assumed to be constant throughout the entire file.
 	Columns []byte
 
-	// cache
-	remainBuf *bytes.Buffer
-	appendBuf *bytes.Buffer
 	ioWorkers *worker.Pool
 }
 
@@ -58,7 +58,8 @@ type Chunk struct {
 	RowIDMax     int64
 }
 
-// Row is the content of a row.
+// Row is the content of a row. `Row` references the read buffer of the parser
+// instead of a copy, see ChunkParser.RetainRows for how long it is valid.
 type Row struct {
 	RowID int64
 	Row   []byte
@@ -68,9 +69,7 @@ type Row struct {
 func NewChunkParser(reader io.Reader, blockBufSize int64, ioWorkers *worker.Pool) *ChunkParser {
 	return &ChunkParser{
 		reader:    reader,
-		blockBuf:  make([]byte, blockBufSize*config.BufferSizeScale),
-		remainBuf: &bytes.Buffer{},
-		appendBuf: &bytes.Buffer{},
+		blockSize: int(blockBufSize * config.BufferSizeScale),
 		ioWorkers: ioWorkers,
 	}
 }
@@ -100,12 +99,46 @@ const (
 	tokName
 )
 
+// SetBlockSize changes the size of the blocks read from now on.
+func (parser *ChunkParser) SetBlockSize(blockBufSize int64) {
+	parser.blockSize = int(blockBufSize * config.BufferSizeScale)
+}
+
+// RetainRows makes the rows read from now on stay valid until ReleaseRows is
+// called. By default a row is only valid until the next call to ReadRow, since
+// the read buffer is reused for the following blocks. While retaining, a new
+// buffer is allocated for each block instead, and the old ones are handed over
+// to the caller, so the rows can be used without being copied.
+func (parser *ChunkParser) RetainRows() {
+	parser.retaining = true
+}
+
+// ReleaseRows tells the parser that none of the rows read before are used, so
+// the read buffer can be reused again.
+func (parser *ChunkParser) ReleaseRows() {
+	parser.retaining = false
+}
+
 func (parser *ChunkParser) readBlock() error {
 	startTime := time.Now()
 
+	// the unconsumed data is moved to the front of the buffer, followed by
+	// the new block read directly after it.
+	remain := len(parser.buf)
+	size := remain + parser.blockSize
+	block := parser.block
+	if parser.retaining || cap(block) < size {
+		block = make([]byte, size)
+	} else {
+		block = block[:size]
+	}
+	copy(block, parser.buf)
+	parser.block = block
+	parser.buf = block[:remain]
+
 	// limit IO concurrency
 	w := parser.ioWorkers.Apply()
-	n, err := parser.reader.Read(parser.blockBuf)
+	n, err := parser.reader.Read(block[remain:])
 	parser.ioWorkers.Recycle(w)
 
 	switch err {
@@ -113,14 +146,7 @@ func (parser *ChunkParser) readBlock() error {
 		parser.isLastChunk = true
 		fallthrough
 	case nil:
-		// `parser.buf` reference to `appendBuf.Bytes`, so should use remainBuf to
-		// hold the `parser.buf` rest data to prevent slice overlap
-		parser.remainBuf.Reset()
-		parser.remainBuf.Write(parser.buf)
-		parser.appendBuf.Reset()
-		parser.appendBuf.Write(parser.remainBuf.Bytes())
-		parser.appendBuf.Write(parser.blockBuf[:n])
-		parser.buf = parser.appendBuf.Bytes()
+		parser.buf = block[:remain+n]
 		metric.ChunkParserReadBlockSecondsHistogram.Observe(time.Since(startTime).Seconds())
 		return nil
 	default:
@@ -165,13 +191,14 @@ func (parser *ChunkParser) ReadRow() error {
 				row.Row = content
 				return nil
 			case stateColumns:
-				parser.Columns = content
+				// copied as the columns outlive the read buffer.
+				parser.Columns = append([]byte(nil), content...)
 				continue
 			}
 
 		case tokName:
 			st = stateColumns
-			parser.TableName = content
+			parser.TableName = append([]byte(nil), content...)
 			parser.Columns = nil
 			continue
 
@@ -185,7 +212,8 @@ func (parser *ChunkParser) ReadRow() error {
 	}
 }
 
-// LastRow is the copy of the row parsed by the last call to ReadRow().
+// LastRow is the row parsed by the last call to ReadRow(). The content is not
+// copied, see RetainRows.
 func (parser *ChunkParser) LastRow() Row {
 	return parser.lastRow
 }
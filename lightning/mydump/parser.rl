@@ -109,7 +109,7 @@ func (parser *ChunkParser) lex() (token, []byte, error) {
 		%% write exec;
 
 		if cs == %%{ write error; }%% {
-			common.AppLogger.Errorf("Syntax error near byte %d, content is «%s»", parser.pos, string(data))
+			common.AppLogger.Errorf("Syntax error near byte %d, content is «%s»", parser.pos, common.RedactString(string(data)))
 			return tokNil, nil, errors.New("Syntax error")
 		}
 
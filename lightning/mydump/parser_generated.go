@@ -1480,7 +1480,7 @@ func (parser *ChunkParser) lex() (token, []byte, error) {
 		//.... lightning/mydump/parser.rl:97
 
 		if cs == 0 {
-			common.AppLogger.Errorf("Syntax error near byte %d, content is «%s»", parser.pos, string(data))
+			common.AppLogger.Errorf("Syntax error near byte %d, content is «%s»", parser.pos, common.RedactString(string(data)))
 			return tokNil, nil, errors.New("Syntax error")
 		}
 
@@ -157,3 +157,37 @@ func (s *testMydumpParserSuite) TestNestedRow(c *C) {
 		},
 	})
 }
+
+func (s *testMydumpParserSuite) TestRetainRows(c *C) {
+	const data = "INSERT INTO t (a, b) VALUES (1, 'one'), (2, 'two'), (3, 'three'), (4, 'four'), (5, 'five'), (6, 'six');"
+	expected := [][]byte{
+		[]byte("(1, 'one')"),
+		[]byte("(2, 'two')"),
+		[]byte("(3, 'three')"),
+		[]byte("(4, 'four')"),
+		[]byte("(5, 'five')"),
+		[]byte("(6, 'six')"),
+	}
+	ioWorkers := worker.NewPool(context.Background(), 5, "test")
+
+	// the rows are checked right after being read while the buffer is reused.
+	parser := mydump.NewChunkParser(strings.NewReader(data), 2, ioWorkers)
+	for i, row := range expected {
+		c.Assert(parser.ReadRow(), IsNil)
+		c.Assert(parser.LastRow(), DeepEquals, mydump.Row{RowID: int64(i + 1), Row: row})
+	}
+	c.Assert(errors.Cause(parser.ReadRow()), Equals, io.EOF)
+
+	// the retained rows stay valid after the following blocks are read.
+	parser = mydump.NewChunkParser(strings.NewReader(data), 2, ioWorkers)
+	parser.RetainRows()
+	var rows [][]byte
+	for range expected {
+		c.Assert(parser.ReadRow(), IsNil)
+		rows = append(rows, parser.LastRow().Row)
+	}
+	c.Assert(rows, DeepEquals, expected)
+	c.Assert(parser.Columns, DeepEquals, []byte("(a, b)"))
+	parser.ReleaseRows()
+	c.Assert(errors.Cause(parser.ReadRow()), Equals, io.EOF)
+}
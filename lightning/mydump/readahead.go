@@ -0,0 +1,92 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mydump
+
+import (
+	"io"
+	"os"
+
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/config"
+)
+
+// readaheadWindow is how far ahead of the parser the kernel is asked to read
+// the data file.
+const readaheadWindow = 8 * 1024 * 1024
+
+// ReadSeekCloser is a data file opened by OpenDataFile.
+type ReadSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// OpenDataFile opens the data file for the chunk parser. With the readahead
+// engine, the kernel is told that the file is read sequentially, and is asked
+// to load the next window while the parser is still on the current one, so
+// the reads mostly hit the page cache. With the io_uring engine, the blocks
+// ahead of the parser are read asynchronously through io_uring.
+func OpenDataFile(path string, readEngine string) (ReadSeekCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	switch readEngine {
+	case config.ReadEngineReadahead:
+		// the advices are only hints, the file is read all the same if the
+		// kernel ignores them.
+		adviseSequential(file)
+		return &readaheadFile{File: file}, nil
+	case config.ReadEngineIOURing:
+		reader, err := openURingFile(file)
+		if err != nil {
+			file.Close()
+			return nil, errors.Trace(err)
+		}
+		return reader, nil
+	default:
+		return file, nil
+	}
+}
+
+// readaheadFile keeps the kernel reading a window ahead of the position.
+type readaheadFile struct {
+	*os.File
+	pos     int64
+	advised int64 // the end of the range already asked to be read ahead
+}
+
+func (f *readaheadFile) Read(p []byte) (int, error) {
+	// ask for the next window once half of the current one is consumed.
+	if f.pos+readaheadWindow/2 >= f.advised {
+		start := f.advised
+		if start < f.pos {
+			start = f.pos
+		}
+		adviseWillNeed(f.File, start, readaheadWindow)
+		f.advised = start + readaheadWindow
+	}
+	n, err := f.File.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *readaheadFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.pos = pos
+		f.advised = pos
+	}
+	return pos, err
+}
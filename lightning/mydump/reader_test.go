@@ -14,10 +14,16 @@
 package mydump_test
 
 import (
+	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
+	"runtime"
 
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/config"
 	. "github.com/pingcap/tidb-lightning/lightning/mydump"
 )
 
@@ -126,3 +132,84 @@ func (s *testMydumpReaderSuite) TestExportStatementGibberishError(c *C) {
 	c.Assert(data, IsNil)
 	c.Assert(err, NotNil)
 }
+
+// readEngines lists the read engines supported on this platform.
+func readEngines() []string {
+	engines := []string{config.ReadEngineSync, config.ReadEngineReadahead}
+	if runtime.GOOS == "linux" && (runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64") {
+		engines = append(engines, config.ReadEngineIOURing)
+	}
+	return engines
+}
+
+func (s *testMydumpReaderSuite) TestOpenDataFile(c *C) {
+	file, err := ioutil.TempFile("", "tidb_lightning_test_reader")
+	c.Assert(err, IsNil)
+	defer os.Remove(file.Name())
+	_, err = file.Write([]byte("INSERT INTO t VALUES (1),(2);"))
+	c.Assert(err, IsNil)
+	c.Assert(file.Close(), IsNil)
+
+	for _, readEngine := range readEngines() {
+		reader, err := OpenDataFile(file.Name(), readEngine)
+		c.Assert(err, IsNil)
+		pos, err := reader.Seek(21, io.SeekStart)
+		c.Assert(err, IsNil)
+		c.Assert(pos, Equals, int64(21))
+		data, err := ioutil.ReadAll(reader)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, "(1),(2);")
+		c.Assert(reader.Close(), IsNil)
+	}
+
+	_, err = OpenDataFile(file.Name()+".missing", config.ReadEngineReadahead)
+	c.Assert(os.IsNotExist(errors.Cause(err)), IsTrue)
+}
+
+func (s *testMydumpReaderSuite) TestReadEnginesLargeFile(c *C) {
+	// the file spans several blocks read ahead, and does not end on a block
+	// boundary.
+	content := make([]byte, 3*1024*1024+123)
+	for i := range content {
+		content[i] = byte(i * 7 / 5)
+	}
+	file, err := ioutil.TempFile("", "tidb_lightning_test_reader")
+	c.Assert(err, IsNil)
+	defer os.Remove(file.Name())
+	_, err = file.Write(content)
+	c.Assert(err, IsNil)
+	c.Assert(file.Close(), IsNil)
+
+	for _, readEngine := range readEngines() {
+		reader, err := OpenDataFile(file.Name(), readEngine)
+		c.Assert(err, IsNil)
+
+		var data bytes.Buffer
+		buf := make([]byte, 64*1024+1)
+		for {
+			n, err := reader.Read(buf)
+			data.Write(buf[:n])
+			if err == io.EOF {
+				break
+			}
+			c.Assert(err, IsNil)
+		}
+		c.Assert(bytes.Equal(data.Bytes(), content), IsTrue, Commentf("read engine %s", readEngine))
+
+		for _, offset := range []int64{100, 2*1024*1024 - 1, int64(len(content)) - 10, 5} {
+			pos, err := reader.Seek(offset, io.SeekStart)
+			c.Assert(err, IsNil)
+			c.Assert(pos, Equals, offset)
+			n, err := io.ReadFull(reader, buf[:10])
+			c.Assert(err, IsNil)
+			c.Assert(buf[:n], DeepEquals, content[offset:offset+10], Commentf("read engine %s", readEngine))
+		}
+
+		_, err = reader.Seek(int64(len(content)), io.SeekStart)
+		c.Assert(err, IsNil)
+		n, err := reader.Read(buf)
+		c.Assert(n, Equals, 0)
+		c.Assert(err, Equals, io.EOF)
+		c.Assert(reader.Close(), IsNil)
+	}
+}
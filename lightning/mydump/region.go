@@ -60,6 +60,10 @@ func (rs regionSlice) Less(i, j int) bool {
 
 ////////////////////////////////////////////////////////////////
 
+// AllocateEngineIDs splits the regions into engines. With a zero
+// batchImportRatio, the engines are of about the same size, each not much
+// larger than batchSize. Balanced engines are imported in similar time, unlike
+// filling up every engine and leaving the remainder in the last one.
 func AllocateEngineIDs(
 	filesRegions []*TableRegion,
 	dataFileSizes []float64,
@@ -72,8 +76,40 @@ func AllocateEngineIDs(
 		totalDataFileSize += dataFileSize
 	}
 
+	if batchImportRatio > 0 {
+		allocateScaledEngineIDs(filesRegions, dataFileSizes, totalDataFileSize, batchSize, batchImportRatio, tableConcurrency)
+		return
+	}
+
+	engineCount := math.Ceil(totalDataFileSize / batchSize)
+	balancedEngineSize := totalDataFileSize / engineCount
+
+	curEngineID := 0
+	curDataFileSize := 0.0
+	for i, dataFileSize := range dataFileSizes {
+		filesRegions[i].EngineID = curEngineID
+		curDataFileSize += dataFileSize
+		if curDataFileSize >= float64(curEngineID+1)*balancedEngineSize {
+			curEngineID++
+		}
+	}
+}
+
+// allocateScaledEngineIDs fills up the engines of increasing sizes, starting
+// from about batchSize.
+func allocateScaledEngineIDs(
+	filesRegions []*TableRegion,
+	dataFileSizes []float64,
+	totalDataFileSize float64,
+	batchSize float64,
+	batchImportRatio float64,
+	tableConcurrency float64,
+) {
 	// No need to batch if the size is too small :)
 	if totalDataFileSize <= batchSize {
+		for _, region := range filesRegions {
+			region.EngineID = 0
+		}
 		return
 	}
 
@@ -149,6 +185,10 @@ func MakeTableRegions(
 			return nil, errors.Annotatef(err, "cannot stat %s", dataFile)
 		}
 		dataFileSize := dataFileInfo.Size()
+		// every row takes at least `columns+2` bytes, e.g. `(1,2)`, so the
+		// range is large enough for all rows of the file. The ranges only
+		// depend on the file sizes in order, and are recorded in the
+		// checkpoints, so the row IDs stay the same after resuming.
 		rowIDMax := prevRowIDMax + dataFileSize/(int64(columns)+2)
 		filesRegions = append(filesRegions, &TableRegion{
 			DB:    meta.DB,
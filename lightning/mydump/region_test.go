@@ -131,21 +131,46 @@ func (s *testMydumpRegionSuite) TestAllocateEngineIDs(c *C) {
 		c.Assert(actual, DeepEquals, expected, Commentf("%s", what))
 	}
 
-	// Batch size > Total size => Everything in the zero batch.
-	AllocateEngineIDs(filesRegions, dataFileSizes, 1000, 0.5, 1000)
+	// Engine size > Total size => Everything in the zero engine.
+	AllocateEngineIDs(filesRegions, dataFileSizes, 1000, 0, 1000)
 	checkEngineSizes("no batching", map[int]int{
 		0: 700,
 	})
 
-	// Allocate 3 engines.
+	// Allocate 4 balanced engines instead of 3 full ones and a small one.
+	AllocateEngineIDs(filesRegions, dataFileSizes, 200, 0, 1000)
+	checkEngineSizes("engine size = 200", map[int]int{
+		0: 175,
+		1: 175,
+		2: 175,
+		3: 175,
+	})
+
+	// Exact multiple.
+	AllocateEngineIDs(filesRegions, dataFileSizes, 100, 0, 1000)
+	checkEngineSizes("engine size = 100", map[int]int{
+		0: 100,
+		1: 100,
+		2: 100,
+		3: 100,
+		4: 100,
+		5: 100,
+		6: 100,
+	})
+
+	// Scaled up engines with a positive ratio.
+	AllocateEngineIDs(filesRegions, dataFileSizes, 1000, 0.5, 1000)
+	checkEngineSizes("no batching, ratio = 0.5", map[int]int{
+		0: 700,
+	})
+
 	AllocateEngineIDs(filesRegions, dataFileSizes, 200, 0.5, 1000)
-	checkEngineSizes("batch size = 200", map[int]int{
+	checkEngineSizes("batch size = 200, ratio = 0.5", map[int]int{
 		0: 170,
 		1: 213,
 		2: 317,
 	})
 
-	// Allocate 3 engines with an alternative ratio
 	AllocateEngineIDs(filesRegions, dataFileSizes, 200, 0.6, 1000)
 	checkEngineSizes("batch size = 200, ratio = 0.6", map[int]int{
 		0: 160,
@@ -153,9 +178,8 @@ func (s *testMydumpRegionSuite) TestAllocateEngineIDs(c *C) {
 		2: 332,
 	})
 
-	// Allocate 5 engines.
 	AllocateEngineIDs(filesRegions, dataFileSizes, 100, 0.5, 1000)
-	checkEngineSizes("batch size = 100", map[int]int{
+	checkEngineSizes("batch size = 100, ratio = 0.5", map[int]int{
 		0: 93,
 		1: 105,
 		2: 122,
@@ -165,7 +189,7 @@ func (s *testMydumpRegionSuite) TestAllocateEngineIDs(c *C) {
 
 	// Number of engines > table concurrency
 	AllocateEngineIDs(filesRegions, dataFileSizes, 50, 0.5, 4)
-	checkEngineSizes("batch size = 50, limit table conc = 4", map[int]int{
+	checkEngineSizes("batch size = 50, ratio = 0.5, limit table conc = 4", map[int]int{
 		0:  50,
 		1:  59,
 		2:  73,
@@ -181,15 +205,14 @@ func (s *testMydumpRegionSuite) TestAllocateEngineIDs(c *C) {
 		12: 8,
 	})
 
-	// Zero ratio = Uniform
-	AllocateEngineIDs(filesRegions, dataFileSizes, 100, 0.0, 1000)
-	checkEngineSizes("batch size = 100, ratio = 0", map[int]int{
-		0: 100,
-		1: 100,
-		2: 100,
-		3: 100,
-		4: 100,
-		5: 100,
-		6: 100,
+	// Large files are not split, but the engines after them are still
+	// balanced.
+	dataFileSizes[0] = 300
+	AllocateEngineIDs(filesRegions, dataFileSizes, 300, 0, 1000)
+	checkEngineSizes("engine size = 300 with a large file", map[int]int{
+		0: 1,
+		1: 200,
+		2: 250,
+		3: 249,
 	})
 }
@@ -0,0 +1,352 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package mydump
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pingcap/errors"
+	"golang.org/x/sys/unix"
+)
+
+// The io_uring interface of Linux 5.1, used through the raw system calls. The
+// numbers are the same on every architecture using the generic syscall table.
+const (
+	sysIOURingSetup = 425
+	sysIOURingEnter = 426
+
+	iouringOffSQRing = 0
+	iouringOffCQRing = 0x8000000
+	iouringOffSQEs   = 0x10000000
+
+	iouringEnterGetEvents = 1
+	iouringOpReadv        = 1
+
+	iouringSQESize = 64
+	iouringCQESize = 16
+)
+
+// uringQueueDepth blocks of uringBlockSize are read ahead of the parser.
+const (
+	uringQueueDepth = 4
+	uringBlockSize  = 256 * 1024
+)
+
+type iouringSQRingOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	resv2                                                           uint64
+}
+
+type iouringCQRingOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	resv2                                                           uint64
+}
+
+type iouringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  iouringSQRingOffsets
+	cqOff                                                                  iouringCQRingOffsets
+}
+
+// iouring is a ring submitting reads and reaping their completions from a
+// single goroutine.
+type iouring struct {
+	fd     int
+	params iouringParams
+	sq     []byte
+	cq     []byte
+	sqes   []byte
+}
+
+func newIOURing(entries uint32) (*iouring, error) {
+	r := &iouring{}
+	fd, _, errno := unix.Syscall(sysIOURingSetup, uintptr(entries), uintptr(unsafe.Pointer(&r.params)), 0)
+	if errno != 0 {
+		return nil, errors.Annotate(errno, "cannot set up io_uring")
+	}
+	r.fd = int(fd)
+
+	var err error
+	mmap := func(offset int64, size uint32) []byte {
+		if err != nil {
+			return nil
+		}
+		var data []byte
+		data, err = unix.Mmap(r.fd, offset, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		return data
+	}
+	p := &r.params
+	r.sq = mmap(iouringOffSQRing, p.sqOff.array+p.sqEntries*4)
+	r.cq = mmap(iouringOffCQRing, p.cqOff.cqes+p.cqEntries*iouringCQESize)
+	r.sqes = mmap(iouringOffSQEs, p.sqEntries*iouringSQESize)
+	if err != nil {
+		r.close()
+		return nil, errors.Annotate(err, "cannot map io_uring")
+	}
+	return r, nil
+}
+
+func (r *iouring) close() {
+	for _, data := range [][]byte{r.sq, r.cq, r.sqes} {
+		if data != nil {
+			unix.Munmap(data)
+		}
+	}
+	unix.Close(r.fd)
+}
+
+func ringUint32(ring []byte, offset uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&ring[offset]))
+}
+
+func (r *iouring) enter(toSubmit uint32, minComplete uint32, flags uint32) error {
+	for {
+		_, _, errno := unix.Syscall6(sysIOURingEnter, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), uintptr(flags), 0, 0)
+		switch errno {
+		case 0:
+			return nil
+		case syscall.EINTR, syscall.EAGAIN:
+		default:
+			return errors.Annotate(errno, "io_uring_enter failed")
+		}
+	}
+}
+
+// submitReadv submits reading the file at the offset into the buffers, which
+// must not be touched until the completion is reaped. The caller never has
+// more requests in flight than the entries of the ring.
+func (r *iouring) submitReadv(fd int, offset int64, iov *unix.Iovec, userData uint64) error {
+	tail := *ringUint32(r.sq, r.params.sqOff.tail)
+	index := tail & *ringUint32(r.sq, r.params.sqOff.ringMask)
+	sqe := r.sqes[index*iouringSQESize : (index+1)*iouringSQESize]
+	for i := range sqe {
+		sqe[i] = 0
+	}
+	sqe[0] = iouringOpReadv
+	*(*int32)(unsafe.Pointer(&sqe[4])) = int32(fd)
+	*(*uint64)(unsafe.Pointer(&sqe[8])) = uint64(offset)
+	*(*uint64)(unsafe.Pointer(&sqe[16])) = uint64(uintptr(unsafe.Pointer(iov)))
+	*(*uint32)(unsafe.Pointer(&sqe[24])) = 1
+	*(*uint64)(unsafe.Pointer(&sqe[32])) = userData
+	*ringUint32(r.sq, r.params.sqOff.array+index*4) = index
+	atomic.StoreUint32(ringUint32(r.sq, r.params.sqOff.tail), tail+1)
+	return r.enter(1, 0, 0)
+}
+
+// wait reaps a completion, blocking until there is one.
+func (r *iouring) wait() (userData uint64, res int32, err error) {
+	headPtr := ringUint32(r.cq, r.params.cqOff.head)
+	for {
+		head := *headPtr
+		if head != atomic.LoadUint32(ringUint32(r.cq, r.params.cqOff.tail)) {
+			index := head & *ringUint32(r.cq, r.params.cqOff.ringMask)
+			cqe := r.cq[r.params.cqOff.cqes+index*iouringCQESize:]
+			userData = *(*uint64)(unsafe.Pointer(&cqe[0]))
+			res = *(*int32)(unsafe.Pointer(&cqe[8]))
+			atomic.StoreUint32(headPtr, head+1)
+			return userData, res, nil
+		}
+		if err := r.enter(0, 1, iouringEnterGetEvents); err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// uringBlock is a buffer read by the ring.
+type uringBlock struct {
+	index  int
+	buf    []byte
+	iov    unix.Iovec
+	offset int64 // the file offset of the buffer
+	want   int   // the length to read, shorter than the buffer at the end of the file
+	filled int
+	done   bool
+	err    error
+}
+
+// uringFile reads the data file ahead of the parser through io_uring, with
+// several blocks in flight, so the parser is mostly copying from the blocks
+// already read rather than waiting for the disk.
+type uringFile struct {
+	file *os.File
+	size int64
+	ring *iouring
+
+	blocks  []*uringBlock
+	pending []*uringBlock // the blocks submitted or read, in the file order
+	free    []*uringBlock
+	next    int64 // the file offset of the next block to submit
+	pos     int64
+	cur     *uringBlock // the block being consumed, at pos
+}
+
+func openURingFile(file *os.File) (ReadSeekCloser, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ring, err := newIOURing(uringQueueDepth)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	f := &uringFile{file: file, size: stat.Size(), ring: ring}
+	for i := 0; i < uringQueueDepth; i++ {
+		block := &uringBlock{index: i, buf: make([]byte, uringBlockSize)}
+		f.blocks = append(f.blocks, block)
+		f.free = append(f.free, block)
+	}
+	if err := f.fill(); err != nil {
+		f.drain()
+		ring.close()
+		return nil, errors.Trace(err)
+	}
+	return f, nil
+}
+
+// submit reads the rest of the block.
+func (f *uringFile) submit(block *uringBlock) error {
+	block.iov.Base = &block.buf[block.filled]
+	block.iov.SetLen(block.want - block.filled)
+	return f.ring.submitReadv(int(f.file.Fd()), block.offset+int64(block.filled), &block.iov, uint64(block.index))
+}
+
+// fill submits the free blocks until the end of the file.
+func (f *uringFile) fill() error {
+	for len(f.free) > 0 && f.next < f.size {
+		block := f.free[len(f.free)-1]
+		f.free = f.free[:len(f.free)-1]
+		block.offset = f.next
+		block.want = len(block.buf)
+		if rest := f.size - f.next; rest < int64(block.want) {
+			block.want = int(rest)
+		}
+		block.filled, block.done, block.err = 0, false, nil
+		f.pending = append(f.pending, block)
+		f.next += int64(block.want)
+		if err := f.submit(block); err != nil {
+			// the block is not in flight, so it is not waited for.
+			block.done, block.err = true, err
+			return err
+		}
+	}
+	return nil
+}
+
+// reap waits for a completion, and resubmits the block if it is not fully
+// read yet.
+func (f *uringFile) reap() {
+	userData, res, err := f.ring.wait()
+	if err != nil {
+		// the ring is broken, so nothing in flight is going to complete.
+		for _, block := range f.pending {
+			if !block.done {
+				block.done, block.err = true, err
+			}
+		}
+		return
+	}
+	block := f.blocks[userData]
+	switch {
+	case res < 0:
+		block.done, block.err = true, errors.Annotatef(syscall.Errno(-res), "cannot read %s", f.file.Name())
+	case res == 0:
+		block.done, block.err = true, errors.Annotatef(io.ErrUnexpectedEOF, "%s is truncated while reading", f.file.Name())
+	default:
+		block.filled += int(res)
+		if block.filled < block.want {
+			if err := f.submit(block); err != nil {
+				block.done, block.err = true, err
+			}
+		} else {
+			block.done = true
+		}
+	}
+}
+
+func (f *uringFile) Read(p []byte) (int, error) {
+	for f.cur == nil {
+		if len(f.pending) == 0 {
+			return 0, io.EOF
+		}
+		block := f.pending[0]
+		for !block.done {
+			f.reap()
+		}
+		if block.err != nil {
+			return 0, block.err
+		}
+		f.pending = f.pending[1:]
+		if f.pos < block.offset+int64(block.want) {
+			f.cur = block
+		} else {
+			f.free = append(f.free, block)
+		}
+	}
+
+	n := copy(p, f.cur.buf[f.pos-f.cur.offset:f.cur.want])
+	f.pos += int64(n)
+	if f.pos == f.cur.offset+int64(f.cur.want) {
+		f.free = append(f.free, f.cur)
+		f.cur = nil
+		if err := f.fill(); err != nil {
+			return n, errors.Trace(err)
+		}
+	}
+	return n, nil
+}
+
+// drain waits for all the blocks in flight, whose buffers are then free.
+func (f *uringFile) drain() {
+	for _, block := range f.pending {
+		for !block.done {
+			f.reap()
+		}
+		f.free = append(f.free, block)
+	}
+	f.pending = nil
+	if f.cur != nil {
+		f.free = append(f.free, f.cur)
+		f.cur = nil
+	}
+}
+
+func (f *uringFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return f.pos, errors.Errorf("seek %s to a negative offset %d", f.file.Name(), offset)
+	}
+	f.drain()
+	f.pos = offset
+	f.next = offset
+	return offset, errors.Trace(f.fill())
+}
+
+func (f *uringFile) Close() error {
+	f.drain()
+	f.ring.close()
+	return f.file.Close()
+}
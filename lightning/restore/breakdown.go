@@ -0,0 +1,139 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/tidb-lightning/lightning/metric"
+)
+
+const (
+	BoundEncode   = "encode-bound"
+	BoundDelivery = "delivery-bound"
+	BoundIngest   = "ingest-bound"
+)
+
+type tablePhase int
+
+const (
+	tablePhaseRead tablePhase = iota
+	tablePhaseEncode
+	tablePhaseDeliver
+	tablePhaseClose
+	tablePhaseImport
+	numTablePhases
+)
+
+var tablePhaseNames = [numTablePhases]string{
+	metric.TablePhaseRead,
+	metric.TablePhaseEncode,
+	metric.TablePhaseDeliver,
+	metric.TablePhaseClose,
+	metric.TablePhaseImport,
+}
+
+// phaseBreakdown accumulates the time spent by a table in each phase, summed
+// over the chunks and engines running concurrently. The elements are in
+// nanoseconds, accessed atomically.
+type phaseBreakdown [numTablePhases]int64
+
+func (b *phaseBreakdown) add(phase tablePhase, d time.Duration) {
+	atomic.AddInt64(&b[phase], int64(d))
+}
+
+func (b *phaseBreakdown) durations() (durations [numTablePhases]time.Duration, total time.Duration) {
+	for phase := range b {
+		durations[phase] = time.Duration(atomic.LoadInt64(&b[phase]))
+		total += durations[phase]
+	}
+	return
+}
+
+// seconds returns the time of each phase by the names, or nil if nothing is
+// recorded.
+func (b *phaseBreakdown) seconds() map[string]float64 {
+	durations, total := b.durations()
+	if total == 0 {
+		return nil
+	}
+	seconds := make(map[string]float64, numTablePhases)
+	for phase, d := range durations {
+		seconds[tablePhaseNames[phase]] = d.Seconds()
+	}
+	return seconds
+}
+
+// bound tells which part of the pipeline the table spent most time on:
+// reading and encoding the rows, delivering them into the engines, or
+// importing the engines into TiKV.
+func (b *phaseBreakdown) bound() string {
+	durations, total := b.durations()
+	if total == 0 {
+		return ""
+	}
+	encode := durations[tablePhaseRead] + durations[tablePhaseEncode]
+	delivery := durations[tablePhaseDeliver] + durations[tablePhaseClose]
+	ingest := durations[tablePhaseImport]
+	switch {
+	case encode >= delivery && encode >= ingest:
+		return BoundEncode
+	case delivery >= ingest:
+		return BoundDelivery
+	default:
+		return BoundIngest
+	}
+}
+
+func (b *phaseBreakdown) String() string {
+	durations, total := b.durations()
+	if total == 0 {
+		return "nothing recorded"
+	}
+	parts := make([]string, 0, numTablePhases)
+	for phase, d := range durations {
+		parts = append(parts, fmt.Sprintf("%s %v (%.1f%%)", tablePhaseNames[phase], d.Round(time.Millisecond), float64(d)/float64(total)*100))
+	}
+	return strings.Join(parts, ", ") + ", " + b.bound()
+}
+
+// exportMetrics adds the time of each phase to TablePhaseSecondsCounter.
+func (b *phaseBreakdown) exportMetrics(tableName string) {
+	durations, _ := b.durations()
+	for phase, d := range durations {
+		metric.TablePhaseSecondsCounter.WithLabelValues(tablePhaseNames[phase], metric.TableLabel(tableName)).Add(d.Seconds())
+	}
+}
+
+// observeEngine records the time an engine spent in a step, and the speed
+// of writing or importing its KV pairs.
+func observeEngine(step string, kvBytes uint64, d time.Duration) {
+	metric.EngineSecondsHistogram.WithLabelValues(step).Observe(d.Seconds())
+	if step != metric.EngineStepClose && d > 0 {
+		metric.EngineSpeedHistogram.WithLabelValues(step).Observe(float64(kvBytes) / d.Seconds())
+	}
+}
+
+// engineKVSize is the size of the KV pairs written into the engine by all
+// runs.
+func engineKVSize(cp *EngineCheckpoint) uint64 {
+	var size uint64
+	for _, chunk := range cp.Chunks {
+		size += chunk.Checksum.SumSize()
+	}
+	return size
+}
@@ -0,0 +1,771 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/charset"
+	"github.com/pingcap/parser/model"
+	tmysql "github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb/ddl"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/mock"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/config"
+)
+
+var (
+	requiredTiDBVersion = *semver.New("2.1.0")
+	requiredPDVersion   = *semver.New("2.1.0")
+	requiredTiKVVersion = *semver.New("2.1.0")
+)
+
+const (
+	// the region distribution is considered unhealthy if the store with the
+	// fewest regions has less than half of the regions of the store with the
+	// most regions, and the difference exceeds this number.
+	regionCountTolerance = 1000
+)
+
+// PreCheckResult is the outcome of a single pre-check.
+type PreCheckResult struct {
+	Name    string `json:"name"`
+	Level   string `json:"level"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+type preCheck struct {
+	name  string
+	level string
+	check func(ctx context.Context) error
+}
+
+// checkRequirements runs the pre-checks before restoring the schemas, and logs
+// the report. Returns an error if any strict check failed.
+func (rc *RestoreController) checkRequirements(ctx context.Context) error {
+	// skip requirement check if explicitly turned off
+	if !rc.cfg.App.CheckRequirements {
+		return nil
+	}
+
+	levels := &rc.cfg.PreCheck
+	return rc.runPreChecks(ctx, []preCheck{
+		{name: "version", level: levels.Version, check: rc.checkClusterVersion},
+		{name: "importer", level: levels.Importer, check: rc.checkImporter},
+		{name: "source-files", level: levels.SourceFiles, check: rc.checkSourceFiles},
+		{name: "schema", level: levels.Schema, check: rc.checkSchema},
+		{name: "free-space", level: levels.FreeSpace, check: rc.checkFreeSpace},
+		{name: "region-distribution", level: levels.RegionDistribution, check: rc.checkRegionDistribution},
+	})
+}
+
+// checkResumeRequirements runs the pre-checks reading the checkpoints, after
+// the checkpoints are initialized.
+func (rc *RestoreController) checkResumeRequirements(ctx context.Context) error {
+	if !rc.cfg.App.CheckRequirements {
+		return nil
+	}
+
+	levels := &rc.cfg.PreCheck
+	return rc.runPreChecks(ctx, []preCheck{
+		{name: "checkpoints", level: levels.Checkpoints, check: rc.checkCheckpoints},
+		{name: "cluster-empty", level: levels.ClusterEmpty, check: rc.checkClusterEmpty},
+	})
+}
+
+// runPreChecks runs the checks, logs the report and adds the results to those
+// reported by the status. Returns an error if any strict check failed.
+func (rc *RestoreController) runPreChecks(ctx context.Context, checks []preCheck) error {
+	var failed []string
+	results := make([]*PreCheckResult, 0, len(checks))
+	for _, c := range checks {
+		if c.level == config.CheckLevelOff {
+			continue
+		}
+		result := &PreCheckResult{Name: c.name, Level: c.level, Passed: true}
+		if err := c.check(ctx); err != nil {
+			if common.IsContextCanceledError(err) {
+				return errors.Trace(err)
+			}
+			result.Passed = false
+			result.Message = err.Error()
+			if c.level == config.CheckLevelStrict {
+				failed = append(failed, c.name)
+			}
+		}
+		results = append(results, result)
+	}
+
+	common.AppLogger.Info("[pre-check] report:")
+	for _, result := range results {
+		switch {
+		case result.Passed:
+			common.AppLogger.Infof("[pre-check] %-20s passed", result.Name)
+		case result.Level == config.CheckLevelWarn:
+			common.AppLogger.Warnf("[pre-check] %-20s failed (ignored): %s", result.Name, result.Message)
+		default:
+			common.AppLogger.Errorf("[pre-check] %-20s failed: %s", result.Name, result.Message)
+		}
+	}
+	rc.preCheckLock.Lock()
+	rc.preCheckResults = append(rc.preCheckResults, results...)
+	rc.preCheckLock.Unlock()
+
+	if len(failed) > 0 {
+		return errors.Errorf("pre-check failed: %s (set the level to 'warn' or 'off' in [pre-check] to skip)", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// preCheckReport returns the results of the pre-checks run so far.
+func (rc *RestoreController) preCheckReport() []*PreCheckResult {
+	rc.preCheckLock.Lock()
+	defer rc.preCheckLock.Unlock()
+	return append([]*PreCheckResult(nil), rc.preCheckResults...)
+}
+
+func (rc *RestoreController) checkClusterVersion(context.Context) error {
+	client := rc.tls.HTTPClient()
+	if err := rc.checkTiDBVersion(client); err != nil {
+		return errors.Trace(err)
+	}
+	if err := rc.checkPDVersion(client); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(rc.checkTiKVVersion(client))
+}
+
+func (rc *RestoreController) checkImporter(ctx context.Context) error {
+	return errors.Trace(rc.importer.CheckRequirements(ctx))
+}
+
+func checkFileReadable(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer file.Close()
+	var buf [1]byte
+	if _, err := file.Read(buf[:]); err != nil && err != io.EOF {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (rc *RestoreController) checkSourceFiles(context.Context) error {
+	var unreadable []string
+	check := func(path string) {
+		if len(path) == 0 {
+			return
+		}
+		if err := checkFileReadable(path); err != nil {
+			unreadable = append(unreadable, err.Error())
+		}
+	}
+
+	for _, dbMeta := range rc.dbMetas {
+		check(dbMeta.SchemaFile)
+		for _, tableMeta := range dbMeta.Tables {
+			check(tableMeta.SchemaFile)
+			for _, path := range tableMeta.DataFiles {
+				check(path)
+			}
+		}
+	}
+
+	if len(unreadable) > 0 {
+		return errors.Errorf("cannot read source files: %s", strings.Join(unreadable, "; "))
+	}
+	return nil
+}
+
+// existingCheckpoint returns the checkpoint of the table if the table has been
+// (partially) imported before, or nil if the table is new.
+func (rc *RestoreController) existingCheckpoint(ctx context.Context, tableName string) (*TableCheckpoint, error) {
+	if !rc.cfg.Checkpoint.Enable {
+		return nil, nil
+	}
+	cp, err := rc.checkpointsDB.Get(ctx, tableName)
+	switch {
+	case isCheckpointNotFound(err):
+		return nil, nil
+	case err != nil:
+		return nil, errors.Trace(err)
+	case len(cp.Engines) == 0 && cp.Status == CheckpointStatusLoaded:
+		return nil, nil
+	default:
+		return cp, nil
+	}
+}
+
+func (rc *RestoreController) checkCheckpoints(ctx context.Context) error {
+	var problems []string
+	for _, dbMeta := range rc.dbMetas {
+		for _, tableMeta := range dbMeta.Tables {
+			tableName := common.UniqueTable(dbMeta.Name, tableMeta.Name)
+			cp, err := rc.existingCheckpoint(ctx, tableName)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if cp == nil {
+				continue
+			}
+			if cp.Status <= CheckpointStatusMaxInvalid {
+				problems = append(problems, fmt.Sprintf(
+					"checkpoint of %s has invalid status %d, use tidb-lightning-ctl --checkpoint-error-destroy or --checkpoint-error-ignore to clear it",
+					tableName, cp.Status,
+				))
+				continue
+			}
+			if cp.Status < CheckpointStatusAllWritten {
+				if err := verifyChunkSourceFiles(tableName, cp); err != nil {
+					problems = append(problems, err.Error())
+				}
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (rc *RestoreController) checkClusterEmpty(ctx context.Context) error {
+	if rc.cfg.App.Incremental {
+		return nil
+	}
+	var nonEmptyTables []string
+	for _, dbMeta := range rc.dbMetas {
+		for _, tableMeta := range dbMeta.Tables {
+			tableName := common.UniqueTable(dbMeta.Name, tableMeta.Name)
+			// resuming tables are expected to contain data.
+			cp, err := rc.existingCheckpoint(ctx, tableName)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if cp != nil {
+				continue
+			}
+
+			var dummy int
+			query := fmt.Sprintf("SELECT 1 FROM %s LIMIT 1", tableName)
+			err = rc.tidbMgr.db.QueryRowContext(ctx, query).Scan(&dummy)
+			switch {
+			case err == nil:
+				nonEmptyTables = append(nonEmptyTables, tableName)
+			case err == sql.ErrNoRows || isTableNotExistError(err):
+			default:
+				return errors.Annotatef(err, "cannot check whether %s is empty", tableName)
+			}
+		}
+	}
+
+	if len(nonEmptyTables) > 0 {
+		return errors.Errorf("target tables are not empty: %s", strings.Join(nonEmptyTables, ", "))
+	}
+	return nil
+}
+
+func isTableNotExistError(err error) bool {
+	if mysqlErr, ok := errors.Cause(err).(*mysql.MySQLError); ok {
+		return mysqlErr.Number == tmysql.ErrNoSuchTable || mysqlErr.Number == tmysql.ErrBadDB
+	}
+	return false
+}
+
+// checkSchema compares the target tables which already exist with the schema
+// files, so the data are not imported into a table of a different structure,
+// which would only be found at the checksum.
+func (rc *RestoreController) checkSchema(ctx context.Context) error {
+	if rc.cfg.Mydumper.NoSchema {
+		return nil
+	}
+	var problems []string
+	for _, dbMeta := range rc.dbMetas {
+		for _, tableMeta := range dbMeta.Tables {
+			if len(tableMeta.SchemaFile) == 0 {
+				continue
+			}
+			tableName := common.UniqueTable(dbMeta.Name, tableMeta.Name)
+			targetSchema, err := rc.tidbMgr.getCreateTableStmt(ctx, dbMeta.Name, tableMeta.Name)
+			switch {
+			case isTableNotExistError(err):
+				continue
+			case err != nil:
+				return errors.Annotatef(err, "cannot read the schema of %s", tableName)
+			}
+
+			incompatible, compatible, err := diffTableSchema(tableMeta.GetSchema(), targetSchema)
+			if err != nil {
+				common.TableLogger(tableName).Warnf("cannot compare the table with the schema file: %s", err)
+				continue
+			}
+			for _, diff := range compatible {
+				common.TableLogger(tableName).Warnf("the table differs from the schema file compatibly: %s", diff)
+			}
+			for _, diff := range incompatible {
+				problems = append(problems, fmt.Sprintf("%s: %s", tableName, diff))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("target tables differ from the schema files: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// schemaInfo is a parsed CREATE TABLE statement.
+type schemaInfo struct {
+	*model.TableInfo
+	// the charset of each column as declared, or the default charset of the
+	// table, empty if neither is specified.
+	charsets []string
+}
+
+func parseSchemaInfo(createTable string) (*schemaInfo, error) {
+	stmt, err := parser.New().ParseOneStmt(createTable, "", "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	createTableStmt, ok := stmt.(*ast.CreateTableStmt)
+	if !ok {
+		return nil, errors.Errorf("not a CREATE TABLE statement: %s", createTable)
+	}
+
+	var tableCharset string
+	for _, opt := range createTableStmt.Options {
+		if opt.Tp == ast.TableOptionCharset {
+			tableCharset = strings.ToLower(opt.StrValue)
+		}
+	}
+	// MockTableInfo fills the unspecified charsets with the default one, so
+	// they are taken before it.
+	charsets := make([]string, 0, len(createTableStmt.Cols))
+	for _, col := range createTableStmt.Cols {
+		cs := strings.ToLower(col.Tp.Charset)
+		if len(cs) == 0 {
+			cs = tableCharset
+		}
+		charsets = append(charsets, cs)
+	}
+
+	tbl, err := ddl.MockTableInfo(mock.NewContext(), createTableStmt, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &schemaInfo{TableInfo: tbl, charsets: charsets}, nil
+}
+
+// diffTableSchema compares the CREATE TABLE statement of the target table with
+// the one of the schema file. The incompatible differences would change the
+// imported data or fail the import, while the compatible ones, e.g. a wider
+// column or an extra non-unique index, are harmless.
+func diffTableSchema(sourceSchema, targetSchema string) (incompatible []string, compatible []string, err error) {
+	source, err := parseSchemaInfo(sourceSchema)
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "cannot parse the schema file")
+	}
+	target, err := parseSchemaInfo(targetSchema)
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "cannot parse the schema of the table")
+	}
+
+	targetColumns := make(map[string]*model.ColumnInfo, len(target.Columns))
+	for _, col := range target.Columns {
+		targetColumns[col.Name.L] = col
+	}
+	for _, col := range source.Columns {
+		targetCol, ok := targetColumns[col.Name.L]
+		if !ok {
+			incompatible = append(incompatible, fmt.Sprintf("column %s is missing in the table", col.Name.O))
+			continue
+		}
+		delete(targetColumns, col.Name.L)
+		if targetCol.Offset != col.Offset {
+			incompatible = append(incompatible, fmt.Sprintf(
+				"column %s is column %d in the schema file, but column %d in the table",
+				col.Name.O, col.Offset+1, targetCol.Offset+1,
+			))
+		}
+		inc, comp := diffColumn(col, targetCol, source.charsets[col.Offset], target.charsets[targetCol.Offset])
+		incompatible = append(incompatible, inc...)
+		compatible = append(compatible, comp...)
+	}
+	for _, col := range target.Columns {
+		if _, ok := targetColumns[col.Name.L]; ok {
+			incompatible = append(incompatible, fmt.Sprintf("column %s is not in the schema file", col.Name.O))
+		}
+	}
+
+	sourceKeys, targetKeys := tableKeys(source.TableInfo), tableKeys(target.TableInfo)
+	for _, key := range sortedKeys(sourceKeys) {
+		if _, ok := targetKeys[key]; ok {
+			continue
+		}
+		diff := fmt.Sprintf("%s is missing in the table", key)
+		if sourceKeys[key] {
+			incompatible = append(incompatible, diff)
+		} else {
+			compatible = append(compatible, diff)
+		}
+	}
+	for _, key := range sortedKeys(targetKeys) {
+		if _, ok := sourceKeys[key]; ok {
+			continue
+		}
+		diff := fmt.Sprintf("%s is not in the schema file", key)
+		if targetKeys[key] {
+			incompatible = append(incompatible, diff)
+		} else {
+			compatible = append(compatible, diff)
+		}
+	}
+	return incompatible, compatible, nil
+}
+
+func diffColumn(source, target *model.ColumnInfo, sourceCharset, targetCharset string) (incompatible []string, compatible []string) {
+	sourceType, targetType := source.InfoSchemaStr(), target.InfoSchemaStr()
+	switch {
+	case source.Tp != target.Tp ||
+		tmysql.HasUnsignedFlag(source.Flag) != tmysql.HasUnsignedFlag(target.Flag) ||
+		!equalStrings(source.Elems, target.Elems):
+		incompatible = append(incompatible, fmt.Sprintf(
+			"column %s is %s in the schema file, but %s in the table", source.Name.O, sourceType, targetType,
+		))
+	case tmysql.IsIntegerType(source.Tp):
+		// the display width does not affect the data.
+	case source.Decimal != target.Decimal || source.Flen > target.Flen:
+		incompatible = append(incompatible, fmt.Sprintf(
+			"column %s is %s in the schema file, but %s in the table", source.Name.O, sourceType, targetType,
+		))
+	case source.Flen < target.Flen:
+		compatible = append(compatible, fmt.Sprintf(
+			"column %s is widened from %s to %s", source.Name.O, sourceType, targetType,
+		))
+	}
+
+	if isTextColumn(source) && len(sourceCharset) > 0 && len(targetCharset) > 0 && sourceCharset != targetCharset {
+		diff := fmt.Sprintf(
+			"column %s is in charset %s in the schema file, but %s in the table", source.Name.O, sourceCharset, targetCharset,
+		)
+		// utf8mb4 is a superset of utf8.
+		if sourceCharset == charset.CharsetUTF8 && targetCharset == charset.CharsetUTF8MB4 {
+			compatible = append(compatible, diff)
+		} else {
+			incompatible = append(incompatible, diff)
+		}
+	}
+
+	sourceNotNull, targetNotNull := tmysql.HasNotNullFlag(source.Flag), tmysql.HasNotNullFlag(target.Flag)
+	switch {
+	case !sourceNotNull && targetNotNull:
+		incompatible = append(incompatible, fmt.Sprintf("column %s is nullable in the schema file, but NOT NULL in the table", source.Name.O))
+	case sourceNotNull && !targetNotNull:
+		compatible = append(compatible, fmt.Sprintf("column %s is NOT NULL in the schema file, but nullable in the table", source.Name.O))
+	}
+
+	if source.IsGenerated() != target.IsGenerated() {
+		incompatible = append(incompatible, fmt.Sprintf("column %s is generated in only one of the schema file and the table", source.Name.O))
+	}
+	return incompatible, compatible
+}
+
+// isTextColumn returns whether the charset applies to the column.
+func isTextColumn(col *model.ColumnInfo) bool {
+	return col.Charset != charset.CharsetBin && (types.IsString(col.Tp) || col.Tp == tmysql.TypeEnum || col.Tp == tmysql.TypeSet)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// tableKeys describes the keys of the table by their columns, ignoring the
+// names, and whether each of them is unique.
+func tableKeys(tbl *model.TableInfo) map[string]bool {
+	keys := make(map[string]bool, len(tbl.Indices)+1)
+	if tbl.PKIsHandle {
+		if pk := tbl.GetPkColInfo(); pk != nil {
+			keys[fmt.Sprintf("PRIMARY KEY (%s)", pk.Name.O)] = true
+		}
+	}
+	for _, idx := range tbl.Indices {
+		columns := make([]string, 0, len(idx.Columns))
+		for _, col := range idx.Columns {
+			if col.Length != types.UnspecifiedLength {
+				columns = append(columns, fmt.Sprintf("%s(%d)", col.Name.O, col.Length))
+			} else {
+				columns = append(columns, col.Name.O)
+			}
+		}
+		kind := "KEY"
+		switch {
+		case idx.Primary:
+			kind = "PRIMARY KEY"
+		case idx.Unique:
+			kind = "UNIQUE KEY"
+		}
+		keys[fmt.Sprintf("%s (%s)", kind, strings.Join(columns, ", "))] = idx.Unique
+	}
+	return keys
+}
+
+func sortedKeys(keys map[string]bool) []string {
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+type pdStoresInfo struct {
+	Stores []struct {
+		Store struct {
+			Address   string `json:"address"`
+			StateName string `json:"state_name"`
+		} `json:"store"`
+		Status struct {
+			Capacity    string `json:"capacity"`
+			Available   string `json:"available"`
+			RegionCount int    `json:"region_count"`
+		} `json:"status"`
+	} `json:"stores"`
+}
+
+func (rc *RestoreController) getStoresInfo(client *http.Client) (*pdStoresInfo, error) {
+	var stores pdStoresInfo
+	url := rc.tls.URL(rc.cfg.TiDB.PdAddr, "/pd/api/v1/stores")
+	err := common.GetJSON(client, url, &stores)
+	return &stores, errors.Trace(err)
+}
+
+var byteSizeRegexp = regexp.MustCompile(`^([0-9.]+)\s*([KMGTPE]?)i?B?$`)
+
+// parseByteSize parses the human-readable sizes reported by PD, e.g.
+// "1.819TiB" or "512MiB".
+func parseByteSize(s string) (int64, error) {
+	match := byteSizeRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0, errors.Errorf("invalid size %q", s)
+	}
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	unit := float64(1)
+	for _, prefix := range "KMGTPE" {
+		unit *= 1024
+		if match[2] == string(prefix) {
+			return int64(value * unit), nil
+		}
+	}
+	return int64(value), nil
+}
+
+func (rc *RestoreController) checkFreeSpace(context.Context) error {
+	client := rc.tls.HTTPClient()
+	stores, err := rc.getStoresInfo(client)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var replicate struct {
+		MaxReplicas int64 `json:"max-replicas"`
+	}
+	url := rc.tls.URL(rc.cfg.TiDB.PdAddr, "/pd/api/v1/config/replicate")
+	if err := common.GetJSON(client, url, &replicate); err != nil {
+		return errors.Trace(err)
+	}
+	if replicate.MaxReplicas <= 0 {
+		replicate.MaxReplicas = 1
+	}
+
+	var available int64
+	for _, store := range stores.Stores {
+		size, err := parseByteSize(store.Status.Available)
+		if err != nil {
+			return errors.Annotatef(err, "TiKV (at %s)", store.Store.Address)
+		}
+		available += size
+	}
+
+	var sourceSize int64
+	for _, dbMeta := range rc.dbMetas {
+		for _, tableMeta := range dbMeta.Tables {
+			sourceSize += tableMeta.TotalSize
+		}
+	}
+	required := sourceSize * replicate.MaxReplicas
+
+	if available < required {
+		return errors.Errorf(
+			"TiKV stores have %d bytes available in total, but about %d bytes are required (source size %d bytes x %d replicas)",
+			available, required, sourceSize, replicate.MaxReplicas,
+		)
+	}
+	return nil
+}
+
+func (rc *RestoreController) checkRegionDistribution(context.Context) error {
+	stores, err := rc.getStoresInfo(rc.tls.HTTPClient())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var problems []string
+	minCount, maxCount := -1, 0
+	for _, store := range stores.Stores {
+		if store.Store.StateName != "Up" {
+			problems = append(problems, fmt.Sprintf("TiKV (at %s) is %s", store.Store.Address, store.Store.StateName))
+			continue
+		}
+		count := store.Status.RegionCount
+		if minCount < 0 || count < minCount {
+			minCount = count
+		}
+		if count > maxCount {
+			maxCount = count
+		}
+	}
+	if minCount >= 0 && minCount < maxCount/2 && maxCount-minCount > regionCountTolerance {
+		problems = append(problems, fmt.Sprintf("regions are unevenly distributed among TiKV stores (min %d, max %d)", minCount, maxCount))
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func extractTiDBVersion(version string) (*semver.Version, error) {
+	// version format: "5.7.10-TiDB-v2.1.0-rc.1-7-g38c939f"
+	//                               ^~~~~~~~~^ we only want this part
+	// version format: "5.7.10-TiDB-v2.0.4-1-g06a0bf5"
+	//                               ^~~~^
+	// version format: "5.7.10-TiDB-v2.0.7"
+	//                               ^~~~^
+	// The version is generated by `git describe --tags` on the TiDB repository.
+	versions := strings.Split(version, "-")
+	end := len(versions)
+	switch end {
+	case 3, 4:
+	case 5, 6:
+		end -= 2
+	default:
+		return nil, errors.Errorf("not a valid TiDB version: %s", version)
+	}
+	rawVersion := strings.Join(versions[2:end], "-")
+	rawVersion = strings.TrimPrefix(rawVersion, "v")
+	return semver.NewVersion(rawVersion)
+}
+
+func (rc *RestoreController) checkTiDBVersion(client *http.Client) error {
+	url := rc.tls.URL(fmt.Sprintf("%s:%d", rc.cfg.TiDB.Host, rc.cfg.TiDB.StatusPort), "/status")
+	var status struct{ Version string }
+	err := common.GetJSON(client, url, &status)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	version, err := extractTiDBVersion(status.Version)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return checkVersion("TiDB", requiredTiDBVersion, *version)
+}
+
+func (rc *RestoreController) checkPDVersion(client *http.Client) error {
+	url := rc.tls.URL(rc.cfg.TiDB.PdAddr, "/pd/api/v1/config/cluster-version")
+	var rawVersion string
+	err := common.GetJSON(client, url, &rawVersion)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	version, err := semver.NewVersion(rawVersion)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return checkVersion("PD", requiredPDVersion, *version)
+}
+
+func (rc *RestoreController) checkTiKVVersion(client *http.Client) error {
+	url := rc.tls.URL(rc.cfg.TiDB.PdAddr, "/pd/api/v1/stores")
+
+	var stores struct {
+		Stores []struct {
+			Store struct {
+				Address string
+				Version string
+			}
+		}
+	}
+	err := common.GetJSON(client, url, &stores)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, store := range stores.Stores {
+		version, err := semver.NewVersion(store.Store.Version)
+		if err != nil {
+			return errors.Annotate(err, store.Store.Address)
+		}
+		component := fmt.Sprintf("TiKV (at %s)", store.Store.Address)
+		err = checkVersion(component, requiredTiKVVersion, *version)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func checkVersion(component string, expected, actual semver.Version) error {
+	if actual.Compare(expected) >= 0 {
+		return nil
+	}
+	return errors.Errorf(
+		"%s version too old, expected '>=%s', found '%s'",
+		component,
+		expected,
+		actual,
+	)
+}
@@ -0,0 +1,188 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+
+	. "github.com/pingcap/check"
+
+	"github.com/pingcap/tidb-lightning/lightning/config"
+	"github.com/pingcap/tidb-lightning/lightning/mydump"
+)
+
+var _ = Suite(&checkSuite{})
+
+type checkSuite struct{}
+
+func (s *checkSuite) TestParseByteSize(c *C) {
+	testCases := []struct {
+		input    string
+		expected int64
+	}{
+		{"0B", 0},
+		{"512", 512},
+		{"1KiB", 1024},
+		{"1.5MiB", 1572864},
+		{"2 GiB", 2 << 30},
+		{"1TiB", 1 << 40},
+	}
+	for _, tc := range testCases {
+		size, err := parseByteSize(tc.input)
+		c.Assert(err, IsNil, Commentf("input = %s", tc.input))
+		c.Assert(size, Equals, tc.expected, Commentf("input = %s", tc.input))
+	}
+
+	_, err := parseByteSize("many bytes")
+	c.Assert(err, ErrorMatches, `invalid size "many bytes"`)
+}
+
+func (s *checkSuite) TestCheckSourceFiles(c *C) {
+	dir := c.MkDir()
+	existing := filepath.Join(dir, "db.t.sql")
+	c.Assert(ioutil.WriteFile(existing, []byte("INSERT INTO t VALUES (1);"), 0644), IsNil)
+
+	rc := &RestoreController{
+		dbMetas: []*mydump.MDDatabaseMeta{{
+			Name: "db",
+			Tables: []*mydump.MDTableMeta{{
+				DB:        "db",
+				Name:      "t",
+				DataFiles: []string{existing},
+			}},
+		}},
+	}
+	c.Assert(rc.checkSourceFiles(context.Background()), IsNil)
+
+	rc.dbMetas[0].Tables[0].DataFiles = append(rc.dbMetas[0].Tables[0].DataFiles, filepath.Join(dir, "db.t.2.sql"))
+	c.Assert(rc.checkSourceFiles(context.Background()), ErrorMatches, "cannot read source files: .*db.t.2.sql.*")
+}
+
+func (s *checkSuite) TestCheckRegionDistribution(c *C) {
+	stores := `{"stores": [
+		{"store": {"address": "tikv1:20160", "state_name": "Up"}, "status": {"region_count": 3000}},
+		{"store": {"address": "tikv2:20160", "state_name": "Up"}, "status": {"region_count": 2900}},
+		{"store": {"address": "tikv3:20160", "state_name": "Up"}, "status": {"region_count": 3100}}
+	]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(req.URL.Path, Equals, "/pd/api/v1/stores")
+		w.Write([]byte(stores))
+	}))
+	defer server.Close()
+
+	cfg := config.NewConfig()
+	cfg.TiDB.PdAddr = strings.TrimPrefix(server.URL, "http://")
+	tls, err := cfg.Security.ToTLS()
+	c.Assert(err, IsNil)
+	rc := &RestoreController{cfg: cfg, tls: tls}
+	c.Assert(rc.checkRegionDistribution(context.Background()), IsNil)
+
+	stores = `{"stores": [
+		{"store": {"address": "tikv1:20160", "state_name": "Up"}, "status": {"region_count": 3000}},
+		{"store": {"address": "tikv2:20160", "state_name": "Up"}, "status": {"region_count": 100}},
+		{"store": {"address": "tikv3:20160", "state_name": "Offline"}, "status": {"region_count": 3100}}
+	]}`
+	c.Assert(rc.checkRegionDistribution(context.Background()), ErrorMatches,
+		`TiKV \(at tikv3:20160\) is Offline; regions are unevenly distributed among TiKV stores \(min 100, max 3000\)`)
+}
+
+func (s *checkSuite) TestDiffTableSchema(c *C) {
+	source := "CREATE TABLE `t` (" +
+		"`id` INT PRIMARY KEY, " +
+		"`name` VARCHAR(16) CHARACTER SET utf8 NOT NULL, " +
+		"`price` DECIMAL(10, 2), " +
+		"`kind` ENUM('a', 'b'), " +
+		"UNIQUE KEY `uk` (`name`), " +
+		"KEY `k` (`price`)" +
+		") DEFAULT CHARSET=latin1"
+
+	testCases := []struct {
+		target       string
+		incompatible []string
+		compatible   []string
+	}{
+		{
+			target: "CREATE TABLE `t` (" +
+				"`id` int(10) NOT NULL, " +
+				"`name` varchar(16) CHARACTER SET utf8 NOT NULL, " +
+				"`price` decimal(10,2) DEFAULT NULL, " +
+				"`kind` enum('a','b') DEFAULT NULL, " +
+				"PRIMARY KEY (`id`), " +
+				"UNIQUE KEY `name` (`name`), " +
+				"KEY `price` (`price`)" +
+				") ENGINE=InnoDB DEFAULT CHARSET=latin1",
+		},
+		{
+			target: "CREATE TABLE `t` (" +
+				"`id` int(11) NOT NULL, " +
+				"`name` varchar(32) CHARACTER SET utf8mb4, " +
+				"`price` decimal(12,2) DEFAULT NULL, " +
+				"`kind` enum('a','b') DEFAULT NULL, " +
+				"PRIMARY KEY (`id`), " +
+				"UNIQUE KEY `uk` (`name`), " +
+				"KEY `k2` (`kind`)" +
+				") DEFAULT CHARSET=latin1",
+			compatible: []string{
+				"column name is widened from varchar(16) to varchar(32)",
+				"column name is in charset utf8 in the schema file, but utf8mb4 in the table",
+				"column name is NOT NULL in the schema file, but nullable in the table",
+				"column price is widened from decimal(10,2) to decimal(12,2)",
+				"KEY (price) is missing in the table",
+				"KEY (kind) is not in the schema file",
+			},
+		},
+		{
+			target: "CREATE TABLE `t` (" +
+				"`id` bigint NOT NULL, " +
+				"`price` decimal(10,3) NOT NULL, " +
+				"`name` varchar(8) CHARACTER SET utf8 NOT NULL, " +
+				"`kind` enum('a','b','c'), " +
+				"`extra` int, " +
+				"UNIQUE KEY (`name`, `kind`)" +
+				") DEFAULT CHARSET=utf8mb4",
+			incompatible: []string{
+				"column id is int(11) in the schema file, but bigint(20) in the table",
+				"column name is column 2 in the schema file, but column 3 in the table",
+				"column name is varchar(16) in the schema file, but varchar(8) in the table",
+				"column price is column 3 in the schema file, but column 2 in the table",
+				"column price is decimal(10,2) in the schema file, but decimal(10,3) in the table",
+				"column price is nullable in the schema file, but NOT NULL in the table",
+				"column kind is enum('a','b') in the schema file, but enum('a','b','c') in the table",
+				"column kind is in charset latin1 in the schema file, but utf8mb4 in the table",
+				"column extra is not in the schema file",
+				"PRIMARY KEY (id) is missing in the table",
+				"UNIQUE KEY (name) is missing in the table",
+				"UNIQUE KEY (name, kind) is not in the schema file",
+			},
+			compatible: []string{
+				"KEY (price) is missing in the table",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		incompatible, compatible, err := diffTableSchema(source, tc.target)
+		c.Assert(err, IsNil)
+		c.Assert(incompatible, DeepEquals, tc.incompatible, Commentf("target: %s", tc.target))
+		c.Assert(compatible, DeepEquals, tc.compatible, Commentf("target: %s", tc.target))
+	}
+
+	_, _, err := diffTableSchema(source, "CREATE VIEW v AS SELECT 1")
+	c.Assert(err, ErrorMatches, "cannot parse the schema of the table.*")
+}
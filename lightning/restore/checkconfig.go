@@ -0,0 +1,248 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/config"
+	"github.com/pingcap/tidb-lightning/lightning/mydump"
+)
+
+// the time limit of each check of the `-check-config` mode, so that an
+// unreachable component does not block the others.
+const configCheckTimeout = 30 * time.Second
+
+// ConfigCheckResult is the outcome of a single check of the `-check-config`
+// mode.
+type ConfigCheckResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Skipped bool   `json:"skipped"`
+	Message string `json:"message,omitempty"`
+}
+
+type configCheck struct {
+	name string
+	// check returns the description of what has been verified, or an empty
+	// string if the check does not apply to the config.
+	check func(ctx context.Context, cfg *config.Config) (string, error)
+}
+
+var configChecks = []configCheck{
+	{name: "data-source", check: checkConfigDataSource},
+	{name: "tidb", check: checkConfigTiDB},
+	{name: "tidb-status", check: checkConfigTiDBStatus},
+	{name: "pd", check: checkConfigPD},
+	{name: "importer", check: checkConfigImporter},
+	{name: "checkpoint", check: checkConfigCheckpoint},
+}
+
+// CheckConfig verifies the config, which has been parsed and validated, by
+// resolving the data source and connecting to every component it refers to.
+// Nothing is written into the cluster. The report is logged and printed to
+// stdout. Returns an error if any check failed.
+func CheckConfig(ctx context.Context, cfg *config.Config) error {
+	var failed []string
+	results := make([]*ConfigCheckResult, 0, len(configChecks))
+	for _, c := range configChecks {
+		checkCtx, cancel := context.WithTimeout(ctx, configCheckTimeout)
+		message, err := c.check(checkCtx, cfg)
+		cancel()
+		if ctx.Err() != nil {
+			return errors.Trace(ctx.Err())
+		}
+
+		result := &ConfigCheckResult{Name: c.name, Passed: err == nil, Message: message}
+		switch {
+		case err != nil:
+			result.Message = err.Error()
+			failed = append(failed, c.name)
+			common.AppLogger.Errorf("[check-config] %-12s failed: %s", c.name, result.Message)
+		case len(message) == 0:
+			result.Skipped = true
+			common.AppLogger.Infof("[check-config] %-12s skipped", c.name)
+		default:
+			common.AppLogger.Infof("[check-config] %-12s passed: %s", c.name, message)
+		}
+		results = append(results, result)
+	}
+
+	writeConfigCheckReport(os.Stdout, results)
+
+	if len(failed) > 0 {
+		return errors.Errorf("config check failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func checkConfigDataSource(_ context.Context, cfg *config.Config) (string, error) {
+	dir, err := filepath.Abs(cfg.Mydumper.SourceDir)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	mdl, err := mydump.NewMyDumpLoader(cfg)
+	if err != nil {
+		return "", errors.Annotatef(err, "cannot load the data source %s", dir)
+	}
+	dbMetas := mdl.GetDatabases()
+	tables, files := 0, 0
+	for _, dbMeta := range dbMetas {
+		tables += len(dbMeta.Tables)
+		for _, tableMeta := range dbMeta.Tables {
+			files += len(tableMeta.DataFiles)
+		}
+	}
+	return fmt.Sprintf("%s: %d databases, %d tables, %d data files", dir, len(dbMetas), tables, files), nil
+}
+
+func checkConfigTiDB(ctx context.Context, cfg *config.Config) (string, error) {
+	tls, err := cfg.Security.ToTLS()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	tidbMgr, err := NewTiDBManager(cfg.TiDB, tls)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer tidbMgr.Close()
+
+	var version string
+	if err := tidbMgr.db.QueryRowContext(ctx, "SELECT version()").Scan(&version); err != nil {
+		return "", errors.Annotatef(err, "cannot query %s:%d", cfg.TiDB.Host, cfg.TiDB.Port)
+	}
+	return fmt.Sprintf("%s:%d, version %s", cfg.TiDB.Host, cfg.TiDB.Port, version), nil
+}
+
+func checkConfigTiDBStatus(_ context.Context, cfg *config.Config) (string, error) {
+	tls, err := cfg.Security.ToTLS()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	addr := fmt.Sprintf("%s:%d", cfg.TiDB.Host, cfg.TiDB.StatusPort)
+	var status struct{ Version string }
+	if err := common.GetJSON(tls.HTTPClient(), tls.URL(addr, "/status"), &status); err != nil {
+		return "", errors.Annotatef(err, "cannot read the status of TiDB at %s", addr)
+	}
+	return addr, nil
+}
+
+func checkConfigPD(_ context.Context, cfg *config.Config) (string, error) {
+	if cfg.TikvImporter.Backend == config.BackendTiDB && !cfg.Coordination.Enable && cfg.Checkpoint.Driver != "etcd" {
+		// PD is not used when writing through TiDB.
+		return "", nil
+	}
+	tls, err := cfg.Security.ToTLS()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	var version string
+	if err := common.GetJSON(tls.HTTPClient(), tls.URL(cfg.TiDB.PdAddr, "/pd/api/v1/config/cluster-version"), &version); err != nil {
+		return "", errors.Annotatef(err, "cannot reach PD at %s", cfg.TiDB.PdAddr)
+	}
+	return fmt.Sprintf("%s, cluster version %s", cfg.TiDB.PdAddr, version), nil
+}
+
+func checkConfigImporter(ctx context.Context, cfg *config.Config) (string, error) {
+	importer, err := NewImporter(ctx, cfg)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer importer.Close()
+	if err := importer.CheckRequirements(ctx); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	switch cfg.TikvImporter.Backend {
+	case config.BackendLocal:
+		return fmt.Sprintf("local backend, sorted-kv-dir %s", cfg.TikvImporter.SortedKVDir), nil
+	case config.BackendTiDB:
+		return "tidb backend", nil
+	default:
+		return fmt.Sprintf("importer backend, %s", cfg.TikvImporter.Addr), nil
+	}
+}
+
+// checkConfigCheckpoint verifies the checkpoint storage is reachable, without
+// creating the checkpoint schema or file.
+func checkConfigCheckpoint(ctx context.Context, cfg *config.Config) (string, error) {
+	if !cfg.Checkpoint.Enable {
+		return "", nil
+	}
+
+	switch cfg.Checkpoint.Driver {
+	case "mysql":
+		db, err := sql.Open("mysql", cfg.Checkpoint.DSN)
+		if err != nil {
+			return "", errors.Annotate(err, "invalid `checkpoint.dsn`")
+		}
+		defer db.Close()
+		if err := db.PingContext(ctx); err != nil {
+			return "", errors.Annotate(err, "cannot connect to the checkpoint database")
+		}
+		return fmt.Sprintf("mysql, schema %s", cfg.Checkpoint.Schema), nil
+
+	case "file":
+		dir := filepath.Dir(cfg.Checkpoint.DSN)
+		file, err := ioutil.TempFile(dir, ".lightning-check-")
+		if err != nil {
+			return "", errors.Annotatef(err, "the directory of the checkpoint file %s is not writable", cfg.Checkpoint.DSN)
+		}
+		file.Close()
+		if err := os.Remove(file.Name()); err != nil {
+			return "", errors.Trace(err)
+		}
+		return fmt.Sprintf("file %s", cfg.Checkpoint.DSN), nil
+
+	case "etcd":
+		// opening the etcd checkpoints only reads them.
+		cpdb, err := OpenCheckpointsDB(ctx, cfg)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		cpdb.Close()
+		return fmt.Sprintf("etcd %s, task %s", common.RedactDSN(cfg.Checkpoint.DSN), cfg.Checkpoint.Schema), nil
+
+	default:
+		return "", errors.Errorf("unknown checkpoint driver %s", cfg.Checkpoint.Driver)
+	}
+}
+
+func writeConfigCheckReport(w io.Writer, results []*ConfigCheckResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tMESSAGE")
+	for _, result := range results {
+		status := "passed"
+		switch {
+		case !result.Passed:
+			status = "FAILED"
+		case result.Skipped:
+			status = "skipped"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", result.Name, status, result.Message)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/pingcap/check"
+
+	"github.com/pingcap/tidb-lightning/lightning/config"
+)
+
+var _ = Suite(&checkConfigSuite{})
+
+type checkConfigSuite struct{}
+
+func (s *checkConfigSuite) TestCheckConfigDataSource(c *C) {
+	dir := c.MkDir()
+	files := map[string]string{
+		"db-schema-create.sql": "CREATE DATABASE db;",
+		"db.t-schema.sql":      "CREATE TABLE t (a INT PRIMARY KEY);",
+		"db.t.sql":             "INSERT INTO t VALUES (1);",
+		"db.t.1.sql":           "INSERT INTO t VALUES (2);",
+	}
+	for name, content := range files {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), IsNil)
+	}
+
+	cfg := config.NewConfig()
+	cfg.Mydumper.SourceDir = dir
+	cfg.Mydumper.CharacterSet = "auto"
+	message, err := checkConfigDataSource(context.Background(), cfg)
+	c.Assert(err, IsNil)
+	c.Assert(message, Equals, dir+": 1 databases, 1 tables, 2 data files")
+
+	cfg.Mydumper.SourceDir = filepath.Join(dir, "not-exist")
+	_, err = checkConfigDataSource(context.Background(), cfg)
+	c.Assert(err, NotNil)
+}
+
+func (s *checkConfigSuite) TestCheckConfigCheckpoint(c *C) {
+	cfg := config.NewConfig()
+	cfg.Checkpoint.Enable = false
+	message, err := checkConfigCheckpoint(context.Background(), cfg)
+	c.Assert(err, IsNil)
+	c.Assert(message, Equals, "")
+
+	dir := c.MkDir()
+	cfg.Checkpoint.Enable = true
+	cfg.Checkpoint.Driver = "file"
+	cfg.Checkpoint.DSN = filepath.Join(dir, "cp.pb")
+	message, err = checkConfigCheckpoint(context.Background(), cfg)
+	c.Assert(err, IsNil)
+	c.Assert(message, Equals, "file "+cfg.Checkpoint.DSN)
+	// nothing is left behind.
+	entries, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+
+	cfg.Checkpoint.DSN = filepath.Join(dir, "not-exist", "cp.pb")
+	_, err = checkConfigCheckpoint(context.Background(), cfg)
+	c.Assert(err, ErrorMatches, "the directory of the checkpoint file .* is not writable.*")
+}
+
+func (s *checkConfigSuite) TestWriteConfigCheckReport(c *C) {
+	results := []*ConfigCheckResult{
+		{Name: "data-source", Passed: true, Message: "/data: 1 databases"},
+		{Name: "pd", Passed: true, Skipped: true},
+		{Name: "tidb", Message: "connection refused"},
+	}
+	var buf bytes.Buffer
+	writeConfigCheckReport(&buf, results)
+	c.Assert(buf.String(), Equals, ""+
+		"CHECK        RESULT   MESSAGE\n"+
+		"data-source  passed   /data: 1 databases\n"+
+		"pd           skipped  \n"+
+		"tidb         FAILED   connection refused\n")
+}
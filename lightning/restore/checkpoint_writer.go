@@ -0,0 +1,273 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/kv"
+	"github.com/pingcap/tidb-lightning/lightning/metric"
+)
+
+// the checkpoint updates are merged by this many goroutines, each buffering
+// the updates of its tables.
+const (
+	checkpointShardCount  = 8
+	checkpointShardBuffer = 64
+)
+
+type saveCp struct {
+	tableName string
+	merger    TableCheckpointMerger
+	// if waitCh is not nil, this is a barrier instead of an update, and the
+	// channel will be closed after all previous updates have been saved.
+	waitCh chan<- struct{}
+}
+
+func (rc *RestoreController) saveStatusCheckpoint(tableName string, engineID int, err error, statusIfSucceed CheckpointStatus) {
+	merger := &StatusCheckpointMerger{Status: statusIfSucceed, EngineID: engineID}
+
+	switch {
+	case err == nil:
+		break
+	case !common.IsContextCanceledError(err):
+		merger.SetInvalid()
+		rc.errorSummaries.record(tableName, err, statusIfSucceed)
+	default:
+		return
+	}
+
+	metric.RecordTableCount(statusIfSucceed.MetricName(), err)
+	rc.saveCheckpoint(saveCp{tableName: tableName, merger: merger})
+}
+
+// newCheckpointShards creates the channels the checkpoint updates are sent
+// through. Each is merged by its own goroutine, so the chunks of different
+// tables do not queue up behind each other.
+func newCheckpointShards(count int) []chan saveCp {
+	chs := make([]chan saveCp, count)
+	for i := range chs {
+		chs[i] = make(chan saveCp, checkpointShardBuffer)
+	}
+	return chs
+}
+
+// checkpointShard chooses the shard of the table. The updates of a table are
+// always sent through the same shard, so they are merged in order.
+func checkpointShard(tableName string, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(tableName))
+	return int(h.Sum32() % uint32(count))
+}
+
+// saveCheckpoint sends the checkpoint update of a table to be merged.
+func (rc *RestoreController) saveCheckpoint(scp saveCp) {
+	rc.saveCpChs[checkpointShard(scp.tableName, len(rc.saveCpChs))] <- scp
+}
+
+// sendCheckpoint is like saveCheckpoint, but gives up when the context is
+// canceled while the shard is full.
+func (rc *RestoreController) sendCheckpoint(ctx context.Context, scp saveCp) error {
+	select {
+	case rc.saveCpChs[checkpointShard(scp.tableName, len(rc.saveCpChs))] <- scp:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkpointMerger coalesces the updates received from a shard until they are
+// taken by the next write into the checkpoints database.
+type checkpointMerger struct {
+	lock     sync.Mutex
+	coalesed map[string]*TableCheckpointDiff
+	waiters  []chan<- struct{}
+}
+
+// take returns the coalesced updates and the barriers received so far.
+func (m *checkpointMerger) take() (map[string]*TableCheckpointDiff, []chan<- struct{}) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cpd, w := m.coalesed, m.waiters
+	m.coalesed = make(map[string]*TableCheckpointDiff)
+	m.waiters = nil
+	return cpd, w
+}
+
+// listenCheckpointUpdates will combine several checkpoints together to reduce database load.
+// The first failed write is kept in rc.checkpointErr, and reported to the
+// waiters of the later barriers.
+func (rc *RestoreController) listenCheckpointUpdates(ctx context.Context, wg *sync.WaitGroup) {
+	mergers := make([]*checkpointMerger, len(rc.saveCpChs))
+	for i := range mergers {
+		mergers[i] = &checkpointMerger{coalesed: make(map[string]*TableCheckpointDiff)}
+	}
+
+	hasCheckpoint := make(chan struct{}, 1)
+
+	go func() {
+		for range hasCheckpoint {
+			// the shards never share a table, so their updates are simply
+			// put together.
+			cpd := make(map[string]*TableCheckpointDiff)
+			var w []chan<- struct{}
+			for _, m := range mergers {
+				shardCpd, shardWaiters := m.take()
+				for tableName, diff := range shardCpd {
+					cpd[tableName] = diff
+				}
+				w = append(w, shardWaiters...)
+			}
+
+			if len(cpd) > 0 {
+				// a slow checkpoint DB holds back the waiters, i.e. the
+				// whole pipeline.
+				updateStart := time.Now()
+				if err := rc.checkpointsDB.Update(ctx, cpd); err != nil {
+					rc.checkpointErr.Set("checkpoints", errors.Annotate(err, "failed to save checkpoints"))
+				}
+				metric.CheckpointUpdateSecondsHistogram.Observe(time.Since(updateStart).Seconds())
+				rc.lastCheckpointTime.Store(time.Now())
+			}
+			for _, waitCh := range w {
+				close(waitCh)
+			}
+			wg.Done()
+		}
+	}()
+
+	var shardsWg sync.WaitGroup
+	for i, ch := range rc.saveCpChs {
+		shardsWg.Add(1)
+		go func(m *checkpointMerger, ch <-chan saveCp) {
+			defer shardsWg.Done()
+			rc.mergeCheckpointUpdates(m, ch, hasCheckpoint, wg)
+		}(mergers[i], ch)
+	}
+	shardsWg.Wait()
+}
+
+// mergeCheckpointUpdates coalesces the updates received from a shard, and
+// requests a write into the checkpoints database unless one is pending.
+func (rc *RestoreController) mergeCheckpointUpdates(m *checkpointMerger, ch <-chan saveCp, hasCheckpoint chan<- struct{}, wg *sync.WaitGroup) {
+	for scp := range ch {
+		m.lock.Lock()
+		if scp.waitCh != nil {
+			m.waiters = append(m.waiters, scp.waitCh)
+		} else {
+			cpd, ok := m.coalesed[scp.tableName]
+			if !ok {
+				cpd = NewTableCheckpointDiff()
+				m.coalesed[scp.tableName] = cpd
+			}
+			scp.merger.MergeInto(cpd)
+		}
+		m.lock.Unlock()
+
+		// the pending write will take this update too, if any.
+		wg.Add(1)
+		select {
+		case hasCheckpoint <- struct{}{}:
+		default:
+			wg.Done()
+		}
+
+		// gofail: var FailIfImportedChunk struct{}
+		// if _, ok := scp.merger.(*ChunkCheckpointMerger); ok {
+		// 	wg.Wait()
+		// 	panic("forcing failure due to FailIfImportedChunk")
+		// }
+		// continue
+
+		// gofail: var FailIfStatusBecomes int
+		// if merger, ok := scp.merger.(*StatusCheckpointMerger); ok && merger.EngineID >= 0 && int(merger.Status) == FailIfStatusBecomes {
+		// 	wg.Wait()
+		// 	panic("forcing failure due to FailIfStatusBecomes")
+		// }
+		// continue
+	}
+}
+
+// flushCheckpoints blocks until all checkpoint updates sent before this call
+// have been written into the checkpoints database, and fails if any write has
+// failed.
+func (rc *RestoreController) flushCheckpoints(ctx context.Context) error {
+	// every shard receives a barrier, which passes once the updates before it
+	// in the shard are written.
+	waitChs := make([]chan struct{}, len(rc.saveCpChs))
+	for i, ch := range rc.saveCpChs {
+		waitChs[i] = make(chan struct{})
+		select {
+		case ch <- saveCp{waitCh: waitChs[i]}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for _, waitCh := range waitChs {
+		select {
+		case <-waitCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return rc.checkpointErr.Get()
+}
+
+// flushCheckpoint flushes the engine, so the rows delivered so far are
+// durable, then saves the delivered watermark of this chunk into the
+// checkpoints database, and waits until it is written. Only the shard of the
+// table is waited for.
+func (cr *chunkRestore) flushCheckpoint(ctx context.Context, t *TableRestore, engineID int, engine *kv.OpenedEngine, rc *RestoreController) error {
+	if err := engine.Flush(ctx); err != nil {
+		return errors.Trace(err)
+	}
+
+	waitCh := make(chan struct{})
+	updates := []saveCp{
+		{
+			tableName: t.tableName,
+			merger: &RebaseCheckpointMerger{
+				AllocBase: t.alloc.Base() + 1,
+			},
+		},
+		{
+			tableName: t.tableName,
+			merger: &ChunkCheckpointMerger{
+				EngineID: engineID,
+				Key:      cr.chunk.Key,
+				Checksum: cr.chunk.Checksum,
+				Pos:      cr.chunk.Chunk.Offset,
+				RowID:    cr.chunk.Chunk.PrevRowIDMax,
+			},
+		},
+		{tableName: t.tableName, waitCh: waitCh},
+	}
+	for _, scp := range updates {
+		if err := rc.sendCheckpoint(ctx, scp); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	select {
+	case <-waitCh:
+		return rc.checkpointErr.Get()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"sort"
 	"strings"
 	"sync"
@@ -53,9 +54,14 @@ const nodeID = 0
 const (
 	// the table names to store each kind of checkpoint in the checkpoint database
 	// remember to increase the version number in case of incompatible change.
-	checkpointTableNameTable  = "table_v4"
-	checkpointTableNameEngine = "engine_v4"
-	checkpointTableNameChunk  = "chunk_v4"
+	checkpointTableNameTable  = "table_v5"
+	checkpointTableNameEngine = "engine_v5"
+	checkpointTableNameChunk  = "chunk_v5"
+	checkpointTableNameTask   = "progress_v5"
+	checkpointTableNameMeta   = "meta_v5"
+
+	checkpointHistorySuffix  = "_history"
+	checkpointArchiveTimeFmt = "20060102150405"
 )
 
 func (status CheckpointStatus) MetricName() string {
@@ -105,11 +111,21 @@ type ChunkCheckpoint struct {
 	ShouldIncludeRowID bool
 	Chunk              mydump.Chunk
 	Checksum           verify.KVChecksum
+	// FileSize and FileModTime (in Unix nanoseconds) describe the source file
+	// at the time the chunk was created, to detect changes when resuming.
+	FileSize    int64
+	FileModTime int64
+	// QuarantineReason is the last error of a chunk which failed too many
+	// times. Quarantined chunks are skipped until retried explicitly.
+	QuarantineReason string
 }
 
 type EngineCheckpoint struct {
 	Status CheckpointStatus
 	Chunks []*ChunkCheckpoint // a sorted array
+	// Importer is the tikv-importer the engine is assigned to when there are
+	// several, so that resuming writes into the same one.
+	Importer string
 }
 
 type TableCheckpoint struct {
@@ -126,6 +142,16 @@ func (cp *TableCheckpoint) CountChunks() int {
 	return result
 }
 
+// kvSize returns the total size of KV pairs already written from the chunks
+// of this engine.
+func (cp *EngineCheckpoint) kvSize() int64 {
+	var result uint64
+	for _, chunk := range cp.Chunks {
+		result += chunk.Checksum.SumSize()
+	}
+	return int64(result)
+}
+
 type chunkCheckpointDiff struct {
 	pos      int64
 	rowID    int64
@@ -133,9 +159,12 @@ type chunkCheckpointDiff struct {
 }
 
 type engineCheckpointDiff struct {
-	hasStatus bool
-	status    CheckpointStatus
-	chunks    map[ChunkCheckpointKey]chunkCheckpointDiff
+	hasStatus   bool
+	hasImporter bool
+	status      CheckpointStatus
+	importer    string
+	chunks      map[ChunkCheckpointKey]chunkCheckpointDiff
+	quarantined map[ChunkCheckpointKey]string
 }
 
 type TableCheckpointDiff struct {
@@ -158,9 +187,19 @@ func (cpd *TableCheckpointDiff) insertEngineCheckpointDiff(engineID int, newDiff
 			oldDiff.hasStatus = true
 			oldDiff.status = newDiff.status
 		}
+		if newDiff.hasImporter {
+			oldDiff.hasImporter = true
+			oldDiff.importer = newDiff.importer
+		}
 		for key, chunkDiff := range newDiff.chunks {
 			oldDiff.chunks[key] = chunkDiff
 		}
+		if len(newDiff.quarantined) > 0 && oldDiff.quarantined == nil {
+			oldDiff.quarantined = make(map[ChunkCheckpointKey]string)
+		}
+		for key, reason := range newDiff.quarantined {
+			oldDiff.quarantined[key] = reason
+		}
 		newDiff = oldDiff
 	}
 	cpd.engines[engineID] = newDiff
@@ -225,6 +264,38 @@ func (merger *ChunkCheckpointMerger) MergeInto(cpd *TableCheckpointDiff) {
 	})
 }
 
+// QuarantineCheckpointMerger marks a chunk as quarantined, so it is skipped
+// until retried with `tidb-lightning-ctl -chunk-retry`. An empty reason clears
+// the mark.
+type QuarantineCheckpointMerger struct {
+	EngineID int
+	Key      ChunkCheckpointKey
+	Reason   string
+}
+
+func (merger *QuarantineCheckpointMerger) MergeInto(cpd *TableCheckpointDiff) {
+	cpd.insertEngineCheckpointDiff(merger.EngineID, engineCheckpointDiff{
+		chunks: make(map[ChunkCheckpointKey]chunkCheckpointDiff),
+		quarantined: map[ChunkCheckpointKey]string{
+			merger.Key: merger.Reason,
+		},
+	})
+}
+
+// ImporterCheckpointMerger records the tikv-importer an engine is assigned to.
+type ImporterCheckpointMerger struct {
+	EngineID int
+	Importer string
+}
+
+func (merger *ImporterCheckpointMerger) MergeInto(cpd *TableCheckpointDiff) {
+	cpd.insertEngineCheckpointDiff(merger.EngineID, engineCheckpointDiff{
+		hasImporter: true,
+		importer:    merger.Importer,
+		chunks:      make(map[ChunkCheckpointKey]chunkCheckpointDiff),
+	})
+}
+
 type RebaseCheckpointMerger struct {
 	AllocBase int64
 }
@@ -239,21 +310,122 @@ type DestroyedTableCheckpoint struct {
 	EnginesCount int
 }
 
+type retryChunk struct {
+	engineID     int
+	key          ChunkCheckpointKey
+	rowIDMax     int64
+	prevRowIDMax int64
+}
+
+// computeRetryChunks finds the chunks belonging to the given engine, and
+// recovers the initial row ID of each of them, so that the chunks can be
+// restored from the beginning again.
+//
+// The row ID ranges of all chunks in a table are contiguous and never
+// overlap, so the initial `PrevRowIDMax` of a chunk is always the `RowIDMax`
+// of the chunk right before it.
+func computeRetryChunks(chunks []retryChunk, engineID int) []retryChunk {
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].rowIDMax < chunks[j].rowIDMax
+	})
+
+	var result []retryChunk
+	prevRowIDMax := int64(0)
+	for _, chunk := range chunks {
+		if chunk.engineID == engineID {
+			chunk.prevRowIDMax = prevRowIDMax
+			result = append(result, chunk)
+		}
+		prevRowIDMax = chunk.rowIDMax
+	}
+	return result
+}
+
+// TaskProgress is the progress accumulated by all runs of the task, so the
+// progress and speed are still correct after resuming from the checkpoint.
+type TaskProgress struct {
+	StartTime time.Time     // when the task was first started
+	Elapsed   time.Duration // total time spent on importing
+	BytesRead int64         // total bytes read from the data source
+}
+
+func (model *TaskProgressModel) toProgress() *TaskProgress {
+	return &TaskProgress{
+		StartTime: time.Unix(0, model.StartTime),
+		Elapsed:   time.Duration(model.Elapsed),
+		BytesRead: model.BytesRead,
+	}
+}
+
+func (progress *TaskProgress) toModel() *TaskProgressModel {
+	return &TaskProgressModel{
+		StartTime: progress.StartTime.UnixNano(),
+		Elapsed:   int64(progress.Elapsed),
+		BytesRead: progress.BytesRead,
+	}
+}
+
+// errCheckpointNotFound is returned by Get if the table has no checkpoint,
+// i.e. before the checkpoints are initialized or after they are removed.
+var errCheckpointNotFound = errors.New("checkpoint not found")
+
+func isCheckpointNotFound(err error) bool {
+	return errors.Cause(err) == errCheckpointNotFound
+}
+
 type CheckpointsDB interface {
 	Initialize(ctx context.Context, dbInfo map[string]*TidbDBInfo) error
+	// Get returns an error caused by errCheckpointNotFound if the table has
+	// no checkpoint.
 	Get(ctx context.Context, tableName string) (*TableCheckpoint, error)
 	Close() error
 	InsertEngineCheckpoints(ctx context.Context, tableName string, checkpoints []*EngineCheckpoint) error
-	Update(checkpointDiffs map[string]*TableCheckpointDiff)
+	// Update applies the diffs to the checkpoints. If it fails, the
+	// checkpoints may be partially updated.
+	Update(ctx context.Context, checkpointDiffs map[string]*TableCheckpointDiff) error
+	// GetTaskProgress returns nil if the task has no saved progress.
+	GetTaskProgress(ctx context.Context) (*TaskProgress, error)
+	UpdateTaskProgress(ctx context.Context, progress *TaskProgress) error
+	// GetTaskMeta returns nil if the task has no meta of the given name. Unlike
+	// the progress, the task meta is kept when the checkpoints are removed or
+	// archived, since it records the cluster state changed by the task.
+	GetTaskMeta(ctx context.Context, name string) ([]byte, error)
+	// UpdateTaskMeta saves the task meta, or removes it if the value is nil.
+	UpdateTaskMeta(ctx context.Context, name string, value []byte) error
 
 	RemoveCheckpoint(ctx context.Context, tableName string) error
+	// ArchiveCheckpoints moves all checkpoints of this node out of the way
+	// into a history storage, preserving them for auditing.
+	ArchiveCheckpoints(ctx context.Context, archiveTime time.Time) error
 	IgnoreErrorCheckpoint(ctx context.Context, tableName string) error
 	DestroyErrorCheckpoint(ctx context.Context, tableName string) ([]DestroyedTableCheckpoint, error)
+	RetryEngineCheckpoint(ctx context.Context, tableName string, engineID int) error
+	// RetryChunkCheckpoints clears the quarantine of the chunks in the given
+	// table (or "all"), and resets their engines, so the next run imports
+	// these chunks into the engines again. Returns the number of chunks.
+	RetryChunkCheckpoints(ctx context.Context, tableName string) (int, error)
 	DumpTables(ctx context.Context, csv io.Writer) error
 	DumpEngines(ctx context.Context, csv io.Writer) error
 	DumpChunks(ctx context.Context, csv io.Writer) error
 }
 
+// CheckpointEvent describes a change of a table checkpoint.
+type CheckpointEvent struct {
+	TableName string
+	// Checkpoint is the new checkpoint of the table, or nil if the checkpoint
+	// is removed.
+	Checkpoint *TableCheckpoint
+}
+
+// CheckpointsWatcher is implemented by the checkpoints databases which can
+// report the changes of the checkpoints as they happen.
+type CheckpointsWatcher interface {
+	// Watch returns a channel reporting every change of the table checkpoints
+	// after this call. The channel is closed when the context is canceled or
+	// the watch fails.
+	Watch(ctx context.Context) <-chan CheckpointEvent
+}
+
 // NullCheckpointsDB is a checkpoints database with no checkpoints.
 type NullCheckpointsDB struct{}
 
@@ -278,7 +450,25 @@ func (*NullCheckpointsDB) InsertEngineCheckpoints(_ context.Context, _ string, _
 	return nil
 }
 
-func (*NullCheckpointsDB) Update(map[string]*TableCheckpointDiff) {}
+func (*NullCheckpointsDB) Update(context.Context, map[string]*TableCheckpointDiff) error {
+	return nil
+}
+
+func (*NullCheckpointsDB) GetTaskProgress(context.Context) (*TaskProgress, error) {
+	return nil, nil
+}
+
+func (*NullCheckpointsDB) UpdateTaskProgress(context.Context, *TaskProgress) error {
+	return nil
+}
+
+func (*NullCheckpointsDB) GetTaskMeta(context.Context, string) ([]byte, error) {
+	return nil, nil
+}
+
+func (*NullCheckpointsDB) UpdateTaskMeta(context.Context, string, []byte) error {
+	return nil
+}
 
 type MySQLCheckpointsDB struct {
 	db      *sql.DB
@@ -286,6 +476,97 @@ type MySQLCheckpointsDB struct {
 	session uint64
 }
 
+// checkpointColumn is a column of a checkpoint table. The history table has
+// the same columns without the defaults, so every column is archived.
+type checkpointColumn struct {
+	name string
+	typ  string
+	dflt string // the default value, if any
+}
+
+var (
+	tableCheckpointColumns = []checkpointColumn{
+		{name: "node_id", typ: "int unsigned NOT NULL"},
+		{name: "session", typ: "bigint unsigned NOT NULL"},
+		{name: "table_name", typ: "varchar(261) NOT NULL"},
+		{name: "hash", typ: "binary(32) NOT NULL"},
+		{name: "status", typ: "tinyint unsigned", dflt: "30"},
+		{name: "alloc_base", typ: "bigint NOT NULL", dflt: "0"},
+		{name: "create_time", typ: "timestamp NOT NULL", dflt: "CURRENT_TIMESTAMP"},
+		{name: "update_time", typ: "timestamp NOT NULL", dflt: "CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"},
+	}
+	engineCheckpointColumns = []checkpointColumn{
+		{name: "table_name", typ: "varchar(261) NOT NULL"},
+		{name: "engine_id", typ: "int unsigned NOT NULL"},
+		{name: "status", typ: "tinyint unsigned", dflt: "30"},
+		{name: "importer", typ: "varchar(255) NOT NULL", dflt: "''"},
+		{name: "create_time", typ: "timestamp NOT NULL", dflt: "CURRENT_TIMESTAMP"},
+		{name: "update_time", typ: "timestamp NOT NULL", dflt: "CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"},
+	}
+	chunkCheckpointColumns = []checkpointColumn{
+		{name: "table_name", typ: "varchar(261) NOT NULL"},
+		{name: "engine_id", typ: "int unsigned NOT NULL"},
+		{name: "path", typ: "varchar(2048) NOT NULL"},
+		{name: "offset", typ: "bigint NOT NULL"},
+		{name: "columns", typ: "text NULL"},
+		{name: "should_include_row_id", typ: "BOOL NOT NULL"},
+		{name: "end_offset", typ: "bigint NOT NULL"},
+		{name: "pos", typ: "bigint NOT NULL"},
+		{name: "prev_rowid_max", typ: "bigint NOT NULL"},
+		{name: "rowid_max", typ: "bigint NOT NULL"},
+		{name: "kvc_bytes", typ: "bigint unsigned NOT NULL", dflt: "0"},
+		{name: "kvc_kvs", typ: "bigint unsigned NOT NULL", dflt: "0"},
+		{name: "kvc_checksum", typ: "bigint unsigned NOT NULL", dflt: "0"},
+		{name: "file_size", typ: "bigint NOT NULL", dflt: "0"},
+		{name: "file_mod_time", typ: "bigint NOT NULL", dflt: "0"},
+		{name: "quarantine_reason", typ: "varchar(1024) NOT NULL", dflt: "''"},
+		{name: "create_time", typ: "timestamp NOT NULL", dflt: "CURRENT_TIMESTAMP"},
+		{name: "update_time", typ: "timestamp NOT NULL", dflt: "CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"},
+	}
+)
+
+// createCheckpointTableSQL returns the statement creating the table with the
+// columns, followed by the keys.
+func createCheckpointTableSQL(schema string, table string, columns []checkpointColumn, keys string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "CREATE TABLE IF NOT EXISTS %s.%s (\n", schema, table)
+	for _, col := range columns {
+		fmt.Fprintf(&sb, "\t%s %s", col.name, col.typ)
+		if len(col.dflt) > 0 {
+			fmt.Fprintf(&sb, " DEFAULT %s", col.dflt)
+		}
+		sb.WriteString(",\n")
+	}
+	fmt.Fprintf(&sb, "\t%s\n);", keys)
+	return sb.String()
+}
+
+// createHistoryTableSQL returns the statement creating the history table of
+// the checkpoint table, with the archive time after the columns. The same
+// checkpoints may be archived several times, so there is no unique key.
+func createHistoryTableSQL(schema string, table string, columns []checkpointColumn) string {
+	history := make([]checkpointColumn, 0, len(columns)+1)
+	for _, col := range columns {
+		history = append(history, checkpointColumn{name: col.name, typ: col.typ})
+	}
+	history = append(history, checkpointColumn{name: "archive_time", typ: "timestamp NOT NULL"})
+	return createCheckpointTableSQL(schema, table+checkpointHistorySuffix, history, "INDEX(table_name)")
+}
+
+// archiveCheckpointsSQL returns the statement copying the rows matching the
+// condition into the history table, taking the archive time as the first
+// argument.
+func archiveCheckpointsSQL(schema string, table string, columns []checkpointColumn, where string) string {
+	names := make([]string, 0, len(columns))
+	for _, col := range columns {
+		names = append(names, col.name)
+	}
+	return fmt.Sprintf(`
+		INSERT INTO %[1]s.%[2]s%[3]s (%[4]s, archive_time)
+		SELECT %[4]s, ? FROM %[1]s.%[2]s WHERE %[5]s;
+	`, schema, table, checkpointHistorySuffix, strings.Join(names, ", "), where)
+}
+
 func NewMySQLCheckpointsDB(ctx context.Context, db *sql.DB, schemaName string) (*MySQLCheckpointsDB, error) {
 	var escapedSchemaName strings.Builder
 	common.WriteMySQLIdentifier(&escapedSchemaName, schemaName)
@@ -298,57 +579,52 @@ func NewMySQLCheckpointsDB(ctx context.Context, db *sql.DB, schemaName string) (
 		return nil, errors.Trace(err)
 	}
 
-	err = common.ExecWithRetry(ctx, db, "(create table checkpoints table)", fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS %s.%s (
-			node_id int unsigned NOT NULL,
-			session bigint unsigned NOT NULL,
-			table_name varchar(261) NOT NULL PRIMARY KEY,
-			hash binary(32) NOT NULL,
-			status tinyint unsigned DEFAULT 30,
-			alloc_base bigint NOT NULL DEFAULT 0,
-			create_time timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			update_time timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-			INDEX(node_id, session)
-		);
-	`, schema, checkpointTableNameTable))
+	err = common.ExecWithRetry(ctx, db, "(create table checkpoints table)", createCheckpointTableSQL(
+		schema, checkpointTableNameTable, tableCheckpointColumns,
+		"PRIMARY KEY(table_name), INDEX(node_id, session)",
+	))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = common.ExecWithRetry(ctx, db, "(create engine checkpoints table)", createCheckpointTableSQL(
+		schema, checkpointTableNameEngine, engineCheckpointColumns,
+		"PRIMARY KEY(table_name, engine_id DESC)",
+	))
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	err = common.ExecWithRetry(ctx, db, "(create engine checkpoints table)", fmt.Sprintf(`
+	err = common.ExecWithRetry(ctx, db, "(create chunks checkpoints table)", createCheckpointTableSQL(
+		schema, checkpointTableNameChunk, chunkCheckpointColumns,
+		"PRIMARY KEY(table_name, engine_id, path(500), offset)",
+	))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = common.ExecWithRetry(ctx, db, "(create task progress table)", fmt.Sprintf(`
 		CREATE TABLE IF NOT EXISTS %s.%s (
-			table_name varchar(261) NOT NULL,
-			engine_id int unsigned NOT NULL,
-			status tinyint unsigned DEFAULT 30,
-			create_time timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			update_time timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-			PRIMARY KEY(table_name, engine_id DESC)
+			node_id int unsigned NOT NULL PRIMARY KEY,
+			start_time bigint NOT NULL,
+			elapsed bigint NOT NULL,
+			bytes_read bigint NOT NULL,
+			update_time timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 		);
-	`, schema, checkpointTableNameEngine))
+	`, schema, checkpointTableNameTask))
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	err = common.ExecWithRetry(ctx, db, "(create chunks checkpoints table)", fmt.Sprintf(`
+	err = common.ExecWithRetry(ctx, db, "(create task meta table)", fmt.Sprintf(`
 		CREATE TABLE IF NOT EXISTS %s.%s (
-			table_name varchar(261) NOT NULL,
-			engine_id int unsigned NOT NULL,
-			path varchar(2048) NOT NULL,
-			offset bigint NOT NULL,
-			columns text NULL,
-			should_include_row_id BOOL NOT NULL,
-			end_offset bigint NOT NULL,
-			pos bigint NOT NULL,
-			prev_rowid_max bigint NOT NULL,
-			rowid_max bigint NOT NULL,
-			kvc_bytes bigint unsigned NOT NULL DEFAULT 0,
-			kvc_kvs bigint unsigned NOT NULL DEFAULT 0,
-			kvc_checksum bigint unsigned NOT NULL DEFAULT 0,
-			create_time timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			node_id int unsigned NOT NULL,
+			name varchar(64) NOT NULL,
+			value blob NOT NULL,
 			update_time timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-			PRIMARY KEY(table_name, engine_id, path(500), offset)
+			PRIMARY KEY(node_id, name)
 		);
-	`, schema, checkpointTableNameChunk))
+	`, schema, checkpointTableNameMeta))
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -411,16 +687,21 @@ func (cpdb *MySQLCheckpointsDB) Close() error {
 
 func (cpdb *MySQLCheckpointsDB) Get(ctx context.Context, tableName string) (*TableCheckpoint, error) {
 	cp := new(TableCheckpoint)
+	// not returned as an error from the transaction, which would be retried.
+	notFound := false
 
 	purpose := "(read checkpoint " + tableName + ")"
 	err := common.TransactWithRetry(ctx, cpdb.db, purpose, func(c context.Context, tx *sql.Tx) error {
 		// 1. Populate the engines.
 
 		engineQuery := fmt.Sprintf(`
-			SELECT engine_id, status FROM %s.%s WHERE table_name = ? ORDER BY engine_id DESC;
+			SELECT engine_id, status, importer FROM %s.%s WHERE table_name = ? ORDER BY engine_id DESC;
 		`, cpdb.schema, checkpointTableNameEngine)
 		engineRows, err := tx.QueryContext(c, engineQuery, tableName)
-		if err != nil {
+		if isTableNotExistError(err) {
+			notFound = true
+			return nil
+		} else if err != nil {
 			return errors.Trace(err)
 		}
 		defer engineRows.Close()
@@ -428,14 +709,16 @@ func (cpdb *MySQLCheckpointsDB) Get(ctx context.Context, tableName string) (*Tab
 			var (
 				engineID int
 				status   uint8
+				importer string
 			)
-			if err := engineRows.Scan(&engineID, &status); err != nil {
+			if err := engineRows.Scan(&engineID, &status, &importer); err != nil {
 				return errors.Trace(err)
 			}
 			for len(cp.Engines) <= engineID {
 				cp.Engines = append(cp.Engines, new(EngineCheckpoint))
 			}
 			cp.Engines[engineID].Status = CheckpointStatus(status)
+			cp.Engines[engineID].Importer = importer
 		}
 		if err := engineRows.Err(); err != nil {
 			return errors.Trace(err)
@@ -447,7 +730,8 @@ func (cpdb *MySQLCheckpointsDB) Get(ctx context.Context, tableName string) (*Tab
 			SELECT
 				engine_id, path, offset, columns, should_include_row_id,
 				pos, end_offset, prev_rowid_max, rowid_max,
-				kvc_bytes, kvc_kvs, kvc_checksum
+				kvc_bytes, kvc_kvs, kvc_checksum,
+				file_size, file_mod_time, quarantine_reason
 			FROM %s.%s WHERE table_name = ?
 			ORDER BY engine_id, path, offset;
 		`, cpdb.schema, checkpointTableNameChunk)
@@ -468,6 +752,7 @@ func (cpdb *MySQLCheckpointsDB) Get(ctx context.Context, tableName string) (*Tab
 				&engineID, &value.Key.Path, &value.Key.Offset, &value.Columns, &value.ShouldIncludeRowID,
 				&value.Chunk.Offset, &value.Chunk.EndOffset, &value.Chunk.PrevRowIDMax, &value.Chunk.RowIDMax,
 				&kvcBytes, &kvcKVs, &kvcChecksum,
+				&value.FileSize, &value.FileModTime, &value.QuarantineReason,
 			); err != nil {
 				return errors.Trace(err)
 			}
@@ -486,7 +771,10 @@ func (cpdb *MySQLCheckpointsDB) Get(ctx context.Context, tableName string) (*Tab
 		tableRow := tx.QueryRowContext(c, tableQuery, tableName)
 
 		var status uint8
-		if err := tableRow.Scan(&status, &cp.AllocBase); err != nil {
+		if err := tableRow.Scan(&status, &cp.AllocBase); err == sql.ErrNoRows {
+			notFound = true
+			return nil
+		} else if err != nil {
 			return errors.Trace(err)
 		}
 		cp.Status = CheckpointStatus(status)
@@ -495,6 +783,9 @@ func (cpdb *MySQLCheckpointsDB) Get(ctx context.Context, tableName string) (*Tab
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	if notFound {
+		return nil, errors.Annotate(errCheckpointNotFound, tableName)
+	}
 
 	return cp, nil
 }
@@ -514,12 +805,14 @@ func (cpdb *MySQLCheckpointsDB) InsertEngineCheckpoints(ctx context.Context, tab
 				table_name, engine_id,
 				path, offset, columns, should_include_row_id,
 				pos, end_offset, prev_rowid_max, rowid_max,
-				kvc_bytes, kvc_kvs, kvc_checksum
+				kvc_bytes, kvc_kvs, kvc_checksum,
+				file_size, file_mod_time
 			) VALUES (
 				?, ?,
 				?, ?, ?, ?,
 				?, ?, ?, ?,
-				?, ?, ?
+				?, ?, ?,
+				?, ?
 			);
 		`, cpdb.schema, checkpointTableNameChunk))
 		if err != nil {
@@ -538,6 +831,7 @@ func (cpdb *MySQLCheckpointsDB) InsertEngineCheckpoints(ctx context.Context, tab
 					value.Key.Path, value.Key.Offset, value.Columns, value.ShouldIncludeRowID,
 					value.Chunk.Offset, value.Chunk.EndOffset, value.Chunk.PrevRowIDMax, value.Chunk.RowIDMax,
 					value.Checksum.SumSize(), value.Checksum.SumKVS(), value.Checksum.Sum(),
+					value.FileSize, value.FileModTime,
 				)
 				if err != nil {
 					return errors.Trace(err)
@@ -554,9 +848,36 @@ func (cpdb *MySQLCheckpointsDB) InsertEngineCheckpoints(ctx context.Context, tab
 	return nil
 }
 
-func (cpdb *MySQLCheckpointsDB) Update(checkpointDiffs map[string]*TableCheckpointDiff) {
-	chunkQuery := fmt.Sprintf(`
-		UPDATE %s.%s SET pos = ?, prev_rowid_max = ?, kvc_bytes = ?, kvc_kvs = ?, kvc_checksum = ?
+// chunkUpdateBatchSize is the maximum number of chunks updated by a statement,
+// which keeps the placeholders far below the limit of MySQL (65535).
+const chunkUpdateBatchSize = 256
+
+// chunkUpdateArgs is the number of parameters of each chunk in
+// chunkUpdateQuery.
+const chunkUpdateArgs = 9
+
+// chunkUpdateQuery updates the progress of `rows` chunks in one statement, by
+// joining the chunks with a derived table of the parameters. Each chunk takes
+// the parameters table_name, engine_id, path, offset, pos, prev_rowid_max,
+// kvc_bytes, kvc_kvs and kvc_checksum in order.
+func chunkUpdateQuery(schema string, rows int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "UPDATE %s.%s c JOIN (", schema, checkpointTableNameChunk)
+	for i := 0; i < rows; i++ {
+		if i == 0 {
+			sb.WriteString("SELECT ? AS table_name, ? AS engine_id, ? AS path, ? AS offset, ? AS pos, ? AS prev_rowid_max, ? AS kvc_bytes, ? AS kvc_kvs, ? AS kvc_checksum")
+		} else {
+			sb.WriteString(" UNION ALL SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?")
+		}
+	}
+	sb.WriteString(`) d ON (c.table_name, c.engine_id, c.path, c.offset) = (d.table_name, d.engine_id, d.path, d.offset)
+		SET c.pos = d.pos, c.prev_rowid_max = d.prev_rowid_max, c.kvc_bytes = d.kvc_bytes, c.kvc_kvs = d.kvc_kvs, c.kvc_checksum = d.kvc_checksum;`)
+	return sb.String()
+}
+
+func (cpdb *MySQLCheckpointsDB) Update(ctx context.Context, checkpointDiffs map[string]*TableCheckpointDiff) error {
+	quarantineQuery := fmt.Sprintf(`
+		UPDATE %s.%s SET quarantine_reason = ?
 		WHERE (table_name, engine_id, path, offset) = (?, ?, ?, ?);
 	`, cpdb.schema, checkpointTableNameChunk)
 	checksumQuery := fmt.Sprintf(`
@@ -568,63 +889,143 @@ func (cpdb *MySQLCheckpointsDB) Update(checkpointDiffs map[string]*TableCheckpoi
 	engineStatusQuery := fmt.Sprintf(`
 		UPDATE %s.%s SET status = ? WHERE (table_name, engine_id) = (?, ?);
 	`, cpdb.schema, checkpointTableNameEngine)
+	engineImporterQuery := fmt.Sprintf(`
+		UPDATE %s.%s SET importer = ? WHERE (table_name, engine_id) = (?, ?);
+	`, cpdb.schema, checkpointTableNameEngine)
 
-	err := common.TransactWithRetry(context.Background(), cpdb.db, "(update checkpoints)", func(c context.Context, tx *sql.Tx) error {
-		chunkStmt, e := tx.PrepareContext(c, chunkQuery)
-		if e != nil {
-			return errors.Trace(e)
-		}
-		defer chunkStmt.Close()
-		checksumStmt, e := tx.PrepareContext(c, checksumQuery)
-		if e != nil {
-			return errors.Trace(e)
-		}
-		defer checksumStmt.Close()
-		tableStatusStmt, e := tx.PrepareContext(c, tableStatusQuery)
-		if e != nil {
-			return errors.Trace(e)
+	// the chunks take the most of the updates, so they are updated in batches
+	// by multi-row statements.
+	var chunkArgs []interface{}
+	for tableName, cpd := range checkpointDiffs {
+		for engineID, engineDiff := range cpd.engines {
+			for key, diff := range engineDiff.chunks {
+				chunkArgs = append(chunkArgs,
+					tableName, engineID, key.Path, key.Offset,
+					diff.pos, diff.rowID, diff.checksum.SumSize(), diff.checksum.SumKVS(), diff.checksum.Sum(),
+				)
+			}
 		}
-		defer tableStatusStmt.Close()
-		engineStatusStmt, e := tx.PrepareContext(c, engineStatusQuery)
-		if e != nil {
+	}
+	chunkBatchArgs := chunkUpdateBatchSize * chunkUpdateArgs
+
+	err := common.TransactWithRetry(ctx, cpdb.db, "(update checkpoints)", func(c context.Context, tx *sql.Tx) error {
+		// the statements are prepared once used, and reused in the transaction.
+		stmts := make(map[string]*sql.Stmt)
+		defer func() {
+			for _, stmt := range stmts {
+				stmt.Close()
+			}
+		}()
+		exec := func(query string, args ...interface{}) error {
+			stmt, ok := stmts[query]
+			if !ok {
+				var e error
+				if stmt, e = tx.PrepareContext(c, query); e != nil {
+					return errors.Trace(e)
+				}
+				stmts[query] = stmt
+			}
+			_, e := stmt.ExecContext(c, args...)
 			return errors.Trace(e)
 		}
-		defer engineStatusStmt.Close()
 
 		for tableName, cpd := range checkpointDiffs {
 			if cpd.hasStatus {
-				if _, e := tableStatusStmt.ExecContext(c, cpd.status, tableName); e != nil {
-					return errors.Trace(e)
+				if e := exec(tableStatusQuery, cpd.status, tableName); e != nil {
+					return e
 				}
 			}
 			if cpd.hasRebase {
-				if _, e := checksumStmt.ExecContext(c, cpd.allocBase, tableName); e != nil {
-					return errors.Trace(e)
+				if e := exec(checksumQuery, cpd.allocBase, tableName); e != nil {
+					return e
 				}
 			}
 			for engineID, engineDiff := range cpd.engines {
 				if engineDiff.hasStatus {
-					if _, e := engineStatusStmt.ExecContext(c, engineDiff.status, tableName, engineID); e != nil {
-						return errors.Trace(e)
+					if e := exec(engineStatusQuery, engineDiff.status, tableName, engineID); e != nil {
+						return e
 					}
 				}
-				for key, diff := range engineDiff.chunks {
-					if _, e := chunkStmt.ExecContext(
-						c,
-						diff.pos, diff.rowID, diff.checksum.SumSize(), diff.checksum.SumKVS(), diff.checksum.Sum(),
-						tableName, engineID, key.Path, key.Offset,
-					); e != nil {
-						return errors.Trace(e)
+				if engineDiff.hasImporter {
+					if e := exec(engineImporterQuery, engineDiff.importer, tableName, engineID); e != nil {
+						return e
+					}
+				}
+				for key, reason := range engineDiff.quarantined {
+					if e := exec(quarantineQuery, reason, tableName, engineID, key.Path, key.Offset); e != nil {
+						return e
 					}
 				}
 			}
 		}
 
+		for args := chunkArgs; len(args) > 0; {
+			n := mathutil.Min(len(args), chunkBatchArgs)
+			if e := exec(chunkUpdateQuery(cpdb.schema, n/chunkUpdateArgs), args[:n]...); e != nil {
+				return e
+			}
+			args = args[n:]
+		}
 		return nil
 	})
-	if err != nil {
-		common.AppLogger.Errorf("failed to save checkpoint: %v", err)
+	return errors.Trace(err)
+}
+
+func (cpdb *MySQLCheckpointsDB) GetTaskProgress(ctx context.Context) (*TaskProgress, error) {
+	var model TaskProgressModel
+	query := fmt.Sprintf(`
+		SELECT start_time, elapsed, bytes_read FROM %s.%s WHERE node_id = ?;
+	`, cpdb.schema, checkpointTableNameTask)
+	err := common.Retry(ctx, "(read task progress)", func() error {
+		err := cpdb.db.QueryRowContext(ctx, query, nodeID).Scan(&model.StartTime, &model.Elapsed, &model.BytesRead)
+		if err == sql.ErrNoRows {
+			model.StartTime = 0
+			return nil
+		}
+		return errors.Trace(err)
+	})
+	if err != nil || model.StartTime == 0 {
+		return nil, errors.Trace(err)
 	}
+	return model.toProgress(), nil
+}
+
+func (cpdb *MySQLCheckpointsDB) UpdateTaskProgress(ctx context.Context, progress *TaskProgress) error {
+	model := progress.toModel()
+	query := fmt.Sprintf(`
+		REPLACE INTO %s.%s (node_id, start_time, elapsed, bytes_read) VALUES (?, ?, ?, ?);
+	`, cpdb.schema, checkpointTableNameTask)
+	return errors.Trace(common.ExecWithRetry(ctx, cpdb.db, "(update task progress)", query, nodeID, model.StartTime, model.Elapsed, model.BytesRead))
+}
+
+func (cpdb *MySQLCheckpointsDB) GetTaskMeta(ctx context.Context, name string) ([]byte, error) {
+	var value []byte
+	query := fmt.Sprintf(`
+		SELECT value FROM %s.%s WHERE node_id = ? AND name = ?;
+	`, cpdb.schema, checkpointTableNameMeta)
+	err := common.Retry(ctx, fmt.Sprintf("(read task meta %s)", name), func() error {
+		err := cpdb.db.QueryRowContext(ctx, query, nodeID, name).Scan(&value)
+		if err == sql.ErrNoRows {
+			value = nil
+			return nil
+		}
+		return errors.Trace(err)
+	})
+	return value, errors.Trace(err)
+}
+
+func (cpdb *MySQLCheckpointsDB) UpdateTaskMeta(ctx context.Context, name string, value []byte) error {
+	purpose := fmt.Sprintf("(update task meta %s)", name)
+	if value == nil {
+		query := fmt.Sprintf(`
+			DELETE FROM %s.%s WHERE node_id = ? AND name = ?;
+		`, cpdb.schema, checkpointTableNameMeta)
+		return errors.Trace(common.ExecWithRetry(ctx, cpdb.db, purpose, query, nodeID, name))
+	}
+	query := fmt.Sprintf(`
+		REPLACE INTO %s.%s (node_id, name, value) VALUES (?, ?, ?);
+	`, cpdb.schema, checkpointTableNameMeta)
+	return errors.Trace(common.ExecWithRetry(ctx, cpdb.db, purpose, query, nodeID, name, value))
 }
 
 type FileCheckpointsDB struct {
@@ -690,8 +1091,83 @@ func (cpdb *FileCheckpointsDB) Get(_ context.Context, tableName string) (*TableC
 	cpdb.lock.Lock()
 	defer cpdb.lock.Unlock()
 
-	tableModel := cpdb.checkpoints.Checkpoints[tableName]
+	tableModel, ok := cpdb.checkpoints.Checkpoints[tableName]
+	if !ok {
+		return nil, errors.Annotate(errCheckpointNotFound, tableName)
+	}
+	return tableModel.toCheckpoint(), nil
+}
 
+func (cpdb *FileCheckpointsDB) InsertEngineCheckpoints(_ context.Context, tableName string, checkpoints []*EngineCheckpoint) error {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	cpdb.checkpoints.Checkpoints[tableName].insertEngines(checkpoints)
+	return errors.Trace(cpdb.save())
+}
+
+func (cpdb *FileCheckpointsDB) Update(_ context.Context, checkpointDiffs map[string]*TableCheckpointDiff) error {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	for tableName, cpd := range checkpointDiffs {
+		cpdb.checkpoints.Checkpoints[tableName].applyDiff(cpd)
+	}
+
+	return errors.Trace(cpdb.save())
+}
+
+func (cpdb *FileCheckpointsDB) GetTaskProgress(context.Context) (*TaskProgress, error) {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	if cpdb.checkpoints.Progress == nil {
+		return nil, nil
+	}
+	return cpdb.checkpoints.Progress.toProgress(), nil
+}
+
+func (cpdb *FileCheckpointsDB) UpdateTaskProgress(_ context.Context, progress *TaskProgress) error {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	cpdb.checkpoints.Progress = progress.toModel()
+	return errors.Trace(cpdb.save())
+}
+
+func (cpdb *FileCheckpointsDB) GetTaskMeta(_ context.Context, name string) ([]byte, error) {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	return cpdb.checkpoints.TaskMeta[name], nil
+}
+
+func (cpdb *FileCheckpointsDB) UpdateTaskMeta(_ context.Context, name string, value []byte) error {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	if value == nil {
+		delete(cpdb.checkpoints.TaskMeta, name)
+	} else {
+		if cpdb.checkpoints.TaskMeta == nil {
+			cpdb.checkpoints.TaskMeta = make(map[string][]byte)
+		}
+		cpdb.checkpoints.TaskMeta[name] = value
+	}
+	return errors.Trace(cpdb.save())
+}
+
+// resetCheckpoints clears everything except the task meta.
+func (cpdb *FileCheckpointsDB) resetCheckpoints() {
+	taskMeta := cpdb.checkpoints.TaskMeta
+	cpdb.checkpoints.Reset()
+	cpdb.checkpoints.TaskMeta = taskMeta
+}
+
+// Protobuf model functions, shared by all drivers storing the checkpoints as
+// serialized TableCheckpointModel -----------------------------------------------
+
+func (tableModel *TableCheckpointModel) toCheckpoint() *TableCheckpoint {
 	cp := &TableCheckpoint{
 		Status:    CheckpointStatus(tableModel.Status),
 		AllocBase: tableModel.AllocBase,
@@ -700,8 +1176,9 @@ func (cpdb *FileCheckpointsDB) Get(_ context.Context, tableName string) (*TableC
 
 	for _, engineModel := range tableModel.Engines {
 		engine := &EngineCheckpoint{
-			Status: CheckpointStatus(engineModel.Status),
-			Chunks: make([]*ChunkCheckpoint, 0, len(engineModel.Chunks)),
+			Status:   CheckpointStatus(engineModel.Status),
+			Chunks:   make([]*ChunkCheckpoint, 0, len(engineModel.Chunks)),
+			Importer: engineModel.Importer,
 		}
 
 		for _, chunkModel := range engineModel.Chunks {
@@ -718,7 +1195,10 @@ func (cpdb *FileCheckpointsDB) Get(_ context.Context, tableName string) (*TableC
 					PrevRowIDMax: chunkModel.PrevRowidMax,
 					RowIDMax:     chunkModel.RowidMax,
 				},
-				Checksum: verify.MakeKVChecksum(chunkModel.KvcBytes, chunkModel.KvcKvs, chunkModel.KvcChecksum),
+				Checksum:         verify.MakeKVChecksum(chunkModel.KvcBytes, chunkModel.KvcKvs, chunkModel.KvcChecksum),
+				FileSize:         chunkModel.FileSize,
+				FileModTime:      chunkModel.FileModTime,
+				QuarantineReason: chunkModel.QuarantineReason,
 			})
 		}
 
@@ -729,14 +1209,10 @@ func (cpdb *FileCheckpointsDB) Get(_ context.Context, tableName string) (*TableC
 		cp.Engines = append(cp.Engines, engine)
 	}
 
-	return cp, nil
+	return cp
 }
 
-func (cpdb *FileCheckpointsDB) InsertEngineCheckpoints(_ context.Context, tableName string, checkpoints []*EngineCheckpoint) error {
-	cpdb.lock.Lock()
-	defer cpdb.lock.Unlock()
-
-	tableModel := cpdb.checkpoints.Checkpoints[tableName]
+func (tableModel *TableCheckpointModel) insertEngines(checkpoints []*EngineCheckpoint) {
 	for len(tableModel.Engines) < len(checkpoints) {
 		tableModel.Engines = append(tableModel.Engines, &EngineCheckpointModel{
 			Status: uint32(CheckpointStatusLoaded),
@@ -755,6 +1231,8 @@ func (cpdb *FileCheckpointsDB) InsertEngineCheckpoints(_ context.Context, tableN
 					Offset:             value.Key.Offset,
 					Columns:            value.Columns,
 					ShouldIncludeRowId: value.ShouldIncludeRowID,
+					FileSize:           value.FileSize,
+					FileModTime:        value.FileModTime,
 				}
 				engineModel.Chunks[key] = chunk
 			}
@@ -767,42 +1245,104 @@ func (cpdb *FileCheckpointsDB) InsertEngineCheckpoints(_ context.Context, tableN
 			chunk.KvcChecksum = value.Checksum.Sum()
 		}
 	}
-
-	return errors.Trace(cpdb.save())
 }
 
-func (cpdb *FileCheckpointsDB) Update(checkpointDiffs map[string]*TableCheckpointDiff) {
-	cpdb.lock.Lock()
-	defer cpdb.lock.Unlock()
+func (tableModel *TableCheckpointModel) applyDiff(cpd *TableCheckpointDiff) {
+	if cpd.hasStatus {
+		tableModel.Status = uint32(cpd.status)
+	}
+	if cpd.hasRebase {
+		tableModel.AllocBase = cpd.allocBase
+	}
+	for engineID, engineDiff := range cpd.engines {
+		engineModel := tableModel.Engines[engineID]
+		if engineDiff.hasStatus {
+			engineModel.Status = uint32(engineDiff.status)
+		}
+		if engineDiff.hasImporter {
+			engineModel.Importer = engineDiff.importer
+		}
 
-	for tableName, cpd := range checkpointDiffs {
-		tableModel := cpdb.checkpoints.Checkpoints[tableName]
-		if cpd.hasStatus {
-			tableModel.Status = uint32(cpd.status)
+		for key, diff := range engineDiff.chunks {
+			chunkModel := engineModel.Chunks[key.String()]
+			chunkModel.Pos = diff.pos
+			chunkModel.PrevRowidMax = diff.rowID
+			chunkModel.KvcBytes = diff.checksum.SumSize()
+			chunkModel.KvcKvs = diff.checksum.SumKVS()
+			chunkModel.KvcChecksum = diff.checksum.Sum()
 		}
-		if cpd.hasRebase {
-			tableModel.AllocBase = cpd.allocBase
+		for key, reason := range engineDiff.quarantined {
+			engineModel.Chunks[key.String()].QuarantineReason = reason
 		}
-		for engineID, engineDiff := range cpd.engines {
-			engineModel := tableModel.Engines[engineID]
-			if engineDiff.hasStatus {
-				engineModel.Status = uint32(engineDiff.status)
-			}
+	}
+}
 
-			for key, diff := range engineDiff.chunks {
-				chunkModel := engineModel.Chunks[key.String()]
-				chunkModel.Pos = diff.pos
-				chunkModel.PrevRowidMax = diff.rowID
-				chunkModel.KvcBytes = diff.checksum.SumSize()
-				chunkModel.KvcKvs = diff.checksum.SumKVS()
-				chunkModel.KvcChecksum = diff.checksum.Sum()
+func (tableModel *TableCheckpointModel) ignoreError() {
+	if tableModel.Status <= uint32(CheckpointStatusMaxInvalid) {
+		tableModel.Status = uint32(CheckpointStatusLoaded)
+	}
+	for _, engineModel := range tableModel.Engines {
+		if engineModel.Status <= uint32(CheckpointStatusMaxInvalid) {
+			engineModel.Status = uint32(CheckpointStatusLoaded)
+		}
+	}
+}
+
+func (tableModel *TableCheckpointModel) retryEngine(engineID int) {
+	var chunks []retryChunk
+	for eid, engineModel := range tableModel.Engines {
+		for _, chunkModel := range engineModel.Chunks {
+			chunks = append(chunks, retryChunk{
+				engineID: eid,
+				key:      ChunkCheckpointKey{Path: chunkModel.Path, Offset: chunkModel.Offset},
+				rowIDMax: chunkModel.RowidMax,
+			})
+		}
+	}
+
+	engineModel := tableModel.Engines[engineID]
+	for _, chunk := range computeRetryChunks(chunks, engineID) {
+		chunkModel := engineModel.Chunks[chunk.key.String()]
+		chunkModel.Pos = chunkModel.Offset
+		chunkModel.PrevRowidMax = chunk.prevRowIDMax
+		chunkModel.KvcBytes = 0
+		chunkModel.KvcKvs = 0
+		chunkModel.KvcChecksum = 0
+		chunkModel.QuarantineReason = ""
+	}
+	engineModel.Status = uint32(CheckpointStatusLoaded)
+	tableModel.Status = uint32(CheckpointStatusLoaded)
+}
+
+// checkQuarantinedChunks ensures the engines containing quarantined chunks
+// are imported, because the chunks can only be written into a new engine.
+func (tableModel *TableCheckpointModel) checkQuarantinedChunks(tableName string) error {
+	for engineID, engineModel := range tableModel.Engines {
+		if engineModel.Status >= uint32(CheckpointStatusImported) {
+			continue
+		}
+		for _, chunkModel := range engineModel.Chunks {
+			if len(chunkModel.QuarantineReason) != 0 {
+				return errors.Errorf("engine %s:%d with quarantined chunks is not yet imported, please resume the import first", tableName, engineID)
 			}
 		}
 	}
+	return nil
+}
 
-	if err := cpdb.save(); err != nil {
-		common.AppLogger.Errorf("failed to save checkpoint: %v", err)
+func (tableModel *TableCheckpointModel) retryQuarantinedChunks() int {
+	count := 0
+	for _, engineModel := range tableModel.Engines {
+		for _, chunkModel := range engineModel.Chunks {
+			if len(chunkModel.QuarantineReason) != 0 {
+				chunkModel.QuarantineReason = ""
+				engineModel.Status = uint32(CheckpointStatusLoaded)
+				tableModel.Status = uint32(CheckpointStatusLoaded)
+				count++
+			}
+		}
 	}
+	return count
 }
 
 // Management functions ----------------------------------------------------------------------------
@@ -812,12 +1352,21 @@ var cannotManageNullDB = errors.New("cannot perform this function while checkpoi
 func (*NullCheckpointsDB) RemoveCheckpoint(context.Context, string) error {
 	return errors.Trace(cannotManageNullDB)
 }
+func (*NullCheckpointsDB) ArchiveCheckpoints(context.Context, time.Time) error {
+	return nil
+}
 func (*NullCheckpointsDB) IgnoreErrorCheckpoint(context.Context, string) error {
 	return errors.Trace(cannotManageNullDB)
 }
 func (*NullCheckpointsDB) DestroyErrorCheckpoint(context.Context, string) ([]DestroyedTableCheckpoint, error) {
 	return nil, errors.Trace(cannotManageNullDB)
 }
+func (*NullCheckpointsDB) RetryEngineCheckpoint(context.Context, string, int) error {
+	return errors.Trace(cannotManageNullDB)
+}
+func (*NullCheckpointsDB) RetryChunkCheckpoints(context.Context, string) (int, error) {
+	return 0, errors.Trace(cannotManageNullDB)
+}
 func (*NullCheckpointsDB) DumpTables(context.Context, io.Writer) error {
 	return errors.Trace(cannotManageNullDB)
 }
@@ -829,6 +1378,15 @@ func (*NullCheckpointsDB) DumpChunks(context.Context, io.Writer) error {
 }
 
 func (cpdb *MySQLCheckpointsDB) RemoveCheckpoint(ctx context.Context, tableName string) error {
+	err := common.TransactWithRetry(ctx, cpdb.db, fmt.Sprintf("(remove checkpoints of %s)", tableName), func(c context.Context, tx *sql.Tx) error {
+		return errors.Trace(cpdb.removeCheckpointsTx(c, tx, tableName))
+	})
+	return errors.Trace(err)
+}
+
+// removeCheckpointsTx deletes the checkpoints of the table, or of this node if
+// tableName is "all", within the transaction.
+func (cpdb *MySQLCheckpointsDB) removeCheckpointsTx(ctx context.Context, tx *sql.Tx, tableName string) error {
 	var (
 		deleteChunkFmt  string
 		deleteEngineFmt string
@@ -851,17 +1409,57 @@ func (cpdb *MySQLCheckpointsDB) RemoveCheckpoint(ctx context.Context, tableName
 	deleteChunkQuery := fmt.Sprintf(deleteChunkFmt, cpdb.schema, checkpointTableNameChunk, checkpointTableNameTable)
 	deleteEngineQuery := fmt.Sprintf(deleteEngineFmt, cpdb.schema, checkpointTableNameEngine, checkpointTableNameTable)
 	deleteTableQuery := fmt.Sprintf(deleteTableFmt, cpdb.schema, checkpointTableNameTable)
-	err := common.TransactWithRetry(ctx, cpdb.db, fmt.Sprintf("(remove checkpoints of %s)", tableName), func(c context.Context, tx *sql.Tx) error {
-		if _, e := tx.ExecContext(c, deleteChunkQuery, arg); e != nil {
-			return errors.Trace(e)
-		}
-		if _, e := tx.ExecContext(c, deleteEngineQuery, arg); e != nil {
+	deleteTaskQuery := fmt.Sprintf("DELETE FROM %s.%s WHERE node_id = ?", cpdb.schema, checkpointTableNameTask)
+	if _, e := tx.ExecContext(ctx, deleteChunkQuery, arg); e != nil {
+		return errors.Trace(e)
+	}
+	if _, e := tx.ExecContext(ctx, deleteEngineQuery, arg); e != nil {
+		return errors.Trace(e)
+	}
+	if _, e := tx.ExecContext(ctx, deleteTableQuery, arg); e != nil {
+		return errors.Trace(e)
+	}
+	if tableName == "all" {
+		if _, e := tx.ExecContext(ctx, deleteTaskQuery, nodeID); e != nil {
 			return errors.Trace(e)
 		}
-		if _, e := tx.ExecContext(c, deleteTableQuery, arg); e != nil {
-			return errors.Trace(e)
+	}
+	return nil
+}
+
+// ArchiveCheckpoints copies the checkpoints of this node into the history
+// tables (`table_v5_history` etc.), tagged with the archive time, and removes
+// them from the live tables in the same transaction, so they are neither lost
+// nor archived twice if interrupted.
+func (cpdb *MySQLCheckpointsDB) ArchiveCheckpoints(ctx context.Context, archiveTime time.Time) error {
+	err := common.ExecWithRetry(ctx, cpdb.db, "(create table checkpoints history table)",
+		createHistoryTableSQL(cpdb.schema, checkpointTableNameTable, tableCheckpointColumns))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = common.ExecWithRetry(ctx, cpdb.db, "(create engine checkpoints history table)",
+		createHistoryTableSQL(cpdb.schema, checkpointTableNameEngine, engineCheckpointColumns))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = common.ExecWithRetry(ctx, cpdb.db, "(create chunks checkpoints history table)",
+		createHistoryTableSQL(cpdb.schema, checkpointTableNameChunk, chunkCheckpointColumns))
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	ofThisNode := fmt.Sprintf("table_name IN (SELECT table_name FROM %s.%s WHERE node_id = ?)", cpdb.schema, checkpointTableNameTable)
+	archiveChunkQuery := archiveCheckpointsSQL(cpdb.schema, checkpointTableNameChunk, chunkCheckpointColumns, ofThisNode)
+	archiveEngineQuery := archiveCheckpointsSQL(cpdb.schema, checkpointTableNameEngine, engineCheckpointColumns, ofThisNode)
+	archiveTableQuery := archiveCheckpointsSQL(cpdb.schema, checkpointTableNameTable, tableCheckpointColumns, "node_id = ?")
+
+	err = common.TransactWithRetry(ctx, cpdb.db, "(archive checkpoints)", func(c context.Context, tx *sql.Tx) error {
+		for _, query := range []string{archiveChunkQuery, archiveEngineQuery, archiveTableQuery} {
+			if _, e := tx.ExecContext(c, query, archiveTime, nodeID); e != nil {
+				return errors.Trace(e)
+			}
 		}
-		return nil
+		return errors.Trace(cpdb.removeCheckpointsTx(c, tx, "all"))
 	})
 	return errors.Trace(err)
 }
@@ -968,6 +1566,139 @@ func (cpdb *MySQLCheckpointsDB) DestroyErrorCheckpoint(ctx context.Context, tabl
 	return targetTables, nil
 }
 
+func (cpdb *MySQLCheckpointsDB) RetryEngineCheckpoint(ctx context.Context, tableName string, engineID int) error {
+	selectQuery := fmt.Sprintf(`
+		SELECT engine_id, path, offset, rowid_max FROM %s.%s WHERE table_name = ?;
+	`, cpdb.schema, checkpointTableNameChunk)
+	chunkQuery := fmt.Sprintf(`
+		UPDATE %s.%s SET pos = offset, prev_rowid_max = ?, kvc_bytes = 0, kvc_kvs = 0, kvc_checksum = 0, quarantine_reason = ''
+		WHERE (table_name, engine_id, path, offset) = (?, ?, ?, ?);
+	`, cpdb.schema, checkpointTableNameChunk)
+	engineQuery := fmt.Sprintf(`
+		UPDATE %s.%s SET status = %d WHERE (table_name, engine_id) = (?, ?);
+	`, cpdb.schema, checkpointTableNameEngine, CheckpointStatusLoaded)
+	tableQuery := fmt.Sprintf(`
+		UPDATE %s.%s SET status = %d WHERE table_name = ?;
+	`, cpdb.schema, checkpointTableNameTable, CheckpointStatusLoaded)
+
+	purpose := fmt.Sprintf("(retry engine checkpoint %s:%d)", tableName, engineID)
+	err := common.TransactWithRetry(ctx, cpdb.db, purpose, func(c context.Context, tx *sql.Tx) error {
+		rows, e := tx.QueryContext(c, selectQuery, tableName)
+		if e != nil {
+			return errors.Trace(e)
+		}
+		var chunks []retryChunk
+		for rows.Next() {
+			var chunk retryChunk
+			if e := rows.Scan(&chunk.engineID, &chunk.key.Path, &chunk.key.Offset, &chunk.rowIDMax); e != nil {
+				rows.Close()
+				return errors.Trace(e)
+			}
+			chunks = append(chunks, chunk)
+		}
+		rows.Close()
+		if e := rows.Err(); e != nil {
+			return errors.Trace(e)
+		}
+
+		resetChunks := computeRetryChunks(chunks, engineID)
+		if len(resetChunks) == 0 {
+			return errors.Errorf("engine %s:%d not found in checkpoint", tableName, engineID)
+		}
+
+		for _, chunk := range resetChunks {
+			if _, e := tx.ExecContext(c, chunkQuery, chunk.prevRowIDMax, tableName, engineID, chunk.key.Path, chunk.key.Offset); e != nil {
+				return errors.Trace(e)
+			}
+		}
+		if _, e := tx.ExecContext(c, engineQuery, tableName, engineID); e != nil {
+			return errors.Trace(e)
+		}
+		if _, e := tx.ExecContext(c, tableQuery, tableName); e != nil {
+			return errors.Trace(e)
+		}
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+func (cpdb *MySQLCheckpointsDB) RetryChunkCheckpoints(ctx context.Context, tableName string) (int, error) {
+	var (
+		conditionColumn string
+		arg             interface{}
+	)
+	if tableName == "all" {
+		conditionColumn, arg = "node_id", nodeID
+	} else {
+		conditionColumn, arg = "table_name", tableName
+	}
+
+	selectQuery := fmt.Sprintf(`
+		SELECT c.table_name, c.engine_id, e.status, COUNT(*)
+		FROM %[1]s.%[3]s c
+		JOIN %[1]s.%[4]s e ON c.table_name = e.table_name AND c.engine_id = e.engine_id
+		WHERE c.quarantine_reason != '' AND c.table_name IN (SELECT table_name FROM %[1]s.%[5]s WHERE %[2]s = ?)
+		GROUP BY c.table_name, c.engine_id, e.status;
+	`, cpdb.schema, conditionColumn, checkpointTableNameChunk, checkpointTableNameEngine, checkpointTableNameTable)
+	chunkQuery := fmt.Sprintf(`
+		UPDATE %s.%s SET quarantine_reason = '' WHERE (table_name, engine_id) = (?, ?);
+	`, cpdb.schema, checkpointTableNameChunk)
+	engineQuery := fmt.Sprintf(`
+		UPDATE %s.%s SET status = %d WHERE (table_name, engine_id) = (?, ?);
+	`, cpdb.schema, checkpointTableNameEngine, CheckpointStatusLoaded)
+	tableQuery := fmt.Sprintf(`
+		UPDATE %s.%s SET status = %d WHERE table_name = ?;
+	`, cpdb.schema, checkpointTableNameTable, CheckpointStatusLoaded)
+
+	type quarantinedEngine struct {
+		tableName string
+		engineID  int
+		status    uint8
+		chunks    int
+	}
+
+	var count int
+	purpose := fmt.Sprintf("(retry chunk checkpoints for %s)", tableName)
+	err := common.TransactWithRetry(ctx, cpdb.db, purpose, func(c context.Context, tx *sql.Tx) error {
+		rows, e := tx.QueryContext(c, selectQuery, arg)
+		if e != nil {
+			return errors.Trace(e)
+		}
+		var engines []quarantinedEngine
+		for rows.Next() {
+			var engine quarantinedEngine
+			if e := rows.Scan(&engine.tableName, &engine.engineID, &engine.status, &engine.chunks); e != nil {
+				rows.Close()
+				return errors.Trace(e)
+			}
+			engines = append(engines, engine)
+		}
+		rows.Close()
+		if e := rows.Err(); e != nil {
+			return errors.Trace(e)
+		}
+
+		count = 0
+		for _, engine := range engines {
+			if CheckpointStatus(engine.status) < CheckpointStatusImported {
+				return errors.Errorf("engine %s:%d with quarantined chunks is not yet imported, please resume the import first", engine.tableName, engine.engineID)
+			}
+			if _, e := tx.ExecContext(c, chunkQuery, engine.tableName, engine.engineID); e != nil {
+				return errors.Trace(e)
+			}
+			if _, e := tx.ExecContext(c, engineQuery, engine.tableName, engine.engineID); e != nil {
+				return errors.Trace(e)
+			}
+			if _, e := tx.ExecContext(c, tableQuery, engine.tableName); e != nil {
+				return errors.Trace(e)
+			}
+			count += engine.chunks
+		}
+		return nil
+	})
+	return count, errors.Trace(err)
+}
+
 func (cpdb *MySQLCheckpointsDB) DumpTables(ctx context.Context, writer io.Writer) error {
 	rows, err := cpdb.db.QueryContext(ctx, fmt.Sprintf(`
 		SELECT
@@ -995,6 +1726,7 @@ func (cpdb *MySQLCheckpointsDB) DumpEngines(ctx context.Context, writer io.Write
 			table_name,
 			engine_id,
 			status,
+			importer,
 			create_time,
 			update_time
 		FROM %s.%s;
@@ -1021,6 +1753,9 @@ func (cpdb *MySQLCheckpointsDB) DumpChunks(ctx context.Context, writer io.Writer
 			kvc_bytes,
 			kvc_kvs,
 			kvc_checksum,
+			file_size,
+			file_mod_time,
+			quarantine_reason,
 			create_time,
 			update_time
 		FROM %s.%s;
@@ -1038,13 +1773,31 @@ func (cpdb *FileCheckpointsDB) RemoveCheckpoint(_ context.Context, tableName str
 	defer cpdb.lock.Unlock()
 
 	if tableName == "all" {
-		cpdb.checkpoints.Reset()
+		cpdb.resetCheckpoints()
 	} else {
 		delete(cpdb.checkpoints.Checkpoints, tableName)
 	}
 	return errors.Trace(cpdb.save())
 }
 
+// ArchiveCheckpoints renames the checkpoint file by appending the archive time,
+// e.g. "/tmp/tidb_lightning_checkpoint.pb.20190101150405", and starts over
+// with an empty file.
+func (cpdb *FileCheckpointsDB) ArchiveCheckpoints(_ context.Context, archiveTime time.Time) error {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	if err := cpdb.save(); err != nil {
+		return errors.Trace(err)
+	}
+	archivePath := cpdb.path + "." + archiveTime.Format(checkpointArchiveTimeFmt)
+	if err := os.Rename(cpdb.path, archivePath); err != nil {
+		return errors.Trace(err)
+	}
+	cpdb.resetCheckpoints()
+	return errors.Trace(cpdb.save())
+}
+
 func (cpdb *FileCheckpointsDB) IgnoreErrorCheckpoint(_ context.Context, targetTableName string) error {
 	cpdb.lock.Lock()
 	defer cpdb.lock.Unlock()
@@ -1053,14 +1806,7 @@ func (cpdb *FileCheckpointsDB) IgnoreErrorCheckpoint(_ context.Context, targetTa
 		if !(targetTableName == "all" || targetTableName == tableName) {
 			continue
 		}
-		if tableModel.Status <= uint32(CheckpointStatusMaxInvalid) {
-			tableModel.Status = uint32(CheckpointStatusLoaded)
-		}
-		for _, engineModel := range tableModel.Engines {
-			if engineModel.Status <= uint32(CheckpointStatusMaxInvalid) {
-				engineModel.Status = uint32(CheckpointStatusLoaded)
-			}
-		}
+		tableModel.ignoreError()
 	}
 	return errors.Trace(cpdb.save())
 }
@@ -1095,6 +1841,41 @@ func (cpdb *FileCheckpointsDB) DestroyErrorCheckpoint(_ context.Context, targetT
 	return targetTables, nil
 }
 
+func (cpdb *FileCheckpointsDB) RetryEngineCheckpoint(_ context.Context, tableName string, engineID int) error {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	tableModel, ok := cpdb.checkpoints.Checkpoints[tableName]
+	if !ok || engineID < 0 || engineID >= len(tableModel.Engines) {
+		return errors.Errorf("engine %s:%d not found in checkpoint", tableName, engineID)
+	}
+	tableModel.retryEngine(engineID)
+	return errors.Trace(cpdb.save())
+}
+
+func (cpdb *FileCheckpointsDB) RetryChunkCheckpoints(_ context.Context, targetTableName string) (int, error) {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	for tableName, tableModel := range cpdb.checkpoints.Checkpoints {
+		if !(targetTableName == "all" || targetTableName == tableName) {
+			continue
+		}
+		if err := tableModel.checkQuarantinedChunks(tableName); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	count := 0
+	for tableName, tableModel := range cpdb.checkpoints.Checkpoints {
+		if !(targetTableName == "all" || targetTableName == tableName) {
+			continue
+		}
+		count += tableModel.retryQuarantinedChunks()
+	}
+	return count, errors.Trace(cpdb.save())
+}
+
 func (cpdb *FileCheckpointsDB) DumpTables(context.Context, io.Writer) error {
 	return errors.Errorf("dumping file checkpoint into CSV not unsupported, you may copy %s instead", cpdb.path)
 }
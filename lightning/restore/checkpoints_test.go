@@ -0,0 +1,444 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/pingcap/tidb-lightning/lightning/metric"
+	"github.com/pingcap/tidb-lightning/lightning/mydump"
+	verify "github.com/pingcap/tidb-lightning/lightning/verification"
+)
+
+var _ = Suite(&checkpointsSuite{})
+
+type checkpointsSuite struct {
+	dir string
+}
+
+func (s *checkpointsSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *checkpointsSuite) newFileCheckpointsDB(c *C) *FileCheckpointsDB {
+	ctx := context.Background()
+	cpdb := NewFileCheckpointsDB(filepath.Join(s.dir, "cp.pb"))
+	err := cpdb.Initialize(ctx, map[string]*TidbDBInfo{
+		"db": {
+			Name: "db",
+			Tables: map[string]*TidbTableInfo{
+				"t": {Name: "t"},
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	err = cpdb.InsertEngineCheckpoints(ctx, "`db`.`t`", []*EngineCheckpoint{
+		{
+			Status: CheckpointStatusLoaded,
+			Chunks: []*ChunkCheckpoint{{
+				Key:   ChunkCheckpointKey{Path: "/tmp/db.t.1.sql"},
+				Chunk: mydump.Chunk{Offset: 0, EndOffset: 100, PrevRowIDMax: 0, RowIDMax: 20},
+			}},
+		},
+		{
+			Status: CheckpointStatusLoaded,
+			Chunks: []*ChunkCheckpoint{
+				{
+					Key:   ChunkCheckpointKey{Path: "/tmp/db.t.2.sql"},
+					Chunk: mydump.Chunk{Offset: 0, EndOffset: 100, PrevRowIDMax: 20, RowIDMax: 40},
+				},
+				{
+					Key:   ChunkCheckpointKey{Path: "/tmp/db.t.3.sql"},
+					Chunk: mydump.Chunk{Offset: 0, EndOffset: 100, PrevRowIDMax: 40, RowIDMax: 60},
+				},
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+	return cpdb
+}
+
+func (s *checkpointsSuite) TestRetryEngineCheckpoint(c *C) {
+	ctx := context.Background()
+	cpdb := s.newFileCheckpointsDB(c)
+	defer cpdb.Close()
+
+	// simulate progress on all engines, and a failure on engine 1.
+	cpd := NewTableCheckpointDiff()
+	(&ChunkCheckpointMerger{
+		EngineID: 0,
+		Key:      ChunkCheckpointKey{Path: "/tmp/db.t.1.sql"},
+		Checksum: verify.MakeKVChecksum(10, 2, 333),
+		Pos:      100,
+		RowID:    15,
+	}).MergeInto(cpd)
+	(&ChunkCheckpointMerger{
+		EngineID: 1,
+		Key:      ChunkCheckpointKey{Path: "/tmp/db.t.3.sql"},
+		Checksum: verify.MakeKVChecksum(10, 2, 444),
+		Pos:      50,
+		RowID:    45,
+	}).MergeInto(cpd)
+	(&StatusCheckpointMerger{EngineID: 0, Status: CheckpointStatusImported}).MergeInto(cpd)
+	(&StatusCheckpointMerger{EngineID: 1, Status: CheckpointStatusImported / 10}).MergeInto(cpd)
+	c.Assert(cpdb.Update(context.Background(), map[string]*TableCheckpointDiff{"`db`.`t`": cpd}), IsNil)
+
+	err := cpdb.RetryEngineCheckpoint(ctx, "`db`.`t`", 1)
+	c.Assert(err, IsNil)
+
+	cp, err := cpdb.Get(ctx, "`db`.`t`")
+	c.Assert(err, IsNil)
+	c.Assert(cp.Status, Equals, CheckpointStatusLoaded)
+
+	// the sibling engine is untouched.
+	c.Assert(cp.Engines[0].Status, Equals, CheckpointStatusImported)
+	c.Assert(cp.Engines[0].Chunks[0].Chunk.Offset, Equals, int64(100))
+	c.Assert(cp.Engines[0].Chunks[0].Chunk.PrevRowIDMax, Equals, int64(15))
+	c.Assert(cp.Engines[0].Chunks[0].Checksum.Sum(), Equals, uint64(333))
+
+	// the retried engine starts over.
+	c.Assert(cp.Engines[1].Status, Equals, CheckpointStatusLoaded)
+	c.Assert(cp.Engines[1].Chunks[1].Chunk.Offset, Equals, int64(0))
+	c.Assert(cp.Engines[1].Chunks[1].Chunk.PrevRowIDMax, Equals, int64(40))
+	c.Assert(cp.Engines[1].Chunks[1].Checksum.SumKVS(), Equals, uint64(0))
+	c.Assert(cp.Engines[1].Chunks[0].Chunk.PrevRowIDMax, Equals, int64(20))
+
+	err = cpdb.RetryEngineCheckpoint(ctx, "`db`.`t`", 2)
+	c.Assert(err, ErrorMatches, "engine `db`.`t`:2 not found in checkpoint")
+}
+
+func (s *checkpointsSuite) TestRetryChunkCheckpoints(c *C) {
+	ctx := context.Background()
+	cpdb := s.newFileCheckpointsDB(c)
+	defer cpdb.Close()
+
+	// quarantine a chunk in engine 1 after it delivered half of the data.
+	cpd := NewTableCheckpointDiff()
+	(&ChunkCheckpointMerger{
+		EngineID: 1,
+		Key:      ChunkCheckpointKey{Path: "/tmp/db.t.3.sql"},
+		Checksum: verify.MakeKVChecksum(10, 2, 444),
+		Pos:      50,
+		RowID:    45,
+	}).MergeInto(cpd)
+	(&QuarantineCheckpointMerger{
+		EngineID: 1,
+		Key:      ChunkCheckpointKey{Path: "/tmp/db.t.3.sql"},
+		Reason:   "bad row",
+	}).MergeInto(cpd)
+	(&StatusCheckpointMerger{EngineID: 1, Status: CheckpointStatusClosed}).MergeInto(cpd)
+	c.Assert(cpdb.Update(context.Background(), map[string]*TableCheckpointDiff{"`db`.`t`": cpd}), IsNil)
+
+	cp, err := cpdb.Get(ctx, "`db`.`t`")
+	c.Assert(err, IsNil)
+	c.Assert(cp.Engines[1].Chunks[1].QuarantineReason, Equals, "bad row")
+	c.Assert(cp.Engines[1].Chunks[1].Chunk.Offset, Equals, int64(50))
+
+	// the chunk cannot be retried before the engine is imported.
+	_, err = cpdb.RetryChunkCheckpoints(ctx, "all")
+	c.Assert(err, ErrorMatches, "engine `db`.`t`:1 with quarantined chunks is not yet imported.*")
+
+	cpd = NewTableCheckpointDiff()
+	(&StatusCheckpointMerger{EngineID: 1, Status: CheckpointStatusImported}).MergeInto(cpd)
+	(&StatusCheckpointMerger{EngineID: -1, Status: CheckpointStatusImported}).MergeInto(cpd)
+	c.Assert(cpdb.Update(context.Background(), map[string]*TableCheckpointDiff{"`db`.`t`": cpd}), IsNil)
+
+	count, err := cpdb.RetryChunkCheckpoints(ctx, "`db`.`t`")
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 1)
+
+	cp, err = cpdb.Get(ctx, "`db`.`t`")
+	c.Assert(err, IsNil)
+	c.Assert(cp.Status, Equals, CheckpointStatusLoaded)
+	c.Assert(cp.Engines[0].Status, Equals, CheckpointStatusLoaded)
+	c.Assert(cp.Engines[1].Status, Equals, CheckpointStatusLoaded)
+	// the chunk resumes from where it was quarantined.
+	c.Assert(cp.Engines[1].Chunks[1].QuarantineReason, Equals, "")
+	c.Assert(cp.Engines[1].Chunks[1].Chunk.Offset, Equals, int64(50))
+	c.Assert(cp.Engines[1].Chunks[1].Checksum.Sum(), Equals, uint64(444))
+}
+
+func (s *checkpointsSuite) TestFileCheckpointsPersisted(c *C) {
+	cpdb := s.newFileCheckpointsDB(c)
+	c.Assert(cpdb.Close(), IsNil)
+
+	_, err := os.Stat(filepath.Join(s.dir, "cp.pb"))
+	c.Assert(err, IsNil)
+
+	cpdb = NewFileCheckpointsDB(filepath.Join(s.dir, "cp.pb"))
+	defer cpdb.Close()
+	cp, err := cpdb.Get(context.Background(), "`db`.`t`")
+	c.Assert(err, IsNil)
+	c.Assert(cp.Engines, HasLen, 2)
+	c.Assert(cp.CountChunks(), Equals, 3)
+}
+
+func (s *checkpointsSuite) TestExportCheckpointMetrics(c *C) {
+	cpdb := s.newFileCheckpointsDB(c)
+	defer cpdb.Close()
+
+	cpd := NewTableCheckpointDiff()
+	(&ChunkCheckpointMerger{
+		EngineID: 1,
+		Key:      ChunkCheckpointKey{Path: "/tmp/db.t.2.sql"},
+		Pos:      70,
+		RowID:    30,
+	}).MergeInto(cpd)
+	(&StatusCheckpointMerger{EngineID: 0, Status: CheckpointStatusImported}).MergeInto(cpd)
+	c.Assert(cpdb.Update(context.Background(), map[string]*TableCheckpointDiff{"`db`.`t`": cpd}), IsNil)
+
+	rc := &RestoreController{
+		dbMetas: []*mydump.MDDatabaseMeta{{
+			Name:   "db",
+			Tables: []*mydump.MDTableMeta{{DB: "db", Name: "t"}},
+		}},
+		checkpointsDB: cpdb,
+	}
+	rc.exportCheckpointMetrics(context.Background())
+
+	c.Assert(testutil.ToFloat64(metric.CheckpointTablesGauge.WithLabelValues("pending")), Equals, 1.0)
+	c.Assert(testutil.ToFloat64(metric.CheckpointEnginesGauge.WithLabelValues("pending")), Equals, 1.0)
+	c.Assert(testutil.ToFloat64(metric.CheckpointEnginesGauge.WithLabelValues("imported")), Equals, 1.0)
+	// engine 0 is already imported, so only the unread parts of engine 1 remain.
+	c.Assert(testutil.ToFloat64(metric.CheckpointRemainingBytesGauge.WithLabelValues("`db`.`t`")), Equals, 130.0)
+}
+
+func (s *checkpointsSuite) TestFileArchiveCheckpoints(c *C) {
+	ctx := context.Background()
+	cpdb := s.newFileCheckpointsDB(c)
+
+	archiveTime := time.Date(2019, 1, 2, 15, 4, 5, 0, time.Local)
+	err := cpdb.ArchiveCheckpoints(ctx, archiveTime)
+	c.Assert(err, IsNil)
+	c.Assert(cpdb.Close(), IsNil)
+
+	archived := NewFileCheckpointsDB(filepath.Join(s.dir, "cp.pb.20190102150405"))
+	cp, err := archived.Get(ctx, "`db`.`t`")
+	c.Assert(err, IsNil)
+	c.Assert(cp.CountChunks(), Equals, 3)
+
+	cpdb = NewFileCheckpointsDB(filepath.Join(s.dir, "cp.pb"))
+	defer cpdb.Close()
+	c.Assert(cpdb.checkpoints.Checkpoints, HasLen, 0)
+}
+
+func (s *checkpointsSuite) TestMySQLArchiveCheckpoints(c *C) {
+	ctx := context.Background()
+	archiveTime := time.Date(2019, 1, 2, 15, 4, 5, 0, time.Local)
+
+	expectArchive := func(mock *mockDB) *mockStatement {
+		for _, table := range []string{"table_v5_history", "engine_v5_history", "chunk_v5_history"} {
+			mock.expect("^BEGIN$")
+			mock.expect("CREATE TABLE IF NOT EXISTS `cp`." + table)
+			mock.expect("^COMMIT$")
+		}
+		mock.expect("^BEGIN$")
+		mock.expect("INSERT INTO `cp`.chunk_v5_history", archiveTime, int64(nodeID))
+		mock.expect("INSERT INTO `cp`.engine_v5_history", archiveTime, int64(nodeID))
+		mock.expect("INSERT INTO `cp`.table_v5_history", archiveTime, int64(nodeID))
+		mock.expect("DELETE FROM `cp`.chunk_v5", int64(nodeID))
+		mock.expect("DELETE FROM `cp`.engine_v5", int64(nodeID))
+		return mock.expect("DELETE FROM `cp`.table_v5", int64(nodeID))
+	}
+
+	// the checkpoints are copied and removed in the same transaction.
+	db, mock := newMockDB()
+	expectArchive(mock)
+	mock.expect("DELETE FROM `cp`.progress_v5", int64(nodeID))
+	mock.expect("^COMMIT$")
+	cpdb := &MySQLCheckpointsDB{db: db, schema: "`cp`"}
+	c.Assert(cpdb.ArchiveCheckpoints(ctx, archiveTime), IsNil)
+	c.Assert(mock.check(), IsNil)
+	c.Assert(db.Close(), IsNil)
+
+	// nothing is archived if they cannot be removed.
+	db, mock = newMockDB()
+	expectArchive(mock).willFail(&mysql.MySQLError{Number: 1146, Message: "cannot delete"})
+	mock.expect("^ROLLBACK$")
+	cpdb = &MySQLCheckpointsDB{db: db, schema: "`cp`"}
+	c.Assert(cpdb.ArchiveCheckpoints(ctx, archiveTime), ErrorMatches, ".*cannot delete")
+	c.Assert(mock.check(), IsNil)
+	c.Assert(db.Close(), IsNil)
+}
+
+// parseTableColumns returns the name, type and nullability of every column
+// created by the CREATE TABLE statement.
+func parseTableColumns(c *C, query string) []string {
+	stmt, err := parser.New().ParseOneStmt(query, "", "")
+	c.Assert(err, IsNil)
+	var columns []string
+	for _, col := range stmt.(*ast.CreateTableStmt).Cols {
+		notNull := false
+		for _, opt := range col.Options {
+			if opt.Tp == ast.ColumnOptionNotNull {
+				notNull = true
+			}
+		}
+		columns = append(columns, fmt.Sprintf("%s %s not-null=%v", col.Name.Name.L, col.Tp, notNull))
+	}
+	return columns
+}
+
+func (s *checkpointsSuite) TestMySQLHistorySchema(c *C) {
+	ctx := context.Background()
+	db, mock := newMockDB()
+	defer db.Close()
+	expectDDL := func(pattern string) *mockStatement {
+		mock.expect("^BEGIN$")
+		stmt := mock.expect(pattern)
+		mock.expect("^COMMIT$")
+		return stmt
+	}
+
+	expectDDL("CREATE DATABASE IF NOT EXISTS `cp`")
+	archived := []string{checkpointTableNameTable, checkpointTableNameEngine, checkpointTableNameChunk}
+	live := make(map[string]*mockStatement)
+	for _, table := range archived {
+		live[table] = expectDDL("CREATE TABLE IF NOT EXISTS `cp`." + table + " ")
+	}
+	expectDDL("CREATE TABLE IF NOT EXISTS `cp`." + checkpointTableNameTask + " ")
+	expectDDL("CREATE TABLE IF NOT EXISTS `cp`." + checkpointTableNameMeta + " ")
+	cpdb, err := NewMySQLCheckpointsDB(ctx, db, "cp")
+	c.Assert(err, IsNil)
+
+	history := make(map[string]*mockStatement)
+	for _, table := range []string{checkpointTableNameTable, checkpointTableNameEngine, checkpointTableNameChunk} {
+		history[table] = expectDDL("CREATE TABLE IF NOT EXISTS `cp`." + table + "_history")
+	}
+	mock.expect("^BEGIN$")
+	insert := make(map[string]*mockStatement)
+	for _, table := range []string{checkpointTableNameChunk, checkpointTableNameEngine, checkpointTableNameTable} {
+		insert[table] = mock.expect("INSERT INTO `cp`." + table + "_history")
+	}
+	for _, table := range []string{checkpointTableNameChunk, checkpointTableNameEngine, checkpointTableNameTable, checkpointTableNameTask} {
+		mock.expect("DELETE FROM `cp`." + table)
+	}
+	mock.expect("^COMMIT$")
+	c.Assert(cpdb.ArchiveCheckpoints(ctx, time.Now()), IsNil)
+	c.Assert(mock.check(), IsNil)
+
+	// the history tables have every column of the checkpoint tables, followed
+	// by the archive time, and all of them are copied.
+	insertColumns := regexp.MustCompile(`\(([^()]*), archive_time\)\s*SELECT ([^?]*), \?`)
+	for _, table := range archived {
+		liveColumns := parseTableColumns(c, live[table].query)
+		c.Assert(parseTableColumns(c, history[table].query), DeepEquals,
+			append(liveColumns, "archive_time timestamp not-null=true"), Commentf("table %s", table))
+
+		names := make([]string, 0, len(liveColumns))
+		for _, col := range liveColumns {
+			names = append(names, strings.Fields(col)[0])
+		}
+		match := insertColumns.FindStringSubmatch(insert[table].query)
+		c.Assert(match, HasLen, 3, Commentf("%s", insert[table].query))
+		c.Assert(match[1], Equals, strings.Join(names, ", "))
+		c.Assert(match[2], Equals, match[1])
+	}
+}
+
+func (s *checkpointsSuite) TestFileGetNotFound(c *C) {
+	ctx := context.Background()
+	cpdb := NewFileCheckpointsDB(filepath.Join(s.dir, "cp.pb"))
+	defer cpdb.Close()
+
+	// before initialized.
+	_, err := cpdb.Get(ctx, "`db`.`t`")
+	c.Assert(isCheckpointNotFound(err), IsTrue)
+
+	// after removed.
+	cpdb = s.newFileCheckpointsDB(c)
+	c.Assert(cpdb.RemoveCheckpoint(ctx, "all"), IsNil)
+	_, err = cpdb.Get(ctx, "`db`.`t`")
+	c.Assert(isCheckpointNotFound(err), IsTrue)
+}
+
+func (s *checkpointsSuite) TestFileTaskProgress(c *C) {
+	ctx := context.Background()
+	cpdb := s.newFileCheckpointsDB(c)
+
+	progress, err := cpdb.GetTaskProgress(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(progress, IsNil)
+
+	startTime := time.Date(2019, 1, 2, 15, 4, 5, 0, time.Local)
+	err = cpdb.UpdateTaskProgress(ctx, &TaskProgress{StartTime: startTime, Elapsed: time.Hour, BytesRead: 12345})
+	c.Assert(err, IsNil)
+	c.Assert(cpdb.Close(), IsNil)
+
+	cpdb = NewFileCheckpointsDB(filepath.Join(s.dir, "cp.pb"))
+	progress, err = cpdb.GetTaskProgress(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(progress.StartTime.Equal(startTime), IsTrue)
+	c.Assert(progress.Elapsed, Equals, time.Hour)
+	c.Assert(progress.BytesRead, Equals, int64(12345))
+
+	// the progress starts over with the checkpoints.
+	c.Assert(cpdb.RemoveCheckpoint(ctx, "all"), IsNil)
+	progress, err = cpdb.GetTaskProgress(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(progress, IsNil)
+	c.Assert(cpdb.Close(), IsNil)
+}
+
+func (s *checkpointsSuite) TestFileTaskMeta(c *C) {
+	ctx := context.Background()
+	cpdb := s.newFileCheckpointsDB(c)
+
+	meta, err := cpdb.GetTaskMeta(ctx, "pd-schedulers")
+	c.Assert(err, IsNil)
+	c.Assert(meta, IsNil)
+
+	c.Assert(cpdb.UpdateTaskMeta(ctx, "pd-schedulers", []byte(`{"schedulers":[]}`)), IsNil)
+	c.Assert(cpdb.UpdateTaskMeta(ctx, "tikv-mode", []byte("import")), IsNil)
+	c.Assert(cpdb.Close(), IsNil)
+
+	// the task meta is kept when the checkpoints are removed or archived.
+	cpdb = NewFileCheckpointsDB(filepath.Join(s.dir, "cp.pb"))
+	c.Assert(cpdb.RemoveCheckpoint(ctx, "all"), IsNil)
+	c.Assert(cpdb.ArchiveCheckpoints(ctx, time.Now()), IsNil)
+	meta, err = cpdb.GetTaskMeta(ctx, "pd-schedulers")
+	c.Assert(err, IsNil)
+	c.Assert(string(meta), Equals, `{"schedulers":[]}`)
+
+	c.Assert(cpdb.UpdateTaskMeta(ctx, "pd-schedulers", nil), IsNil)
+	c.Assert(cpdb.Close(), IsNil)
+	cpdb = NewFileCheckpointsDB(filepath.Join(s.dir, "cp.pb"))
+	meta, err = cpdb.GetTaskMeta(ctx, "pd-schedulers")
+	c.Assert(err, IsNil)
+	c.Assert(meta, IsNil)
+	meta, err = cpdb.GetTaskMeta(ctx, "tikv-mode")
+	c.Assert(err, IsNil)
+	c.Assert(string(meta), Equals, "import")
+	c.Assert(cpdb.Close(), IsNil)
+}
+
+func (s *checkpointsSuite) TestChunkUpdateQuery(c *C) {
+	query := chunkUpdateQuery("`cp`", 2)
+	c.Assert(strings.HasPrefix(query, "UPDATE `cp`.chunk_v5 c JOIN (SELECT ? AS table_name, ? AS engine_id, ? AS path, ? AS offset, ? AS pos, ? AS prev_rowid_max, ? AS kvc_bytes, ? AS kvc_kvs, ? AS kvc_checksum UNION ALL SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?) d ON "), IsTrue, Commentf("%s", query))
+	c.Assert(strings.Count(query, "?"), Equals, 2*chunkUpdateArgs)
+	c.Assert(strings.Count(chunkUpdateQuery("`cp`", chunkUpdateBatchSize), "?"), Equals, chunkUpdateBatchSize*chunkUpdateArgs)
+}
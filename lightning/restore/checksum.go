@@ -0,0 +1,278 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/metric"
+	"github.com/pingcap/tidb-lightning/lightning/worker"
+)
+
+const (
+	defaultGCLifeTime = 100 * time.Hour
+)
+
+// the name of the increased tikv_gc_life_time shared among the instances.
+const sharedGCLifeTime = "gc-life-time"
+
+// checksumManager runs the remote checksum of multiple tables, at most
+// `concurrency` of them at the same time.
+//
+// Every checksum needs the old MVCC versions kept from GC. This is done once
+// when the first checksum starts, and undone only after the last running
+// checksum finishes, so parallel checksums won't race with each other.
+//
+// The data is protected by a GC service safe point in PD, which expires by
+// itself if Lightning crashed. When PD does not support it (before v4.0), the
+// tikv_gc_life_time is increased instead, which is shared with the other
+// instances if coordination is enabled.
+type checksumManager struct {
+	db          *sql.DB
+	tls         *common.TLS
+	pdAddr      string
+	workers     *worker.Pool
+	coordinator *coordinator
+
+	mu            sync.Mutex
+	running       int
+	keeper        *serviceSafePointKeeper // nil if using tikv_gc_life_time
+	oriGCLifeTime string
+}
+
+func newChecksumManager(ctx context.Context, db *sql.DB, tls *common.TLS, pdAddr string, concurrency int, co *coordinator) *checksumManager {
+	return &checksumManager{
+		db:          db,
+		tls:         tls,
+		pdAddr:      pdAddr,
+		workers:     worker.NewPool(ctx, concurrency, "checksum"),
+		coordinator: co,
+	}
+}
+
+func (m *checksumManager) protectFromGC(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running == 0 {
+		keeper, err := startServiceSafePointKeeper(ctx, m.tls, m.pdAddr)
+		if err == nil {
+			m.keeper = keeper
+		} else {
+			if common.IsContextCanceledError(err) {
+				return errors.Trace(err)
+			}
+			common.AppLogger.Warnf("cannot register GC service safe point, increasing tikv_gc_life_time instead: %v", err)
+			if m.coordinator != nil {
+				err = m.coordinator.acquireShared(ctx, sharedGCLifeTime, func() (string, error) {
+					return increaseGCLifeTime(ctx, m.db)
+				})
+				if err != nil {
+					return errors.Trace(err)
+				}
+			} else {
+				ori, err := increaseGCLifeTime(ctx, m.db)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				m.oriGCLifeTime = ori
+			}
+		}
+	}
+	m.running++
+	return nil
+}
+
+func (m *checksumManager) unprotectFromGC() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running--
+	if m.running > 0 {
+		return
+	}
+	if m.keeper != nil {
+		m.keeper.stop()
+		m.keeper = nil
+		return
+	}
+	// the context may have been canceled, but the GC life time must be
+	// restored regardless.
+	var err error
+	if m.coordinator != nil {
+		err = m.coordinator.releaseShared(context.Background(), sharedGCLifeTime, func(ori string) error {
+			return UpdateGCLifeTime(context.Background(), m.db, ori)
+		})
+	} else {
+		err = UpdateGCLifeTime(context.Background(), m.db, m.oriGCLifeTime)
+	}
+	if err != nil {
+		common.AppLogger.Errorf("update tikv_gc_life_time error %v", errors.ErrorStack(err))
+	}
+}
+
+// checksum computes the remote checksum of the table, waiting for a free slot
+// if too many tables are being checksummed.
+func (m *checksumManager) checksum(ctx context.Context, table string) (*RemoteChecksum, error) {
+	var cs *RemoteChecksum
+	err := m.run(ctx, func() error {
+		var err error
+		cs, err = remoteChecksum(ctx, m.db, table)
+		return err
+	})
+	return cs, errors.Trace(err)
+}
+
+// rowCount counts the rows of the table, sharing the slots and the GC
+// protection with the checksums.
+func (m *checksumManager) rowCount(ctx context.Context, table string) (int64, error) {
+	var count int64
+	err := m.run(ctx, func() error {
+		var err error
+		count, err = remoteRowCount(ctx, m.db, table)
+		return err
+	})
+	return count, errors.Trace(err)
+}
+
+// run verifies a table by fn, with the old MVCC versions kept from GC.
+func (m *checksumManager) run(ctx context.Context, fn func() error) error {
+	metric.ChecksumTablesGauge.WithLabelValues(metric.ChecksumStateWaiting).Inc()
+	w := m.workers.Apply()
+	metric.ChecksumTablesGauge.WithLabelValues(metric.ChecksumStateWaiting).Dec()
+	defer m.workers.Recycle(w)
+
+	metric.ChecksumTablesGauge.WithLabelValues(metric.ChecksumStateRunning).Inc()
+	defer metric.ChecksumTablesGauge.WithLabelValues(metric.ChecksumStateRunning).Dec()
+
+	start := time.Now()
+	if err := m.protectFromGC(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	err := fn()
+	m.unprotectFromGC()
+
+	metric.ChecksumSecondsHistogram.Observe(time.Since(start).Seconds())
+	if err != nil {
+		metric.ChecksumTableCounter.WithLabelValues(metric.TableResultFailure).Inc()
+		return errors.Trace(err)
+	}
+	metric.ChecksumTableCounter.WithLabelValues(metric.TableResultSuccess).Inc()
+	return nil
+}
+
+// RemoteChecksum represents a checksum result got from tidb.
+type RemoteChecksum struct {
+	Schema     string
+	Table      string
+	Checksum   uint64
+	TotalKVs   uint64
+	TotalBytes uint64
+}
+
+func (c *RemoteChecksum) String() string {
+	return fmt.Sprintf("[%s] remote_checksum=%d, total_kvs=%d, total_bytes=%d", common.UniqueTable(c.Schema, c.Table), c.Checksum, c.TotalKVs, c.TotalBytes)
+}
+
+// DoChecksum do checksum for tables.
+// table should be in <db>.<table>, format.  e.g. foo.bar
+// The tikv_gc_life_time is increased during the checksum. The restore process
+// uses checksumManager instead, which relies on the PD service safe point.
+func DoChecksum(ctx context.Context, db *sql.DB, table string) (*RemoteChecksum, error) {
+	timer := time.Now()
+
+	ori, err := increaseGCLifeTime(ctx, db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// set it back finally
+	defer func() {
+		err = UpdateGCLifeTime(ctx, db, ori)
+		if err != nil && !common.IsContextCanceledError(err) {
+			common.TableLogger(table).Errorf("update tikv_gc_life_time error %v", errors.ErrorStack(err))
+		}
+	}()
+
+	cs, err := remoteChecksum(ctx, db, table)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	common.TableLogger(table).Infof("do checksum takes %v", time.Since(timer))
+	return cs, nil
+}
+
+// remoteChecksum runs ADMIN CHECKSUM TABLE without touching the GC life time.
+func remoteChecksum(ctx context.Context, db *sql.DB, table string) (*RemoteChecksum, error) {
+	// ADMIN CHECKSUM TABLE <table>,<table>  example.
+	// 	mysql> admin checksum table test.t;
+	// +---------+------------+---------------------+-----------+-------------+
+	// | Db_name | Table_name | Checksum_crc64_xor  | Total_kvs | Total_bytes |
+	// +---------+------------+---------------------+-----------+-------------+
+	// | test    | t          | 8520875019404689597 |   7296873 |   357601387 |
+	// +---------+------------+---------------------+-----------+-------------+
+
+	cs := RemoteChecksum{}
+	common.TableLogger(table).Info("doing remote checksum")
+	query := fmt.Sprintf("ADMIN CHECKSUM TABLE %s", table)
+	err := common.QueryRowWithRetry(ctx, db, query, &cs.Schema, &cs.Table, &cs.Checksum, &cs.TotalKVs, &cs.TotalBytes)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &cs, nil
+}
+
+// remoteRowCount runs SELECT COUNT(*) without touching the GC life time.
+func remoteRowCount(ctx context.Context, db *sql.DB, table string) (int64, error) {
+	var count int64
+	common.TableLogger(table).Info("doing remote row count")
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s", table)
+	err := common.QueryRowWithRetry(ctx, db, query, &count)
+	return count, errors.Trace(err)
+}
+
+func increaseGCLifeTime(ctx context.Context, db *sql.DB) (oriGCLifeTime string, err error) {
+	// checksum command usually takes a long time to execute,
+	// so here need to increase the gcLifeTime for single transaction.
+	oriGCLifeTime, err = ObtainGCLifeTime(ctx, db)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	var increaseGCLifeTime bool
+	if oriGCLifeTime != "" {
+		ori, err := time.ParseDuration(oriGCLifeTime)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if ori < defaultGCLifeTime {
+			increaseGCLifeTime = true
+		}
+	} else {
+		increaseGCLifeTime = true
+	}
+
+	if increaseGCLifeTime {
+		err = UpdateGCLifeTime(ctx, db, defaultGCLifeTime.String())
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+
+	return oriGCLifeTime, nil
+}
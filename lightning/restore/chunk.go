@@ -0,0 +1,821 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cznic/mathutil"
+	"github.com/opentracing/opentracing-go"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/kvencoder"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/config"
+	"github.com/pingcap/tidb-lightning/lightning/kv"
+	"github.com/pingcap/tidb-lightning/lightning/metric"
+	"github.com/pingcap/tidb-lightning/lightning/mydump"
+	verify "github.com/pingcap/tidb-lightning/lightning/verification"
+	"github.com/pingcap/tidb-lightning/lightning/worker"
+)
+
+type chunkRestore struct {
+	parser *mydump.ChunkParser
+	index  int
+	chunk  *ChunkCheckpoint
+
+	// with the TiDB backend, the statements start with `insert` rather than
+	// "INSERT INTO", and the _tidb_rowid column is left to TiDB.
+	insert   string
+	noRowIDs bool
+
+	// the offsets of the table columns of the values in the rows, built from
+	// the column list of the chunk.
+	permutation []int
+
+	// the random source of sampling the rows, created on the first row.
+	sampleRand *rand.Rand
+
+	// the delivery tracked for the stall detection, nil if not tracked.
+	activity *chunkActivity
+}
+
+func newChunkRestore(index int, chunk *ChunkCheckpoint, blockBufSize int64, readEngine string, ioWorkers *worker.Pool) (*chunkRestore, error) {
+	reader, err := mydump.OpenDataFile(chunk.Key.Path, readEngine)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	parser := mydump.NewChunkParser(reader, blockBufSize, ioWorkers)
+
+	reader.Seek(chunk.Chunk.Offset, io.SeekStart)
+	parser.SetPos(chunk.Chunk.Offset, chunk.Chunk.PrevRowIDMax)
+
+	return &chunkRestore{
+		parser: parser,
+		index:  index,
+		chunk:  chunk,
+	}, nil
+}
+
+func (cr *chunkRestore) close() {
+	cr.parser.Reader().(io.Closer).Close()
+}
+
+const (
+	maxKVQueueSize  = 128
+	maxDeliverBytes = 31 << 20 // 31 MB. hardcoded by importer, so do we
+	// the maximum number of streams delivering the KV pairs of a chunk
+	// concurrently.
+	maxDeliverStreams = 4
+)
+
+func splitIntoDeliveryStreams(totalKVs []kvenc.KvPair, splitSize int) [][]kvenc.KvPair {
+	res := make([][]kvenc.KvPair, 0, 1)
+	i := 0
+	cumSize := 0
+
+	for j, pair := range totalKVs {
+		size := len(pair.Key) + len(pair.Val)
+		if i < j && cumSize+size > splitSize {
+			res = append(res, totalKVs[i:j])
+			i = j
+			cumSize = 0
+		}
+		cumSize += size
+	}
+
+	return append(res, totalKVs[i:])
+}
+
+// readStatement reads the rows of the chunk until `endOffset`, and writes them
+// into the buffer as a single INSERT statement. Nothing is written if there are
+// no more rows.
+func (cr *chunkRestore) readStatement(t *TableRestore, buffer *bytes.Buffer, endOffset int64) error {
+	var sep byte = ' '
+readLoop:
+	for cr.parser.Pos() < endOffset {
+		readRowStartTime := time.Now()
+		err := cr.parser.ReadRow()
+		switch errors.Cause(err) {
+		case nil:
+			buffer.WriteByte(sep)
+			if sep == ' ' {
+				if len(cr.insert) != 0 {
+					buffer.WriteString(cr.insert)
+				} else {
+					buffer.WriteString("INSERT INTO ")
+				}
+				buffer.WriteString(t.tableName)
+				if cr.chunk.Columns == nil {
+					t.initializeColumns(cr.parser.Columns, cr.chunk, cr.noRowIDs)
+				}
+				buffer.Write(cr.chunk.Columns)
+				buffer.WriteString(" VALUES ")
+				sep = ','
+			}
+			metric.ChunkParserReadRowSecondsHistogram.Observe(time.Since(readRowStartTime).Seconds())
+			cr.writeRow(buffer, cr.parser.LastRow())
+		case io.EOF:
+			cr.chunk.Chunk.EndOffset = cr.parser.Pos()
+			break readLoop
+		default:
+			return common.WithCategory(errors.Trace(err), common.ErrorCategorySourceData)
+		}
+	}
+	if sep == ',' { // quick and dirty way to check if `buffer` actually contained any values
+		buffer.WriteByte(';')
+	}
+	return nil
+}
+
+// writeRow writes the values of the row into the buffer, appending the row ID
+// if the _tidb_rowid column is included.
+func (cr *chunkRestore) writeRow(buffer *bytes.Buffer, row mydump.Row) {
+	if cr.chunk.ShouldIncludeRowID {
+		buffer.Write(row.Row[:len(row.Row)-1])
+		fmt.Fprintf(buffer, ",%d)", row.RowID)
+	} else {
+		buffer.Write(row.Row)
+	}
+}
+
+// encodeRows reads the rows of the chunk until `endOffset`, and encodes them
+// into KV pairs. The rows are parsed into datums and encoded directly (or
+// through prepared statements, see kv.TableKVEncoder.UsePrepareStmt), except
+// those which cannot be (e.g. containing function calls), which are encoded
+// from single-row INSERT statements instead. It returns the KV pairs appended
+// to `kvs`, the number of rows and the time spent on reading.
+func (cr *chunkRestore) encodeRows(
+	t *TableRestore,
+	kvEncoder *kv.TableKVEncoder,
+	kvs []kvenc.KvPair,
+	endOffset int64,
+) (_ []kvenc.KvPair, rows uint64, readDur time.Duration, err error) {
+	var buffer bytes.Buffer
+	for cr.parser.Pos() < endOffset {
+		row, err := cr.readRow(t, kvEncoder, &readDur)
+		switch errors.Cause(err) {
+		case nil:
+		case io.EOF:
+			return kvs, rows, readDur, nil
+		default:
+			return nil, 0, readDur, errors.Trace(err)
+		}
+
+		pairs, err := cr.encodeRow(t, kvEncoder, row, &buffer)
+		if err != nil {
+			return nil, 0, readDur, errors.Trace(err)
+		}
+		kvs = append(kvs, pairs...)
+		rows++
+	}
+	return kvs, rows, readDur, nil
+}
+
+// encodeRowsParallel reads the rows of the chunk until `endOffset` like
+// encodeRows, and splits them into continuous parts encoded by the encoders
+// concurrently. The KV pairs are appended to `kvs` in the order of the rows,
+// the same as encoding them with a single encoder.
+func (cr *chunkRestore) encodeRowsParallel(
+	t *TableRestore,
+	kvEncoders []*kv.TableKVEncoder,
+	kvs []kvenc.KvPair,
+	endOffset int64,
+) (_ []kvenc.KvPair, rows uint64, readDur time.Duration, err error) {
+	// the pending rows reference the read buffers handed over by the parser
+	// instead of copies, until they are all encoded.
+	cr.parser.RetainRows()
+	defer cr.parser.ReleaseRows()
+
+	var pending []offsetRow
+readLoop:
+	for cr.parser.Pos() < endOffset {
+		row, err := cr.readRow(t, kvEncoders[0], &readDur)
+		switch errors.Cause(err) {
+		case nil:
+		case io.EOF:
+			break readLoop
+		default:
+			return nil, 0, readDur, errors.Trace(err)
+		}
+		pending = append(pending, row)
+	}
+
+	parts := make([][]kvenc.KvPair, len(kvEncoders))
+	errs := make([]error, len(kvEncoders))
+	partSize := (len(pending) + len(kvEncoders) - 1) / len(kvEncoders)
+	var wg sync.WaitGroup
+	for i := range kvEncoders {
+		start := mathutil.Min(i*partSize, len(pending))
+		end := mathutil.Min(start+partSize, len(pending))
+		wg.Add(1)
+		go func(i int, rows []offsetRow) {
+			defer wg.Done()
+			var buffer bytes.Buffer
+			for _, row := range rows {
+				pairs, err := cr.encodeRow(t, kvEncoders[i], row, &buffer)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				parts[i] = append(parts[i], pairs...)
+			}
+		}(i, pending[start:end])
+	}
+	wg.Wait()
+
+	// the error of the earliest row is reported.
+	for _, err := range errs {
+		if err != nil {
+			return nil, 0, readDur, errors.Trace(err)
+		}
+	}
+	for _, part := range parts {
+		kvs = append(kvs, part...)
+	}
+	return kvs, uint64(len(pending)), readDur, nil
+}
+
+// offsetRow is a row read from the chunk, with its offset in the data file.
+type offsetRow struct {
+	mydump.Row
+	offset int64
+}
+
+// readRow reads the next row of the chunk, initializing the columns of the
+// chunk when the first row is read. The time spent is added to `readDur`.
+// io.EOF is returned at the end of the data file.
+func (cr *chunkRestore) readRow(t *TableRestore, kvEncoder *kv.TableKVEncoder, readDur *time.Duration) (offsetRow, error) {
+	rowOffset := cr.parser.Pos()
+	readRowStartTime := time.Now()
+	err := cr.parser.ReadRow()
+	switch errors.Cause(err) {
+	case nil:
+	case io.EOF:
+		cr.chunk.Chunk.EndOffset = cr.parser.Pos()
+		return offsetRow{}, err
+	default:
+		return offsetRow{}, common.WithCategory(errors.Annotatef(err, "failed to read %s at offset %d", cr.chunk.Key.Path, rowOffset), common.ErrorCategorySourceData)
+	}
+	readRowDur := time.Since(readRowStartTime)
+	*readDur += readRowDur
+	metric.ChunkParserReadRowSecondsHistogram.Observe(readRowDur.Seconds())
+
+	if cr.chunk.Columns == nil {
+		t.initializeColumns(cr.parser.Columns, cr.chunk, cr.noRowIDs)
+		cr.permutation = nil
+	}
+	if cr.permutation == nil {
+		if cr.permutation, err = kvEncoder.ColumnPermutation(cr.chunk.Columns); err != nil {
+			return offsetRow{}, errors.Trace(err)
+		}
+	}
+	if t.sampler != nil {
+		cr.sample(t, kvEncoder, rowOffset)
+	}
+	return offsetRow{Row: cr.parser.LastRow(), offset: rowOffset}, nil
+}
+
+// encodeRow encodes a row read by readRow into KV pairs. `buffer` is used for
+// building the INSERT statement if the row cannot be encoded directly.
+func (cr *chunkRestore) encodeRow(t *TableRestore, kvEncoder *kv.TableKVEncoder, row offsetRow, buffer *bytes.Buffer) ([]kvenc.KvPair, error) {
+	// the row IDs must stay in the range of the chunk, so they neither
+	// collide with the other chunks nor change when the chunk is resumed.
+	if row.RowID > cr.chunk.Chunk.RowIDMax {
+		err := errors.Errorf("row ID exceeds the maximum %d of the chunk", cr.chunk.Chunk.RowIDMax)
+		return nil, cr.encodeError(t, row.Row, row.offset, err)
+	}
+	var pairs []kvenc.KvPair
+	values, err := kvEncoder.ParseRow(row.Row.Row)
+	if err == nil {
+		if cr.chunk.ShouldIncludeRowID {
+			values = append(values, types.NewIntDatum(kvEncoder.ShardRowID(row.RowID)))
+		}
+		if kvEncoder.UsePrepareStmt() {
+			pairs, err = kvEncoder.EncodePrepared(cr.permutation, values, row.RowID)
+		} else {
+			pairs, err = kvEncoder.Datums2KV(cr.permutation, values, row.RowID)
+		}
+	}
+	if errors.Cause(err) == kv.ErrUnsupportedValue {
+		buffer.Reset()
+		buffer.WriteString("INSERT INTO ")
+		buffer.WriteString(t.tableName)
+		buffer.Write(cr.chunk.Columns)
+		buffer.WriteString(" VALUES ")
+		cr.writeRow(buffer, mydump.Row{RowID: kvEncoder.ShardRowID(row.RowID), Row: row.Row.Row})
+		pairs, _, err = kvEncoder.SQL2KV(buffer.String())
+	}
+	if err != nil {
+		return nil, cr.encodeError(t, row.Row, row.offset, err)
+	}
+	return pairs, nil
+}
+
+// maxRowSnippetLen is the maximum length of the row quoted in the encoding
+// errors.
+const maxRowSnippetLen = 256
+
+// encodeError annotates the error of encoding the row with where the row is,
+// so the bad data can be located in the data file.
+func (cr *chunkRestore) encodeError(t *TableRestore, row mydump.Row, offset int64, err error) error {
+	err = errors.Annotatef(common.RedactError(err), "failed to encode row %d of table %s at offset %d of %s: %s",
+		row.RowID, t.tableName, offset, cr.chunk.Key.Path, common.RedactString(rowSnippet(row.Row)))
+	return common.WithCategory(err, common.ErrorCategorySourceData)
+}
+
+// rowSnippet quotes the row for the logs, truncated to maxRowSnippetLen bytes.
+func rowSnippet(row []byte) string {
+	if len(row) <= maxRowSnippetLen {
+		return strconv.Quote(string(row))
+	}
+	return fmt.Sprintf("%s... (%d bytes)", strconv.Quote(string(row[:maxRowSnippetLen])), len(row))
+}
+
+func (cr *chunkRestore) restore(
+	ctx context.Context,
+	t *TableRestore,
+	engineID int,
+	engine *kv.OpenedEngine,
+	rc *RestoreController,
+) (err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "chunk", opentracing.Tags{
+		"table":  t.tableName,
+		"engine": engineID,
+		"chunk":  cr.chunk.Key.String(),
+	})
+	defer func() { finishSpan(span, err) }()
+
+	cr.activity = rc.trackChunk(t.tableName, engineID, &cr.chunk.Key)
+	defer rc.untrackChunk(cr.activity)
+
+	if rc.importer.RowsFormat() == kv.RowsFormatSQL {
+		return errors.Trace(cr.restoreStatements(ctx, t, engineID, engine, rc))
+	}
+
+	// Create the encoders, one for each goroutine encoding the rows.
+	opts := rc.encoderOpts
+	opts.sqlMode = rc.cfg.TiDB.SQLModeOf(t.dbInfo.Name, t.tableInfo.Name)
+	kvEncoders := make([]*kv.TableKVEncoder, 0, rc.cfg.App.EncodeConcurrency)
+	defer func() {
+		for _, kvEncoder := range kvEncoders {
+			if closeErr := kvEncoder.Close(); closeErr != nil {
+				common.AppLogger.Errorf("restore chunk task err %v", errors.ErrorStack(closeErr))
+			}
+		}
+	}()
+	for i := 0; i < cap(kvEncoders); i++ {
+		kvEncoder, err := t.newKVEncoder(opts)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		kvEncoders = append(kvEncoders, kvEncoder)
+	}
+
+	timer := time.Now()
+	readTotalDur := time.Duration(0)
+	encodeTotalDur := time.Duration(0)
+	sizer := newBlockSizer(int64(rc.cfg.Mydumper.ReadBlockSize), rc.cfg.Mydumper.AdaptiveReadBlockSize)
+
+	kvsCh := make(chan encodedBatch, maxKVQueueSize)
+	// the slices of the delivered batches are sent back for reuse.
+	freeKVsCh := make(chan []kvenc.KvPair, maxKVQueueSize)
+	deliverCompleteCh := make(chan deliverResult, 1)
+	go func() {
+		deliverCompleteCh <- cr.deliverLoop(ctx, t, engineID, engine, rc, kvsCh, freeKVsCh)
+	}()
+
+	// stop the deliver goroutine when encoding is interrupted, so it can
+	// save the watermark and exit. A failed chunk may be restarted from the
+	// watermark, so also wait until the deliver goroutine stops updating it.
+	encodeCompleted := false
+	deliverFinished := false
+	defer func() {
+		if !encodeCompleted {
+			close(kvsCh)
+		}
+		if !deliverFinished {
+			<-deliverCompleteCh
+		}
+		// the batches left behind if the deliver goroutine failed.
+		for batch := range kvsCh {
+			batch.buffers.Recycle()
+			rc.memoryQuota.Release(int64(batch.checksum.SumSize()))
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		endOffset := mathutil.MinInt64(cr.chunk.Chunk.EndOffset, cr.parser.Pos()+sizer.size)
+		if cr.parser.Pos() >= endOffset {
+			break
+		}
+
+		// the KV pairs waiting for delivery in all chunks are bounded too,
+		// since the queue of each chunk alone may not fit with wide rows.
+		quotaWaitStart := time.Now()
+		if err := rc.memoryQuota.Wait(ctx); err != nil {
+			return errors.Trace(err)
+		}
+		rc.tuner.addBackpressureTime(time.Since(quotaWaitStart))
+
+		var kvs []kvenc.KvPair
+		select {
+		case kvs = <-freeKVsCh:
+		default:
+		}
+
+		// rows -> kv
+		startOffset := cr.parser.Pos()
+		start := time.Now()
+		var rows uint64
+		var readDur time.Duration
+		var err error
+		if len(kvEncoders) > 1 {
+			kvs, rows, readDur, err = cr.encodeRowsParallel(t, kvEncoders, kvs, endOffset)
+		} else {
+			kvs, rows, readDur, err = cr.encodeRows(t, kvEncoders[0], kvs, endOffset)
+		}
+		encodeDur := time.Since(start) - readDur
+		buffers := new(kv.KVBuffers)
+		for _, kvEncoder := range kvEncoders {
+			buffers.Merge(kvEncoder.TakeKVBuffers())
+		}
+		if err != nil {
+			buffers.Recycle()
+			common.AppLogger.Errorf("kv encode failed = %s\n", err.Error())
+			return errors.Trace(err)
+		}
+		if rows == 0 {
+			buffers.Recycle()
+			continue
+		}
+
+		traceBlock(span, start, readDur, encodeDur, startOffset, cr.parser.Pos(), rows)
+		readTotalDur += readDur
+		metric.BlockReadSecondsHistogram.Observe(readDur.Seconds())
+		metric.BlockReadBytesHistogram.Observe(float64(cr.parser.Pos() - startOffset))
+		encodeTotalDur += encodeDur
+		metric.BlockEncodeSecondsHistogram.Observe(encodeDur.Seconds())
+		rc.tuner.addEncodeTime(encodeDur)
+		if sizer.observe(cr.parser.Pos()-startOffset, encodeDur) {
+			cr.parser.SetBlockSize(sizer.size)
+			common.EngineLogger(t.tableName, engineID).WithField(common.LogFieldChunk, cr.chunk.Key.String()).Debugf("block size -> %d", sizer.size)
+		}
+		common.AppLogger.Debugf("len(kvs) %d, rows %d", len(kvs), rows)
+
+		batch := encodedBatch{
+			kvs:      kvs,
+			buffers:  buffers,
+			checksum: verify.MakeKVChecksum(0, 0, 0),
+			rows:     rows,
+			offset:   cr.parser.Pos(),
+			rowID:    cr.parser.LastRow().RowID,
+		}
+		batch.checksum.Update(kvs)
+		batchSize := int64(batch.checksum.SumSize())
+		rc.memoryQuota.Consume(batchSize)
+
+		// the queue is bounded, which blocks the encoding when delivery is
+		// slower, so the KV pairs won't pile up in memory.
+		waitStart := time.Now()
+		select {
+		case kvsCh <- batch:
+		case result := <-deliverCompleteCh:
+			// the deliver goroutine stopped early because of an error.
+			deliverFinished = true
+			buffers.Recycle()
+			rc.memoryQuota.Release(batchSize)
+			return errors.Trace(result.err)
+		case <-ctx.Done():
+			buffers.Recycle()
+			rc.memoryQuota.Release(batchSize)
+			return ctx.Err()
+		}
+		rc.tuner.addBackpressureTime(time.Since(waitStart))
+	}
+
+	encodeCompleted = true
+	close(kvsCh)
+
+	select {
+	case result := <-deliverCompleteCh:
+		deliverFinished = true
+		if result.err == nil {
+			common.EngineLogger(t.tableName, engineID).WithField(common.LogFieldChunk, cr.chunk.Key.String()).Infof(
+				"restore chunk #%d takes %v (read: %v, encode: %v, deliver: %v)",
+				cr.index, time.Since(timer), readTotalDur, encodeTotalDur, result.deliverDur,
+			)
+			span.SetTag("read_seconds", readTotalDur.Seconds())
+			span.SetTag("encode_seconds", encodeTotalDur.Seconds())
+			span.SetTag("deliver_seconds", result.deliverDur.Seconds())
+			t.phases.add(tablePhaseRead, readTotalDur)
+			t.phases.add(tablePhaseEncode, encodeTotalDur)
+			t.phases.add(tablePhaseDeliver, result.deliverDur)
+		}
+		return errors.Trace(result.err)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// traceBlock records the reading and encoding of a block as the child spans
+// of the chunk. The rows are read and encoded one by one, so the spans are
+// laid out one after another with the total durations of each step.
+func traceBlock(chunkSpan opentracing.Span, start time.Time, readDur, encodeDur time.Duration, startOffset, endOffset int64, rows uint64) {
+	tracer := chunkSpan.Tracer()
+	readSpan := tracer.StartSpan("read", opentracing.ChildOf(chunkSpan.Context()), opentracing.StartTime(start), opentracing.Tags{
+		"offset": startOffset,
+		"bytes":  endOffset - startOffset,
+	})
+	readSpan.FinishWithOptions(opentracing.FinishOptions{FinishTime: start.Add(readDur)})
+	encodeSpan := tracer.StartSpan("encode", opentracing.ChildOf(chunkSpan.Context()), opentracing.StartTime(start.Add(readDur)), opentracing.Tags{
+		"rows": rows,
+	})
+	encodeSpan.FinishWithOptions(opentracing.FinishOptions{FinishTime: start.Add(readDur + encodeDur)})
+}
+
+// encodedBatch is the KV pairs encoded from a block of rows, passed from the
+// encoding to the delivery.
+type encodedBatch struct {
+	kvs      []kvenc.KvPair
+	buffers  *kv.KVBuffers // the memory of kvs
+	checksum verify.KVChecksum
+	rows     uint64
+	// the watermark of the chunk after delivering the batch.
+	offset int64
+	rowID  int64
+}
+
+type deliverResult struct {
+	deliverDur time.Duration
+	err        error
+}
+
+// deliverLoop writes the batches received from kvsCh into the engine, and
+// advances the watermark of the chunk, until kvsCh is closed. The pending
+// batches are delivered together, written through up to maxDeliverStreams
+// streams concurrently.
+func (cr *chunkRestore) deliverLoop(
+	ctx context.Context,
+	t *TableRestore,
+	engineID int,
+	engine *kv.OpenedEngine,
+	rc *RestoreController,
+	kvsCh <-chan encodedBatch,
+	freeKVsCh chan<- []kvenc.KvPair,
+) (result deliverResult) {
+	var totalKVs []kvenc.KvPair
+	lastFlush := time.Now()
+	for {
+		var batch encodedBatch
+		var ok bool
+		select {
+		case batch, ok = <-kvsCh:
+		case <-ctx.Done():
+			// interrupted, resuming delivers the blocks after the last
+			// flush again, which puts the same KV pairs.
+			result.err = ctx.Err()
+			return
+		}
+		if !ok {
+			result.err = errors.Trace(cr.flushCheckpoint(ctx, t, engineID, engine, rc))
+			return
+		}
+
+		// take the other pending batches too, up to the size of the streams.
+		var buffers kv.KVBuffers
+		var offset, rowID int64
+		var rows uint64
+		checksum := verify.MakeKVChecksum(0, 0, 0)
+		totalKVs = totalKVs[:0]
+		for pending := true; pending; {
+			totalKVs = append(totalKVs, batch.kvs...)
+			buffers.Merge(batch.buffers)
+			checksum.Add(&batch.checksum)
+			rows += batch.rows
+			offset, rowID = batch.offset, batch.rowID
+			select {
+			case freeKVsCh <- batch.kvs[:0]:
+			default:
+			}
+
+			pending = false
+			if checksum.SumSize() < maxDeliverStreams*maxDeliverBytes {
+				select {
+				case batch, pending = <-kvsCh:
+				default:
+				}
+			}
+		}
+
+		// kv -> deliver ( -> tikv )
+		start := time.Now()
+		span, deliverCtx := opentracing.StartSpanFromContext(ctx, "deliver", opentracing.Tags{
+			"kvs":   len(totalKVs),
+			"bytes": checksum.SumSize(),
+		})
+		err := cr.deliverKVs(deliverCtx, engine, totalKVs)
+		finishSpan(span, err)
+		// the backends do not retain the KV pairs, so their memory is
+		// reused by the following blocks.
+		buffers.Recycle()
+		rc.memoryQuota.Release(int64(checksum.SumSize()))
+		deliverDur := time.Since(start)
+		result.deliverDur += deliverDur
+		metric.BlockDeliverSecondsHistogram.WithLabelValues(metric.TableLabel(t.tableName)).Observe(deliverDur.Seconds())
+		metric.BlockDeliverBytesHistogram.WithLabelValues(metric.TableLabel(t.tableName)).Observe(float64(checksum.SumSize()))
+
+		if err != nil {
+			if !common.IsContextCanceledError(err) {
+				common.EngineLogger(t.tableName, engineID).Errorf("kv deliver failed = %v", err)
+			}
+			// TODO : retry ~
+			result.err = errors.Trace(err)
+			return
+		}
+
+		// Advance the delivered watermark.
+		// (the write to the importer is effective immediately, thus update these here)
+		cr.chunk.Checksum.Add(&checksum)
+		cr.chunk.Chunk.Offset = offset
+		cr.chunk.Chunk.PrevRowIDMax = rowID
+		rc.diskQuota.Consume(int64(checksum.SumSize()))
+		atomic.AddUint64(&t.rows, rows)
+		cr.activity.delivered(int64(checksum.SumSize()), time.Now())
+
+		// Periodically flush the engine and save the watermark, so that
+		// resuming will restart exactly from the last flushed position.
+		if time.Since(lastFlush) >= rc.cfg.Cron.FlushCheckpoint.Duration {
+			if err := cr.flushCheckpoint(ctx, t, engineID, engine, rc); err != nil {
+				result.err = errors.Trace(err)
+				return
+			}
+			lastFlush = time.Now()
+		}
+	}
+}
+
+// deliverKVs writes the KV pairs into the engine, split into streams of at
+// most maxDeliverBytes which are written concurrently.
+func (cr *chunkRestore) deliverKVs(ctx context.Context, engine *kv.OpenedEngine, kvs []kvenc.KvPair) error {
+	streams := splitIntoDeliveryStreams(kvs, maxDeliverBytes)
+	if len(streams) == 1 {
+		return errors.Trace(engine.WriteRows(ctx, kv.KVRows(streams[0])))
+	}
+	var wg sync.WaitGroup
+	var streamErr common.OnceError
+	for _, stream := range streams {
+		wg.Add(1)
+		go func(stream []kvenc.KvPair) {
+			defer wg.Done()
+			if err := engine.WriteRows(ctx, kv.KVRows(stream)); err != nil {
+				streamErr.Set("deliver", err)
+			}
+		}(stream)
+	}
+	wg.Wait()
+	return errors.Trace(streamErr.Get())
+}
+
+// insertStatementPrefix returns how the statements of the TiDB backend start,
+// according to `tikv-importer.on-duplicate`.
+func insertStatementPrefix(onDuplicate string) string {
+	switch onDuplicate {
+	case config.OnDuplicateIgnore:
+		return "INSERT IGNORE INTO "
+	case config.OnDuplicateError:
+		return "INSERT INTO "
+	default:
+		return "REPLACE INTO "
+	}
+}
+
+// restoreStatements restores the chunk with the TiDB backend, executing the
+// statements read from the chunk one by one. Nothing is encoded, so the chunk
+// checksum is left empty.
+//
+// With on-duplicate = "error", the checkpoint is flushed after every statement,
+// so a previous run may have executed at most the first statement of a resumed
+// chunk without recording it. That statement is replayed with INSERT IGNORE, so
+// that the rows already inserted are not reported as duplicates. Otherwise the
+// checkpoint is flushed every cron.flush-checkpoint, and the statements after
+// it are replayed as they are.
+func (cr *chunkRestore) restoreStatements(
+	ctx context.Context,
+	t *TableRestore,
+	engineID int,
+	engine *kv.OpenedEngine,
+	rc *RestoreController,
+) error {
+	strict := rc.cfg.TikvImporter.OnDuplicate == config.OnDuplicateError
+	cr.insert = insertStatementPrefix(rc.cfg.TikvImporter.OnDuplicate)
+	if strict && t.resumed {
+		cr.insert = insertStatementPrefix(config.OnDuplicateIgnore)
+	}
+	cr.noRowIDs = true
+
+	timer := time.Now()
+	readTotalDur := time.Duration(0)
+	deliverTotalDur := time.Duration(0)
+
+	lastFlush := time.Now()
+
+	var buffer bytes.Buffer
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		endOffset := mathutil.MinInt64(cr.chunk.Chunk.EndOffset, cr.parser.Pos()+int64(rc.cfg.Mydumper.ReadBlockSize))
+		if cr.parser.Pos() >= endOffset {
+			break
+		}
+
+		buffer.Reset()
+		start := time.Now()
+		readSpan, _ := opentracing.StartSpanFromContext(ctx, "read", opentracing.Tags{"offset": cr.parser.Pos()})
+		err := cr.readStatement(t, &buffer, endOffset)
+		readSpan.SetTag("bytes", buffer.Len())
+		finishSpan(readSpan, err)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if buffer.Len() == 0 {
+			continue
+		}
+		readDur := time.Since(start)
+		readTotalDur += readDur
+		metric.BlockReadSecondsHistogram.Observe(readDur.Seconds())
+		metric.BlockReadBytesHistogram.Observe(float64(buffer.Len()))
+
+		start = time.Now()
+		deliverSpan, deliverCtx := opentracing.StartSpanFromContext(ctx, "deliver", opentracing.Tags{"bytes": buffer.Len()})
+		err = engine.WriteRows(deliverCtx, kv.SQLRows(buffer.String()))
+		finishSpan(deliverSpan, err)
+		if err != nil {
+			if !common.IsContextCanceledError(err) {
+				common.EngineLogger(t.tableName, engineID).Errorf("execute statement failed = %v", err)
+			}
+			return errors.Trace(err)
+		}
+		deliverDur := time.Since(start)
+		deliverTotalDur += deliverDur
+		metric.BlockDeliverSecondsHistogram.WithLabelValues(metric.TableLabel(t.tableName)).Observe(deliverDur.Seconds())
+		metric.BlockDeliverBytesHistogram.WithLabelValues(metric.TableLabel(t.tableName)).Observe(float64(buffer.Len()))
+
+		// the statement is committed, advance the watermark.
+		cr.chunk.Chunk.Offset = cr.parser.Pos()
+		cr.chunk.Chunk.PrevRowIDMax = cr.parser.LastRow().RowID
+		cr.activity.delivered(int64(buffer.Len()), time.Now())
+		cr.insert = insertStatementPrefix(rc.cfg.TikvImporter.OnDuplicate)
+		if strict || time.Since(lastFlush) >= rc.cfg.Cron.FlushCheckpoint.Duration {
+			if err := cr.flushCheckpoint(ctx, t, engineID, engine, rc); err != nil {
+				return errors.Trace(err)
+			}
+			lastFlush = time.Now()
+		}
+	}
+
+	if err := cr.flushCheckpoint(ctx, t, engineID, engine, rc); err != nil {
+		return errors.Trace(err)
+	}
+	common.EngineLogger(t.tableName, engineID).WithField(common.LogFieldChunk, cr.chunk.Key.String()).Infof(
+		"restore chunk #%d takes %v (read: %v, execute: %v)",
+		cr.index, time.Since(timer), readTotalDur, deliverTotalDur,
+	)
+	t.phases.add(tablePhaseRead, readTotalDur)
+	t.phases.add(tablePhaseDeliver, deliverTotalDur)
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span.SetTag("read_seconds", readTotalDur.Seconds())
+		span.SetTag("deliver_seconds", deliverTotalDur.Seconds())
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/tablecodec"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/kv"
+)
+
+const (
+	compactStateIdle int32 = iota
+	compactStateDoing
+)
+
+// the interval of logging the progress of the full compaction.
+const compactProgressInterval = 30 * time.Second
+
+// compactRange is a key range compacted by a single request.
+type compactRange struct {
+	name       string
+	start, end []byte
+}
+
+// tableCompactRanges slices the key space of the restored tables into the
+// ranges of the indices and of the rows of each table (or each partition of a
+// partitioned table), ordered by the keys.
+func tableCompactRanges(dbInfos map[string]*TidbDBInfo) []compactRange {
+	var ranges []compactRange
+	for _, dbInfo := range dbInfos {
+		for _, tableInfo := range dbInfo.Tables {
+			tableName := common.UniqueTable(dbInfo.Name, tableInfo.Name)
+			physicalIDs := []int64{tableInfo.ID}
+			if tableInfo.core != nil {
+				if pi := tableInfo.core.GetPartitionInfo(); pi != nil {
+					physicalIDs = physicalIDs[:0]
+					for _, def := range pi.Definitions {
+						physicalIDs = append(physicalIDs, def.ID)
+					}
+				}
+			}
+			for _, id := range physicalIDs {
+				name := tableName
+				if id != tableInfo.ID {
+					name = fmt.Sprintf("%s partition %d", tableName, id)
+				}
+				ranges = append(ranges,
+					compactRange{
+						name:  name + " indices",
+						start: tablecodec.GenTableIndexPrefix(id),
+						end:   tablecodec.GenTableRecordPrefix(id),
+					},
+					compactRange{
+						name:  name + " rows",
+						start: tablecodec.GenTableRecordPrefix(id),
+						end:   tablecodec.GenTablePrefix(id + 1),
+					},
+				)
+			}
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+	return ranges
+}
+
+// compactRanges compacts the ranges with `post-restore.compact-concurrency`
+// requests running at the same time, and logs the progress periodically, so a
+// long compaction does not look hung.
+func (rc *RestoreController) compactRanges(ctx context.Context, level int32, ranges []compactRange) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	concurrency := rc.cfg.PostRestore.CompactConcurrency
+	if concurrency > len(ranges) {
+		concurrency = len(ranges)
+	}
+	common.AppLogger.Infof("compact level %d of %d ranges, %d at the same time", level, len(ranges), concurrency)
+	start := time.Now()
+
+	rangesCh := make(chan compactRange, len(ranges))
+	for _, r := range ranges {
+		rangesCh <- r
+	}
+	close(rangesCh)
+
+	var finished int32
+	var wg sync.WaitGroup
+	var compactErr common.OnceError
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range rangesCh {
+				if err := rc.importer.CompactRange(ctx, level, r.start, r.end); err != nil {
+					compactErr.Set(r.name, errors.Annotatef(err, "compact %s", r.name))
+					cancel()
+					return
+				}
+				atomic.AddInt32(&finished, 1)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(compactProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			if err := compactErr.Get(); err != nil {
+				return errors.Trace(err)
+			}
+			common.AppLogger.Infof("compact level %d of %d ranges takes %v", level, len(ranges), time.Since(start))
+			return errors.Trace(ctx.Err())
+		case <-ticker.C:
+			common.AppLogger.Infof("compacted %d/%d ranges, elapsed %v", atomic.LoadInt32(&finished), len(ranges), time.Since(start).Round(time.Second))
+		}
+	}
+}
+
+// do full compaction for the whole data.
+func (rc *RestoreController) fullCompact(ctx context.Context) error {
+	// the compaction covers the whole cluster, so it is done only once after
+	// all instances finished importing.
+	if rc.coordinator != nil {
+		return errors.Trace(rc.coordinator.runOnce(ctx, "full-compact", rc.doFullCompact))
+	}
+	return errors.Trace(rc.doFullCompact(ctx))
+}
+
+func (rc *RestoreController) doFullCompact(ctx context.Context) error {
+	if !rc.cfg.PostRestore.Compact || rc.importer.RowsFormat() == kv.RowsFormatSQL {
+		common.AppLogger.Info("Skip full compaction.")
+		return nil
+	}
+
+	// wait until any existing level-1 compact to complete first.
+	common.AppLogger.Info("Wait for existing level 1 compaction to finish")
+	start := time.Now()
+	for !atomic.CompareAndSwapInt32(&rc.compactState, compactStateIdle, compactStateDoing) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	common.AppLogger.Infof("Wait for existing level 1 compaction to finish takes %v", time.Since(start))
+
+	// a single request compacting the whole cluster can run for hours on
+	// a large cluster without telling anything, so the restored tables
+	// are compacted range by range instead.
+	if ranges := tableCompactRanges(rc.dbInfos); len(ranges) > 0 && rc.importer.CanCompactRange() {
+		return errors.Trace(rc.compactRanges(ctx, FullLevelCompact, ranges))
+	}
+	return errors.Trace(rc.doCompact(ctx, FullLevelCompact))
+}
+
+func (rc *RestoreController) doCompact(ctx context.Context, level int32) error {
+	return errors.Trace(rc.importer.Compact(ctx, level))
+}
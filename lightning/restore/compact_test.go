@@ -0,0 +1,114 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/tablecodec"
+
+	"github.com/pingcap/tidb-lightning/lightning/config"
+	"github.com/pingcap/tidb-lightning/lightning/kv"
+)
+
+var _ = Suite(&compactSuite{})
+
+type compactSuite struct{}
+
+func (s *compactSuite) TestTableCompactRanges(c *C) {
+	dbInfos := map[string]*TidbDBInfo{
+		"db": {
+			Name: "db",
+			Tables: map[string]*TidbTableInfo{
+				"t2": {ID: 50, Name: "t2", core: &model.TableInfo{
+					Partition: &model.PartitionInfo{
+						Enable:      true,
+						Definitions: []model.PartitionDefinition{{ID: 51}, {ID: 52}},
+					},
+				}},
+				"t1": {ID: 42, Name: "t1", core: &model.TableInfo{}},
+			},
+		},
+	}
+	ranges := tableCompactRanges(dbInfos)
+
+	var names []string
+	for _, r := range ranges {
+		names = append(names, r.name)
+	}
+	c.Assert(names, DeepEquals, []string{
+		"`db`.`t1` indices",
+		"`db`.`t1` rows",
+		"`db`.`t2` partition 51 indices",
+		"`db`.`t2` partition 51 rows",
+		"`db`.`t2` partition 52 indices",
+		"`db`.`t2` partition 52 rows",
+	})
+	c.Assert(ranges[0].start, DeepEquals, []byte(tablecodec.GenTableIndexPrefix(42)))
+	c.Assert(ranges[0].end, DeepEquals, []byte(tablecodec.GenTableRecordPrefix(42)))
+	c.Assert(ranges[1].start, DeepEquals, []byte(tablecodec.GenTableRecordPrefix(42)))
+	c.Assert(ranges[1].end, DeepEquals, []byte(tablecodec.GenTablePrefix(43)))
+	// the ranges do not overlap.
+	for i := 1; i < len(ranges); i++ {
+		c.Assert(string(ranges[i-1].end) <= string(ranges[i].start), IsTrue)
+	}
+}
+
+// rangeCompactingBackend records the ranges compacted, failing on `failOn`.
+type rangeCompactingBackend struct {
+	kv.Backend
+
+	mu     sync.Mutex
+	ranges []string
+	failOn string
+}
+
+func (be *rangeCompactingBackend) CompactRange(_ context.Context, _ int32, start, end []byte) error {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if string(start) == be.failOn {
+		return errors.New("compaction failed")
+	}
+	be.ranges = append(be.ranges, string(start)+"-"+string(end))
+	return nil
+}
+
+func (s *compactSuite) TestCompactRanges(c *C) {
+	backend := &rangeCompactingBackend{}
+	rc := &RestoreController{cfg: config.NewConfig(), importer: kv.NewBackendImporter(backend)}
+	c.Assert(rc.importer.CanCompactRange(), IsTrue)
+
+	ranges := []compactRange{
+		{name: "a", start: []byte("a"), end: []byte("b")},
+		{name: "b", start: []byte("b"), end: []byte("c")},
+		{name: "c", start: []byte("c"), end: []byte("d")},
+		{name: "d", start: []byte("d"), end: []byte("e")},
+		{name: "e", start: []byte("e"), end: []byte("f")},
+	}
+	c.Assert(rc.compactRanges(context.Background(), FullLevelCompact, ranges), IsNil)
+	sort.Strings(backend.ranges)
+	c.Assert(backend.ranges, DeepEquals, []string{"a-b", "b-c", "c-d", "d-e", "e-f"})
+
+	backend.ranges = nil
+	backend.failOn = "c"
+	err := rc.compactRanges(context.Background(), FullLevelCompact, ranges)
+	c.Assert(err, ErrorMatches, "compact c: compaction failed")
+
+	c.Assert(kv.NewBackendImporter(&recordingBackend{}).CanCompactRange(), IsFalse)
+}
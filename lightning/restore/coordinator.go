@@ -0,0 +1,353 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/pingcap/errors"
+	"github.com/satori/go.uuid"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/config"
+)
+
+const (
+	etcdCoordinationKeyPrefix = "/tidb-lightning/coordination/"
+	coordinationPollInterval  = 5 * time.Second
+	coordinationSessionTTL    = 30 // seconds
+)
+
+// coordinator shares a task among several Lightning instances through etcd.
+// The first instance started assigns an ID to the run of the task, saved in
+// "/tidb-lightning/coordination/$task/run", and all keys of the run are
+// stored under "/tidb-lightning/coordination/$task/runs/$run/":
+//
+//   - "leader": the instance running the global steps, i.e. the first one
+//     started, which expires with the instance.
+//   - "tables/$table": the instance importing the table, which expires with
+//     the instance.
+//   - "finished-tables/$table": the instance which has imported the table.
+//   - "phases/$phase/arrived/$instance": the instances which have reached the
+//     phase.
+//   - "phases/$phase/done": the error message of the phase run by the leader,
+//     empty if succeeded.
+//   - "shared/$name/state": the state of a resource shared by the instances,
+//     saved by the instance which sets it up.
+//   - "shared/$name/users/$instance": the instances using the shared resource,
+//     which expire with the instance.
+//   - "finished/$instance": the instances which have finished the task. The
+//     last one removes the run, so the next task starts afresh.
+//
+// The claims are bound to the instance ID rather than the process, so a
+// restarted instance resumes its own tables. The claims of a crashed instance
+// expire with its session, and the waiting instances take over the leader.
+type coordinator struct {
+	cli        *clientv3.Client
+	session    *concurrency.Session
+	taskPrefix string
+	runID      string
+	prefix     string
+	instanceID string
+	instances  int
+	leader     bool
+
+	pollInterval time.Duration
+}
+
+func newCoordinator(ctx context.Context, tls *common.TLS, cfg *config.Coordination) (*coordinator, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(cfg.Endpoints, ","),
+		DialTimeout: etcdDialTimeout,
+		TLS:         tls.TLSConfig(),
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "cannot connect to etcd at %s", cfg.Endpoints)
+	}
+	session, err := concurrency.NewSession(cli, concurrency.WithTTL(coordinationSessionTTL))
+	if err != nil {
+		cli.Close()
+		return nil, errors.Trace(err)
+	}
+
+	co := &coordinator{
+		cli:        cli,
+		session:    session,
+		taskPrefix: etcdCoordinationKeyPrefix + cfg.Task + "/",
+		instanceID: cfg.InstanceID,
+		instances:  cfg.Instances,
+
+		pollInterval: coordinationPollInterval,
+	}
+	if err := co.joinRun(ctx); err != nil {
+		co.close()
+		return nil, errors.Trace(err)
+	}
+	co.leader, err = co.claim(ctx, co.prefix+"leader")
+	if err != nil {
+		co.close()
+		return nil, errors.Trace(err)
+	}
+	common.AppLogger.Infof("[coordination] instance %s joined run %s of task %s, leader = %v", co.instanceID, co.runID, cfg.Task, co.leader)
+	return co, nil
+}
+
+// joinRun joins the current run of the task, or starts a new run if there is
+// none.
+func (co *coordinator) joinRun(ctx context.Context) error {
+	runKey := co.taskPrefix + "run"
+	runID := uuid.NewV4().String()
+	resp, err := co.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(runKey), "=", 0)).
+		Then(clientv3.OpPut(runKey, runID)).
+		Else(clientv3.OpGet(runKey)).
+		Commit()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !resp.Succeeded {
+		runID = string(resp.Responses[0].GetResponseRange().Kvs[0].Value)
+	}
+	co.runID = runID
+	co.prefix = co.taskPrefix + "runs/" + runID + "/"
+	return nil
+}
+
+func (co *coordinator) close() {
+	co.session.Close()
+	co.cli.Close()
+}
+
+// claim atomically assigns the key to this instance if it is not assigned
+// yet, and returns whether the key belongs to this instance. The key expires
+// with the session, a key claimed by the previous process of this instance is
+// moved to the current session.
+func (co *coordinator) claim(ctx context.Context, key string, extra ...clientv3.Cmp) (bool, error) {
+	lease := clientv3.WithLease(co.session.Lease())
+	resp, err := co.cli.Txn(ctx).
+		If(append(extra, clientv3.Compare(clientv3.CreateRevision(key), "=", 0))...).
+		Then(clientv3.OpPut(key, co.instanceID, lease)).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if resp.Succeeded {
+		return true, nil
+	}
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	if len(kvs) == 0 || string(kvs[0].Value) != co.instanceID {
+		return false, nil
+	}
+	if kvs[0].Lease != int64(co.session.Lease()) {
+		resp, err = co.cli.Txn(ctx).
+			If(clientv3.Compare(clientv3.Value(key), "=", co.instanceID)).
+			Then(clientv3.OpPut(key, co.instanceID, lease)).
+			Commit()
+		if err != nil || !resp.Succeeded {
+			return false, errors.Trace(err)
+		}
+	}
+	return true, nil
+}
+
+// claimTable returns whether this instance should import the table, i.e. the
+// table is claimed by this instance, and not finished by another one.
+func (co *coordinator) claimTable(ctx context.Context, tableName string) (bool, error) {
+	finishedKey := co.prefix + "finished-tables/" + tableName
+	resp, err := co.cli.Get(ctx, finishedKey)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if len(resp.Kvs) > 0 {
+		return string(resp.Kvs[0].Value) == co.instanceID, nil
+	}
+	claimed, err := co.claim(ctx, co.prefix+"tables/"+tableName, clientv3.Compare(clientv3.CreateRevision(finishedKey), "=", 0))
+	return claimed, errors.Trace(err)
+}
+
+// finishTable records the table is imported by this instance, so it is not
+// imported again after the claim expires.
+func (co *coordinator) finishTable(ctx context.Context, tableName string) error {
+	_, err := co.cli.Put(ctx, co.prefix+"finished-tables/"+tableName, co.instanceID)
+	return errors.Trace(err)
+}
+
+// finish records this instance has finished the task. The last instance
+// removes all keys of the run.
+func (co *coordinator) finish(ctx context.Context) error {
+	if _, err := co.cli.Put(ctx, co.prefix+"finished/"+co.instanceID, ""); err != nil {
+		return errors.Trace(err)
+	}
+	resp, err := co.cli.Get(ctx, co.prefix+"finished/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil || resp.Count < int64(co.instances) {
+		return errors.Trace(err)
+	}
+	runKey := co.taskPrefix + "run"
+	_, err = co.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(runKey), "=", co.runID)).
+		Then(
+			clientv3.OpDelete(co.prefix, clientv3.WithPrefix()),
+			clientv3.OpDelete(runKey),
+		).
+		Commit()
+	if err == nil {
+		common.AppLogger.Infof("[coordination] all instances finished run %s, removed", co.runID)
+	}
+	return errors.Trace(err)
+}
+
+func (co *coordinator) poll(ctx context.Context, ready func() (bool, error)) error {
+	ticker := time.NewTicker(co.pollInterval)
+	defer ticker.Stop()
+	for {
+		ok, err := ready()
+		if err != nil || ok {
+			return errors.Trace(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// runOnce waits until all instances have reached the phase, then the leader
+// runs `fn` while the others wait for its result.
+func (co *coordinator) runOnce(ctx context.Context, phase string, fn func(context.Context) error) error {
+	phasePrefix := co.prefix + "phases/" + phase + "/"
+	if _, err := co.cli.Put(ctx, phasePrefix+"arrived/"+co.instanceID, ""); err != nil {
+		return errors.Trace(err)
+	}
+
+	common.AppLogger.Infof("[coordination] waiting for all %d instances to reach %s", co.instances, phase)
+	err := co.poll(ctx, func() (bool, error) {
+		resp, err := co.cli.Get(ctx, phasePrefix+"arrived/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		return resp.Count >= int64(co.instances), nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	doneKey := phasePrefix + "done"
+	if co.leader {
+		err := fn(ctx)
+		if common.IsContextCanceledError(err) {
+			// not finished, the leader will run it again after restarting.
+			return errors.Trace(err)
+		}
+		result := ""
+		if err != nil {
+			result = err.Error()
+		}
+		if _, e := co.cli.Put(ctx, doneKey, result); e != nil {
+			common.AppLogger.Errorf("[coordination] cannot save the result of %s: %v", phase, e)
+			if err == nil {
+				err = e
+			}
+		}
+		return errors.Trace(err)
+	}
+
+	common.AppLogger.Infof("[coordination] waiting for the leader to finish %s", phase)
+	var result string
+	err = co.poll(ctx, func() (bool, error) {
+		resp, err := co.cli.Get(ctx, doneKey)
+		if err != nil || len(resp.Kvs) > 0 {
+			if err == nil {
+				result = string(resp.Kvs[0].Value)
+			}
+			return err == nil, errors.Trace(err)
+		}
+		// the claim of a crashed leader expires, then one of the waiting
+		// instances takes over.
+		co.leader, err = co.claim(ctx, co.prefix+"leader")
+		return co.leader, errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if co.leader {
+		common.AppLogger.Infof("[coordination] the leader is gone, instance %s takes over", co.instanceID)
+		return errors.Trace(co.runOnce(ctx, phase, fn))
+	}
+	if len(result) != 0 {
+		return errors.Errorf("%s failed on the leader instance: %s", phase, result)
+	}
+	return nil
+}
+
+// acquireShared registers this instance as a user of the named resource. If
+// the resource is not set up yet, `setup` is called, and the returned state is
+// saved for the last user to undo the setup in releaseShared.
+func (co *coordinator) acquireShared(ctx context.Context, name string, setup func() (string, error)) error {
+	mu := concurrency.NewMutex(co.session, co.prefix+"locks/"+name)
+	if err := mu.Lock(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	defer mu.Unlock(context.Background())
+
+	sharedPrefix := co.prefix + "shared/" + name + "/"
+	resp, err := co.cli.Get(ctx, sharedPrefix+"state")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(resp.Kvs) == 0 {
+		state, err := setup()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := co.cli.Put(ctx, sharedPrefix+"state", state); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	_, err = co.cli.Put(ctx, sharedPrefix+"users/"+co.instanceID, "", clientv3.WithLease(co.session.Lease()))
+	return errors.Trace(err)
+}
+
+// releaseShared unregisters this instance from the named resource. If no
+// other instances are using it, `teardown` is called with the saved state.
+func (co *coordinator) releaseShared(ctx context.Context, name string, teardown func(state string) error) error {
+	mu := concurrency.NewMutex(co.session, co.prefix+"locks/"+name)
+	if err := mu.Lock(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	defer mu.Unlock(context.Background())
+
+	sharedPrefix := co.prefix + "shared/" + name + "/"
+	if _, err := co.cli.Delete(ctx, sharedPrefix+"users/"+co.instanceID); err != nil {
+		return errors.Trace(err)
+	}
+	users, err := co.cli.Get(ctx, sharedPrefix+"users/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil || users.Count > 0 {
+		return errors.Trace(err)
+	}
+	resp, err := co.cli.Get(ctx, sharedPrefix+"state")
+	if err != nil || len(resp.Kvs) == 0 {
+		return errors.Trace(err)
+	}
+	if err := teardown(string(resp.Kvs[0].Value)); err != nil {
+		return errors.Trace(err)
+	}
+	_, err = co.cli.Delete(ctx, sharedPrefix+"state")
+	return errors.Trace(err)
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/config"
+)
+
+var _ = Suite(&coordinatorSuite{})
+
+type coordinatorSuite struct {
+	etcd *mockEtcd
+}
+
+func (s *coordinatorSuite) SetUpTest(c *C) {
+	var err error
+	s.etcd, err = newMockEtcd()
+	c.Assert(err, IsNil)
+}
+
+func (s *coordinatorSuite) TearDownTest(c *C) {
+	s.etcd.close()
+}
+
+func (s *coordinatorSuite) newCoordinator(c *C, instanceID string) *coordinator {
+	tls, err := common.NewTLS("", "", "")
+	c.Assert(err, IsNil)
+	co, err := newCoordinator(context.Background(), tls, &config.Coordination{
+		Enable:     true,
+		Endpoints:  s.etcd.endpoint(),
+		Task:       "nightly",
+		InstanceID: instanceID,
+		Instances:  2,
+	})
+	c.Assert(err, IsNil)
+	co.pollInterval = 10 * time.Millisecond
+	return co
+}
+
+func (s *coordinatorSuite) claimTable(c *C, co *coordinator, tableName string) bool {
+	claimed, err := co.claimTable(context.Background(), tableName)
+	c.Assert(err, IsNil)
+	return claimed
+}
+
+func (s *coordinatorSuite) TestClaimTables(c *C) {
+	a := s.newCoordinator(c, "a")
+	b := s.newCoordinator(c, "b")
+	defer b.close()
+	c.Assert(a.leader, IsTrue)
+	c.Assert(b.leader, IsFalse)
+	c.Assert(b.runID, Equals, a.runID)
+
+	c.Assert(s.claimTable(c, a, "`db`.`t1`"), IsTrue)
+	c.Assert(s.claimTable(c, a, "`db`.`t2`"), IsTrue)
+	c.Assert(s.claimTable(c, a, "`db`.`t1`"), IsTrue)
+	c.Assert(s.claimTable(c, b, "`db`.`t1`"), IsFalse)
+	c.Assert(a.finishTable(context.Background(), "`db`.`t1`"), IsNil)
+
+	// the claims of the crashed instance expire, except the finished table.
+	s.etcd.expireLeases("a")
+	a.close()
+	c.Assert(s.claimTable(c, b, "`db`.`t1`"), IsFalse)
+	c.Assert(s.claimTable(c, b, "`db`.`t2`"), IsTrue)
+
+	// the restarted instance resumes its finished table only.
+	a = s.newCoordinator(c, "a")
+	defer a.close()
+	c.Assert(a.runID, Equals, b.runID)
+	c.Assert(s.claimTable(c, a, "`db`.`t1`"), IsTrue)
+	c.Assert(s.claimTable(c, a, "`db`.`t2`"), IsFalse)
+}
+
+func (s *coordinatorSuite) TestClaimMovedToNewSession(c *C) {
+	a := s.newCoordinator(c, "a")
+	c.Assert(s.claimTable(c, a, "`db`.`t1`"), IsTrue)
+	// restarted before the old session expires.
+	a.cli.Close()
+	a = s.newCoordinator(c, "a")
+	defer a.close()
+	c.Assert(a.leader, IsTrue)
+	c.Assert(s.claimTable(c, a, "`db`.`t1`"), IsTrue)
+
+	resp, err := a.cli.Get(context.Background(), a.prefix+"tables/`db`.`t1`")
+	c.Assert(err, IsNil)
+	c.Assert(resp.Kvs, HasLen, 1)
+	c.Assert(resp.Kvs[0].Lease, Equals, int64(a.session.Lease()))
+}
+
+func (s *coordinatorSuite) TestRunOnce(c *C) {
+	a := s.newCoordinator(c, "a")
+	defer a.close()
+	b := s.newCoordinator(c, "b")
+	defer b.close()
+
+	ctx := context.Background()
+	runs := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- b.runOnce(ctx, "full-compact", func(context.Context) error {
+			runs++
+			return nil
+		})
+	}()
+	err := a.runOnce(ctx, "full-compact", func(context.Context) error {
+		return errors.New("compaction failed")
+	})
+	c.Assert(err, ErrorMatches, "compaction failed")
+	c.Assert(<-done, ErrorMatches, "full-compact failed on the leader instance: compaction failed")
+	c.Assert(runs, Equals, 0)
+}
+
+func (s *coordinatorSuite) TestLeaderTakeover(c *C) {
+	a := s.newCoordinator(c, "a")
+	b := s.newCoordinator(c, "b")
+	defer b.close()
+
+	// the leader crashed after reaching the phase.
+	ctx := context.Background()
+	_, err := a.cli.Put(ctx, a.prefix+"phases/full-compact/arrived/a", "")
+	c.Assert(err, IsNil)
+	s.etcd.expireLeases("a")
+	a.close()
+
+	runs := 0
+	err = b.runOnce(ctx, "full-compact", func(context.Context) error {
+		runs++
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(runs, Equals, 1)
+	c.Assert(b.leader, IsTrue)
+}
+
+func (s *coordinatorSuite) TestFinish(c *C) {
+	a := s.newCoordinator(c, "a")
+	defer a.close()
+	b := s.newCoordinator(c, "b")
+	defer b.close()
+	ctx := context.Background()
+	c.Assert(s.claimTable(c, a, "`db`.`t1`"), IsTrue)
+	c.Assert(a.finishTable(ctx, "`db`.`t1`"), IsNil)
+
+	c.Assert(a.finish(ctx), IsNil)
+	c.Assert(s.etcd.keys(), Not(HasLen), 0)
+	c.Assert(b.finish(ctx), IsNil)
+	for _, key := range s.etcd.keys() {
+		c.Assert(key, Not(Matches), etcdCoordinationKeyPrefix+".*")
+	}
+
+	// the next task with the same name starts a new run.
+	next := s.newCoordinator(c, "b")
+	defer next.close()
+	c.Assert(next.runID, Not(Equals), a.runID)
+	c.Assert(next.leader, IsTrue)
+	c.Assert(s.claimTable(c, next, "`db`.`t1`"), IsTrue)
+}
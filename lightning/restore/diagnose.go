@@ -0,0 +1,267 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/model"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	verify "github.com/pingcap/tidb-lightning/lightning/verification"
+)
+
+// the maximum number of chunks whose rows are counted in TiDB one by one.
+const maxDiagnosedChunks = 1000
+
+// ChecksumSummary is the checksum of a table, an engine or a chunk.
+type ChecksumSummary struct {
+	Checksum   uint64 `json:"checksum"`
+	TotalKVs   uint64 `json:"total-kvs"`
+	TotalBytes uint64 `json:"total-bytes"`
+	Rows       int64  `json:"rows"`
+}
+
+// ChunkDiagnosis is what is known about a chunk when the table mismatches.
+type ChunkDiagnosis struct {
+	Path        string          `json:"path"`
+	Offset      int64           `json:"offset"`
+	EndOffset   int64           `json:"end-offset"`
+	RowIDStart  int64           `json:"row-id-start"` // exclusive
+	RowIDMax    int64           `json:"row-id-max"`
+	Local       ChecksumSummary `json:"local"`
+	RemoteRows  *int64          `json:"remote-rows,omitempty"`
+	Quarantined string          `json:"quarantined,omitempty"`
+}
+
+// EngineDiagnosis is what is known about an engine when the table mismatches.
+type EngineDiagnosis struct {
+	EngineID   int               `json:"engine-id"`
+	Status     string            `json:"status"`
+	Importer   string            `json:"importer,omitempty"`
+	Local      ChecksumSummary   `json:"local"`
+	RemoteRows *int64            `json:"remote-rows,omitempty"`
+	Chunks     []*ChunkDiagnosis `json:"chunks"`
+}
+
+// ChecksumMismatchReport is written when the data in TiDB differs from the
+// data source after importing, to locate the engines and chunks diverged.
+type ChecksumMismatchReport struct {
+	Table   string             `json:"table"`
+	Time    time.Time          `json:"time"`
+	Method  string             `json:"method"`
+	Remote  ChecksumSummary    `json:"remote"`
+	Local   ChecksumSummary    `json:"local"`
+	Base    *ChecksumSummary   `json:"base,omitempty"` // the existing data of an incremental import
+	Engines []*EngineDiagnosis `json:"engines"`
+	// Suspects are the chunks most likely diverged, as "path:offset".
+	Suspects []string `json:"suspects"`
+	Notes    []string `json:"notes"`
+}
+
+// localRows is the number of rows encoded into the KV pairs, i.e. the KV pairs
+// over the record and one entry for each index.
+func (tr *TableRestore) localRows(kvs uint64) int64 {
+	return int64(kvs / uint64(1+len(tr.tableInfo.core.Indices)))
+}
+
+func (tr *TableRestore) summarize(checksum *verify.KVChecksum) ChecksumSummary {
+	return ChecksumSummary{
+		Checksum:   checksum.Sum(),
+		TotalKVs:   checksum.SumKVS(),
+		TotalBytes: checksum.SumSize(),
+		Rows:       tr.localRows(checksum.SumKVS()),
+	}
+}
+
+// newMismatchReport collects the local checksums of the engines and chunks.
+func (tr *TableRestore) newMismatchReport(cp *TableCheckpoint, method string) *ChecksumMismatchReport {
+	report := &ChecksumMismatchReport{
+		Table:  tr.tableName,
+		Time:   time.Now(),
+		Method: method,
+	}
+	var total verify.KVChecksum
+	for engineID, engine := range cp.Engines {
+		var engineChecksum verify.KVChecksum
+		diagnosis := &EngineDiagnosis{
+			EngineID: engineID,
+			Status:   engine.Status.MetricName(),
+			Importer: engine.Importer,
+		}
+		for _, chunk := range engine.Chunks {
+			engineChecksum.Add(&chunk.Checksum)
+			diagnosis.Chunks = append(diagnosis.Chunks, &ChunkDiagnosis{
+				Path:        chunk.Key.Path,
+				Offset:      chunk.Key.Offset,
+				EndOffset:   chunk.Chunk.EndOffset,
+				RowIDMax:    chunk.Chunk.RowIDMax,
+				Local:       tr.summarize(&chunk.Checksum),
+				Quarantined: chunk.QuarantineReason,
+			})
+		}
+		diagnosis.Local = tr.summarize(&engineChecksum)
+		total.Add(&engineChecksum)
+		report.Engines = append(report.Engines, diagnosis)
+	}
+	report.Local = tr.summarize(&total)
+	report.Notes = append(report.Notes,
+		"the engines are cleaned up from the importer after being imported, only their checkpoints are kept",
+		"TiDB provides no checksum below the table level, the rows in the row ID range of each chunk are counted instead",
+	)
+	return report
+}
+
+// chunkRanges assigns the row ID range to every chunk of the report. The
+// ranges are contiguous, so a chunk starts after the largest row ID of the
+// chunk before it.
+func (report *ChecksumMismatchReport) chunkRanges() []*ChunkDiagnosis {
+	var chunks []*ChunkDiagnosis
+	for _, engine := range report.Engines {
+		chunks = append(chunks, engine.Chunks...)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].RowIDMax < chunks[j].RowIDMax
+	})
+	var start int64
+	for _, chunk := range chunks {
+		chunk.RowIDStart = start
+		start = chunk.RowIDMax
+	}
+	return chunks
+}
+
+// rowIDRangesUsable tells whether the rows of a chunk can be found in TiDB by
+// the row IDs assigned when encoding. Returns the reason if not.
+func (tr *TableRestore) rowIDRangesUsable(cp *TableCheckpoint, incremental bool) string {
+	core := tr.tableInfo.core
+	switch {
+	case core.PKIsHandle:
+		return "the rows are keyed by the integer primary key instead of the row IDs"
+	case core.ShardRowIDBits > 0 || tr.tableInfo.AutoRandomBits > 0:
+		return "the row IDs are sharded"
+	case incremental:
+		return "the row IDs of an incremental import are shifted after the existing rows"
+	}
+	for _, engine := range cp.Engines {
+		for _, chunk := range engine.Chunks {
+			if !chunk.ShouldIncludeRowID {
+				return fmt.Sprintf("the row IDs are given by the data source %s", chunk.Key.Path)
+			}
+		}
+	}
+	if n := cp.CountChunks(); n > maxDiagnosedChunks {
+		return fmt.Sprintf("the table has too many chunks (%d) to count one by one", n)
+	}
+	return ""
+}
+
+// countRemoteRows counts the rows of every chunk in TiDB by its row ID range.
+func (tr *TableRestore) countRemoteRows(ctx context.Context, rc *RestoreController, report *ChecksumMismatchReport) error {
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE `%s` > ? AND `%s` <= ?", tr.tableName, model.ExtraHandleName, model.ExtraHandleName)
+	for _, chunk := range report.chunkRanges() {
+		var rows int64
+		err := common.Retry(ctx, "count rows of "+tr.tableName, func() error {
+			return rc.tidbMgr.db.QueryRowContext(ctx, query, chunk.RowIDStart, chunk.RowIDMax).Scan(&rows)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		chunk.RemoteRows = &rows
+	}
+	for _, engine := range report.Engines {
+		var rows int64
+		for _, chunk := range engine.Chunks {
+			rows += *chunk.RemoteRows
+		}
+		engine.RemoteRows = &rows
+	}
+	return nil
+}
+
+// findSuspects lists the chunks whose rows counted in TiDB differ from those
+// encoded, the largest difference first.
+func (report *ChecksumMismatchReport) findSuspects() {
+	type suspect struct {
+		chunk *ChunkDiagnosis
+		diff  int64
+	}
+	var suspects []suspect
+	for _, engine := range report.Engines {
+		for _, chunk := range engine.Chunks {
+			if chunk.RemoteRows == nil {
+				return
+			}
+			diff := *chunk.RemoteRows - chunk.Local.Rows
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff > 0 {
+				suspects = append(suspects, suspect{chunk: chunk, diff: diff})
+			}
+		}
+	}
+	sort.SliceStable(suspects, func(i, j int) bool {
+		return suspects[i].diff > suspects[j].diff
+	})
+	for _, s := range suspects {
+		report.Suspects = append(report.Suspects, fmt.Sprintf("%s:%d", s.chunk.Path, s.chunk.Offset))
+	}
+	if len(suspects) == 0 {
+		report.Notes = append(report.Notes, "the rows of every chunk are counted the same, "+
+			"the values or the indices are likely diverged, which post-restore.spot-check may locate")
+	}
+}
+
+// diagnoseMismatch completes the report with the rows counted in TiDB, and
+// writes it into the checksum report directory. Returns the path written, or
+// empty if the report cannot be written.
+func (tr *TableRestore) diagnoseMismatch(ctx context.Context, rc *RestoreController, cp *TableCheckpoint, report *ChecksumMismatchReport) string {
+	if reason := tr.rowIDRangesUsable(cp, rc.cfg.App.Incremental); len(reason) > 0 {
+		report.Notes = append(report.Notes, "the rows of the chunks are not counted, "+reason)
+	} else if err := tr.countRemoteRows(ctx, rc, report); err != nil {
+		report.Notes = append(report.Notes, "cannot count the rows of the chunks: "+err.Error())
+	} else {
+		report.findSuspects()
+	}
+
+	path, err := writeMismatchReport(rc.cfg.PostRestore.ChecksumReportDir, tr.tableInfo.ID, report)
+	if err != nil {
+		tr.logger().Warnf("cannot write the checksum mismatch report: %v", err)
+		return ""
+	}
+	return path
+}
+
+// writeMismatchReport writes the report into a new file in the directory, or
+// the temporary directory if empty. Returns the file path.
+func writeMismatchReport(dir string, tableID int64, report *ChecksumMismatchReport) (string, error) {
+	if len(dir) == 0 {
+		dir = os.TempDir()
+	}
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("tidb-lightning-checksum-%d-%s.json", tableID, report.Time.Format("20060102-150405.000")))
+	return path, errors.Trace(ioutil.WriteFile(path, content, 0644))
+}
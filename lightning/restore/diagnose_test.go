@@ -0,0 +1,104 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/parser/model"
+)
+
+var _ = Suite(&diagnoseSuite{})
+
+type diagnoseSuite struct{}
+
+func chunkDiagnosis(path string, rowIDMax int64, localRows int64) *ChunkDiagnosis {
+	return &ChunkDiagnosis{Path: path, RowIDMax: rowIDMax, Local: ChecksumSummary{Rows: localRows}}
+}
+
+func (s *diagnoseSuite) TestChunkRanges(c *C) {
+	report := &ChecksumMismatchReport{
+		Engines: []*EngineDiagnosis{
+			{Chunks: []*ChunkDiagnosis{chunkDiagnosis("a", 10, 10), chunkDiagnosis("c", 40, 15)}},
+			{Chunks: []*ChunkDiagnosis{chunkDiagnosis("b", 25, 15)}},
+		},
+	}
+	chunks := report.chunkRanges()
+	c.Assert(chunks, HasLen, 3)
+	var paths []string
+	var starts []int64
+	for _, chunk := range chunks {
+		paths = append(paths, chunk.Path)
+		starts = append(starts, chunk.RowIDStart)
+	}
+	c.Assert(paths, DeepEquals, []string{"a", "b", "c"})
+	c.Assert(starts, DeepEquals, []int64{0, 10, 25})
+}
+
+func (s *diagnoseSuite) TestFindSuspects(c *C) {
+	rows := func(n int64) *int64 { return &n }
+	a, b, d := chunkDiagnosis("a", 10, 10), chunkDiagnosis("b", 25, 15), chunkDiagnosis("d", 40, 15)
+	a.RemoteRows, b.RemoteRows, d.RemoteRows = rows(9), rows(15), rows(20)
+	report := &ChecksumMismatchReport{
+		Engines: []*EngineDiagnosis{{Chunks: []*ChunkDiagnosis{a, b, d}}},
+	}
+	report.findSuspects()
+	c.Assert(report.Suspects, DeepEquals, []string{"d:0", "a:0"})
+	c.Assert(report.Notes, HasLen, 0)
+
+	// all chunks counted the same.
+	a.RemoteRows, d.RemoteRows = rows(10), rows(15)
+	report.Suspects = nil
+	report.findSuspects()
+	c.Assert(report.Suspects, HasLen, 0)
+	c.Assert(report.Notes, HasLen, 1)
+}
+
+func (s *diagnoseSuite) TestWriteMismatchReport(c *C) {
+	dir, err := ioutil.TempDir("", "lightning-diagnose")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	report := &ChecksumMismatchReport{
+		Table:    "`db`.`t`",
+		Time:     time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC),
+		Suspects: []string{"a:0"},
+	}
+	path, err := writeMismatchReport(dir, 42, report)
+	c.Assert(err, IsNil)
+	c.Assert(filepath.Dir(path), Equals, dir)
+	c.Assert(filepath.Base(path), Equals, "tidb-lightning-checksum-42-20190701-120000.000.json")
+
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	var loaded ChecksumMismatchReport
+	c.Assert(json.Unmarshal(content, &loaded), IsNil)
+	c.Assert(loaded.Table, Equals, report.Table)
+	c.Assert(loaded.Suspects, DeepEquals, report.Suspects)
+}
+
+func (s *diagnoseSuite) TestLocalRows(c *C) {
+	tr := &TableRestore{tableInfo: &TidbTableInfo{core: &model.TableInfo{}}}
+	// every row is a record only.
+	c.Assert(tr.localRows(10), Equals, int64(10))
+	// a record and an entry for each index.
+	tr.tableInfo.core.Indices = make([]*model.IndexInfo, 2)
+	c.Assert(tr.localRows(30), Equals, int64(10))
+	c.Assert(tr.localRows(0), Equals, int64(0))
+}
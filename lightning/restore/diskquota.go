@@ -0,0 +1,61 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// interval between queries of the disk usage while waiting for the disk space.
+const diskUsageCheckInterval = 10 * time.Second
+
+// waitDiskWatermark blocks while the disk storing the engines is used above
+// `tikv-importer.disk-high-watermark`, until the running engines are imported
+// and release their space. It returns immediately if no engine is running,
+// since nothing would release the space then.
+func (rc *RestoreController) waitDiskWatermark(ctx context.Context, logger *log.Entry) error {
+	watermark := rc.cfg.TikvImporter.DiskHighWatermark
+	if watermark <= 0 {
+		return nil
+	}
+
+	waiting := false
+	for {
+		used, capacity, err := rc.importer.DiskUsage(ctx)
+		if err != nil {
+			logger.Warnf("cannot check the disk usage: %v", err)
+			return nil
+		}
+		if capacity == 0 || float64(used) < watermark*float64(capacity) {
+			return nil
+		}
+		if rc.diskQuota.Used() == 0 {
+			logger.Warnf("disk usage %d/%d bytes is above the high watermark, but no engine is running to release the space", used, capacity)
+			return nil
+		}
+		if !waiting {
+			logger.Infof("disk usage %d/%d bytes is above the high watermark, waiting for other engines to be imported", used, capacity)
+			waiting = true
+		}
+
+		select {
+		case <-time.After(diskUsageCheckInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how often the progress on the terminal is refreshed.
+	progressDisplayInterval = time.Second
+	// the width of the progress bars, in characters.
+	progressBarWidth = 30
+	// at most this many active tables are shown, the rest are summarized.
+	maxDisplayedTables = 10
+)
+
+// tableProgress is the number of chunks a table being restored has finished.
+type tableProgress struct {
+	name     string
+	finished int64
+	total    int64
+}
+
+// progressDisplay renders the progress of the task as bars on the terminal,
+// redrawn in place every time.
+type progressDisplay struct {
+	out   io.Writer
+	lines int // the number of lines drawn last time, to be overwritten
+}
+
+// isTerminal returns whether the file is a terminal rather than a pipe or a
+// regular file.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// newProgressDisplay returns the display on stdout if it is a terminal, or nil
+// if the progress should be logged instead. The logs must be written into a
+// file, otherwise they would be mixed with the bars.
+func (rc *RestoreController) newProgressDisplay() *progressDisplay {
+	if !rc.cfg.App.TerminalProgress || len(rc.cfg.App.File) == 0 || !isTerminal(os.Stdout) {
+		return nil
+	}
+	return &progressDisplay{out: os.Stdout}
+}
+
+// tableProgresses returns the progress of the tables being restored, ordered
+// by the names.
+func (rc *RestoreController) tableProgresses() []tableProgress {
+	var tables []tableProgress
+	rc.activeTables.Range(func(key, value interface{}) bool {
+		t := value.(*TableRestore)
+		tables = append(tables, tableProgress{
+			name:     t.tableName,
+			finished: atomic.LoadInt64(&t.finishedChunks),
+			total:    atomic.LoadInt64(&t.totalChunks),
+		})
+		return true
+	})
+	sort.Slice(tables, func(i, j int) bool { return tables[i].name < tables[j].name })
+	return tables
+}
+
+func (d *progressDisplay) render(progress *Progress, tables []tableProgress) {
+	var buf strings.Builder
+	if d.lines > 0 {
+		// move back to the first line drawn last time.
+		fmt.Fprintf(&buf, "\x1b[%dA", d.lines)
+	}
+	lines := formatProgress(progress, tables)
+	for _, line := range lines {
+		buf.WriteString("\x1b[2K")
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	// clear the lines of the tables finished since last time.
+	for i := len(lines); i < d.lines; i++ {
+		buf.WriteString("\x1b[2K\n")
+	}
+	if d.lines > len(lines) {
+		fmt.Fprintf(&buf, "\x1b[%dA", d.lines-len(lines))
+	}
+	d.lines = len(lines)
+	io.WriteString(d.out, buf.String())
+}
+
+// formatProgress renders the overall progress, followed by one line for each
+// active table.
+func formatProgress(progress *Progress, tables []tableProgress) []string {
+	eta := "--"
+	if progress.FinishedChunks >= progress.EstimatedChunks && progress.EstimatedChunks > 0 {
+		eta = "post-processing"
+	} else if progress.EstimatedRemaining >= 0 {
+		eta = time.Duration(progress.EstimatedRemaining * float64(time.Second)).Round(time.Second).String()
+	}
+	lines := make([]string, 0, len(tables)+2)
+	lines = append(lines, fmt.Sprintf(
+		"%s %s %.0f/%.0f chunks, %.0f/%.0f tables, %.2f MiB/s, ETA %s",
+		progressBar(progress.FinishedChunks, progress.EstimatedChunks),
+		progress.Phase,
+		progress.FinishedChunks, progress.EstimatedChunks,
+		progress.CompletedTables, progress.TotalTables,
+		progress.Speed/1048576,
+		eta,
+	))
+	for i, table := range tables {
+		if i == maxDisplayedTables {
+			lines = append(lines, fmt.Sprintf("... and %d more tables", len(tables)-maxDisplayedTables))
+			break
+		}
+		lines = append(lines, fmt.Sprintf(
+			"%s %s %d/%d chunks",
+			progressBar(float64(table.finished), float64(table.total)),
+			table.name, table.finished, table.total,
+		))
+	}
+	return lines
+}
+
+// progressBar draws the bar of the ratio with the percentage, e.g.
+// "[#######-------]  50.0%".
+func progressBar(done, total float64) string {
+	ratio := 0.0
+	if total > 0 {
+		ratio = done / total
+	}
+	if ratio > 1 {
+		ratio = 1
+	}
+	filled := int(ratio * progressBarWidth)
+	return fmt.Sprintf("[%s%s] %5.1f%%", strings.Repeat("#", filled), strings.Repeat("-", progressBarWidth-filled), ratio*100)
+}
@@ -0,0 +1,320 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cznic/mathutil"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/ddl"
+	"github.com/pingcap/tidb/util/mock"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/config"
+	"github.com/pingcap/tidb-lightning/lightning/mydump"
+	verify "github.com/pingcap/tidb-lightning/lightning/verification"
+	"github.com/pingcap/tidb-lightning/lightning/worker"
+)
+
+// maximum number of encoding errors kept in the dry-run report of each table.
+const maxDryRunErrors = 10
+
+// DryRunReport summarizes the KV pairs a table would be encoded into.
+type DryRunReport struct {
+	Table    string
+	Rows     uint64
+	Checksum verify.KVChecksum
+	// Errors are the first encoding errors, and ErrorCount is the total.
+	Errors     []string
+	ErrorCount int
+}
+
+func (r *DryRunReport) addError(err error) {
+	r.ErrorCount++
+	if len(r.Errors) < maxDryRunErrors {
+		r.Errors = append(r.Errors, err.Error())
+	}
+}
+
+func (r *DryRunReport) merge(other *DryRunReport) {
+	r.Rows += other.Rows
+	r.Checksum.Add(&other.Checksum)
+	r.ErrorCount += other.ErrorCount
+	for _, e := range other.Errors {
+		if len(r.Errors) < maxDryRunErrors {
+			r.Errors = append(r.Errors, e)
+		}
+	}
+}
+
+// DryRun reads and encodes all data files like a normal import, but writes
+// nothing into tikv-importer or TiDB. The report of every table is logged and
+// printed to stdout. Returns an error if any row cannot be encoded.
+func DryRun(ctx context.Context, dbMetas []*mydump.MDDatabaseMeta, cfg *config.Config) error {
+	dbInfos, err := loadDryRunSchemaInfo(ctx, dbMetas, cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	ioWorkers := worker.NewPool(ctx, cfg.App.IOConcurrency, "io")
+	regionWorkers := worker.NewPool(ctx, cfg.App.RegionConcurrency, "region")
+
+	var reports []*DryRunReport
+	for _, dbMeta := range dbMetas {
+		dbInfo := dbInfos[dbMeta.Name]
+		for _, tableMeta := range dbMeta.Tables {
+			tableInfo, ok := dbInfo.Tables[tableMeta.Name]
+			if !ok {
+				return errors.Errorf("table info %s.%s not found", dbMeta.Name, tableMeta.Name)
+			}
+			tableName := common.UniqueTable(dbInfo.Name, tableInfo.Name)
+			report, err := dryRunTable(ctx, cfg, tableName, tableMeta, dbInfo, tableInfo, ioWorkers, regionWorkers)
+			if err != nil {
+				return errors.Annotatef(err, "[%s] dry run failed", tableName)
+			}
+			reports = append(reports, report)
+		}
+	}
+
+	writeDryRunReport(os.Stdout, reports)
+
+	errorCount := 0
+	for _, report := range reports {
+		errorCount += report.ErrorCount
+	}
+	if errorCount > 0 {
+		return errors.Errorf("dry run found %d encoding errors", errorCount)
+	}
+	return nil
+}
+
+// loadDryRunSchemaInfo builds the table infos from the schema files without
+// creating the tables. If the schema files are not used, the table infos are
+// read from the target TiDB instead, which must have all tables created.
+func loadDryRunSchemaInfo(ctx context.Context, dbMetas []*mydump.MDDatabaseMeta, cfg *config.Config) (map[string]*TidbDBInfo, error) {
+	if cfg.Mydumper.NoSchema {
+		tls, err := cfg.Security.ToTLS()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		tidbMgr, err := NewTiDBManager(cfg.TiDB, tls)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer tidbMgr.Close()
+		dbInfos, err := tidbMgr.LoadSchemaInfo(ctx, dbMetas)
+		return dbInfos, errors.Trace(err)
+	}
+
+	p := parser.New()
+	tableID := int64(0)
+	result := make(map[string]*TidbDBInfo, len(dbMetas))
+	for _, dbMeta := range dbMetas {
+		dbInfo := &TidbDBInfo{
+			Name:   dbMeta.Name,
+			Tables: make(map[string]*TidbTableInfo),
+		}
+		for _, tableMeta := range dbMeta.Tables {
+			createTable := tableMeta.GetSchema()
+			stmt, err := p.ParseOneStmt(createTable, "", "")
+			if err != nil {
+				return nil, errors.Annotatef(err, "cannot parse schema of %s.%s", dbMeta.Name, tableMeta.Name)
+			}
+			createTableStmt, ok := stmt.(*ast.CreateTableStmt)
+			if !ok {
+				return nil, errors.Errorf("schema of %s.%s is not a CREATE TABLE statement", dbMeta.Name, tableMeta.Name)
+			}
+
+			tableID++
+			core, err := ddl.MockTableInfo(mock.NewContext(), createTableStmt, tableID)
+			if err != nil {
+				return nil, errors.Annotatef(err, "invalid schema of %s.%s", dbMeta.Name, tableMeta.Name)
+			}
+			// the table is treated as created, the same as those from TiDB.
+			core.State = model.StatePublic
+			for _, opt := range createTableStmt.Options {
+				if opt.Tp == ast.TableOptionShardRowID {
+					core.ShardRowIDBits = opt.UintValue
+				}
+			}
+			dbInfo.Tables[tableMeta.Name] = &TidbTableInfo{
+				ID:              tableID,
+				Name:            tableMeta.Name,
+				Columns:         len(core.Columns),
+				Indices:         len(core.Indices),
+				CreateTableStmt: createTable,
+				AutoRandomBits:  autoRandomBitsOf(createTable),
+				IsCommonHandle:  isCommonHandleOf(createTable, core),
+				core:            core,
+			}
+		}
+		result[dbMeta.Name] = dbInfo
+	}
+	return result, nil
+}
+
+func dryRunTable(
+	ctx context.Context,
+	cfg *config.Config,
+	tableName string,
+	tableMeta *mydump.MDTableMeta,
+	dbInfo *TidbDBInfo,
+	tableInfo *TidbTableInfo,
+	ioWorkers *worker.Pool,
+	regionWorkers *worker.Pool,
+) (*DryRunReport, error) {
+	timer := time.Now()
+	cp := &TableCheckpoint{Status: CheckpointStatusLoaded}
+	tr, err := NewTableRestore(tableName, tableMeta, dbInfo, tableInfo, cp)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer tr.Close()
+	if err := tr.populateChunks(cfg, dryRunEngineSize(int64(cfg.Mydumper.BatchSize)), cp); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// the first failed chunk stops the others, which are all joined before
+	// returning.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	report := &DryRunReport{Table: tableName}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var chunkErr common.OnceError
+outer:
+	for _, engine := range cp.Engines {
+		for chunkIndex, chunk := range engine.Chunks {
+			if ctx.Err() != nil {
+				break outer
+			}
+			cr, err := newChunkRestore(chunkIndex, chunk, int64(cfg.Mydumper.ReadBlockSize), cfg.Mydumper.ReadEngine, ioWorkers)
+			if err != nil {
+				chunkErr.Set(tableName, err)
+				break outer
+			}
+			w := regionWorkers.Apply()
+			wg.Add(1)
+			go func(w *worker.Worker, cr *chunkRestore) {
+				defer wg.Done()
+				defer regionWorkers.Recycle(w)
+				defer cr.close()
+				chunkReport, err := cr.dryRun(ctx, tr, cfg)
+				if err != nil {
+					chunkErr.Set(tableName, err)
+					cancel()
+					return
+				}
+				lock.Lock()
+				report.merge(chunkReport)
+				lock.Unlock()
+			}(w, cr)
+		}
+	}
+	wg.Wait()
+	if err := chunkErr.Get(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	logger := common.TableLogger(tableName)
+	logger.Infof(
+		"dry run takes %v: %d rows, %d KV pairs, %d bytes, checksum %d, %d encoding errors",
+		time.Since(timer), report.Rows, report.Checksum.SumKVS(), report.Checksum.SumSize(), report.Checksum.Sum(), report.ErrorCount,
+	)
+	for _, e := range report.Errors {
+		logger.Errorf("dry run encoding error: %s", e)
+	}
+	return report, nil
+}
+
+// dryRun encodes the chunk without delivering the KV pairs. When a row cannot
+// be encoded, the error is recorded into the report, and the row is skipped
+// together with the rows read before it in the same block.
+func (cr *chunkRestore) dryRun(ctx context.Context, t *TableRestore, cfg *config.Config) (*DryRunReport, error) {
+	// the dry run does not connect to the cluster to know its collations.
+	kvEncoder, err := t.newKVEncoder(encoderOptions{
+		sqlMode:        cfg.TiDB.SQLModeOf(t.dbInfo.Name, t.tableInfo.Name),
+		timeZone:       cfg.TiDB.TimeZone,
+		usePrepareStmt: cfg.TiDB.UsePrepareStmt,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer kvEncoder.Close()
+
+	report := &DryRunReport{Table: t.tableName, Checksum: verify.MakeKVChecksum(0, 0, 0)}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		endOffset := mathutil.MinInt64(cr.chunk.Chunk.EndOffset, cr.parser.Pos()+int64(cfg.Mydumper.ReadBlockSize))
+		if cr.parser.Pos() >= endOffset {
+			break
+		}
+
+		startOffset := cr.parser.Pos()
+		kvs, rows, _, err := cr.encodeRows(t, kvEncoder, nil, endOffset)
+		buffers := kvEncoder.TakeKVBuffers()
+		if err != nil {
+			buffers.Recycle()
+			if cr.parser.Pos() == startOffset {
+				// not even a row could be read, the file itself is broken.
+				return nil, errors.Trace(err)
+			}
+			// the error tells where the bad row is.
+			report.addError(err)
+			continue
+		}
+		report.Rows += rows
+		report.Checksum.Update(kvs)
+		// the KV pairs are only checksummed, their memory can be reused.
+		buffers.Recycle()
+	}
+	return report, nil
+}
+
+func writeDryRunReport(w io.Writer, reports []*DryRunReport) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TABLE\tROWS\tKV PAIRS\tKV SIZE\tCHECKSUM\tERRORS")
+	for _, report := range reports {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n",
+			report.Table, report.Rows, report.Checksum.SumKVS(), report.Checksum.SumSize(), report.Checksum.Sum(), report.ErrorCount)
+	}
+	tw.Flush()
+
+	for _, report := range reports {
+		for _, e := range report.Errors {
+			fmt.Fprintf(w, "%s: %s\n", report.Table, e)
+		}
+		if report.ErrorCount > len(report.Errors) {
+			fmt.Fprintf(w, "%s: ... and %d more errors\n", report.Table, report.ErrorCount-len(report.Errors))
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/config"
+	"github.com/pingcap/tidb-lightning/lightning/mydump"
+	verify "github.com/pingcap/tidb-lightning/lightning/verification"
+	"github.com/pingcap/tidb-lightning/lightning/worker"
+)
+
+var _ = Suite(&dryRunSuite{})
+
+type dryRunSuite struct{}
+
+func (s *dryRunSuite) TestDryRunTable(c *C) {
+	dir := c.MkDir()
+	files := map[string]string{
+		"db-schema-create.sql": "CREATE DATABASE db;",
+		"db.t-schema.sql":      "CREATE TABLE t (a INT PRIMARY KEY, b VARCHAR(4));",
+		"db.t.sql":             "INSERT INTO t VALUES (1, 'x'), (2, 'y');\nINSERT INTO t VALUES (3, 'too long');\n",
+	}
+	for name, content := range files {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), IsNil)
+	}
+
+	cfg := config.NewConfig()
+	cfg.Mydumper.SourceDir = dir
+	cfg.Mydumper.ReadBlockSize = 5 // one row per block
+	cfg.Mydumper.BatchSize = 100 << 30
+	cfg.Mydumper.CharacterSet = "auto"
+	cfg.TiDB.SQLMode = "STRICT_TRANS_TABLES"
+	loader, err := mydump.NewMyDumpLoader(cfg)
+	c.Assert(err, IsNil)
+	dbMetas := loader.GetDatabases()
+
+	ctx := context.Background()
+	dbInfos, err := loadDryRunSchemaInfo(ctx, dbMetas, cfg)
+	c.Assert(err, IsNil)
+	tableInfo := dbInfos["db"].Tables["t"]
+	c.Assert(tableInfo.Columns, Equals, 2)
+	c.Assert(tableInfo.core.PKIsHandle, IsTrue)
+
+	report, err := dryRunTable(
+		ctx, cfg, "`db`.`t`", dbMetas[0].Tables[0], dbInfos["db"], tableInfo,
+		worker.NewPool(ctx, 1, "io"), worker.NewPool(ctx, 1, "region"),
+	)
+	c.Assert(err, IsNil)
+	c.Assert(report.Rows, Equals, uint64(2))
+	c.Assert(report.Checksum.SumKVS(), Equals, uint64(2))
+	c.Assert(report.ErrorCount, Equals, 1)
+	c.Assert(report.Errors[0], Matches, `failed to encode row 3 of table `+"`db`.`t`"+` at offset \d+ of .*db.t.sql: "\(3, 'too long'\)": .*Data too long.*`)
+
+	// the too long value is truncated in the non-strict SQL mode of the table.
+	cfg.TiDB.TableSQLMode = map[string]string{"DB.T": ""}
+	report, err = dryRunTable(
+		ctx, cfg, "`db`.`t`", dbMetas[0].Tables[0], dbInfos["db"], tableInfo,
+		worker.NewPool(ctx, 1, "io"), worker.NewPool(ctx, 1, "region"),
+	)
+	c.Assert(err, IsNil)
+	c.Assert(report.Rows, Equals, uint64(3))
+	c.Assert(report.ErrorCount, Equals, 0)
+}
+
+func (s *dryRunSuite) TestDryRunTableFailed(c *C) {
+	dir := c.MkDir()
+	files := map[string]string{
+		"db-schema-create.sql": "CREATE DATABASE db;",
+		"db.t-schema.sql":      "CREATE TABLE t (a INT PRIMARY KEY);",
+		"db.t.1.sql":           "INSERT INTO t VALUES (1);\n",
+		"db.t.2.sql":           "INSERT INTO t VALUES (2);\n",
+		"db.t.3.sql":           "INSERT INTO t VALUES (3);\n",
+		"db.t.4.sql":           "INSERT INTO t VALUES (4);\n",
+	}
+	for name, content := range files {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), IsNil)
+	}
+
+	cfg := config.NewConfig()
+	cfg.Mydumper.SourceDir = dir
+	cfg.Mydumper.ReadBlockSize = 64
+	cfg.Mydumper.BatchSize = 100 << 30
+	cfg.Mydumper.CharacterSet = "auto"
+	loader, err := mydump.NewMyDumpLoader(cfg)
+	c.Assert(err, IsNil)
+	dbMetas := loader.GetDatabases()
+	dbInfos, err := loadDryRunSchemaInfo(context.Background(), dbMetas, cfg)
+	c.Assert(err, IsNil)
+
+	dryRun := func(ctx context.Context) error {
+		ioWorkers := worker.NewPool(ctx, 1, "io")
+		regionWorkers := worker.NewPool(ctx, 1, "region")
+		_, err := dryRunTable(
+			ctx, cfg, "`db`.`t`", dbMetas[0].Tables[0], dbInfos["db"], dbInfos["db"].Tables["t"],
+			ioWorkers, regionWorkers,
+		)
+		// all the chunks are finished and their workers recycled.
+		c.Assert(ioWorkers.HasWorker(), IsTrue)
+		c.Assert(regionWorkers.HasWorker(), IsTrue)
+		return err
+	}
+
+	// the chunk which cannot be read fails the table.
+	c.Assert(os.Remove(filepath.Join(dir, "db.t.2.sql")), IsNil)
+	c.Assert(os.Mkdir(filepath.Join(dir, "db.t.2.sql"), 0755), IsNil)
+	c.Assert(dryRun(context.Background()), ErrorMatches, ".*db.t.2.sql.*")
+
+	// no chunks run once the task is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = dryRun(ctx)
+	c.Assert(errors.Cause(err), Equals, context.Canceled)
+}
+
+func (s *dryRunSuite) TestWriteDryRunReport(c *C) {
+	reports := []*DryRunReport{
+		{Table: "`db`.`a`", Rows: 2, Checksum: verify.MakeKVChecksum(30, 4, 12345)},
+		{Table: "`db`.`b`", ErrorCount: 12, Errors: []string{"bad row"}},
+	}
+	var buf bytes.Buffer
+	writeDryRunReport(&buf, reports)
+	c.Assert(buf.String(), Equals, ""+
+		"TABLE     ROWS  KV PAIRS  KV SIZE  CHECKSUM  ERRORS\n"+
+		"`db`.`a`  2     4         30       12345     0\n"+
+		"`db`.`b`  0     0         0        0         12\n"+
+		"`db`.`b`: bad row\n"+
+		"`db`.`b`: ... and 11 more errors\n")
+}
@@ -0,0 +1,262 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/config"
+	"github.com/pingcap/tidb-lightning/lightning/kv"
+	verify "github.com/pingcap/tidb-lightning/lightning/verification"
+)
+
+// EngineRegistryPath returns the path of the registry of the engines opened by
+// the task, see kv.EngineRegistry. The registry is named after the checkpoint
+// schema, which tells the tasks apart, and kept with the sorted KV pairs of the
+// local backend, or beside the checkpoint file.
+func EngineRegistryPath(cfg *config.Config) string {
+	dir := os.TempDir()
+	switch {
+	case cfg.TikvImporter.Backend == config.BackendLocal && len(cfg.TikvImporter.SortedKVDir) > 0:
+		dir = cfg.TikvImporter.SortedKVDir
+	case cfg.Checkpoint.Enable && cfg.Checkpoint.Driver == "file":
+		dir = filepath.Dir(cfg.Checkpoint.DSN)
+	}
+	return filepath.Join(dir, cfg.Checkpoint.Schema+".engines.json")
+}
+
+// CleanupOrphanEngines cleans up the engines recorded in the registry of the
+// importer which are not needed for resuming from the checkpoints, i.e. all
+// engines except those saved in the checkpoints and not yet imported. Nothing
+// is cleaned up if the checkpoints are disabled, since the engines cannot be
+// told apart then.
+func CleanupOrphanEngines(ctx context.Context, importer *kv.Importer, cpdb CheckpointsDB) ([]kv.EngineRecord, error) {
+	if _, ok := cpdb.(*NullCheckpointsDB); ok {
+		common.AppLogger.Info("checkpoints are disabled, orphan engines are not cleaned up")
+		return nil, nil
+	}
+
+	tableCps := make(map[string]*TableCheckpoint)
+	var cpErr error
+	cleaned, err := importer.CleanupOrphanEngines(ctx, func(tableName string, engineID int) bool {
+		cp, ok := tableCps[tableName]
+		if !ok {
+			var err error
+			cp, err = cpdb.Get(ctx, tableName)
+			switch {
+			case isCheckpointNotFound(err):
+				// the table is not part of the task any more.
+				cp = &TableCheckpoint{}
+			case err != nil:
+				// keep the engine if unsure.
+				cpErr = err
+				return true
+			}
+			tableCps[tableName] = cp
+		}
+		if engineID < 0 || engineID >= len(cp.Engines) {
+			return false
+		}
+		return cp.Engines[engineID].Status < CheckpointStatusImported
+	})
+	if err == nil {
+		err = cpErr
+	}
+	return cleaned, errors.Trace(err)
+}
+
+// cleanupOrphanEngines reclaims the disk space of the backend occupied by the
+// engines left behind by the previous runs.
+func (rc *RestoreController) cleanupOrphanEngines(ctx context.Context) error {
+	cleaned, err := CleanupOrphanEngines(ctx, rc.importer, rc.checkpointsDB)
+	if len(cleaned) > 0 {
+		common.AppLogger.Infof("cleaned up %d orphan engines", len(cleaned))
+	}
+	if err != nil && !common.IsContextCanceledError(err) {
+		// the orphan engines only waste the disk space, which is not fatal.
+		common.AppLogger.Warnf("cannot cleanup orphan engines: %v", err)
+		return nil
+	}
+	return errors.Trace(err)
+}
+
+// assignEngine binds the engine to the tikv-importer instance recorded in the
+// checkpoint, or to a new one which is then recorded, when there are several
+// instances. ErrEngineLost is returned if the recorded instance is no longer
+// used, so the engine is rewound and written into another instance.
+func (t *TableRestore) assignEngine(rc *RestoreController, engineID int, cp *EngineCheckpoint) error {
+	if cp.Status >= CheckpointStatusImported {
+		return nil
+	}
+	addr, err := rc.importer.AssignEngine(t.tableName, engineID, cp.Importer)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if addr != cp.Importer {
+		common.EngineLogger(t.tableName, engineID).Infof("engine assigned to tikv-importer at %s", addr)
+		cp.Importer = addr
+		rc.saveCheckpoint(saveCp{
+			tableName: t.tableName,
+			merger:    &ImporterCheckpointMerger{EngineID: engineID, Importer: addr},
+		})
+	}
+	return nil
+}
+
+// verifyResumedEngine checks the engine still holds the KV pairs the
+// checkpoint says written into it. An empty engine is reported lost, so it is
+// written again from the beginning.
+func (t *TableRestore) verifyResumedEngine(ctx context.Context, rc *RestoreController, engineID int, cp *EngineCheckpoint) error {
+	var localChecksum verify.KVChecksum
+	for _, chunk := range cp.Chunks {
+		localChecksum.Add(&chunk.Checksum)
+	}
+	if localChecksum.SumKVS() == 0 {
+		// nothing written yet, i.e. not resumed.
+		return nil
+	}
+	logger := common.EngineLogger(t.tableName, engineID)
+	if !rc.importer.CanReportEngineStats() {
+		logger.Infof("skip verifying the resumed engine, the backend cannot count its KV pairs, checkpoint has %+v", localChecksum)
+		return nil
+	}
+
+	start := time.Now()
+	kvs, size, err := rc.importer.EngineStats(ctx, t.tableName, engineID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if kvs == 0 {
+		return errors.Annotatef(kv.ErrEngineLost, "engine is empty, but %d KV pairs (%d bytes) are recorded in the checkpoint",
+			localChecksum.SumKVS(), localChecksum.SumSize())
+	}
+	// the engine may hold more than recorded, which are the KV pairs written
+	// after the last checkpoint was saved, and are written again anyway. it
+	// may also hold less, as the checkpoint counts every KV pair written while
+	// the engine keeps only the last of those with the same key, so this is
+	// only a warning, and the checksum tells whether the data are complete.
+	if kvs < localChecksum.SumKVS() || size < localChecksum.SumSize() {
+		logger.Warnf("engine has %d KV pairs (%d bytes), fewer than %d (%d bytes) recorded in the checkpoint, the source data may have duplicate keys",
+			kvs, size, localChecksum.SumKVS(), localChecksum.SumSize())
+		return nil
+	}
+	logger.Infof("resumed engine verified, %d KV pairs (%d bytes) in engine, checkpoint has %+v, takes %v", kvs, size, localChecksum, time.Since(start))
+	return nil
+}
+
+// discardAllocatedEngine cleans up the resumed engine if the AUTO_INCREMENT
+// values of its rows are allocated, and reports it lost, so it is written
+// again from the beginning. The rows written after the last checkpoint would
+// be allocated different values when encoded again, and the engine would keep
+// both copies of them. The values given as NULL in the data files are not
+// detected.
+func (t *TableRestore) discardAllocatedEngine(ctx context.Context, rc *RestoreController, engineID int, cp *EngineCheckpoint) error {
+	opts := rc.encoderOpts
+	opts.sqlMode = rc.cfg.TiDB.SQLModeOf(t.dbInfo.Name, t.tableInfo.Name)
+	kvEncoder, err := t.newKVEncoder(opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer kvEncoder.Close()
+
+	allocates := false
+	for _, chunk := range cp.Chunks {
+		if chunk.Chunk.Offset <= chunk.Key.Offset {
+			continue
+		}
+		permutation, err := kvEncoder.ColumnPermutation(chunk.Columns)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if kvEncoder.AllocatesAutoIncrement(permutation) {
+			allocates = true
+			break
+		}
+	}
+	if !allocates {
+		return nil
+	}
+
+	closedEngine, err := rc.importer.UnsafeCloseEngine(ctx, t.tableName, engineID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := closedEngine.Cleanup(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Annotate(kv.ErrEngineLost, "the resumed engine has allocated AUTO_INCREMENT values, and is discarded")
+}
+
+// rewindEngine moves all chunks of the engine back to their beginning after
+// the engine is lost in tikv-importer, so that the engine can be written again.
+// The row IDs of every chunk are recovered as well, so the rewritten KV pairs
+// are identical to those written before.
+func (t *TableRestore) rewindEngine(rc *RestoreController, cp *TableCheckpoint, engineID int) {
+	var chunks []retryChunk
+	for eid, engine := range cp.Engines {
+		for _, chunk := range engine.Chunks {
+			chunks = append(chunks, retryChunk{
+				engineID: eid,
+				key:      chunk.Key,
+				rowIDMax: chunk.Chunk.RowIDMax,
+			})
+		}
+	}
+	prevRowIDMaxes := make(map[ChunkCheckpointKey]int64)
+	for _, chunk := range computeRetryChunks(chunks, engineID) {
+		prevRowIDMaxes[chunk.key] = chunk.prevRowIDMax
+	}
+
+	engine := cp.Engines[engineID]
+	for _, chunk := range engine.Chunks {
+		chunk.Chunk.Offset = chunk.Key.Offset
+		chunk.Chunk.PrevRowIDMax = prevRowIDMaxes[chunk.Key]
+		chunk.Checksum = verify.MakeKVChecksum(0, 0, 0)
+		rc.saveCheckpoint(saveCp{
+			tableName: t.tableName,
+			merger: &ChunkCheckpointMerger{
+				EngineID: engineID,
+				Key:      chunk.Key,
+				Checksum: chunk.Checksum,
+				Pos:      chunk.Chunk.Offset,
+				RowID:    chunk.Chunk.PrevRowIDMax,
+			},
+		})
+		// the chunks quarantined are retried along with the rest.
+		if len(chunk.QuarantineReason) != 0 {
+			chunk.QuarantineReason = ""
+			rc.saveCheckpoint(saveCp{
+				tableName: t.tableName,
+				merger:    &QuarantineCheckpointMerger{EngineID: engineID, Key: chunk.Key},
+			})
+		}
+	}
+	engine.Status = CheckpointStatusLoaded
+	rc.saveCheckpoint(saveCp{
+		tableName: t.tableName,
+		merger:    &StatusCheckpointMerger{EngineID: engineID, Status: CheckpointStatusLoaded},
+	})
+	// the engine may be written into another tikv-importer instance.
+	engine.Importer = ""
+	rc.saveCheckpoint(saveCp{
+		tableName: t.tableName,
+		merger:    &ImporterCheckpointMerger{EngineID: engineID},
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	. "github.com/pingcap/check"
+	"github.com/satori/go.uuid"
+
+	"github.com/pingcap/tidb-lightning/lightning/config"
+	"github.com/pingcap/tidb-lightning/lightning/kv"
+)
+
+var _ = Suite(&enginesSuite{})
+
+type enginesSuite struct{}
+
+// cleanupBackend records the engines cleaned up.
+type cleanupBackend struct {
+	kv.Backend
+	cleaned []uuid.UUID
+}
+
+func (*cleanupBackend) OpenEngine(context.Context, uuid.UUID) error  { return nil }
+func (*cleanupBackend) CloseEngine(context.Context, uuid.UUID) error { return nil }
+func (b *cleanupBackend) CleanupEngine(_ context.Context, engineUUID uuid.UUID) error {
+	b.cleaned = append(b.cleaned, engineUUID)
+	return nil
+}
+
+func (s *enginesSuite) TestEngineRegistryPath(c *C) {
+	cfg := config.NewConfig()
+	cfg.Checkpoint.Schema = "task1"
+	cfg.Checkpoint.Enable = true
+	cfg.Checkpoint.Driver = "mysql"
+	c.Assert(EngineRegistryPath(cfg), Equals, filepath.Join(os.TempDir(), "task1.engines.json"))
+
+	cfg.Checkpoint.Driver = "file"
+	cfg.Checkpoint.DSN = "/data/checkpoints/task1.pb"
+	c.Assert(EngineRegistryPath(cfg), Equals, "/data/checkpoints/task1.engines.json")
+
+	cfg.TikvImporter.Backend = config.BackendLocal
+	cfg.TikvImporter.SortedKVDir = "/data/sorted"
+	c.Assert(EngineRegistryPath(cfg), Equals, "/data/sorted/task1.engines.json")
+}
+
+func (s *enginesSuite) TestCleanupOrphanEngines(c *C) {
+	ctx := context.Background()
+	dir := c.MkDir()
+	registry, err := kv.LoadEngineRegistry(filepath.Join(dir, "task.engines.json"))
+	c.Assert(err, IsNil)
+	backend := new(cleanupBackend)
+	importer := kv.NewBackendImporter(backend)
+	importer.SetEngineRegistry(registry)
+	for _, table := range []string{"`db`.`t`", "`db`.`gone`"} {
+		for engineID := 0; engineID < 2; engineID++ {
+			_, err := importer.OpenEngine(ctx, table, engineID)
+			c.Assert(err, IsNil)
+		}
+	}
+
+	// nothing is cleaned up without checkpoints.
+	cleaned, err := CleanupOrphanEngines(ctx, importer, NewNullCheckpointsDB())
+	c.Assert(err, IsNil)
+	c.Assert(cleaned, HasLen, 0)
+	c.Assert(registry.Engines(), HasLen, 4)
+
+	// only the engine of `db`.`t` not imported is needed, the table `gone`
+	// has no checkpoints.
+	cpdb := NewFileCheckpointsDB(filepath.Join(dir, "cp.pb"))
+	defer cpdb.Close()
+	err = cpdb.Initialize(ctx, map[string]*TidbDBInfo{
+		"db": {Name: "db", Tables: map[string]*TidbTableInfo{"t": {Name: "t"}}},
+	})
+	c.Assert(err, IsNil)
+	err = cpdb.InsertEngineCheckpoints(ctx, "`db`.`t`", []*EngineCheckpoint{{}, {}})
+	c.Assert(err, IsNil)
+	cpd := NewTableCheckpointDiff()
+	(&StatusCheckpointMerger{EngineID: 0, Status: CheckpointStatusImported}).MergeInto(cpd)
+	c.Assert(cpdb.Update(context.Background(), map[string]*TableCheckpointDiff{"`db`.`t`": cpd}), IsNil)
+
+	cleaned, err = CleanupOrphanEngines(ctx, importer, cpdb)
+	c.Assert(err, IsNil)
+	c.Assert(cleaned, HasLen, 3)
+	records := registry.Engines()
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].Table, Equals, "`db`.`t`")
+	c.Assert(records[0].EngineID, Equals, 1)
+	c.Assert(backend.cleaned, HasLen, 3)
+}
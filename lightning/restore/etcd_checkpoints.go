@@ -0,0 +1,623 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/cznic/mathutil"
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+const (
+	etcdCheckpointsKeyPrefix        = "/tidb-lightning/checkpoints/"
+	etcdCheckpointsHistoryKeyPrefix = "/tidb-lightning/checkpoints-history/"
+	etcdTaskProgressKeyPrefix       = "/tidb-lightning/task-progress/"
+	etcdTaskMetaKeyPrefix           = "/tidb-lightning/task-meta/"
+	etcdTablesKeyPart               = "tables/"
+	etcdChunksKeyPart               = "chunks/"
+	etcdDialTimeout                 = 5 * time.Second
+	// etcd rejects transactions with more operations than `--max-txn-ops`,
+	// which is 128 by default.
+	etcdMaxTxnOps = 128
+)
+
+// EtcdCheckpointsDB stores the checkpoints inside an etcd cluster, typically
+// the one embedded in PD. Under the prefix "/tidb-lightning/checkpoints/$task/",
+// every table is stored as a serialized TableCheckpointModel without the
+// chunks under the key "tables/$tableName", and every chunk is stored as a
+// serialized ChunkCheckpointModel under the key
+// "chunks/$tableName/$engineID/$path:$offset", so tables with many chunks do
+// not exceed the request size limit of etcd. The table names and the chunk
+// keys are escaped by url.PathEscape.
+//
+// Similar to FileCheckpointsDB, the whole content is cached in memory, and
+// etcd is only written to. This assumes only one Lightning instance is
+// importing the task at a time.
+type EtcdCheckpointsDB struct {
+	lock        sync.Mutex // we need to ensure only a thread can access to `checkpoints` at a time
+	cli         *clientv3.Client
+	taskName    string
+	prefix      string
+	checkpoints map[string]*TableCheckpointModel
+}
+
+// NewEtcdCheckpointsDB connects to the etcd cluster at the comma-separated
+// `endpoints`, and loads all checkpoints stored under the given task.
+func NewEtcdCheckpointsDB(ctx context.Context, tls *common.TLS, endpoints string, taskName string) (*EtcdCheckpointsDB, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		DialTimeout: etcdDialTimeout,
+		TLS:         tls.TLSConfig(),
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "cannot connect to etcd at %s", endpoints)
+	}
+
+	cpdb := &EtcdCheckpointsDB{
+		cli:         cli,
+		taskName:    taskName,
+		prefix:      etcdCheckpointsKeyPrefix + taskName + "/",
+		checkpoints: make(map[string]*TableCheckpointModel),
+	}
+
+	resp, err := cli.Get(ctx, cpdb.prefix, clientv3.WithPrefix())
+	if err != nil {
+		cli.Close()
+		return nil, errors.Trace(err)
+	}
+	cache := newEtcdCheckpointsCache(cpdb.prefix)
+	for _, kv := range resp.Kvs {
+		if _, err := cache.apply(kv, false); err != nil {
+			cli.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	for tableName := range cache.tables {
+		cpdb.checkpoints[tableName] = cache.checkpoint(tableName)
+	}
+
+	return cpdb, nil
+}
+
+func etcdTableKey(prefix string, tableName string) string {
+	return prefix + etcdTablesKeyPart + url.PathEscape(tableName)
+}
+
+func etcdChunksKeyPrefix(prefix string, tableName string) string {
+	return prefix + etcdChunksKeyPart + url.PathEscape(tableName) + "/"
+}
+
+func etcdChunkKey(prefix string, tableName string, engineID int, chunkKey string) string {
+	return etcdChunksKeyPrefix(prefix, tableName) + strconv.Itoa(engineID) + "/" + url.PathEscape(chunkKey)
+}
+
+// etcdCheckpointsCache assembles the table checkpoints from the keys stored
+// under the prefix of a task.
+type etcdCheckpointsCache struct {
+	prefix string
+	tables map[string]*TableCheckpointModel                    // without the chunks
+	chunks map[string]map[int]map[string]*ChunkCheckpointModel // table name -> engine ID -> chunk key -> chunk
+}
+
+func newEtcdCheckpointsCache(prefix string) *etcdCheckpointsCache {
+	return &etcdCheckpointsCache{
+		prefix: prefix,
+		tables: make(map[string]*TableCheckpointModel),
+		chunks: make(map[string]map[int]map[string]*ChunkCheckpointModel),
+	}
+}
+
+// apply updates the cache with a key which is put or deleted, and returns the
+// name of the table it belongs to.
+func (cache *etcdCheckpointsCache) apply(kv *mvccpb.KeyValue, deleted bool) (string, error) {
+	key := strings.TrimPrefix(string(kv.Key), cache.prefix)
+	switch {
+	case strings.HasPrefix(key, etcdTablesKeyPart):
+		tableName, err := url.PathUnescape(key[len(etcdTablesKeyPart):])
+		if err != nil {
+			return "", errors.Annotatef(err, "corrupted checkpoint key %s", kv.Key)
+		}
+		if deleted {
+			delete(cache.tables, tableName)
+			delete(cache.chunks, tableName)
+			return tableName, nil
+		}
+		tableModel := new(TableCheckpointModel)
+		if err := tableModel.Unmarshal(kv.Value); err != nil {
+			return "", errors.Annotatef(err, "corrupted checkpoint %s", kv.Key)
+		}
+		cache.tables[tableName] = tableModel
+		return tableName, nil
+
+	case strings.HasPrefix(key, etcdChunksKeyPart):
+		parts := strings.Split(key[len(etcdChunksKeyPart):], "/")
+		if len(parts) != 3 {
+			return "", errors.Errorf("corrupted checkpoint key %s", kv.Key)
+		}
+		tableName, err := url.PathUnescape(parts[0])
+		if err != nil {
+			return "", errors.Annotatef(err, "corrupted checkpoint key %s", kv.Key)
+		}
+		engineID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return "", errors.Annotatef(err, "corrupted checkpoint key %s", kv.Key)
+		}
+		chunkKey, err := url.PathUnescape(parts[2])
+		if err != nil {
+			return "", errors.Annotatef(err, "corrupted checkpoint key %s", kv.Key)
+		}
+		if deleted {
+			delete(cache.chunks[tableName][engineID], chunkKey)
+			return tableName, nil
+		}
+		chunkModel := new(ChunkCheckpointModel)
+		if err := chunkModel.Unmarshal(kv.Value); err != nil {
+			return "", errors.Annotatef(err, "corrupted checkpoint %s", kv.Key)
+		}
+		engines, ok := cache.chunks[tableName]
+		if !ok {
+			engines = make(map[int]map[string]*ChunkCheckpointModel)
+			cache.chunks[tableName] = engines
+		}
+		chunks, ok := engines[engineID]
+		if !ok {
+			chunks = make(map[string]*ChunkCheckpointModel)
+			engines[engineID] = chunks
+		}
+		chunks[chunkKey] = chunkModel
+		return tableName, nil
+
+	default:
+		return "", errors.Errorf("unknown checkpoint key %s", kv.Key)
+	}
+}
+
+// checkpoint assembles the checkpoint of the table, or returns nil if the
+// table has no checkpoint. The chunks of the engines not yet in the table are
+// left out, since they are written before the table.
+func (cache *etcdCheckpointsCache) checkpoint(tableName string) *TableCheckpointModel {
+	tableModel, ok := cache.tables[tableName]
+	if !ok {
+		return nil
+	}
+	assembled := *tableModel
+	assembled.Engines = make([]*EngineCheckpointModel, 0, len(tableModel.Engines))
+	for engineID, engineModel := range tableModel.Engines {
+		engine := *engineModel
+		engine.Chunks = make(map[string]*ChunkCheckpointModel, len(cache.chunks[tableName][engineID]))
+		for key, chunkModel := range cache.chunks[tableName][engineID] {
+			engine.Chunks[key] = chunkModel
+		}
+		assembled.Engines = append(assembled.Engines, &engine)
+	}
+	return &assembled
+}
+
+// etcdChunkRef locates a chunk in a table checkpoint.
+type etcdChunkRef struct {
+	engineID int
+	key      string
+}
+
+func allChunkRefs(tableModel *TableCheckpointModel) []etcdChunkRef {
+	var refs []etcdChunkRef
+	for engineID, engineModel := range tableModel.Engines {
+		for key := range engineModel.Chunks {
+			refs = append(refs, etcdChunkRef{engineID: engineID, key: key})
+		}
+	}
+	return refs
+}
+
+// putTableOps returns the operations writing the given chunks and the rest of
+// the table checkpoint under the prefix. The table comes last, so the chunks
+// of a newly inserted engine are complete once the engine appears.
+func putTableOps(prefix string, tableName string, tableModel *TableCheckpointModel, chunks []etcdChunkRef) ([]clientv3.Op, error) {
+	ops := make([]clientv3.Op, 0, len(chunks)+1)
+	for _, ref := range chunks {
+		serialized, err := tableModel.Engines[ref.engineID].Chunks[ref.key].Marshal()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ops = append(ops, clientv3.OpPut(etcdChunkKey(prefix, tableName, ref.engineID, ref.key), string(serialized)))
+	}
+
+	stripped := *tableModel
+	stripped.Engines = make([]*EngineCheckpointModel, 0, len(tableModel.Engines))
+	for _, engineModel := range tableModel.Engines {
+		engine := *engineModel
+		engine.Chunks = nil
+		stripped.Engines = append(stripped.Engines, &engine)
+	}
+	serialized, err := stripped.Marshal()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return append(ops, clientv3.OpPut(etcdTableKey(prefix, tableName), string(serialized))), nil
+}
+
+func deleteTableOps(prefix string, tableName string) []clientv3.Op {
+	return []clientv3.Op{
+		clientv3.OpDelete(etcdTableKey(prefix, tableName)),
+		clientv3.OpDelete(etcdChunksKeyPrefix(prefix, tableName), clientv3.WithPrefix()),
+	}
+}
+
+// commit executes the operations in order, in transactions of at most
+// etcdMaxTxnOps operations each.
+func (cpdb *EtcdCheckpointsDB) commit(ctx context.Context, ops []clientv3.Op) error {
+	for len(ops) > 0 {
+		n := mathutil.Min(len(ops), etcdMaxTxnOps)
+		if _, err := cpdb.cli.Txn(ctx).Then(ops[:n]...).Commit(); err != nil {
+			return errors.Trace(err)
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+// save writes the given chunks and the rest of the table checkpoint.
+func (cpdb *EtcdCheckpointsDB) save(ctx context.Context, tableName string, chunks []etcdChunkRef) error {
+	ops, err := putTableOps(cpdb.prefix, tableName, cpdb.checkpoints[tableName], chunks)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(cpdb.commit(ctx, ops))
+}
+
+func (cpdb *EtcdCheckpointsDB) delete(ctx context.Context, tableName string) error {
+	delete(cpdb.checkpoints, tableName)
+	return errors.Trace(cpdb.commit(ctx, deleteTableOps(cpdb.prefix, tableName)))
+}
+
+func (cpdb *EtcdCheckpointsDB) Initialize(ctx context.Context, dbInfo map[string]*TidbDBInfo) error {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	for _, db := range dbInfo {
+		for _, table := range db.Tables {
+			tableName := common.UniqueTable(db.Name, table.Name)
+			if _, ok := cpdb.checkpoints[tableName]; ok {
+				continue
+			}
+			cpdb.checkpoints[tableName] = &TableCheckpointModel{
+				Status: uint32(CheckpointStatusLoaded),
+			}
+			if err := cpdb.save(ctx, tableName, nil); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (cpdb *EtcdCheckpointsDB) Close() error {
+	return errors.Trace(cpdb.cli.Close())
+}
+
+func (cpdb *EtcdCheckpointsDB) Get(_ context.Context, tableName string) (*TableCheckpoint, error) {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	tableModel, ok := cpdb.checkpoints[tableName]
+	if !ok {
+		return nil, errors.Annotate(errCheckpointNotFound, tableName)
+	}
+	return tableModel.toCheckpoint(), nil
+}
+
+func (cpdb *EtcdCheckpointsDB) InsertEngineCheckpoints(ctx context.Context, tableName string, checkpoints []*EngineCheckpoint) error {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	tableModel := cpdb.checkpoints[tableName]
+	tableModel.insertEngines(checkpoints)
+	return errors.Trace(cpdb.save(ctx, tableName, allChunkRefs(tableModel)))
+}
+
+func (cpdb *EtcdCheckpointsDB) Update(ctx context.Context, checkpointDiffs map[string]*TableCheckpointDiff) error {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	// only the chunks changed are written.
+	var ops []clientv3.Op
+	for tableName, cpd := range checkpointDiffs {
+		tableModel := cpdb.checkpoints[tableName]
+		tableModel.applyDiff(cpd)
+
+		var chunks []etcdChunkRef
+		for engineID, engineDiff := range cpd.engines {
+			for key := range engineDiff.chunks {
+				chunks = append(chunks, etcdChunkRef{engineID: engineID, key: key.String()})
+			}
+			for key := range engineDiff.quarantined {
+				if _, ok := engineDiff.chunks[key]; !ok {
+					chunks = append(chunks, etcdChunkRef{engineID: engineID, key: key.String()})
+				}
+			}
+		}
+		tableOps, err := putTableOps(cpdb.prefix, tableName, tableModel, chunks)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		ops = append(ops, tableOps...)
+	}
+	return errors.Trace(cpdb.commit(ctx, ops))
+}
+
+// GetTaskProgress reads the serialized TaskProgressModel stored under the key
+// "/tidb-lightning/task-progress/$task".
+func (cpdb *EtcdCheckpointsDB) GetTaskProgress(ctx context.Context) (*TaskProgress, error) {
+	resp, err := cpdb.cli.Get(ctx, etcdTaskProgressKeyPrefix+cpdb.taskName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	model := new(TaskProgressModel)
+	if err := model.Unmarshal(resp.Kvs[0].Value); err != nil {
+		return nil, errors.Annotatef(err, "corrupted task progress %s", resp.Kvs[0].Key)
+	}
+	return model.toProgress(), nil
+}
+
+func (cpdb *EtcdCheckpointsDB) UpdateTaskProgress(ctx context.Context, progress *TaskProgress) error {
+	serialized, err := progress.toModel().Marshal()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = cpdb.cli.Put(ctx, etcdTaskProgressKeyPrefix+cpdb.taskName, string(serialized))
+	return errors.Trace(err)
+}
+
+// GetTaskMeta reads the task meta stored under the key
+// "/tidb-lightning/task-meta/$task/$name".
+func (cpdb *EtcdCheckpointsDB) GetTaskMeta(ctx context.Context, name string) ([]byte, error) {
+	resp, err := cpdb.cli.Get(ctx, etcdTaskMetaKeyPrefix+cpdb.taskName+"/"+name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+func (cpdb *EtcdCheckpointsDB) UpdateTaskMeta(ctx context.Context, name string, value []byte) error {
+	key := etcdTaskMetaKeyPrefix + cpdb.taskName + "/" + name
+	var err error
+	if value == nil {
+		_, err = cpdb.cli.Delete(ctx, key)
+	} else {
+		_, err = cpdb.cli.Put(ctx, key, string(value))
+	}
+	return errors.Trace(err)
+}
+
+// Watch implements CheckpointsWatcher. The changes are read from etcd, so those
+// made by other processes (e.g. tidb-lightning-ctl) are reported too.
+func (cpdb *EtcdCheckpointsDB) Watch(ctx context.Context) <-chan CheckpointEvent {
+	events := make(chan CheckpointEvent)
+	go func() {
+		defer close(events)
+		if err := cpdb.watch(ctx, events); err != nil && !common.IsContextCanceledError(err) {
+			common.AppLogger.Warnf("failed to watch checkpoints: %v", err)
+		}
+	}()
+	return events
+}
+
+func (cpdb *EtcdCheckpointsDB) watch(ctx context.Context, events chan<- CheckpointEvent) error {
+	// the chunk keys only make sense with their tables, so the watch starts
+	// from a snapshot of all keys.
+	resp, err := cpdb.cli.Get(ctx, cpdb.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cache := newEtcdCheckpointsCache(cpdb.prefix)
+	for _, kv := range resp.Kvs {
+		if _, err := cache.apply(kv, false); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	watchCh := cpdb.cli.Watch(ctx, cpdb.prefix, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+	for watchResp := range watchCh {
+		if err := watchResp.Err(); err != nil {
+			return errors.Trace(err)
+		}
+		// a transaction may change many keys of a table, which are reported
+		// as a single event after all of them are applied.
+		changed := make(map[string]struct{})
+		for _, ev := range watchResp.Events {
+			tableName, err := cache.apply(ev.Kv, ev.Type == clientv3.EventTypeDelete)
+			if err != nil {
+				common.AppLogger.Warnf("failed to watch checkpoints: %v", err)
+				continue
+			}
+			changed[tableName] = struct{}{}
+		}
+		tableNames := make([]string, 0, len(changed))
+		for tableName := range changed {
+			tableNames = append(tableNames, tableName)
+		}
+		sort.Strings(tableNames)
+
+		for _, tableName := range tableNames {
+			event := CheckpointEvent{TableName: tableName}
+			if tableModel := cache.checkpoint(tableName); tableModel != nil {
+				event.Checkpoint = tableModel.toCheckpoint()
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+func (cpdb *EtcdCheckpointsDB) RemoveCheckpoint(ctx context.Context, tableName string) error {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	if tableName == "all" {
+		cpdb.checkpoints = make(map[string]*TableCheckpointModel)
+		_, err := cpdb.cli.Txn(ctx).Then(
+			clientv3.OpDelete(cpdb.prefix, clientv3.WithPrefix()),
+			clientv3.OpDelete(etcdTaskProgressKeyPrefix+cpdb.taskName),
+		).Commit()
+		return errors.Trace(err)
+	}
+	return errors.Trace(cpdb.delete(ctx, tableName))
+}
+
+// ArchiveCheckpoints moves every table checkpoint of this task under the
+// prefix "/tidb-lightning/checkpoints-history/$task/$archiveTime/", in the same
+// layout as the live checkpoints.
+func (cpdb *EtcdCheckpointsDB) ArchiveCheckpoints(ctx context.Context, archiveTime time.Time) error {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	historyPrefix := etcdCheckpointsHistoryKeyPrefix + cpdb.taskName + "/" + archiveTime.Format(checkpointArchiveTimeFmt) + "/"
+	for tableName, tableModel := range cpdb.checkpoints {
+		// the table is removed only after its copy is complete.
+		ops, err := putTableOps(historyPrefix, tableName, tableModel, allChunkRefs(tableModel))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := cpdb.commit(ctx, ops); err != nil {
+			return errors.Trace(err)
+		}
+		if err := cpdb.delete(ctx, tableName); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	_, err := cpdb.cli.Delete(ctx, etcdTaskProgressKeyPrefix+cpdb.taskName)
+	return errors.Trace(err)
+}
+
+func (cpdb *EtcdCheckpointsDB) IgnoreErrorCheckpoint(ctx context.Context, targetTableName string) error {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	for tableName, tableModel := range cpdb.checkpoints {
+		if !(targetTableName == "all" || targetTableName == tableName) {
+			continue
+		}
+		tableModel.ignoreError()
+		if err := cpdb.save(ctx, tableName, nil); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func (cpdb *EtcdCheckpointsDB) DestroyErrorCheckpoint(ctx context.Context, targetTableName string) ([]DestroyedTableCheckpoint, error) {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	var targetTables []DestroyedTableCheckpoint
+
+	for tableName, tableModel := range cpdb.checkpoints {
+		if !(targetTableName == "all" || targetTableName == tableName) {
+			continue
+		}
+		if tableModel.Status <= uint32(CheckpointStatusMaxInvalid) {
+			targetTables = append(targetTables, DestroyedTableCheckpoint{
+				TableName:    tableName,
+				EnginesCount: len(tableModel.Engines),
+			})
+		}
+	}
+
+	for _, dtcp := range targetTables {
+		if err := cpdb.delete(ctx, dtcp.TableName); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return targetTables, nil
+}
+
+func (cpdb *EtcdCheckpointsDB) RetryEngineCheckpoint(ctx context.Context, tableName string, engineID int) error {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	tableModel, ok := cpdb.checkpoints[tableName]
+	if !ok || engineID < 0 || engineID >= len(tableModel.Engines) {
+		return errors.Errorf("engine %s:%d not found in checkpoint", tableName, engineID)
+	}
+	tableModel.retryEngine(engineID)
+	var chunks []etcdChunkRef
+	for key := range tableModel.Engines[engineID].Chunks {
+		chunks = append(chunks, etcdChunkRef{engineID: engineID, key: key})
+	}
+	return errors.Trace(cpdb.save(ctx, tableName, chunks))
+}
+
+func (cpdb *EtcdCheckpointsDB) RetryChunkCheckpoints(ctx context.Context, targetTableName string) (int, error) {
+	cpdb.lock.Lock()
+	defer cpdb.lock.Unlock()
+
+	for tableName, tableModel := range cpdb.checkpoints {
+		if !(targetTableName == "all" || targetTableName == tableName) {
+			continue
+		}
+		if err := tableModel.checkQuarantinedChunks(tableName); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	count := 0
+	for tableName, tableModel := range cpdb.checkpoints {
+		if !(targetTableName == "all" || targetTableName == tableName) {
+			continue
+		}
+		if n := tableModel.retryQuarantinedChunks(); n > 0 {
+			if err := cpdb.save(ctx, tableName, allChunkRefs(tableModel)); err != nil {
+				return count, errors.Trace(err)
+			}
+			count += n
+		}
+	}
+	return count, nil
+}
+
+func (cpdb *EtcdCheckpointsDB) DumpTables(context.Context, io.Writer) error {
+	return errors.Errorf("dumping etcd checkpoint into CSV not unsupported, you may read the keys under %s instead", cpdb.prefix)
+}
+
+func (cpdb *EtcdCheckpointsDB) DumpEngines(context.Context, io.Writer) error {
+	return errors.Errorf("dumping etcd checkpoint into CSV not unsupported, you may read the keys under %s instead", cpdb.prefix)
+}
+
+func (cpdb *EtcdCheckpointsDB) DumpChunks(context.Context, io.Writer) error {
+	return errors.Errorf("dumping etcd checkpoint into CSV not unsupported, you may read the keys under %s instead", cpdb.prefix)
+}
@@ -0,0 +1,446 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/mydump"
+	verify "github.com/pingcap/tidb-lightning/lightning/verification"
+)
+
+var _ = Suite(&etcdCheckpointsSuite{})
+
+type etcdCheckpointsSuite struct {
+	etcd *mockEtcd
+}
+
+func (s *etcdCheckpointsSuite) SetUpTest(c *C) {
+	var err error
+	s.etcd, err = newMockEtcd()
+	c.Assert(err, IsNil)
+}
+
+func (s *etcdCheckpointsSuite) TearDownTest(c *C) {
+	s.etcd.close()
+}
+
+func (s *etcdCheckpointsSuite) openEtcdCheckpointsDB(c *C) *EtcdCheckpointsDB {
+	tls, err := common.NewTLS("", "", "")
+	c.Assert(err, IsNil)
+	cpdb, err := NewEtcdCheckpointsDB(context.Background(), tls, s.etcd.endpoint(), "task")
+	c.Assert(err, IsNil)
+	return cpdb
+}
+
+func (s *etcdCheckpointsSuite) initialize(c *C, cpdb *EtcdCheckpointsDB) {
+	err := cpdb.Initialize(context.Background(), map[string]*TidbDBInfo{
+		"db": {
+			Name: "db",
+			Tables: map[string]*TidbTableInfo{
+				"t1": {Name: "t1"},
+				"t2": {Name: "t2"},
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *etcdCheckpointsSuite) newEtcdCheckpointsDB(c *C) *EtcdCheckpointsDB {
+	cpdb := s.openEtcdCheckpointsDB(c)
+	s.initialize(c, cpdb)
+	err := cpdb.InsertEngineCheckpoints(context.Background(), "`db`.`t1`", []*EngineCheckpoint{
+		{
+			Status: CheckpointStatusLoaded,
+			Chunks: []*ChunkCheckpoint{{
+				Key:   ChunkCheckpointKey{Path: "/tmp/db.t1.1.sql"},
+				Chunk: mydump.Chunk{Offset: 0, EndOffset: 100, PrevRowIDMax: 0, RowIDMax: 20},
+			}},
+		},
+		{
+			Status: CheckpointStatusLoaded,
+			Chunks: []*ChunkCheckpoint{{
+				Key:   ChunkCheckpointKey{Path: "/tmp/db.t1.2.sql"},
+				Chunk: mydump.Chunk{Offset: 0, EndOffset: 100, PrevRowIDMax: 20, RowIDMax: 40},
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+	return cpdb
+}
+
+func (s *etcdCheckpointsSuite) TestCheckpointsPersisted(c *C) {
+	ctx := context.Background()
+	cpdb := s.newEtcdCheckpointsDB(c)
+
+	cpd := NewTableCheckpointDiff()
+	(&ChunkCheckpointMerger{
+		EngineID: 1,
+		Key:      ChunkCheckpointKey{Path: "/tmp/db.t1.2.sql"},
+		Checksum: verify.MakeKVChecksum(10, 2, 444),
+		Pos:      50,
+		RowID:    30,
+	}).MergeInto(cpd)
+	(&StatusCheckpointMerger{EngineID: 0, Status: CheckpointStatusImported}).MergeInto(cpd)
+	(&RebaseCheckpointMerger{AllocBase: 31}).MergeInto(cpd)
+	c.Assert(cpdb.Update(context.Background(), map[string]*TableCheckpointDiff{"`db`.`t1`": cpd}), IsNil)
+	c.Assert(cpdb.Close(), IsNil)
+
+	// every table and every chunk is stored under its own key.
+	c.Assert(s.etcd.keys(), DeepEquals, []string{
+		"/tidb-lightning/checkpoints/task/chunks/%60db%60.%60t1%60/0/%2Ftmp%2Fdb.t1.1.sql:0",
+		"/tidb-lightning/checkpoints/task/chunks/%60db%60.%60t1%60/1/%2Ftmp%2Fdb.t1.2.sql:0",
+		"/tidb-lightning/checkpoints/task/tables/%60db%60.%60t1%60",
+		"/tidb-lightning/checkpoints/task/tables/%60db%60.%60t2%60",
+	})
+
+	// the checkpoints are loaded by the next run, and initializing again does
+	// not reset them.
+	cpdb = s.openEtcdCheckpointsDB(c)
+	defer cpdb.Close()
+	s.initialize(c, cpdb)
+	cp, err := cpdb.Get(ctx, "`db`.`t1`")
+	c.Assert(err, IsNil)
+	c.Assert(cp.AllocBase, Equals, int64(31))
+	c.Assert(cp.Engines, HasLen, 2)
+	c.Assert(cp.Engines[0].Status, Equals, CheckpointStatusImported)
+	c.Assert(cp.Engines[1].Status, Equals, CheckpointStatusLoaded)
+	c.Assert(cp.Engines[1].Chunks[0].Chunk.Offset, Equals, int64(50))
+	c.Assert(cp.Engines[1].Chunks[0].Chunk.PrevRowIDMax, Equals, int64(30))
+	c.Assert(cp.Engines[1].Chunks[0].Checksum.Sum(), Equals, uint64(444))
+
+	cp, err = cpdb.Get(ctx, "`db`.`t2`")
+	c.Assert(err, IsNil)
+	c.Assert(cp.Status, Equals, CheckpointStatusLoaded)
+	c.Assert(cp.Engines, HasLen, 0)
+
+	_, err = cpdb.Get(ctx, "`db`.`t3`")
+	c.Assert(isCheckpointNotFound(err), IsTrue)
+}
+
+func (s *etcdCheckpointsSuite) TestCorruptedCheckpoint(c *C) {
+	cli, err := s.etcd.newClient()
+	c.Assert(err, IsNil)
+	defer cli.Close()
+	tls, err := common.NewTLS("", "", "")
+	c.Assert(err, IsNil)
+
+	_, err = cli.Put(context.Background(), "/tidb-lightning/checkpoints/task/tables/%60db%60.%60t1%60", "\xff")
+	c.Assert(err, IsNil)
+	_, err = NewEtcdCheckpointsDB(context.Background(), tls, s.etcd.endpoint(), "task")
+	c.Assert(err, ErrorMatches, "corrupted checkpoint /tidb-lightning/checkpoints/task/tables/%60db%60.%60t1%60.*")
+
+	_, err = cli.Put(context.Background(), "/tidb-lightning/checkpoints/task/tables/%60db%60.%60t1%60", "")
+	c.Assert(err, IsNil)
+	_, err = cli.Put(context.Background(), "/tidb-lightning/checkpoints/task/chunks/%60db%60.%60t1%60/x/%2Ftmp%2Fdb.t1.1.sql:0", "")
+	c.Assert(err, IsNil)
+	_, err = NewEtcdCheckpointsDB(context.Background(), tls, s.etcd.endpoint(), "task")
+	c.Assert(err, ErrorMatches, "corrupted checkpoint key /tidb-lightning/checkpoints/task/chunks/%60db%60.%60t1%60/x/.*")
+}
+
+func (s *etcdCheckpointsSuite) TestUpdateOnlyChangedChunks(c *C) {
+	ctx := context.Background()
+	cpdb := s.newEtcdCheckpointsDB(c)
+	defer cpdb.Close()
+	cli, err := s.etcd.newClient()
+	c.Assert(err, IsNil)
+	defer cli.Close()
+
+	modRevisions := func() map[string]int64 {
+		resp, err := cli.Get(ctx, "/tidb-lightning/checkpoints/task/", clientv3.WithPrefix())
+		c.Assert(err, IsNil)
+		revs := make(map[string]int64)
+		for _, kv := range resp.Kvs {
+			revs[string(kv.Key)] = kv.ModRevision
+		}
+		return revs
+	}
+	before := modRevisions()
+
+	cpd := NewTableCheckpointDiff()
+	(&ChunkCheckpointMerger{
+		EngineID: 1,
+		Key:      ChunkCheckpointKey{Path: "/tmp/db.t1.2.sql"},
+		Pos:      50,
+		RowID:    30,
+	}).MergeInto(cpd)
+	c.Assert(cpdb.Update(ctx, map[string]*TableCheckpointDiff{"`db`.`t1`": cpd}), IsNil)
+
+	after := modRevisions()
+	for key, rev := range after {
+		switch key {
+		case "/tidb-lightning/checkpoints/task/chunks/%60db%60.%60t1%60/1/%2Ftmp%2Fdb.t1.2.sql:0",
+			"/tidb-lightning/checkpoints/task/tables/%60db%60.%60t1%60":
+			c.Assert(rev, Greater, before[key], Commentf("%s", key))
+		default:
+			c.Assert(rev, Equals, before[key], Commentf("%s", key))
+		}
+	}
+}
+
+func (s *etcdCheckpointsSuite) TestManyChunks(c *C) {
+	ctx := context.Background()
+	cpdb := s.openEtcdCheckpointsDB(c)
+	s.initialize(c, cpdb)
+
+	// more chunks than a transaction of etcd can take.
+	engine := &EngineCheckpoint{Status: CheckpointStatusLoaded}
+	for i := 0; i < etcdMaxTxnOps*2+1; i++ {
+		engine.Chunks = append(engine.Chunks, &ChunkCheckpoint{
+			Key:   ChunkCheckpointKey{Path: "/tmp/db.t1.sql", Offset: int64(i * 100)},
+			Chunk: mydump.Chunk{Offset: int64(i * 100), EndOffset: int64(i*100 + 100)},
+		})
+	}
+	c.Assert(cpdb.InsertEngineCheckpoints(ctx, "`db`.`t1`", []*EngineCheckpoint{engine}), IsNil)
+	c.Assert(cpdb.Close(), IsNil)
+
+	cpdb = s.openEtcdCheckpointsDB(c)
+	cp, err := cpdb.Get(ctx, "`db`.`t1`")
+	c.Assert(err, IsNil)
+	c.Assert(cp.CountChunks(), Equals, etcdMaxTxnOps*2+1)
+
+	archiveTime := time.Date(2019, 1, 2, 15, 4, 5, 0, time.Local)
+	c.Assert(cpdb.ArchiveCheckpoints(ctx, archiveTime), IsNil)
+	c.Assert(cpdb.Close(), IsNil)
+	c.Assert(s.etcd.keys(), HasLen, etcdMaxTxnOps*2+3)
+}
+
+func (s *etcdCheckpointsSuite) TestUpdateFailed(c *C) {
+	cpdb := s.newEtcdCheckpointsDB(c)
+	defer cpdb.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cpd := NewTableCheckpointDiff()
+	(&StatusCheckpointMerger{EngineID: -1, Status: CheckpointStatusAllWritten}).MergeInto(cpd)
+	err := cpdb.Update(ctx, map[string]*TableCheckpointDiff{"`db`.`t1`": cpd})
+	c.Assert(errors.Cause(err), Equals, context.Canceled)
+}
+
+func (s *etcdCheckpointsSuite) TestWatch(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cpdb := s.newEtcdCheckpointsDB(c)
+	defer cpdb.Close()
+	events := cpdb.Watch(ctx)
+
+	// the changes made by others are reported too.
+	ctlDB := s.openEtcdCheckpointsDB(c)
+	defer ctlDB.Close()
+
+	cpd := NewTableCheckpointDiff()
+	(&ChunkCheckpointMerger{
+		EngineID: 1,
+		Key:      ChunkCheckpointKey{Path: "/tmp/db.t1.2.sql"},
+		Pos:      50,
+		RowID:    30,
+	}).MergeInto(cpd)
+	(&StatusCheckpointMerger{EngineID: 1, Status: CheckpointStatusAllWritten}).MergeInto(cpd)
+	c.Assert(cpdb.Update(ctx, map[string]*TableCheckpointDiff{"`db`.`t1`": cpd}), IsNil)
+
+	// the chunk is reported with the rest of the table.
+	event := <-events
+	c.Assert(event.TableName, Equals, "`db`.`t1`")
+	c.Assert(event.Checkpoint.Engines, HasLen, 2)
+	c.Assert(event.Checkpoint.Engines[1].Status, Equals, CheckpointStatusAllWritten)
+	c.Assert(event.Checkpoint.Engines[1].Chunks[0].Chunk.Offset, Equals, int64(50))
+	c.Assert(event.Checkpoint.Engines[0].Chunks, HasLen, 1)
+
+	c.Assert(ctlDB.RemoveCheckpoint(ctx, "`db`.`t2`"), IsNil)
+	event = <-events
+	c.Assert(event.TableName, Equals, "`db`.`t2`")
+	c.Assert(event.Checkpoint, IsNil)
+
+	cancel()
+	for range events {
+	}
+}
+
+func (s *etcdCheckpointsSuite) TestRetryEngineCheckpoint(c *C) {
+	ctx := context.Background()
+	cpdb := s.newEtcdCheckpointsDB(c)
+
+	cpd := NewTableCheckpointDiff()
+	(&ChunkCheckpointMerger{
+		EngineID: 1,
+		Key:      ChunkCheckpointKey{Path: "/tmp/db.t1.2.sql"},
+		Checksum: verify.MakeKVChecksum(10, 2, 444),
+		Pos:      50,
+		RowID:    30,
+	}).MergeInto(cpd)
+	(&StatusCheckpointMerger{EngineID: 1, Status: CheckpointStatusImported / 10}).MergeInto(cpd)
+	c.Assert(cpdb.Update(context.Background(), map[string]*TableCheckpointDiff{"`db`.`t1`": cpd}), IsNil)
+
+	c.Assert(cpdb.RetryEngineCheckpoint(ctx, "`db`.`t1`", 1), IsNil)
+	c.Assert(cpdb.Close(), IsNil)
+
+	cpdb = s.openEtcdCheckpointsDB(c)
+	defer cpdb.Close()
+	cp, err := cpdb.Get(ctx, "`db`.`t1`")
+	c.Assert(err, IsNil)
+	c.Assert(cp.Engines[1].Status, Equals, CheckpointStatusLoaded)
+	c.Assert(cp.Engines[1].Chunks[0].Chunk.Offset, Equals, int64(0))
+	c.Assert(cp.Engines[1].Chunks[0].Chunk.PrevRowIDMax, Equals, int64(20))
+
+	err = cpdb.RetryEngineCheckpoint(ctx, "`db`.`t1`", 2)
+	c.Assert(err, ErrorMatches, "engine `db`.`t1`:2 not found in checkpoint")
+}
+
+func (s *etcdCheckpointsSuite) TestErrorCheckpoints(c *C) {
+	ctx := context.Background()
+	cpdb := s.newEtcdCheckpointsDB(c)
+	defer cpdb.Close()
+
+	for _, tableName := range []string{"`db`.`t1`", "`db`.`t2`"} {
+		cpd := NewTableCheckpointDiff()
+		(&StatusCheckpointMerger{EngineID: -1, Status: CheckpointStatusAllWritten / 10}).MergeInto(cpd)
+		c.Assert(cpdb.Update(context.Background(), map[string]*TableCheckpointDiff{tableName: cpd}), IsNil)
+	}
+
+	// the error of t2 is ignored, so only t1 is destroyed.
+	c.Assert(cpdb.IgnoreErrorCheckpoint(ctx, "`db`.`t2`"), IsNil)
+	destroyed, err := cpdb.DestroyErrorCheckpoint(ctx, "all")
+	c.Assert(err, IsNil)
+	c.Assert(destroyed, DeepEquals, []DestroyedTableCheckpoint{{TableName: "`db`.`t1`", EnginesCount: 2}})
+	c.Assert(s.etcd.keys(), DeepEquals, []string{"/tidb-lightning/checkpoints/task/tables/%60db%60.%60t2%60"})
+
+	cp, err := cpdb.Get(ctx, "`db`.`t2`")
+	c.Assert(err, IsNil)
+	c.Assert(cp.Status, Equals, CheckpointStatusLoaded)
+}
+
+func (s *etcdCheckpointsSuite) TestRemoveCheckpoint(c *C) {
+	ctx := context.Background()
+	cpdb := s.newEtcdCheckpointsDB(c)
+	defer cpdb.Close()
+	c.Assert(cpdb.UpdateTaskProgress(ctx, &TaskProgress{StartTime: time.Now(), Elapsed: time.Hour}), IsNil)
+	c.Assert(cpdb.UpdateTaskMeta(ctx, "pd-schedulers", []byte("{}")), IsNil)
+
+	c.Assert(cpdb.RemoveCheckpoint(ctx, "`db`.`t1`"), IsNil)
+	_, err := cpdb.Get(ctx, "`db`.`t1`")
+	c.Assert(isCheckpointNotFound(err), IsTrue)
+	c.Assert(s.etcd.keys(), DeepEquals, []string{
+		"/tidb-lightning/checkpoints/task/tables/%60db%60.%60t2%60",
+		"/tidb-lightning/task-meta/task/pd-schedulers",
+		"/tidb-lightning/task-progress/task",
+	})
+
+	// the progress starts over with the checkpoints, but the task meta is kept.
+	c.Assert(cpdb.RemoveCheckpoint(ctx, "all"), IsNil)
+	_, err = cpdb.Get(ctx, "`db`.`t2`")
+	c.Assert(isCheckpointNotFound(err), IsTrue)
+	c.Assert(s.etcd.keys(), DeepEquals, []string{"/tidb-lightning/task-meta/task/pd-schedulers"})
+}
+
+func (s *etcdCheckpointsSuite) TestArchiveCheckpoints(c *C) {
+	ctx := context.Background()
+	cpdb := s.newEtcdCheckpointsDB(c)
+	defer cpdb.Close()
+	c.Assert(cpdb.UpdateTaskProgress(ctx, &TaskProgress{StartTime: time.Now(), Elapsed: time.Hour}), IsNil)
+
+	archiveTime := time.Date(2019, 1, 2, 15, 4, 5, 0, time.Local)
+	c.Assert(cpdb.ArchiveCheckpoints(ctx, archiveTime), IsNil)
+	c.Assert(s.etcd.keys(), DeepEquals, []string{
+		"/tidb-lightning/checkpoints-history/task/20190102150405/chunks/%60db%60.%60t1%60/0/%2Ftmp%2Fdb.t1.1.sql:0",
+		"/tidb-lightning/checkpoints-history/task/20190102150405/chunks/%60db%60.%60t1%60/1/%2Ftmp%2Fdb.t1.2.sql:0",
+		"/tidb-lightning/checkpoints-history/task/20190102150405/tables/%60db%60.%60t1%60",
+		"/tidb-lightning/checkpoints-history/task/20190102150405/tables/%60db%60.%60t2%60",
+	})
+	_, err := cpdb.Get(ctx, "`db`.`t1`")
+	c.Assert(isCheckpointNotFound(err), IsTrue)
+
+	// the archived checkpoints are intact.
+	cli, err := s.etcd.newClient()
+	c.Assert(err, IsNil)
+	defer cli.Close()
+	historyPrefix := "/tidb-lightning/checkpoints-history/task/20190102150405/"
+	resp, err := cli.Get(ctx, historyPrefix, clientv3.WithPrefix())
+	c.Assert(err, IsNil)
+	cache := newEtcdCheckpointsCache(historyPrefix)
+	for _, kv := range resp.Kvs {
+		_, err := cache.apply(kv, false)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(cache.checkpoint("`db`.`t1`").toCheckpoint().CountChunks(), Equals, 2)
+}
+
+func (s *etcdCheckpointsSuite) TestTaskProgressAndMeta(c *C) {
+	ctx := context.Background()
+	cpdb := s.openEtcdCheckpointsDB(c)
+	defer cpdb.Close()
+
+	progress, err := cpdb.GetTaskProgress(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(progress, IsNil)
+	startTime := time.Date(2019, 1, 2, 15, 4, 5, 0, time.Local)
+	c.Assert(cpdb.UpdateTaskProgress(ctx, &TaskProgress{StartTime: startTime, Elapsed: time.Hour, BytesRead: 12345}), IsNil)
+	progress, err = cpdb.GetTaskProgress(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(progress.StartTime.Equal(startTime), IsTrue)
+	c.Assert(progress.Elapsed, Equals, time.Hour)
+	c.Assert(progress.BytesRead, Equals, int64(12345))
+
+	meta, err := cpdb.GetTaskMeta(ctx, "tikv-mode")
+	c.Assert(err, IsNil)
+	c.Assert(meta, IsNil)
+	c.Assert(cpdb.UpdateTaskMeta(ctx, "tikv-mode", []byte("import")), IsNil)
+	meta, err = cpdb.GetTaskMeta(ctx, "tikv-mode")
+	c.Assert(err, IsNil)
+	c.Assert(string(meta), Equals, "import")
+	c.Assert(cpdb.UpdateTaskMeta(ctx, "tikv-mode", nil), IsNil)
+	meta, err = cpdb.GetTaskMeta(ctx, "tikv-mode")
+	c.Assert(err, IsNil)
+	c.Assert(meta, IsNil)
+}
+
+func (s *etcdCheckpointsSuite) TestDumpUnsupported(c *C) {
+	cpdb := s.openEtcdCheckpointsDB(c)
+	defer cpdb.Close()
+	c.Assert(cpdb.DumpTables(context.Background(), nil), ErrorMatches, "dumping etcd checkpoint into CSV not unsupported.*")
+}
+
+func (s *etcdCheckpointsSuite) TestWatchTableStatuses(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cpdb := s.newEtcdCheckpointsDB(c)
+	defer cpdb.Close()
+
+	rc := &RestoreController{checkpointsDB: NewNullCheckpointsDB()}
+	_, ok := rc.WatchTableStatuses(ctx)
+	c.Assert(ok, IsFalse)
+
+	rc.checkpointsDB = cpdb
+	statuses, ok := rc.WatchTableStatuses(ctx)
+	c.Assert(ok, IsTrue)
+	cpd := NewTableCheckpointDiff()
+	(&StatusCheckpointMerger{EngineID: 0, Status: CheckpointStatusImported}).MergeInto(cpd)
+	c.Assert(cpdb.Update(ctx, map[string]*TableCheckpointDiff{"`db`.`t1`": cpd}), IsNil)
+	c.Assert(<-statuses, DeepEquals, &TableStatus{
+		Name:   "`db`.`t1`",
+		Status: "pending",
+		Engines: []*EngineStatus{
+			{ID: 0, Status: "imported", Chunks: 1},
+			{ID: 1, Status: "pending", Chunks: 1, RemainingBytes: 100},
+		},
+	})
+
+	c.Assert(cpdb.RemoveCheckpoint(ctx, "`db`.`t1`"), IsNil)
+	c.Assert(<-statuses, DeepEquals, &TableStatus{Name: "`db`.`t1`", Status: TableStatusNotStarted})
+}
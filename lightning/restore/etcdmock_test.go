@@ -0,0 +1,509 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/pingcap/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// mockEtcd is an in-memory etcd server implementing the KV, lease and watch
+// services used by Lightning, so the real etcd client can be tested against it.
+// The history is never compacted, the watch filters are ignored, and the
+// leases only expire by expireLeases.
+type mockEtcd struct {
+	mu        sync.Mutex
+	rev       int64
+	kvs       map[string]*mvccpb.KeyValue
+	leases    map[int64]int64 // ID -> TTL
+	nextLease int64
+	events    []*mvccpb.Event // the whole history, in order
+	changed   chan struct{}   // closed on the next change
+
+	server   *grpc.Server
+	listener net.Listener
+}
+
+func newMockEtcd() (*mockEtcd, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	m := &mockEtcd{
+		rev:       1,
+		kvs:       make(map[string]*mvccpb.KeyValue),
+		leases:    make(map[int64]int64),
+		nextLease: 1000,
+		changed:   make(chan struct{}),
+		server:    grpc.NewServer(),
+		listener:  listener,
+	}
+	pb.RegisterKVServer(m.server, m)
+	pb.RegisterLeaseServer(m.server, m)
+	pb.RegisterWatchServer(m.server, m)
+	healthpb.RegisterHealthServer(m.server, health.NewServer())
+	go m.server.Serve(listener)
+	return m, nil
+}
+
+func (m *mockEtcd) endpoint() string {
+	return m.listener.Addr().String()
+}
+
+func (m *mockEtcd) close() {
+	m.server.Stop()
+}
+
+func (m *mockEtcd) newClient() (*clientv3.Client, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{m.endpoint()},
+		DialTimeout: 5 * time.Second,
+	})
+	return cli, errors.Trace(err)
+}
+
+// expireLeases expires the leases attached to any key with the value, as if
+// the process holding them crashed.
+func (m *mockEtcd) expireLeases(value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, kv := range m.kvs {
+		if kv.Lease != 0 && string(kv.Value) == value {
+			m.revokeLocked(kv.Lease)
+		}
+	}
+}
+
+// keys lists all keys stored, in order.
+func (m *mockEtcd) keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.kvs))
+	for key := range m.kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *mockEtcd) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{ClusterId: 1, MemberId: 1, Revision: m.rev, RaftTerm: 1}
+}
+
+// recordLocked appends an event of the current revision to the history, and
+// wakes up the watchers.
+func (m *mockEtcd) recordLocked(typ mvccpb.Event_EventType, kv *mvccpb.KeyValue) {
+	if typ == mvccpb.DELETE {
+		kv = &mvccpb.KeyValue{Key: kv.Key, ModRevision: m.rev}
+	}
+	m.events = append(m.events, &mvccpb.Event{Type: typ, Kv: kv})
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func inRange(key []byte, start []byte, end []byte) bool {
+	switch {
+	case len(end) == 0:
+		return bytes.Equal(key, start)
+	case len(end) == 1 && end[0] == 0:
+		return bytes.Compare(key, start) >= 0
+	default:
+		return bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0
+	}
+}
+
+func (m *mockEtcd) rangeLocked(req *pb.RangeRequest) *pb.RangeResponse {
+	var kvs []*mvccpb.KeyValue
+	for _, kv := range m.kvs {
+		if !inRange(kv.Key, req.Key, req.RangeEnd) ||
+			(req.MinModRevision > 0 && kv.ModRevision < req.MinModRevision) ||
+			(req.MaxModRevision > 0 && kv.ModRevision > req.MaxModRevision) ||
+			(req.MinCreateRevision > 0 && kv.CreateRevision < req.MinCreateRevision) ||
+			(req.MaxCreateRevision > 0 && kv.CreateRevision > req.MaxCreateRevision) {
+			continue
+		}
+		kvs = append(kvs, kv)
+	}
+
+	less := func(a, b *mvccpb.KeyValue) bool {
+		switch req.SortTarget {
+		case pb.RangeRequest_VERSION:
+			return a.Version < b.Version
+		case pb.RangeRequest_CREATE:
+			return a.CreateRevision < b.CreateRevision
+		case pb.RangeRequest_MOD:
+			return a.ModRevision < b.ModRevision
+		case pb.RangeRequest_VALUE:
+			return bytes.Compare(a.Value, b.Value) < 0
+		default:
+			return bytes.Compare(a.Key, b.Key) < 0
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		if req.SortOrder == pb.RangeRequest_DESCEND {
+			return less(kvs[j], kvs[i])
+		}
+		return less(kvs[i], kvs[j])
+	})
+
+	resp := &pb.RangeResponse{Header: m.header(), Count: int64(len(kvs))}
+	if req.Limit > 0 && int64(len(kvs)) > req.Limit {
+		kvs = kvs[:req.Limit]
+		resp.More = true
+	}
+	if !req.CountOnly {
+		for _, kv := range kvs {
+			copied := *kv
+			if req.KeysOnly {
+				copied.Value = nil
+			}
+			resp.Kvs = append(resp.Kvs, &copied)
+		}
+	}
+	return resp
+}
+
+func (m *mockEtcd) putLocked(req *pb.PutRequest) (*pb.PutResponse, error) {
+	if _, ok := m.leases[req.Lease]; req.Lease != 0 && !ok {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	resp := &pb.PutResponse{}
+	kv := &mvccpb.KeyValue{Key: req.Key, Value: req.Value, Lease: req.Lease, CreateRevision: m.rev, ModRevision: m.rev, Version: 1}
+	if prev, ok := m.kvs[string(req.Key)]; ok {
+		if req.PrevKv {
+			copied := *prev
+			resp.PrevKv = &copied
+		}
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+	}
+	m.kvs[string(req.Key)] = kv
+	m.recordLocked(mvccpb.PUT, kv)
+	return resp, nil
+}
+
+func (m *mockEtcd) deleteLocked(req *pb.DeleteRangeRequest) *pb.DeleteRangeResponse {
+	resp := &pb.DeleteRangeResponse{}
+	for key, kv := range m.kvs {
+		if inRange(kv.Key, req.Key, req.RangeEnd) {
+			delete(m.kvs, key)
+			m.recordLocked(mvccpb.DELETE, kv)
+			resp.Deleted++
+			if req.PrevKv {
+				resp.PrevKvs = append(resp.PrevKvs, kv)
+			}
+		}
+	}
+	return resp
+}
+
+func (m *mockEtcd) compareLocked(cmp *pb.Compare) bool {
+	kv, ok := m.kvs[string(cmp.Key)]
+	if !ok {
+		kv = &mvccpb.KeyValue{}
+	}
+	var result int
+	switch target := cmp.TargetUnion.(type) {
+	case *pb.Compare_Value:
+		if !ok {
+			return false
+		}
+		result = bytes.Compare(kv.Value, target.Value)
+	case *pb.Compare_Version:
+		result = compareInt64(kv.Version, target.Version)
+	case *pb.Compare_CreateRevision:
+		result = compareInt64(kv.CreateRevision, target.CreateRevision)
+	case *pb.Compare_ModRevision:
+		result = compareInt64(kv.ModRevision, target.ModRevision)
+	case *pb.Compare_Lease:
+		result = compareInt64(kv.Lease, target.Lease)
+	}
+	switch cmp.Result {
+	case pb.Compare_EQUAL:
+		return result == 0
+	case pb.Compare_GREATER:
+		return result > 0
+	case pb.Compare_LESS:
+		return result < 0
+	default:
+		return result != 0
+	}
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (m *mockEtcd) Range(_ context.Context, req *pb.RangeRequest) (*pb.RangeResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rangeLocked(req), nil
+}
+
+func (m *mockEtcd) Put(_ context.Context, req *pb.PutRequest) (*pb.PutResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rev++
+	resp, err := m.putLocked(req)
+	if err != nil {
+		m.rev--
+		return nil, err
+	}
+	resp.Header = m.header()
+	return resp, nil
+}
+
+func (m *mockEtcd) DeleteRange(_ context.Context, req *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rev++
+	resp := m.deleteLocked(req)
+	if resp.Deleted == 0 {
+		m.rev--
+	}
+	resp.Header = m.header()
+	return resp, nil
+}
+
+func (m *mockEtcd) Txn(_ context.Context, req *pb.TxnRequest) (*pb.TxnResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	succeeded := true
+	for _, cmp := range req.Compare {
+		if !m.compareLocked(cmp) {
+			succeeded = false
+			break
+		}
+	}
+	ops := req.Success
+	if !succeeded {
+		ops = req.Failure
+	}
+
+	m.rev++
+	written := false
+	resp := &pb.TxnResponse{Succeeded: succeeded}
+	for _, op := range ops {
+		switch op := op.Request.(type) {
+		case *pb.RequestOp_RequestRange:
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{Response: &pb.ResponseOp_ResponseRange{ResponseRange: m.rangeLocked(op.RequestRange)}})
+		case *pb.RequestOp_RequestPut:
+			put, err := m.putLocked(op.RequestPut)
+			if err != nil {
+				return nil, err
+			}
+			written = true
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{Response: &pb.ResponseOp_ResponsePut{ResponsePut: put}})
+		case *pb.RequestOp_RequestDeleteRange:
+			del := m.deleteLocked(op.RequestDeleteRange)
+			written = written || del.Deleted > 0
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{Response: &pb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: del}})
+		default:
+			return nil, errors.New("nested transactions are not supported by the mock etcd")
+		}
+	}
+	if !written {
+		m.rev--
+	}
+	resp.Header = m.header()
+	return resp, nil
+}
+
+func (m *mockEtcd) Compact(context.Context, *pb.CompactionRequest) (*pb.CompactionResponse, error) {
+	return nil, errors.New("compaction is not supported by the mock etcd")
+}
+
+func (m *mockEtcd) LeaseGrant(_ context.Context, req *pb.LeaseGrantRequest) (*pb.LeaseGrantResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := req.ID
+	if id == 0 {
+		m.nextLease++
+		id = m.nextLease
+	}
+	m.leases[id] = req.TTL
+	return &pb.LeaseGrantResponse{Header: m.header(), ID: id, TTL: req.TTL}, nil
+}
+
+// revokeLocked removes the lease and the keys attached to it.
+func (m *mockEtcd) revokeLocked(id int64) {
+	delete(m.leases, id)
+	m.rev++
+	for key, kv := range m.kvs {
+		if kv.Lease == id {
+			delete(m.kvs, key)
+			m.recordLocked(mvccpb.DELETE, kv)
+		}
+	}
+}
+
+func (m *mockEtcd) LeaseRevoke(_ context.Context, req *pb.LeaseRevokeRequest) (*pb.LeaseRevokeResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.leases[req.ID]; !ok {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	m.revokeLocked(req.ID)
+	return &pb.LeaseRevokeResponse{Header: m.header()}, nil
+}
+
+func (m *mockEtcd) LeaseKeepAlive(stream pb.Lease_LeaseKeepAliveServer) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		m.mu.Lock()
+		// an expired lease is reported with TTL <= 0.
+		ttl, ok := m.leases[req.ID]
+		if !ok {
+			ttl = -1
+		}
+		resp := &pb.LeaseKeepAliveResponse{Header: m.header(), ID: req.ID, TTL: ttl}
+		m.mu.Unlock()
+		if err := stream.Send(resp); err != nil {
+			return nil
+		}
+	}
+}
+
+func (m *mockEtcd) LeaseTimeToLive(_ context.Context, req *pb.LeaseTimeToLiveRequest) (*pb.LeaseTimeToLiveResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ttl, ok := m.leases[req.ID]
+	if !ok {
+		return &pb.LeaseTimeToLiveResponse{Header: m.header(), ID: req.ID, TTL: -1}, nil
+	}
+	resp := &pb.LeaseTimeToLiveResponse{Header: m.header(), ID: req.ID, TTL: ttl, GrantedTTL: ttl}
+	if req.Keys {
+		for _, kv := range m.kvs {
+			if kv.Lease == req.ID {
+				resp.Keys = append(resp.Keys, kv.Key)
+			}
+		}
+	}
+	return resp, nil
+}
+
+func (m *mockEtcd) LeaseLeases(context.Context, *pb.LeaseLeasesRequest) (*pb.LeaseLeasesResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp := &pb.LeaseLeasesResponse{Header: m.header()}
+	for id := range m.leases {
+		resp.Leases = append(resp.Leases, &pb.LeaseStatus{ID: id})
+	}
+	return resp, nil
+}
+
+func (m *mockEtcd) Watch(stream pb.Watch_WatchServer) error {
+	var sendLock sync.Mutex
+	send := func(resp *pb.WatchResponse) error {
+		sendLock.Lock()
+		defer sendLock.Unlock()
+		return stream.Send(resp)
+	}
+
+	cancels := make(map[int64]context.CancelFunc)
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	var nextID int64
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		switch req := req.RequestUnion.(type) {
+		case *pb.WatchRequest_CreateRequest:
+			m.mu.Lock()
+			header := m.header()
+			m.mu.Unlock()
+			startRev := req.CreateRequest.StartRevision
+			if startRev == 0 {
+				startRev = header.Revision + 1
+			}
+			id := nextID
+			nextID++
+			if err := send(&pb.WatchResponse{Header: header, WatchId: id, Created: true}); err != nil {
+				return nil
+			}
+			ctx, cancel := context.WithCancel(stream.Context())
+			cancels[id] = cancel
+			go m.serveWatch(ctx, id, req.CreateRequest, startRev, send)
+		case *pb.WatchRequest_CancelRequest:
+			id := req.CancelRequest.WatchId
+			if cancel, ok := cancels[id]; ok {
+				cancel()
+				delete(cancels, id)
+			}
+			m.mu.Lock()
+			header := m.header()
+			m.mu.Unlock()
+			if err := send(&pb.WatchResponse{Header: header, WatchId: id, Canceled: true}); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// serveWatch sends the events in range since the revision, until the context
+// is canceled.
+func (m *mockEtcd) serveWatch(ctx context.Context, id int64, req *pb.WatchCreateRequest, rev int64, send func(*pb.WatchResponse) error) {
+	for {
+		m.mu.Lock()
+		var events []*mvccpb.Event
+		for _, ev := range m.events {
+			if ev.Kv.ModRevision >= rev && inRange(ev.Kv.Key, req.Key, req.RangeEnd) {
+				events = append(events, ev)
+			}
+		}
+		header := m.header()
+		changed := m.changed
+		m.mu.Unlock()
+
+		rev = header.Revision + 1
+		if len(events) > 0 {
+			if err := send(&pb.WatchResponse{Header: header, WatchId: id, Events: events}); err != nil {
+				return
+			}
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
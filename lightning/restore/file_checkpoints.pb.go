@@ -25,16 +25,19 @@ const _ = proto.GoGoProtoPackageIsVersion2 // please upgrade the proto package
 
 type CheckpointsModel struct {
 	// key is table_name
-	Checkpoints          map[string]*TableCheckpointModel `protobuf:"bytes,1,rep,name=checkpoints" json:"checkpoints,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value"`
-	XXX_NoUnkeyedLiteral struct{}                         `json:"-"`
-	XXX_sizecache        int32                            `json:"-"`
+	Checkpoints map[string]*TableCheckpointModel `protobuf:"bytes,1,rep,name=checkpoints" json:"checkpoints,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value"`
+	Progress    *TaskProgressModel               `protobuf:"bytes,2,opt,name=progress,proto3" json:"progress,omitempty"`
+	// key is the name of the meta, e.g. "pd-schedulers"
+	TaskMeta             map[string][]byte `protobuf:"bytes,3,rep,name=task_meta,json=taskMeta" json:"task_meta,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
 }
 
 func (m *CheckpointsModel) Reset()         { *m = CheckpointsModel{} }
 func (m *CheckpointsModel) String() string { return proto.CompactTextString(m) }
 func (*CheckpointsModel) ProtoMessage()    {}
 func (*CheckpointsModel) Descriptor() ([]byte, []int) {
-	return fileDescriptor_file_checkpoints_168275cfec5db5bf, []int{0}
+	return fileDescriptor_file_checkpoints_da57ce914828063d, []int{0}
 }
 func (m *CheckpointsModel) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -63,6 +66,49 @@ func (m *CheckpointsModel) XXX_DiscardUnknown() {
 
 var xxx_messageInfo_CheckpointsModel proto.InternalMessageInfo
 
+type TaskProgressModel struct {
+	// unix time in nanoseconds
+	StartTime int64 `protobuf:"varint,1,opt,name=start_time,json=startTime,proto3" json:"start_time,omitempty"`
+	// in nanoseconds
+	Elapsed              int64    `protobuf:"varint,2,opt,name=elapsed,proto3" json:"elapsed,omitempty"`
+	BytesRead            int64    `protobuf:"varint,3,opt,name=bytes_read,json=bytesRead,proto3" json:"bytes_read,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *TaskProgressModel) Reset()         { *m = TaskProgressModel{} }
+func (m *TaskProgressModel) String() string { return proto.CompactTextString(m) }
+func (*TaskProgressModel) ProtoMessage()    {}
+func (*TaskProgressModel) Descriptor() ([]byte, []int) {
+	return fileDescriptor_file_checkpoints_da57ce914828063d, []int{1}
+}
+func (m *TaskProgressModel) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *TaskProgressModel) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_TaskProgressModel.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalTo(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (dst *TaskProgressModel) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TaskProgressModel.Merge(dst, src)
+}
+func (m *TaskProgressModel) XXX_Size() int {
+	return m.Size()
+}
+func (m *TaskProgressModel) XXX_DiscardUnknown() {
+	xxx_messageInfo_TaskProgressModel.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_TaskProgressModel proto.InternalMessageInfo
+
 type TableCheckpointModel struct {
 	Hash                 []byte                   `protobuf:"bytes,1,opt,name=hash,proto3" json:"hash,omitempty"`
 	Status               uint32                   `protobuf:"varint,3,opt,name=status,proto3" json:"status,omitempty"`
@@ -76,7 +122,7 @@ func (m *TableCheckpointModel) Reset()         { *m = TableCheckpointModel{} }
 func (m *TableCheckpointModel) String() string { return proto.CompactTextString(m) }
 func (*TableCheckpointModel) ProtoMessage()    {}
 func (*TableCheckpointModel) Descriptor() ([]byte, []int) {
-	return fileDescriptor_file_checkpoints_168275cfec5db5bf, []int{1}
+	return fileDescriptor_file_checkpoints_da57ce914828063d, []int{2}
 }
 func (m *TableCheckpointModel) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -108,16 +154,18 @@ var xxx_messageInfo_TableCheckpointModel proto.InternalMessageInfo
 type EngineCheckpointModel struct {
 	Status uint32 `protobuf:"varint,1,opt,name=status,proto3" json:"status,omitempty"`
 	// key is "$path:$offset"
-	Chunks               map[string]*ChunkCheckpointModel `protobuf:"bytes,2,rep,name=chunks" json:"chunks,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value"`
-	XXX_NoUnkeyedLiteral struct{}                         `json:"-"`
-	XXX_sizecache        int32                            `json:"-"`
+	Chunks map[string]*ChunkCheckpointModel `protobuf:"bytes,2,rep,name=chunks" json:"chunks,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value"`
+	// the tikv-importer address the engine is assigned to
+	Importer             string   `protobuf:"bytes,3,opt,name=importer,proto3" json:"importer,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *EngineCheckpointModel) Reset()         { *m = EngineCheckpointModel{} }
 func (m *EngineCheckpointModel) String() string { return proto.CompactTextString(m) }
 func (*EngineCheckpointModel) ProtoMessage()    {}
 func (*EngineCheckpointModel) Descriptor() ([]byte, []int) {
-	return fileDescriptor_file_checkpoints_168275cfec5db5bf, []int{2}
+	return fileDescriptor_file_checkpoints_da57ce914828063d, []int{3}
 }
 func (m *EngineCheckpointModel) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -147,17 +195,21 @@ func (m *EngineCheckpointModel) XXX_DiscardUnknown() {
 var xxx_messageInfo_EngineCheckpointModel proto.InternalMessageInfo
 
 type ChunkCheckpointModel struct {
-	Path                 string   `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
-	Offset               int64    `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
-	Columns              []byte   `protobuf:"bytes,3,opt,name=columns,proto3" json:"columns,omitempty"`
-	ShouldIncludeRowId   bool     `protobuf:"varint,4,opt,name=should_include_row_id,json=shouldIncludeRowId,proto3" json:"should_include_row_id,omitempty"`
-	EndOffset            int64    `protobuf:"varint,5,opt,name=end_offset,json=endOffset,proto3" json:"end_offset,omitempty"`
-	Pos                  int64    `protobuf:"varint,6,opt,name=pos,proto3" json:"pos,omitempty"`
-	PrevRowidMax         int64    `protobuf:"varint,7,opt,name=prev_rowid_max,json=prevRowidMax,proto3" json:"prev_rowid_max,omitempty"`
-	RowidMax             int64    `protobuf:"varint,8,opt,name=rowid_max,json=rowidMax,proto3" json:"rowid_max,omitempty"`
-	KvcBytes             uint64   `protobuf:"varint,9,opt,name=kvc_bytes,json=kvcBytes,proto3" json:"kvc_bytes,omitempty"`
-	KvcKvs               uint64   `protobuf:"varint,10,opt,name=kvc_kvs,json=kvcKvs,proto3" json:"kvc_kvs,omitempty"`
-	KvcChecksum          uint64   `protobuf:"fixed64,11,opt,name=kvc_checksum,json=kvcChecksum,proto3" json:"kvc_checksum,omitempty"`
+	Path               string `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	Offset             int64  `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	Columns            []byte `protobuf:"bytes,3,opt,name=columns,proto3" json:"columns,omitempty"`
+	ShouldIncludeRowId bool   `protobuf:"varint,4,opt,name=should_include_row_id,json=shouldIncludeRowId,proto3" json:"should_include_row_id,omitempty"`
+	EndOffset          int64  `protobuf:"varint,5,opt,name=end_offset,json=endOffset,proto3" json:"end_offset,omitempty"`
+	Pos                int64  `protobuf:"varint,6,opt,name=pos,proto3" json:"pos,omitempty"`
+	PrevRowidMax       int64  `protobuf:"varint,7,opt,name=prev_rowid_max,json=prevRowidMax,proto3" json:"prev_rowid_max,omitempty"`
+	RowidMax           int64  `protobuf:"varint,8,opt,name=rowid_max,json=rowidMax,proto3" json:"rowid_max,omitempty"`
+	KvcBytes           uint64 `protobuf:"varint,9,opt,name=kvc_bytes,json=kvcBytes,proto3" json:"kvc_bytes,omitempty"`
+	KvcKvs             uint64 `protobuf:"varint,10,opt,name=kvc_kvs,json=kvcKvs,proto3" json:"kvc_kvs,omitempty"`
+	KvcChecksum        uint64 `protobuf:"fixed64,11,opt,name=kvc_checksum,json=kvcChecksum,proto3" json:"kvc_checksum,omitempty"`
+	FileSize           int64  `protobuf:"varint,12,opt,name=file_size,json=fileSize,proto3" json:"file_size,omitempty"`
+	FileModTime        int64  `protobuf:"varint,13,opt,name=file_mod_time,json=fileModTime,proto3" json:"file_mod_time,omitempty"`
+	// non-empty if the chunk is quarantined after repeated failures
+	QuarantineReason     string   `protobuf:"bytes,14,opt,name=quarantine_reason,json=quarantineReason,proto3" json:"quarantine_reason,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
 }
@@ -166,7 +218,7 @@ func (m *ChunkCheckpointModel) Reset()         { *m = ChunkCheckpointModel{} }
 func (m *ChunkCheckpointModel) String() string { return proto.CompactTextString(m) }
 func (*ChunkCheckpointModel) ProtoMessage()    {}
 func (*ChunkCheckpointModel) Descriptor() ([]byte, []int) {
-	return fileDescriptor_file_checkpoints_168275cfec5db5bf, []int{3}
+	return fileDescriptor_file_checkpoints_da57ce914828063d, []int{4}
 }
 func (m *ChunkCheckpointModel) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -198,6 +250,8 @@ var xxx_messageInfo_ChunkCheckpointModel proto.InternalMessageInfo
 func init() {
 	proto.RegisterType((*CheckpointsModel)(nil), "CheckpointsModel")
 	proto.RegisterMapType((map[string]*TableCheckpointModel)(nil), "CheckpointsModel.CheckpointsEntry")
+	proto.RegisterMapType((map[string][]byte)(nil), "CheckpointsModel.TaskMetaEntry")
+	proto.RegisterType((*TaskProgressModel)(nil), "TaskProgressModel")
 	proto.RegisterType((*TableCheckpointModel)(nil), "TableCheckpointModel")
 	proto.RegisterType((*EngineCheckpointModel)(nil), "EngineCheckpointModel")
 	proto.RegisterMapType((map[string]*ChunkCheckpointModel)(nil), "EngineCheckpointModel.ChunksEntry")
@@ -246,6 +300,72 @@ func (m *CheckpointsModel) MarshalTo(dAtA []byte) (int, error) {
 			}
 		}
 	}
+	if m.Progress != nil {
+		dAtA[i] = 0x12
+		i++
+		i = encodeVarintFileCheckpoints(dAtA, i, uint64(m.Progress.Size()))
+		n2, err := m.Progress.MarshalTo(dAtA[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n2
+	}
+	if len(m.TaskMeta) > 0 {
+		for k, _ := range m.TaskMeta {
+			dAtA[i] = 0x1a
+			i++
+			v := m.TaskMeta[k]
+			byteSize := 0
+			if len(v) > 0 {
+				byteSize = 1 + len(v) + sovFileCheckpoints(uint64(len(v)))
+			}
+			mapSize := 1 + len(k) + sovFileCheckpoints(uint64(len(k))) + byteSize
+			i = encodeVarintFileCheckpoints(dAtA, i, uint64(mapSize))
+			dAtA[i] = 0xa
+			i++
+			i = encodeVarintFileCheckpoints(dAtA, i, uint64(len(k)))
+			i += copy(dAtA[i:], k)
+			if len(v) > 0 {
+				dAtA[i] = 0x12
+				i++
+				i = encodeVarintFileCheckpoints(dAtA, i, uint64(len(v)))
+				i += copy(dAtA[i:], v)
+			}
+		}
+	}
+	return i, nil
+}
+
+func (m *TaskProgressModel) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *TaskProgressModel) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if m.StartTime != 0 {
+		dAtA[i] = 0x8
+		i++
+		i = encodeVarintFileCheckpoints(dAtA, i, uint64(m.StartTime))
+	}
+	if m.Elapsed != 0 {
+		dAtA[i] = 0x10
+		i++
+		i = encodeVarintFileCheckpoints(dAtA, i, uint64(m.Elapsed))
+	}
+	if m.BytesRead != 0 {
+		dAtA[i] = 0x18
+		i++
+		i = encodeVarintFileCheckpoints(dAtA, i, uint64(m.BytesRead))
+	}
 	return i, nil
 }
 
@@ -335,14 +455,20 @@ func (m *EngineCheckpointModel) MarshalTo(dAtA []byte) (int, error) {
 				dAtA[i] = 0x12
 				i++
 				i = encodeVarintFileCheckpoints(dAtA, i, uint64(v.Size()))
-				n2, err := v.MarshalTo(dAtA[i:])
+				n3, err := v.MarshalTo(dAtA[i:])
 				if err != nil {
 					return 0, err
 				}
-				i += n2
+				i += n3
 			}
 		}
 	}
+	if len(m.Importer) > 0 {
+		dAtA[i] = 0x1a
+		i++
+		i = encodeVarintFileCheckpoints(dAtA, i, uint64(len(m.Importer)))
+		i += copy(dAtA[i:], m.Importer)
+	}
 	return i, nil
 }
 
@@ -424,6 +550,22 @@ func (m *ChunkCheckpointModel) MarshalTo(dAtA []byte) (int, error) {
 		encoding_binary.LittleEndian.PutUint64(dAtA[i:], uint64(m.KvcChecksum))
 		i += 8
 	}
+	if m.FileSize != 0 {
+		dAtA[i] = 0x60
+		i++
+		i = encodeVarintFileCheckpoints(dAtA, i, uint64(m.FileSize))
+	}
+	if m.FileModTime != 0 {
+		dAtA[i] = 0x68
+		i++
+		i = encodeVarintFileCheckpoints(dAtA, i, uint64(m.FileModTime))
+	}
+	if len(m.QuarantineReason) > 0 {
+		dAtA[i] = 0x72
+		i++
+		i = encodeVarintFileCheckpoints(dAtA, i, uint64(len(m.QuarantineReason)))
+		i += copy(dAtA[i:], m.QuarantineReason)
+	}
 	return i, nil
 }
 
@@ -452,6 +594,37 @@ func (m *CheckpointsModel) Size() (n int) {
 			n += mapEntrySize + 1 + sovFileCheckpoints(uint64(mapEntrySize))
 		}
 	}
+	if m.Progress != nil {
+		l = m.Progress.Size()
+		n += 1 + l + sovFileCheckpoints(uint64(l))
+	}
+	if len(m.TaskMeta) > 0 {
+		for k, v := range m.TaskMeta {
+			_ = k
+			_ = v
+			l = 0
+			if len(v) > 0 {
+				l = 1 + len(v) + sovFileCheckpoints(uint64(len(v)))
+			}
+			mapEntrySize := 1 + len(k) + sovFileCheckpoints(uint64(len(k))) + l
+			n += mapEntrySize + 1 + sovFileCheckpoints(uint64(mapEntrySize))
+		}
+	}
+	return n
+}
+
+func (m *TaskProgressModel) Size() (n int) {
+	var l int
+	_ = l
+	if m.StartTime != 0 {
+		n += 1 + sovFileCheckpoints(uint64(m.StartTime))
+	}
+	if m.Elapsed != 0 {
+		n += 1 + sovFileCheckpoints(uint64(m.Elapsed))
+	}
+	if m.BytesRead != 0 {
+		n += 1 + sovFileCheckpoints(uint64(m.BytesRead))
+	}
 	return n
 }
 
@@ -496,6 +669,10 @@ func (m *EngineCheckpointModel) Size() (n int) {
 			n += mapEntrySize + 1 + sovFileCheckpoints(uint64(mapEntrySize))
 		}
 	}
+	l = len(m.Importer)
+	if l > 0 {
+		n += 1 + l + sovFileCheckpoints(uint64(l))
+	}
 	return n
 }
 
@@ -537,6 +714,16 @@ func (m *ChunkCheckpointModel) Size() (n int) {
 	if m.KvcChecksum != 0 {
 		n += 9
 	}
+	if m.FileSize != 0 {
+		n += 1 + sovFileCheckpoints(uint64(m.FileSize))
+	}
+	if m.FileModTime != 0 {
+		n += 1 + sovFileCheckpoints(uint64(m.FileModTime))
+	}
+	l = len(m.QuarantineReason)
+	if l > 0 {
+		n += 1 + l + sovFileCheckpoints(uint64(l))
+	}
 	return n
 }
 
@@ -705,6 +892,265 @@ func (m *CheckpointsModel) Unmarshal(dAtA []byte) error {
 			}
 			m.Checkpoints[mapkey] = mapvalue
 			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Progress", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFileCheckpoints
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthFileCheckpoints
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Progress == nil {
+				m.Progress = &TaskProgressModel{}
+			}
+			if err := m.Progress.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TaskMeta", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFileCheckpoints
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthFileCheckpoints
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.TaskMeta == nil {
+				m.TaskMeta = make(map[string][]byte)
+			}
+			var mapkey string
+			mapvalue := []byte{}
+			for iNdEx < postIndex {
+				entryPreIndex := iNdEx
+				var wire uint64
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowFileCheckpoints
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					wire |= (uint64(b) & 0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				fieldNum := int32(wire >> 3)
+				if fieldNum == 1 {
+					var stringLenmapkey uint64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowFileCheckpoints
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						stringLenmapkey |= (uint64(b) & 0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					intStringLenmapkey := int(stringLenmapkey)
+					if intStringLenmapkey < 0 {
+						return ErrInvalidLengthFileCheckpoints
+					}
+					postStringIndexmapkey := iNdEx + intStringLenmapkey
+					if postStringIndexmapkey > l {
+						return io.ErrUnexpectedEOF
+					}
+					mapkey = string(dAtA[iNdEx:postStringIndexmapkey])
+					iNdEx = postStringIndexmapkey
+				} else if fieldNum == 2 {
+					var mapbyteLen uint64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowFileCheckpoints
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						mapbyteLen |= (uint64(b) & 0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					intMapbyteLen := int(mapbyteLen)
+					if intMapbyteLen < 0 {
+						return ErrInvalidLengthFileCheckpoints
+					}
+					postbytesIndex := iNdEx + intMapbyteLen
+					if postbytesIndex > l {
+						return io.ErrUnexpectedEOF
+					}
+					mapvalue = make([]byte, mapbyteLen)
+					copy(mapvalue, dAtA[iNdEx:postbytesIndex])
+					iNdEx = postbytesIndex
+				} else {
+					iNdEx = entryPreIndex
+					skippy, err := skipFileCheckpoints(dAtA[iNdEx:])
+					if err != nil {
+						return err
+					}
+					if skippy < 0 {
+						return ErrInvalidLengthFileCheckpoints
+					}
+					if (iNdEx + skippy) > postIndex {
+						return io.ErrUnexpectedEOF
+					}
+					iNdEx += skippy
+				}
+			}
+			m.TaskMeta[mapkey] = mapvalue
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipFileCheckpoints(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthFileCheckpoints
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *TaskProgressModel) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowFileCheckpoints
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: TaskProgressModel: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: TaskProgressModel: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field StartTime", wireType)
+			}
+			m.StartTime = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFileCheckpoints
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.StartTime |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Elapsed", wireType)
+			}
+			m.Elapsed = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFileCheckpoints
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Elapsed |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BytesRead", wireType)
+			}
+			m.BytesRead = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFileCheckpoints
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.BytesRead |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipFileCheckpoints(dAtA[iNdEx:])
@@ -1047,6 +1493,35 @@ func (m *EngineCheckpointModel) Unmarshal(dAtA []byte) error {
 			}
 			m.Chunks[mapkey] = mapvalue
 			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Importer", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFileCheckpoints
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthFileCheckpoints
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Importer = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipFileCheckpoints(dAtA[iNdEx:])
@@ -1320,6 +1795,73 @@ func (m *ChunkCheckpointModel) Unmarshal(dAtA []byte) error {
 			}
 			m.KvcChecksum = uint64(encoding_binary.LittleEndian.Uint64(dAtA[iNdEx:]))
 			iNdEx += 8
+		case 12:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field FileSize", wireType)
+			}
+			m.FileSize = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFileCheckpoints
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.FileSize |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 13:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field FileModTime", wireType)
+			}
+			m.FileModTime = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFileCheckpoints
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.FileModTime |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 14:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field QuarantineReason", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowFileCheckpoints
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthFileCheckpoints
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.QuarantineReason = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipFileCheckpoints(dAtA[iNdEx:])
@@ -1447,44 +1989,55 @@ var (
 )
 
 func init() {
-	proto.RegisterFile("lightning/restore/file_checkpoints.proto", fileDescriptor_file_checkpoints_168275cfec5db5bf)
+	proto.RegisterFile("lightning/restore/file_checkpoints.proto", fileDescriptor_file_checkpoints_da57ce914828063d)
 }
 
-var fileDescriptor_file_checkpoints_168275cfec5db5bf = []byte{
-	// 550 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x53, 0xcf, 0x6e, 0xd3, 0x3e,
-	0x1c, 0x9f, 0x9b, 0x2d, 0x6d, 0xbf, 0xe9, 0xef, 0xa7, 0xca, 0x5a, 0x87, 0x55, 0xb4, 0x2a, 0x54,
-	0x1c, 0x22, 0x21, 0x52, 0x18, 0x17, 0xb4, 0x63, 0xcb, 0x0e, 0x13, 0x9a, 0x40, 0x16, 0x5c, 0xb8,
-	0x44, 0xf9, 0xe3, 0x26, 0x51, 0xd2, 0xb8, 0x8a, 0x93, 0x6c, 0x7d, 0x0b, 0x24, 0x1e, 0x84, 0x27,
-	0xe0, 0xbe, 0x23, 0x0f, 0xc0, 0x01, 0xca, 0x8b, 0x20, 0x3b, 0x99, 0x9a, 0x4d, 0x15, 0xe2, 0xf6,
-	0xfd, 0xfc, 0xf1, 0xc7, 0xce, 0xc7, 0x31, 0x58, 0x69, 0x1c, 0x46, 0x45, 0x16, 0x67, 0xe1, 0x2c,
-	0x67, 0xa2, 0xe0, 0x39, 0x9b, 0x2d, 0xe3, 0x94, 0x39, 0x7e, 0xc4, 0xfc, 0x64, 0xcd, 0xe3, 0xac,
-	0x10, 0xf6, 0x3a, 0xe7, 0x05, 0x1f, 0x3f, 0x0f, 0xe3, 0x22, 0x2a, 0x3d, 0xdb, 0xe7, 0xab, 0x59,
-	0xc8, 0x43, 0x3e, 0x53, 0xb4, 0x57, 0x2e, 0x15, 0x52, 0x40, 0x4d, 0xb5, 0x7d, 0xfa, 0x15, 0xc1,
-	0x70, 0xb1, 0x0b, 0xb9, 0xe2, 0x01, 0x4b, 0xf1, 0x1b, 0x30, 0x5a, 0xc1, 0x04, 0x99, 0x9a, 0x65,
-	0x9c, 0x4d, 0xed, 0x87, 0xbe, 0x36, 0x71, 0x91, 0x15, 0xf9, 0x86, 0xb6, 0x97, 0x8d, 0x3f, 0xde,
-	0x4b, 0x56, 0x06, 0x3c, 0x04, 0x2d, 0x61, 0x1b, 0x82, 0x4c, 0x64, 0xf5, 0xa9, 0x1c, 0xf1, 0x33,
-	0x38, 0xaa, 0xdc, 0xb4, 0x64, 0xa4, 0x63, 0x22, 0xcb, 0x38, 0x1b, 0xd9, 0x1f, 0x5c, 0x2f, 0x65,
-	0xbb, 0x85, 0x6a, 0x27, 0x5a, 0x7b, 0xce, 0x3b, 0xaf, 0xd1, 0xf4, 0x0b, 0x82, 0xe3, 0x7d, 0x1e,
-	0x8c, 0xe1, 0x30, 0x72, 0x45, 0xa4, 0xc2, 0x07, 0x54, 0xcd, 0xf8, 0x04, 0x74, 0x51, 0xb8, 0x45,
-	0x29, 0x88, 0x66, 0x22, 0xeb, 0x3f, 0xda, 0x20, 0x7c, 0x0a, 0xe0, 0xa6, 0x29, 0xf7, 0x1d, 0xcf,
-	0x15, 0x8c, 0x1c, 0x9a, 0xc8, 0xd2, 0x68, 0x5f, 0x31, 0x73, 0x57, 0x30, 0xfc, 0x02, 0xba, 0x2c,
-	0x0b, 0xe3, 0x8c, 0x09, 0xa2, 0xab, 0x8f, 0x3f, 0xb1, 0x2f, 0x14, 0x7e, 0x78, 0xae, 0x3b, 0xdb,
-	0xf4, 0x1b, 0x82, 0xd1, 0x5e, 0x4b, 0xeb, 0x08, 0xe8, 0xde, 0x11, 0xce, 0x41, 0xf7, 0xa3, 0x32,
-	0x4b, 0x04, 0xe9, 0x34, 0xfd, 0xee, 0x5d, 0x6f, 0x2f, 0x94, 0xa9, 0xee, 0xb7, 0x59, 0x31, 0x7e,
-	0x0f, 0x46, 0x8b, 0xfe, 0x97, 0x56, 0x95, 0xfd, 0x2f, 0xad, 0xfe, 0xe8, 0xc0, 0xf1, 0x3e, 0x8f,
-	0x6c, 0x75, 0xed, 0x16, 0x51, 0x13, 0xae, 0x66, 0xf9, 0x49, 0x7c, 0xb9, 0x14, 0xac, 0x50, 0xf1,
-	0x1a, 0x6d, 0x10, 0x26, 0xd0, 0xf5, 0x79, 0x5a, 0xae, 0xb2, 0xba, 0xee, 0x01, 0xbd, 0x83, 0xf8,
-	0x25, 0x8c, 0x44, 0xc4, 0xcb, 0x34, 0x70, 0xe2, 0xcc, 0x4f, 0xcb, 0x80, 0x39, 0x39, 0xbf, 0x76,
-	0xe2, 0x40, 0x55, 0xdf, 0xa3, 0xb8, 0x16, 0x2f, 0x6b, 0x8d, 0xf2, 0xeb, 0xcb, 0x40, 0x5e, 0x11,
-	0xcb, 0x02, 0xa7, 0xd9, 0xe8, 0xa8, 0xbe, 0x22, 0x96, 0x05, 0xef, 0xea, 0xbd, 0x86, 0xa0, 0xad,
-	0xb9, 0xbc, 0x1e, 0xc9, 0xcb, 0x11, 0x3f, 0x85, 0xff, 0xd7, 0x39, 0xab, 0x64, 0x72, 0x1c, 0x38,
-	0x2b, 0xf7, 0x86, 0x74, 0x95, 0x38, 0x90, 0x2c, 0x95, 0xe4, 0x95, 0x7b, 0x83, 0x1f, 0x43, 0x7f,
-	0x67, 0xe8, 0x29, 0x43, 0x2f, 0x6f, 0x89, 0x49, 0xe5, 0x3b, 0xde, 0xa6, 0x60, 0x82, 0xf4, 0x4d,
-	0x64, 0x1d, 0xd2, 0x5e, 0x52, 0xf9, 0x73, 0x89, 0xf1, 0x23, 0xe8, 0x4a, 0x31, 0xa9, 0x04, 0x01,
-	0x25, 0xe9, 0x49, 0xe5, 0xbf, 0xad, 0x04, 0x7e, 0x02, 0x03, 0x29, 0xa8, 0x7f, 0x5f, 0x94, 0x2b,
-	0x62, 0x98, 0xc8, 0xd2, 0xa9, 0x91, 0x54, 0xfe, 0xa2, 0xa1, 0xe6, 0xa7, 0xb7, 0xbf, 0x26, 0x07,
-	0xb7, 0xdb, 0x09, 0xfa, 0xbe, 0x9d, 0xa0, 0x9f, 0xdb, 0x09, 0xfa, 0xfc, 0x7b, 0x72, 0xf0, 0xa9,
-	0xdb, 0xbc, 0x65, 0x4f, 0x57, 0x8f, 0xf1, 0xd5, 0x9f, 0x00, 0x00, 0x00, 0xff, 0xff, 0x5b, 0x0d,
-	0x43, 0xc6, 0xe7, 0x03, 0x00, 0x00,
+var fileDescriptor_file_checkpoints_da57ce914828063d = []byte{
+	// 732 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0x4d, 0x6f, 0xd3, 0x40,
+	0x10, 0x8d, 0xeb, 0x36, 0x1f, 0x9b, 0xa4, 0x4a, 0x57, 0x6d, 0xb1, 0x82, 0x08, 0x21, 0x02, 0x29,
+	0x52, 0x85, 0x03, 0xe5, 0x82, 0x0a, 0xa7, 0x96, 0x1e, 0x2a, 0x14, 0x51, 0x2d, 0xe5, 0xc2, 0xc5,
+	0xda, 0xd8, 0x9b, 0xd8, 0xf2, 0xc7, 0x1a, 0xef, 0xda, 0xfd, 0xf8, 0x15, 0x48, 0xfc, 0xa9, 0x8a,
+	0x53, 0x8f, 0xc0, 0x09, 0xda, 0x3f, 0x82, 0x76, 0xec, 0x36, 0x6e, 0x1b, 0x24, 0x6e, 0x3b, 0x6f,
+	0xde, 0xbc, 0xb7, 0xe3, 0x19, 0x2f, 0x1a, 0x06, 0xde, 0xcc, 0x95, 0x91, 0x17, 0xcd, 0x46, 0x09,
+	0x13, 0x92, 0x27, 0x6c, 0x34, 0xf5, 0x02, 0x66, 0xd9, 0x2e, 0xb3, 0xfd, 0x98, 0x7b, 0x91, 0x14,
+	0x66, 0x9c, 0x70, 0xc9, 0xbb, 0xcf, 0x67, 0x9e, 0x74, 0xd3, 0x89, 0x69, 0xf3, 0x70, 0x34, 0xe3,
+	0x33, 0x3e, 0x02, 0x78, 0x92, 0x4e, 0x21, 0x82, 0x00, 0x4e, 0x39, 0x7d, 0xf0, 0x6b, 0x09, 0x75,
+	0xf6, 0xe6, 0x22, 0x63, 0xee, 0xb0, 0x00, 0xbf, 0x43, 0xcd, 0x92, 0xb0, 0xa1, 0xf5, 0xf5, 0x61,
+	0x73, 0x7b, 0x60, 0xde, 0xe5, 0x95, 0x81, 0xfd, 0x48, 0x26, 0xa7, 0xa4, 0x5c, 0x86, 0x4d, 0x54,
+	0x8f, 0x13, 0x3e, 0x4b, 0x98, 0x10, 0xc6, 0x52, 0x5f, 0x1b, 0x36, 0xb7, 0xb1, 0x79, 0x44, 0x85,
+	0x7f, 0x58, 0x80, 0xa0, 0x41, 0x6e, 0x38, 0xf8, 0x2d, 0x6a, 0x48, 0x2a, 0x7c, 0x2b, 0x64, 0x92,
+	0x1a, 0x3a, 0x78, 0x3e, 0xbe, 0xef, 0xa9, 0x14, 0xc6, 0x4c, 0xd2, 0xdc, 0xb0, 0x2e, 0x8b, 0xb0,
+	0xfb, 0xe9, 0x56, 0x1f, 0x90, 0xc5, 0x1d, 0xa4, 0xfb, 0xec, 0xd4, 0xd0, 0xfa, 0xda, 0xb0, 0x41,
+	0xd4, 0x11, 0x6f, 0xa1, 0x95, 0x8c, 0x06, 0x29, 0x2b, 0x2e, 0xb4, 0x61, 0x1e, 0xd1, 0x49, 0xc0,
+	0xe6, 0x85, 0xf9, 0x9d, 0x72, 0xce, 0xce, 0xd2, 0x6b, 0xad, 0xfb, 0x06, 0xb5, 0x6f, 0x39, 0x2e,
+	0xd0, 0x5c, 0x2f, 0x6b, 0xb6, 0x4a, 0xc5, 0x03, 0x1f, 0xad, 0xdd, 0x6b, 0x18, 0x3f, 0x42, 0x48,
+	0x48, 0x9a, 0x48, 0x4b, 0x7a, 0x21, 0x03, 0x1d, 0x9d, 0x34, 0x00, 0x39, 0xf2, 0x42, 0x86, 0x0d,
+	0x54, 0x63, 0x01, 0x8d, 0x05, 0x73, 0x40, 0x4f, 0x27, 0xd7, 0xa1, 0x2a, 0x9c, 0x9c, 0x4a, 0x26,
+	0xac, 0x84, 0x51, 0xc7, 0xd0, 0xf3, 0x42, 0x40, 0x08, 0xa3, 0xce, 0xe0, 0x9b, 0x86, 0xd6, 0x17,
+	0x75, 0x83, 0x31, 0x5a, 0x76, 0xa9, 0x70, 0xc1, 0xaa, 0x45, 0xe0, 0x8c, 0x37, 0x51, 0x55, 0x48,
+	0x2a, 0x53, 0x01, 0x3a, 0x6d, 0x52, 0x44, 0xca, 0x83, 0x06, 0x01, 0xb7, 0xad, 0x09, 0x15, 0xcc,
+	0x58, 0xce, 0x3d, 0x00, 0xd9, 0xa5, 0x82, 0xe1, 0x17, 0xa8, 0xc6, 0xa2, 0x99, 0x17, 0x31, 0x61,
+	0x54, 0x61, 0x40, 0x9b, 0xe6, 0x3e, 0xc4, 0x77, 0xbf, 0xe0, 0x35, 0x6d, 0xf0, 0x53, 0x43, 0x1b,
+	0x0b, 0x29, 0xa5, 0x2b, 0x68, 0xb7, 0xae, 0xb0, 0x83, 0xaa, 0xb6, 0x9b, 0x46, 0xbe, 0x5a, 0x9a,
+	0x7c, 0xef, 0x16, 0xd6, 0x9b, 0x7b, 0x40, 0xca, 0xd7, 0xa0, 0xa8, 0xc0, 0x5d, 0x54, 0xf7, 0xc2,
+	0x98, 0x27, 0x92, 0x25, 0xd0, 0x58, 0x83, 0xdc, 0xc4, 0xdd, 0x43, 0xd4, 0x2c, 0x95, 0xfc, 0xcf,
+	0x6e, 0x00, 0xfd, 0xdf, 0xbb, 0x31, 0xf8, 0xae, 0xa3, 0xf5, 0x45, 0x1c, 0xf5, 0xc5, 0x63, 0x2a,
+	0xdd, 0x42, 0x1c, 0xce, 0xaa, 0x5d, 0x3e, 0x9d, 0x0a, 0x26, 0x8b, 0xb1, 0x16, 0x91, 0x9a, 0xb7,
+	0xcd, 0x83, 0x34, 0x8c, 0xf2, 0x51, 0xb4, 0xc8, 0x75, 0x88, 0x5f, 0xa2, 0x0d, 0xe1, 0xf2, 0x34,
+	0x70, 0x2c, 0x2f, 0xb2, 0x83, 0xd4, 0x61, 0x56, 0xc2, 0x8f, 0x2d, 0xcf, 0x81, 0xb1, 0xd4, 0x09,
+	0xce, 0x93, 0x07, 0x79, 0x8e, 0xf0, 0xe3, 0x03, 0x58, 0x11, 0x16, 0x39, 0x56, 0x61, 0xb4, 0x92,
+	0x8f, 0x8f, 0x45, 0xce, 0x87, 0xdc, 0xab, 0x83, 0xf4, 0x98, 0xab, 0xd1, 0x29, 0x5c, 0x1d, 0xf1,
+	0x53, 0xb4, 0x1a, 0x27, 0x2c, 0x53, 0xca, 0x9e, 0x63, 0x85, 0xf4, 0xc4, 0xa8, 0x41, 0xb2, 0xa5,
+	0x50, 0xa2, 0xc0, 0x31, 0x3d, 0xc1, 0x0f, 0x51, 0x63, 0x4e, 0xa8, 0x03, 0xa1, 0x9e, 0x94, 0x92,
+	0x7e, 0x66, 0x5b, 0xb0, 0x88, 0x46, 0xa3, 0xaf, 0x0d, 0x97, 0x49, 0xdd, 0xcf, 0xec, 0x5d, 0x15,
+	0xe3, 0x07, 0xa8, 0xa6, 0x92, 0x7e, 0x26, 0x0c, 0x04, 0xa9, 0xaa, 0x9f, 0xd9, 0xef, 0x33, 0x81,
+	0x9f, 0xa0, 0x96, 0x4a, 0xc0, 0x7b, 0x21, 0xd2, 0xd0, 0x68, 0xf6, 0xb5, 0x61, 0x95, 0x34, 0xfd,
+	0xcc, 0xde, 0x2b, 0x20, 0x25, 0x0c, 0x6f, 0x9c, 0xf0, 0xce, 0x98, 0xd1, 0xca, 0x5d, 0x15, 0xf0,
+	0xd1, 0x3b, 0x63, 0x78, 0x80, 0xda, 0x90, 0x0c, 0xb9, 0x93, 0xff, 0x48, 0x6d, 0x20, 0x34, 0x15,
+	0x38, 0xe6, 0x0e, 0xfc, 0x4a, 0x5b, 0x68, 0xed, 0x4b, 0x4a, 0x13, 0x1a, 0x49, 0x2f, 0x62, 0xea,
+	0xaf, 0x11, 0x3c, 0x32, 0x56, 0x61, 0x26, 0x9d, 0x79, 0x82, 0x00, 0xbe, 0xfb, 0xec, 0xfc, 0x4f,
+	0xaf, 0x72, 0x7e, 0xd9, 0xd3, 0x2e, 0x2e, 0x7b, 0xda, 0xef, 0xcb, 0x9e, 0xf6, 0xf5, 0xaa, 0x57,
+	0xb9, 0xb8, 0xea, 0x55, 0x7e, 0x5c, 0xf5, 0x2a, 0x9f, 0x6b, 0xc5, 0xab, 0x3b, 0xa9, 0xc2, 0xb3,
+	0xf9, 0xea, 0xef, 0x00, 0x58, 0x7d, 0x45, 0xe4, 0x91, 0x05, 0x00, 0x00,
 }
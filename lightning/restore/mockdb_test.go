@@ -0,0 +1,208 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sync"
+
+	"github.com/pingcap/errors"
+)
+
+// mockStatement is a statement the mockDB expects, and its outcome.
+type mockStatement struct {
+	pattern *regexp.Regexp
+	args    []driver.Value // not compared if nil
+	columns []string
+	rows    [][]driver.Value
+	err     error
+	query   string // the statement executed
+}
+
+// mockDB is a database/sql driver which expects the statements in order, and
+// replies with the given rows or error.
+type mockDB struct {
+	mu       sync.Mutex
+	expected []*mockStatement
+	failure  error // the first unexpected statement
+}
+
+var (
+	mockDBs      sync.Map // string -> *mockDB
+	mockDBSeq    int
+	mockDBSeqMu  sync.Mutex
+	registerMock sync.Once
+)
+
+// newMockDB opens a *sql.DB backed by a new mockDB.
+func newMockDB() (*sql.DB, *mockDB) {
+	registerMock.Do(func() { sql.Register("lightning-mock", mockDriver{}) })
+	mockDBSeqMu.Lock()
+	mockDBSeq++
+	dsn := fmt.Sprintf("mock-%d", mockDBSeq)
+	mockDBSeqMu.Unlock()
+
+	mock := &mockDB{}
+	mockDBs.Store(dsn, mock)
+	db, _ := sql.Open("lightning-mock", dsn)
+	return db, mock
+}
+
+// expect adds a statement matching the regular expression, which succeeds
+// with no rows.
+func (m *mockDB) expect(pattern string, args ...driver.Value) *mockStatement {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stmt := &mockStatement{pattern: regexp.MustCompile(pattern), args: args}
+	m.expected = append(m.expected, stmt)
+	return stmt
+}
+
+func (s *mockStatement) willReturnRows(columns []string, rows ...[]driver.Value) {
+	s.columns = columns
+	s.rows = rows
+}
+
+func (s *mockStatement) willFail(err error) {
+	s.err = err
+}
+
+// check returns an error if any statement is unexpected or not executed.
+func (m *mockDB) check() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failure != nil {
+		return m.failure
+	}
+	if len(m.expected) > 0 {
+		return errors.Errorf("%d statements not executed, the next is %s", len(m.expected), m.expected[0].pattern)
+	}
+	return nil
+}
+
+func (m *mockDB) next(query string, args []driver.NamedValue) (*mockStatement, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values := make([]driver.Value, 0, len(args))
+	for _, arg := range args {
+		values = append(values, arg.Value)
+	}
+	var err error
+	switch {
+	case len(m.expected) == 0:
+		err = errors.Errorf("unexpected statement %s %v", query, values)
+	case !m.expected[0].pattern.MatchString(query):
+		err = errors.Errorf("statement %s %v does not match %s", query, values, m.expected[0].pattern)
+	case m.expected[0].args != nil && !reflect.DeepEqual(m.expected[0].args, values):
+		err = errors.Errorf("statement %s has arguments %v, expected %v", query, values, m.expected[0].args)
+	}
+	if err != nil {
+		if m.failure == nil {
+			m.failure = err
+		}
+		return nil, err
+	}
+	stmt := m.expected[0]
+	stmt.query = query
+	m.expected = m.expected[1:]
+	return stmt, stmt.err
+}
+
+type mockDriver struct{}
+
+func (mockDriver) Open(dsn string) (driver.Conn, error) {
+	mock, ok := mockDBs.Load(dsn)
+	if !ok {
+		return nil, errors.Errorf("unknown mock database %s", dsn)
+	}
+	return &mockConn{db: mock.(*mockDB)}, nil
+}
+
+type mockConn struct {
+	db *mockDB
+}
+
+func (c *mockConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported by the mock database")
+}
+
+func (c *mockConn) Close() error {
+	return nil
+}
+
+// Begin expects a "BEGIN" statement, and the transaction ends with a "COMMIT"
+// or "ROLLBACK" statement.
+func (c *mockConn) Begin() (driver.Tx, error) {
+	if _, err := c.db.next("BEGIN", nil); err != nil {
+		return nil, err
+	}
+	return mockTx{db: c.db}, nil
+}
+
+func (c *mockConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if _, err := c.db.next(query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *mockConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	stmt, err := c.db.next(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &mockRows{columns: stmt.columns, rows: stmt.rows}, nil
+}
+
+type mockTx struct {
+	db *mockDB
+}
+
+func (tx mockTx) Commit() error {
+	_, err := tx.db.next("COMMIT", nil)
+	return err
+}
+
+func (tx mockTx) Rollback() error {
+	_, err := tx.db.next("ROLLBACK", nil)
+	return err
+}
+
+type mockRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *mockRows) Columns() []string {
+	return r.columns
+}
+
+func (r *mockRows) Close() error {
+	return nil
+}
+
+func (r *mockRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
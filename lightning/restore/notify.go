@@ -0,0 +1,149 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+const (
+	NotificationHeartbeat = "heartbeat"
+	NotificationFinished  = "finished"
+)
+
+// Notification is posted as JSON to `notification.webhook-url`, periodically
+// as a heartbeat while the task is running, and once when it finishes.
+type Notification struct {
+	Event              string     `json:"event"`
+	Task               string     `json:"task"`
+	Time               time.Time  `json:"time"`
+	Phase              string     `json:"phase"`
+	Progress           *Progress  `json:"progress"`
+	LastCheckpointTime *time.Time `json:"last_checkpoint_time"` // nil until a checkpoint is saved
+	Status             string     `json:"status,omitempty"`     // only for the finished event
+	Error              string     `json:"error,omitempty"`
+}
+
+// taskName identifies the task in the traces and the notifications.
+func (rc *RestoreController) taskName() string {
+	if rc.cfg.Coordination.Enable {
+		return rc.cfg.Coordination.Task
+	}
+	return rc.cfg.Checkpoint.Schema
+}
+
+func (rc *RestoreController) notification(event string) *Notification {
+	progress := rc.Progress()
+	n := &Notification{
+		Event:    event,
+		Task:     rc.taskName(),
+		Time:     time.Now(),
+		Phase:    progress.Phase,
+		Progress: progress,
+	}
+	if t, ok := rc.lastCheckpointTime.Load().(time.Time); ok {
+		n.LastCheckpointTime = &t
+	}
+	return n
+}
+
+// runHeartbeats posts the heartbeats until the context is done.
+func (rc *RestoreController) runHeartbeats(ctx context.Context) {
+	ticker := time.NewTicker(rc.cfg.Notification.HeartbeatInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := rc.postWebhook(ctx, rc.cfg.Notification.WebhookURL, rc.notification(NotificationHeartbeat)); err != nil {
+				common.AppLogger.Warnf("cannot post the heartbeat: %v", err)
+			}
+		}
+	}
+}
+
+// notifyFinished posts the outcome of the task to the webhooks. The task is
+// not affected if the webhooks are unavailable.
+func (rc *RestoreController) notifyFinished(err error) {
+	n := rc.notification(NotificationFinished)
+	n.Status = taskResultStatus(err)
+	if err != nil {
+		n.Error = common.RedactError(err).Error()
+	}
+
+	ctx := context.Background()
+	if webhookURL := rc.cfg.Notification.WebhookURL; len(webhookURL) > 0 {
+		if e := rc.postWebhook(ctx, webhookURL, n); e != nil {
+			common.AppLogger.Warnf("cannot post the task outcome to the webhook: %v", e)
+		}
+	}
+	if webhookURL := rc.cfg.Notification.SlackWebhookURL; len(webhookURL) > 0 {
+		message := struct {
+			Text string `json:"text"`
+		}{Text: slackMessage(n)}
+		if e := rc.postWebhook(ctx, webhookURL, &message); e != nil {
+			common.AppLogger.Warnf("cannot post the task outcome to Slack: %v", e)
+		}
+	}
+}
+
+// slackMessage summarizes the finished task in a line.
+func slackMessage(n *Notification) string {
+	text := fmt.Sprintf("tidb-lightning task %q %s after %v", n.Task, n.Status, time.Duration(n.Progress.Elapsed*float64(time.Second)).Round(time.Second))
+	if len(n.Error) > 0 {
+		text += ": " + n.Error
+	}
+	return text
+}
+
+func (rc *RestoreController) postWebhook(ctx context.Context, webhookURL string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, rc.cfg.Notification.Timeout.Duration)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		// the error quotes the URL, which may contain tokens.
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return errors.Annotate(err, "cannot reach the webhook")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("the webhook responds %s", resp.Status)
+	}
+	return nil
+}
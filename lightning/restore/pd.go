@@ -0,0 +1,221 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+// the PD schedulers removed while importing, which move regions around and
+// compete with the ingestion for IO.
+var pausedPDSchedulers = []string{
+	"balance-leader-scheduler",
+	"balance-region-scheduler",
+	"balance-hot-region-scheduler",
+}
+
+// the PD schedule config set to 0 while importing, which stops merging the
+// empty regions created by splitting.
+var pausedPDScheduleConfig = []string{
+	"max-merge-region-size",
+	"max-merge-region-keys",
+}
+
+// the name of the task meta in the checkpoints storing the pdSchedulerRecord.
+const pdSchedulerTaskMeta = "pd-schedulers"
+
+// pdSchedulerRecord is the original PD scheduling setting changed by
+// Lightning. It is persisted in the checkpoints before the change, so the
+// setting can be restored by the next run even if Lightning crashed.
+type pdSchedulerRecord struct {
+	Schedulers []string               `json:"schedulers"`
+	Config     map[string]interface{} `json:"config"`
+}
+
+func (rc *RestoreController) pdURL(path string) string {
+	return rc.tls.URL(rc.cfg.TiDB.PdAddr, "/pd/api/v1/"+path)
+}
+
+func doPDRequest(ctx context.Context, client *http.Client, method string, url string, body interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &reqBody)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("%s %s http status code != 200, message %s", method, url, message)
+	}
+	return nil
+}
+
+// loadPDSchedulerRecord returns the record of this run, or the one left in
+// the checkpoints by a previous run. Returns nil if the schedulers are not
+// paused.
+func (rc *RestoreController) loadPDSchedulerRecord(ctx context.Context) (*pdSchedulerRecord, error) {
+	if rc.pdSchedulerRecord != nil {
+		return rc.pdSchedulerRecord, nil
+	}
+	content, err := rc.checkpointsDB.GetTaskMeta(ctx, pdSchedulerTaskMeta)
+	if err != nil || content == nil {
+		return nil, errors.Trace(err)
+	}
+	record := new(pdSchedulerRecord)
+	if err := json.Unmarshal(content, record); err != nil {
+		return nil, errors.Annotatef(err, "invalid task meta %s in the checkpoints", pdSchedulerTaskMeta)
+	}
+	return record, nil
+}
+
+// savePDSchedulerRecord persists the record. It is also kept in memory, so the
+// setting is restored by this run even if the checkpoints are disabled.
+func (rc *RestoreController) savePDSchedulerRecord(ctx context.Context, record *pdSchedulerRecord) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := rc.checkpointsDB.UpdateTaskMeta(ctx, pdSchedulerTaskMeta, content); err != nil {
+		return errors.Trace(err)
+	}
+	rc.pdSchedulerRecord = record
+	return nil
+}
+
+// fetchPDSchedulerRecord reads the current PD scheduling setting which is
+// going to be changed.
+func (rc *RestoreController) fetchPDSchedulerRecord(client *http.Client) (*pdSchedulerRecord, error) {
+	var schedulers []string
+	if err := common.GetJSON(client, rc.pdURL("schedulers"), &schedulers); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var scheduleConfig map[string]interface{}
+	if err := common.GetJSON(client, rc.pdURL("config/schedule"), &scheduleConfig); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	record := &pdSchedulerRecord{Config: make(map[string]interface{})}
+	for _, name := range pausedPDSchedulers {
+		for _, scheduler := range schedulers {
+			if scheduler == name {
+				record.Schedulers = append(record.Schedulers, name)
+				break
+			}
+		}
+	}
+	for _, key := range pausedPDScheduleConfig {
+		if value, ok := scheduleConfig[key]; ok {
+			record.Config[key] = value
+		}
+	}
+	return record, nil
+}
+
+// pausePDSchedulers removes the balance schedulers and disables region merge
+// in PD, after recording the original setting.
+func (rc *RestoreController) pausePDSchedulers(ctx context.Context) error {
+	client := rc.tls.HTTPClient()
+
+	// if the previous run did not restore the setting, the current setting
+	// is the paused one, and the original is in the record.
+	record, err := rc.loadPDSchedulerRecord(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if record != nil {
+		common.AppLogger.Warnf("[pd] found the PD scheduling setting left by a previous run in the checkpoints, it will be restored after importing")
+		rc.pdSchedulerRecord = record
+	} else {
+		record, err = rc.fetchPDSchedulerRecord(client)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := rc.savePDSchedulerRecord(ctx, record); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	for _, name := range record.Schedulers {
+		if err := doPDRequest(ctx, client, http.MethodDelete, rc.pdURL("schedulers/"+name), nil); err != nil {
+			// the scheduler may have been removed by the previous run.
+			common.AppLogger.Warnf("[pd] cannot remove scheduler %s: %v", name, err)
+		}
+	}
+	pausedConfig := make(map[string]interface{}, len(record.Config))
+	for key := range record.Config {
+		pausedConfig[key] = 0
+	}
+	if len(pausedConfig) > 0 {
+		if err := doPDRequest(ctx, client, http.MethodPost, rc.pdURL("config/schedule"), pausedConfig); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	common.AppLogger.Infof("[pd] paused schedulers %v and schedule config %v", record.Schedulers, pausedPDScheduleConfig)
+	return nil
+}
+
+// resumePDSchedulers restores the PD scheduling setting changed by
+// pausePDSchedulers, either in this run or a previous run which did not
+// finish.
+func (rc *RestoreController) resumePDSchedulers(ctx context.Context) error {
+	record, err := rc.loadPDSchedulerRecord(ctx)
+	if err != nil || record == nil {
+		return errors.Trace(err)
+	}
+
+	client := rc.tls.HTTPClient()
+	for _, name := range record.Schedulers {
+		if err := doPDRequest(ctx, client, http.MethodPost, rc.pdURL("schedulers"), map[string]string{"name": name}); err != nil {
+			return errors.Annotatef(err, "cannot add back scheduler %s, the original PD scheduling setting is kept in the checkpoints", name)
+		}
+	}
+	if len(record.Config) > 0 {
+		if err := doPDRequest(ctx, client, http.MethodPost, rc.pdURL("config/schedule"), record.Config); err != nil {
+			return errors.Annotate(err, "cannot restore the schedule config, the original PD scheduling setting is kept in the checkpoints")
+		}
+	}
+
+	common.AppLogger.Infof("[pd] resumed schedulers %v and schedule config %v", record.Schedulers, record.Config)
+	rc.pdSchedulerRecord = nil
+	return errors.Trace(rc.checkpointsDB.UpdateTaskMeta(ctx, pdSchedulerTaskMeta, nil))
+}
+
+func (rc *RestoreController) resumePDSchedulersIfPaused(ctx context.Context) {
+	if !rc.cfg.TiDB.PausePDSchedulers {
+		return
+	}
+	if err := rc.resumePDSchedulers(ctx); err != nil {
+		common.AppLogger.Warnf("cannot resume PD schedulers: %v", err)
+	}
+}
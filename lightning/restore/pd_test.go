@@ -0,0 +1,160 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	. "github.com/pingcap/check"
+
+	"github.com/pingcap/tidb-lightning/lightning/config"
+)
+
+var _ = Suite(&pdSuite{})
+
+type pdSuite struct{}
+
+// mockPD keeps the schedulers and schedule config like PD does.
+type mockPD struct {
+	sync.Mutex
+	schedulers map[string]bool
+	config     map[string]interface{}
+}
+
+func (pd *mockPD) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	pd.Lock()
+	defer pd.Unlock()
+
+	switch {
+	case req.URL.Path == "/pd/api/v1/schedulers" && req.Method == http.MethodGet:
+		names := []string{}
+		for name := range pd.schedulers {
+			names = append(names, name)
+		}
+		json.NewEncoder(w).Encode(names)
+	case req.URL.Path == "/pd/api/v1/schedulers" && req.Method == http.MethodPost:
+		var body map[string]string
+		json.NewDecoder(req.Body).Decode(&body)
+		pd.schedulers[body["name"]] = true
+	case strings.HasPrefix(req.URL.Path, "/pd/api/v1/schedulers/") && req.Method == http.MethodDelete:
+		name := strings.TrimPrefix(req.URL.Path, "/pd/api/v1/schedulers/")
+		if !pd.schedulers[name] {
+			http.Error(w, "scheduler not found", http.StatusInternalServerError)
+			return
+		}
+		delete(pd.schedulers, name)
+	case req.URL.Path == "/pd/api/v1/config/schedule" && req.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(pd.config)
+	case req.URL.Path == "/pd/api/v1/config/schedule" && req.Method == http.MethodPost:
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		for key, value := range body {
+			pd.config[key] = value
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (pd *mockPD) schedulerNames() []string {
+	pd.Lock()
+	defer pd.Unlock()
+	names := []string{}
+	for name := range pd.schedulers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *pdSuite) TestPauseAndResumePDSchedulers(c *C) {
+	pd := &mockPD{
+		schedulers: map[string]bool{
+			"balance-leader-scheduler": true,
+			"balance-region-scheduler": true,
+			"label-scheduler":          true,
+		},
+		config: map[string]interface{}{
+			"max-merge-region-size": 20.0,
+			"max-merge-region-keys": 200000.0,
+			"max-snapshot-count":    3.0,
+		},
+	}
+	server := httptest.NewServer(pd)
+	defer server.Close()
+
+	cfg := config.NewConfig()
+	cfg.TiDB.PdAddr = strings.TrimPrefix(server.URL, "http://")
+	tls, err := cfg.Security.ToTLS()
+	c.Assert(err, IsNil)
+	cpPath := filepath.Join(c.MkDir(), "cp.pb")
+	rc := &RestoreController{cfg: cfg, tls: tls, checkpointsDB: NewFileCheckpointsDB(cpPath)}
+	ctx := context.Background()
+
+	c.Assert(rc.pausePDSchedulers(ctx), IsNil)
+	c.Assert(pd.schedulerNames(), DeepEquals, []string{"label-scheduler"})
+	c.Assert(pd.config["max-merge-region-size"], Equals, 0.0)
+	c.Assert(pd.config["max-merge-region-keys"], Equals, 0.0)
+	c.Assert(pd.config["max-snapshot-count"], Equals, 3.0)
+
+	// pausing again in a restarted run must keep the original setting, even
+	// if the checkpoints were removed in between.
+	c.Assert(rc.checkpointsDB.RemoveCheckpoint(ctx, "all"), IsNil)
+	c.Assert(rc.checkpointsDB.Close(), IsNil)
+	rc = &RestoreController{cfg: cfg, tls: tls, checkpointsDB: NewFileCheckpointsDB(cpPath)}
+	c.Assert(rc.pausePDSchedulers(ctx), IsNil)
+
+	c.Assert(rc.resumePDSchedulers(ctx), IsNil)
+	c.Assert(pd.schedulerNames(), DeepEquals, []string{"balance-leader-scheduler", "balance-region-scheduler", "label-scheduler"})
+	c.Assert(pd.config["max-merge-region-size"], Equals, 20.0)
+	c.Assert(pd.config["max-merge-region-keys"], Equals, 200000.0)
+
+	meta, err := rc.checkpointsDB.GetTaskMeta(ctx, pdSchedulerTaskMeta)
+	c.Assert(err, IsNil)
+	c.Assert(meta, IsNil)
+
+	// resuming without a record does nothing.
+	c.Assert(rc.resumePDSchedulers(ctx), IsNil)
+}
+
+func (s *pdSuite) TestPauseAndResumePDSchedulersWithoutCheckpoints(c *C) {
+	pd := &mockPD{
+		schedulers: map[string]bool{"balance-leader-scheduler": true},
+		config:     map[string]interface{}{"max-merge-region-size": 20.0},
+	}
+	server := httptest.NewServer(pd)
+	defer server.Close()
+
+	cfg := config.NewConfig()
+	cfg.TiDB.PdAddr = strings.TrimPrefix(server.URL, "http://")
+	tls, err := cfg.Security.ToTLS()
+	c.Assert(err, IsNil)
+	rc := &RestoreController{cfg: cfg, tls: tls, checkpointsDB: NewNullCheckpointsDB()}
+	ctx := context.Background()
+
+	// the setting is still restored by the same run.
+	c.Assert(rc.pausePDSchedulers(ctx), IsNil)
+	c.Assert(pd.schedulerNames(), HasLen, 0)
+	c.Assert(pd.config["max-merge-region-size"], Equals, 0.0)
+	c.Assert(rc.resumePDSchedulers(ctx), IsNil)
+	c.Assert(pd.schedulerNames(), DeepEquals, []string{"balance-leader-scheduler"})
+	c.Assert(pd.config["max-merge-region-size"], Equals, 20.0)
+}
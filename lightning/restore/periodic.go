@@ -0,0 +1,241 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/metric"
+)
+
+func (rc *RestoreController) runPeriodicActions(ctx context.Context, stop <-chan struct{}) {
+	switchModeTicker := time.NewTicker(rc.cfg.Cron.SwitchMode.Duration)
+	logProgressTicker := time.NewTicker(rc.cfg.Cron.LogProgress.Duration)
+	defer func() {
+		switchModeTicker.Stop()
+		logProgressTicker.Stop()
+	}()
+
+	var tuneC <-chan time.Time
+	if rc.tuner != nil {
+		tuneTicker := time.NewTicker(concurrencyTuneInterval)
+		defer tuneTicker.Stop()
+		tuneC = tuneTicker.C
+	}
+
+	var checkpointMetricsC <-chan time.Time
+	if rc.cfg.Cron.CheckpointMetrics.Duration > 0 {
+		checkpointMetricsTicker := time.NewTicker(rc.cfg.Cron.CheckpointMetrics.Duration)
+		defer checkpointMetricsTicker.Stop()
+		checkpointMetricsC = checkpointMetricsTicker.C
+	}
+
+	var saveAllocBaseC <-chan time.Time
+	if rc.cfg.Cron.SaveAllocBase.Duration > 0 {
+		saveAllocBaseTicker := time.NewTicker(rc.cfg.Cron.SaveAllocBase.Duration)
+		defer saveAllocBaseTicker.Stop()
+		saveAllocBaseC = saveAllocBaseTicker.C
+	}
+
+	var stallC <-chan time.Time
+	if timeout := rc.cfg.App.StallTimeout.Duration; timeout > 0 {
+		stallTicker := time.NewTicker(stallCheckInterval(timeout))
+		defer stallTicker.Stop()
+		stallC = stallTicker.C
+	}
+
+	rc.switchToImportMode(ctx)
+	if checkpointMetricsC != nil {
+		rc.exportCheckpointMetrics(ctx)
+	}
+
+	progressMetricsTicker := time.NewTicker(progressMetricsInterval)
+	defer progressMetricsTicker.Stop()
+
+	// on a terminal, the progress is shown as bars instead of being logged.
+	var displayC <-chan time.Time
+	display := rc.newProgressDisplay()
+	if display != nil {
+		displayTicker := time.NewTicker(progressDisplayInterval)
+		defer displayTicker.Stop()
+		displayC = displayTicker.C
+		defer func() { display.render(rc.Progress(), rc.tableProgresses()) }()
+	}
+
+	start := time.Now()
+	rc.progressBase.Store(progressBase{previous: rc.loadTaskProgress(ctx, start), start: start})
+	rc.exportProgressMetrics()
+	defer func() {
+		if err := rc.checkpointsDB.UpdateTaskProgress(context.Background(), rc.currentTaskProgress()); err != nil {
+			common.AppLogger.Warnf("cannot save task progress: %v", err)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			common.AppLogger.Warnf("Stopping periodic actions due to %v", ctx.Err())
+			return
+		case <-stop:
+			common.AppLogger.Info("Everything imported, stopping periodic actions")
+			return
+
+		case settings := <-rc.settingsCh:
+			switchModeTicker.Stop()
+			switchModeTicker = time.NewTicker(settings.SwitchMode.Duration)
+			logProgressTicker.Stop()
+			logProgressTicker = time.NewTicker(settings.LogProgress.Duration)
+
+		case <-switchModeTicker.C:
+			// periodically switch to import mode, as requested by TiKV 3.0
+			rc.switchToImportMode(ctx)
+
+		case <-logProgressTicker.C:
+			// log the current progress periodically, so OPS will know that we're still working
+			if err := rc.checkpointsDB.UpdateTaskProgress(ctx, rc.currentTaskProgress()); err != nil {
+				common.AppLogger.Warnf("cannot save task progress: %v", err)
+			}
+			progress := rc.exportProgressMetrics()
+			if display != nil {
+				break
+			}
+
+			var remaining string
+			if progress.FinishedChunks >= progress.EstimatedChunks {
+				remaining = ", post-processing"
+			} else if progress.EstimatedRemaining >= 0 {
+				remaining = fmt.Sprintf(", remaining %s", time.Duration(progress.EstimatedRemaining*float64(time.Second)).Round(time.Second))
+			}
+
+			// Note: a speed of 28 MiB/s roughly corresponds to 100 GiB/hour.
+			common.AppLogger.Infof(
+				"progress: %.0f/%.0f chunks (%.1f%%), %.0f/%.0f tables (%.1f%%), speed %.2f MiB/s%s",
+				progress.FinishedChunks, progress.EstimatedChunks, progress.FinishedChunks/progress.EstimatedChunks*100,
+				progress.CompletedTables, progress.TotalTables, progress.CompletedTables/progress.TotalTables*100,
+				progress.Speed/1048576,
+				remaining,
+			)
+
+		case <-progressMetricsTicker.C:
+			rc.exportProgressMetrics()
+
+		case <-displayC:
+			display.render(rc.Progress(), rc.tableProgresses())
+
+		case <-checkpointMetricsC:
+			rc.exportCheckpointMetrics(ctx)
+
+		case <-saveAllocBaseC:
+			rc.saveAllocBases()
+
+		case <-stallC:
+			rc.checkStalls()
+
+		case <-tuneC:
+			rc.tuner.tune(concurrencyTuneInterval)
+		}
+	}
+}
+
+// loadTaskProgress reads the progress of the previous runs from the
+// checkpoint, or starts a new one at `start`.
+func (rc *RestoreController) loadTaskProgress(ctx context.Context, start time.Time) *TaskProgress {
+	progress, err := rc.checkpointsDB.GetTaskProgress(ctx)
+	if err != nil {
+		common.AppLogger.Warnf("cannot read task progress, the progress will start over: %v", err)
+	}
+	if progress == nil {
+		return &TaskProgress{StartTime: start}
+	}
+	common.AppLogger.Infof(
+		"resuming task started at %v, previously spent %v and read %d bytes",
+		progress.StartTime, progress.Elapsed.Round(time.Second), progress.BytesRead,
+	)
+	return progress
+}
+
+// saveAllocBases saves the allocator base of every table being restored into
+// the checkpoint. The chunk checkpoints also carry the base, but they are only
+// saved after delivering a block, which may take long on a huge chunk. If the
+// base is rolled back by a crash, the resumed import may reuse the row IDs.
+func (rc *RestoreController) saveAllocBases() {
+	rc.activeTables.Range(func(key, value interface{}) bool {
+		t := value.(*TableRestore)
+		rc.saveCheckpoint(saveCp{
+			tableName: t.tableName,
+			merger: &RebaseCheckpointMerger{
+				AllocBase: t.alloc.Base() + 1,
+			},
+		})
+		return true
+	})
+}
+
+// exportCheckpointMetrics reports the progress saved in the checkpoints
+// database as gauges. Unlike the counters updated during the import, these
+// reflect the whole task even after Lightning is restarted.
+func (rc *RestoreController) exportCheckpointMetrics(ctx context.Context) {
+	tableStates := make(map[string]float64)
+	engineStates := make(map[string]float64)
+	remainingBytes := make(map[string]float64)
+
+	for _, dbMeta := range rc.dbMetas {
+		for _, tableMeta := range dbMeta.Tables {
+			tableName := common.UniqueTable(dbMeta.Name, tableMeta.Name)
+			cp, err := rc.checkpointsDB.Get(ctx, tableName)
+			if err != nil {
+				common.TableLogger(tableName).Warnf("cannot read checkpoint for exporting metrics: %v", err)
+				return
+			}
+
+			tableStates[cp.Status.MetricName()]++
+			var remaining int64
+			if len(cp.Engines) == 0 && cp.Status < CheckpointStatusAllWritten {
+				// chunks are not populated yet, so the whole table is remaining.
+				for _, path := range tableMeta.DataFiles {
+					if stat, err := os.Stat(path); err == nil {
+						remaining += stat.Size()
+					}
+				}
+			}
+			for _, engine := range cp.Engines {
+				engineStates[engine.Status.MetricName()]++
+				if engine.Status >= CheckpointStatusAllWritten {
+					continue
+				}
+				for _, chunk := range engine.Chunks {
+					remaining += chunk.Chunk.EndOffset - chunk.Chunk.Offset
+				}
+			}
+			remainingBytes[tableName] = float64(remaining)
+		}
+	}
+
+	metric.CheckpointTablesGauge.Reset()
+	for state, count := range tableStates {
+		metric.CheckpointTablesGauge.WithLabelValues(state).Set(count)
+	}
+	metric.CheckpointEnginesGauge.Reset()
+	for state, count := range engineStates {
+		metric.CheckpointEnginesGauge.WithLabelValues(state).Set(count)
+	}
+	metric.CheckpointRemainingBytesGauge.Reset()
+	for tableName, size := range remainingBytes {
+		metric.CheckpointRemainingBytesGauge.WithLabelValues(tableName).Set(size)
+	}
+}
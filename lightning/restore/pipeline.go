@@ -0,0 +1,138 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pingcap/tidb-lightning/lightning/metric"
+)
+
+// enginePriority orders the engines of all tables. The engines of the tables
+// earlier in the import order go first, then the engines with smaller IDs.
+//
+// Granting both the encode and the import slots in this order forms a
+// pipeline across tables: a table finishes encoding as early as possible, so
+// its closed engines keep the importer busy, while the encode slots move on
+// to the next tables instead of interleaving all of them.
+type enginePriority struct {
+	table  int
+	engine int
+}
+
+func (p enginePriority) less(other enginePriority) bool {
+	if p.table != other.table {
+		return p.table < other.table
+	}
+	return p.engine < other.engine
+}
+
+type semaphoreWaiter struct {
+	priority enginePriority
+	seq      int64
+	ready    chan struct{}
+	canceled bool
+}
+
+type waiterHeap []*semaphoreWaiter
+
+func (h waiterHeap) Len() int { return len(h) }
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority.less(h[j].priority)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h waiterHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *waiterHeap) Push(x interface{}) { *h = append(*h, x.(*semaphoreWaiter)) }
+func (h *waiterHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// prioritySemaphore limits the number of engines in a step. Unlike a worker
+// pool, the waiting engines are granted by priority rather than randomly.
+type prioritySemaphore struct {
+	name string
+
+	lock    sync.Mutex
+	free    int
+	waiters waiterHeap
+	seq     int64
+}
+
+func newPrioritySemaphore(limit int, name string) *prioritySemaphore {
+	metric.IdleWorkersGauge.WithLabelValues(name).Set(float64(limit))
+	return &prioritySemaphore{name: name, free: limit}
+}
+
+// acquire blocks until a slot is granted to the engine, or the context is
+// canceled.
+func (s *prioritySemaphore) acquire(ctx context.Context, priority enginePriority) error {
+	start := time.Now()
+	defer func() {
+		metric.ApplyWorkerSecondsHistogram.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+	}()
+
+	s.lock.Lock()
+	if s.free > 0 && len(s.waiters) == 0 {
+		s.free--
+		metric.IdleWorkersGauge.WithLabelValues(s.name).Set(float64(s.free))
+		s.lock.Unlock()
+		return nil
+	}
+	s.seq++
+	waiter := &semaphoreWaiter{priority: priority, seq: s.seq, ready: make(chan struct{})}
+	heap.Push(&s.waiters, waiter)
+	s.lock.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+		s.lock.Lock()
+		select {
+		case <-waiter.ready:
+			// granted at the same time, pass it on.
+			s.lock.Unlock()
+			s.release()
+		default:
+			waiter.canceled = true
+			s.lock.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+// release returns the slot, granting it to the waiting engine with the
+// highest priority.
+func (s *prioritySemaphore) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.waiters) > 0 {
+		waiter := heap.Pop(&s.waiters).(*semaphoreWaiter)
+		if !waiter.canceled {
+			close(waiter.ready)
+			return
+		}
+	}
+	s.free++
+	metric.IdleWorkersGauge.WithLabelValues(s.name).Set(float64(s.free))
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"time"
+
+	. "github.com/pingcap/check"
+)
+
+var _ = Suite(&pipelineSuite{})
+
+type pipelineSuite struct{}
+
+func (s *pipelineSuite) TestPrioritySemaphore(c *C) {
+	ctx := context.Background()
+	sem := newPrioritySemaphore(1, "test")
+	c.Assert(sem.acquire(ctx, enginePriority{table: 5}), IsNil)
+
+	granted := make(chan enginePriority, 3)
+	waitFor := func(priority enginePriority) {
+		go func() {
+			if sem.acquire(ctx, priority) == nil {
+				granted <- priority
+			}
+		}()
+		// make sure the waiters are queued in the given order.
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitFor(enginePriority{table: 2, engine: 1})
+	waitFor(enginePriority{table: 1, engine: 3})
+	waitFor(enginePriority{table: 2, engine: 0})
+
+	// the waiters are granted by priority regardless of the arrival order.
+	expected := []enginePriority{{table: 1, engine: 3}, {table: 2, engine: 0}, {table: 2, engine: 1}}
+	for _, priority := range expected {
+		sem.release()
+		c.Assert(<-granted, Equals, priority)
+	}
+	sem.release()
+	c.Assert(sem.free, Equals, 1)
+}
+
+func (s *pipelineSuite) TestPrioritySemaphoreCancel(c *C) {
+	sem := newPrioritySemaphore(1, "test")
+	c.Assert(sem.acquire(context.Background(), enginePriority{}), IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(sem.acquire(ctx, enginePriority{table: 1}), Equals, context.Canceled)
+
+	// the canceled waiter does not take the slot.
+	sem.release()
+	c.Assert(sem.free, Equals, 1)
+	c.Assert(sem.waiters, HasLen, 0)
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"net/http"
+
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+const (
+	// the default region-split-size of TiKV, used when PD does not have any
+	// non-empty regions to measure.
+	defaultRegionSize = 96 << 20
+
+	// number of regions every store receives when an engine is imported. The
+	// engine is split into regions scattered among the stores, so the engines
+	// are ingested in waves occupying all stores evenly.
+	engineRegionsPerStore = 128
+
+	minEngineSize = 1 << 30
+	maxEngineSize = 100 << 30
+)
+
+// decideEngineSize computes the maximum size of an engine from the average
+// region size and the number of TiKV stores.
+func decideEngineSize(regionSize int64, stores int) int64 {
+	if regionSize <= 0 {
+		regionSize = defaultRegionSize
+	}
+	if stores < 1 {
+		stores = 1
+	}
+	engineSize := regionSize * int64(stores) * engineRegionsPerStore
+	switch {
+	case engineSize < minEngineSize:
+		return minEngineSize
+	case engineSize > maxEngineSize:
+		return maxEngineSize
+	default:
+		return engineSize
+	}
+}
+
+// getAverageRegionSize returns the average size of the non-empty regions in
+// bytes, or 0 if there are none.
+func (rc *RestoreController) getAverageRegionSize(client *http.Client) (int64, error) {
+	var stats struct {
+		Count       int64 `json:"count"`
+		EmptyCount  int64 `json:"empty_count"`
+		StorageSize int64 `json:"storage_size"` // MiB
+	}
+	url := rc.tls.URL(rc.cfg.TiDB.PdAddr, "/pd/api/v1/stats/region")
+	if err := common.GetJSON(client, url, &stats); err != nil {
+		return 0, errors.Trace(err)
+	}
+	if nonEmpty := stats.Count - stats.EmptyCount; nonEmpty > 0 {
+		return (stats.StorageSize << 20) / nonEmpty, nil
+	}
+	return 0, nil
+}
+
+// planEngineSize decides the engine size of the task, unless it is given by
+// `mydumper.batch-size`.
+func (rc *RestoreController) planEngineSize() {
+	if rc.cfg.Mydumper.BatchSize > 0 {
+		rc.engineSize = int64(rc.cfg.Mydumper.BatchSize)
+		return
+	}
+
+	client := rc.tls.HTTPClient()
+	regionSize, err := rc.getAverageRegionSize(client)
+	if err != nil {
+		common.AppLogger.Warnf("[plan] cannot read the region size from PD, using the default: %v", err)
+	}
+	stores := 0
+	storesInfo, err := rc.getStoresInfo(client)
+	if err != nil {
+		common.AppLogger.Warnf("[plan] cannot read the TiKV stores from PD, assuming a single store: %v", err)
+	} else {
+		for _, store := range storesInfo.Stores {
+			if store.Store.StateName == "Up" {
+				stores++
+			}
+		}
+	}
+
+	rc.engineSize = decideEngineSize(regionSize, stores)
+	common.AppLogger.Infof("[plan] region size %d bytes, %d TiKV stores, using engine size %d bytes", regionSize, stores, rc.engineSize)
+}
+
+// dryRunEngineSize is the engine size used by the dry run, which does not
+// contact PD.
+func dryRunEngineSize(batchSize int64) int64 {
+	if batchSize > 0 {
+		return batchSize
+	}
+	return decideEngineSize(defaultRegionSize, 1)
+}
@@ -0,0 +1,32 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	. "github.com/pingcap/check"
+)
+
+var _ = Suite(&planSuite{})
+
+type planSuite struct{}
+
+func (s *planSuite) TestDecideEngineSize(c *C) {
+	// 96 MiB * 3 stores * 128 regions.
+	c.Assert(decideEngineSize(96<<20, 3), Equals, int64(36<<30))
+	// unknown region size and stores fall back to the defaults.
+	c.Assert(decideEngineSize(0, 0), Equals, int64(12<<30))
+	// clamped.
+	c.Assert(decideEngineSize(1<<20, 1), Equals, int64(minEngineSize))
+	c.Assert(decideEngineSize(96<<20, 100), Equals, int64(maxEngineSize))
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pingcap/tidb-lightning/lightning/metric"
+)
+
+// interval between updates of the progress gauges.
+const progressMetricsInterval = 15 * time.Second
+
+// Progress is the estimated progress of the task, reported by the
+// `/progress` endpoint and the progress gauges. The elapsed time and the bytes
+// read include the previous runs of the task.
+type Progress struct {
+	Phase              string  `json:"phase"`
+	Elapsed            float64 `json:"elapsed_seconds"`
+	EstimatedChunks    float64 `json:"estimated_chunks"`
+	FinishedChunks     float64 `json:"finished_chunks"`
+	TotalTables        float64 `json:"total_tables"`
+	CompletedTables    float64 `json:"completed_tables"`
+	TotalBytes         int64   `json:"total_bytes"`
+	BytesRead          int64   `json:"bytes_read"`
+	RemainingBytes     int64   `json:"remaining_bytes"`
+	Speed              float64 `json:"speed"` // in bytes per second
+	EstimatedRemaining float64 `json:"estimated_remaining_seconds"`
+}
+
+// progressBase is the progress of the previous runs, and when this run
+// started counting on top of it.
+type progressBase struct {
+	previous *TaskProgress
+	start    time.Time
+}
+
+// setPhase records the phase the task is running.
+func (rc *RestoreController) setPhase(phase string) {
+	rc.phase.Store(phase)
+	metric.TaskPhaseGauge.Reset()
+	metric.TaskPhaseGauge.WithLabelValues(phase).Set(1)
+}
+
+// currentTaskProgress adds the progress of this run onto that of the previous
+// runs, which is saved into the checkpoint.
+func (rc *RestoreController) currentTaskProgress() *TaskProgress {
+	bytesRead := int64(metric.ReadHistogramSum(metric.BlockReadBytesHistogram))
+	base, ok := rc.progressBase.Load().(progressBase)
+	if !ok {
+		// the tables are not being restored yet.
+		return &TaskProgress{StartTime: rc.startTime, Elapsed: time.Since(rc.startTime), BytesRead: bytesRead}
+	}
+	return &TaskProgress{
+		StartTime: base.previous.StartTime,
+		Elapsed:   base.previous.Elapsed + time.Since(base.start),
+		BytesRead: base.previous.BytesRead + bytesRead,
+	}
+}
+
+// Progress estimates the progress of the task. The remaining time is
+// extrapolated from the time spent on the finished chunks, and is -1 until
+// any chunk is finished.
+func (rc *RestoreController) Progress() *Progress {
+	current := rc.currentTaskProgress()
+	progress := &Progress{
+		Elapsed:         current.Elapsed.Seconds(),
+		EstimatedChunks: metric.SumCounterVec(metric.ChunkCounter, prometheus.Labels{"state": metric.ChunkStateEstimated}),
+		FinishedChunks:  metric.SumCounterVec(metric.ChunkCounter, prometheus.Labels{"state": metric.ChunkStateFinished}),
+		TotalTables:     metric.ReadCounter(metric.TableCounter.WithLabelValues(metric.TableStatePending, metric.TableResultSuccess)),
+		CompletedTables: metric.ReadCounter(metric.TableCounter.WithLabelValues(metric.TableStateCompleted, metric.TableResultSuccess)),
+		BytesRead:       current.BytesRead,
+	}
+	if phase, ok := rc.phase.Load().(string); ok {
+		progress.Phase = phase
+	}
+	for _, dbMeta := range rc.dbMetas {
+		for _, tableMeta := range dbMeta.Tables {
+			progress.TotalBytes += tableMeta.TotalSize
+		}
+	}
+	if progress.TotalBytes > progress.BytesRead {
+		progress.RemainingBytes = progress.TotalBytes - progress.BytesRead
+	}
+	if progress.Elapsed > 0 {
+		progress.Speed = float64(progress.BytesRead) / progress.Elapsed
+	}
+	progress.EstimatedRemaining = estimateRemaining(progress)
+	return progress
+}
+
+func estimateRemaining(progress *Progress) float64 {
+	switch {
+	case progress.Phase == metric.TaskPhaseFinished:
+		return 0
+	case progress.EstimatedChunks == 0 || progress.FinishedChunks == 0:
+		return -1
+	case progress.FinishedChunks >= progress.EstimatedChunks:
+		// post-processing.
+		return 0
+	default:
+		return (progress.EstimatedChunks/progress.FinishedChunks - 1) * progress.Elapsed
+	}
+}
+
+// exportProgressMetrics updates the progress gauges.
+func (rc *RestoreController) exportProgressMetrics() *Progress {
+	progress := rc.Progress()
+	metric.EstimatedRemainingSecondsGauge.Set(progress.EstimatedRemaining)
+	metric.RemainingBytesGauge.Set(float64(progress.RemainingBytes))
+	return progress
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+// maximum length of the error message kept with a quarantined chunk.
+const maxQuarantineReasonLen = 1024
+
+type quarantinedChunk struct {
+	tableName string
+	engineID  int
+	path      string
+	pos       int64
+	endOffset int64
+	reason    string
+}
+type quarantineSummaries struct {
+	sync.Mutex
+	chunks []quarantinedChunk
+}
+
+func (qs *quarantineSummaries) emitLog() {
+	qs.Lock()
+	defer qs.Unlock()
+	if chunkCount := len(qs.chunks); chunkCount > 0 {
+		var msg strings.Builder
+		fmt.Fprintf(&msg, "Totally **%d** chunks are quarantined, the following byte ranges are not imported.\n", chunkCount)
+		for _, chunk := range qs.chunks {
+			fmt.Fprintf(&msg, "- [%s:%d] [%s] [%d, %d) %s\n", chunk.tableName, chunk.engineID, chunk.path, chunk.pos, chunk.endOffset, chunk.reason)
+		}
+		msg.WriteString("Retry them by running `tidb-lightning-ctl -chunk-retry` and then restarting tidb-lightning.")
+		common.AppLogger.Error(msg.String())
+	}
+}
+
+// record adds all quarantined chunks of the table into the summary.
+func (qs *quarantineSummaries) record(tableName string, cp *TableCheckpoint) int {
+	qs.Lock()
+	defer qs.Unlock()
+	count := 0
+	for engineID, engine := range cp.Engines {
+		for _, chunk := range engine.Chunks {
+			if len(chunk.QuarantineReason) == 0 {
+				continue
+			}
+			qs.chunks = append(qs.chunks, quarantinedChunk{
+				tableName: tableName,
+				engineID:  engineID,
+				path:      chunk.Key.Path,
+				pos:       chunk.Chunk.Offset,
+				endOffset: chunk.Chunk.EndOffset,
+				reason:    chunk.QuarantineReason,
+			})
+			count++
+		}
+	}
+	return count
+}
+
+func (qs *quarantineSummaries) count() int {
+	qs.Lock()
+	defer qs.Unlock()
+	return len(qs.chunks)
+}
+
+// quarantineChunk marks the chunk which failed too many times, so the rest of
+// the engine can be imported without it.
+func (t *TableRestore) quarantineChunk(rc *RestoreController, engineID int, chunk *ChunkCheckpoint, err error) {
+	common.EngineLogger(t.tableName, engineID).WithField(common.LogFieldChunk, chunk.Key.String()).Errorf(
+		"chunk quarantined, bytes %d to %d are skipped: %v", chunk.Chunk.Offset, chunk.Chunk.EndOffset, err)
+	reason := err.Error()
+	if len(reason) > maxQuarantineReasonLen {
+		end := maxQuarantineReasonLen
+		for end > 0 && !utf8.RuneStart(reason[end]) {
+			end--
+		}
+		reason = reason[:end]
+	}
+	chunk.QuarantineReason = reason
+	rc.saveCheckpoint(saveCp{
+		tableName: t.tableName,
+		merger: &QuarantineCheckpointMerger{
+			EngineID: engineID,
+			Key:      chunk.Key,
+			Reason:   reason,
+		},
+	})
+}
@@ -18,17 +18,18 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/coreos/go-semver/semver"
 	"github.com/cznic/mathutil"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	tracelog "github.com/opentracing/opentracing-go/log"
 	sstpb "github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/parser/model"
 	"github.com/pingcap/tidb-lightning/lightning/common"
@@ -43,6 +44,7 @@ import (
 	tidbcfg "github.com/pingcap/tidb/config"
 	"github.com/pingcap/tidb/meta/autoid"
 	"github.com/pingcap/tidb/util/kvencoder"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -51,18 +53,10 @@ const (
 )
 
 const (
-	defaultGCLifeTime = 100 * time.Hour
-)
-
-const (
-	compactStateIdle int32 = iota
-	compactStateDoing
-)
-
-var (
-	requiredTiDBVersion = *semver.New("2.1.0")
-	requiredPDVersion   = *semver.New("2.1.0")
-	requiredTiKVVersion = *semver.New("2.1.0")
+	// maximum number of times an engine is written again after being lost
+	// because tikv-importer restarted.
+	maxEngineRestarts    = 3
+	engineRestartBackoff = 10 * time.Second
 )
 
 func init() {
@@ -72,11 +66,6 @@ func init() {
 	kv.InitMembufCap(defReadBlockSize)
 }
 
-type saveCp struct {
-	tableName string
-	merger    TableCheckpointMerger
-}
-
 type errorSummary struct {
 	status CheckpointStatus
 	err    error
@@ -105,28 +94,146 @@ func (es *errorSummaries) record(tableName string, err error, status CheckpointS
 	es.summary[tableName] = errorSummary{status: status, err: err}
 }
 
+func (es *errorSummaries) has(tableName string) bool {
+	es.Lock()
+	defer es.Unlock()
+	_, ok := es.summary[tableName]
+	return ok
+}
+
+// category returns the category shared by the errors of all failed tables,
+// or ErrorCategoryUnknown if they fail for different reasons. Like the errors
+// stopping the task, the uncategorized ones are blamed on the cluster.
+func (es *errorSummaries) category() common.ErrorCategory {
+	es.Lock()
+	defer es.Unlock()
+	category := common.ErrorCategoryUnknown
+	for _, summary := range es.summary {
+		c := common.CategoryOf(common.WithCategory(summary.err, common.ErrorCategoryCluster))
+		if category != common.ErrorCategoryUnknown && c != category {
+			return common.ErrorCategoryUnknown
+		}
+		category = c
+	}
+	return category
+}
+
+func (es *errorSummaries) count() int {
+	es.Lock()
+	defer es.Unlock()
+	return len(es.summary)
+}
+
 type RestoreController struct {
-	cfg             *config.Config
-	dbMetas         []*mydump.MDDatabaseMeta
-	dbInfos         map[string]*TidbDBInfo
-	tableWorkers    *worker.Pool
-	regionWorkers   *worker.Pool
-	ioWorkers       *worker.Pool
-	importer        *kv.Importer
-	tidbMgr         *TiDBManager
-	postProcessLock sync.Mutex // a simple way to ensure post-processing is not concurrent without using complicated goroutines
-	alterTableLock  sync.Mutex
-	compactState    int32
-
-	errorSummaries errorSummaries
+	cfg                *config.Config
+	dbMetas            []*mydump.MDDatabaseMeta
+	dbInfos            map[string]*TidbDBInfo
+	encodeSlots        *prioritySemaphore // engines being encoded and written
+	importSlots        *prioritySemaphore // engines being imported
+	inflightImports    *prioritySemaphore // closed engines not yet imported, nil if unlimited
+	regionWorkers      *worker.Pool
+	ioWorkers          *worker.Pool
+	importer           *kv.Importer
+	tidbMgr            *TiDBManager
+	tls                *common.TLS
+	alterTableLock     sync.Mutex
+	compactState       int32
+	startTime          time.Time
+	phase              atomic.Value // string, the phase the task is running
+	progressBase       atomic.Value // progressBase, unset until the tables are restored
+	lastCheckpointTime atomic.Value // time.Time, when the checkpoints were last saved
+	tikvMode           atomic.Value // string, the TiKV mode last switched to
+	pauser             common.Pauser
+	diskQuota          common.Quota // size of KV pairs written into engines not yet imported
+	memoryQuota        common.Quota // size of KV pairs encoded but not yet delivered
+	preCheckLock       sync.Mutex
+	preCheckResults    []*PreCheckResult // guarded by preCheckLock
+	tuner              *concurrencyTuner // nil unless auto-tune is enabled
+	splitter           *regionSplitter   // nil unless pre-split-regions is enabled
+	engineSize         int64             // maximum source data size of an engine
+	coordinator        *coordinator      // nil unless coordination is enabled
+	checksumMgr        *checksumManager
+	analyzeWorkers     *worker.Pool
+	activeTables       sync.Map // string -> *TableRestore, the tables being restored
+	tableRuns          sync.Map // string -> tableRun, the tables restored in this run
+	finalCheckpoints   sync.Map // string -> *TableCheckpoint, kept before the checkpoints are cleaned up
+	activeChunks       sync.Map // *chunkActivity -> struct{}, the chunks being restored
+	encoderOpts        encoderOptions
+	settingsCh         chan config.Settings // the settings changed while running
+	cancelTask         context.CancelFunc   // stops the running task
+	timeoutErr         common.OnceError     // the first timeout which stopped the task
+	pdSchedulerRecord  *pdSchedulerRecord   // nil unless the PD schedulers are paused by this run
+
+	errorSummaries      errorSummaries
+	quarantineSummaries quarantineSummaries
 
 	checkpointsDB CheckpointsDB
-	saveCpCh      chan saveCp
+	saveCpChs     []chan saveCp // sharded by the table names
 	checkpointsWg sync.WaitGroup
+	checkpointErr common.OnceError // the first failed write into the checkpoints database
+}
+
+// NewImporter creates the importer of the backend chosen by
+// `tikv-importer.backend`.
+func NewImporter(ctx context.Context, cfg *config.Config) (*kv.Importer, error) {
+	tls, err := cfg.Security.ToTLS()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var importer *kv.Importer
+	switch cfg.TikvImporter.Backend {
+	case config.BackendLocal:
+		importer, err = kv.NewLocalImporter(ctx, tls, cfg.TiDB.PdAddr, cfg.TikvImporter.SortedKVDir)
+	case config.BackendTiDB:
+		// the TiDB backend leaves nothing behind in the engines.
+		db, err := connectTiDBBackend(cfg.TiDB)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return kv.NewTiDBImporter(db), nil
+	default:
+		importer, err = kv.NewImporter(ctx, tls, cfg.TikvImporter.Addr, cfg.TiDB.PdAddr, kv.ImporterOptions{
+			KeepaliveTime:    cfg.TikvImporter.GRPCKeepaliveTime.Duration,
+			KeepaliveTimeout: cfg.TikvImporter.GRPCKeepaliveTimeout.Duration,
+			MaxMsgSize:       int(cfg.TikvImporter.GRPCMaxMsgSize),
+			Compression:      cfg.TikvImporter.GRPCCompression,
+			WriteStreams:     cfg.TikvImporter.WriteStreams,
+		})
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	registry, err := kv.LoadEngineRegistry(EngineRegistryPath(cfg))
+	if err != nil {
+		importer.Close()
+		return nil, errors.Trace(err)
+	}
+	importer.SetEngineRegistry(registry)
+	return importer, nil
 }
 
 func NewRestoreController(ctx context.Context, dbMetas []*mydump.MDDatabaseMeta, cfg *config.Config) (*RestoreController, error) {
-	importer, err := kv.NewImporter(ctx, cfg.TikvImporter.Addr, cfg.TiDB.PdAddr)
+	importer, err := NewImporter(ctx, cfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return NewRestoreControllerWithImporter(ctx, dbMetas, cfg, importer)
+}
+
+// NewRestoreControllerWithImporter creates a restore controller using the
+// given importer, e.g. one with a custom backend created by
+// kv.NewBackendImporter, instead of the backend chosen by the config.
+func NewRestoreControllerWithImporter(ctx context.Context, dbMetas []*mydump.MDDatabaseMeta, cfg *config.Config, importer *kv.Importer) (*RestoreController, error) {
+	importer.SetWriteBandwidthLimit(int64(cfg.TikvImporter.StoreWriteBWLimit))
+
+	dbMetas, err := selectSubset(dbMetas, &cfg.Subset)
+	if err != nil {
+		return nil, common.WithCategory(errors.Trace(err), common.ErrorCategoryConfig)
+	}
+
+	tls, err := cfg.Security.ToTLS()
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -136,27 +243,56 @@ func NewRestoreController(ctx context.Context, dbMetas []*mydump.MDDatabaseMeta,
 		return nil, errors.Trace(err)
 	}
 
-	tidbMgr, err := NewTiDBManager(cfg.TiDB)
+	tidbMgr, err := NewTiDBManager(cfg.TiDB, tls)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
 	rc := &RestoreController{
-		cfg:           cfg,
-		dbMetas:       dbMetas,
-		tableWorkers:  worker.NewPool(ctx, cfg.App.TableConcurrency, "table"),
-		regionWorkers: worker.NewPool(ctx, cfg.App.RegionConcurrency, "region"),
-		ioWorkers:     worker.NewPool(ctx, cfg.App.IOConcurrency, "io"),
-		importer:      importer,
-		tidbMgr:       tidbMgr,
+		cfg:            cfg,
+		dbMetas:        dbMetas,
+		encodeSlots:    newPrioritySemaphore(cfg.App.TableConcurrency, "table"),
+		importSlots:    newPrioritySemaphore(1, "import"),
+		ioWorkers:      worker.NewPool(ctx, cfg.App.IOConcurrency, "io"),
+		analyzeWorkers: worker.NewPool(ctx, cfg.PostRestore.AnalyzeConcurrency, "analyze"),
+		importer:       importer,
+		tidbMgr:        tidbMgr,
+		tls:            tls,
+		encoderOpts: encoderOptions{
+			timeZone:       cfg.TiDB.TimeZone,
+			usePrepareStmt: cfg.TiDB.UsePrepareStmt,
+		},
 
 		errorSummaries: errorSummaries{
 			summary: make(map[string]errorSummary),
 		},
 
 		checkpointsDB: cpdb,
-		saveCpCh:      make(chan saveCp),
+		saveCpChs:     newCheckpointShards(checkpointShardCount),
+		startTime:     time.Now(),
+		settingsCh:    make(chan config.Settings, 1),
+	}
+	rc.tikvMode.Store("unknown")
+	rc.diskQuota.SetLimit(int64(cfg.TikvImporter.DiskQuota))
+	rc.memoryQuota.SetLimit(int64(cfg.App.KVMemoryQuota))
+	if cfg.App.MaxInflightImports > 0 {
+		rc.inflightImports = newPrioritySemaphore(cfg.App.MaxInflightImports, "inflight-import")
+	}
+	// only the tuner resizes the region workers, which otherwise stay at the
+	// configured concurrency.
+	if cfg.App.AutoTune {
+		rc.regionWorkers = worker.NewResizablePool(ctx, cfg.App.RegionConcurrency, cfg.App.RegionConcurrency*2, "region")
+		rc.tuner = newConcurrencyTuner(rc.regionWorkers, cfg.App.RegionConcurrency)
+	} else {
+		rc.regionWorkers = worker.NewPool(ctx, cfg.App.RegionConcurrency, "region")
+	}
+	if cfg.Coordination.Enable {
+		rc.coordinator, err = newCoordinator(ctx, tls, &cfg.Coordination)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 	}
+	rc.checksumMgr = newChecksumManager(ctx, tidbMgr.db, tls, cfg.TiDB.PdAddr, cfg.PostRestore.ChecksumConcurrency, rc.coordinator)
 
 	return rc, nil
 }
@@ -182,71 +318,148 @@ func OpenCheckpointsDB(ctx context.Context, cfg *config.Config) (CheckpointsDB,
 	case "file":
 		return NewFileCheckpointsDB(cfg.Checkpoint.DSN), nil
 
+	case "etcd":
+		tls, err := cfg.Security.ToTLS()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		cpdb, err := NewEtcdCheckpointsDB(ctx, tls, cfg.Checkpoint.DSN, cfg.Checkpoint.Schema)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return cpdb, nil
+
 	default:
 		return nil, errors.Errorf("Unknown checkpoint driver %s", cfg.Checkpoint.Driver)
 	}
 }
 
-func (rc *RestoreController) Wait() {
+// Wait blocks until the pending checkpoints are written, and returns the
+// first error writing them.
+func (rc *RestoreController) Wait() error {
 	rc.checkpointsWg.Wait()
+	return rc.checkpointErr.Get()
 }
 
 func (rc *RestoreController) Close() {
 	rc.importer.Close()
 	rc.tidbMgr.Close()
+	if rc.coordinator != nil {
+		rc.coordinator.close()
+	}
 }
 
 func (rc *RestoreController) Run(ctx context.Context) error {
 	timer := time.Now()
-	opts := []func(context.Context) error{
-		rc.checkRequirements,
-		rc.restoreSchema,
-		rc.restoreTables,
-		rc.fullCompact,
-		rc.switchToNormalMode,
-		rc.cleanCheckpoints,
+	ctx, rc.cancelTask = context.WithCancel(ctx)
+	defer rc.cancelTask()
+	if timeout := rc.cfg.App.TaskTimeout.Duration; timeout > 0 {
+		taskTimer := time.AfterFunc(timeout, func() { rc.expire("task", "the task", timeout) })
+		defer taskTimer.Stop()
+	}
+	span, ctx := opentracing.StartSpanFromContext(ctx, "task", opentracing.Tags{"task": rc.taskName()})
+	if interval := rc.cfg.Notification.HeartbeatInterval.Duration; interval > 0 && len(rc.cfg.Notification.WebhookURL) > 0 {
+		heartbeatCtx, stopHeartbeats := context.WithCancel(ctx)
+		defer stopHeartbeats()
+		go rc.runHeartbeats(heartbeatCtx)
+	}
+	// the errors not categorized where they happened are blamed on the step.
+	// the tables mostly fail in writing or importing the data.
+	type step struct {
+		phase    string
+		process  func(context.Context) error
+		category common.ErrorCategory
+	}
+	steps := []step{
+		{metric.TaskPhaseCheckRequirements, rc.checkRequirements, common.ErrorCategoryPreCheck},
+		{metric.TaskPhaseRestoreSchema, rc.restoreSchema, common.ErrorCategoryCluster},
+		{metric.TaskPhaseCleanupEngines, rc.cleanupOrphanEngines, common.ErrorCategoryCluster},
+		{metric.TaskPhaseRestoreTables, rc.restoreTables, common.ErrorCategoryCluster},
+	}
+	if rc.cfg.PostRestore.KeepImportMode {
+		// the next task continues importing, and the last one will compact
+		// and switch back to normal mode for all of them.
+		common.AppLogger.Info("TiKV will be kept in import mode after the task, full compaction is skipped")
+	} else {
+		steps = append(steps,
+			step{metric.TaskPhaseFullCompact, rc.fullCompact, common.ErrorCategoryCluster},
+			step{metric.TaskPhaseSwitchMode, rc.switchToNormalMode, common.ErrorCategoryCluster},
+		)
 	}
+	steps = append(steps, step{metric.TaskPhaseCleanCheckpoints, rc.cleanCheckpoints, common.ErrorCategoryCluster})
 
 	var err error
 outside:
-	for _, process := range opts {
-		err = process(ctx)
+	for _, step := range steps {
+		rc.setPhase(step.phase)
+		err = step.process(ctx)
 		switch {
 		case err == nil:
 		case common.IsContextCanceledError(err):
 			common.AppLogger.Infof("user terminated : %v", err)
-			err = nil
+			// the periodic actions have stopped, so TiKV needs to be switched
+			// back explicitly, otherwise it will be stuck in import mode.
+			// other instances may still be importing though.
+			if rc.coordinator == nil {
+				rc.switchToNormalMode(context.Background())
+			}
 			break outside
 		default:
+			err = common.WithCategory(err, step.category)
 			common.AppLogger.Errorf("run cause error : %v", err)
 			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			// TiKV is left in import mode for the retry, but the schedulers
+			// should not stay paused if the task is abandoned.
+			rc.resumePDSchedulersIfPaused(context.Background())
 			break outside // ps : not continue
 		}
 	}
 
+	// the run is kept for the other instances or the retry unless succeeded.
+	if err == nil && rc.coordinator != nil {
+		if e := rc.coordinator.finish(ctx); e != nil {
+			common.AppLogger.Warnf("[coordination] cannot record the task is finished: %v", e)
+		}
+	}
+
+	rc.setPhase(metric.TaskPhaseFinished)
 	common.AppLogger.Infof("the whole procedure takes %v", time.Since(timer))
+	if timeoutErr := rc.timeoutErr.Get(); timeoutErr != nil && err != nil {
+		err = timeoutErr
+	}
 
 	rc.errorSummaries.emitLog()
+	if errorCount := rc.errorSummaries.count(); err == nil && errorCount > 0 {
+		err = common.WithCategory(errors.Errorf("%d tables failed to be imported", errorCount), rc.errorSummaries.category())
+	}
+	rc.quarantineSummaries.emitLog()
+	if chunkCount := rc.quarantineSummaries.count(); err == nil && chunkCount > 0 {
+		err = common.WithCategory(errors.Errorf("%d chunks are quarantined", chunkCount), common.ErrorCategorySourceData)
+	}
 
+	if resultFile := rc.cfg.App.ResultFile; len(resultFile) > 0 {
+		if e := rc.writeTaskResult(resultFile, timer, err); e != nil {
+			common.AppLogger.Errorf("cannot write the task result into %s: %v", resultFile, e)
+		}
+	}
+	rc.notifyFinished(err)
+	finishSpan(span, err)
 	return errors.Trace(err)
 }
 
 func (rc *RestoreController) restoreSchema(ctx context.Context) error {
-	tidbMgr, err := NewTiDBManager(rc.cfg.TiDB)
+	tidbMgr, err := NewTiDBManager(rc.cfg.TiDB, rc.tls)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	defer tidbMgr.Close()
 
-	if !rc.cfg.Mydumper.NoSchema {
+	// the tables already exist when importing incrementally.
+	if !rc.cfg.Mydumper.NoSchema && !rc.cfg.App.Incremental {
 		for _, dbMeta := range rc.dbMetas {
 			timer := time.Now()
 			common.AppLogger.Infof("restore table schema for `%s`", dbMeta.Name)
-			tablesSchema := make(map[string]string)
-			for _, tblMeta := range dbMeta.Tables {
-				tablesSchema[tblMeta.Name] = tblMeta.GetSchema()
-			}
-			err = tidbMgr.InitSchema(ctx, dbMeta.Name, tablesSchema)
+			err = tidbMgr.InitSchema(ctx, dbMeta, rc.cfg.TiDB.DDLConcurrency, rc.cfg.TiDB.DDLBatchSize)
 			if err != nil {
 				return errors.Errorf("db schema failed to init : %v", err)
 			}
@@ -259,151 +472,176 @@ func (rc *RestoreController) restoreSchema(ctx context.Context) error {
 	}
 	rc.dbInfos = dbInfos
 
+	// the index keys must be encoded with the collations of the cluster,
+	// otherwise the imported indices are inconsistent with the rows.
+	rc.encoderOpts.newCollation, err = ObtainNewCollationEnabled(ctx, tidbMgr.db)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// the TiDB backend leaves the encoding of the index keys to TiDB.
+	if rc.encoderOpts.newCollation {
+		common.AppLogger.Info("new collation is enabled in the cluster")
+		if rc.cfg.TikvImporter.Backend != config.BackendTiDB {
+			if err := checkNewCollation(dbInfos); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	if rc.cfg.TikvImporter.Backend != config.BackendTiDB {
+		if err := checkCommonHandle(dbInfos); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// the TIMESTAMP values are interpreted in the time zone of the cluster,
+	// the same as INSERT statements executed through TiDB.
+	if len(rc.encoderOpts.timeZone) == 0 {
+		timeZone, err := ObtainTimeZone(ctx, tidbMgr.db)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if config.ValidTimeZone(timeZone) {
+			rc.encoderOpts.timeZone = timeZone
+		} else {
+			common.AppLogger.Warnf("unknown time zone %s of the cluster, using the local time zone, set `tidb.time-zone` to override", timeZone)
+		}
+	}
+	common.AppLogger.Infof("TIMESTAMP values are encoded in time zone %s", rc.encoderOpts.describeTimeZone())
+
 	// Load new checkpoints
 	err = rc.checkpointsDB.Initialize(ctx, dbInfos)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if err := rc.checkResumeRequirements(ctx); err != nil {
+		return common.WithCategory(err, common.ErrorCategoryPreCheck)
+	}
 
-	go rc.listenCheckpointUpdates(&rc.checkpointsWg)
+	// the checkpoints are still written after the task is canceled, so the
+	// next run resumes from the last progress.
+	go rc.listenCheckpointUpdates(context.Background(), &rc.checkpointsWg)
 
 	// Estimate the number of chunks for progress reporting
 	rc.estimateChunkCountIntoMetrics()
 	return nil
 }
 
+// checkNewCollation verifies the indices of all tables can be encoded under the
+// new collation framework.
+func checkNewCollation(dbInfos map[string]*TidbDBInfo) error {
+	var problems []string
+	for _, dbInfo := range dbInfos {
+		for _, tableInfo := range dbInfo.Tables {
+			if err := kv.CheckNewCollation(tableInfo.core); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.Errorf("cannot import with new collation enabled, only the binary and `_bin` collations are supported "+
+			"unless `tikv-importer.backend` is \"tidb\": %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkCommonHandle verifies no tables are clustered by a non-integer primary
+// key. The rows of such tables are keyed by the encoded primary key, and their
+// indices refer to it, in formats the vendored TiDB cannot encode. They can be
+// imported through the TiDB backend instead. The tables clustered by an integer
+// primary key are keyed by it the same as before, and are supported.
+func checkCommonHandle(dbInfos map[string]*TidbDBInfo) error {
+	var tables []string
+	for _, dbInfo := range dbInfos {
+		for _, tableInfo := range dbInfo.Tables {
+			if tableInfo.IsCommonHandle {
+				tables = append(tables, common.UniqueTable(dbInfo.Name, tableInfo.Name))
+			}
+		}
+	}
+	if len(tables) > 0 {
+		sort.Strings(tables)
+		return errors.Errorf(
+			"tables clustered by a non-integer primary key can only be imported with `tikv-importer.backend = \"tidb\"`: %s",
+			strings.Join(tables, ", "),
+		)
+	}
+	return nil
+}
+
 func (rc *RestoreController) estimateChunkCountIntoMetrics() {
-	estimatedChunkCount := 0
+	rc.enableTableMetrics()
 	for _, dbMeta := range rc.dbMetas {
 		for _, tableMeta := range dbMeta.Tables {
-			estimatedChunkCount += len(tableMeta.DataFiles)
+			tableName := common.UniqueTable(dbMeta.Name, tableMeta.Name)
+			metric.ChunkCounter.WithLabelValues(metric.ChunkStateEstimated, metric.TableLabel(tableName)).Add(float64(len(tableMeta.DataFiles)))
 		}
 	}
-	metric.ChunkCounter.WithLabelValues(metric.ChunkStateEstimated).Add(float64(estimatedChunkCount))
 }
 
-func (rc *RestoreController) saveStatusCheckpoint(tableName string, engineID int, err error, statusIfSucceed CheckpointStatus) {
-	merger := &StatusCheckpointMerger{Status: statusIfSucceed, EngineID: engineID}
-
-	switch {
-	case err == nil:
-		break
-	case !common.IsContextCanceledError(err):
-		merger.SetInvalid()
-		rc.errorSummaries.record(tableName, err, statusIfSucceed)
-	default:
+// enableTableMetrics labels the metrics by the table names if requested, unless
+// there are too many tables, which would flood Prometheus with the series.
+func (rc *RestoreController) enableTableMetrics() {
+	if !rc.cfg.App.TableMetrics {
+		metric.EnableTableLabels(false)
 		return
 	}
-
-	metric.RecordTableCount(statusIfSucceed.MetricName(), err)
-	rc.saveCpCh <- saveCp{tableName: tableName, merger: merger}
+	tableCount := 0
+	for _, dbMeta := range rc.dbMetas {
+		tableCount += len(dbMeta.Tables)
+	}
+	if tableCount > rc.cfg.App.TableMetricsLimit {
+		common.AppLogger.Warnf("%d tables exceed `lightning.table-metrics-limit` (%d), the metrics are not labelled by table", tableCount, rc.cfg.App.TableMetricsLimit)
+		metric.EnableTableLabels(false)
+		return
+	}
+	metric.EnableTableLabels(true)
 }
 
-// listenCheckpointUpdates will combine several checkpoints together to reduce database load.
-func (rc *RestoreController) listenCheckpointUpdates(wg *sync.WaitGroup) {
-	var lock sync.Mutex
-	coalesed := make(map[string]*TableCheckpointDiff)
-
-	hasCheckpoint := make(chan struct{}, 1)
-
-	go func() {
-		for range hasCheckpoint {
-			lock.Lock()
-			cpd := coalesed
-			coalesed = make(map[string]*TableCheckpointDiff)
-			lock.Unlock()
+// orderTables lists all tables in the order they should be started. Tables in
+// `explicitList` (in the form "db.table") come first, and the rest are sorted
+// according to the `order` policy.
+func orderTables(dbMetas []*mydump.MDDatabaseMeta, order string, explicitList []string) []*mydump.MDTableMeta {
+	explicitIndex := make(map[string]int, len(explicitList))
+	for i, name := range explicitList {
+		explicitIndex[name] = i
+	}
 
-			if len(cpd) > 0 {
-				rc.checkpointsDB.Update(cpd)
+	var tables, explicitTables []*mydump.MDTableMeta
+	for _, dbMeta := range dbMetas {
+		for _, tableMeta := range dbMeta.Tables {
+			if _, ok := explicitIndex[tableMeta.DB+"."+tableMeta.Name]; ok {
+				explicitTables = append(explicitTables, tableMeta)
+			} else {
+				tables = append(tables, tableMeta)
 			}
-			wg.Done()
-		}
-	}()
-
-	for scp := range rc.saveCpCh {
-		lock.Lock()
-		cpd, ok := coalesed[scp.tableName]
-		if !ok {
-			cpd = NewTableCheckpointDiff()
-			coalesed[scp.tableName] = cpd
-		}
-		scp.merger.MergeInto(cpd)
-
-		if len(hasCheckpoint) == 0 {
-			wg.Add(1)
-			hasCheckpoint <- struct{}{}
 		}
-
-		lock.Unlock()
-
-		// gofail: var FailIfImportedChunk struct{}
-		// if _, ok := scp.merger.(*ChunkCheckpointMerger); ok {
-		// 	wg.Wait()
-		// 	panic("forcing failure due to FailIfImportedChunk")
-		// }
-		// continue
-
-		// gofail: var FailIfStatusBecomes int
-		// if merger, ok := scp.merger.(*StatusCheckpointMerger); ok && merger.EngineID >= 0 && int(merger.Status) == FailIfStatusBecomes {
-		// 	wg.Wait()
-		// 	panic("forcing failure due to FailIfStatusBecomes")
-		// }
-		// continue
 	}
-}
-
-func (rc *RestoreController) runPeriodicActions(ctx context.Context, stop <-chan struct{}) {
-	switchModeTicker := time.NewTicker(rc.cfg.Cron.SwitchMode.Duration)
-	logProgressTicker := time.NewTicker(rc.cfg.Cron.LogProgress.Duration)
-	defer func() {
-		switchModeTicker.Stop()
-		logProgressTicker.Stop()
-	}()
-
-	rc.switchToImportMode(ctx)
 
-	start := time.Now()
+	sort.SliceStable(explicitTables, func(i, j int) bool {
+		return explicitIndex[explicitTables[i].DB+"."+explicitTables[i].Name] < explicitIndex[explicitTables[j].DB+"."+explicitTables[j].Name]
+	})
 
-	for {
-		select {
-		case <-ctx.Done():
-			common.AppLogger.Warnf("Stopping periodic actions due to %v", ctx.Err())
-			return
-		case <-stop:
-			common.AppLogger.Info("Everything imported, stopping periodic actions")
-			return
-
-		case <-switchModeTicker.C:
-			// periodically switch to import mode, as requested by TiKV 3.0
-			rc.switchToImportMode(ctx)
-
-		case <-logProgressTicker.C:
-			// log the current progress periodically, so OPS will know that we're still working
-			nanoseconds := float64(time.Since(start).Nanoseconds())
-			estimated := metric.ReadCounter(metric.ChunkCounter.WithLabelValues(metric.ChunkStateEstimated))
-			finished := metric.ReadCounter(metric.ChunkCounter.WithLabelValues(metric.ChunkStateFinished))
-			totalTables := metric.ReadCounter(metric.TableCounter.WithLabelValues(metric.TableStatePending, metric.TableResultSuccess))
-			completedTables := metric.ReadCounter(metric.TableCounter.WithLabelValues(metric.TableStateCompleted, metric.TableResultSuccess))
-			bytesRead := metric.ReadHistogramSum(metric.BlockReadBytesHistogram)
-
-			var remaining string
-			if finished >= estimated {
-				remaining = ", post-processing"
-			} else if finished > 0 {
-				remainNanoseconds := (estimated/finished - 1) * nanoseconds
-				remaining = fmt.Sprintf(", remaining %s", time.Duration(remainNanoseconds).Round(time.Second))
+	switch order {
+	case config.ImportOrderLargestFirst:
+		sort.SliceStable(tables, func(i, j int) bool {
+			return tables[i].TotalSize > tables[j].TotalSize
+		})
+	case config.ImportOrderSmallestFirst:
+		sort.SliceStable(tables, func(i, j int) bool {
+			return tables[i].TotalSize < tables[j].TotalSize
+		})
+	case config.ImportOrderAlphabetical:
+		sort.SliceStable(tables, func(i, j int) bool {
+			if tables[i].DB != tables[j].DB {
+				return tables[i].DB < tables[j].DB
 			}
-
-			// Note: a speed of 28 MiB/s roughly corresponds to 100 GiB/hour.
-			common.AppLogger.Infof(
-				"progress: %.0f/%.0f chunks (%.1f%%), %.0f/%.0f tables (%.1f%%), speed %.2f MiB/s%s",
-				finished, estimated, finished/estimated*100,
-				completedTables, totalTables, completedTables/totalTables*100,
-				bytesRead/(1048576e-9*nanoseconds),
-				remaining,
-			)
-		}
+			return tables[i].Name < tables[j].Name
+		})
 	}
+
+	return append(explicitTables, tables...)
 }
 
 func (rc *RestoreController) restoreTables(ctx context.Context) error {
@@ -411,49 +649,148 @@ func (rc *RestoreController) restoreTables(ctx context.Context) error {
 	var wg sync.WaitGroup
 
 	var restoreErr common.OnceError
+	continueOnError := rc.cfg.App.OnTableError == config.OnTableErrorContinue
+
+	// planned before pausing the schedulers, which affects the region stats.
+	rc.planEngineSize()
+
+	// tikv-importer does not report its disk usage, which leaves the quota the
+	// only limit of the engines.
+	if rc.cfg.TikvImporter.DiskHighWatermark > 0 && rc.importer.RowsFormat() != kv.RowsFormatSQL && !rc.importer.CanReportDiskUsage() {
+		common.AppLogger.Warnf("`tikv-importer.disk-high-watermark` is not supported by the %s backend and is ignored, "+
+			"set `tikv-importer.disk-quota` to limit the disk usage", rc.cfg.TikvImporter.Backend)
+	}
+
+	// the leader instance restores the schedulers in switchToNormalMode.
+	// the TiDB backend does not ingest anything, so the schedulers are kept.
+	if rc.cfg.TiDB.PausePDSchedulers && rc.importer.RowsFormat() != kv.RowsFormatSQL && (rc.coordinator == nil || rc.coordinator.leader) {
+		if err := rc.pausePDSchedulers(ctx); err != nil {
+			common.AppLogger.Warnf("cannot pause PD schedulers: %v", err)
+		}
+	}
+
+	if rc.cfg.TikvImporter.PreSplitRegions && rc.importer.RowsFormat() != kv.RowsFormatSQL {
+		splitter, err := newRegionSplitter(rc.tls, rc.cfg.TiDB.PdAddr)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		rc.splitter = splitter
+		defer func() {
+			rc.splitter = nil
+			splitter.close()
+		}()
+	}
 
 	stopPeriodicActions := make(chan struct{}, 1)
 	go rc.runPeriodicActions(ctx, stopPeriodicActions)
 
-	for _, dbMeta := range rc.dbMetas {
-		dbInfo, ok := rc.dbInfos[dbMeta.Name]
+	// with multiple instances, a table is claimed only when there is room to
+	// import it, so the tables are spread among the instances.
+	var tableSlots chan struct{}
+	if rc.coordinator != nil {
+		tableSlots = make(chan struct{}, rc.cfg.App.TableConcurrency)
+	}
+	releaseTableSlot := func() {
+		if tableSlots != nil {
+			<-tableSlots
+		}
+	}
+
+	for tableIndex, tableMeta := range orderTables(rc.dbMetas, rc.cfg.Mydumper.ImportOrder, rc.cfg.Mydumper.ImportOrderList) {
+		dbInfo, ok := rc.dbInfos[tableMeta.DB]
 		if !ok {
-			common.AppLogger.Errorf("database %s not found in rc.dbInfos", dbMeta.Name)
+			common.AppLogger.Errorf("database %s not found in rc.dbInfos", tableMeta.DB)
 			continue
 		}
-		for _, tableMeta := range dbMeta.Tables {
-			tableInfo, ok := dbInfo.Tables[tableMeta.Name]
-			if !ok {
-				return errors.Errorf("table info %s not found", tableMeta.Name)
-			}
+		tableInfo, ok := dbInfo.Tables[tableMeta.Name]
+		if !ok {
+			return errors.Errorf("table info %s not found", tableMeta.Name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 
+		tableName := common.UniqueTable(dbInfo.Name, tableInfo.Name)
+		if rc.coordinator != nil {
 			select {
+			case tableSlots <- struct{}{}:
 			case <-ctx.Done():
 				return ctx.Err()
-			default:
-			}
-
-			tableName := common.UniqueTable(dbInfo.Name, tableInfo.Name)
-			cp, err := rc.checkpointsDB.Get(ctx, tableName)
-			if cp.Status <= CheckpointStatusMaxInvalid {
-				return errors.Errorf("Checkpoint for %s has invalid status: %d", tableName, cp.Status)
 			}
+			claimed, err := rc.coordinator.claimTable(ctx, tableName)
 			if err != nil {
 				return errors.Trace(err)
 			}
-			tr, err := NewTableRestore(tableName, tableMeta, dbInfo, tableInfo, cp)
-			if err != nil {
-				return errors.Trace(err)
+			if !claimed {
+				releaseTableSlot()
+				common.TableLogger(tableName).Info("skipped: imported by another instance")
+				continue
 			}
-
-			wg.Add(1)
-			go func(t *TableRestore, cp *TableCheckpoint) {
-				defer wg.Done()
-				err := t.restoreTable(ctx, rc, cp)
-				metric.RecordTableCount("completed", err)
-				restoreErr.Set(t.tableName, err)
-			}(tr, cp)
 		}
+		cp, err := rc.checkpointsDB.Get(ctx, tableName)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if cp.Status <= CheckpointStatusMaxInvalid {
+			err := errors.Errorf("Checkpoint for %s has invalid status: %d", tableName, cp.Status)
+			if !continueOnError {
+				return err
+			}
+			common.TableLogger(tableName).Warnf("skipped: %v", err)
+			rc.errorSummaries.record(tableName, err, cp.Status)
+			releaseTableSlot()
+			continue
+		}
+		tr, err := NewTableRestore(tableName, tableMeta, dbInfo, tableInfo, cp)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		tr.order = tableIndex
+		if rc.cfg.PostRestore.SpotCheck != config.PostOpLevelOff && rc.importer.RowsFormat() == kv.RowsFormatKV {
+			tr.sampler = newRowSampler(rc.cfg.PostRestore.SpotCheckRows)
+		}
+
+		wg.Add(1)
+		go func(t *TableRestore, cp *TableCheckpoint) {
+			defer wg.Done()
+			defer releaseTableSlot()
+			rc.activeTables.Store(t.tableName, t)
+			defer rc.activeTables.Delete(t.tableName)
+			start := time.Now()
+			span, ctx := opentracing.StartSpanFromContext(ctx, "table", opentracing.Tags{"table": t.tableName})
+			err := t.restoreTable(ctx, rc, cp)
+			finishSpan(span, err)
+			if err == nil && rc.coordinator != nil {
+				if e := rc.coordinator.finishTable(ctx, t.tableName); e != nil {
+					t.logger().Warnf("cannot record the table is finished for the other instances: %v", e)
+				}
+			}
+			if t.phases.seconds() != nil {
+				t.logger().Infof("phase breakdown: %s", &t.phases)
+				t.phases.exportMetrics(t.tableName)
+			}
+			rc.tableRuns.Store(t.tableName, tableRun{
+				rows:         atomic.LoadUint64(&t.rows),
+				elapsed:      time.Since(start),
+				phaseSeconds: t.phases.seconds(),
+				bound:        t.phases.bound(),
+				verification: t.verification,
+			})
+			metric.RecordTableCount("completed", err)
+			if continueOnError && err != nil && !common.IsContextCanceledError(err) {
+				t.logger().Errorf("failed, continue importing other tables: %v", err)
+				// errors not attributed to any step still need to be recorded,
+				// so the table is marked failed in the checkpoint.
+				if !rc.errorSummaries.has(t.tableName) {
+					rc.saveStatusCheckpoint(t.tableName, -1, err, CheckpointStatusLoaded)
+				}
+				return
+			}
+			restoreErr.Set(t.tableName, err)
+		}(tr, cp)
 	}
 
 	wg.Wait()
@@ -472,11 +809,31 @@ func (t *TableRestore) restoreTable(
 
 	// no need to do anything if the chunks are already populated
 	if len(cp.Engines) > 0 {
-		common.AppLogger.Infof("[%s] reusing %d engines and %d chunks from checkpoint", t.tableName, len(cp.Engines), cp.CountChunks())
+		t.logger().Infof("reusing %d engines and %d chunks from checkpoint", len(cp.Engines), cp.CountChunks())
+		t.resumed = true
+		// chunks finished by the previous runs count towards the progress.
+		for _, engine := range cp.Engines {
+			for _, chunk := range engine.Chunks {
+				if chunk.Chunk.Offset >= chunk.Chunk.EndOffset {
+					metric.ChunkCounter.WithLabelValues(metric.ChunkStateFinished, metric.TableLabel(t.tableName)).Inc()
+					atomic.AddInt64(&t.finishedChunks, 1)
+				}
+			}
+		}
+		if cp.Status < CheckpointStatusAllWritten {
+			if err := t.verifySourceFiles(cp); err != nil {
+				return errors.Trace(err)
+			}
+		}
 	} else if cp.Status < CheckpointStatusAllWritten {
-		if err := t.populateChunks(rc.cfg, cp); err != nil {
+		if err := t.populateChunks(rc.cfg, rc.engineSize, cp); err != nil {
 			return errors.Trace(err)
 		}
+		if rc.cfg.App.Incremental {
+			if err := t.prepareIncremental(ctx, rc, cp); err != nil {
+				return errors.Trace(err)
+			}
+		}
 		if err := rc.checkpointsDB.InsertEngineCheckpoints(ctx, t.tableName, cp.Engines); err != nil {
 			return errors.Trace(err)
 		}
@@ -489,14 +846,16 @@ func (t *TableRestore) restoreTable(
 			}
 		}
 		t.alloc.Rebase(t.tableInfo.ID, cp.AllocBase, false)
-		rc.saveCpCh <- saveCp{
+		rc.saveCheckpoint(saveCp{
 			tableName: t.tableName,
 			merger: &RebaseCheckpointMerger{
 				AllocBase: cp.AllocBase,
 			},
-		}
+		})
 	}
 
+	atomic.StoreInt64(&t.totalChunks, int64(cp.CountChunks()))
+
 	// 2. Restore engines (if still needed)
 
 	if cp.Status < CheckpointStatusImported {
@@ -504,6 +863,7 @@ func (t *TableRestore) restoreTable(
 
 		var wg sync.WaitGroup
 		var engineErr common.OnceError
+		skippedEngines := 0
 
 		for engineID, engine := range cp.Engines {
 			select {
@@ -514,34 +874,43 @@ func (t *TableRestore) restoreTable(
 			if engineErr.Get() != nil {
 				break
 			}
+			if !rc.cfg.Subset.HasEngine(engineID) {
+				if engine.Status < CheckpointStatusImported {
+					skippedEngines++
+				}
+				continue
+			}
 
-			wg.Add(1)
-
-			// Note: We still need tableWorkers to control the concurrency of tables.
-			// In the future, we will investigate more about
-			// the difference between restoring tables concurrently and restoring tables one by one.
-			restoreWorker := rc.tableWorkers.Apply()
+			// closed engines only need to be imported, so they don't take an
+			// encode slot from the other engines.
+			priority := enginePriority{table: t.order, engine: engineID}
+			needsEncode := engine.Status < CheckpointStatusClosed
+			if needsEncode {
+				if err := rc.encodeSlots.acquire(ctx, priority); err != nil {
+					return errors.Trace(err)
+				}
+			}
 
-			go func(w *worker.Worker, eid int, ecp *EngineCheckpoint) {
+			wg.Add(1)
+			go func(eid int, ecp *EngineCheckpoint) {
 				defer wg.Done()
 				tag := fmt.Sprintf("%s:%d", t.tableName, eid)
-
-				closedEngine, err := t.restoreEngine(ctx, rc, eid, ecp)
-				rc.tableWorkers.Recycle(w)
-				if err != nil {
-					engineErr.Set(tag, err)
-					return
-				}
-				if err := t.importEngine(ctx, closedEngine, rc, eid, ecp); err != nil {
+				if err := t.restoreAndImportEngine(ctx, rc, cp, eid, ecp, priority, needsEncode); err != nil {
 					engineErr.Set(tag, err)
 				}
-			}(restoreWorker, engineID, engine)
+			}(engineID, engine)
 		}
 
 		wg.Wait()
 
-		common.AppLogger.Infof("[%s] import whole table takes %v", t.tableName, time.Since(timer))
+		t.logger().Infof("import whole table takes %v", time.Since(timer))
 		err := engineErr.Get()
+		if err == nil && skippedEngines > 0 {
+			// the table is incomplete until the other engines are imported by
+			// the later runs.
+			t.logger().Warnf("skipped post-processing because %d engines not given by -engine are not imported yet", skippedEngines)
+			return nil
+		}
 		rc.saveStatusCheckpoint(t.tableName, -1, err, CheckpointStatusImported)
 		if err != nil {
 			return errors.Trace(err)
@@ -550,21 +919,107 @@ func (t *TableRestore) restoreTable(
 
 	// 3. Post-process
 
+	// the table is incomplete without the quarantined chunks, so the checksum
+	// cannot match, and the statistics would be misleading.
+	if n := rc.quarantineSummaries.record(t.tableName, cp); n > 0 {
+		t.logger().Warnf("skipped post-processing because %d chunks are quarantined", n)
+		return nil
+	}
+
 	return errors.Trace(t.postProcess(ctx, rc, cp))
 }
 
+// restoreAndImportEngine writes the engine, rewinding it if lost in
+// tikv-importer, and imports it. The encode slot is released once the engine
+// is closed.
+func (t *TableRestore) restoreAndImportEngine(
+	ctx context.Context,
+	rc *RestoreController,
+	cp *TableCheckpoint,
+	engineID int,
+	ecp *EngineCheckpoint,
+	priority enginePriority,
+	needsEncode bool,
+) (err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "engine", opentracing.Tags{"table": t.tableName, "engine": engineID})
+	defer func() { finishSpan(span, err) }()
+
+	sizeBefore := ecp.kvSize()
+	// the engine no longer occupies the importer's disk once imported, and a
+	// failed engine won't be imported by this run, so the quota is released
+	// either way.
+	defer func() { rc.diskQuota.Release(ecp.kvSize() - sizeBefore) }()
+
+	closedEngine, err := t.restoreEngine(ctx, rc, engineID, ecp)
+	for restarts := 0; kv.IsEngineLostError(err) && restarts < maxEngineRestarts; restarts++ {
+		common.EngineLogger(t.tableName, engineID).Warnf("engine is lost in tikv-importer, writing it again from the beginning in %v : %v", engineRestartBackoff, err)
+		// everything written into the lost engine is gone with it.
+		rc.diskQuota.Release(ecp.kvSize() - sizeBefore)
+		t.rewindEngine(rc, cp, engineID)
+		sizeBefore = 0
+		select {
+		case <-time.After(engineRestartBackoff):
+			closedEngine, err = t.restoreEngine(ctx, rc, engineID, ecp)
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	// the closed engine waits for its import holding the encode slot if too
+	// many are pending, so the next engines of the table are not written
+	// until the import catches up.
+	if err == nil && rc.inflightImports != nil {
+		if err = rc.inflightImports.acquire(ctx, priority); err == nil {
+			defer rc.inflightImports.release()
+		}
+	}
+	if needsEncode {
+		rc.encodeSlots.release()
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(t.importEngine(ctx, closedEngine, rc, engineID, ecp))
+}
+
 func (t *TableRestore) restoreEngine(
 	ctx context.Context,
 	rc *RestoreController,
 	engineID int,
 	cp *EngineCheckpoint,
 ) (*kv.ClosedEngine, error) {
+	if err := t.assignEngine(rc, engineID, cp); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if rc.cfg.Checkpoint.VerifyOnResume && cp.Status < CheckpointStatusImported {
+		if err := t.verifyResumedEngine(ctx, rc, engineID, cp); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if cp.Status < CheckpointStatusClosed && cp.kvSize() > 0 {
+		if err := t.discardAllocatedEngine(ctx, rc, engineID, cp); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
 	if cp.Status >= CheckpointStatusClosed {
 		closedEngine, err := rc.importer.UnsafeCloseEngine(ctx, t.tableName, engineID)
 		return closedEngine, errors.Trace(err)
 	}
 
-	timer := time.Now()
+	// don't start writing a new engine while the engines not yet imported
+	// have used up the disk quota.
+	if rc.diskQuota.Exceeded() {
+		common.EngineLogger(t.tableName, engineID).Infof("disk quota exceeded (used %d bytes), waiting for other engines to be imported", rc.diskQuota.Used())
+	}
+	if err := rc.diskQuota.Wait(ctx); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := rc.waitDiskWatermark(ctx, common.EngineLogger(t.tableName, engineID)); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	timer := time.Now()
 
 	engine, err := rc.importer.OpenEngine(ctx, t.tableName, engineID)
 	if err != nil {
@@ -573,10 +1028,11 @@ func (t *TableRestore) restoreEngine(
 
 	var wg sync.WaitGroup
 	var chunkErr common.OnceError
+	maxFailures := rc.cfg.App.MaxChunkFailures
 
 	// Restore table data
 	for chunkIndex, chunk := range cp.Chunks {
-		if chunk.Chunk.Offset >= chunk.Chunk.EndOffset {
+		if chunk.Chunk.Offset >= chunk.Chunk.EndOffset || len(chunk.QuarantineReason) != 0 {
 			continue
 		}
 
@@ -590,19 +1046,26 @@ func (t *TableRestore) restoreEngine(
 			break
 		}
 
+		// block here while the task is paused, letting the in-flight chunks finish.
+		if err := rc.pauser.Wait(ctx); err != nil {
+			return nil, errors.Trace(err)
+		}
+
 		// Flows :
 		// 	1. read mydump file
 		// 	2. sql -> kvs
 		// 	3. load kvs data (into kv deliver server)
 		// 	4. flush kvs data (into tikv node)
 
-		cr, err := newChunkRestore(chunkIndex, chunk, rc.cfg.Mydumper.ReadBlockSize, rc.ioWorkers)
+		cr, err := newChunkRestore(chunkIndex, chunk, int64(rc.cfg.Mydumper.ReadBlockSize), rc.cfg.Mydumper.ReadEngine, rc.ioWorkers)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
-		metric.ChunkCounter.WithLabelValues(metric.ChunkStatePending).Inc()
+		metric.ChunkCounter.WithLabelValues(metric.ChunkStatePending, metric.TableLabel(t.tableName)).Inc()
 
+		applyStart := time.Now()
 		restoreWorker := rc.regionWorkers.Apply()
+		rc.tuner.addWorkerWaitTime(time.Since(applyStart))
 		wg.Add(1)
 		go func(w *worker.Worker, cr *chunkRestore) {
 			// Restore a chunk.
@@ -611,14 +1074,33 @@ func (t *TableRestore) restoreEngine(
 				wg.Done()
 				rc.regionWorkers.Recycle(w)
 			}()
-			metric.ChunkCounter.WithLabelValues(metric.ChunkStateRunning).Inc()
+			metric.ChunkCounter.WithLabelValues(metric.ChunkStateRunning, metric.TableLabel(t.tableName)).Inc()
+			tag := fmt.Sprintf("%s:%d] [%s", t.tableName, engineID, &cr.chunk.Key)
+			logger := common.EngineLogger(t.tableName, engineID).WithField(common.LogFieldChunk, cr.chunk.Key.String())
 			err := cr.restore(ctx, t, engineID, engine, rc)
+			// a lost engine is rewound as a whole, which the chunk cannot retry.
+			for failures := 1; err != nil && maxFailures > 0 && !common.IsContextCanceledError(err) && !kv.IsEngineLostError(err); failures++ {
+				if failures >= maxFailures {
+					metric.ChunkCounter.WithLabelValues(metric.ChunkStateFailed, metric.TableLabel(t.tableName)).Inc()
+					t.quarantineChunk(rc, engineID, cr.chunk, err)
+					return
+				}
+				logger.Warnf("chunk failed %d times, restarting from offset %d: %v", failures, cr.chunk.Chunk.Offset, err)
+				cr.close()
+				next, e := newChunkRestore(cr.index, cr.chunk, int64(rc.cfg.Mydumper.ReadBlockSize), rc.cfg.Mydumper.ReadEngine, rc.ioWorkers)
+				if e != nil {
+					err = errors.Trace(e)
+					break
+				}
+				cr = next
+				err = cr.restore(ctx, t, engineID, engine, rc)
+			}
 			if err == nil {
-				metric.ChunkCounter.WithLabelValues(metric.ChunkStateFinished).Inc()
+				metric.ChunkCounter.WithLabelValues(metric.ChunkStateFinished, metric.TableLabel(t.tableName)).Inc()
+				atomic.AddInt64(&t.finishedChunks, 1)
 				return
 			}
-			metric.ChunkCounter.WithLabelValues(metric.ChunkStateFailed).Inc()
-			tag := fmt.Sprintf("%s:%d] [%s", t.tableName, engineID, &cr.chunk.Key)
+			metric.ChunkCounter.WithLabelValues(metric.ChunkStateFailed, metric.TableLabel(t.tableName)).Inc()
 			chunkErr.Set(tag, err)
 		}(restoreWorker, cr)
 	}
@@ -634,14 +1116,36 @@ func (t *TableRestore) restoreEngine(
 		totalSQLSize += chunk.Chunk.EndOffset
 	}
 
-	common.AppLogger.Infof("[%s:%d] encode kv data and write takes %v (read %d, written %d)", t.tableName, engineID, dur, totalSQLSize, totalKVSize)
+	common.EngineLogger(t.tableName, engineID).Infof("encode kv data and write takes %v (read %d, written %d)", dur, totalSQLSize, totalKVSize)
 	err = chunkErr.Get()
+	if kv.IsEngineLostError(err) {
+		// the engine will be written again, don't mark the checkpoint invalid.
+		return nil, errors.Trace(err)
+	}
 	rc.saveStatusCheckpoint(t.tableName, engineID, err, CheckpointStatusAllWritten)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	metric.EngineKVBytesHistogram.Observe(float64(totalKVSize))
+	observeEngine(metric.EngineStepWrite, totalKVSize, dur)
+
+	// make sure the delivered watermarks of all chunks are durable before
+	// closing the engine, so a crash in between won't resume from a stale
+	// position.
+	if err := rc.flushCheckpoints(ctx); err != nil {
+		return nil, errors.Trace(err)
+	}
 
+	closeStart := time.Now()
 	closedEngine, err := engine.Close(ctx)
+	if kv.IsEngineLostError(err) {
+		return nil, errors.Trace(err)
+	}
+	if err == nil {
+		closeDur := time.Since(closeStart)
+		observeEngine(metric.EngineStepClose, totalKVSize, closeDur)
+		t.phases.add(tablePhaseClose, closeDur)
+	}
 	rc.saveStatusCheckpoint(t.tableName, engineID, err, CheckpointStatusClosed)
 	if err != nil {
 		common.AppLogger.Errorf("[kv-deliver] flush stage with error (step = close) : %s", errors.ErrorStack(err))
@@ -664,11 +1168,34 @@ func (t *TableRestore) importEngine(
 	// 1. close engine, then calling import
 	// FIXME: flush is an asynchronous operation, what if flush failed?
 
-	// the lock ensures the import() step will not be concurrent.
-	rc.postProcessLock.Lock()
-	err := t.importKV(ctx, closedEngine)
+	// pre-splitting only speeds up the import, failure is not fatal.
+	if rc.splitter != nil {
+		if err := rc.splitter.splitAndScatter(ctx, t.tableName, engineSplitKeys(t.tableInfo, cp)); err != nil {
+			if common.IsContextCanceledError(err) {
+				return errors.Trace(err)
+			}
+			common.EngineLogger(t.tableName, engineID).Warnf("cannot pre-split regions: %v", err)
+		}
+	}
+
+	// the import() step is not concurrent. the engines are imported in the
+	// priority order rather than the closing order.
+	if err := rc.importSlots.acquire(ctx, enginePriority{table: t.order, engine: engineID}); err != nil {
+		return errors.Trace(err)
+	}
+	span, importCtx := opentracing.StartSpanFromContext(ctx, "import", opentracing.Tags{"table": t.tableName, "engine": engineID})
+	importStart := time.Now()
+	err := rc.withTimeout(fmt.Sprintf("%s:%d", t.tableName, engineID), "importing the engine", rc.cfg.TikvImporter.ImportTimeout.Duration, func() error {
+		return t.importKV(importCtx, closedEngine)
+	})
+	finishSpan(span, err)
+	if err == nil {
+		importDur := time.Since(importStart)
+		observeEngine(metric.EngineStepImport, engineKVSize(cp), importDur)
+		t.phases.add(tablePhaseImport, importDur)
+	}
 	// gofail: var SlowDownImport struct{}
-	rc.postProcessLock.Unlock()
+	rc.importSlots.release()
 	rc.saveStatusCheckpoint(t.tableName, engineID, err, CheckpointStatusImported)
 	if err != nil {
 		return errors.Trace(err)
@@ -690,206 +1217,212 @@ func (t *TableRestore) importEngine(
 }
 
 func (t *TableRestore) postProcess(ctx context.Context, rc *RestoreController, cp *TableCheckpoint) error {
-	setSessionConcurrencyVars(ctx, rc.tidbMgr.db, rc.cfg.TiDB)
-
 	// 3. alter table set auto_increment
 	if cp.Status < CheckpointStatusAlteredAutoInc {
-		rc.alterTableLock.Lock()
-		err := t.restoreTableMeta(ctx, rc.tidbMgr.db)
-		rc.alterTableLock.Unlock()
+		var err error
+		// the TiDB backend lets TiDB allocate the IDs, which are already
+		// rebased by the inserted rows.
+		switch {
+		case rc.importer.RowsFormat() == kv.RowsFormatSQL:
+		case !t.needsAutoIDRebase():
+			t.logger().Info("no auto ID is allocated, skip rebasing")
+		default:
+			rc.alterTableLock.Lock()
+			err = t.restoreTableMeta(ctx, rc.tidbMgr.db)
+			rc.alterTableLock.Unlock()
+		}
 		rc.saveStatusCheckpoint(t.tableName, -1, err, CheckpointStatusAlteredAutoInc)
 		if err != nil {
-			common.AppLogger.Errorf(
-				"[%[1]s] failed to AUTO TABLE %[1]s SET AUTO_INCREMENT=%[2]d : %[3]v",
-				t.tableName, t.alloc.Base()+1, err.Error(),
-			)
+			t.logger().Errorf("failed to rebase the auto ID to %d : %v", t.alloc.Base()+1, err.Error())
 			return errors.Trace(err)
 		}
 	}
 
 	// 4. do table checksum
 	if cp.Status < CheckpointStatusChecksummed {
-		if !rc.cfg.PostRestore.Checksum {
-			common.AppLogger.Infof("[%s] Skip checksum.", t.tableName)
+		rowCountOnly := rc.cfg.PostRestore.ChecksumMethod == config.ChecksumMethodRowCount
+		t.verification = VerificationNone
+		if rc.cfg.PostRestore.Checksum == config.PostOpLevelOff {
+			t.logger().Info("Skip checksum.")
+			rc.saveStatusCheckpoint(t.tableName, -1, nil, CheckpointStatusChecksumSkipped)
+		} else if rc.importer.RowsFormat() == kv.RowsFormatSQL {
+			// the rows are not encoded, so there is no local checksum.
+			t.logger().Info("Skip checksum, which is not supported by the TiDB backend.")
+			rc.saveStatusCheckpoint(t.tableName, -1, nil, CheckpointStatusChecksumSkipped)
+		} else if rc.cfg.App.Incremental && t.baseChecksum == nil && t.baseRowCount == nil {
+			// the checksum before importing is only kept in memory.
+			t.logger().Warn("Skip checksum, the checksum of the existing data is lost after resuming from the checkpoint.")
 			rc.saveStatusCheckpoint(t.tableName, -1, nil, CheckpointStatusChecksumSkipped)
 		} else {
-			err := t.compareChecksum(ctx, rc.tidbMgr.db, cp)
-			rc.saveStatusCheckpoint(t.tableName, -1, err, CheckpointStatusChecksummed)
-			if err != nil {
-				common.AppLogger.Errorf("[%s] checksum failed: %v", t.tableName, err.Error())
+			span, checksumCtx := opentracing.StartSpanFromContext(ctx, "checksum", opentracing.Tags{"table": t.tableName})
+			err := rc.withTimeout(t.tableName, "checksum", rc.cfg.PostRestore.ChecksumTimeout.Duration, func() error {
+				if rowCountOnly {
+					return t.compareRowCount(checksumCtx, rc, cp)
+				}
+				return t.compareChecksum(checksumCtx, rc, cp)
+			})
+			finishSpan(span, err)
+			switch {
+			case err == nil:
+				// the checksum of a partitioned table may have been replaced
+				// by the row count, see compareChecksum.
+				if t.verification == VerificationNone {
+					t.verification = VerificationChecksum
+				}
+				if rowCountOnly {
+					t.verification = VerificationRowCount
+				}
+				rc.saveStatusCheckpoint(t.tableName, -1, nil, CheckpointStatusChecksummed)
+			case rc.cfg.PostRestore.Checksum == config.PostOpLevelOptional && !common.IsContextCanceledError(err):
+				t.verification = VerificationFailed
+				t.logger().Warnf("checksum failed, which is optional, continue: %v", err.Error())
+				rc.saveStatusCheckpoint(t.tableName, -1, nil, CheckpointStatusChecksumSkipped)
+			default:
+				t.verification = VerificationFailed
+				rc.saveStatusCheckpoint(t.tableName, -1, err, CheckpointStatusChecksummed)
+				t.logger().Errorf("checksum failed: %v", err.Error())
 				return errors.Trace(err)
 			}
 		}
 	}
 
-	// 5. do table analyze
+	// 5. spot check the sampled rows
+	// the rows are sampled while encoding, so there is nothing to check if
+	// the table was encoded by the previous runs.
+	if cp.Status < CheckpointStatusAnalyzed && t.sampler != nil {
+		span, spotCheckCtx := opentracing.StartSpanFromContext(ctx, "spot-check", opentracing.Tags{"table": t.tableName})
+		err := t.spotCheck(spotCheckCtx, rc)
+		finishSpan(span, err)
+		switch {
+		case err == nil:
+		case rc.cfg.PostRestore.SpotCheck == config.PostOpLevelOptional && !common.IsContextCanceledError(err):
+			t.logger().Warnf("spot check failed, which is optional, continue: %v", err.Error())
+		default:
+			rc.saveStatusCheckpoint(t.tableName, -1, err, CheckpointStatusChecksummed)
+			t.logger().Errorf("spot check failed: %v", err.Error())
+			return errors.Trace(err)
+		}
+	}
+
+	// 6. do table analyze
 	if cp.Status < CheckpointStatusAnalyzed {
-		if !rc.cfg.PostRestore.Analyze {
-			common.AppLogger.Infof("[%s] Skip analyze.", t.tableName)
+		if !rc.cfg.PostRestore.Analyze || skipsAnalyze(rc.cfg.PostRestore.AnalyzeSkipTables, t.dbInfo.Name, t.tableInfo.Name) {
+			t.logger().Info("Skip analyze.")
 			rc.saveStatusCheckpoint(t.tableName, -1, nil, CheckpointStatusAnalyzeSkipped)
 		} else {
-			err := t.analyzeTable(ctx, rc.tidbMgr.db)
+			w := rc.analyzeWorkers.Apply()
+			span, analyzeCtx := opentracing.StartSpanFromContext(ctx, "analyze", opentracing.Tags{"table": t.tableName})
+			err := rc.withTimeout(t.tableName, "analyze", rc.cfg.PostRestore.AnalyzeTimeout.Duration, func() error {
+				return t.analyzeTable(analyzeCtx, rc.tidbMgr.db, &rc.cfg.PostRestore)
+			})
+			finishSpan(span, err)
+			rc.analyzeWorkers.Recycle(w)
 			rc.saveStatusCheckpoint(t.tableName, -1, err, CheckpointStatusAnalyzed)
 			if err != nil {
-				common.AppLogger.Errorf("[%s] analyze failed: %v", t.tableName, err.Error())
+				t.logger().Errorf("analyze failed: %v", err.Error())
 				return errors.Trace(err)
 			}
 		}
 	}
 
-	return nil
-}
-
-// do full compaction for the whole data.
-func (rc *RestoreController) fullCompact(ctx context.Context) error {
-	if !rc.cfg.PostRestore.Compact {
-		common.AppLogger.Info("Skip full compaction.")
-		return nil
-	}
-
-	// wait until any existing level-1 compact to complete first.
-	common.AppLogger.Info("Wait for existing level 1 compaction to finish")
-	start := time.Now()
-	for !atomic.CompareAndSwapInt32(&rc.compactState, compactStateIdle, compactStateDoing) {
-		time.Sleep(100 * time.Millisecond)
+	// 7. wait for TiFlash replica
+	// this is only waiting, so no checkpoint is needed.
+	if rc.cfg.PostRestore.WaitTiFlash {
+		if err := t.waitTiFlashReplica(ctx, rc.tidbMgr.db, rc.cfg.PostRestore.WaitTiFlashTimeout.Duration); err != nil {
+			t.logger().Errorf("wait TiFlash replica failed: %v", err.Error())
+			return errors.Trace(err)
+		}
 	}
-	common.AppLogger.Infof("Wait for existing level 1 compaction to finish takes %v", time.Since(start))
-
-	return errors.Trace(rc.doCompact(ctx, FullLevelCompact))
-}
-
-func (rc *RestoreController) doCompact(ctx context.Context, level int32) error {
-	return errors.Trace(rc.importer.Compact(ctx, level))
-}
-
-func (rc *RestoreController) switchToImportMode(ctx context.Context) {
-	rc.switchTiKVMode(ctx, sstpb.SwitchMode_Import)
-}
 
-func (rc *RestoreController) switchToNormalMode(ctx context.Context) error {
-	rc.switchTiKVMode(ctx, sstpb.SwitchMode_Normal)
 	return nil
 }
 
-func (rc *RestoreController) switchTiKVMode(ctx context.Context, mode sstpb.SwitchMode) {
-	if err := rc.importer.SwitchMode(ctx, mode); err != nil {
-		common.AppLogger.Warnf("cannot switch to %s mode: %v", mode.String(), err)
-	}
+// Pause stops scheduling new chunks. Chunks being restored are not affected,
+// and their progress is saved into the checkpoint as usual.
+func (rc *RestoreController) Pause() {
+	common.AppLogger.Info("pausing the task")
+	rc.pauser.Pause()
 }
 
-func (rc *RestoreController) checkRequirements(_ context.Context) error {
-	// skip requirement check if explicitly turned off
-	if !rc.cfg.App.CheckRequirements {
-		return nil
-	}
-
-	client := &http.Client{}
-	if err := rc.checkTiDBVersion(client); err != nil {
-		return errors.Trace(err)
-	}
-	if err := rc.checkPDVersion(client); err != nil {
-		return errors.Trace(err)
+// withTimeout runs fn, and stops the whole task if fn is still running after
+// the timeout. 0 means no timeout.
+func (rc *RestoreController) withTimeout(tag string, phase string, timeout time.Duration, fn func() error) error {
+	if timeout <= 0 {
+		return fn()
 	}
-	if err := rc.checkTiKVVersion(client); err != nil {
-		return errors.Trace(err)
-	}
-
-	return nil
+	timer := time.AfterFunc(timeout, func() { rc.expire(tag, phase, timeout) })
+	defer timer.Stop()
+	return fn()
 }
 
-func extractTiDBVersion(version string) (*semver.Version, error) {
-	// version format: "5.7.10-TiDB-v2.1.0-rc.1-7-g38c939f"
-	//                               ^~~~~~~~~^ we only want this part
-	// version format: "5.7.10-TiDB-v2.0.4-1-g06a0bf5"
-	//                               ^~~~^
-	// version format: "5.7.10-TiDB-v2.0.7"
-	//                               ^~~~^
-	// The version is generated by `git describe --tags` on the TiDB repository.
-	versions := strings.Split(version, "-")
-	end := len(versions)
-	switch end {
-	case 3, 4:
-	case 5, 6:
-		end -= 2
-	default:
-		return nil, errors.Errorf("not a valid TiDB version: %s", version)
+// expire stops the task the same as being interrupted, so the progress is
+// kept in the checkpoint, and Run returns an ErrTimeout.
+func (rc *RestoreController) expire(tag string, phase string, timeout time.Duration) {
+	rc.timeoutErr.Set(tag, errors.Annotatef(common.ErrTimeout, "%s exceeds %v", phase, timeout))
+	rc.Pause()
+	if rc.cancelTask != nil {
+		rc.cancelTask()
 	}
-	rawVersion := strings.Join(versions[2:end], "-")
-	rawVersion = strings.TrimPrefix(rawVersion, "v")
-	return semver.NewVersion(rawVersion)
 }
 
-func (rc *RestoreController) checkTiDBVersion(client *http.Client) error {
-	url := fmt.Sprintf("http://%s:%d/status", rc.cfg.TiDB.Host, rc.cfg.TiDB.StatusPort)
-	var status struct{ Version string }
-	err := common.GetJSON(client, url, &status)
+// finishSpan finishes the tracing span, marking it failed if err is not nil.
+func finishSpan(span opentracing.Span, err error) {
 	if err != nil {
-		return errors.Trace(err)
+		ext.Error.Set(span, true)
+		span.LogFields(tracelog.Error(err))
 	}
-
-	version, err := extractTiDBVersion(status.Version)
-	if err != nil {
-		return errors.Trace(err)
-	}
-	return checkVersion("TiDB", requiredTiDBVersion, *version)
+	span.Finish()
 }
 
-func (rc *RestoreController) checkPDVersion(client *http.Client) error {
-	url := fmt.Sprintf("http://%s/pd/api/v1/config/cluster-version", rc.cfg.TiDB.PdAddr)
-	var rawVersion string
-	err := common.GetJSON(client, url, &rawVersion)
-	if err != nil {
-		return errors.Trace(err)
-	}
+// Resume continues scheduling chunks after Pause().
+func (rc *RestoreController) Resume() {
+	common.AppLogger.Info("resuming the task")
+	rc.pauser.Resume()
+}
 
-	version, err := semver.NewVersion(rawVersion)
-	if err != nil {
-		return errors.Trace(err)
+// UpdateSettings applies the settings changed while running. The write
+// bandwidth limit takes effect immediately, and the periodic actions are
+// rescheduled with the new intervals.
+func (rc *RestoreController) UpdateSettings(settings config.Settings) {
+	rc.importer.SetWriteBandwidthLimit(int64(settings.StoreWriteBWLimit))
+	// only the latest settings matter.
+	select {
+	case <-rc.settingsCh:
+	default:
 	}
-
-	return checkVersion("PD", requiredPDVersion, *version)
+	rc.settingsCh <- settings
 }
 
-func (rc *RestoreController) checkTiKVVersion(client *http.Client) error {
-	url := fmt.Sprintf("http://%s/pd/api/v1/stores", rc.cfg.TiDB.PdAddr)
+func (rc *RestoreController) switchToImportMode(ctx context.Context) {
+	rc.switchTiKVMode(ctx, sstpb.SwitchMode_Import)
+}
 
-	var stores struct {
-		Stores []struct {
-			Store struct {
-				Address string
-				Version string
-			}
-		}
-	}
-	err := common.GetJSON(client, url, &stores)
-	if err != nil {
-		return errors.Trace(err)
+func (rc *RestoreController) switchToNormalMode(ctx context.Context) error {
+	if rc.coordinator != nil {
+		return errors.Trace(rc.coordinator.runOnce(ctx, "switch-mode", rc.doSwitchToNormalMode))
 	}
+	return errors.Trace(rc.doSwitchToNormalMode(ctx))
+}
 
-	for _, store := range stores.Stores {
-		version, err := semver.NewVersion(store.Store.Version)
-		if err != nil {
-			return errors.Annotate(err, store.Store.Address)
-		}
-		component := fmt.Sprintf("TiKV (at %s)", store.Store.Address)
-		err = checkVersion(component, requiredTiKVVersion, *version)
-		if err != nil {
-			return errors.Trace(err)
-		}
-	}
+func (rc *RestoreController) doSwitchToNormalMode(ctx context.Context) error {
+	rc.switchTiKVMode(ctx, sstpb.SwitchMode_Normal)
+	rc.resumePDSchedulersIfPaused(ctx)
 	return nil
 }
 
-func checkVersion(component string, expected, actual semver.Version) error {
-	if actual.Compare(expected) >= 0 {
-		return nil
+func (rc *RestoreController) switchTiKVMode(ctx context.Context, mode sstpb.SwitchMode) {
+	// the TiDB backend imports into a cluster which may be serving traffic.
+	if rc.importer.RowsFormat() == kv.RowsFormatSQL {
+		return
+	}
+	if err := rc.importer.SwitchMode(ctx, mode); err != nil {
+		common.AppLogger.Warnf("cannot switch to %s mode: %v", mode.String(), err)
+		return
+	}
+	rc.tikvMode.Store(mode.String())
+	if err := SaveTiKVModeRecord(ctx, rc.checkpointsDB, rc.cfg, mode); err != nil {
+		common.AppLogger.Warnf("cannot record the TiKV mode into the checkpoints: %v", err)
 	}
-	return errors.Errorf(
-		"%s version too old, expected '>=%s', found '%s'",
-		component,
-		expected,
-		actual,
-	)
 }
 
 func (rc *RestoreController) cleanCheckpoints(ctx context.Context) error {
@@ -898,47 +1431,82 @@ func (rc *RestoreController) cleanCheckpoints(ctx context.Context) error {
 
 		return nil
 	}
+	if errorCount := rc.errorSummaries.count(); errorCount > 0 {
+		// the checkpoints of the failed tables are needed to retry them.
+		common.AppLogger.Infof("Skip clean checkpoints since %d tables failed.", errorCount)
+		return nil
+	}
+	if rc.cfg.Subset.Enabled() {
+		// the checkpoints of the other tables are still needed.
+		common.AppLogger.Info("Skip clean checkpoints since only a subset of tables is restored.")
+		return nil
+	}
+	// the task result and status are still reported from the checkpoints.
+	for _, dbMeta := range rc.dbMetas {
+		for _, tableMeta := range dbMeta.Tables {
+			tableName := common.UniqueTable(dbMeta.Name, tableMeta.Name)
+			cp, err := rc.checkpointsDB.Get(ctx, tableName)
+			if err != nil {
+				common.TableLogger(tableName).Warnf("cannot read checkpoint before cleaning up: %v", err)
+				continue
+			}
+			rc.finalCheckpoints.Store(tableName, cp)
+		}
+	}
+
 	timer := time.Now()
-	err := rc.checkpointsDB.RemoveCheckpoint(ctx, "all")
+	var err error
+	if rc.cfg.Checkpoint.ArchiveAfterSuccess {
+		err = rc.checkpointsDB.ArchiveCheckpoints(ctx, timer)
+	} else {
+		err = rc.checkpointsDB.RemoveCheckpoint(ctx, "all")
+	}
 	common.AppLogger.Infof("clean checkpoints takes %v", time.Since(timer))
 	return errors.Trace(err)
 }
 
-type chunkRestore struct {
-	parser *mydump.ChunkParser
-	index  int
-	chunk  *ChunkCheckpoint
-}
-
-func newChunkRestore(index int, chunk *ChunkCheckpoint, blockBufSize int64, ioWorkers *worker.Pool) (*chunkRestore, error) {
-	reader, err := os.Open(chunk.Key.Path)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	parser := mydump.NewChunkParser(reader, blockBufSize, ioWorkers)
-
-	reader.Seek(chunk.Chunk.Offset, io.SeekStart)
-	parser.SetPos(chunk.Chunk.Offset, chunk.Chunk.PrevRowIDMax)
-
-	return &chunkRestore{
-		parser: parser,
-		index:  index,
-		chunk:  chunk,
-	}, nil
-}
-
-func (cr *chunkRestore) close() {
-	cr.parser.Reader().(*os.File).Close()
-}
-
 type TableRestore struct {
 	// The unique table name in the form "`db`.`tbl`".
 	tableName string
+	// The position of the table in the import order, which decides the
+	// priority of its engines.
+	order     int
 	dbInfo    *TidbDBInfo
 	tableInfo *TidbTableInfo
 	tableMeta *mydump.MDTableMeta
 	encoder   kvenc.KvEncoder
 	alloc     autoid.Allocator
+
+	// the checksum of the existing data before an incremental import, or nil
+	// if unknown.
+	baseChecksum *verify.KVChecksum
+	// the number of the existing rows before an incremental import, counted
+	// for checksum-method = "row-count" or the partitioned tables, or nil if
+	// unknown.
+	baseRowCount *int64
+	// the rows sampled for the spot check, nil if not enabled.
+	sampler *rowSampler
+	// how the table is verified in this run, one of Verification*, or empty
+	// if the table is not post-processed in this run.
+	verification string
+
+	// the number of rows encoded and delivered in this run, accessed
+	// atomically. the rows executed by the TiDB backend are not counted.
+	rows uint64
+	// the time spent in each phase in this run.
+	phases phaseBreakdown
+	// the number of chunks of the table, and those finished including by the
+	// previous runs, accessed atomically.
+	totalChunks    int64
+	finishedChunks int64
+	// whether the chunks were populated by a previous run, which may have
+	// executed statements of the TiDB backend not yet recorded.
+	resumed bool
+}
+
+// logger returns the logger attaching the table to every record.
+func (tr *TableRestore) logger() *log.Entry {
+	return common.TableLogger(tr.tableName)
 }
 
 func NewTableRestore(
@@ -948,7 +1516,7 @@ func NewTableRestore(
 	tableInfo *TidbTableInfo,
 	cp *TableCheckpoint,
 ) (*TableRestore, error) {
-	idAlloc := kv.NewPanickingAllocator(cp.AllocBase)
+	idAlloc := kv.NewIDAllocator(cp.AllocBase)
 	encoder, err := kvenc.New(dbInfo.Name, idAlloc)
 	if err != nil {
 		return nil, errors.Annotatef(err, "failed to kvenc.New %s", tableName)
@@ -956,6 +1524,7 @@ func NewTableRestore(
 	// create table in encoder.
 	err = encoder.ExecDDLSQL(tableInfo.CreateTableStmt)
 	if err != nil {
+		encoder.Close()
 		return nil, errors.Annotatef(err, "failed to ExecDDLSQL %s", tableName)
 	}
 
@@ -969,23 +1538,89 @@ func NewTableRestore(
 	}, nil
 }
 
+// encoderOptions are the session settings of the KV encoders, which must match
+// the target cluster for the KV pairs to be the same as INSERT statements.
+type encoderOptions struct {
+	// the SQL mode of the table, see config.DBStore.SQLModeOf.
+	sqlMode string
+	// the time_zone of the session, or empty for the local time zone.
+	timeZone string
+	// whether the cluster enables the new collation framework.
+	newCollation bool
+	// whether the parsed rows are encoded through prepared statements.
+	usePrepareStmt bool
+}
+
+func (opts *encoderOptions) describeTimeZone() string {
+	if len(opts.timeZone) == 0 {
+		return "SYSTEM (" + time.Local.String() + ")"
+	}
+	return opts.timeZone
+}
+
+// newKVEncoder creates the encoder of the rows of the table.
+func (tr *TableRestore) newKVEncoder(opts encoderOptions) (*kv.TableKVEncoder, error) {
+	kvEncoder, err := kv.NewTableKVEncoder(
+		tr.dbInfo.Name,
+		tr.tableInfo.Name,
+		tr.tableInfo.core,
+		opts.sqlMode,
+		tr.alloc,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if tr.tableInfo.AutoRandomBits > 0 {
+		if err := kvEncoder.SetAutoRandomBits(tr.tableInfo.AutoRandomBits); err != nil {
+			kvEncoder.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	if len(opts.timeZone) > 0 {
+		if err := kvEncoder.SetTimeZone(opts.timeZone); err != nil {
+			kvEncoder.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	if opts.newCollation {
+		if err := kvEncoder.EnableNewCollation(); err != nil {
+			kvEncoder.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	if opts.usePrepareStmt {
+		kvEncoder.EnablePrepareStmt()
+	}
+	return kvEncoder, nil
+}
+
 func (tr *TableRestore) Close() {
 	tr.encoder.Close()
-	common.AppLogger.Infof("[%s] restore done", tr.tableName)
+	tr.logger().Info("restore done")
 }
 
 var tidbRowIDColumnRegex = regexp.MustCompile(fmt.Sprintf("`%[1]s`|(?i:\\b%[1]s\\b)", model.ExtraHandleName))
 
-func (t *TableRestore) populateChunks(cfg *config.Config, cp *TableCheckpoint) error {
-	common.AppLogger.Infof("[%s] load chunks", t.tableName)
+func (t *TableRestore) populateChunks(cfg *config.Config, engineSize int64, cp *TableCheckpoint) error {
+	t.logger().Info("load chunks")
 	timer := time.Now()
 
-	chunks, err := mydump.MakeTableRegions(t.tableMeta, t.tableInfo.Columns, cfg.Mydumper.BatchSize, cfg.Mydumper.BatchImportRatio, cfg.App.TableConcurrency)
+	chunks, err := mydump.MakeTableRegions(t.tableMeta, t.tableInfo.Columns, engineSize, cfg.Mydumper.BatchImportRatio, cfg.App.TableConcurrency)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
+	fileStats := make(map[string]os.FileInfo)
 	for _, chunk := range chunks {
+		stat, ok := fileStats[chunk.File]
+		if !ok {
+			stat, err = os.Stat(chunk.File)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			fileStats[chunk.File] = stat
+		}
+
 		for chunk.EngineID >= len(cp.Engines) {
 			cp.Engines = append(cp.Engines, &EngineCheckpoint{Status: CheckpointStatusLoaded})
 		}
@@ -994,17 +1629,65 @@ func (t *TableRestore) populateChunks(cfg *config.Config, cp *TableCheckpoint) e
 				Path:   chunk.File,
 				Offset: chunk.Chunk.Offset,
 			},
-			Columns: nil,
-			Chunk:   chunk.Chunk,
+			Columns:     nil,
+			Chunk:       chunk.Chunk,
+			FileSize:    stat.Size(),
+			FileModTime: stat.ModTime().UnixNano(),
 		})
 	}
 
-	common.AppLogger.Infof("[%s] load %d engines and %d chunks takes %v", t.tableName, len(cp.Engines), len(chunks), time.Since(timer))
+	t.logger().Infof("load %d engines and %d chunks takes %v", len(cp.Engines), len(chunks), time.Since(timer))
+	return nil
+}
+
+// verifySourceFiles ensures the data files are unchanged since the chunks were
+// recorded into the checkpoint. Resuming on modified files would read from
+// shifted offsets and import corrupted rows without any error.
+func (t *TableRestore) verifySourceFiles(cp *TableCheckpoint) error {
+	return common.WithCategory(verifyChunkSourceFiles(t.tableName, cp), common.ErrorCategorySourceData)
+}
+
+// verifyChunkSourceFiles checks whether the source files recorded in the
+// checkpoint are modified.
+func verifyChunkSourceFiles(tableName string, cp *TableCheckpoint) error {
+	checked := make(map[string]struct{})
+	var changedFiles []string
+	for _, engine := range cp.Engines {
+		for _, chunk := range engine.Chunks {
+			path := chunk.Key.Path
+			if _, ok := checked[path]; ok {
+				continue
+			}
+			checked[path] = struct{}{}
+			// checkpoints created by older versions did not record the file info.
+			if chunk.FileModTime == 0 {
+				continue
+			}
+
+			stat, err := os.Stat(path)
+			switch {
+			case os.IsNotExist(err):
+				changedFiles = append(changedFiles, path+" (removed)")
+			case err != nil:
+				return errors.Trace(err)
+			case stat.Size() != chunk.FileSize || stat.ModTime().UnixNano() != chunk.FileModTime:
+				changedFiles = append(changedFiles, path)
+			}
+		}
+	}
+
+	if len(changedFiles) > 0 {
+		return errors.Errorf(
+			"source files of table %s have changed since the checkpoint was created, please restore the original files or remove the checkpoint of this table: %s",
+			tableName, strings.Join(changedFiles, ", "),
+		)
+	}
 	return nil
 }
 
-func (t *TableRestore) initializeColumns(columns []byte, ccp *ChunkCheckpoint) {
-	shouldIncludeRowID := !t.tableInfo.core.PKIsHandle && !tidbRowIDColumnRegex.Match(columns)
+func (t *TableRestore) initializeColumns(columns []byte, ccp *ChunkCheckpoint, noRowIDs bool) {
+	hasRowID := !t.tableInfo.core.PKIsHandle && !t.tableInfo.IsCommonHandle
+	shouldIncludeRowID := !noRowIDs && hasRowID && !tidbRowIDColumnRegex.Match(columns)
 	if shouldIncludeRowID {
 		// we need to inject the _tidb_rowid column
 		if len(columns) != 0 {
@@ -1029,426 +1712,265 @@ func (t *TableRestore) initializeColumns(columns []byte, ccp *ChunkCheckpoint) {
 	ccp.ShouldIncludeRowID = shouldIncludeRowID
 }
 
+// prepareIncremental makes the chunks of a non-empty table use the row IDs
+// above the existing rows, and records the checksum of the existing data.
+func (t *TableRestore) prepareIncremental(ctx context.Context, rc *RestoreController, cp *TableCheckpoint) error {
+	base, err := ObtainRowIDBase(ctx, rc.tidbMgr.db, t.dbInfo.Name, t.tableInfo.core)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	shiftRowIDs(cp, base)
+	t.logger().Infof("incremental import, row IDs start from %d", base+1)
+
+	switch {
+	case rc.cfg.PostRestore.Checksum == config.PostOpLevelOff:
+	case rc.cfg.PostRestore.ChecksumMethod == config.ChecksumMethodRowCount:
+		count, err := rc.checksumMgr.rowCount(ctx, t.tableName)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		t.baseRowCount = &count
+	default:
+		remoteChecksum, err := rc.checksumMgr.checksum(ctx, t.tableName)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		checksum := verify.MakeKVChecksum(remoteChecksum.TotalBytes, remoteChecksum.TotalKVs, remoteChecksum.Checksum)
+		t.baseChecksum = &checksum
+		// the rows are counted too in case the checksum does not cover the
+		// partitions, see compareChecksum.
+		if t.isPartitioned() {
+			count, err := rc.checksumMgr.rowCount(ctx, t.tableName)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			t.baseRowCount = &count
+		}
+	}
+	return nil
+}
+
+// shiftRowIDs moves the row ID ranges of all chunks after `base`.
+func shiftRowIDs(cp *TableCheckpoint, base int64) {
+	for _, engine := range cp.Engines {
+		for _, chunk := range engine.Chunks {
+			chunk.Chunk.PrevRowIDMax += base
+			chunk.Chunk.RowIDMax += base
+		}
+	}
+}
+
+// needsAutoIDRebase returns whether the table allocates IDs from the auto ID
+// base, i.e. it has an AUTO_INCREMENT or AUTO_RANDOM column, or its rows are
+// keyed by _tidb_rowid. The tables keyed by their primary keys without such
+// columns need not be rebased.
+func (tr *TableRestore) needsAutoIDRebase() bool {
+	core := tr.tableInfo.core
+	if tr.tableInfo.AutoRandomBits > 0 || core.GetAutoIncrementColInfo() != nil {
+		return true
+	}
+	return !core.PKIsHandle && !tr.tableInfo.IsCommonHandle
+}
+
+// isPartitioned returns whether the rows are stored under the IDs of the
+// partitions instead of the table. The partitions allocate the row IDs from
+// the table, so the auto ID is still rebased on the table.
+func (tr *TableRestore) isPartitioned() bool {
+	return tr.tableInfo.core.GetPartitionInfo() != nil
+}
+
+// maxRebaseAttempts is the number of times the auto ID is rebased before
+// giving up, if the next ID read back is still below the imported IDs.
+const maxRebaseAttempts = 3
+
+// restoreTableMeta rebases the auto ID of the table after the imported IDs,
+// and verifies the rebase took effect. Otherwise the rows inserted afterwards
+// would silently overwrite the imported rows with the same IDs.
 func (tr *TableRestore) restoreTableMeta(ctx context.Context, db *sql.DB) error {
 	timer := time.Now()
 
-	err := AlterAutoIncrement(ctx, db, tr.tableMeta.DB, tr.tableMeta.Name, tr.alloc.Base()+1)
-	if err != nil {
-		return errors.Trace(err)
+	autoRandom := tr.tableInfo.AutoRandomBits > 0
+	base := tr.alloc.Base() + 1
+	for attempt := 1; ; attempt++ {
+		var err error
+		if autoRandom {
+			err = AlterAutoRandom(ctx, db, tr.tableMeta.DB, tr.tableMeta.Name, base)
+		} else {
+			err = AlterAutoIncrement(ctx, db, tr.tableMeta.DB, tr.tableMeta.Name, base)
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		nextID, err := ObtainNextAutoID(ctx, db, tr.tableMeta.DB, tr.tableMeta.Name, autoRandom)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if nextID == 0 {
+			tr.logger().Warnf("cannot read back the auto ID, skip verifying it is rebased to %d", base)
+			break
+		}
+		if nextID >= base {
+			break
+		}
+		if attempt >= maxRebaseAttempts {
+			return errors.Errorf("the next auto ID of %s is %d after rebasing to %d for %d times", tr.tableName, nextID, base, attempt)
+		}
+		tr.logger().Warnf("the next auto ID is %d after rebasing to %d, retrying", nextID, base)
 	}
-	common.AppLogger.Infof("[%s] alter table set auto_id takes %v", common.UniqueTable(tr.tableMeta.DB, tr.tableMeta.Name), time.Since(timer))
+	tr.logger().Infof("alter table set auto_id takes %v", time.Since(timer))
 	return nil
 }
 
 func (tr *TableRestore) importKV(ctx context.Context, closedEngine *kv.ClosedEngine) error {
-	common.AppLogger.Infof("[%s] flush kv deliver ...", tr.tableName)
+	tr.logger().Info("flush kv deliver ...")
 
 	start := time.Now()
 
 	err := closedEngine.Import(ctx)
 	if err != nil {
 		if !common.IsContextCanceledError(err) {
-			common.AppLogger.Errorf("[%s] failed to flush kvs : %s", tr.tableName, err.Error())
+			tr.logger().Errorf("failed to flush kvs : %s", err.Error())
 		}
 		return errors.Trace(err)
 	}
 	closedEngine.Cleanup(ctx)
 
 	dur := time.Since(start)
-	metric.ImportSecondsHistogram.Observe(dur.Seconds())
-	common.AppLogger.Infof("[%s] kv deliver all flushed, takes %v", tr.tableName, dur)
+	metric.ImportSecondsHistogram.WithLabelValues(metric.TableLabel(tr.tableName)).Observe(dur.Seconds())
+	tr.logger().Infof("kv deliver all flushed, takes %v", dur)
 
 	return nil
 }
 
 // do checksum for each table.
-func (tr *TableRestore) compareChecksum(ctx context.Context, db *sql.DB, cp *TableCheckpoint) error {
+func (tr *TableRestore) compareChecksum(ctx context.Context, rc *RestoreController, cp *TableCheckpoint) error {
 	var localChecksum verify.KVChecksum
 	for _, engine := range cp.Engines {
 		for _, chunk := range engine.Chunks {
 			localChecksum.Add(&chunk.Checksum)
 		}
 	}
+	// after an incremental import the table contains the existing data too.
+	if tr.baseChecksum != nil {
+		localChecksum.Add(tr.baseChecksum)
+	}
 
 	start := time.Now()
-	remoteChecksum, err := DoChecksum(ctx, db, tr.tableName)
+	remoteChecksum, err := rc.checksumMgr.checksum(ctx, tr.tableName)
 	dur := time.Since(start)
-	metric.ChecksumSecondsHistogram.Observe(dur.Seconds())
 	if err != nil {
 		return errors.Trace(err)
 	}
 
+	// TiDB before 3.0 checksums only the range of the logical table ID, under
+	// which a partitioned table stores nothing, so the rows of all partitions
+	// are counted instead.
+	if tr.isPartitioned() && remoteChecksum.TotalKVs == 0 && localChecksum.SumKVS() > 0 {
+		tr.logger().Warn("ADMIN CHECKSUM TABLE does not cover the partitions, comparing the row count instead")
+		tr.verification = VerificationRowCount
+		return errors.Trace(tr.compareRowCount(ctx, rc, cp))
+	}
+
 	if remoteChecksum.Checksum != localChecksum.Sum() ||
 		remoteChecksum.TotalKVs != localChecksum.SumKVS() ||
 		remoteChecksum.TotalBytes != localChecksum.SumSize() {
-		return errors.Errorf("checksum mismatched remote vs local => (checksum: %d vs %d) (total_kvs: %d vs %d) (total_bytes:%d vs %d)",
+		msg := fmt.Sprintf("checksum mismatched remote vs local => (checksum: %d vs %d) (total_kvs: %d vs %d) (total_bytes:%d vs %d)",
 			remoteChecksum.Checksum, localChecksum.Sum(),
 			remoteChecksum.TotalKVs, localChecksum.SumKVS(),
 			remoteChecksum.TotalBytes, localChecksum.SumSize(),
 		)
+		report := tr.newMismatchReport(cp, config.ChecksumMethodAdmin)
+		report.Remote = ChecksumSummary{
+			Checksum:   remoteChecksum.Checksum,
+			TotalKVs:   remoteChecksum.TotalKVs,
+			TotalBytes: remoteChecksum.TotalBytes,
+			Rows:       tr.localRows(remoteChecksum.TotalKVs),
+		}
+		if tr.baseChecksum != nil {
+			base := tr.summarize(tr.baseChecksum)
+			report.Base = &base
+		}
+		if path := tr.diagnoseMismatch(ctx, rc, cp, report); len(path) > 0 {
+			msg += ", see the diagnostics in " + path
+		}
+		return common.WithCategory(errors.New(msg), common.ErrorCategoryChecksumMismatch)
 	}
 
-	common.AppLogger.Infof("[%s] checksum pass, %+v takes %v", tr.tableName, localChecksum, dur)
+	tr.logger().Infof("checksum pass, %+v takes %v", localChecksum, dur)
 	return nil
 }
 
-func (tr *TableRestore) analyzeTable(ctx context.Context, db *sql.DB) error {
-	timer := time.Now()
-	common.AppLogger.Infof("[%s] analyze", tr.tableName)
-	query := fmt.Sprintf("ANALYZE TABLE %s", tr.tableName)
-	err := common.ExecWithRetry(ctx, db, query, query)
-	if err != nil {
-		return errors.Trace(err)
-	}
-	common.AppLogger.Infof("[%s] analyze takes %v", tr.tableName, time.Since(timer))
-	return nil
-}
-
-// RemoteChecksum represents a checksum result got from tidb.
-type RemoteChecksum struct {
-	Schema     string
-	Table      string
-	Checksum   uint64
-	TotalKVs   uint64
-	TotalBytes uint64
-}
-
-func (c *RemoteChecksum) String() string {
-	return fmt.Sprintf("[%s] remote_checksum=%d, total_kvs=%d, total_bytes=%d", common.UniqueTable(c.Schema, c.Table), c.Checksum, c.TotalKVs, c.TotalBytes)
-}
-
-func setSessionConcurrencyVars(ctx context.Context, db *sql.DB, dsn config.DBStore) {
-	err := common.ExecWithRetry(ctx, db, "(set session concurrency variables)", `SET
-		SESSION tidb_build_stats_concurrency = ?,
-		SESSION tidb_distsql_scan_concurrency = ?,
-		SESSION tidb_index_serial_scan_concurrency = ?,
-		SESSION tidb_checksum_table_concurrency = ?;
-	`, dsn.BuildStatsConcurrency, dsn.DistSQLScanConcurrency, dsn.IndexSerialScanConcurrency, dsn.ChecksumTableConcurrency)
-	if err != nil {
-		common.AppLogger.Warnf("failed to set session concurrency variables: %s", err.Error())
-	}
-}
-
-// DoChecksum do checksum for tables.
-// table should be in <db>.<table>, format.  e.g. foo.bar
-func DoChecksum(ctx context.Context, db *sql.DB, table string) (*RemoteChecksum, error) {
-	timer := time.Now()
-
-	ori, err := increaseGCLifeTime(ctx, db)
-	if err != nil {
-		return nil, errors.Trace(err)
+// compareRowCount verifies the number of rows in TiDB against the rows
+// encoded, which is the number of KV pairs over the KV pairs of a row, i.e.
+// the record and one entry for each index.
+func (tr *TableRestore) compareRowCount(ctx context.Context, rc *RestoreController, cp *TableCheckpoint) error {
+	var localChecksum verify.KVChecksum
+	for _, engine := range cp.Engines {
+		for _, chunk := range engine.Chunks {
+			localChecksum.Add(&chunk.Checksum)
+		}
 	}
-	// set it back finally
-	defer func() {
-		err = UpdateGCLifeTime(ctx, db, ori)
-		if err != nil && !common.IsContextCanceledError(err) {
-			common.AppLogger.Errorf("[%s] update tikv_gc_life_time error %v", table, errors.ErrorStack(err))
-		}
-	}()
-
-	// ADMIN CHECKSUM TABLE <table>,<table>  example.
-	// 	mysql> admin checksum table test.t;
-	// +---------+------------+---------------------+-----------+-------------+
-	// | Db_name | Table_name | Checksum_crc64_xor  | Total_kvs | Total_bytes |
-	// +---------+------------+---------------------+-----------+-------------+
-	// | test    | t          | 8520875019404689597 |   7296873 |   357601387 |
-	// +---------+------------+---------------------+-----------+-------------+
-
-	cs := RemoteChecksum{}
-	common.AppLogger.Infof("[%s] doing remote checksum", table)
-	query := fmt.Sprintf("ADMIN CHECKSUM TABLE %s", table)
-	err = common.QueryRowWithRetry(ctx, db, query, &cs.Schema, &cs.Table, &cs.Checksum, &cs.TotalKVs, &cs.TotalBytes)
-	if err != nil {
-		return nil, errors.Trace(err)
+	localRows := tr.localRows(localChecksum.SumKVS())
+	// after an incremental import the table contains the existing rows too.
+	if tr.baseRowCount != nil {
+		localRows += *tr.baseRowCount
 	}
-	common.AppLogger.Infof("[%s] do checksum takes %v", table, time.Since(timer))
-
-	return &cs, nil
-}
 
-func increaseGCLifeTime(ctx context.Context, db *sql.DB) (oriGCLifeTime string, err error) {
-	// checksum command usually takes a long time to execute,
-	// so here need to increase the gcLifeTime for single transaction.
-	oriGCLifeTime, err = ObtainGCLifeTime(ctx, db)
+	start := time.Now()
+	remoteRows, err := rc.checksumMgr.rowCount(ctx, tr.tableName)
+	dur := time.Since(start)
 	if err != nil {
-		return "", errors.Trace(err)
+		return errors.Trace(err)
 	}
 
-	var increaseGCLifeTime bool
-	if oriGCLifeTime != "" {
-		ori, err := time.ParseDuration(oriGCLifeTime)
-		if err != nil {
-			return "", errors.Trace(err)
-		}
-		if ori < defaultGCLifeTime {
-			increaseGCLifeTime = true
+	if remoteRows != localRows {
+		msg := fmt.Sprintf("row count mismatched remote vs local => %d vs %d", remoteRows, localRows)
+		report := tr.newMismatchReport(cp, config.ChecksumMethodRowCount)
+		report.Remote = ChecksumSummary{Rows: remoteRows}
+		if tr.baseRowCount != nil {
+			report.Base = &ChecksumSummary{Rows: *tr.baseRowCount}
 		}
-	} else {
-		increaseGCLifeTime = true
-	}
-
-	if increaseGCLifeTime {
-		err = UpdateGCLifeTime(ctx, db, defaultGCLifeTime.String())
-		if err != nil {
-			return "", errors.Trace(err)
+		if path := tr.diagnoseMismatch(ctx, rc, cp, report); len(path) > 0 {
+			msg += ", see the diagnostics in " + path
 		}
+		return common.WithCategory(errors.New(msg), common.ErrorCategoryChecksumMismatch)
 	}
 
-	return oriGCLifeTime, nil
-}
-
-////////////////////////////////////////////////////////////////
-
-const (
-	maxKVQueueSize  = 128
-	maxDeliverBytes = 31 << 20 // 31 MB. hardcoded by importer, so do we
-)
-
-func splitIntoDeliveryStreams(totalKVs []kvenc.KvPair, splitSize int) [][]kvenc.KvPair {
-	res := make([][]kvenc.KvPair, 0, 1)
-	i := 0
-	cumSize := 0
-
-	for j, pair := range totalKVs {
-		size := len(pair.Key) + len(pair.Val)
-		if i < j && cumSize+size > splitSize {
-			res = append(res, totalKVs[i:j])
-			i = j
-			cumSize = 0
-		}
-		cumSize += size
-	}
-
-	return append(res, totalKVs[i:])
+	tr.logger().Infof("row count pass, %d rows takes %v", localRows, dur)
+	return nil
 }
 
-func (cr *chunkRestore) restore(
-	ctx context.Context,
-	t *TableRestore,
-	engineID int,
-	engine *kv.OpenedEngine,
-	rc *RestoreController,
-) error {
-	// Create the encoder.
-	kvEncoder, err := kv.NewTableKVEncoder(
-		t.dbInfo.Name,
-		t.tableInfo.Name,
-		t.tableInfo.ID,
-		rc.cfg.TiDB.SQLMode,
-		t.alloc,
-	)
+func (tr *TableRestore) analyzeTable(ctx context.Context, db *sql.DB, cfg *config.PostRestore) error {
+	timer := time.Now()
+	tr.logger().Info("analyze")
+	query := analyzeQuery(tr.tableName, cfg)
+	err := common.ExecWithRetry(ctx, db, query, query)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	defer func() {
-		closeErr := kvEncoder.Close()
-		kvEncoder = nil
-		if closeErr != nil {
-			common.AppLogger.Errorf("restore chunk task err %v", errors.ErrorStack(closeErr))
-		}
-	}()
-
-	timer := time.Now()
-	readTotalDur := time.Duration(0)
-	encodeTotalDur := time.Duration(0)
-	deliverTotalDur := time.Duration(0)
-
-	var block struct {
-		cond            *sync.Cond
-		encodeCompleted bool
-		totalKVs        []kvenc.KvPair
-		localChecksum   verify.KVChecksum
-		chunkOffset     int64
-		chunkRowID      int64
-	}
-	block.cond = sync.NewCond(new(sync.Mutex))
-	deliverCompleteCh := make(chan error, 1)
-
-	go func() {
-		for {
-			block.cond.L.Lock()
-			for !block.encodeCompleted && len(block.totalKVs) == 0 {
-				block.cond.Wait()
-			}
-			b := block
-			block.totalKVs = nil
-			block.localChecksum = verify.MakeKVChecksum(0, 0, 0)
-			block.cond.L.Unlock()
-
-			if b.encodeCompleted && len(b.totalKVs) == 0 {
-				deliverCompleteCh <- nil
-				return
-			}
-
-			// kv -> deliver ( -> tikv )
-			start := time.Now()
-			stream, err := engine.NewWriteStream(ctx)
-			if err != nil {
-				deliverCompleteCh <- errors.Trace(err)
-				return
-			}
-
-			for _, kvs := range splitIntoDeliveryStreams(b.totalKVs, maxDeliverBytes) {
-				if e := stream.Put(kvs); e != nil {
-					if err != nil {
-						common.AppLogger.Warnf("failed to put write stream: %s", e.Error())
-					} else {
-						err = e
-					}
-				}
-			}
-			b.totalKVs = nil
-
-			block.cond.Signal()
-			if e := stream.Close(); e != nil {
-				if err != nil {
-					common.AppLogger.Warnf("[%s:%d] failed to close write stream: %s", t.tableName, engineID, e.Error())
-				} else {
-					err = e
-				}
-			}
-			deliverDur := time.Since(start)
-			deliverTotalDur += deliverDur
-			metric.BlockDeliverSecondsHistogram.Observe(deliverDur.Seconds())
-			metric.BlockDeliverBytesHistogram.Observe(float64(b.localChecksum.SumSize()))
-
-			if err != nil {
-				if !common.IsContextCanceledError(err) {
-					common.AppLogger.Errorf("[%s:%d] kv deliver failed = %v", t.tableName, engineID, err)
-				}
-				// TODO : retry ~
-				deliverCompleteCh <- errors.Trace(err)
-				return
-			}
-
-			// Update the table, and save a checkpoint.
-			// (the write to the importer is effective immediately, thus update these here)
-			cr.chunk.Checksum.Add(&b.localChecksum)
-			cr.chunk.Chunk.Offset = b.chunkOffset
-			cr.chunk.Chunk.PrevRowIDMax = b.chunkRowID
-			rc.saveCpCh <- saveCp{
-				tableName: t.tableName,
-				merger: &RebaseCheckpointMerger{
-					AllocBase: t.alloc.Base() + 1,
-				},
-			}
-			rc.saveCpCh <- saveCp{
-				tableName: t.tableName,
-				merger: &ChunkCheckpointMerger{
-					EngineID: engineID,
-					Key:      cr.chunk.Key,
-					Checksum: cr.chunk.Checksum,
-					Pos:      cr.chunk.Chunk.Offset,
-					RowID:    cr.chunk.Chunk.PrevRowIDMax,
-				},
-			}
-		}
-	}()
-
-	var buffer bytes.Buffer
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
-
-		endOffset := mathutil.MinInt64(cr.chunk.Chunk.EndOffset, cr.parser.Pos()+rc.cfg.Mydumper.ReadBlockSize)
-		if cr.parser.Pos() >= endOffset {
-			break
-		}
-
-		buffer.Reset()
-		start := time.Now()
-
-		var sep byte = ' '
-	readLoop:
-		for cr.parser.Pos() < endOffset {
-			readRowStartTime := time.Now()
-			err := cr.parser.ReadRow()
-			switch errors.Cause(err) {
-			case nil:
-				buffer.WriteByte(sep)
-				if sep == ' ' {
-					buffer.WriteString("INSERT INTO ")
-					buffer.WriteString(t.tableName)
-					if cr.chunk.Columns == nil {
-						t.initializeColumns(cr.parser.Columns, cr.chunk)
-					}
-					buffer.Write(cr.chunk.Columns)
-					buffer.WriteString(" VALUES ")
-					sep = ','
-				}
-				metric.ChunkParserReadRowSecondsHistogram.Observe(time.Since(readRowStartTime).Seconds())
-				lastRow := cr.parser.LastRow()
-				if cr.chunk.ShouldIncludeRowID {
-					buffer.Write(lastRow.Row[:len(lastRow.Row)-1])
-					fmt.Fprintf(&buffer, ",%d)", lastRow.RowID)
-				} else {
-					buffer.Write(lastRow.Row)
-				}
-			case io.EOF:
-				cr.chunk.Chunk.EndOffset = cr.parser.Pos()
-				break readLoop
-			default:
-				return errors.Trace(err)
-			}
-		}
-		if sep != ',' { // quick and dirty way to check if `buffer` actually contained any values
-			continue
-		}
-		buffer.WriteByte(';')
-
-		readDur := time.Since(start)
-		readTotalDur += readDur
-		metric.BlockReadSecondsHistogram.Observe(readDur.Seconds())
-		metric.BlockReadBytesHistogram.Observe(float64(buffer.Len()))
-
-		// sql -> kv
-		start = time.Now()
-		kvs, _, err := kvEncoder.SQL2KV(buffer.String())
-		encodeDur := time.Since(start)
-		encodeTotalDur += encodeDur
-		metric.BlockEncodeSecondsHistogram.Observe(encodeDur.Seconds())
-
-		common.AppLogger.Debugf("len(kvs) %d, len(sql) %d", len(kvs), buffer.Len())
-		if err != nil {
-			common.AppLogger.Errorf("kv encode failed = %s\n", err.Error())
-			return errors.Trace(err)
-		}
+	tr.logger().Infof("analyze takes %v", time.Since(timer))
+	return nil
+}
 
-		block.cond.L.Lock()
-		for len(block.totalKVs) > len(kvs)*maxKVQueueSize {
-			// ^ hack to create a back-pressure preventing sending too many KV pairs at once
-			// this happens when delivery is slower than encoding.
-			// note that the KV pairs will retain the memory buffer backing the KV encoder
-			// and thus blow up the memory usage and will easily cause lightning to go OOM.
-			block.cond.Wait()
-		}
-		block.totalKVs = append(block.totalKVs, kvs...)
-		block.localChecksum.Update(kvs)
-		block.chunkOffset = cr.parser.Pos()
-		block.chunkRowID = cr.parser.LastRow().RowID
-		block.cond.Signal()
-		block.cond.L.Unlock()
+func analyzeQuery(tableName string, cfg *config.PostRestore) string {
+	switch {
+	case cfg.AnalyzeSamples > 0:
+		return fmt.Sprintf("ANALYZE TABLE %s WITH %d SAMPLES", tableName, cfg.AnalyzeSamples)
+	case cfg.AnalyzeSampleRate > 0:
+		return fmt.Sprintf("ANALYZE TABLE %s WITH %g SAMPLERATE", tableName, cfg.AnalyzeSampleRate)
+	default:
+		return fmt.Sprintf("ANALYZE TABLE %s", tableName)
 	}
+}
 
-	block.cond.L.Lock()
-	block.encodeCompleted = true
-	block.cond.Signal()
-	block.cond.L.Unlock()
-
-	select {
-	case err := <-deliverCompleteCh:
-		if err == nil {
-			common.AppLogger.Infof(
-				"[%s:%d] restore chunk #%d (%s) takes %v (read: %v, encode: %v, deliver: %v)",
-				t.tableName, engineID, cr.index, &cr.chunk.Key, time.Since(timer),
-				readTotalDur, encodeTotalDur, deliverTotalDur,
-			)
+// skipsAnalyze returns whether the table is listed in `skipTables`, which are
+// in the form "db.table".
+func skipsAnalyze(skipTables []string, schema string, table string) bool {
+	for _, name := range skipTables {
+		if strings.EqualFold(name, schema+"."+table) {
+			return true
 		}
-		return errors.Trace(err)
-	case <-ctx.Done():
-		return ctx.Err()
 	}
+	return false
 }
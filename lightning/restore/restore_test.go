@@ -14,8 +14,37 @@
 package restore
 
 import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	sstpb "github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
 	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/config"
+	"github.com/pingcap/tidb-lightning/lightning/kv"
+	"github.com/pingcap/tidb-lightning/lightning/metric"
+	"github.com/pingcap/tidb-lightning/lightning/mydump"
+	verify "github.com/pingcap/tidb-lightning/lightning/verification"
+	"github.com/pingcap/tidb-lightning/lightning/worker"
+	"github.com/pingcap/tidb/types"
+	kvenc "github.com/pingcap/tidb/util/kvencoder"
+	"github.com/satori/go.uuid"
 )
 
 var _ = Suite(&restoreSuite{})
@@ -49,6 +78,1672 @@ func (s *restoreSuite) TestNewTableRestore(c *C) {
 		} else {
 			c.Assert(tr, NotNil)
 			c.Assert(err, IsNil)
+			tr.Close()
+		}
+	}
+}
+
+func (s *restoreSuite) TestVerifySourceFiles(c *C) {
+	dir := c.MkDir()
+	unchangedPath := filepath.Join(dir, "db.t.1.sql")
+	changedPath := filepath.Join(dir, "db.t.2.sql")
+	removedPath := filepath.Join(dir, "db.t.3.sql")
+	for _, path := range []string{unchangedPath, changedPath, removedPath} {
+		err := ioutil.WriteFile(path, []byte("INSERT INTO t VALUES (1);"), 0644)
+		c.Assert(err, IsNil)
+	}
+
+	makeChunk := func(path string) *ChunkCheckpoint {
+		stat, err := os.Stat(path)
+		c.Assert(err, IsNil)
+		return &ChunkCheckpoint{
+			Key:         ChunkCheckpointKey{Path: path},
+			FileSize:    stat.Size(),
+			FileModTime: stat.ModTime().UnixNano(),
+		}
+	}
+	cp := &TableCheckpoint{
+		Engines: []*EngineCheckpoint{
+			{Chunks: []*ChunkCheckpoint{makeChunk(unchangedPath), makeChunk(changedPath)}},
+			{Chunks: []*ChunkCheckpoint{makeChunk(removedPath)}},
+		},
+	}
+	tr := &TableRestore{tableName: "`db`.`t`"}
+	c.Assert(tr.verifySourceFiles(cp), IsNil)
+
+	err := ioutil.WriteFile(changedPath, []byte("INSERT INTO t VALUES (1),(2);"), 0644)
+	c.Assert(err, IsNil)
+	c.Assert(os.Remove(removedPath), IsNil)
+
+	err = tr.verifySourceFiles(cp)
+	c.Assert(err, ErrorMatches, "source files of table `db`.`t` have changed since the checkpoint was created.*")
+	c.Assert(err.Error(), Not(Matches), ".*db.t.1.sql.*")
+	c.Assert(err.Error(), Matches, ".*db.t.2.sql, .*db.t.3.sql \\(removed\\)")
+
+	// checkpoints without file info are not verified.
+	cp.Engines[0].Chunks[1].FileModTime = 0
+	cp.Engines[1].Chunks[0].FileModTime = 0
+	c.Assert(tr.verifySourceFiles(cp), IsNil)
+}
+
+func (s *restoreSuite) TestRewindEngine(c *C) {
+	makeChunk := func(path string, offset, endOffset, rowIDMax int64) *ChunkCheckpoint {
+		return &ChunkCheckpoint{
+			Key:      ChunkCheckpointKey{Path: path, Offset: offset},
+			Chunk:    mydump.Chunk{Offset: endOffset, EndOffset: endOffset, PrevRowIDMax: rowIDMax, RowIDMax: rowIDMax},
+			Checksum: verify.MakeKVChecksum(100, 10, 12345),
+		}
+	}
+	cp := &TableCheckpoint{
+		Engines: []*EngineCheckpoint{
+			{
+				Status: CheckpointStatusImported,
+				Chunks: []*ChunkCheckpoint{makeChunk("a.sql", 0, 100, 10)},
+			},
+			{
+				Status:   CheckpointStatusAllWritten,
+				Importer: "127.0.0.1:8287",
+				Chunks: []*ChunkCheckpoint{
+					makeChunk("b.sql", 0, 100, 20),
+					makeChunk("b.sql", 100, 200, 30),
+				},
+			},
+		},
+	}
+
+	cp.Engines[1].Chunks[1].QuarantineReason = "syntax error"
+
+	rc := &RestoreController{saveCpChs: []chan saveCp{make(chan saveCp, 8)}}
+	tr := &TableRestore{tableName: "`db`.`t`"}
+	tr.rewindEngine(rc, cp, 1)
+
+	c.Assert(cp.Engines[0].Status, Equals, CheckpointStatusImported)
+	c.Assert(cp.Engines[0].Chunks[0].Chunk.Offset, Equals, int64(100))
+
+	c.Assert(cp.Engines[1].Status, Equals, CheckpointStatusLoaded)
+	c.Assert(cp.Engines[1].Importer, Equals, "")
+	chunks := cp.Engines[1].Chunks
+	c.Assert(chunks[0].Chunk.Offset, Equals, int64(0))
+	c.Assert(chunks[0].Chunk.PrevRowIDMax, Equals, int64(10))
+	c.Assert(chunks[1].Chunk.Offset, Equals, int64(100))
+	c.Assert(chunks[1].Chunk.PrevRowIDMax, Equals, int64(20))
+	c.Assert(chunks[1].Checksum.SumSize(), Equals, uint64(0))
+	c.Assert(chunks[1].QuarantineReason, Equals, "")
+
+	// the rewind is persisted into the checkpoints too.
+	c.Assert(rc.saveCpChs[0], HasLen, 5)
+	cpd := NewTableCheckpointDiff()
+	for i := 0; i < 5; i++ {
+		(<-rc.saveCpChs[0]).merger.MergeInto(cpd)
+	}
+	engineDiff := cpd.engines[1]
+	c.Assert(engineDiff.status, Equals, CheckpointStatusLoaded)
+	c.Assert(engineDiff.hasImporter, IsTrue)
+	c.Assert(engineDiff.importer, Equals, "")
+	c.Assert(engineDiff.chunks[chunks[1].Key].pos, Equals, int64(100))
+	c.Assert(engineDiff.chunks[chunks[1].Key].rowID, Equals, int64(20))
+	c.Assert(engineDiff.quarantined, DeepEquals, map[ChunkCheckpointKey]string{chunks[1].Key: ""})
+}
+
+// statsBackend reports the given number and size of the KV pairs of every
+// engine.
+type statsBackend struct {
+	kv.Backend
+	kvs  uint64
+	size uint64
+}
+
+func (b *statsBackend) EngineStats(context.Context, uuid.UUID) (uint64, uint64, error) {
+	return b.kvs, b.size, nil
+}
+
+func (s *restoreSuite) TestVerifyResumedEngine(c *C) {
+	backend := &statsBackend{}
+	rc := &RestoreController{importer: kv.NewBackendImporter(backend)}
+	tr := &TableRestore{tableName: "`db`.`t`"}
+	cp := &EngineCheckpoint{Chunks: []*ChunkCheckpoint{
+		{Checksum: verify.MakeKVChecksum(100, 10, 12345)},
+		{Checksum: verify.MakeKVChecksum(200, 20, 67890)},
+	}}
+	verifyWith := func(kvs, size uint64) error {
+		backend.kvs, backend.size = kvs, size
+		return tr.verifyResumedEngine(context.Background(), rc, 0, cp)
+	}
+
+	c.Assert(verifyWith(30, 300), IsNil)
+	// written after the last checkpoint.
+	c.Assert(verifyWith(40, 400), IsNil)
+	// the duplicate keys are kept once by the engine.
+	c.Assert(verifyWith(25, 250), IsNil)
+	err := verifyWith(0, 0)
+	c.Assert(kv.IsEngineLostError(err), IsTrue)
+	c.Assert(err, ErrorMatches, "engine is empty, but 30 KV pairs \\(300 bytes\\) are recorded in the checkpoint.*")
+
+	// nothing to verify before anything is written.
+	c.Assert(tr.verifyResumedEngine(context.Background(), rc, 0, &EngineCheckpoint{}), IsNil)
+}
+
+func (s *restoreSuite) TestDiscardAllocatedEngine(c *C) {
+	dir := c.MkDir()
+	files := map[string]string{
+		"db-schema-create.sql": "CREATE DATABASE db;",
+		"db.t-schema.sql":      "CREATE TABLE t (id INT PRIMARY KEY AUTO_INCREMENT, v INT);",
+		"db.t.sql":             "INSERT INTO t (v) VALUES (1);",
+	}
+	for name, content := range files {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), IsNil)
+	}
+	cfg := config.NewConfig()
+	cfg.Mydumper.SourceDir = dir
+	cfg.Mydumper.CharacterSet = "auto"
+	loader, err := mydump.NewMyDumpLoader(cfg)
+	c.Assert(err, IsNil)
+	dbMetas := loader.GetDatabases()
+	dbInfos, err := loadDryRunSchemaInfo(context.Background(), dbMetas, cfg)
+	c.Assert(err, IsNil)
+	tr, err := NewTableRestore("`db`.`t`", dbMetas[0].Tables[0], dbInfos["db"], dbInfos["db"].Tables["t"], &TableCheckpoint{})
+	c.Assert(err, IsNil)
+	defer tr.Close()
+
+	backend := new(cleanupBackend)
+	rc := &RestoreController{cfg: cfg, importer: kv.NewBackendImporter(backend)}
+	discard := func(columns string, offset int64) error {
+		cp := &EngineCheckpoint{Chunks: []*ChunkCheckpoint{{
+			Key:     ChunkCheckpointKey{Path: "db.t.sql"},
+			Columns: []byte(columns),
+			Chunk:   mydump.Chunk{Offset: offset, EndOffset: 100},
+		}}}
+		return tr.discardAllocatedEngine(context.Background(), rc, 0, cp)
+	}
+
+	c.Assert(discard("", 50), IsNil)
+	c.Assert(discard("(`id`,`v`)", 50), IsNil)
+	c.Assert(discard("(`v`)", 0), IsNil)
+	c.Assert(backend.cleaned, HasLen, 0)
+	// the rows after the checkpoint would be allocated other values.
+	err = discard("(`v`)", 50)
+	c.Assert(kv.IsEngineLostError(err), IsTrue)
+	c.Assert(backend.cleaned, HasLen, 1)
+}
+
+func (s *restoreSuite) TestSaveAllocBases(c *C) {
+	rc := &RestoreController{saveCpChs: []chan saveCp{make(chan saveCp, 8)}}
+	rc.activeTables.Store("`db`.`t`", &TableRestore{tableName: "`db`.`t`", alloc: kv.NewIDAllocator(41)})
+	rc.saveAllocBases()
+
+	c.Assert(rc.saveCpChs[0], HasLen, 1)
+	saved := <-rc.saveCpChs[0]
+	c.Assert(saved.tableName, Equals, "`db`.`t`")
+	cpd := NewTableCheckpointDiff()
+	saved.merger.MergeInto(cpd)
+	c.Assert(cpd.hasRebase, IsTrue)
+	c.Assert(cpd.allocBase, Equals, int64(42))
+}
+
+type recordingCheckpointsDB struct {
+	NullCheckpointsDB
+	sync.Mutex
+	diffs map[string]*TableCheckpointDiff
+	err   error // fails every update if not nil
+}
+
+func (db *recordingCheckpointsDB) Update(_ context.Context, cpd map[string]*TableCheckpointDiff) error {
+	db.Lock()
+	defer db.Unlock()
+	if db.err != nil {
+		return db.err
+	}
+	for tableName, diff := range cpd {
+		db.diffs[tableName] = diff
+	}
+	return nil
+}
+
+func (s *restoreSuite) TestListenCheckpointUpdates(c *C) {
+	cpdb := &recordingCheckpointsDB{diffs: make(map[string]*TableCheckpointDiff)}
+	rc := &RestoreController{
+		checkpointsDB: cpdb,
+		saveCpChs:     newCheckpointShards(4),
+	}
+	go rc.listenCheckpointUpdates(context.Background(), &rc.checkpointsWg)
+
+	tableNames := make([]string, 16)
+	for i := range tableNames {
+		tableNames[i] = fmt.Sprintf("`db`.`t%d`", i)
+		rc.saveStatusCheckpoint(tableNames[i], -1, nil, CheckpointStatusAllWritten)
+		rc.saveStatusCheckpoint(tableNames[i], -1, nil, CheckpointStatusClosed)
+	}
+	c.Assert(rc.flushCheckpoints(context.Background()), IsNil)
+
+	cpdb.Lock()
+	defer cpdb.Unlock()
+	c.Assert(cpdb.diffs, HasLen, len(tableNames))
+	for _, tableName := range tableNames {
+		// the updates of a table are merged in order.
+		c.Assert(cpdb.diffs[tableName].status, Equals, CheckpointStatusClosed)
+	}
+}
+
+func (s *restoreSuite) TestListenCheckpointUpdatesFailed(c *C) {
+	cpdb := &recordingCheckpointsDB{
+		diffs: make(map[string]*TableCheckpointDiff),
+		err:   errors.New("etcdserver: request timed out"),
+	}
+	rc := &RestoreController{
+		checkpointsDB: cpdb,
+		saveCpChs:     newCheckpointShards(4),
+	}
+	go rc.listenCheckpointUpdates(context.Background(), &rc.checkpointsWg)
+
+	// the failed write is reported by the next barrier, and kept for the end
+	// of the task.
+	rc.saveStatusCheckpoint("`db`.`t`", -1, nil, CheckpointStatusAllWritten)
+	c.Assert(rc.flushCheckpoints(context.Background()), ErrorMatches, "failed to save checkpoints: etcdserver: request timed out")
+	c.Assert(rc.Wait(), ErrorMatches, "failed to save checkpoints: etcdserver: request timed out")
+}
+
+func (s *restoreSuite) TestCheckpointShard(c *C) {
+	for _, tableName := range []string{"`db`.`t`", "`db`.`u`", ""} {
+		shard := checkpointShard(tableName, checkpointShardCount)
+		c.Assert(shard >= 0 && shard < checkpointShardCount, IsTrue)
+		c.Assert(checkpointShard(tableName, checkpointShardCount), Equals, shard)
+		c.Assert(checkpointShard(tableName, 1), Equals, 0)
+	}
+}
+
+func (s *restoreSuite) TestShiftRowIDs(c *C) {
+	cp := &TableCheckpoint{
+		Engines: []*EngineCheckpoint{
+			{Chunks: []*ChunkCheckpoint{
+				{Chunk: mydump.Chunk{PrevRowIDMax: 0, RowIDMax: 10}},
+				{Chunk: mydump.Chunk{PrevRowIDMax: 10, RowIDMax: 25}},
+			}},
+			{Chunks: []*ChunkCheckpoint{
+				{Chunk: mydump.Chunk{PrevRowIDMax: 25, RowIDMax: 40}},
+			}},
+		},
+	}
+	shiftRowIDs(cp, 1000)
+
+	c.Assert(cp.Engines[0].Chunks[0].Chunk, DeepEquals, mydump.Chunk{PrevRowIDMax: 1000, RowIDMax: 1010})
+	c.Assert(cp.Engines[0].Chunks[1].Chunk, DeepEquals, mydump.Chunk{PrevRowIDMax: 1010, RowIDMax: 1025})
+	c.Assert(cp.Engines[1].Chunks[0].Chunk, DeepEquals, mydump.Chunk{PrevRowIDMax: 1025, RowIDMax: 1040})
+}
+
+func (s *restoreSuite) TestOrderTables(c *C) {
+	dbMetas := []*mydump.MDDatabaseMeta{
+		{
+			Name: "b",
+			Tables: []*mydump.MDTableMeta{
+				{DB: "b", Name: "t1", TotalSize: 300},
+				{DB: "b", Name: "t0", TotalSize: 100},
+			},
+		},
+		{
+			Name: "a",
+			Tables: []*mydump.MDTableMeta{
+				{DB: "a", Name: "t2", TotalSize: 200},
+				{DB: "a", Name: "t3", TotalSize: 400},
+			},
+		},
+	}
+	names := func(tables []*mydump.MDTableMeta) []string {
+		res := make([]string, 0, len(tables))
+		for _, t := range tables {
+			res = append(res, t.DB+"."+t.Name)
 		}
+		return res
 	}
+
+	c.Assert(names(orderTables(dbMetas, config.ImportOrderDefault, nil)), DeepEquals, []string{"b.t1", "b.t0", "a.t2", "a.t3"})
+	c.Assert(names(orderTables(dbMetas, config.ImportOrderLargestFirst, nil)), DeepEquals, []string{"a.t3", "b.t1", "a.t2", "b.t0"})
+	c.Assert(names(orderTables(dbMetas, config.ImportOrderSmallestFirst, nil)), DeepEquals, []string{"b.t0", "a.t2", "b.t1", "a.t3"})
+	c.Assert(names(orderTables(dbMetas, config.ImportOrderAlphabetical, nil)), DeepEquals, []string{"a.t2", "a.t3", "b.t0", "b.t1"})
+	c.Assert(
+		names(orderTables(dbMetas, config.ImportOrderLargestFirst, []string{"b.t0", "x.y", "a.t2"})),
+		DeepEquals,
+		[]string{"b.t0", "a.t2", "a.t3", "b.t1"},
+	)
+}
+
+func (s *restoreSuite) TestAnalyzeQuery(c *C) {
+	cfg := &config.PostRestore{}
+	c.Assert(analyzeQuery("`db`.`t`", cfg), Equals, "ANALYZE TABLE `db`.`t`")
+	cfg.AnalyzeSamples = 10000
+	c.Assert(analyzeQuery("`db`.`t`", cfg), Equals, "ANALYZE TABLE `db`.`t` WITH 10000 SAMPLES")
+	cfg.AnalyzeSamples = 0
+	cfg.AnalyzeSampleRate = 0.05
+	c.Assert(analyzeQuery("`db`.`t`", cfg), Equals, "ANALYZE TABLE `db`.`t` WITH 0.05 SAMPLERATE")
+}
+
+func (s *restoreSuite) TestSkipsAnalyze(c *C) {
+	skipTables := []string{"db.huge", "Other.Logs"}
+	c.Assert(skipsAnalyze(skipTables, "db", "huge"), IsTrue)
+	c.Assert(skipsAnalyze(skipTables, "other", "logs"), IsTrue)
+	c.Assert(skipsAnalyze(skipTables, "db", "small"), IsFalse)
+	c.Assert(skipsAnalyze(nil, "db", "huge"), IsFalse)
+}
+
+func (s *restoreSuite) TestInsertStatementPrefix(c *C) {
+	c.Assert(insertStatementPrefix(config.OnDuplicateReplace), Equals, "REPLACE INTO ")
+	c.Assert(insertStatementPrefix(config.OnDuplicateIgnore), Equals, "INSERT IGNORE INTO ")
+	c.Assert(insertStatementPrefix(config.OnDuplicateError), Equals, "INSERT INTO ")
+}
+
+func (s *restoreSuite) TestRowSnippet(c *C) {
+	c.Assert(rowSnippet([]byte("(1, 'a\n')")), Equals, `"(1, 'a\n')"`)
+
+	long := bytes.Repeat([]byte("x"), maxRowSnippetLen+10)
+	c.Assert(rowSnippet(long), Equals, strconv.Quote(string(long[:maxRowSnippetLen]))+"... (266 bytes)")
+}
+
+func (s *restoreSuite) TestEncodeErrorRedacted(c *C) {
+	cr := &chunkRestore{chunk: &ChunkCheckpoint{Key: ChunkCheckpointKey{Path: "db.t.1.sql"}}}
+	t := &TableRestore{tableName: "`db`.`t`"}
+	row := mydump.Row{RowID: 7, Row: []byte("(1, 'secret')")}
+	cause := errors.New("Incorrect value 'secret'")
+
+	err := cr.encodeError(t, row, 100, cause)
+	c.Assert(err, ErrorMatches, "failed to encode row 7 of table `db`.`t` at offset 100 of db.t.1.sql: .*secret.*")
+
+	common.SetRedactInfoLog(true)
+	defer common.SetRedactInfoLog(false)
+	err = cr.encodeError(t, row, 100, cause)
+	c.Assert(err, ErrorMatches, "failed to encode row 7 of table `db`.`t` at offset 100 of db.t.1.sql: \\?: \\?")
+	c.Assert(errors.Cause(err), Equals, cause)
+}
+
+// fullDiskBackend reports a disk used above any watermark.
+type fullDiskBackend struct {
+	kv.Backend
+}
+
+func (fullDiskBackend) DiskUsage(context.Context) (uint64, uint64, error) {
+	return 99, 100, nil
+}
+
+func (s *restoreSuite) TestWaitDiskWatermark(c *C) {
+	cfg := config.NewConfig()
+	rc := &RestoreController{cfg: cfg, importer: kv.NewBackendImporter(fullDiskBackend{})}
+	c.Assert(rc.importer.CanReportDiskUsage(), IsTrue)
+	c.Assert(kv.NewBackendImporter(&recordingBackend{}).CanReportDiskUsage(), IsFalse)
+
+	// nothing releases the space if no engine is running.
+	c.Assert(rc.waitDiskWatermark(context.Background(), common.EngineLogger("`db`.`t`", 0)), IsNil)
+
+	rc.diskQuota.Consume(100)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.Assert(rc.waitDiskWatermark(ctx, common.EngineLogger("`db`.`t`", 0)), Equals, context.DeadlineExceeded)
+
+	cfg.TikvImporter.DiskHighWatermark = 0
+	c.Assert(rc.waitDiskWatermark(ctx, common.EngineLogger("`db`.`t`", 0)), IsNil)
+}
+
+// recordingBackend counts the KV pairs written, and records the statements
+// executed.
+type recordingBackend struct {
+	kv.Backend
+
+	mu         sync.Mutex
+	pairs      int
+	statements []string
+}
+
+func (*recordingBackend) OpenEngine(context.Context, uuid.UUID) error {
+	return nil
+}
+
+func (be *recordingBackend) WriteRows(_ context.Context, _ uuid.UUID, _ uint64, rows kv.Rows) error {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	switch rows := rows.(type) {
+	case kv.KVRows:
+		be.pairs += len(rows)
+	case kv.SQLRows:
+		be.statements = append(be.statements, string(rows))
+	}
+	return nil
+}
+
+func (s *restoreSuite) TestDeliverLoop(c *C) {
+	ctx := context.Background()
+	backend := &recordingBackend{}
+	rc := &RestoreController{
+		cfg:       config.NewConfig(),
+		importer:  kv.NewBackendImporter(backend),
+		saveCpChs: []chan saveCp{make(chan saveCp)},
+	}
+	go func() {
+		for cp := range rc.saveCpChs[0] {
+			if cp.waitCh != nil {
+				close(cp.waitCh)
+			}
+		}
+	}()
+	defer close(rc.saveCpChs[0])
+
+	t := &TableRestore{tableName: "`db`.`t`", alloc: kv.NewIDAllocator(0)}
+	cr := &chunkRestore{chunk: &ChunkCheckpoint{Checksum: verify.MakeKVChecksum(0, 0, 0)}}
+	engine, err := rc.importer.OpenEngine(ctx, t.tableName, 0)
+	c.Assert(err, IsNil)
+
+	kvsCh := make(chan encodedBatch, 3)
+	freeKVsCh := make(chan []kvenc.KvPair, 3)
+	for i := 1; i <= 3; i++ {
+		kvs := []kvenc.KvPair{{Key: []byte("key"), Val: []byte("value")}, {Key: []byte("k"), Val: []byte("v")}}
+		batch := encodedBatch{kvs: kvs, buffers: new(kv.KVBuffers), checksum: verify.MakeKVChecksum(0, 0, 0), offset: int64(i * 100), rowID: int64(i)}
+		batch.checksum.Update(kvs)
+		rc.memoryQuota.Consume(int64(batch.checksum.SumSize()))
+		kvsCh <- batch
+	}
+	close(kvsCh)
+	c.Assert(rc.memoryQuota.Used(), Equals, int64(30))
+
+	result := cr.deliverLoop(ctx, t, 0, engine, rc, kvsCh, freeKVsCh)
+	c.Assert(result.err, IsNil)
+	c.Assert(backend.pairs, Equals, 6)
+	c.Assert(cr.chunk.Chunk.Offset, Equals, int64(300))
+	c.Assert(cr.chunk.Chunk.PrevRowIDMax, Equals, int64(3))
+	c.Assert(cr.chunk.Checksum.SumKVS(), Equals, uint64(6))
+	c.Assert(cr.chunk.Checksum.SumSize(), Equals, uint64(30))
+	// the slices of the delivered batches are given back.
+	c.Assert(freeKVsCh, HasLen, 3)
+	// the delivered batches no longer count towards the memory quota.
+	c.Assert(rc.memoryQuota.Used(), Equals, int64(0))
+
+	// the loop stops when interrupted.
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	result = cr.deliverLoop(ctx, t, 0, engine, rc, make(chan encodedBatch), freeKVsCh)
+	c.Assert(result.err, Equals, context.Canceled)
+}
+
+// flushingBackend records the number of KV pairs written at every flush.
+type flushingBackend struct {
+	recordingBackend
+	flushedPairs []int
+}
+
+func (be *flushingBackend) FlushEngine(context.Context, uuid.UUID) error {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	be.flushedPairs = append(be.flushedPairs, be.pairs)
+	return nil
+}
+
+func (be *flushingBackend) lastFlushedPairs() int {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if len(be.flushedPairs) == 0 {
+		return 0
+	}
+	return be.flushedPairs[len(be.flushedPairs)-1]
+}
+
+func (s *restoreSuite) TestDeliverLoopFlushes(c *C) {
+	testCases := []struct {
+		interval   time.Duration
+		flushedPos []int64
+	}{
+		// one flush after every block, and the last when the chunk is finished.
+		{0, []int64{100, 200, 300, 300}},
+		// only the last flush when the interval has not passed.
+		{time.Hour, []int64{300}},
+	}
+	for _, tc := range testCases {
+		ctx := context.Background()
+		backend := &flushingBackend{}
+		rc := &RestoreController{
+			cfg:       config.NewConfig(),
+			importer:  kv.NewBackendImporter(backend),
+			saveCpChs: []chan saveCp{make(chan saveCp)},
+		}
+		rc.cfg.Cron.FlushCheckpoint.Duration = tc.interval
+		// records the watermark written by every flush, and the KV pairs
+		// flushed into the engine before it.
+		var flushedPos []int64
+		var flushedPairs []int
+		flushedCh := make(chan struct{}, 4)
+		go func() {
+			var pos int64
+			for cp := range rc.saveCpChs[0] {
+				if merger, ok := cp.merger.(*ChunkCheckpointMerger); ok {
+					pos = merger.Pos
+				}
+				if cp.waitCh != nil {
+					flushedPos = append(flushedPos, pos)
+					flushedPairs = append(flushedPairs, backend.lastFlushedPairs())
+					close(cp.waitCh)
+					flushedCh <- struct{}{}
+				}
+			}
+		}()
+
+		t := &TableRestore{tableName: "`db`.`t`", alloc: kv.NewIDAllocator(0)}
+		cr := &chunkRestore{chunk: &ChunkCheckpoint{Checksum: verify.MakeKVChecksum(0, 0, 0)}}
+		engine, err := rc.importer.OpenEngine(ctx, t.tableName, 0)
+		c.Assert(err, IsNil)
+
+		// the next block is sent only after the previous one is delivered,
+		// so each is delivered by itself.
+		kvsCh := make(chan encodedBatch)
+		go func() {
+			for i := 1; i <= 3; i++ {
+				kvs := []kvenc.KvPair{{Key: []byte("key"), Val: []byte("value")}}
+				batch := encodedBatch{kvs: kvs, buffers: new(kv.KVBuffers), checksum: verify.MakeKVChecksum(0, 0, 0), offset: int64(i * 100), rowID: int64(i)}
+				batch.checksum.Update(kvs)
+				rc.memoryQuota.Consume(int64(batch.checksum.SumSize()))
+				kvsCh <- batch
+				if tc.interval == 0 {
+					<-flushedCh
+				}
+			}
+			close(kvsCh)
+		}()
+
+		result := cr.deliverLoop(ctx, t, 0, engine, rc, kvsCh, make(chan []kvenc.KvPair, 3))
+		c.Assert(result.err, IsNil)
+		<-flushedCh
+		close(rc.saveCpChs[0])
+		c.Assert(flushedPos, DeepEquals, tc.flushedPos, Commentf("interval %v", tc.interval))
+		// the engine is flushed up to the watermark before it is saved.
+		for i, pos := range flushedPos {
+			c.Assert(flushedPairs[i], Equals, int(pos/100))
+		}
+	}
+}
+
+func (s *restoreSuite) TestFlushCheckpointCanceled(c *C) {
+	t := &TableRestore{tableName: "`db`.`t`", alloc: kv.NewIDAllocator(0)}
+	cr := &chunkRestore{chunk: &ChunkCheckpoint{Checksum: verify.MakeKVChecksum(0, 0, 0)}}
+	engine, err := kv.NewBackendImporter(&recordingBackend{}).OpenEngine(context.Background(), t.tableName, 0)
+	c.Assert(err, IsNil)
+
+	// nobody receives the updates.
+	rc := &RestoreController{saveCpChs: []chan saveCp{make(chan saveCp)}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(errors.Cause(cr.flushCheckpoint(ctx, t, 0, engine, rc)), Equals, context.Canceled)
+
+	// the updates are received, but never written.
+	rc = &RestoreController{saveCpChs: []chan saveCp{make(chan saveCp, 8)}}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.Assert(errors.Cause(cr.flushCheckpoint(ctx, t, 0, engine, rc)), Equals, context.DeadlineExceeded)
+	c.Assert(rc.saveCpChs[0], HasLen, 3)
+}
+
+func (s *restoreSuite) TestEncodeRowsParallel(c *C) {
+	dir := c.MkDir()
+	files := map[string]string{
+		"db-schema-create.sql": "CREATE DATABASE db;",
+		"db.t-schema.sql":      "CREATE TABLE t (a INT, b VARCHAR(8), KEY (b));",
+		"db.t.sql": "INSERT INTO t VALUES (1, 'a'), (2, 'b'), (3, CONCAT('c', 'c')), (4, 'd'), (5, 'e');\n" +
+			"INSERT INTO t VALUES (6, 'f'), (7, 'g');\n",
+	}
+	for name, content := range files {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), IsNil)
+	}
+
+	cfg := config.NewConfig()
+	cfg.Mydumper.SourceDir = dir
+	cfg.Mydumper.CharacterSet = "auto"
+	loader, err := mydump.NewMyDumpLoader(cfg)
+	c.Assert(err, IsNil)
+	dbMetas := loader.GetDatabases()
+	dbInfos, err := loadDryRunSchemaInfo(context.Background(), dbMetas, cfg)
+	c.Assert(err, IsNil)
+
+	cp := &TableCheckpoint{Status: CheckpointStatusLoaded}
+	tr, err := NewTableRestore("`db`.`t`", dbMetas[0].Tables[0], dbInfos["db"], dbInfos["db"].Tables["t"], cp)
+	c.Assert(err, IsNil)
+	defer tr.Close()
+	c.Assert(tr.populateChunks(cfg, 100<<30, cp), IsNil)
+	chunk := cp.Engines[0].Chunks[0]
+
+	encode := func(concurrency int) ([]kvenc.KvPair, uint64) {
+		// the small blocks make the parser reuse the memory of the rows.
+		cr, err := newChunkRestore(0, chunk, 5, config.ReadEngineSync, worker.NewPool(context.Background(), 1, "io"))
+		c.Assert(err, IsNil)
+		defer cr.close()
+
+		var encoders []*kv.TableKVEncoder
+		for i := 0; i < concurrency; i++ {
+			encoder, err := tr.newKVEncoder(encoderOptions{sqlMode: cfg.TiDB.SQLMode})
+			c.Assert(err, IsNil)
+			defer encoder.Close()
+			encoders = append(encoders, encoder)
+		}
+		var kvs []kvenc.KvPair
+		var rows uint64
+		if concurrency > 1 {
+			kvs, rows, _, err = cr.encodeRowsParallel(tr, encoders, nil, chunk.Chunk.EndOffset)
+		} else {
+			kvs, rows, _, err = cr.encodeRows(tr, encoders[0], nil, chunk.Chunk.EndOffset)
+		}
+		c.Assert(err, IsNil)
+		// the memory of the KV pairs is recycled when the encoders are closed.
+		clones := make([]kvenc.KvPair, 0, len(kvs))
+		for _, pair := range kvs {
+			clones = append(clones, kvenc.KvPair{Key: append([]byte(nil), pair.Key...), Val: append([]byte(nil), pair.Val...)})
+		}
+		return clones, rows
+	}
+
+	expected, rows := encode(1)
+	c.Assert(rows, Equals, uint64(7))
+	c.Assert(expected, HasLen, 14)
+	for _, concurrency := range []int{2, 3, 8} {
+		kvs, rows := encode(concurrency)
+		c.Assert(rows, Equals, uint64(7))
+		c.Assert(kvs, DeepEquals, expected, Commentf("concurrency %d", concurrency))
+	}
+}
+
+func (s *restoreSuite) TestRestoreStatementsResumed(c *C) {
+	dir := c.MkDir()
+	files := map[string]string{
+		"db-schema-create.sql": "CREATE DATABASE db;",
+		"db.t-schema.sql":      "CREATE TABLE t (a INT PRIMARY KEY);",
+		"db.t.sql":             "INSERT INTO t VALUES (1),(2);\nINSERT INTO t VALUES (3),(4);\nINSERT INTO t VALUES (5);\n",
+	}
+	for name, content := range files {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), IsNil)
+	}
+
+	ctx := context.Background()
+	cfg := config.NewConfig()
+	cfg.Mydumper.SourceDir = dir
+	cfg.Mydumper.CharacterSet = "auto"
+	cfg.Mydumper.ReadBlockSize = 20
+	cfg.TikvImporter.OnDuplicate = config.OnDuplicateError
+	loader, err := mydump.NewMyDumpLoader(cfg)
+	c.Assert(err, IsNil)
+	dbMetas := loader.GetDatabases()
+	dbInfos, err := loadDryRunSchemaInfo(ctx, dbMetas, cfg)
+	c.Assert(err, IsNil)
+
+	backend := &recordingBackend{}
+	rc := &RestoreController{
+		cfg:       cfg,
+		importer:  kv.NewBackendImporter(backend),
+		saveCpChs: []chan saveCp{make(chan saveCp)},
+	}
+	flushes := 0
+	go func() {
+		for cp := range rc.saveCpChs[0] {
+			if cp.waitCh != nil {
+				flushes++
+				close(cp.waitCh)
+			}
+		}
+	}()
+	defer close(rc.saveCpChs[0])
+
+	cp := &TableCheckpoint{Status: CheckpointStatusLoaded}
+	tr, err := NewTableRestore("`db`.`t`", dbMetas[0].Tables[0], dbInfos["db"], dbInfos["db"].Tables["t"], cp)
+	c.Assert(err, IsNil)
+	defer tr.Close()
+	c.Assert(tr.populateChunks(cfg, 100<<30, cp), IsNil)
+	tr.resumed = true
+	engine, err := rc.importer.OpenEngine(ctx, tr.tableName, 0)
+	c.Assert(err, IsNil)
+
+	cr, err := newChunkRestore(0, cp.Engines[0].Chunks[0], int64(cfg.Mydumper.ReadBlockSize), config.ReadEngineSync, worker.NewPool(ctx, 1, "io"))
+	c.Assert(err, IsNil)
+	defer cr.close()
+	c.Assert(cr.restoreStatements(ctx, tr, 0, engine, rc), IsNil)
+
+	// only the first statement may have been executed by the previous run, and
+	// the checkpoint is flushed after every statement.
+	c.Assert(len(backend.statements) > 1, IsTrue)
+	c.Assert(backend.statements[0], Matches, " INSERT IGNORE INTO `db`.`t` .*")
+	for _, stmt := range backend.statements[1:] {
+		c.Assert(stmt, Matches, " INSERT INTO `db`.`t` .*")
+	}
+	c.Assert(flushes, Equals, len(backend.statements)+1)
+}
+
+// closeFailingBackend fails to close the engines after writing them.
+type closeFailingBackend struct {
+	recordingBackend
+}
+
+func (*closeFailingBackend) RowsFormat() kv.RowsFormat {
+	return kv.RowsFormatKV
+}
+
+func (*closeFailingBackend) CloseEngine(context.Context, uuid.UUID) error {
+	return errors.New("cannot close")
+}
+
+func (s *restoreSuite) TestRestoreTableMeta(c *C) {
+	ctx := context.Background()
+	alloc := kv.NewIDAllocator(0)
+	c.Assert(alloc.Rebase(0, 100, false), IsNil)
+	tr := &TableRestore{
+		tableName: "`db`.`t`",
+		tableMeta: &mydump.MDTableMeta{DB: "db", Name: "t"},
+		tableInfo: &TidbTableInfo{},
+		alloc:     alloc,
+	}
+	columns := []string{"DB_NAME", "TABLE_NAME", "COLUMN_NAME", "NEXT_GLOBAL_ROW_ID", "ID_TYPE"}
+	expectRebase := func(mock *mockDB, nextID string) {
+		mock.expect("^BEGIN$")
+		mock.expect("^ALTER TABLE `db`.`t` AUTO_INCREMENT=101$")
+		mock.expect("^COMMIT$")
+		mock.expect("^SHOW TABLE `db`.`t` NEXT_ROW_ID$").
+			willReturnRows(columns, []driver.Value{"db", "t", "_tidb_rowid", nextID, "_TIDB_ROWID"})
+	}
+
+	// the rebase is verified.
+	db, mock := newMockDB()
+	expectRebase(mock, "101")
+	c.Assert(tr.restoreTableMeta(ctx, db), IsNil)
+	c.Assert(mock.check(), IsNil)
+
+	// the rebase is retried if the next ID is still low, e.g. the ALTER TABLE
+	// was lost in a concurrent DDL.
+	db, mock = newMockDB()
+	expectRebase(mock, "1")
+	expectRebase(mock, "130")
+	c.Assert(tr.restoreTableMeta(ctx, db), IsNil)
+	c.Assert(mock.check(), IsNil)
+
+	// it fails after the attempts are exhausted.
+	db, mock = newMockDB()
+	for i := 0; i < maxRebaseAttempts; i++ {
+		expectRebase(mock, "1")
+	}
+	err := tr.restoreTableMeta(ctx, db)
+	c.Assert(err, ErrorMatches, "the next auto ID of `db`.`t` is 1 after rebasing to 101 for 3 times")
+	c.Assert(mock.check(), IsNil)
+
+	// the verification is skipped if the next ID is unknown.
+	db, mock = newMockDB()
+	mock.expect("^BEGIN$")
+	mock.expect("^ALTER TABLE `db`.`t` AUTO_INCREMENT=101$")
+	mock.expect("^COMMIT$")
+	mock.expect("^SHOW TABLE `db`.`t` NEXT_ROW_ID$").willReturnRows(columns)
+	c.Assert(tr.restoreTableMeta(ctx, db), IsNil)
+	c.Assert(mock.check(), IsNil)
+
+	// the AUTO_RANDOM base is rebased and verified instead.
+	tr.tableInfo.AutoRandomBits = 5
+	db, mock = newMockDB()
+	mock.expect("^BEGIN$")
+	mock.expect("^ALTER TABLE `db`.`t` AUTO_RANDOM_BASE=101$")
+	mock.expect("^COMMIT$")
+	mock.expect("^SHOW TABLE `db`.`t` NEXT_ROW_ID$").willReturnRows(columns,
+		[]driver.Value{"db", "t", "_tidb_rowid", "1", "_TIDB_ROWID"},
+		[]driver.Value{"db", "t", "id", "101", "AUTO_RANDOM"},
+	)
+	c.Assert(tr.restoreTableMeta(ctx, db), IsNil)
+	c.Assert(mock.check(), IsNil)
+}
+
+func (s *restoreSuite) TestFailedEngineReleasesDiskQuota(c *C) {
+	dir := c.MkDir()
+	files := map[string]string{
+		"db-schema-create.sql": "CREATE DATABASE db;",
+		"db.t-schema.sql":      "CREATE TABLE t (a INT PRIMARY KEY);",
+		"db.t.sql":             "INSERT INTO t VALUES (1),(2),(3);\n",
+	}
+	for name, content := range files {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), IsNil)
+	}
+
+	ctx := context.Background()
+	cfg := config.NewConfig()
+	cfg.Mydumper.SourceDir = dir
+	cfg.Mydumper.CharacterSet = "auto"
+	cfg.Mydumper.ReadBlockSize = 1024
+	loader, err := mydump.NewMyDumpLoader(cfg)
+	c.Assert(err, IsNil)
+	dbMetas := loader.GetDatabases()
+	dbInfos, err := loadDryRunSchemaInfo(ctx, dbMetas, cfg)
+	c.Assert(err, IsNil)
+
+	backend := &closeFailingBackend{}
+	rc := &RestoreController{
+		cfg:            cfg,
+		importer:       kv.NewBackendImporter(backend),
+		saveCpChs:      []chan saveCp{make(chan saveCp)},
+		regionWorkers:  worker.NewPool(ctx, 1, "region"),
+		ioWorkers:      worker.NewPool(ctx, 1, "io"),
+		errorSummaries: errorSummaries{summary: make(map[string]errorSummary)},
+	}
+	go func() {
+		for cp := range rc.saveCpChs[0] {
+			if cp.waitCh != nil {
+				close(cp.waitCh)
+			}
+		}
+	}()
+	defer close(rc.saveCpChs[0])
+
+	cp := &TableCheckpoint{Status: CheckpointStatusLoaded}
+	tr, err := NewTableRestore("`db`.`t`", dbMetas[0].Tables[0], dbInfos["db"], dbInfos["db"].Tables["t"], cp)
+	c.Assert(err, IsNil)
+	defer tr.Close()
+	c.Assert(tr.populateChunks(cfg, 100<<30, cp), IsNil)
+
+	// the engine is written, but fails before being imported.
+	err = tr.restoreAndImportEngine(ctx, rc, cp, 0, cp.Engines[0], enginePriority{}, false)
+	c.Assert(err, ErrorMatches, ".*cannot close")
+	c.Assert(cp.Engines[0].kvSize(), Greater, int64(0))
+	c.Assert(rc.diskQuota.Used(), Equals, int64(0))
+}
+
+func (s *restoreSuite) TestWithTimeout(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := &RestoreController{cancelTask: cancel}
+
+	// finishing in time.
+	err := rc.withTimeout("`db`.`t`", "checksum", time.Minute, func() error { return nil })
+	c.Assert(err, IsNil)
+	c.Assert(rc.timeoutErr.Get(), IsNil)
+
+	// the whole task is stopped on timeout.
+	err = rc.withTimeout("`db`.`t`", "checksum", 10*time.Millisecond, func() error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	c.Assert(common.IsContextCanceledError(err), IsTrue)
+	c.Assert(rc.timeoutErr.Get(), ErrorMatches, "checksum exceeds 10ms: timed out")
+	c.Assert(errors.Cause(rc.timeoutErr.Get()), Equals, common.ErrTimeout)
+}
+
+func (s *restoreSuite) TestWriteTaskResult(c *C) {
+	rc := &RestoreController{
+		dbMetas: []*mydump.MDDatabaseMeta{{
+			Name: "db",
+			Tables: []*mydump.MDTableMeta{
+				{DB: "db", Name: "t1", TotalSize: 100},
+				{DB: "db", Name: "t2", TotalSize: 200},
+			},
+		}},
+		checkpointsDB:  NewNullCheckpointsDB(),
+		errorSummaries: errorSummaries{summary: make(map[string]errorSummary)},
+	}
+	rc.tableRuns.Store("`db`.`t1`", tableRun{
+		rows:         7,
+		elapsed:      2 * time.Second,
+		phaseSeconds: map[string]float64{"read": 1, "encode": 3, "deliver": 1, "close": 0, "import": 1},
+		bound:        BoundEncode,
+	})
+	rc.errorSummaries.record("`db`.`t2`", errors.New("oops"), CheckpointStatusImported)
+
+	path := filepath.Join(c.MkDir(), "result.json")
+	start := time.Now().Add(-time.Minute)
+	err := rc.writeTaskResult(path, start, errors.Annotate(common.ErrTimeout, "task exceeds 1m"))
+	c.Assert(err, IsNil)
+
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	var result TaskResult
+	c.Assert(json.Unmarshal(content, &result), IsNil)
+	c.Assert(result.Status, Equals, TaskResultTimeout)
+	c.Assert(result.Error, Equals, "task exceeds 1m: timed out")
+	c.Assert(result.ErrorCategory, Equals, "")
+	c.Assert(result.Elapsed >= 60, IsTrue)
+	c.Assert(result.Tables, DeepEquals, []*TableResult{
+		{
+			Name: "`db`.`t1`", Status: "pending", Rows: 7, SourceBytes: 100, Elapsed: 2,
+			PhaseSeconds: map[string]float64{"read": 1, "encode": 3, "deliver": 1, "close": 0, "import": 1},
+			Bound:        BoundEncode,
+		},
+		{Name: "`db`.`t2`", Status: "pending", SourceBytes: 200},
+	})
+	c.Assert(result.Errors, DeepEquals, []*ErrorStatus{
+		{TableName: "`db`.`t2`", Status: "imported", Error: "oops"},
+	})
+}
+
+func (s *restoreSuite) TestTaskResultWithFileCheckpoints(c *C) {
+	ctx := context.Background()
+	cfg := config.NewConfig()
+	cfg.Checkpoint.Enable = true
+	rc := &RestoreController{
+		cfg: cfg,
+		dbMetas: []*mydump.MDDatabaseMeta{{
+			Name:   "db",
+			Tables: []*mydump.MDTableMeta{{DB: "db", Name: "t", TotalSize: 100}},
+		}},
+		checkpointsDB:  NewFileCheckpointsDB(filepath.Join(c.MkDir(), "cp.pb")),
+		errorSummaries: errorSummaries{summary: make(map[string]errorSummary)},
+	}
+	defer rc.checkpointsDB.Close()
+
+	// the task failed before the checkpoints are initialized.
+	result := rc.taskResult(ctx, time.Now(), errors.New("oops"))
+	c.Assert(result.Tables, DeepEquals, []*TableResult{{Name: "`db`.`t`", SourceBytes: 100}})
+
+	err := rc.checkpointsDB.Initialize(ctx, map[string]*TidbDBInfo{
+		"db": {Name: "db", Tables: map[string]*TidbTableInfo{"t": {Name: "t"}}},
+	})
+	c.Assert(err, IsNil)
+	err = rc.checkpointsDB.InsertEngineCheckpoints(ctx, "`db`.`t`", []*EngineCheckpoint{{
+		Status: CheckpointStatusImported,
+		Chunks: []*ChunkCheckpoint{{Checksum: verify.MakeKVChecksum(30, 3, 123)}},
+	}})
+	c.Assert(err, IsNil)
+	cpd := NewTableCheckpointDiff()
+	(&StatusCheckpointMerger{EngineID: -1, Status: CheckpointStatusAnalyzed}).MergeInto(cpd)
+	c.Assert(rc.checkpointsDB.Update(context.Background(), map[string]*TableCheckpointDiff{"`db`.`t`": cpd}), IsNil)
+
+	// the checkpoints are removed after a successful run.
+	c.Assert(rc.cleanCheckpoints(ctx), IsNil)
+	_, err = rc.checkpointsDB.Get(ctx, "`db`.`t`")
+	c.Assert(isCheckpointNotFound(err), IsTrue)
+
+	result = rc.taskResult(ctx, time.Now(), nil)
+	c.Assert(result.Tables, DeepEquals, []*TableResult{{
+		Name: "`db`.`t`", Status: "analyzed", SourceBytes: 100, KVPairs: 3, KVBytes: 30, Checksum: 123,
+	}})
+}
+
+func (s *restoreSuite) TestCheckResumeRequirements(c *C) {
+	ctx := context.Background()
+	cfg := config.NewConfig()
+	cfg.App.CheckRequirements = true
+	cfg.Checkpoint.Enable = true
+	cfg.PreCheck.Checkpoints = config.CheckLevelStrict
+	cfg.PreCheck.ClusterEmpty = config.CheckLevelOff
+	rc := &RestoreController{
+		cfg: cfg,
+		dbMetas: []*mydump.MDDatabaseMeta{{
+			Name:   "db",
+			Tables: []*mydump.MDTableMeta{{DB: "db", Name: "t"}},
+		}},
+		checkpointsDB: NewFileCheckpointsDB(filepath.Join(c.MkDir(), "cp.pb")),
+	}
+	defer rc.checkpointsDB.Close()
+
+	// a table missing from the checkpoints is new.
+	c.Assert(rc.checkResumeRequirements(ctx), IsNil)
+	c.Assert(rc.preCheckReport(), DeepEquals, []*PreCheckResult{
+		{Name: "checkpoints", Level: config.CheckLevelStrict, Passed: true},
+	})
+
+	err := rc.checkpointsDB.Initialize(ctx, map[string]*TidbDBInfo{
+		"db": {Name: "db", Tables: map[string]*TidbTableInfo{"t": {Name: "t"}}},
+	})
+	c.Assert(err, IsNil)
+	cpd := NewTableCheckpointDiff()
+	(&StatusCheckpointMerger{EngineID: -1, Status: CheckpointStatusAllWritten / 10}).MergeInto(cpd)
+	c.Assert(rc.checkpointsDB.Update(context.Background(), map[string]*TableCheckpointDiff{"`db`.`t`": cpd}), IsNil)
+
+	err = rc.checkResumeRequirements(ctx)
+	c.Assert(err, ErrorMatches, "pre-check failed: checkpoints .*")
+	report := rc.preCheckReport()
+	c.Assert(report, HasLen, 2)
+	c.Assert(report[1].Passed, IsFalse)
+	c.Assert(report[1].Message, Matches, "checkpoint of `db`.`t` has invalid status 6.*")
+}
+
+func (s *restoreSuite) TestStatusWithoutCheckpoints(c *C) {
+	ctx := context.Background()
+	rc := &RestoreController{
+		cfg: config.NewConfig(),
+		dbMetas: []*mydump.MDDatabaseMeta{{
+			Name:   "db",
+			Tables: []*mydump.MDTableMeta{{DB: "db", Name: "t"}},
+		}},
+		checkpointsDB:  NewFileCheckpointsDB(filepath.Join(c.MkDir(), "cp.pb")),
+		errorSummaries: errorSummaries{summary: make(map[string]errorSummary)},
+	}
+	defer rc.checkpointsDB.Close()
+	rc.tikvMode.Store("unknown")
+
+	rc.setPhase(metric.TaskPhaseCheckRequirements)
+	c.Assert(rc.Status(ctx).Tables, DeepEquals, []*TableStatus{{Name: "`db`.`t`", Status: TableStatusNotStarted}})
+
+	rc.setPhase(metric.TaskPhaseFinished)
+	c.Assert(rc.Status(ctx).Tables, DeepEquals, []*TableStatus{{Name: "`db`.`t`", Status: TableStatusFinished}})
+
+	rc.finalCheckpoints.Store("`db`.`t`", &TableCheckpoint{Status: CheckpointStatusAnalyzed})
+	c.Assert(rc.Status(ctx).Tables, DeepEquals, []*TableStatus{{Name: "`db`.`t`", Status: "analyzed"}})
+}
+
+func (s *restoreSuite) TestTaskResultStatus(c *C) {
+	c.Assert(taskResultStatus(nil), Equals, TaskResultSuccess)
+	c.Assert(taskResultStatus(errors.Trace(common.ErrTimeout)), Equals, TaskResultTimeout)
+	c.Assert(taskResultStatus(context.Canceled), Equals, TaskResultInterrupted)
+	c.Assert(taskResultStatus(errors.New("oops")), Equals, TaskResultFailed)
+}
+
+func (s *restoreSuite) TestErrorSummariesCategory(c *C) {
+	es := &errorSummaries{summary: make(map[string]errorSummary)}
+	c.Assert(es.category(), Equals, common.ErrorCategoryUnknown)
+
+	es.record("`db`.`t1`", common.WithCategory(errors.New("bad row"), common.ErrorCategorySourceData), CheckpointStatusAllWritten)
+	c.Assert(es.category(), Equals, common.ErrorCategorySourceData)
+	es.record("`db`.`t2`", errors.Trace(common.WithCategory(errors.New("bad file"), common.ErrorCategorySourceData)), CheckpointStatusAllWritten)
+	c.Assert(es.category(), Equals, common.ErrorCategorySourceData)
+
+	// the uncategorized errors are blamed on the cluster.
+	es.record("`db`.`t3`", errors.New("importer is down"), CheckpointStatusClosed)
+	c.Assert(es.category(), Equals, common.ErrorCategoryUnknown)
+	es = &errorSummaries{summary: make(map[string]errorSummary)}
+	es.record("`db`.`t3`", errors.New("importer is down"), CheckpointStatusClosed)
+	c.Assert(es.category(), Equals, common.ErrorCategoryCluster)
+}
+
+func (s *restoreSuite) TestFinishSpan(c *C) {
+	tracer := mocktracer.New()
+
+	finishSpan(tracer.StartSpan("table"), nil)
+	finishSpan(tracer.StartSpan("chunk"), errors.New("oops"))
+
+	spans := tracer.FinishedSpans()
+	c.Assert(spans, HasLen, 2)
+	c.Assert(spans[0].OperationName, Equals, "table")
+	c.Assert(spans[0].Tag("error"), IsNil)
+	c.Assert(spans[1].OperationName, Equals, "chunk")
+	c.Assert(spans[1].Tag("error"), Equals, true)
+	c.Assert(spans[1].Logs(), HasLen, 1)
+}
+
+func (s *restoreSuite) TestProgress(c *C) {
+	rc := &RestoreController{
+		dbMetas: []*mydump.MDDatabaseMeta{{
+			Name: "db",
+			Tables: []*mydump.MDTableMeta{
+				{DB: "db", Name: "t1", TotalSize: 1 << 40},
+				{DB: "db", Name: "t2", TotalSize: 1 << 40},
+			},
+		}},
+		startTime: time.Now(),
+	}
+	rc.setPhase(metric.TaskPhaseRestoreTables)
+	rc.progressBase.Store(progressBase{
+		previous: &TaskProgress{Elapsed: time.Hour, BytesRead: 1 << 40},
+		start:    time.Now(),
+	})
+
+	progress := rc.Progress()
+	c.Assert(progress.Phase, Equals, metric.TaskPhaseRestoreTables)
+	c.Assert(progress.Elapsed >= 3600, IsTrue)
+	c.Assert(progress.TotalBytes, Equals, int64(2<<40))
+	c.Assert(progress.BytesRead >= 1<<40, IsTrue)
+	c.Assert(progress.RemainingBytes, Equals, progress.TotalBytes-progress.BytesRead)
+}
+
+func (s *restoreSuite) TestEstimateRemaining(c *C) {
+	phase := metric.TaskPhaseRestoreTables
+	c.Assert(estimateRemaining(&Progress{Phase: phase, Elapsed: 100}), Equals, -1.0)
+	c.Assert(estimateRemaining(&Progress{Phase: phase, Elapsed: 100, EstimatedChunks: 8}), Equals, -1.0)
+	c.Assert(estimateRemaining(&Progress{Phase: phase, Elapsed: 100, EstimatedChunks: 8, FinishedChunks: 2}), Equals, 300.0)
+	c.Assert(estimateRemaining(&Progress{Phase: phase, Elapsed: 100, EstimatedChunks: 8, FinishedChunks: 8}), Equals, 0.0)
+	c.Assert(estimateRemaining(&Progress{Phase: metric.TaskPhaseFinished, Elapsed: 100}), Equals, 0.0)
+}
+
+func (s *restoreSuite) TestNotifyFinished(c *C) {
+	var notifications []Notification
+	var slackTexts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(req.Method, Equals, http.MethodPost)
+		c.Assert(req.Header.Get("Content-Type"), Equals, "application/json")
+		switch req.URL.Path {
+		case "/webhook":
+			var n Notification
+			c.Assert(json.NewDecoder(req.Body).Decode(&n), IsNil)
+			notifications = append(notifications, n)
+		case "/slack":
+			var message struct{ Text string }
+			c.Assert(json.NewDecoder(req.Body).Decode(&message), IsNil)
+			slackTexts = append(slackTexts, message.Text)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cfg := config.NewConfig()
+	cfg.Checkpoint.Schema = "tidb_lightning_checkpoint"
+	cfg.Notification.WebhookURL = server.URL + "/webhook"
+	cfg.Notification.SlackWebhookURL = server.URL + "/slack"
+	rc := &RestoreController{cfg: cfg, startTime: time.Now()}
+	rc.setPhase(metric.TaskPhaseFinished)
+	checkpointTime := time.Now().Add(-time.Minute)
+	rc.lastCheckpointTime.Store(checkpointTime)
+
+	rc.notifyFinished(errors.New("1 tables failed to be imported"))
+	c.Assert(notifications, HasLen, 1)
+	n := notifications[0]
+	c.Assert(n.Event, Equals, NotificationFinished)
+	c.Assert(n.Task, Equals, "tidb_lightning_checkpoint")
+	c.Assert(n.Phase, Equals, metric.TaskPhaseFinished)
+	c.Assert(n.Status, Equals, TaskResultFailed)
+	c.Assert(n.Error, Equals, "1 tables failed to be imported")
+	c.Assert(n.Progress, NotNil)
+	c.Assert(n.LastCheckpointTime, NotNil)
+	c.Assert(n.LastCheckpointTime.Equal(checkpointTime), IsTrue)
+	c.Assert(slackTexts, DeepEquals, []string{`tidb-lightning task "tidb_lightning_checkpoint" failed after 0s: 1 tables failed to be imported`})
+
+	// an unavailable webhook does not affect the task.
+	cfg.Notification.WebhookURL = server.URL + "/not-found"
+	cfg.Notification.SlackWebhookURL = ""
+	err := rc.postWebhook(context.Background(), cfg.Notification.WebhookURL, rc.notification(NotificationHeartbeat))
+	c.Assert(err, ErrorMatches, "the webhook responds 404 Not Found")
+	rc.notifyFinished(nil)
+	c.Assert(notifications, HasLen, 1)
+}
+
+func (s *restoreSuite) TestHeartbeats(c *C) {
+	heartbeats := make(chan Notification, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var n Notification
+		c.Assert(json.NewDecoder(req.Body).Decode(&n), IsNil)
+		heartbeats <- n
+	}))
+	defer server.Close()
+
+	cfg := config.NewConfig()
+	cfg.Coordination.Enable = true
+	cfg.Coordination.Task = "nightly"
+	cfg.Notification.WebhookURL = server.URL
+	cfg.Notification.HeartbeatInterval.Duration = 10 * time.Millisecond
+	rc := &RestoreController{cfg: cfg, startTime: time.Now()}
+	rc.setPhase(metric.TaskPhaseRestoreTables)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		rc.runHeartbeats(ctx)
+		close(done)
+	}()
+	for i := 0; i < 2; i++ {
+		n := <-heartbeats
+		c.Assert(n.Event, Equals, NotificationHeartbeat)
+		c.Assert(n.Task, Equals, "nightly")
+		c.Assert(n.Phase, Equals, metric.TaskPhaseRestoreTables)
+		c.Assert(n.LastCheckpointTime, IsNil)
+		c.Assert(n.Status, Equals, "")
+	}
+	cancel()
+	<-done
+}
+
+func (s *restoreSuite) TestDetectStalls(c *C) {
+	cfg := config.NewConfig()
+	cfg.App.StallTimeout.Duration = time.Minute
+	rc := &RestoreController{cfg: cfg}
+	stalls := metric.ReadCounter(metric.ChunkStallCounter)
+
+	key := &ChunkCheckpointKey{Path: "db.t.1.sql"}
+	a := rc.trackChunk("`db`.`t`", 0, key)
+	b := rc.trackChunk("`db`.`t`", 1, key)
+	start := time.Now()
+	a.delivered(1<<20, start.Add(30*time.Second))
+	c.Assert(a.speed(start.Add(30*time.Second)) > 0, IsTrue)
+
+	c.Assert(rc.detectStalls(start.Add(50*time.Second)), HasLen, 0)
+	c.Assert(rc.detectStalls(start.Add(80*time.Second)), DeepEquals, []*chunkActivity{b})
+	// reported once until delivering again.
+	c.Assert(rc.detectStalls(start.Add(85*time.Second)), HasLen, 0)
+	c.Assert(rc.detectStalls(start.Add(100*time.Second)), DeepEquals, []*chunkActivity{a})
+	c.Assert(metric.ReadCounter(metric.ChunkStallCounter)-stalls, Equals, 2.0)
+
+	b.delivered(1, start.Add(110*time.Second))
+	c.Assert(rc.detectStalls(start.Add(120*time.Second)), HasLen, 0)
+	c.Assert(rc.detectStalls(start.Add(200*time.Second)), DeepEquals, []*chunkActivity{b})
+
+	rc.untrackChunk(a)
+	rc.untrackChunk(b)
+	c.Assert(rc.detectStalls(start.Add(time.Hour)), HasLen, 0)
+
+	// the chunks without tracking are ignored.
+	var untracked *chunkActivity
+	untracked.delivered(1, start)
+}
+
+func (s *restoreSuite) TestStallCheckInterval(c *C) {
+	c.Assert(stallCheckInterval(time.Minute), Equals, 15*time.Second)
+	c.Assert(stallCheckInterval(time.Hour), Equals, maxStallCheckInterval)
+}
+
+func (s *restoreSuite) TestDumpGoroutines(c *C) {
+	dir := c.MkDir()
+	path, err := dumpGoroutines(dir, time.Now())
+	c.Assert(err, IsNil)
+	c.Assert(filepath.Dir(path), Equals, dir)
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Matches, "(?s)goroutine .*TestDumpGoroutines.*")
+
+	_, err = dumpGoroutines(filepath.Join(dir, "not-exist"), time.Now())
+	c.Assert(err, NotNil)
+}
+
+func (s *restoreSuite) TestPhaseBreakdown(c *C) {
+	var phases phaseBreakdown
+	c.Assert(phases.seconds(), IsNil)
+	c.Assert(phases.bound(), Equals, "")
+	c.Assert(phases.String(), Equals, "nothing recorded")
+
+	phases.add(tablePhaseRead, time.Second)
+	phases.add(tablePhaseEncode, 2*time.Second)
+	phases.add(tablePhaseDeliver, 3*time.Second)
+	phases.add(tablePhaseClose, time.Second)
+	phases.add(tablePhaseImport, 3*time.Second)
+	c.Assert(phases.seconds(), DeepEquals, map[string]float64{"read": 1, "encode": 2, "deliver": 3, "close": 1, "import": 3})
+	c.Assert(phases.bound(), Equals, BoundDelivery)
+	c.Assert(phases.String(), Equals, "read 1s (10.0%), encode 2s (20.0%), deliver 3s (30.0%), close 1s (10.0%), import 3s (30.0%), delivery-bound")
+
+	phases.add(tablePhaseImport, 2*time.Second)
+	c.Assert(phases.bound(), Equals, BoundIngest)
+	phases.add(tablePhaseEncode, 3*time.Second)
+	c.Assert(phases.bound(), Equals, BoundEncode)
+
+	before := metric.ReadCounter(metric.TablePhaseSecondsCounter.WithLabelValues(metric.TablePhaseImport, ""))
+	phases.exportMetrics("`db`.`t`")
+	after := metric.ReadCounter(metric.TablePhaseSecondsCounter.WithLabelValues(metric.TablePhaseImport, ""))
+	c.Assert(after-before, Equals, 5.0)
+}
+
+func (s *restoreSuite) TestEngineKVSize(c *C) {
+	cp := &EngineCheckpoint{Chunks: []*ChunkCheckpoint{
+		{Checksum: verify.MakeKVChecksum(100, 1, 0)},
+		{Checksum: verify.MakeKVChecksum(50, 1, 0)},
+	}}
+	c.Assert(engineKVSize(cp), Equals, uint64(150))
+}
+
+func (s *restoreSuite) TestTiKVModeRecord(c *C) {
+	ctx := context.Background()
+	cfg := config.NewConfig()
+	cfg.TiDB.PdAddr = "127.0.0.1:2379"
+	cpPath := filepath.Join(c.MkDir(), "cp.pb")
+	cpdb := NewFileCheckpointsDB(cpPath)
+
+	record, err := LoadTiKVModeRecord(ctx, cpdb)
+	c.Assert(err, IsNil)
+	c.Assert(record, IsNil)
+
+	c.Assert(SaveTiKVModeRecord(ctx, cpdb, cfg, sstpb.SwitchMode_Import), IsNil)
+	record, err = LoadTiKVModeRecord(ctx, cpdb)
+	c.Assert(err, IsNil)
+	c.Assert(record.Mode, Equals, config.ImportMode)
+	c.Assert(record.PdAddr, Equals, "127.0.0.1:2379")
+	c.Assert(time.Since(record.SwitchedAt) < time.Minute, IsTrue)
+
+	// the switches outside of a restore are recorded in the same checkpoints.
+	c.Assert(cpdb.Close(), IsNil)
+	cfg.Checkpoint.Enable = true
+	cfg.Checkpoint.Driver = "file"
+	cfg.Checkpoint.DSN = cpPath
+	c.Assert(RecordTiKVMode(ctx, cfg, sstpb.SwitchMode_Normal), IsNil)
+	cpdb = NewFileCheckpointsDB(cpPath)
+	record, err = LoadTiKVModeRecord(ctx, cpdb)
+	c.Assert(err, IsNil)
+	c.Assert(record.Mode, Equals, config.NormalMode)
+
+	c.Assert(cpdb.UpdateTaskMeta(ctx, tikvModeTaskMeta, []byte("{")), IsNil)
+	_, err = LoadTiKVModeRecord(ctx, cpdb)
+	c.Assert(err, ErrorMatches, "invalid task meta tikv-mode.*")
+}
+
+func (s *restoreSuite) TestSelectSubset(c *C) {
+	dbMetas := []*mydump.MDDatabaseMeta{
+		{
+			Name: "b",
+			Tables: []*mydump.MDTableMeta{
+				{DB: "b", Name: "t1"},
+				{DB: "b", Name: "t0"},
+			},
+		},
+		{
+			Name: "a",
+			Tables: []*mydump.MDTableMeta{
+				{DB: "a", Name: "t2"},
+			},
+		},
+	}
+
+	subset := new(config.Subset)
+	selected, err := selectSubset(dbMetas, subset)
+	c.Assert(err, IsNil)
+	c.Assert(selected, DeepEquals, dbMetas)
+	c.Assert(subset.HasEngine(3), IsTrue)
+
+	c.Assert(subset.Tables.Set("a.t2"), IsNil)
+	c.Assert(subset.Tables.Set("b.t0"), IsNil)
+	c.Assert(subset.Tables.Set("b"), ErrorMatches, ".*not in the form db.tbl")
+	c.Assert(subset.HasTable("`b`.`t0`"), IsTrue)
+	c.Assert(subset.HasTable("`b`.`t1`"), IsFalse)
+	selected, err = selectSubset(dbMetas, subset)
+	c.Assert(err, IsNil)
+	c.Assert(selected, HasLen, 2)
+	c.Assert(selected[0].Tables, DeepEquals, []*mydump.MDTableMeta{{DB: "b", Name: "t0"}})
+	c.Assert(selected[1].Tables, DeepEquals, []*mydump.MDTableMeta{{DB: "a", Name: "t2"}})
+	// the data source itself is unchanged.
+	c.Assert(dbMetas[0].Tables, HasLen, 2)
+
+	c.Assert(subset.Engines.Set("3"), IsNil)
+	c.Assert(subset.Engines.Set("-1"), ErrorMatches, ".*not a valid engine ID")
+	c.Assert(subset.HasEngine(3), IsTrue)
+	c.Assert(subset.HasEngine(0), IsFalse)
+
+	c.Assert(subset.Tables.Set("c.t4"), IsNil)
+	_, err = selectSubset(dbMetas, subset)
+	c.Assert(err, ErrorMatches, "table `c`.`t4` given by -table is not found in the data source")
+}
+
+func (s *restoreSuite) TestFormatProgress(c *C) {
+	c.Assert(progressBar(0, 0), Equals, "[------------------------------]   0.0%")
+	c.Assert(progressBar(1, 4), Equals, "[#######-----------------------]  25.0%")
+	c.Assert(progressBar(5, 4), Equals, "[##############################] 100.0%")
+
+	progress := &Progress{
+		Phase:              metric.TaskPhaseRestoreTables,
+		EstimatedChunks:    40,
+		FinishedChunks:     10,
+		TotalTables:        4,
+		CompletedTables:    1,
+		Speed:              2 * 1048576,
+		EstimatedRemaining: 90,
+	}
+	tables := []tableProgress{{name: "`db`.`t1`", finished: 3, total: 6}}
+	c.Assert(formatProgress(progress, tables), DeepEquals, []string{
+		"[#######-----------------------]  25.0% restore-tables 10/40 chunks, 1/4 tables, 2.00 MiB/s, ETA 1m30s",
+		"[###############---------------]  50.0% `db`.`t1` 3/6 chunks",
+	})
+
+	for i := 2; i <= maxDisplayedTables+2; i++ {
+		tables = append(tables, tableProgress{name: fmt.Sprintf("`db`.`t%d`", i)})
+	}
+	lines := formatProgress(progress, tables)
+	c.Assert(lines, HasLen, maxDisplayedTables+2)
+	c.Assert(lines[len(lines)-1], Equals, "... and 2 more tables")
+}
+
+func (s *restoreSuite) TestProgressDisplayRender(c *C) {
+	var buf bytes.Buffer
+	display := &progressDisplay{out: &buf}
+	progress := &Progress{EstimatedRemaining: -1}
+
+	display.render(progress, []tableProgress{{name: "`db`.`t1`"}, {name: "`db`.`t2`"}})
+	c.Assert(display.lines, Equals, 3)
+	c.Assert(strings.HasPrefix(buf.String(), "\x1b[2K["), IsTrue)
+	c.Assert(strings.Count(buf.String(), "\n"), Equals, 3)
+
+	// redrawn over the previous lines, clearing the one of the finished table.
+	buf.Reset()
+	display.render(progress, []tableProgress{{name: "`db`.`t2`"}})
+	c.Assert(display.lines, Equals, 2)
+	c.Assert(strings.HasPrefix(buf.String(), "\x1b[3A"), IsTrue)
+	c.Assert(strings.HasSuffix(buf.String(), "\x1b[2K\n\x1b[1A"), IsTrue)
+}
+
+func (s *restoreSuite) TestCheckNewCollation(c *C) {
+	column := &model.ColumnInfo{Name: model.NewCIStr("a"), FieldType: *types.NewFieldType(mysql.TypeVarchar)}
+	column.Collate = "utf8mb4_bin"
+	core := &model.TableInfo{
+		Name:    model.NewCIStr("t"),
+		Columns: []*model.ColumnInfo{column},
+		Indices: []*model.IndexInfo{{Name: model.NewCIStr("ia"), Columns: []*model.IndexColumn{{Name: column.Name}}}},
+	}
+	dbInfos := map[string]*TidbDBInfo{
+		"db": {Name: "db", Tables: map[string]*TidbTableInfo{"t": {Name: "t", core: core}}},
+	}
+	c.Assert(checkNewCollation(dbInfos), IsNil)
+
+	column.Collate = "utf8mb4_general_ci"
+	err := checkNewCollation(dbInfos)
+	c.Assert(err, ErrorMatches, "cannot import with new collation enabled, .* unless `tikv-importer.backend` is \"tidb\": "+
+		"index ia of table t uses column a with collation utf8mb4_general_ci.*")
+}
+
+func (s *restoreSuite) TestTraceBlock(c *C) {
+	tracer := mocktracer.New()
+	chunkSpan := tracer.StartSpan("chunk")
+	start := time.Now()
+	traceBlock(chunkSpan, start, time.Second, 2*time.Second, 100, 250, 7)
+
+	spans := tracer.FinishedSpans()
+	c.Assert(spans, HasLen, 2)
+	chunkContext := chunkSpan.Context().(mocktracer.MockSpanContext)
+	read, encode := spans[0], spans[1]
+	c.Assert(read.OperationName, Equals, "read")
+	c.Assert(read.ParentID, Equals, chunkContext.SpanID)
+	c.Assert(read.StartTime, Equals, start)
+	c.Assert(read.FinishTime, Equals, start.Add(time.Second))
+	c.Assert(read.Tag("offset"), Equals, int64(100))
+	c.Assert(read.Tag("bytes"), Equals, int64(150))
+	c.Assert(encode.OperationName, Equals, "encode")
+	c.Assert(encode.ParentID, Equals, chunkContext.SpanID)
+	c.Assert(encode.StartTime, Equals, start.Add(time.Second))
+	c.Assert(encode.FinishTime, Equals, start.Add(3*time.Second))
+	c.Assert(encode.Tag("rows"), Equals, uint64(7))
+}
+
+// kvRowsBackend is a backend taking the encoded KV pairs.
+type kvRowsBackend struct {
+	kv.Backend
+}
+
+func (kvRowsBackend) RowsFormat() kv.RowsFormat {
+	return kv.RowsFormatKV
+}
+
+// newRowCountTable creates the table `db`.`t` with two indices, whose only
+// chunk encoded 10 rows, i.e. 30 KV pairs. The statements are sent to the
+// mock database, and the statuses saved are returned by the function.
+func newRowCountTable(c *C, cfg *config.Config) (*RestoreController, *TableRestore, *TableCheckpoint, *mockDB, func() []CheckpointStatus) {
+	dir := c.MkDir()
+	files := map[string]string{
+		"db-schema-create.sql": "CREATE DATABASE db;",
+		"db.t-schema.sql":      "CREATE TABLE t (a INT, b INT, KEY (a), KEY (b));",
+		"db.t.sql":             "INSERT INTO t VALUES (1, 1);\n",
+	}
+	for name, content := range files {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), IsNil)
+	}
+	ctx := context.Background()
+	cfg.Mydumper.SourceDir = dir
+	cfg.Mydumper.CharacterSet = "auto"
+	cfg.PostRestore.Analyze = false
+	cfg.PostRestore.ChecksumMethod = config.ChecksumMethodRowCount
+	cfg.PostRestore.ChecksumReportDir = c.MkDir()
+	loader, err := mydump.NewMyDumpLoader(cfg)
+	c.Assert(err, IsNil)
+	dbMetas := loader.GetDatabases()
+	dbInfos, err := loadDryRunSchemaInfo(ctx, dbMetas, cfg)
+	c.Assert(err, IsNil)
+
+	db, mock := newMockDB()
+	rc := &RestoreController{
+		cfg:            cfg,
+		importer:       kv.NewBackendImporter(kvRowsBackend{}),
+		tidbMgr:        &TiDBManager{db: db},
+		saveCpChs:      []chan saveCp{make(chan saveCp, 16)},
+		errorSummaries: errorSummaries{summary: make(map[string]errorSummary)},
+		checksumMgr:    newChecksumManager(ctx, db, nil, "", 1, nil),
+	}
+	// another table is being checksummed, so the GC is already kept away
+	// without contacting PD.
+	rc.checksumMgr.running = 1
+
+	cp := &TableCheckpoint{
+		Status: CheckpointStatusAlteredAutoInc,
+		Engines: []*EngineCheckpoint{{
+			Status: CheckpointStatusImported,
+			Chunks: []*ChunkCheckpoint{{
+				Key:      ChunkCheckpointKey{Path: filepath.Join(dir, "db.t.sql")},
+				Checksum: verify.MakeKVChecksum(300, 30, 0),
+			}},
+		}},
+	}
+	tr, err := NewTableRestore("`db`.`t`", dbMetas[0].Tables[0], dbInfos["db"], dbInfos["db"].Tables["t"], cp)
+	c.Assert(err, IsNil)
+
+	statuses := func() []CheckpointStatus {
+		var result []CheckpointStatus
+		for {
+			select {
+			case scp := <-rc.saveCpChs[0]:
+				result = append(result, scp.merger.(*StatusCheckpointMerger).Status)
+			default:
+				return result
+			}
+		}
+	}
+	return rc, tr, cp, mock, statuses
+}
+
+func invalidStatus(status CheckpointStatus) CheckpointStatus {
+	merger := &StatusCheckpointMerger{Status: status}
+	merger.SetInvalid()
+	return merger.Status
+}
+
+func (s *restoreSuite) TestCompareRowCount(c *C) {
+	ctx := context.Background()
+	rc, tr, cp, mock, _ := newRowCountTable(c, config.NewConfig())
+	defer tr.Close()
+
+	// 30 KV pairs of a record and two index entries each.
+	mock.expect("SELECT COUNT\\(\\*\\) FROM `db`.`t`").willReturnRows([]string{"COUNT(*)"}, []driver.Value{int64(10)})
+	c.Assert(tr.compareRowCount(ctx, rc, cp), IsNil)
+
+	mock.expect("SELECT COUNT\\(\\*\\) FROM `db`.`t`").willReturnRows([]string{"COUNT(*)"}, []driver.Value{int64(30)})
+	err := tr.compareRowCount(ctx, rc, cp)
+	c.Assert(err, ErrorMatches, "row count mismatched remote vs local => 30 vs 10, see the diagnostics in .*")
+	c.Assert(common.CategoryOf(err), Equals, common.ErrorCategoryChecksumMismatch)
+	c.Assert(mock.check(), IsNil)
+}
+
+func (s *restoreSuite) TestIncrementalRowCount(c *C) {
+	ctx := context.Background()
+	cfg := config.NewConfig()
+	cfg.App.Incremental = true
+	rc, tr, cp, mock, _ := newRowCountTable(c, cfg)
+	defer tr.Close()
+
+	// the existing rows are counted before the import.
+	mock.expect("SELECT MAX\\(`_tidb_rowid`\\) FROM `db`.`t`").willReturnRows([]string{"MAX"}, []driver.Value{int64(7)})
+	mock.expect("SELECT AUTO_INCREMENT FROM information_schema.tables .*", "db", "t").willReturnRows([]string{"AUTO_INCREMENT"}, []driver.Value{int64(1)})
+	mock.expect("SELECT COUNT\\(\\*\\) FROM `db`.`t`").willReturnRows([]string{"COUNT(*)"}, []driver.Value{int64(5)})
+	c.Assert(tr.prepareIncremental(ctx, rc, cp), IsNil)
+	c.Assert(tr.baseChecksum, IsNil)
+	c.Assert(*tr.baseRowCount, Equals, int64(5))
+
+	// then added to the rows imported.
+	mock.expect("SELECT COUNT\\(\\*\\) FROM `db`.`t`").willReturnRows([]string{"COUNT(*)"}, []driver.Value{int64(15)})
+	c.Assert(tr.compareRowCount(ctx, rc, cp), IsNil)
+	c.Assert(mock.check(), IsNil)
+}
+
+func (s *restoreSuite) TestPartitionedChecksum(c *C) {
+	ctx := context.Background()
+	partitioned := func(tr *TableRestore) {
+		tr.tableInfo.core.Partition = &model.PartitionInfo{
+			Type:        model.PartitionTypeHash,
+			Expr:        "`a`",
+			Enable:      true,
+			Definitions: []model.PartitionDefinition{{ID: 101, Name: model.NewCIStr("p0")}, {ID: 102, Name: model.NewCIStr("p1")}},
+		}
+	}
+	adminChecksum := func(mock *mockDB, checksum, kvs, bytes uint64) {
+		mock.expect("ADMIN CHECKSUM TABLE `db`.`t`").willReturnRows(
+			[]string{"Db_name", "Table_name", "Checksum_crc64_xor", "Total_kvs", "Total_bytes"},
+			[]driver.Value{"db", "t", checksum, kvs, bytes},
+		)
+	}
+
+	// the checksum not covering the partitions is replaced by the row count.
+	cfg := config.NewConfig()
+	rc, tr, cp, mock, statuses := newRowCountTable(c, cfg)
+	cfg.PostRestore.ChecksumMethod = config.ChecksumMethodAdmin
+	partitioned(tr)
+	adminChecksum(mock, 0, 0, 0)
+	mock.expect("SELECT COUNT\\(\\*\\) FROM `db`.`t`").willReturnRows([]string{"COUNT(*)"}, []driver.Value{int64(10)})
+	c.Assert(tr.postProcess(ctx, rc, cp), IsNil)
+	c.Assert(tr.verification, Equals, VerificationRowCount)
+	c.Assert(statuses(), DeepEquals, []CheckpointStatus{CheckpointStatusChecksummed, CheckpointStatusAnalyzeSkipped})
+	c.Assert(mock.check(), IsNil)
+	tr.Close()
+
+	// the checksum covering the partitions is compared as usual.
+	cfg = config.NewConfig()
+	rc, tr, cp, mock, _ = newRowCountTable(c, cfg)
+	cfg.PostRestore.ChecksumMethod = config.ChecksumMethodAdmin
+	partitioned(tr)
+	adminChecksum(mock, 0, 30, 300)
+	c.Assert(tr.compareChecksum(ctx, rc, cp), IsNil)
+	adminChecksum(mock, 0, 29, 290)
+	c.Assert(tr.compareChecksum(ctx, rc, cp), ErrorMatches, "checksum mismatched remote vs local.*")
+	c.Assert(mock.check(), IsNil)
+	tr.Close()
+
+	// the existing rows are counted too for an incremental import.
+	cfg = config.NewConfig()
+	cfg.App.Incremental = true
+	rc, tr, cp, mock, _ = newRowCountTable(c, cfg)
+	cfg.PostRestore.ChecksumMethod = config.ChecksumMethodAdmin
+	partitioned(tr)
+	mock.expect("SELECT MAX\\(`_tidb_rowid`\\) FROM `db`.`t`").willReturnRows([]string{"MAX"}, []driver.Value{int64(7)})
+	mock.expect("SELECT AUTO_INCREMENT FROM information_schema.tables .*", "db", "t").willReturnRows([]string{"AUTO_INCREMENT"}, []driver.Value{int64(1)})
+	adminChecksum(mock, 0, 0, 0)
+	mock.expect("SELECT COUNT\\(\\*\\) FROM `db`.`t`").willReturnRows([]string{"COUNT(*)"}, []driver.Value{int64(5)})
+	c.Assert(tr.prepareIncremental(ctx, rc, cp), IsNil)
+	c.Assert(*tr.baseRowCount, Equals, int64(5))
+	adminChecksum(mock, 0, 0, 0)
+	mock.expect("SELECT COUNT\\(\\*\\) FROM `db`.`t`").willReturnRows([]string{"COUNT(*)"}, []driver.Value{int64(15)})
+	c.Assert(tr.compareChecksum(ctx, rc, cp), IsNil)
+	c.Assert(mock.check(), IsNil)
+	tr.Close()
+}
+
+func (s *restoreSuite) TestPostProcessChecksumLevels(c *C) {
+	ctx := context.Background()
+	countRows := func(mock *mockDB, rows int64) {
+		mock.expect("SELECT COUNT\\(\\*\\) FROM `db`.`t`").willReturnRows([]string{"COUNT(*)"}, []driver.Value{rows})
+	}
+
+	// off: nothing is counted.
+	cfg := config.NewConfig()
+	cfg.PostRestore.Checksum = config.PostOpLevelOff
+	rc, tr, cp, mock, statuses := newRowCountTable(c, cfg)
+	c.Assert(tr.postProcess(ctx, rc, cp), IsNil)
+	c.Assert(tr.verification, Equals, VerificationNone)
+	c.Assert(statuses(), DeepEquals, []CheckpointStatus{CheckpointStatusChecksumSkipped, CheckpointStatusAnalyzeSkipped})
+	c.Assert(mock.check(), IsNil)
+	tr.Close()
+
+	// required and passed.
+	cfg = config.NewConfig()
+	cfg.PostRestore.Checksum = config.PostOpLevelRequired
+	rc, tr, cp, mock, statuses = newRowCountTable(c, cfg)
+	countRows(mock, 10)
+	c.Assert(tr.postProcess(ctx, rc, cp), IsNil)
+	c.Assert(tr.verification, Equals, VerificationRowCount)
+	c.Assert(statuses(), DeepEquals, []CheckpointStatus{CheckpointStatusChecksummed, CheckpointStatusAnalyzeSkipped})
+	c.Assert(mock.check(), IsNil)
+	tr.Close()
+
+	// optional and failed: the table continues.
+	cfg = config.NewConfig()
+	cfg.PostRestore.Checksum = config.PostOpLevelOptional
+	rc, tr, cp, mock, statuses = newRowCountTable(c, cfg)
+	countRows(mock, 9)
+	c.Assert(tr.postProcess(ctx, rc, cp), IsNil)
+	c.Assert(tr.verification, Equals, VerificationFailed)
+	c.Assert(statuses(), DeepEquals, []CheckpointStatus{CheckpointStatusChecksumSkipped, CheckpointStatusAnalyzeSkipped})
+	c.Assert(mock.check(), IsNil)
+	tr.Close()
+
+	// required and failed: the table stops.
+	cfg = config.NewConfig()
+	cfg.PostRestore.Checksum = config.PostOpLevelRequired
+	rc, tr, cp, mock, statuses = newRowCountTable(c, cfg)
+	countRows(mock, 9)
+	c.Assert(tr.postProcess(ctx, rc, cp), ErrorMatches, "row count mismatched remote vs local => 9 vs 10.*")
+	c.Assert(tr.verification, Equals, VerificationFailed)
+	c.Assert(statuses(), DeepEquals, []CheckpointStatus{invalidStatus(CheckpointStatusChecksummed)})
+	c.Assert(mock.check(), IsNil)
+	tr.Close()
 }
@@ -0,0 +1,225 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	verify "github.com/pingcap/tidb-lightning/lightning/verification"
+)
+
+const (
+	TaskResultSuccess     = "success"
+	TaskResultFailed      = "failed"
+	TaskResultInterrupted = "interrupted"
+	TaskResultTimeout     = "timeout"
+)
+
+// TaskResult is the summary of the task written into `lightning.result-file`
+// when the task exits, for the orchestration systems.
+type TaskResult struct {
+	StartTime   time.Time          `json:"start_time"`
+	EndTime     time.Time          `json:"end_time"`
+	Elapsed     float64            `json:"elapsed_seconds"`
+	Status      string             `json:"status"`
+	Error       string             `json:"error,omitempty"`
+	Tables      []*TableResult     `json:"tables"`
+	Errors      []*ErrorStatus     `json:"errors"`
+	Quarantined []*QuarantineEntry `json:"quarantined_chunks"`
+	// why the task failed, the same as told by the exit code.
+	ErrorCategory string `json:"error_category,omitempty"`
+}
+
+// TableResult is the outcome of a table. The checksum covers the KV pairs
+// written in all runs, read from the checkpoint, while Rows and Elapsed only
+// count this run.
+type TableResult struct {
+	Name        string  `json:"name"`
+	Status      string  `json:"status"`
+	Rows        uint64  `json:"rows"`
+	SourceBytes int64   `json:"source_bytes"`
+	KVPairs     uint64  `json:"kv_pairs"`
+	KVBytes     uint64  `json:"kv_bytes"`
+	Checksum    uint64  `json:"checksum"`
+	Elapsed     float64 `json:"elapsed_seconds"`
+	// the time spent in each phase, summed over the concurrent chunks and
+	// engines, and which of encoding, delivery or ingestion dominates.
+	PhaseSeconds map[string]float64 `json:"phase_seconds,omitempty"`
+	Bound        string             `json:"bound,omitempty"`
+	// how the table is verified in this run, one of Verification*. empty if
+	// the table has not reached the verification in this run.
+	Verification string `json:"verification,omitempty"`
+}
+
+// the verifications a table can receive, reported in the task result.
+const (
+	VerificationChecksum = "checksum"
+	VerificationRowCount = "row-count"
+	// the table is not verified, as `post-restore.checksum` is off, or the
+	// verification is not possible.
+	VerificationNone = "none"
+	// the verification failed, and either the table failed, or the failure
+	// is ignored as `post-restore.checksum` is "optional".
+	VerificationFailed = "failed"
+)
+
+// QuarantineEntry is the byte range of a quarantined chunk not imported.
+type QuarantineEntry struct {
+	TableName string `json:"table_name"`
+	EngineID  int    `json:"engine_id"`
+	Path      string `json:"path"`
+	Offset    int64  `json:"offset"`
+	EndOffset int64  `json:"end_offset"`
+	Reason    string `json:"reason"`
+}
+
+// tableRun is what a table did in this run, which is not in the checkpoint.
+type tableRun struct {
+	rows         uint64
+	elapsed      time.Duration
+	phaseSeconds map[string]float64
+	bound        string
+	verification string
+}
+
+func taskResultStatus(err error) string {
+	switch {
+	case err == nil:
+		return TaskResultSuccess
+	case errors.Cause(err) == common.ErrTimeout:
+		return TaskResultTimeout
+	case common.IsContextCanceledError(err):
+		return TaskResultInterrupted
+	default:
+		return TaskResultFailed
+	}
+}
+
+// taskResult collects the result of the task which started at `start` and
+// ended with `err`.
+func (rc *RestoreController) taskResult(ctx context.Context, start time.Time, err error) *TaskResult {
+	end := time.Now()
+	result := &TaskResult{
+		StartTime:   start,
+		EndTime:     end,
+		Elapsed:     end.Sub(start).Seconds(),
+		Status:      taskResultStatus(err),
+		Tables:      []*TableResult{},
+		Errors:      rc.errorStatuses(),
+		Quarantined: []*QuarantineEntry{},
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if result.Status == TaskResultFailed {
+		result.ErrorCategory = common.CategoryOf(err).String()
+	}
+	if result.Errors == nil {
+		result.Errors = []*ErrorStatus{}
+	}
+
+	for _, dbMeta := range rc.dbMetas {
+		for _, tableMeta := range dbMeta.Tables {
+			tableName := common.UniqueTable(dbMeta.Name, tableMeta.Name)
+			tableResult := &TableResult{
+				Name:        tableName,
+				SourceBytes: tableMeta.TotalSize,
+			}
+			if value, ok := rc.tableRuns.Load(tableName); ok {
+				run := value.(tableRun)
+				tableResult.Rows = run.rows
+				tableResult.Elapsed = run.elapsed.Seconds()
+				tableResult.PhaseSeconds = run.phaseSeconds
+				tableResult.Bound = run.bound
+				tableResult.Verification = run.verification
+			}
+			cp, err := rc.tableCheckpoint(ctx, tableName)
+			switch {
+			case isCheckpointNotFound(err):
+				// the task failed before the table is known to the checkpoints.
+			case err != nil:
+				common.TableLogger(tableName).Warnf("cannot read checkpoint for the task result: %v", err)
+			default:
+				tableResult.Status = cp.Status.MetricName()
+				var checksum verify.KVChecksum
+				for _, engine := range cp.Engines {
+					for _, chunk := range engine.Chunks {
+						checksum.Add(&chunk.Checksum)
+					}
+				}
+				tableResult.KVPairs = checksum.SumKVS()
+				tableResult.KVBytes = checksum.SumSize()
+				tableResult.Checksum = checksum.Sum()
+			}
+			result.Tables = append(result.Tables, tableResult)
+		}
+	}
+
+	rc.quarantineSummaries.Lock()
+	for _, chunk := range rc.quarantineSummaries.chunks {
+		result.Quarantined = append(result.Quarantined, &QuarantineEntry{
+			TableName: chunk.tableName,
+			EngineID:  chunk.engineID,
+			Path:      chunk.path,
+			Offset:    chunk.pos,
+			EndOffset: chunk.endOffset,
+			Reason:    chunk.reason,
+		})
+	}
+	rc.quarantineSummaries.Unlock()
+
+	return result
+}
+
+// tableCheckpoint reads the checkpoint of the table, or the copy kept if the
+// checkpoints have been cleaned up.
+func (rc *RestoreController) tableCheckpoint(ctx context.Context, tableName string) (*TableCheckpoint, error) {
+	if cp, ok := rc.finalCheckpoints.Load(tableName); ok {
+		return cp.(*TableCheckpoint), nil
+	}
+	cp, err := rc.checkpointsDB.Get(ctx, tableName)
+	return cp, errors.Trace(err)
+}
+
+// writeTaskResult writes the task result as JSON into the file. The file is
+// replaced atomically, so the readers never see a partial result.
+func (rc *RestoreController) writeTaskResult(path string, start time.Time, err error) error {
+	result := rc.taskResult(context.Background(), start, err)
+	content, e := json.MarshalIndent(result, "", "  ")
+	if e != nil {
+		return errors.Trace(e)
+	}
+
+	tmpFile, e := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if e != nil {
+		return errors.Trace(e)
+	}
+	defer os.Remove(tmpFile.Name())
+	_, e = tmpFile.Write(append(content, '\n'))
+	if closeErr := tmpFile.Close(); e == nil {
+		e = closeErr
+	}
+	if e != nil {
+		return errors.Trace(e)
+	}
+	return errors.Trace(os.Rename(tmpFile.Name(), path))
+}
@@ -0,0 +1,190 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	pd "github.com/pingcap/pd/client"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/grpc"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+const (
+	// the service safe point expires after this long if Lightning crashed
+	// without removing it.
+	serviceSafePointTTL = 5 * time.Minute
+	// the service safe point is refreshed long before it expires.
+	serviceSafePointRefreshInterval = serviceSafePointTTL / 5
+
+	updateServiceGCSafePointMethod = "/pdpb.PD/UpdateServiceGCSafePoint"
+)
+
+// updateServiceGCSafePointRequest is pdpb.UpdateServiceGCSafePointRequest,
+// which was introduced in PD v4.0 and is missing in the vendored kvproto.
+type updateServiceGCSafePointRequest struct {
+	Header    *pdpb.RequestHeader `protobuf:"bytes,1,opt,name=header" json:"header,omitempty"`
+	ServiceId []byte              `protobuf:"bytes,2,opt,name=service_id,json=serviceId,proto3" json:"service_id,omitempty"`
+	TTL       int64               `protobuf:"varint,3,opt,name=TTL,proto3" json:"TTL,omitempty"`
+	SafePoint uint64              `protobuf:"varint,4,opt,name=safe_point,json=safePoint,proto3" json:"safe_point,omitempty"`
+}
+
+func (m *updateServiceGCSafePointRequest) Reset()         { *m = updateServiceGCSafePointRequest{} }
+func (m *updateServiceGCSafePointRequest) String() string { return proto.CompactTextString(m) }
+func (*updateServiceGCSafePointRequest) ProtoMessage()    {}
+
+// updateServiceGCSafePointResponse is pdpb.UpdateServiceGCSafePointResponse.
+type updateServiceGCSafePointResponse struct {
+	Header       *pdpb.ResponseHeader `protobuf:"bytes,1,opt,name=header" json:"header,omitempty"`
+	ServiceId    []byte               `protobuf:"bytes,2,opt,name=service_id,json=serviceId,proto3" json:"service_id,omitempty"`
+	TTL          int64                `protobuf:"varint,3,opt,name=TTL,proto3" json:"TTL,omitempty"`
+	MinSafePoint uint64               `protobuf:"varint,4,opt,name=min_safe_point,json=minSafePoint,proto3" json:"min_safe_point,omitempty"`
+}
+
+func (m *updateServiceGCSafePointResponse) Reset()         { *m = updateServiceGCSafePointResponse{} }
+func (m *updateServiceGCSafePointResponse) String() string { return proto.CompactTextString(m) }
+func (*updateServiceGCSafePointResponse) ProtoMessage()    {}
+
+// serviceSafePointKeeper registers a GC service safe point in PD, which keeps
+// the data needed by the checksum from being garbage collected. Unlike
+// increasing tikv_gc_life_time, the service safe point expires by itself if
+// Lightning crashed without removing it.
+type serviceSafePointKeeper struct {
+	conn      *grpc.ClientConn // connection to the PD leader
+	clusterID uint64
+	serviceID string
+	safePoint uint64
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func startServiceSafePointKeeper(ctx context.Context, tls *common.TLS, pdAddr string) (*serviceSafePointKeeper, error) {
+	pdCli, err := pd.NewClient([]string{pdAddr}, tls.ToPDSecurityOption())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer pdCli.Close()
+
+	physical, logical, err := pdCli.GetTS(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	conn, err := dialPDLeader(ctx, tls, pdAddr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	k := &serviceSafePointKeeper{
+		conn:      conn,
+		clusterID: pdCli.GetClusterID(ctx),
+		serviceID: "lightning-" + uuid.NewV4().String(),
+		safePoint: oracle.ComposeTS(physical, logical),
+	}
+	if err := k.update(ctx, serviceSafePointTTL); err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	keepCtx, cancel := context.WithCancel(context.Background())
+	k.cancel = cancel
+	k.wg.Add(1)
+	go k.keep(keepCtx)
+
+	common.AppLogger.Infof("[%s] registered GC service safe point %d", k.serviceID, k.safePoint)
+	return k, nil
+}
+
+// dialPDLeader connects to the leader of the PD cluster, since only the leader
+// serves UpdateServiceGCSafePoint.
+func dialPDLeader(ctx context.Context, tls *common.TLS, pdAddr string) (*grpc.ClientConn, error) {
+	conn, err := grpc.DialContext(ctx, pdAddr, tls.ToGRPCDialOption())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	members, err := pdpb.NewPDClient(conn).GetMembers(ctx, &pdpb.GetMembersRequest{})
+	if err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+	urls := members.GetLeader().GetClientUrls()
+	if len(urls) == 0 {
+		return conn, nil
+	}
+	leaderAddr := strings.TrimPrefix(strings.TrimPrefix(urls[0], "http://"), "https://")
+	if leaderAddr == pdAddr {
+		return conn, nil
+	}
+	conn.Close()
+	conn, err = grpc.DialContext(ctx, leaderAddr, tls.ToGRPCDialOption())
+	return conn, errors.Trace(err)
+}
+
+// update sets the TTL of the service safe point. A zero TTL removes it.
+func (k *serviceSafePointKeeper) update(ctx context.Context, ttl time.Duration) error {
+	req := &updateServiceGCSafePointRequest{
+		Header:    &pdpb.RequestHeader{ClusterId: k.clusterID},
+		ServiceId: []byte(k.serviceID),
+		TTL:       int64(ttl / time.Second),
+		SafePoint: k.safePoint,
+	}
+	resp := new(updateServiceGCSafePointResponse)
+	if err := k.conn.Invoke(ctx, updateServiceGCSafePointMethod, req, resp); err != nil {
+		return errors.Trace(err)
+	}
+	if pdErr := resp.Header.GetError(); pdErr != nil {
+		return errors.Errorf("update service safe point failed: %s", pdErr.String())
+	}
+	if ttl > 0 && resp.MinSafePoint > k.safePoint {
+		return errors.Errorf("GC safe point %d has already passed the requested %d", resp.MinSafePoint, k.safePoint)
+	}
+	return nil
+}
+
+func (k *serviceSafePointKeeper) keep(ctx context.Context) {
+	defer k.wg.Done()
+	ticker := time.NewTicker(serviceSafePointRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.update(ctx, serviceSafePointTTL); err != nil && !common.IsContextCanceledError(err) {
+				common.AppLogger.Warnf("[%s] cannot refresh GC service safe point: %v", k.serviceID, err)
+			}
+		}
+	}
+}
+
+// stop removes the service safe point.
+func (k *serviceSafePointKeeper) stop() {
+	k.cancel()
+	k.wg.Wait()
+	if err := k.update(context.Background(), 0); err != nil {
+		common.AppLogger.Warnf("[%s] cannot remove GC service safe point, it will expire in %v: %v", k.serviceID, serviceSafePointTTL, err)
+	} else {
+		common.AppLogger.Infof("[%s] removed GC service safe point", k.serviceID)
+	}
+	k.conn.Close()
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"net"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	"google.golang.org/grpc"
+)
+
+var _ = Suite(&safePointSuite{})
+
+type safePointSuite struct{}
+
+// mockSafePointServer records the UpdateServiceGCSafePoint requests.
+type mockSafePointServer struct {
+	requests     []*updateServiceGCSafePointRequest
+	minSafePoint uint64
+}
+
+func (s *mockSafePointServer) serviceDesc() *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: "pdpb.PD",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "UpdateServiceGCSafePoint",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(updateServiceGCSafePointRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				s.requests = append(s.requests, req)
+				return &updateServiceGCSafePointResponse{
+					Header:       &pdpb.ResponseHeader{ClusterId: req.Header.GetClusterId()},
+					ServiceId:    req.ServiceId,
+					TTL:          req.TTL,
+					MinSafePoint: s.minSafePoint,
+				}, nil
+			},
+		}},
+	}
+}
+
+func (s *safePointSuite) TestUpdateServiceSafePoint(c *C) {
+	mock := &mockSafePointServer{minSafePoint: 100}
+	server := grpc.NewServer()
+	server.RegisterService(mock.serviceDesc(), mock)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	k := &serviceSafePointKeeper{
+		conn:      conn,
+		clusterID: 42,
+		serviceID: "lightning-test",
+		safePoint: 200,
+	}
+	ctx := context.Background()
+	c.Assert(k.update(ctx, 5*time.Minute), IsNil)
+	c.Assert(k.update(ctx, 0), IsNil)
+	c.Assert(mock.requests, HasLen, 2)
+	c.Assert(mock.requests[0].Header.GetClusterId(), Equals, uint64(42))
+	c.Assert(string(mock.requests[0].ServiceId), Equals, "lightning-test")
+	c.Assert(mock.requests[0].TTL, Equals, int64(300))
+	c.Assert(mock.requests[0].SafePoint, Equals, uint64(200))
+	c.Assert(mock.requests[1].TTL, Equals, int64(0))
+
+	// the safe point is useless if GC has already gone past it.
+	mock.minSafePoint = 300
+	c.Assert(k.update(ctx, 5*time.Minute), ErrorMatches, "GC safe point 300 has already passed the requested 200")
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/tikvpb"
+	pd "github.com/pingcap/pd/client"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/codec"
+	"google.golang.org/grpc"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+// regionSplitter splits the key range of an engine into empty regions and
+// scatters them among the TiKV stores before the engine is imported, so the
+// ingestion is spread out instead of hitting the few regions at the end of the
+// table.
+type regionSplitter struct {
+	pdAddr string
+	pdCli  pd.Client
+	tls    *common.TLS
+
+	mu    sync.Mutex
+	conns map[uint64]*grpc.ClientConn
+}
+
+func newRegionSplitter(tls *common.TLS, pdAddr string) (*regionSplitter, error) {
+	pdCli, err := pd.NewClient([]string{pdAddr}, tls.ToPDSecurityOption())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &regionSplitter{
+		pdAddr: pdAddr,
+		pdCli:  pdCli,
+		tls:    tls,
+		conns:  make(map[uint64]*grpc.ClientConn),
+	}, nil
+}
+
+func (s *regionSplitter) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.pdCli.Close()
+}
+
+func (s *regionSplitter) tikvClient(ctx context.Context, storeID uint64) (tikvpb.TikvClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn, ok := s.conns[storeID]
+	if !ok {
+		store, err := s.pdCli.GetStore(ctx, storeID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		conn, err = grpc.DialContext(ctx, store.GetAddress(), s.tls.ToGRPCDialOption())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		s.conns[storeID] = conn
+	}
+	return tikvpb.NewTikvClient(conn), nil
+}
+
+// splitRegion splits the region containing `key` so that a region starts
+// exactly at `key`. Does nothing if such region already exists.
+func (s *regionSplitter) splitRegion(ctx context.Context, key []byte) error {
+	encodedKey := codec.EncodeBytes(nil, key)
+	return common.Retry(ctx, fmt.Sprintf("split region at %q", key), func() error {
+		region, leader, err := s.pdCli.GetRegion(ctx, encodedKey)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if region == nil || leader == nil {
+			return errors.Errorf("region of key %q is not ready", key)
+		}
+		if bytes.Equal(region.GetStartKey(), encodedKey) {
+			return nil
+		}
+
+		client, err := s.tikvClient(ctx, leader.GetStoreId())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		resp, err := client.SplitRegion(ctx, &kvrpcpb.SplitRegionRequest{
+			Context: &kvrpcpb.Context{
+				RegionId:    region.GetId(),
+				RegionEpoch: region.GetRegionEpoch(),
+				Peer:        leader,
+			},
+			SplitKey: key,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if regionErr := resp.GetRegionError(); regionErr != nil {
+			return errors.Errorf("region %d: %s", region.GetId(), regionErr.String())
+		}
+		return nil
+	})
+}
+
+func (s *regionSplitter) scatterRegion(ctx context.Context, regionID uint64) error {
+	url := s.tls.URL(s.pdAddr, "/pd/api/v1/operators")
+	return doPDRequest(ctx, s.tls.HTTPClient(), http.MethodPost, url, map[string]interface{}{
+		"name":      "scatter-region",
+		"region_id": regionID,
+	})
+}
+
+// splitAndScatter creates a region starting at every key, and then asks PD to
+// scatter these regions. The keys must be sorted.
+func (s *regionSplitter) splitAndScatter(ctx context.Context, tableName string, keys [][]byte) error {
+	timer := time.Now()
+	for _, key := range keys {
+		if err := s.splitRegion(ctx, key); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// the IDs of the split regions are only stable after all splits are done,
+	// since TiKV keeps the original ID on the right side.
+	scattered := 0
+	for _, key := range keys {
+		region, _, err := s.pdCli.GetRegion(ctx, codec.EncodeBytes(nil, key))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if region == nil {
+			continue
+		}
+		if err := s.scatterRegion(ctx, region.GetId()); err != nil {
+			common.TableLogger(tableName).Warnf("cannot scatter region %d: %v", region.GetId(), err)
+			continue
+		}
+		scattered++
+	}
+
+	common.TableLogger(tableName).Infof("split %d regions and scattered %d of them, takes %v", len(keys), scattered, time.Since(timer))
+	return nil
+}
+
+// engineSplitKeys samples the key range of an engine into keys to split at.
+// The chunks are of similar size, so the row keys at the chunk boundaries
+// split the data evenly. Every index also gets its own regions.
+func engineSplitKeys(tableInfo *TidbTableInfo, cp *EngineCheckpoint) [][]byte {
+	var keys [][]byte
+	for _, index := range tableInfo.core.Indices {
+		keys = append(keys, tablecodec.EncodeTableIndexPrefix(tableInfo.ID, index.ID))
+	}
+	// when the primary key is the handle, the row IDs of the chunks are not
+	// the handles being written.
+	if !tableInfo.core.PKIsHandle {
+		for _, chunk := range cp.Chunks {
+			keys = append(keys, tablecodec.EncodeRowKeyWithHandle(tableInfo.ID, chunk.Chunk.PrevRowIDMax+1))
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	uniqueKeys := keys[:0]
+	for i, key := range keys {
+		if i == 0 || !bytes.Equal(key, keys[i-1]) {
+			uniqueKeys = append(uniqueKeys, key)
+		}
+	}
+	return uniqueKeys
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/tablecodec"
+
+	"github.com/pingcap/tidb-lightning/lightning/mydump"
+)
+
+var _ = Suite(&splitSuite{})
+
+type splitSuite struct{}
+
+func (s *splitSuite) TestEngineSplitKeys(c *C) {
+	tableInfo := &TidbTableInfo{
+		ID: 42,
+		core: &model.TableInfo{
+			Indices: []*model.IndexInfo{{ID: 1}, {ID: 2}},
+		},
+	}
+	cp := &EngineCheckpoint{
+		Chunks: []*ChunkCheckpoint{
+			{Chunk: mydump.Chunk{PrevRowIDMax: 100, RowIDMax: 200}},
+			{Chunk: mydump.Chunk{PrevRowIDMax: 0, RowIDMax: 100}},
+			{Chunk: mydump.Chunk{PrevRowIDMax: 100, RowIDMax: 200}},
+		},
+	}
+
+	keys := engineSplitKeys(tableInfo, cp)
+	c.Assert(keys, DeepEquals, [][]byte{
+		tablecodec.EncodeTableIndexPrefix(42, 1),
+		tablecodec.EncodeTableIndexPrefix(42, 2),
+		tablecodec.EncodeRowKeyWithHandle(42, 1),
+		tablecodec.EncodeRowKeyWithHandle(42, 101),
+	})
+
+	// row IDs are meaningless when the primary key is the handle.
+	tableInfo.core.PKIsHandle = true
+	keys = engineSplitKeys(tableInfo, cp)
+	c.Assert(keys, DeepEquals, [][]byte{
+		tablecodec.EncodeTableIndexPrefix(42, 1),
+		tablecodec.EncodeTableIndexPrefix(42, 2),
+	})
+}
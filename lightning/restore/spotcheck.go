@@ -0,0 +1,286 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/model"
+	tmysql "github.com/pingcap/parser/mysql"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/kv"
+	"github.com/pingcap/tidb-lightning/lightning/mydump"
+)
+
+// the prefix of the scratch tables the sampled rows are inserted into.
+const spotCheckTablePrefix = "_lightning_spot_check_"
+
+// the maximum number of mismatched rows quoted in the spot check error.
+const maxReportedMismatches = 3
+
+// sampledRow is a row read from the data source, kept for the spot check.
+type sampledRow struct {
+	columns     []byte // the column list of the chunk
+	permutation []int  // see chunkRestore.permutation
+	values      []byte // with the row ID appended if the chunk includes it
+	path        string
+	offset      int64
+}
+
+// rowSampler keeps a uniform random sample of the rows read by all chunks of
+// a table, by reservoir sampling.
+type rowSampler struct {
+	size int
+	seen int64 // atomic
+
+	mu      sync.Mutex
+	samples []sampledRow
+}
+
+func newRowSampler(size int) *rowSampler {
+	return &rowSampler{size: size}
+}
+
+// slot decides whether the next row is sampled. It returns the index of the
+// sample replaced by the row, or -1 if the row is not sampled.
+func (s *rowSampler) slot(r *rand.Rand) int {
+	n := atomic.AddInt64(&s.seen, 1)
+	if n <= int64(s.size) {
+		return int(n - 1)
+	}
+	if i := r.Int63n(n); i < int64(s.size) {
+		return int(i)
+	}
+	return -1
+}
+
+// put saves the row into the slot. The slots are filled by the chunks
+// concurrently, not necessarily in order.
+func (s *rowSampler) put(slot int, row sampledRow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.samples) <= slot {
+		s.samples = append(s.samples, sampledRow{})
+	}
+	s.samples[slot] = row
+}
+
+// rows returns the sampled rows.
+func (s *rowSampler) rows() []sampledRow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows := make([]sampledRow, 0, len(s.samples))
+	for _, row := range s.samples {
+		if row.values != nil {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// sample offers the row just read to the sampler of the table.
+func (cr *chunkRestore) sample(t *TableRestore, kvEncoder *kv.TableKVEncoder, offset int64) {
+	if cr.sampleRand == nil {
+		cr.sampleRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	slot := t.sampler.slot(cr.sampleRand)
+	if slot < 0 {
+		return
+	}
+	row := cr.parser.LastRow()
+	var buffer bytes.Buffer
+	cr.writeRow(&buffer, mydump.Row{RowID: kvEncoder.ShardRowID(row.RowID), Row: row.Row})
+	t.sampler.put(slot, sampledRow{
+		columns:     cr.chunk.Columns,
+		permutation: cr.permutation,
+		values:      buffer.Bytes(),
+		path:        cr.chunk.Key.Path,
+		offset:      offset,
+	})
+}
+
+// spotCheck inserts every sampled row by SQL into a scratch copy of the table,
+// and compares it with the row imported by the encoder. The scratch table is
+// dropped afterwards.
+func (t *TableRestore) spotCheck(ctx context.Context, rc *RestoreController) error {
+	samples := t.sampler.rows()
+	if len(samples) == 0 {
+		t.logger().Info("skip spot check, no rows are encoded in this run")
+		return nil
+	}
+	start := time.Now()
+
+	// a single connection, so the session variables apply to every query.
+	conn, err := rc.tidbMgr.db.Conn(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+	// the rows are converted by TiDB the same way as the encoder does.
+	if sqlMode := rc.cfg.TiDB.SQLModeOf(t.dbInfo.Name, t.tableInfo.Name); len(sqlMode) > 0 {
+		if _, err := conn.ExecContext(ctx, "SET SESSION sql_mode = ?", sqlMode); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if timeZone := rc.encoderOpts.timeZone; len(timeZone) > 0 {
+		if _, err := conn.ExecContext(ctx, "SET SESSION time_zone = ?", timeZone); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	// the rows of the tables without an integer primary key are inserted with
+	// the _tidb_rowid assigned by the encoder, which TiDB otherwise rejects.
+	if _, err := conn.ExecContext(ctx, "SET SESSION tidb_opt_write_row_id = 1"); err != nil {
+		return errors.Trace(err)
+	}
+
+	scratch := common.UniqueTable(t.dbInfo.Name, fmt.Sprintf("%s%d", spotCheckTablePrefix, t.tableInfo.ID))
+	if _, err := conn.ExecContext(ctx, "DROP TABLE IF EXISTS "+scratch); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s LIKE %s", scratch, t.tableName)); err != nil {
+		return errors.Trace(err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "DROP TABLE IF EXISTS "+scratch); err != nil {
+			t.logger().Warnf("cannot drop the spot check table %s: %v", scratch, err)
+		}
+	}()
+
+	var mismatches []string
+	checked := 0
+	for i := range samples {
+		mismatch, located, err := t.spotCheckRow(ctx, conn, scratch, &samples[i])
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !located {
+			continue
+		}
+		checked++
+		if len(mismatch) > 0 {
+			mismatches = append(mismatches, mismatch)
+		}
+	}
+
+	if len(mismatches) > 0 {
+		reported := mismatches
+		if len(reported) > maxReportedMismatches {
+			reported = reported[:maxReportedMismatches]
+		}
+		err := errors.Errorf("spot check found %d of %d sampled rows differ from the data source: %s",
+			len(mismatches), checked, strings.Join(reported, "; "))
+		return common.WithCategory(err, common.ErrorCategoryChecksumMismatch)
+	}
+	t.logger().Infof("spot check pass, %d of %d sampled rows compared takes %v", checked, len(samples), time.Since(start))
+	return nil
+}
+
+// spotCheckRow compares a sampled row, returning the mismatch found or empty.
+// A row is not located if neither its integer primary key nor its row ID is
+// given in the data source.
+func (t *TableRestore) spotCheckRow(ctx context.Context, conn *sql.Conn, scratch string, sample *sampledRow) (mismatch string, located bool, err error) {
+	// the columns given in the data source are compared, the others may be
+	// filled differently, e.g. by CURRENT_TIMESTAMP or AUTO_INCREMENT.
+	cols := t.tableInfo.core.Columns
+	var names []string
+	handle := ""
+	for _, offset := range sample.permutation {
+		if offset >= len(cols) {
+			handle = model.ExtraHandleName.O
+			continue
+		}
+		col := cols[offset]
+		names = append(names, col.Name.O)
+		if t.tableInfo.core.PKIsHandle && tmysql.HasPriKeyFlag(col.Flag) {
+			handle = col.Name.O
+		}
+	}
+	if len(handle) == 0 || len(names) == 0 {
+		return "", false, nil
+	}
+	var handleName, selectList strings.Builder
+	common.WriteMySQLIdentifier(&handleName, handle)
+	selectList.WriteString(handleName.String())
+	for _, name := range names {
+		selectList.WriteByte(',')
+		common.WriteMySQLIdentifier(&selectList, name)
+	}
+	location := fmt.Sprintf("row at offset %d of %s", sample.offset, sample.path)
+
+	_, err = conn.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s %s VALUES %s", scratch, sample.columns, sample.values))
+	if err != nil {
+		if _, ok := errors.Cause(err).(*mysql.MySQLError); ok {
+			// the encoder accepted a row which TiDB rejects.
+			return fmt.Sprintf("%s cannot be inserted by SQL: %v", location, common.RedactError(err)), true, nil
+		}
+		return "", false, errors.Trace(err)
+	}
+	defer func() {
+		if _, e := conn.ExecContext(ctx, "DELETE FROM "+scratch); e != nil && err == nil {
+			err = errors.Trace(e)
+		}
+	}()
+
+	var handleValue string
+	expected := make([]sql.NullString, len(names))
+	dest := make([]interface{}, 0, len(names)+1)
+	dest = append(dest, &handleValue)
+	for i := range expected {
+		dest = append(dest, &expected[i])
+	}
+	if err := conn.QueryRowContext(ctx, fmt.Sprintf("SELECT %s FROM %s", selectList.String(), scratch)).Scan(dest...); err != nil {
+		return "", false, errors.Trace(err)
+	}
+
+	var actualHandle string
+	actual := make([]sql.NullString, len(names))
+	dest[0] = &actualHandle
+	for i := range actual {
+		dest[i+1] = &actual[i]
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", selectList.String(), t.tableName, handleName.String())
+	err = conn.QueryRowContext(ctx, query, handleValue).Scan(dest...)
+	switch {
+	case err == sql.ErrNoRows:
+		return fmt.Sprintf("%s is not found by %s = %s", location, handle, common.RedactString(handleValue)), true, nil
+	case err != nil:
+		return "", false, errors.Trace(err)
+	}
+
+	for i, name := range names {
+		if actual[i] != expected[i] {
+			return fmt.Sprintf("%s has %s = %s imported, but %s inserted by SQL",
+				location, name, common.RedactString(nullString(actual[i])), common.RedactString(nullString(expected[i]))), true, nil
+		}
+	}
+	return "", true, nil
+}
+
+func nullString(s sql.NullString) string {
+	if !s.Valid {
+		return "NULL"
+	}
+	return fmt.Sprintf("%q", s.String)
+}
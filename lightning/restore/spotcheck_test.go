@@ -0,0 +1,184 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"database/sql/driver"
+	"math/rand"
+	"strconv"
+	"sync"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/parser/model"
+
+	"github.com/pingcap/tidb-lightning/lightning/config"
+)
+
+var _ = Suite(&spotCheckSuite{})
+
+type spotCheckSuite struct{}
+
+func (s *spotCheckSuite) offer(sampler *rowSampler, r *rand.Rand, offset int64) {
+	if slot := sampler.slot(r); slot >= 0 {
+		sampler.put(slot, sampledRow{values: []byte(strconv.FormatInt(offset, 10)), offset: offset})
+	}
+}
+
+func (s *spotCheckSuite) TestRowSamplerKeepsFirstRows(c *C) {
+	sampler := newRowSampler(5)
+	r := rand.New(rand.NewSource(1))
+	for i := int64(0); i < 3; i++ {
+		s.offer(sampler, r, i)
+	}
+	rows := sampler.rows()
+	c.Assert(rows, HasLen, 3)
+	for i, row := range rows {
+		c.Assert(row.offset, Equals, int64(i))
+	}
+}
+
+func (s *spotCheckSuite) TestRowSamplerIsUniform(c *C) {
+	const rows, size, rounds = 20, 5, 4000
+	counts := make([]int, rows)
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < rounds; round++ {
+		sampler := newRowSampler(size)
+		for i := int64(0); i < rows; i++ {
+			s.offer(sampler, r, i)
+		}
+		sampled := sampler.rows()
+		c.Assert(sampled, HasLen, size)
+		for _, row := range sampled {
+			counts[row.offset]++
+		}
+	}
+	// every row is expected in 1/4 of the rounds.
+	for i, count := range counts {
+		c.Assert(count > rounds/5 && count < rounds*3/10, IsTrue, Commentf("row %d sampled %d times", i, count))
+	}
+}
+
+func (s *spotCheckSuite) TestRowSamplerConcurrent(c *C) {
+	sampler := newRowSampler(10)
+	var wg sync.WaitGroup
+	for chunk := 0; chunk < 8; chunk++ {
+		wg.Add(1)
+		go func(chunk int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(chunk)))
+			for i := 0; i < 1000; i++ {
+				s.offer(sampler, r, int64(chunk*1000+i))
+			}
+		}(chunk)
+	}
+	wg.Wait()
+
+	rows := sampler.rows()
+	c.Assert(rows, HasLen, 10)
+	seen := make(map[int64]bool)
+	for _, row := range rows {
+		c.Assert(seen[row.offset], IsFalse)
+		seen[row.offset] = true
+	}
+}
+
+// newSpotCheckTable returns a table (a, b) without an integer primary key, so
+// the rows are located by the row IDs, with a row sampled.
+func (s *spotCheckSuite) newSpotCheckTable() *TableRestore {
+	t := &TableRestore{
+		tableName: "`db`.`t`",
+		dbInfo:    &TidbDBInfo{Name: "db"},
+		tableInfo: &TidbTableInfo{ID: 42, Name: "t", core: &model.TableInfo{
+			Columns: []*model.ColumnInfo{
+				{Name: model.NewCIStr("a"), Offset: 0},
+				{Name: model.NewCIStr("b"), Offset: 1},
+			},
+		}},
+		sampler: newRowSampler(1),
+	}
+	t.sampler.put(0, sampledRow{
+		columns:     []byte("(`a`,`b`,`_tidb_rowid`)"),
+		permutation: []int{0, 1, 2},
+		values:      []byte("('1','x',5)"),
+		path:        "/data/db.t.sql",
+		offset:      100,
+	})
+	return t
+}
+
+func (s *spotCheckSuite) TestSpotCheck(c *C) {
+	db, mock := newMockDB()
+	defer db.Close()
+	cfg := config.NewConfig()
+	rc := &RestoreController{cfg: cfg, tidbMgr: &TiDBManager{db: db}}
+	rc.encoderOpts.timeZone = "+08:00"
+	t := s.newSpotCheckTable()
+
+	columns := []string{"_tidb_rowid", "a", "b"}
+	mock.expect("^SET SESSION sql_mode = \\?$", cfg.TiDB.SQLMode)
+	mock.expect("^SET SESSION time_zone = \\?$", "+08:00")
+	mock.expect("^SET SESSION tidb_opt_write_row_id = 1$")
+	mock.expect("^DROP TABLE IF EXISTS `db`.`_lightning_spot_check_42`$")
+	mock.expect("^CREATE TABLE `db`.`_lightning_spot_check_42` LIKE `db`.`t`$")
+	mock.expect("^INSERT INTO `db`.`_lightning_spot_check_42` \\(`a`,`b`,`_tidb_rowid`\\) VALUES \\('1','x',5\\)$")
+	mock.expect("^SELECT `_tidb_rowid`,`a`,`b` FROM `db`.`_lightning_spot_check_42`$").
+		willReturnRows(columns, []driver.Value{"5", "1", "x"})
+	mock.expect("^SELECT `_tidb_rowid`,`a`,`b` FROM `db`.`t` WHERE `_tidb_rowid` = \\?$", "5").
+		willReturnRows(columns, []driver.Value{"5", "1", "x"})
+	mock.expect("^DELETE FROM `db`.`_lightning_spot_check_42`$")
+	mock.expect("^DROP TABLE IF EXISTS `db`.`_lightning_spot_check_42`$")
+
+	c.Assert(t.spotCheck(context.Background(), rc), IsNil)
+	c.Assert(mock.check(), IsNil)
+}
+
+func (s *spotCheckSuite) TestSpotCheckRowMismatch(c *C) {
+	ctx := context.Background()
+	db, mock := newMockDB()
+	defer db.Close()
+	conn, err := db.Conn(ctx)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	t := s.newSpotCheckTable()
+	sample := t.sampler.rows()[0]
+
+	columns := []string{"_tidb_rowid", "a", "b"}
+	mock.expect("^INSERT INTO `scratch`")
+	mock.expect("^SELECT `_tidb_rowid`,`a`,`b` FROM `scratch`$").
+		willReturnRows(columns, []driver.Value{"5", "1", "x"})
+	mock.expect("^SELECT `_tidb_rowid`,`a`,`b` FROM `db`.`t` WHERE `_tidb_rowid` = \\?$", "5").
+		willReturnRows(columns, []driver.Value{"5", "1", nil})
+	mock.expect("^DELETE FROM `scratch`$")
+
+	mismatch, located, err := t.spotCheckRow(ctx, conn, "`scratch`", &sample)
+	c.Assert(err, IsNil)
+	c.Assert(located, IsTrue)
+	c.Assert(mismatch, Equals, `row at offset 100 of /data/db.t.sql has b = NULL imported, but "x" inserted by SQL`)
+	c.Assert(mock.check(), IsNil)
+
+	// not found by the row ID.
+	mock.expect("^INSERT INTO `scratch`")
+	mock.expect("^SELECT `_tidb_rowid`,`a`,`b` FROM `scratch`$").
+		willReturnRows(columns, []driver.Value{"5", "1", "x"})
+	mock.expect("^SELECT `_tidb_rowid`,`a`,`b` FROM `db`.`t` WHERE `_tidb_rowid` = \\?$", "5").
+		willReturnRows(columns)
+	mock.expect("^DELETE FROM `scratch`$")
+
+	mismatch, located, err = t.spotCheckRow(ctx, conn, "`scratch`", &sample)
+	c.Assert(err, IsNil)
+	c.Assert(located, IsTrue)
+	c.Assert(mismatch, Equals, "row at offset 100 of /data/db.t.sql is not found by _tidb_rowid = 5")
+	c.Assert(mock.check(), IsNil)
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/metric"
+)
+
+// the maximum interval between the checks of stalled chunks.
+const maxStallCheckInterval = time.Minute
+
+// chunkActivity tracks the delivery of a chunk being restored, to tell a
+// stalled chunk from a slow one.
+type chunkActivity struct {
+	tableName string
+	engineID  int
+	key       string
+	start     time.Time
+
+	lastDelivery   int64 // atomic, in unix nanoseconds
+	deliveredBytes int64 // atomic
+	stalled        int32 // atomic, 1 from being reported stalled until the next delivery
+}
+
+func (a *chunkActivity) logger() *log.Entry {
+	return common.EngineLogger(a.tableName, a.engineID).WithField(common.LogFieldChunk, a.key)
+}
+
+// delivered records a successful delivery of the bytes. It does nothing on a
+// nil activity, i.e. the chunk is not tracked.
+func (a *chunkActivity) delivered(bytes int64, now time.Time) {
+	if a == nil {
+		return
+	}
+	atomic.AddInt64(&a.deliveredBytes, bytes)
+	idle := now.Sub(time.Unix(0, atomic.SwapInt64(&a.lastDelivery, now.UnixNano())))
+	if atomic.CompareAndSwapInt32(&a.stalled, 1, 0) {
+		metric.StalledChunksGauge.Dec()
+		a.logger().Infof("chunk resumes delivery after stalling for %v", idle.Round(time.Second))
+	}
+}
+
+// speed is the average delivery rate of the chunk in bytes per second.
+func (a *chunkActivity) speed(now time.Time) float64 {
+	elapsed := now.Sub(a.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&a.deliveredBytes)) / elapsed
+}
+
+// trackChunk starts tracking the delivery of the chunk.
+func (rc *RestoreController) trackChunk(tableName string, engineID int, key *ChunkCheckpointKey) *chunkActivity {
+	now := time.Now()
+	a := &chunkActivity{
+		tableName:    tableName,
+		engineID:     engineID,
+		key:          key.String(),
+		start:        now,
+		lastDelivery: now.UnixNano(),
+	}
+	rc.activeChunks.Store(a, struct{}{})
+	return a
+}
+
+// untrackChunk stops tracking the chunk, which is finished or failed.
+func (rc *RestoreController) untrackChunk(a *chunkActivity) {
+	rc.activeChunks.Delete(a)
+	if atomic.CompareAndSwapInt32(&a.stalled, 1, 0) {
+		metric.StalledChunksGauge.Dec()
+	}
+}
+
+// stallCheckInterval is how often the stalls are checked, so that a stall is
+// reported soon after the timeout.
+func stallCheckInterval(timeout time.Duration) time.Duration {
+	interval := timeout / 4
+	if interval > maxStallCheckInterval {
+		interval = maxStallCheckInterval
+	}
+	return interval
+}
+
+// detectStalls reports the chunks which have delivered nothing for the stall
+// timeout, and returns those newly found stalled. A stalled chunk is reported
+// once until it delivers again.
+func (rc *RestoreController) detectStalls(now time.Time) []*chunkActivity {
+	timeout := rc.cfg.App.StallTimeout.Duration
+	var stalled []*chunkActivity
+	rc.activeChunks.Range(func(key, _ interface{}) bool {
+		a := key.(*chunkActivity)
+		idle := now.Sub(time.Unix(0, atomic.LoadInt64(&a.lastDelivery)))
+		if idle < timeout || !atomic.CompareAndSwapInt32(&a.stalled, 0, 1) {
+			return true
+		}
+		metric.ChunkStallCounter.Inc()
+		metric.StalledChunksGauge.Inc()
+		a.logger().Warnf(
+			"chunk has made no delivery progress for %v, delivered %d bytes in %v (%.2f MiB/s) before",
+			idle.Round(time.Second), atomic.LoadInt64(&a.deliveredBytes), now.Sub(a.start).Round(time.Second), a.speed(now)/1048576,
+		)
+		stalled = append(stalled, a)
+		return true
+	})
+	return stalled
+}
+
+// checkStalls detects the stalled chunks, and dumps the goroutines if any is
+// newly found, so the stuck operation can be located.
+func (rc *RestoreController) checkStalls() {
+	now := time.Now()
+	if rc.pauser.IsPaused() {
+		// nothing is delivered while paused, restart the clocks instead.
+		rc.activeChunks.Range(func(key, _ interface{}) bool {
+			atomic.StoreInt64(&key.(*chunkActivity).lastDelivery, now.UnixNano())
+			return true
+		})
+		return
+	}
+	stalled := rc.detectStalls(now)
+	if len(stalled) == 0 {
+		return
+	}
+	path, err := dumpGoroutines(rc.cfg.App.StallDumpDir, now)
+	if err != nil {
+		common.AppLogger.Warnf("%d chunks stalled, cannot dump the goroutines: %v", len(stalled), err)
+		return
+	}
+	common.AppLogger.Warnf("%d chunks stalled, the goroutines are dumped into %s", len(stalled), path)
+}
+
+// dumpGoroutines writes the stacks of all goroutines into a new file in the
+// directory, or the temporary directory if empty. Returns the file path.
+func dumpGoroutines(dir string, now time.Time) (string, error) {
+	if len(dir) == 0 {
+		dir = os.TempDir()
+	}
+	path := filepath.Join(dir, fmt.Sprintf("tidb-lightning-stall-%s.goroutines", now.Format("20060102-150405.000")))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	err = pprof.Lookup("goroutine").WriteTo(file, 2)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return path, errors.Trace(err)
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/metric"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TaskStatus is a snapshot of the progress of the whole import task, used by
+// the status server.
+type TaskStatus struct {
+	StartTime       time.Time         `json:"start_time"`
+	Elapsed         time.Duration     `json:"elapsed"`
+	TiKVMode        string            `json:"tikv_mode"`
+	Paused          bool              `json:"paused"`
+	DiskQuotaUsed   int64             `json:"disk_quota_used"`
+	EstimatedChunks float64           `json:"estimated_chunks"`
+	FinishedChunks  float64           `json:"finished_chunks"`
+	TotalTables     float64           `json:"total_tables"`
+	CompletedTables float64           `json:"completed_tables"`
+	BytesRead       float64           `json:"bytes_read"`
+	Speed           float64           `json:"speed"` // in bytes per second
+	PreChecks       []*PreCheckResult `json:"pre_checks"`
+	Tables          []*TableStatus    `json:"tables"`
+	Errors          []*ErrorStatus    `json:"errors"`
+}
+
+// the status of a table without a checkpoint, i.e. before the checkpoints are
+// initialized, or after they are cleaned up.
+const (
+	TableStatusNotStarted = "not started"
+	TableStatusFinished   = "finished"
+)
+
+type TableStatus struct {
+	Name    string          `json:"name"`
+	Status  string          `json:"status"`
+	Engines []*EngineStatus `json:"engines"`
+}
+
+type EngineStatus struct {
+	ID             int    `json:"id"`
+	Status         string `json:"status"`
+	Chunks         int    `json:"chunks"`
+	RemainingBytes int64  `json:"remaining_bytes"`
+}
+
+type ErrorStatus struct {
+	TableName string `json:"table_name"`
+	Status    string `json:"status"`
+	Error     string `json:"error"`
+}
+
+// Status collects the current progress of the task. The per-table states are
+// read from the checkpoints database.
+func (rc *RestoreController) Status(ctx context.Context) *TaskStatus {
+	elapsed := time.Since(rc.startTime)
+	status := &TaskStatus{
+		StartTime:       rc.startTime,
+		Elapsed:         elapsed,
+		TiKVMode:        rc.tikvMode.Load().(string),
+		Paused:          rc.pauser.IsPaused(),
+		DiskQuotaUsed:   rc.diskQuota.Used(),
+		PreChecks:       rc.preCheckReport(),
+		EstimatedChunks: metric.SumCounterVec(metric.ChunkCounter, prometheus.Labels{"state": metric.ChunkStateEstimated}),
+		FinishedChunks:  metric.SumCounterVec(metric.ChunkCounter, prometheus.Labels{"state": metric.ChunkStateFinished}),
+		TotalTables:     metric.ReadCounter(metric.TableCounter.WithLabelValues(metric.TableStatePending, metric.TableResultSuccess)),
+		CompletedTables: metric.ReadCounter(metric.TableCounter.WithLabelValues(metric.TableStateCompleted, metric.TableResultSuccess)),
+		BytesRead:       metric.ReadHistogramSum(metric.BlockReadBytesHistogram),
+	}
+	status.Speed = status.BytesRead / elapsed.Seconds()
+
+	for _, dbMeta := range rc.dbMetas {
+		for _, tableMeta := range dbMeta.Tables {
+			tableName := common.UniqueTable(dbMeta.Name, tableMeta.Name)
+			cp, err := rc.tableCheckpoint(ctx, tableName)
+			if isCheckpointNotFound(err) {
+				cp, err = nil, nil
+			}
+			if err != nil {
+				common.TableLogger(tableName).Warnf("cannot read checkpoint for status: %v", err)
+				continue
+			}
+			status.Tables = append(status.Tables, rc.tableStatus(tableName, cp))
+		}
+	}
+
+	status.Errors = rc.errorStatuses()
+	return status
+}
+
+// tableStatus describes the table with the checkpoint, which is nil if the
+// table has no checkpoint.
+func (rc *RestoreController) tableStatus(tableName string, cp *TableCheckpoint) *TableStatus {
+	if cp == nil {
+		tableStatus := &TableStatus{Name: tableName, Status: TableStatusNotStarted}
+		if phase, _ := rc.phase.Load().(string); phase == metric.TaskPhaseCleanCheckpoints || phase == metric.TaskPhaseFinished {
+			tableStatus.Status = TableStatusFinished
+		}
+		return tableStatus
+	}
+
+	tableStatus := &TableStatus{
+		Name:   tableName,
+		Status: cp.Status.MetricName(),
+	}
+	for engineID, engine := range cp.Engines {
+		engineStatus := &EngineStatus{
+			ID:     engineID,
+			Status: engine.Status.MetricName(),
+			Chunks: len(engine.Chunks),
+		}
+		if engine.Status < CheckpointStatusAllWritten {
+			for _, chunk := range engine.Chunks {
+				engineStatus.RemainingBytes += chunk.Chunk.EndOffset - chunk.Chunk.Offset
+			}
+		}
+		tableStatus.Engines = append(tableStatus.Engines, engineStatus)
+	}
+	return tableStatus
+}
+
+// WatchTableStatuses reports the status of every table whose checkpoint
+// changes, until the context is canceled. Returns false if the checkpoints
+// database cannot be watched.
+func (rc *RestoreController) WatchTableStatuses(ctx context.Context) (<-chan *TableStatus, bool) {
+	watcher, ok := rc.checkpointsDB.(CheckpointsWatcher)
+	if !ok {
+		return nil, false
+	}
+	events := watcher.Watch(ctx)
+	statuses := make(chan *TableStatus)
+	go func() {
+		defer close(statuses)
+		for event := range events {
+			select {
+			case statuses <- rc.tableStatus(event.TableName, event.Checkpoint):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return statuses, true
+}
+
+// errorStatuses lists the failed tables, sorted by the names.
+func (rc *RestoreController) errorStatuses() []*ErrorStatus {
+	var statuses []*ErrorStatus
+	rc.errorSummaries.Lock()
+	for tableName, summary := range rc.errorSummaries.summary {
+		statuses = append(statuses, &ErrorStatus{
+			TableName: tableName,
+			Status:    summary.status.MetricName(),
+			Error:     summary.err.Error(),
+		})
+	}
+	rc.errorSummaries.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].TableName < statuses[j].TableName
+	})
+	return statuses
+}
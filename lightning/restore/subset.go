@@ -0,0 +1,54 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/config"
+	"github.com/pingcap/tidb-lightning/lightning/mydump"
+)
+
+// selectSubset keeps only the tables of the subset, and the databases
+// containing them. It fails if any table of the subset is not in the data
+// source.
+func selectSubset(dbMetas []*mydump.MDDatabaseMeta, subset *config.Subset) ([]*mydump.MDDatabaseMeta, error) {
+	if !subset.Enabled() {
+		return dbMetas, nil
+	}
+	found := make(map[string]struct{}, len(subset.Tables))
+	selected := make([]*mydump.MDDatabaseMeta, 0, len(dbMetas))
+	for _, dbMeta := range dbMetas {
+		tables := make([]*mydump.MDTableMeta, 0, len(subset.Tables))
+		for _, tableMeta := range dbMeta.Tables {
+			tableName := common.UniqueTable(tableMeta.DB, tableMeta.Name)
+			if subset.HasTable(tableName) {
+				tables = append(tables, tableMeta)
+				found[tableName] = struct{}{}
+			}
+		}
+		if len(tables) > 0 {
+			selectedDB := *dbMeta
+			selectedDB.Tables = tables
+			selected = append(selected, &selectedDB)
+		}
+	}
+	for _, tableName := range subset.Tables {
+		if _, ok := found[tableName]; !ok {
+			return nil, errors.Errorf("table %s given by -table is not found in the data source", tableName)
+		}
+	}
+	return selected, nil
+}
@@ -20,10 +20,17 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/cznic/mathutil"
+	"github.com/go-sql-driver/mysql"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/parser/model"
+	tmysql "github.com/pingcap/parser/mysql"
 	"github.com/pingcap/tidb-lightning/lightning/common"
 	"github.com/pingcap/tidb-lightning/lightning/config"
 	"github.com/pingcap/tidb-lightning/lightning/metric"
@@ -32,6 +39,7 @@ import (
 
 type TiDBManager struct {
 	db      *sql.DB
+	dsn     string
 	client  *http.Client
 	baseURL *url.URL
 }
@@ -47,51 +55,179 @@ type TidbTableInfo struct {
 	Columns         int
 	Indices         int
 	CreateTableStmt string
-	core            *model.TableInfo
+	// the number of shard bits of the AUTO_RANDOM primary key, or 0 if the
+	// table has none.
+	AutoRandomBits uint64
+	// whether the rows are keyed by a clustered primary key which is not a
+	// single integer column, instead of _tidb_rowid.
+	IsCommonHandle bool
+	core           *model.TableInfo
 }
 
-func NewTiDBManager(dsn config.DBStore) (*TiDBManager, error) {
-	db, err := common.ConnectDB(dsn.Host, dsn.Port, dsn.User, dsn.Psw)
+// NewTiDBManager connects to TiDB. Every connection of the pool sets the
+// session variables of the concurrency settings and `tidb.session-vars`, which
+// are used by the checksum and analyze.
+func NewTiDBManager(dsn config.DBStore, tls *common.TLS) (*TiDBManager, error) {
+	dbDSN := common.ToDSN(dsn.Host, dsn.Port, dsn.User, dsn.Psw, dsn.TLS) + sessionVarsDSN(dsn)
+	db, err := sql.Open("mysql", dbDSN)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Trace(err)
+	}
+	db.SetMaxOpenConns(dsn.MaxOpenConns)
+	db.SetMaxIdleConns(dsn.MaxIdleConns)
+	db.SetConnMaxLifetime(dsn.ConnMaxLifetime.Duration)
 
-	u, err := url.Parse(fmt.Sprintf("http://%s:%d", dsn.Host, dsn.StatusPort))
+	u, err := url.Parse(tls.URL(fmt.Sprintf("%s:%d", dsn.Host, dsn.StatusPort), ""))
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
 	return &TiDBManager{
 		db:      db,
-		client:  &http.Client{},
+		dsn:     dbDSN,
+		client:  tls.HTTPClient(),
 		baseURL: u,
 	}, nil
 }
 
+// sessionVarsDSN returns the DSN parameters setting the session variables on
+// connect, the user-specified ones overriding the concurrency settings. The
+// values of `tidb.session-vars` are quoted as strings, which TiDB converts into
+// the types of the variables.
+func sessionVarsDSN(dsn config.DBStore) string {
+	vars := map[string]string{
+		"tidb_build_stats_concurrency":       strconv.Itoa(dsn.BuildStatsConcurrency),
+		"tidb_distsql_scan_concurrency":      strconv.Itoa(dsn.DistSQLScanConcurrency),
+		"tidb_index_serial_scan_concurrency": strconv.Itoa(dsn.IndexSerialScanConcurrency),
+		"tidb_checksum_table_concurrency":    strconv.Itoa(dsn.ChecksumTableConcurrency),
+	}
+	for name, value := range dsn.SessionVars {
+		vars[name] = "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value) + "'"
+	}
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var params strings.Builder
+	for _, name := range names {
+		params.WriteString("&" + name + "=" + url.QueryEscape(vars[name]))
+	}
+	return params.String()
+}
+
+// connectTiDBBackend opens the connection used by the TiDB backend to execute
+// the rows, with the session SQL mode set to `tidb.sql-mode`, and the time
+// zone to `tidb.time-zone` if specified.
+func connectTiDBBackend(dsn config.DBStore) (*sql.DB, error) {
+	dbDSN := common.ToDSN(dsn.Host, dsn.Port, dsn.User, dsn.Psw, dsn.TLS) + "&sql_mode=" + url.QueryEscape("'"+dsn.SQLMode+"'")
+	if len(dsn.TimeZone) > 0 {
+		dbDSN += "&time_zone=" + url.QueryEscape("'"+dsn.TimeZone+"'")
+	}
+	db, err := sql.Open("mysql", dbDSN)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Trace(err)
+	}
+	return db, nil
+}
+
 func (timgr *TiDBManager) Close() {
 	timgr.db.Close()
 }
 
-func (timgr *TiDBManager) InitSchema(ctx context.Context, database string, tablesSchema map[string]string) error {
-	createDatabase := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", database)
+// InitSchema creates the database and its tables. Up to `concurrency` CREATE
+// TABLE statements are executed at the same time, each worker through its own
+// connection so the current database is kept. If `batchSize` is larger than 1,
+// each worker sends up to that many statements in one multi-statement query,
+// saving the round trips when there are many tables.
+func (timgr *TiDBManager) InitSchema(ctx context.Context, dbMeta *mydump.MDDatabaseMeta, concurrency int, batchSize int) error {
+	database := dbMeta.Name
+	createDatabase := dbMeta.GetSchema()
 	err := common.ExecWithRetry(ctx, timgr.db, createDatabase, createDatabase)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	useDB := fmt.Sprintf("USE `%s`", database)
-	err = common.ExecWithRetry(ctx, timgr.db, useDB, useDB)
+
+	db := timgr.db
+	if batchSize > 1 {
+		// the multi-statement queries are only allowed on these connections.
+		db, err = sql.Open("mysql", timgr.dsn+"&multiStatements=true")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer db.Close()
+	}
+
+	stmts := make(chan string, len(dbMeta.Tables))
+	for _, tblMeta := range dbMeta.Tables {
+		stmts <- tblMeta.GetSchema()
+	}
+	close(stmts)
+
+	// the other workers stop as soon as any table failed to be created.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var createErr common.OnceError
+	for i := 0; i < concurrency && i < len(dbMeta.Tables); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := createTables(ctx, db, database, stmts, batchSize); err != nil {
+				createErr.Set(database, err)
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Trace(createErr.Get())
+}
+
+// createTables executes the CREATE TABLE statements received from `stmts` in
+// the database, `batchSize` at a time, until the channel is drained or a
+// statement failed.
+func createTables(ctx context.Context, db *sql.DB, database string, stmts <-chan string, batchSize int) error {
+	conn, err := db.Conn(ctx)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	defer conn.Close()
+
+	useDB := fmt.Sprintf("USE `%s`", database)
+	if _, err := conn.ExecContext(ctx, useDB); err != nil {
+		return errors.Annotate(err, useDB)
+	}
+	for sqlCreateTable := range stmts {
+		batch := []string{sqlCreateTable}
+		for len(batch) < batchSize {
+			next, ok := <-stmts
+			if !ok {
+				break
+			}
+			batch = append(batch, next)
+		}
 
-	for _, sqlCreateTable := range tablesSchema {
 		timer := time.Now()
-		if err = safeCreateTable(ctx, timgr.db, sqlCreateTable); err != nil {
+		if len(batch) == 1 {
+			if err := safeCreateTable(ctx, conn, sqlCreateTable); err != nil {
+				return errors.Trace(err)
+			}
+			common.AppLogger.Infof("%s takes %v", sqlCreateTable, time.Since(timer))
+			continue
+		}
+		if err := safeCreateTables(ctx, conn, batch); err != nil {
 			return errors.Trace(err)
 		}
-		common.AppLogger.Infof("%s takes %v", sqlCreateTable, time.Since(timer))
+		common.AppLogger.Infof("creating %d tables in `%s` takes %v", len(batch), database, time.Since(timer))
 	}
-
 	return nil
 }
 
@@ -108,17 +244,57 @@ func createTableIfNotExistsStmt(createTable string) string {
 	return createTable
 }
 
-func safeCreateTable(ctx context.Context, db *sql.DB, createTable string) error {
+// safeCreateTable creates the table if not exists. The statement is retried
+// if it conflicts with the other DDL jobs running concurrently.
+func safeCreateTable(ctx context.Context, conn *sql.Conn, createTable string) error {
 	createTable = createTableIfNotExistsStmt(createTable)
-	err := common.ExecWithRetry(ctx, db, createTable, createTable)
+	err := common.Retry(ctx, createTable, func() error {
+		_, err := conn.ExecContext(ctx, createTable)
+		return err
+	})
 	return errors.Trace(err)
 }
 
-func (timgr *TiDBManager) getTables(schema string) ([]*model.TableInfo, error) {
+// safeCreateTables creates the tables in one multi-statement query. As the
+// statements are CREATE TABLE IF NOT EXISTS, the tables created before a
+// failed statement are skipped when retrying. If the query still failed, the
+// statements are executed one by one to report the failing one.
+func safeCreateTables(ctx context.Context, conn *sql.Conn, createTables []string) error {
+	stmts := make([]string, 0, len(createTables))
+	for _, createTable := range createTables {
+		stmts = append(stmts, strings.TrimRight(createTableIfNotExistsStmt(createTable), "; \t\r\n"))
+	}
+	query := strings.Join(stmts, ";\n")
+	err := common.Retry(ctx, fmt.Sprintf("create %d tables", len(stmts)), func() error {
+		_, err := conn.ExecContext(ctx, query)
+		return err
+	})
+	if err == nil || common.IsContextCanceledError(err) {
+		return errors.Trace(err)
+	}
+
+	common.AppLogger.Warnf("failed to create %d tables at once, create them one by one: %s", len(stmts), err)
+	for _, createTable := range stmts {
+		if err := safeCreateTable(ctx, conn, createTable); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// schemaTable is a table schema returned by the status API, together with the
+// fields the vendored model.TableInfo does not know.
+type schemaTable struct {
+	*model.TableInfo
+	AutoRandomBits uint64 `json:"auto_random_bits"`
+	IsCommonHandle bool   `json:"is_common_handle"`
+}
+
+func (timgr *TiDBManager) getTables(schema string) ([]schemaTable, error) {
 	baseURL := *timgr.baseURL
 	baseURL.Path = fmt.Sprintf("schema/%s", schema)
 
-	var tables []*model.TableInfo
+	var tables []schemaTable
 	err := common.GetJSON(timgr.client, baseURL.String(), &tables)
 	if err != nil {
 		return nil, errors.Annotatef(errors.Trace(err), "get tables for schema %s", schema)
@@ -162,7 +338,9 @@ func (timgr *TiDBManager) LoadSchemaInfo(ctx context.Context, schemas []*mydump.
 				Columns:         len(tbl.Columns),
 				Indices:         len(tbl.Indices),
 				CreateTableStmt: createTableStmt,
-				core:            tbl,
+				AutoRandomBits:  tbl.AutoRandomBits,
+				IsCommonHandle:  tbl.IsCommonHandle,
+				core:            tbl.TableInfo,
 			}
 			dbInfo.Tables[tableName] = tableInfo
 		}
@@ -185,16 +363,249 @@ func ObtainGCLifeTime(ctx context.Context, db *sql.DB) (gcLifeTime string, err e
 	return gcLifeTime, errors.Annotatef(err, "%s", query)
 }
 
+// ObtainNewCollationEnabled returns whether the cluster was bootstrapped with
+// the new collation framework, which changes how the index keys of the string
+// columns are encoded. Clusters not knowing the framework have no such row.
+func ObtainNewCollationEnabled(ctx context.Context, db *sql.DB) (bool, error) {
+	query := "SELECT VARIABLE_VALUE FROM mysql.tidb WHERE VARIABLE_NAME = 'new_collation_enabled'"
+	var enabled string
+	err := common.QueryRowWithRetry(ctx, db, query, &enabled)
+	if errors.Cause(err) == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Annotatef(err, "%s", query)
+	}
+	return strings.EqualFold(enabled, "True"), nil
+}
+
+// ObtainTimeZone returns the global time_zone of the cluster. If it is
+// "SYSTEM", the system time zone of the TiDB server is returned instead.
+func ObtainTimeZone(ctx context.Context, db *sql.DB) (string, error) {
+	query := "SELECT @@global.time_zone, @@system_time_zone"
+	var timeZone, systemTimeZone string
+	if err := common.QueryRowWithRetry(ctx, db, query, &timeZone, &systemTimeZone); err != nil {
+		return "", errors.Annotatef(err, "%s", query)
+	}
+	if strings.EqualFold(timeZone, "SYSTEM") {
+		return systemTimeZone, nil
+	}
+	return timeZone, nil
+}
+
 func UpdateGCLifeTime(ctx context.Context, db *sql.DB, gcLifeTime string) error {
 	query := "UPDATE mysql.tidb SET VARIABLE_VALUE = ? WHERE VARIABLE_NAME = 'tikv_gc_life_time'"
 	err := common.ExecWithRetry(ctx, db, query, query, gcLifeTime)
 	return errors.Annotatef(err, "%s -- ? = %s", query, gcLifeTime)
 }
 
+// ObtainRowIDBase returns the largest row ID already used by the table, which
+// is the maximum of the existing row IDs (or integer primary keys) and the
+// auto-increment ID allocated by TiDB.
+func ObtainRowIDBase(ctx context.Context, db *sql.DB, schema string, tableInfo *model.TableInfo) (int64, error) {
+	handleColumn := model.ExtraHandleName.String()
+	if tableInfo.PKIsHandle {
+		if pk := tableInfo.GetPkColInfo(); pk != nil {
+			handleColumn = pk.Name.String()
+		}
+	}
+	var builder strings.Builder
+	builder.WriteString("SELECT MAX(")
+	common.WriteMySQLIdentifier(&builder, handleColumn)
+	if !tableInfo.PKIsHandle && tableInfo.ShardRowIDBits > 0 {
+		// only the incremental bits of the sharded row IDs are allocated.
+		fmt.Fprintf(&builder, " & %d", int64(1)<<(63-tableInfo.ShardRowIDBits)-1)
+	}
+	builder.WriteString(") FROM ")
+	builder.WriteString(common.UniqueTable(schema, tableInfo.Name.String()))
+	query := builder.String()
+
+	var maxRowID, autoIncrement sql.NullInt64
+	err := common.QueryRowWithRetry(ctx, db, query, &maxRowID)
+	if err != nil {
+		return 0, errors.Annotatef(err, "%s", query)
+	}
+
+	autoIncQuery := "SELECT AUTO_INCREMENT FROM information_schema.tables WHERE table_schema = ? AND table_name = ?"
+	err = common.Retry(ctx, autoIncQuery, func() error {
+		return db.QueryRowContext(ctx, autoIncQuery, schema, tableInfo.Name.String()).Scan(&autoIncrement)
+	})
+	if err != nil {
+		return 0, errors.Annotatef(err, "%s -- ? = %s, %s", autoIncQuery, schema, tableInfo.Name)
+	}
+
+	// AUTO_INCREMENT is the next ID to be allocated.
+	return mathutil.MaxInt64(maxRowID.Int64, autoIncrement.Int64-1), nil
+}
+
+// AlterAutoRandom rebases the AUTO_RANDOM allocator of the table, so that the
+// IDs allocated later have their incremental bits starting from `base`.
+func AlterAutoRandom(ctx context.Context, db *sql.DB, schema string, table string, base int64) error {
+	tableName := common.UniqueTable(schema, table)
+	query := fmt.Sprintf("ALTER TABLE %s AUTO_RANDOM_BASE=%d", tableName, base)
+	common.TableLogger(tableName).Info(query)
+	err := common.ExecWithRetry(ctx, db, query, query)
+	if err != nil {
+		common.AppLogger.Errorf("query failed %v, you should do it manually, err %v", query, err)
+	}
+	return errors.Annotatef(err, "%s", query)
+}
+
+var autoRandomRegexp = regexp.MustCompile(`(?i)\bAUTO_RANDOM\b\s*(?:\(\s*(\d+)\s*\))?`)
+
+// autoRandomBitsOf finds the number of shard bits of the AUTO_RANDOM column
+// in the CREATE TABLE statement, which the vendored parser cannot recognize.
+// The statement from SHOW CREATE TABLE puts it in a comment like
+// "/*T![auto_rand] AUTO_RANDOM(5) */".
+func autoRandomBitsOf(createTable string) uint64 {
+	match := autoRandomRegexp.FindStringSubmatch(createTable)
+	switch {
+	case match == nil:
+		return 0
+	case match[1] == "":
+		return defaultAutoRandomBits
+	}
+	bits, _ := strconv.ParseUint(match[1], 10, 64)
+	return bits
+}
+
+// defaultAutoRandomBits is the number of shard bits of AUTO_RANDOM without an
+// explicit argument.
+const defaultAutoRandomBits = 5
+
+var clusteredCommentRegexp = regexp.MustCompile(`(?i)^/\*T!\[clustered_index\]\s*CLUSTERED\s*\*/$`)
+
+// isCommonHandleOf returns whether the table is clustered by a primary key
+// which is not a single integer column. The vendored parser does not know the
+// CLUSTERED attribute, which the statement from SHOW CREATE TABLE puts in a
+// TiDB comment like "/*T![clustered_index] CLUSTERED */" after the primary
+// key. Such a comment is the only place the attribute can appear in a
+// statement the parser accepts, so it is looked for among the comments only,
+// not in the names, the string literals or the other comments.
+func isCommonHandleOf(createTable string, tableInfo *model.TableInfo) bool {
+	if tableInfo.PKIsHandle {
+		return false
+	}
+	hasPrimaryKey := false
+	for _, idx := range tableInfo.Indices {
+		if idx.Primary {
+			hasPrimaryKey = true
+			break
+		}
+	}
+	if !hasPrimaryKey {
+		return false
+	}
+	for _, comment := range sqlComments(createTable) {
+		if clusteredCommentRegexp.MatchString(comment) {
+			return true
+		}
+	}
+	return false
+}
+
+// sqlComments returns the block comments of the SQL statement, skipping the
+// string literals, the quoted identifiers and the line comments.
+func sqlComments(sql string) []string {
+	var comments []string
+	for i := 0; i < len(sql); i++ {
+		switch c := sql[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			for i++; i < len(sql); i++ {
+				if sql[i] == '\\' && c != '`' {
+					i++
+				} else if sql[i] == c {
+					// a doubled quote is an escaped one.
+					if i+1 < len(sql) && sql[i+1] == c {
+						i++
+					} else {
+						break
+					}
+				}
+			}
+		case c == '#' || c == '-' && strings.HasPrefix(sql[i:], "-- "):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				return comments
+			}
+			comments = append(comments, sql[i:i+end+4])
+			i += end + 3
+		}
+	}
+	return comments
+}
+
+// ObtainNextAutoID returns the next ID the table allocates from its global
+// auto ID base, i.e. the AUTO_RANDOM one if `autoRandom` is set, otherwise the
+// shared one of AUTO_INCREMENT and _tidb_rowid. It returns 0 if the cluster
+// does not report it.
+func ObtainNextAutoID(ctx context.Context, db *sql.DB, schema string, table string, autoRandom bool) (int64, error) {
+	tableName := common.UniqueTable(schema, table)
+	query := fmt.Sprintf("SHOW TABLE %s NEXT_ROW_ID", tableName)
+	var nextID int64
+	err := common.Retry(ctx, query, func() error {
+		nextID = 0
+		rows, err := db.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		columns, err := rows.Columns()
+		if err != nil {
+			return err
+		}
+		// the columns are DB_NAME, TABLE_NAME, COLUMN_NAME, NEXT_GLOBAL_ROW_ID
+		// and, since TiDB 4.0, ID_TYPE.
+		values := make([]sql.RawBytes, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(dest...); err != nil {
+				return err
+			}
+			var id int64
+			isAutoRandom := false
+			for i, column := range columns {
+				switch strings.ToUpper(column) {
+				case "NEXT_GLOBAL_ROW_ID":
+					id, err = strconv.ParseInt(string(values[i]), 10, 64)
+					if err != nil {
+						return errors.Trace(err)
+					}
+				case "ID_TYPE":
+					isAutoRandom = strings.EqualFold(string(values[i]), "AUTO_RANDOM")
+				}
+			}
+			if isAutoRandom == autoRandom && id > nextID {
+				nextID = id
+			}
+		}
+		return rows.Err()
+	})
+	if mysqlErr, ok := errors.Cause(err).(*mysql.MySQLError); ok && mysqlErr.Number == tmysql.ErrParse {
+		// older TiDB only reports the AUTO_INCREMENT.
+		query = "SELECT AUTO_INCREMENT FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?"
+		var autoIncrement sql.NullInt64
+		err = common.Retry(ctx, query, func() error {
+			return db.QueryRowContext(ctx, query, schema, table).Scan(&autoIncrement)
+		})
+		nextID = autoIncrement.Int64
+	}
+	if err != nil {
+		return 0, errors.Annotatef(err, "%s", query)
+	}
+	return nextID, nil
+}
+
 func AlterAutoIncrement(ctx context.Context, db *sql.DB, schema string, table string, incr int64) error {
 	tableName := common.UniqueTable(schema, table)
 	query := fmt.Sprintf("ALTER TABLE %s AUTO_INCREMENT=%d", tableName, incr)
-	common.AppLogger.Infof("[%s.%s] %s", schema, table, query)
+	common.TableLogger(tableName).Info(query)
 	err := common.ExecWithRetry(ctx, db, query, query)
 	if err != nil {
 		common.AppLogger.Errorf("query failed %v, you should do it manually, err %v", query, err)
@@ -14,9 +14,15 @@
 package restore
 
 import (
+	"context"
+	"database/sql/driver"
 	"testing"
 
+	"github.com/go-sql-driver/mysql"
 	. "github.com/pingcap/check"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/config"
 )
 
 var _ = Suite(&tidbSuite{})
@@ -81,3 +87,151 @@ func (s *tidbSuite) TestCreateTableIfNotExistsStmt(c *C) {
 		createTableIfNotExistsStmt("CREATE TABLE IF NOT EXISTS  `\xcc\xcc\xcc`(`\xdd\xdd\xdd` TINYINT(1));"),
 	)
 }
+
+func (s *tidbSuite) TestCreateTablesInBatches(c *C) {
+	stmtsOf := func(createTables ...string) chan string {
+		stmts := make(chan string, len(createTables))
+		for _, createTable := range createTables {
+			stmts <- createTable
+		}
+		close(stmts)
+		return stmts
+	}
+	ctx := context.Background()
+
+	// the statements are sent two at a time, and the last one alone.
+	db, mock := newMockDB()
+	mock.expect("^USE `db`$")
+	mock.expect("^CREATE TABLE IF NOT EXISTS\\s+`a` \\(x INT\\);\nCREATE TABLE IF NOT EXISTS\\s+`b` \\(x INT\\)$")
+	mock.expect("^CREATE TABLE IF NOT EXISTS\\s+`c` \\(x INT\\);$")
+	err := createTables(ctx, db, "db", stmtsOf("CREATE TABLE `a` (x INT);", "CREATE TABLE `b` (x INT);\n", "CREATE TABLE `c` (x INT);"), 2)
+	c.Assert(err, IsNil)
+	c.Assert(mock.check(), IsNil)
+
+	// the batch size of 1 sends the statements one by one.
+	db, mock = newMockDB()
+	mock.expect("^USE `db`$")
+	mock.expect("^CREATE TABLE IF NOT EXISTS\\s+`a`")
+	mock.expect("^CREATE TABLE IF NOT EXISTS\\s+`b`")
+	err = createTables(ctx, db, "db", stmtsOf("CREATE TABLE `a` (x INT);", "CREATE TABLE `b` (x INT);"), 1)
+	c.Assert(err, IsNil)
+	c.Assert(mock.check(), IsNil)
+
+	// the failed batch is retried one by one to find the failing statement.
+	db, mock = newMockDB()
+	mock.expect("^USE `db`$")
+	mock.expect("^CREATE TABLE IF NOT EXISTS\\s+`a`.*;\nCREATE TABLE IF NOT EXISTS\\s+`b`.*;\nCREATE TABLE IF NOT EXISTS\\s+`c`").
+		willFail(&mysql.MySQLError{Number: 1064, Message: "syntax error"})
+	mock.expect("^CREATE TABLE IF NOT EXISTS\\s+`a`")
+	mock.expect("^CREATE TABLE IF NOT EXISTS\\s+`b`").willFail(&mysql.MySQLError{Number: 1064, Message: "syntax error near b"})
+	err = createTables(ctx, db, "db", stmtsOf("CREATE TABLE `a` (x INT);", "CREATE TABLE `b` (x INT BAD);", "CREATE TABLE `c` (x INT);"), 3)
+	c.Assert(err, ErrorMatches, ".*syntax error near b")
+	c.Assert(mock.check(), IsNil)
+}
+
+func (s *tidbSuite) TestObtainNextAutoID(c *C) {
+	ctx := context.Background()
+	columns := []string{"DB_NAME", "TABLE_NAME", "COLUMN_NAME", "NEXT_GLOBAL_ROW_ID", "ID_TYPE"}
+
+	// the ID of the requested type is taken.
+	for _, autoRandom := range []bool{false, true} {
+		db, mock := newMockDB()
+		mock.expect("^SHOW TABLE `db`.`t` NEXT_ROW_ID$").willReturnRows(columns,
+			[]driver.Value{"db", "t", "_tidb_rowid", "101", "_TIDB_ROWID"},
+			[]driver.Value{"db", "t", "id", "201", "AUTO_RANDOM"},
+		)
+		nextID, err := ObtainNextAutoID(ctx, db, "db", "t", autoRandom)
+		c.Assert(err, IsNil)
+		c.Assert(mock.check(), IsNil)
+		if autoRandom {
+			c.Assert(nextID, Equals, int64(201))
+		} else {
+			c.Assert(nextID, Equals, int64(101))
+		}
+	}
+
+	// TiDB before 4.0 has no ID_TYPE.
+	db, mock := newMockDB()
+	mock.expect("^SHOW TABLE `db`.`t` NEXT_ROW_ID$").willReturnRows(columns[:4],
+		[]driver.Value{"db", "t", "id", "51"},
+	)
+	nextID, err := ObtainNextAutoID(ctx, db, "db", "t", false)
+	c.Assert(err, IsNil)
+	c.Assert(nextID, Equals, int64(51))
+	c.Assert(mock.check(), IsNil)
+
+	// TiDB before 3.0 cannot parse SHOW TABLE NEXT_ROW_ID.
+	db, mock = newMockDB()
+	mock.expect("^SHOW TABLE `db`.`t` NEXT_ROW_ID$").willFail(&mysql.MySQLError{Number: 1064, Message: "syntax error"})
+	mock.expect("^SELECT AUTO_INCREMENT FROM information_schema.TABLES ", "db", "t").
+		willReturnRows([]string{"AUTO_INCREMENT"}, []driver.Value{int64(31)})
+	nextID, err = ObtainNextAutoID(ctx, db, "db", "t", false)
+	c.Assert(err, IsNil)
+	c.Assert(nextID, Equals, int64(31))
+	c.Assert(mock.check(), IsNil)
+}
+
+func (s *tidbSuite) TestAutoRandomBitsOf(c *C) {
+	c.Assert(autoRandomBitsOf("CREATE TABLE t (a BIGINT PRIMARY KEY AUTO_INCREMENT)"), Equals, uint64(0))
+	c.Assert(autoRandomBitsOf("CREATE TABLE t (a BIGINT PRIMARY KEY /*T![auto_rand] AUTO_RANDOM(3) */) /*T![auto_rand_base] AUTO_RANDOM_BASE=10 */"), Equals, uint64(3))
+	c.Assert(autoRandomBitsOf("CREATE TABLE t (a BIGINT PRIMARY KEY auto_random)"), Equals, uint64(5))
+	c.Assert(autoRandomBitsOf("CREATE TABLE t (a BIGINT PRIMARY KEY) AUTO_RANDOM_BASE=10"), Equals, uint64(0))
+}
+
+func (s *tidbSuite) TestIsCommonHandleOf(c *C) {
+	testCases := []struct {
+		createTable    string
+		isCommonHandle bool
+	}{
+		{"CREATE TABLE t (a BIGINT PRIMARY KEY /*T![clustered_index] CLUSTERED */, b INT)", false},
+		{"CREATE TABLE t (a VARCHAR(10), b INT, PRIMARY KEY (a, b) /*T![clustered_index] CLUSTERED */)", true},
+		{"CREATE TABLE t (a VARCHAR(10), b INT, PRIMARY KEY (a) /*T![clustered_index] NONCLUSTERED */)", false},
+		{"CREATE TABLE t (a VARCHAR(10), b INT, PRIMARY KEY (a))", false},
+		{"CREATE TABLE t (a VARCHAR(10), b INT, UNIQUE KEY (a)) COMMENT 'clustered'", false},
+		{"CREATE TABLE t (a VARCHAR(10), b INT, PRIMARY KEY (a)) COMMENT 'clustered'", false},
+		{"CREATE TABLE t (a VARCHAR(10) DEFAULT 'clustered', clustered INT, PRIMARY KEY (a))", false},
+		{"CREATE TABLE t (a VARCHAR(10), `b /*T![clustered_index] CLUSTERED */` INT, PRIMARY KEY (a)) /* CLUSTERED */", false},
+		{"CREATE TABLE t (a VARCHAR(10) COMMENT 'it''s /*T![clustered_index] CLUSTERED */', PRIMARY KEY (a))", false},
+		{"CREATE TABLE `clustered` (a VARCHAR(10) PRIMARY KEY /*T![clustered_index] CLUSTERED */)", true},
+	}
+	for _, tc := range testCases {
+		info, err := parseSchemaInfo(tc.createTable)
+		c.Assert(err, IsNil)
+		c.Assert(isCommonHandleOf(tc.createTable, info.TableInfo), Equals, tc.isCommonHandle, Commentf("%s", tc.createTable))
+	}
+}
+
+func (s *tidbSuite) TestSQLComments(c *C) {
+	c.Assert(sqlComments("SELECT 1"), HasLen, 0)
+	c.Assert(sqlComments("SELECT '/* a */', \"\\\" /* b */\", `a`` /* c */`, 1 /* d */ -- /* e */\n# /* f */\n/*! g */ /* h"), DeepEquals, []string{"/* d */", "/*! g */"})
+}
+
+func (s *tidbSuite) TestSessionVarsDSN(c *C) {
+	dsn := config.DBStore{
+		Host:                       "127.0.0.1",
+		Port:                       4000,
+		User:                       "root",
+		BuildStatsConcurrency:      20,
+		DistSQLScanConcurrency:     100,
+		IndexSerialScanConcurrency: 20,
+		ChecksumTableConcurrency:   16,
+		SessionVars: map[string]string{
+			"tidb_mem_quota_query":          "4294967296",
+			"tidb_distsql_scan_concurrency": "50",
+			"tidb_isolation_read_engines":   "tikv,tidb",
+			"quoted":                        `it's \`,
+		},
+	}
+	cfg, err := mysql.ParseDSN(common.ToDSN(dsn.Host, dsn.Port, dsn.User, dsn.Psw, dsn.TLS) + sessionVarsDSN(dsn))
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Params, DeepEquals, map[string]string{
+		"charset":                            "utf8",
+		"tidb_build_stats_concurrency":       "20",
+		"tidb_distsql_scan_concurrency":      "'50'",
+		"tidb_index_serial_scan_concurrency": "20",
+		"tidb_checksum_table_concurrency":    "16",
+		"tidb_mem_quota_query":               "'4294967296'",
+		"tidb_isolation_read_engines":        "'tikv,tidb'",
+		"quoted":                             `'it\'s \\'`,
+	})
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+)
+
+// interval between queries of the TiFlash replica status.
+const tiflashCheckInterval = 30 * time.Second
+
+// tiflashReplicaStatus returns the number of TiFlash replicas of the table and
+// their sync status. The count is 0 if the table has no TiFlash replica, or
+// the TiDB does not support TiFlash at all.
+func (tr *TableRestore) tiflashReplicaStatus(ctx context.Context, db *sql.DB) (count uint64, available bool, progress float64, err error) {
+	query := "SELECT REPLICA_COUNT, AVAILABLE, PROGRESS FROM information_schema.tiflash_replica WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?"
+	err = common.Retry(ctx, "query TiFlash replica of "+tr.tableName, func() error {
+		err := db.QueryRowContext(ctx, query, tr.dbInfo.Name, tr.tableInfo.Name).Scan(&count, &available, &progress)
+		if err == sql.ErrNoRows || isTableNotExistError(err) {
+			count = 0
+			return nil
+		}
+		return errors.Trace(err)
+	})
+	return
+}
+
+// waitTiFlashReplica blocks until the TiFlash replicas of the table are
+// available, logging the progress every tiflashCheckInterval.
+func (tr *TableRestore) waitTiFlashReplica(ctx context.Context, db *sql.DB, timeout time.Duration) error {
+	timer := time.Now()
+	deadline := time.After(timeout)
+	for {
+		count, available, progress, err := tr.tiflashReplicaStatus(ctx, db)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if count == 0 {
+			tr.logger().Info("no TiFlash replica, skip waiting")
+			return nil
+		}
+		if available {
+			tr.logger().Infof("%d TiFlash replicas are available, waited %v", count, time.Since(timer))
+			return nil
+		}
+		tr.logger().Infof("waiting for %d TiFlash replicas, progress %.2f%%", count, progress*100)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return errors.Errorf("TiFlash replicas are not available after %v, progress %.2f%%", timeout, progress*100)
+		case <-time.After(tiflashCheckInterval):
+		}
+	}
+}
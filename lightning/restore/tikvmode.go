@@ -0,0 +1,77 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	sstpb "github.com/pingcap/kvproto/pkg/import_sstpb"
+
+	"github.com/pingcap/tidb-lightning/lightning/config"
+)
+
+// the name of the task meta in the checkpoints storing the TiKVModeRecord.
+const tikvModeTaskMeta = "tikv-mode"
+
+// TiKVModeRecord is the mode TiKV was last switched to by lightning or
+// lightning-ctl for the task. TiKV cannot be asked for its mode, so the mode
+// is recorded in the checkpoints whenever it is switched.
+type TiKVModeRecord struct {
+	Mode       string    `json:"mode"`
+	PdAddr     string    `json:"pd-addr"`
+	SwitchedAt time.Time `json:"switched-at"`
+}
+
+// LoadTiKVModeRecord reads the TiKV mode record, or returns nil if TiKV has
+// never been switched.
+func LoadTiKVModeRecord(ctx context.Context, cpdb CheckpointsDB) (*TiKVModeRecord, error) {
+	content, err := cpdb.GetTaskMeta(ctx, tikvModeTaskMeta)
+	if err != nil || content == nil {
+		return nil, errors.Trace(err)
+	}
+	record := new(TiKVModeRecord)
+	if err := json.Unmarshal(content, record); err != nil {
+		return nil, errors.Annotatef(err, "invalid task meta %s in the checkpoints", tikvModeTaskMeta)
+	}
+	return record, nil
+}
+
+// SaveTiKVModeRecord records that TiKV has just been switched to the mode.
+func SaveTiKVModeRecord(ctx context.Context, cpdb CheckpointsDB, cfg *config.Config, mode sstpb.SwitchMode) error {
+	content, err := json.Marshal(&TiKVModeRecord{
+		Mode:       strings.ToLower(mode.String()),
+		PdAddr:     cfg.TiDB.PdAddr,
+		SwitchedAt: time.Now(),
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(cpdb.UpdateTaskMeta(ctx, tikvModeTaskMeta, content))
+}
+
+// RecordTiKVMode saves the TiKV mode record into the checkpoints of the task,
+// for the switches made outside of a restore.
+func RecordTiKVMode(ctx context.Context, cfg *config.Config, mode sstpb.SwitchMode) error {
+	cpdb, err := OpenCheckpointsDB(ctx, cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer cpdb.Close()
+
+	return errors.Trace(SaveTiKVModeRecord(ctx, cpdb, cfg, mode))
+}
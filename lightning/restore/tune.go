@@ -0,0 +1,174 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/worker"
+)
+
+const concurrencyTuneInterval = 30 * time.Second
+
+const (
+	// the adaptive block size is kept within read-block-size divided and
+	// multiplied by this.
+	blockSizeRange = 16
+	// the adaptive block size is at least this, not to read tiny blocks.
+	minAdaptiveBlockSize = 4096
+
+	// the block is grown if encoding it takes less than this, since the
+	// overhead of each block dominates, and shrunk if more.
+	minBlockEncodeTime = 20 * time.Millisecond
+	maxBlockEncodeTime = 500 * time.Millisecond
+)
+
+// concurrencyTuner adjusts the region concurrency according to where the
+// chunk restore goroutines spend their time. A nil *concurrencyTuner records
+// nothing.
+type concurrencyTuner struct {
+	pool     *worker.Pool
+	minLimit int
+	maxLimit int
+
+	// the durations below are in nanoseconds, and reset on every tune().
+	encodeTime       int64 // time spent on encoding SQL into KV pairs
+	backpressureTime int64 // time the encoders waited for the delivery to catch up
+	workerWaitTime   int64 // time the chunks waited for an idle region worker
+}
+
+func newConcurrencyTuner(pool *worker.Pool, regionConcurrency int) *concurrencyTuner {
+	minLimit := regionConcurrency / 2
+	if minLimit < 1 {
+		minLimit = 1
+	}
+	return &concurrencyTuner{
+		pool:     pool,
+		minLimit: minLimit,
+		maxLimit: regionConcurrency * 2,
+	}
+}
+
+func (t *concurrencyTuner) addEncodeTime(d time.Duration) {
+	if t != nil {
+		atomic.AddInt64(&t.encodeTime, int64(d))
+	}
+}
+
+func (t *concurrencyTuner) addBackpressureTime(d time.Duration) {
+	if t != nil {
+		atomic.AddInt64(&t.backpressureTime, int64(d))
+	}
+}
+
+func (t *concurrencyTuner) addWorkerWaitTime(d time.Duration) {
+	if t != nil {
+		atomic.AddInt64(&t.workerWaitTime, int64(d))
+	}
+}
+
+// decideConcurrency computes the next region concurrency from the time spent
+// during the last interval.
+//
+// When the encoders spend a large portion of time waiting for the delivery,
+// adding more encoders only piles up KV pairs in memory, so the concurrency is
+// reduced. When chunks are waiting for region workers while the delivery keeps
+// up, the encoders are the bottleneck, so the concurrency is increased.
+func decideConcurrency(current, minLimit, maxLimit int, encode, backpressure, workerWait, interval time.Duration) int {
+	switch {
+	case backpressure*2 > encode && current > minLimit:
+		return current - 1
+	case workerWait*10 > interval && backpressure*10 < encode && current < maxLimit:
+		return current + 1
+	default:
+		return current
+	}
+}
+
+// blockSizer adjusts the size of the blocks a chunk is read and encoded in. A
+// non-adaptive blockSizer keeps the initial size.
+type blockSizer struct {
+	size    int64
+	minSize int64
+	maxSize int64
+}
+
+func newBlockSizer(readBlockSize int64, adaptive bool) *blockSizer {
+	s := &blockSizer{size: readBlockSize, minSize: readBlockSize, maxSize: readBlockSize}
+	if adaptive {
+		s.minSize = readBlockSize / blockSizeRange
+		if s.minSize < minAdaptiveBlockSize {
+			s.minSize = minAdaptiveBlockSize
+		}
+		if s.minSize > readBlockSize {
+			s.minSize = readBlockSize
+		}
+		s.maxSize = readBlockSize * blockSizeRange
+	}
+	return s
+}
+
+// observe records a block of `bytes` encoded in `encodeDur`, and returns
+// whether the size is changed.
+func (s *blockSizer) observe(bytes int64, encodeDur time.Duration) bool {
+	next := decideBlockSize(s.size, s.minSize, s.maxSize, bytes, encodeDur)
+	changed := next != s.size
+	s.size = next
+	return changed
+}
+
+// decideBlockSize computes the next block size from the last block.
+//
+// A block is read until the end of the row crossing the block size, so a block
+// much larger than the block size means the rows are large, and the block is
+// shrunk until it holds only a few of them. A block of tiny rows is encoded
+// fast, and then the block is grown to save the overhead of each block, e.g.
+// the delivery and the checksum.
+func decideBlockSize(current, minSize, maxSize, bytes int64, encodeDur time.Duration) int64 {
+	switch {
+	case bytes > current*2 || encodeDur > maxBlockEncodeTime:
+		current /= 2
+		if current < minSize {
+			current = minSize
+		}
+	case bytes >= current && encodeDur < minBlockEncodeTime && current < maxSize:
+		current *= 2
+		if current > maxSize {
+			current = maxSize
+		}
+	}
+	return current
+}
+
+func (t *concurrencyTuner) tune(interval time.Duration) {
+	encode := time.Duration(atomic.SwapInt64(&t.encodeTime, 0))
+	backpressure := time.Duration(atomic.SwapInt64(&t.backpressureTime, 0))
+	workerWait := time.Duration(atomic.SwapInt64(&t.workerWaitTime, 0))
+	if encode == 0 {
+		// nothing is being encoded, e.g. all engines are importing.
+		return
+	}
+
+	current := t.pool.Limit()
+	next := decideConcurrency(current, t.minLimit, t.maxLimit, encode, backpressure, workerWait, interval)
+	if next != current {
+		common.AppLogger.Infof(
+			"[auto-tune] region-concurrency %d -> %d (encode %v, waiting for delivery %v, waiting for workers %v)",
+			current, next, encode, backpressure, workerWait,
+		)
+		t.pool.Resize(next)
+	}
+}
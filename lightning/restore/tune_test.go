@@ -0,0 +1,90 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package restore
+
+import (
+	"context"
+	"time"
+
+	. "github.com/pingcap/check"
+
+	"github.com/pingcap/tidb-lightning/lightning/worker"
+)
+
+var _ = Suite(&tuneSuite{})
+
+type tuneSuite struct{}
+
+func (s *tuneSuite) TestDecideConcurrency(c *C) {
+	interval := 30 * time.Second
+
+	// delivery backpressure dominates.
+	c.Assert(decideConcurrency(8, 4, 16, 10*time.Second, 6*time.Second, 0, interval), Equals, 7)
+	c.Assert(decideConcurrency(4, 4, 16, 10*time.Second, 6*time.Second, 0, interval), Equals, 4)
+
+	// chunks are waiting for encoders.
+	c.Assert(decideConcurrency(8, 4, 16, 100*time.Second, time.Second, 10*time.Second, interval), Equals, 9)
+	c.Assert(decideConcurrency(16, 4, 16, 100*time.Second, time.Second, 10*time.Second, interval), Equals, 16)
+
+	// balanced.
+	c.Assert(decideConcurrency(8, 4, 16, 100*time.Second, 20*time.Second, 10*time.Second, interval), Equals, 8)
+	c.Assert(decideConcurrency(8, 4, 16, 100*time.Second, time.Second, time.Second, interval), Equals, 8)
+}
+
+func (s *tuneSuite) TestTune(c *C) {
+	pool := worker.NewResizablePool(context.Background(), 4, 8, "test-tune")
+	tuner := newConcurrencyTuner(pool, 4)
+
+	tuner.addEncodeTime(10 * time.Second)
+	tuner.addBackpressureTime(8 * time.Second)
+	tuner.tune(concurrencyTuneInterval)
+	c.Assert(pool.Limit(), Equals, 3)
+
+	// the statistics are reset after tuning.
+	tuner.tune(concurrencyTuneInterval)
+	c.Assert(pool.Limit(), Equals, 3)
+
+	// a nil tuner ignores everything.
+	var nilTuner *concurrencyTuner
+	nilTuner.addEncodeTime(time.Second)
+}
+
+func (s *tuneSuite) TestDecideBlockSize(c *C) {
+	// tiny rows encoded fast.
+	c.Assert(decideBlockSize(65536, 4096, 1048576, 65600, 5*time.Millisecond), Equals, int64(131072))
+	c.Assert(decideBlockSize(1048576, 4096, 1048576, 1048600, 5*time.Millisecond), Equals, int64(1048576))
+	// the last block of the chunk is not full.
+	c.Assert(decideBlockSize(65536, 4096, 1048576, 100, 5*time.Millisecond), Equals, int64(65536))
+
+	// large rows overshoot the block.
+	c.Assert(decideBlockSize(65536, 4096, 1048576, 4194304, 5*time.Millisecond), Equals, int64(32768))
+	c.Assert(decideBlockSize(4096, 4096, 1048576, 4194304, 5*time.Millisecond), Equals, int64(4096))
+	// encoding is slow.
+	c.Assert(decideBlockSize(65536, 4096, 1048576, 65600, time.Second), Equals, int64(32768))
+
+	// balanced.
+	c.Assert(decideBlockSize(65536, 4096, 1048576, 65600, 100*time.Millisecond), Equals, int64(65536))
+}
+
+func (s *tuneSuite) TestBlockSizer(c *C) {
+	sizer := newBlockSizer(65536, false)
+	c.Assert(sizer.observe(65600, time.Millisecond), IsFalse)
+	c.Assert(sizer.size, Equals, int64(65536))
+
+	sizer = newBlockSizer(65536, true)
+	c.Assert(sizer.minSize, Equals, int64(4096))
+	c.Assert(sizer.maxSize, Equals, int64(1048576))
+	c.Assert(sizer.observe(65600, time.Millisecond), IsTrue)
+	c.Assert(sizer.size, Equals, int64(131072))
+}
@@ -0,0 +1,252 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lightning
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/config"
+)
+
+var (
+	errTaskNotFound = errors.New("task not found")
+	errTaskStarted  = errors.New("task already started")
+)
+
+// QueuedTask is a task submitted in server mode.
+type QueuedTask struct {
+	ID int64 `json:"id"`
+	// Priority orders the tasks in the queue, the higher the earlier.
+	Priority int `json:"priority"`
+	// NotBefore is the earliest time to start the task. The zero value means
+	// the task can start at once.
+	NotBefore  time.Time `json:"not-before"`
+	SubmitTime time.Time `json:"submit-time"`
+	// Started is set once the task starts, so it is resumed first after a
+	// restart.
+	Started bool `json:"started"`
+	// Config is the TOML content of the task, applied on top of the config
+	// file.
+	Config string `json:"config"`
+}
+
+type taskQueueFile struct {
+	NextID int64         `json:"next-id"`
+	Tasks  []*QueuedTask `json:"tasks"`
+}
+
+// taskQueue keeps the tasks submitted in server mode, in the order they are
+// started: the started task first, then by the priority, then by the order
+// submitted. The queue is saved into the file on every change, so it survives
+// restarts. The tasks are removed once finished.
+type taskQueue struct {
+	lock    sync.Mutex
+	path    string
+	file    taskQueueFile
+	changed chan struct{} // closed on the next change
+}
+
+// openTaskQueue loads the queue saved in the file, if any.
+func openTaskQueue(path string) (*taskQueue, error) {
+	q := &taskQueue{
+		path:    path,
+		file:    taskQueueFile{NextID: 1},
+		changed: make(chan struct{}),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := json.Unmarshal(data, &q.file); err != nil {
+		return nil, errors.Annotatef(err, "corrupted task queue %s", path)
+	}
+	return q, nil
+}
+
+// updateLocked saves the tasks as the new content of the queue, and wakes up
+// the scheduler. The queue is unchanged if it cannot be saved.
+func (q *taskQueue) updateLocked(tasks []*QueuedTask, nextID int64) error {
+	sort.SliceStable(tasks, func(i, j int) bool {
+		a, b := tasks[i], tasks[j]
+		switch {
+		case a.Started != b.Started:
+			return a.Started
+		case a.Priority != b.Priority:
+			return a.Priority > b.Priority
+		default:
+			return a.ID < b.ID
+		}
+	})
+	file := taskQueueFile{NextID: nextID, Tasks: tasks}
+	data, err := json.Marshal(&file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// a crash while writing must not leave a broken queue.
+	tmpPath := q.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.Rename(tmpPath, q.path); err != nil {
+		return errors.Trace(err)
+	}
+
+	q.file = file
+	close(q.changed)
+	q.changed = make(chan struct{})
+	return nil
+}
+
+// tasksExceptLocked copies the tasks, leaving out the given one, which is
+// returned too, or nil if not found.
+func (q *taskQueue) tasksExceptLocked(id int64) ([]*QueuedTask, *QueuedTask) {
+	tasks := make([]*QueuedTask, 0, len(q.file.Tasks))
+	var found *QueuedTask
+	for _, task := range q.file.Tasks {
+		if task.ID == id {
+			found = task
+		} else {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, found
+}
+
+// push adds the task into the queue, and returns its ID.
+func (q *taskQueue) push(task QueuedTask) (int64, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	task.ID = q.file.NextID
+	task.Started = false
+	tasks := append(append([]*QueuedTask(nil), q.file.Tasks...), &task)
+	if err := q.updateLocked(tasks, task.ID+1); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return task.ID, nil
+}
+
+// list returns the tasks in the order they are started.
+func (q *taskQueue) list() []QueuedTask {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	tasks := make([]QueuedTask, 0, len(q.file.Tasks))
+	for _, task := range q.file.Tasks {
+		tasks = append(tasks, *task)
+	}
+	return tasks
+}
+
+// remove cancels a task which is not started yet.
+func (q *taskQueue) remove(id int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	tasks, task := q.tasksExceptLocked(id)
+	switch {
+	case task == nil:
+		return errors.Annotatef(errTaskNotFound, "%d", id)
+	case task.Started:
+		return errors.Annotatef(errTaskStarted, "%d", id)
+	}
+	return errors.Trace(q.updateLocked(tasks, q.file.NextID))
+}
+
+// finish removes a started task.
+func (q *taskQueue) finish(id int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	tasks, task := q.tasksExceptLocked(id)
+	if task == nil {
+		return errors.Annotatef(errTaskNotFound, "%d", id)
+	}
+	return errors.Trace(q.updateLocked(tasks, q.file.NextID))
+}
+
+// next waits for the first task which can start, i.e. its not-before time has
+// passed and the maintenance window is open, and marks it started.
+func (q *taskQueue) next(ctx context.Context, window *config.TimeWindow) (*QueuedTask, error) {
+	for {
+		q.lock.Lock()
+		now := time.Now()
+		var (
+			task   *QueuedTask
+			wakeUp time.Time // zero if only a change can make a task start
+		)
+		for _, t := range q.file.Tasks {
+			if t.Started || !t.NotBefore.After(now) {
+				task = t
+				break
+			}
+			if wakeUp.IsZero() || t.NotBefore.Before(wakeUp) {
+				wakeUp = t.NotBefore
+			}
+		}
+
+		if task != nil {
+			start := window.Next(now)
+			if !start.After(now) {
+				started := *task
+				started.Started = true
+				tasks, _ := q.tasksExceptLocked(task.ID)
+				err := q.updateLocked(append(tasks, &started), q.file.NextID)
+				q.lock.Unlock()
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+				return &started, nil
+			}
+			common.AppLogger.Infof("task %d is waiting for the maintenance window %s, which opens at %v", task.ID, window, start)
+			wakeUp = start
+		}
+		changed := q.changed
+		q.lock.Unlock()
+
+		if err := waitChange(ctx, changed, wakeUp.Sub(now), !wakeUp.IsZero()); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// waitChange blocks until the channel is closed, or the timeout passes if
+// enabled.
+func waitChange(ctx context.Context, changed <-chan struct{}, timeout time.Duration, hasTimeout bool) error {
+	var timeoutCh <-chan time.Time
+	if hasTimeout {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	select {
+	case <-changed:
+	case <-timeoutCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
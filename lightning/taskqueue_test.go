@@ -0,0 +1,147 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lightning
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/tidb-lightning/lightning/config"
+)
+
+func TestLightning(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&taskQueueSuite{})
+
+type taskQueueSuite struct {
+	path string
+}
+
+func (s *taskQueueSuite) SetUpTest(c *C) {
+	s.path = filepath.Join(c.MkDir(), "queue.json")
+}
+
+func (s *taskQueueSuite) open(c *C) *taskQueue {
+	queue, err := openTaskQueue(s.path)
+	c.Assert(err, IsNil)
+	return queue
+}
+
+func taskIDs(tasks []QueuedTask) []int64 {
+	ids := make([]int64, 0, len(tasks))
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+	return ids
+}
+
+func (s *taskQueueSuite) TestOrderAndPersistence(c *C) {
+	queue := s.open(c)
+	for _, priority := range []int{0, 5, 0, -1, 5} {
+		_, err := queue.push(QueuedTask{Priority: priority, Config: "[mydumper]\n"})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(taskIDs(queue.list()), DeepEquals, []int64{2, 5, 1, 3, 4})
+
+	task, err := queue.next(context.Background(), &config.TimeWindow{})
+	c.Assert(err, IsNil)
+	c.Assert(task.ID, Equals, int64(2))
+	c.Assert(task.Started, IsTrue)
+	c.Assert(task.Config, Equals, "[mydumper]\n")
+	c.Assert(queue.remove(3), IsNil)
+
+	// the started task comes first after a restart, and the IDs are not
+	// reused.
+	queue = s.open(c)
+	c.Assert(taskIDs(queue.list()), DeepEquals, []int64{2, 5, 1, 4})
+	id, err := queue.push(QueuedTask{Priority: 9})
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, int64(6))
+	c.Assert(taskIDs(queue.list()), DeepEquals, []int64{2, 6, 5, 1, 4})
+
+	task, err = queue.next(context.Background(), &config.TimeWindow{})
+	c.Assert(err, IsNil)
+	c.Assert(task.ID, Equals, int64(2))
+	c.Assert(queue.finish(2), IsNil)
+	c.Assert(taskIDs(s.open(c).list()), DeepEquals, []int64{6, 5, 1, 4})
+}
+
+func (s *taskQueueSuite) TestRemove(c *C) {
+	queue := s.open(c)
+	_, err := queue.push(QueuedTask{})
+	c.Assert(err, IsNil)
+	_, err = queue.next(context.Background(), &config.TimeWindow{})
+	c.Assert(err, IsNil)
+
+	c.Assert(errors.Cause(queue.remove(1)), Equals, errTaskStarted)
+	c.Assert(errors.Cause(queue.remove(2)), Equals, errTaskNotFound)
+	c.Assert(errors.Cause(queue.finish(2)), Equals, errTaskNotFound)
+}
+
+func (s *taskQueueSuite) TestCorruptedQueue(c *C) {
+	c.Assert(ioutil.WriteFile(s.path, []byte("{"), 0644), IsNil)
+	_, err := openTaskQueue(s.path)
+	c.Assert(err, ErrorMatches, "corrupted task queue .*")
+}
+
+func (s *taskQueueSuite) TestNextWaitsForNotBefore(c *C) {
+	queue := s.open(c)
+	notBefore := time.Now().Add(200 * time.Millisecond)
+	_, err := queue.push(QueuedTask{Priority: 9, NotBefore: notBefore})
+	c.Assert(err, IsNil)
+
+	// the task submitted later starts first, since the other one must wait.
+	done := make(chan *QueuedTask)
+	go func() {
+		task, err := queue.next(context.Background(), &config.TimeWindow{})
+		c.Assert(err, IsNil)
+		done <- task
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_, err = queue.push(QueuedTask{})
+	c.Assert(err, IsNil)
+	task := <-done
+	c.Assert(task.ID, Equals, int64(2))
+	c.Assert(queue.finish(2), IsNil)
+
+	task, err = queue.next(context.Background(), &config.TimeWindow{})
+	c.Assert(err, IsNil)
+	c.Assert(task.ID, Equals, int64(1))
+	c.Assert(time.Now().Before(notBefore), IsFalse)
+}
+
+func (s *taskQueueSuite) TestNextWaitsForWindow(c *C) {
+	queue := s.open(c)
+	_, err := queue.push(QueuedTask{})
+	c.Assert(err, IsNil)
+
+	// a window of an hour which opens in an hour.
+	start := time.Now().Add(time.Hour)
+	var window config.TimeWindow
+	c.Assert(window.UnmarshalText([]byte(start.Format("15:04")+"-"+start.Add(time.Hour).Format("15:04"))), IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = queue.next(ctx, &window)
+	c.Assert(errors.Cause(err), Equals, context.DeadlineExceeded)
+	c.Assert(queue.list()[0].Started, IsFalse)
+}
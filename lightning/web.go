@@ -0,0 +1,433 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lightning
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/pingcap/tidb-lightning/lightning/common"
+	"github.com/pingcap/tidb-lightning/lightning/restore"
+)
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"percent": func(a, b float64) float64 {
+		if b == 0 {
+			return 0
+		}
+		return a / b * 100
+	},
+	"mib": func(bytes interface{}) float64 {
+		switch b := bytes.(type) {
+		case int64:
+			return float64(b) / 1048576
+		case float64:
+			return b / 1048576
+		default:
+			return 0
+		}
+	},
+	"round": func(d time.Duration) time.Duration {
+		return d.Round(time.Second)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>TiDB Lightning</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>TiDB Lightning</h1>
+{{- with .}}
+<table>
+<tr><th>Started</th><td>{{.StartTime.Format "2006-01-02 15:04:05"}} ({{round .Elapsed}} ago)</td></tr>
+<tr><th>TiKV mode</th><td>{{.TiKVMode}}</td></tr>
+<tr><th>Paused</th><td>{{.Paused}}</td></tr>
+<tr><th>Disk quota used</th><td>{{printf "%.2f MiB" (mib .DiskQuotaUsed)}}</td></tr>
+<tr><th>Chunks</th><td>{{printf "%.0f/%.0f (%.1f%%)" .FinishedChunks .EstimatedChunks (percent .FinishedChunks .EstimatedChunks)}}</td></tr>
+<tr><th>Tables</th><td>{{printf "%.0f/%.0f (%.1f%%)" .CompletedTables .TotalTables (percent .CompletedTables .TotalTables)}}</td></tr>
+<tr><th>Speed</th><td>{{printf "%.2f MiB/s" (mib .Speed)}}</td></tr>
+</table>
+
+{{- if .Errors}}
+<h2>Errors</h2>
+<table>
+<tr><th>Table</th><th>Step</th><th>Error</th></tr>
+{{- range .Errors}}
+<tr class="error"><td>{{.TableName}}</td><td>{{.Status}}</td><td>{{.Error}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+
+<h2>Tables</h2>
+<table>
+<tr><th>Table</th><th>Status</th><th>Engine</th><th>Engine status</th><th>Chunks</th><th>Remaining</th></tr>
+{{- range .Tables}}
+{{- $table := .}}
+{{- range .Engines}}
+<tr><td>{{$table.Name}}</td><td>{{$table.Status}}</td><td>{{.ID}}</td><td>{{.Status}}</td><td>{{.Chunks}}</td><td>{{printf "%.2f MiB" (mib .RemainingBytes)}}</td></tr>
+{{- else}}
+<tr><td>{{$table.Name}}</td><td>{{$table.Status}}</td><td colspan="4"></td></tr>
+{{- end}}
+{{- end}}
+</table>
+<script>
+// reloads the page soon after a checkpoint changes, if the checkpoints can be
+// watched.
+if (window.EventSource) {
+	var reloading = false;
+	new EventSource("/tasks/current/checkpoints").onmessage = function() {
+		if (!reloading) {
+			reloading = true;
+			setTimeout(function() { location.reload(); }, 1000);
+		}
+	};
+}
+</script>
+{{- else}}
+<p>No task is running.</p>
+{{- end}}
+</body>
+</html>
+`))
+
+// goServe starts the status server, which also serves the Prometheus metrics
+// and the pprof profiles. It uses HTTPS if the certificate of Lightning is
+// given in [security], and then only accepts the clients presenting a
+// certificate signed by the CA.
+func (l *Lightning) goServe(statusAddr string) {
+	tls, err := common.NewTLS(l.cfg.Security.CAPath, l.cfg.Security.CertPath, l.cfg.Security.KeyPath)
+	if err != nil {
+		common.AppLogger.Errorf("cannot start the status server: %v", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/", l.handleStatusPage)
+	mux.HandleFunc("/tasks", l.handleTasks)
+	mux.HandleFunc("/tasks/", l.handleQueuedTask)
+	mux.HandleFunc("/tasks/current", l.handleCurrentTask)
+	mux.HandleFunc("/progress", l.handleProgress)
+	mux.HandleFunc("/tasks/current/checkpoints", l.handleCheckpoints)
+	mux.HandleFunc("/tasks/current/pause", l.handleTaskControl(func(task *restore.RestoreController) {
+		task.Pause()
+	}))
+	mux.HandleFunc("/tasks/current/resume", l.handleTaskControl(func(task *restore.RestoreController) {
+		task.Resume()
+	}))
+	mux.HandleFunc("/settings", l.handleSettings)
+	mux.HandleFunc("/tasks/current/stop", l.handleTaskControl(func(*restore.RestoreController) {
+		common.AppLogger.Info("stopping the task as requested")
+		go l.Stop()
+	}))
+
+	server := &http.Server{
+		Addr:      statusAddr,
+		Handler:   onlyTrustedControl(mux),
+		TLSConfig: tls.ServerTLSConfig(),
+	}
+	go func() {
+		if server.TLSConfig != nil {
+			common.AppLogger.Infof("starting status server at https://%s", statusAddr)
+			common.AppLogger.Info(server.ListenAndServeTLS("", ""))
+		} else {
+			common.AppLogger.Infof("starting status server at %s", statusAddr)
+			common.AppLogger.Info(server.ListenAndServe())
+		}
+	}()
+}
+
+// onlyTrustedControl rejects the requests controlling Lightning, i.e. those
+// other than GET and HEAD, unless they come from localhost, or present a
+// certificate verified by the CA.
+func onlyTrustedControl(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead && !isTrustedClient(req) {
+			http.Error(w, "Lightning can only be controlled from localhost, or by the clients with a certificate", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+func isTrustedClient(req *http.Request) bool {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (l *Lightning) currentTask() *restore.RestoreController {
+	l.serverLock.Lock()
+	defer l.serverLock.Unlock()
+	return l.curTask
+}
+
+func (l *Lightning) currentTaskQueue() *taskQueue {
+	l.serverLock.Lock()
+	defer l.serverLock.Unlock()
+	return l.taskQueue
+}
+
+func (l *Lightning) currentStatus(req *http.Request) *restore.TaskStatus {
+	curTask := l.currentTask()
+	if curTask == nil {
+		return nil
+	}
+	return curTask.Status(req.Context())
+}
+
+func (l *Lightning) handleStatusPage(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPageTemplate.Execute(w, l.currentStatus(req)); err != nil {
+		common.AppLogger.Warnf("failed to render status page: %v", err)
+	}
+}
+
+func (l *Lightning) handleCurrentTask(w http.ResponseWriter, req *http.Request) {
+	status := l.currentStatus(req)
+	if status == nil {
+		http.Error(w, "no task is running", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		common.AppLogger.Warnf("failed to encode task status: %v", err)
+	}
+}
+
+func (l *Lightning) handleProgress(w http.ResponseWriter, req *http.Request) {
+	curTask := l.currentTask()
+	if curTask == nil {
+		http.Error(w, "no task is running", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(curTask.Progress()); err != nil {
+		common.AppLogger.Warnf("failed to encode task progress: %v", err)
+	}
+}
+
+// handleTasks lists the tasks queued in server mode on GET, and submits a task
+// on POST. The body of POST is the TOML content of the task, applied on top of
+// the config file. The task starts after the queued tasks of higher or equal
+// `priority` (an integer, 0 by default), and not before the `not-before` time
+// (in RFC 3339) if given in the query.
+func (l *Lightning) handleTasks(w http.ResponseWriter, req *http.Request) {
+	queue := l.currentTaskQueue()
+	if queue == nil {
+		http.Error(w, "server mode is not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(queue.list()); err != nil {
+			common.AppLogger.Warnf("failed to encode task queue: %v", err)
+		}
+
+	case http.MethodPost:
+		task := QueuedTask{SubmitTime: time.Now()}
+		query := req.URL.Query()
+		if priority := query.Get("priority"); len(priority) > 0 {
+			var err error
+			if task.Priority, err = strconv.Atoi(priority); err != nil {
+				http.Error(w, "invalid priority: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if notBefore := query.Get("not-before"); len(notBefore) > 0 {
+			var err error
+			if task.NotBefore, err = time.Parse(time.RFC3339, notBefore); err != nil {
+				http.Error(w, "invalid not-before time: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// the config is checked now, rather than when the task starts.
+		if _, err := l.cfg.LoadTask(string(content)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		task.Config = string(content)
+		id, err := queue.push(task)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		common.AppLogger.Infof("task %d submitted, priority %d, not before %v", id, task.Priority, task.NotBefore)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]int64{"id": id}); err != nil {
+			common.AppLogger.Warnf("failed to encode task ID: %v", err)
+		}
+
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleQueuedTask removes the task `/tasks/$id` from the queue on DELETE,
+// unless it is started already.
+func (l *Lightning) handleQueuedTask(w http.ResponseWriter, req *http.Request) {
+	queue := l.currentTaskQueue()
+	if queue == nil {
+		http.Error(w, "server mode is not enabled", http.StatusNotImplemented)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(req.URL.Path, "/tasks/"), 10, 64)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "only DELETE is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err = queue.remove(id)
+	switch errors.Cause(err) {
+	case nil:
+		common.AppLogger.Infof("task %d removed from the queue", id)
+		w.WriteHeader(http.StatusOK)
+	case errTaskNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errTaskStarted:
+		http.Error(w, err.Error()+", stop it by /tasks/current/stop instead", http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleCheckpoints streams the status of the tables as server-sent events
+// whenever their checkpoints change. Each event carries a TableStatus in JSON.
+func (l *Lightning) handleCheckpoints(w http.ResponseWriter, req *http.Request) {
+	curTask := l.currentTask()
+	if curTask == nil {
+		http.Error(w, "no task is running", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	statuses, ok := curTask.WatchTableStatuses(req.Context())
+	if !ok {
+		http.Error(w, "the checkpoints cannot be watched with this driver", http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for status := range statuses {
+		content, err := json.Marshal(status)
+		if err != nil {
+			common.AppLogger.Warnf("failed to encode table status: %v", err)
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", content); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// handleTaskControl creates a handler applying the action on the current task.
+// Only the POST method is accepted since these actions change the state.
+func (l *Lightning) handleTaskControl(action func(*restore.RestoreController)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		curTask := l.currentTask()
+		if curTask == nil {
+			http.Error(w, "no task is running", http.StatusNotFound)
+			return
+		}
+		action(curTask)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// handleSettings returns the settings on GET, and changes the given fields of
+// them on PATCH, e.g. `{"level": "debug"}`.
+func (l *Lightning) handleSettings(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		settings := l.Settings()
+		if err := json.NewDecoder(req.Body).Decode(&settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := l.UpdateSettings(settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPatch)
+		http.Error(w, "only GET and PATCH are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	settings := l.Settings()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&settings); err != nil {
+		common.AppLogger.Warnf("failed to encode settings: %v", err)
+	}
+}
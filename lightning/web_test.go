@@ -0,0 +1,52 @@
+// Copyright 2019 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lightning
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/pingcap/check"
+)
+
+var _ = Suite(&webSuite{})
+
+type webSuite struct{}
+
+func (s *webSuite) TestOnlyTrustedControl(c *C) {
+	handler := onlyTrustedControl(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	serve := func(method string, remoteAddr string, state *tls.ConnectionState) int {
+		req := httptest.NewRequest(method, "/tasks/current/pause", nil)
+		req.RemoteAddr = remoteAddr
+		req.TLS = state
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// anyone can read the status.
+	c.Assert(serve(http.MethodGet, "10.0.0.1:4321", nil), Equals, http.StatusNoContent)
+	c.Assert(serve(http.MethodHead, "10.0.0.1:4321", nil), Equals, http.StatusNoContent)
+
+	c.Assert(serve(http.MethodPost, "10.0.0.1:4321", nil), Equals, http.StatusForbidden)
+	c.Assert(serve(http.MethodPatch, "10.0.0.1:4321", &tls.ConnectionState{}), Equals, http.StatusForbidden)
+	c.Assert(serve(http.MethodPost, "127.0.0.1:4321", nil), Equals, http.StatusNoContent)
+	c.Assert(serve(http.MethodDelete, "[::1]:4321", nil), Equals, http.StatusNoContent)
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	c.Assert(serve(http.MethodPost, "10.0.0.1:4321", verified), Equals, http.StatusNoContent)
+}
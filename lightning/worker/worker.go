@@ -15,6 +15,7 @@ package worker
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/pingcap/tidb-lightning/lightning/metric"
@@ -24,6 +25,13 @@ type Pool struct {
 	limit   int
 	workers chan *Worker
 	name    string
+
+	// for resizable pools, the workers beyond the current limit are kept in
+	// `retired`, and `retiring` counts the busy workers which should be
+	// retired once they are recycled.
+	lock     sync.Mutex
+	retired  []*Worker
+	retiring int
 }
 
 type Worker struct {
@@ -44,6 +52,61 @@ func NewPool(ctx context.Context, limit int, name string) *Pool {
 	}
 }
 
+// NewResizablePool creates a pool with `limit` workers, which can be resized
+// up to `maxLimit` workers via Resize().
+func NewResizablePool(ctx context.Context, limit int, maxLimit int, name string) *Pool {
+	if maxLimit < limit {
+		maxLimit = limit
+	}
+	pool := NewPool(ctx, maxLimit, name)
+	for i := limit; i < maxLimit; i++ {
+		pool.retired = append(pool.retired, <-pool.workers)
+	}
+	pool.limit = limit
+	metric.IdleWorkersGauge.WithLabelValues(name).Set(float64(limit))
+	return pool
+}
+
+// Limit returns the current number of workers in the pool.
+func (pool *Pool) Limit() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return pool.limit
+}
+
+// Resize changes the number of workers in the pool, which is clamped between 1
+// and the maximum limit given to NewResizablePool(). Shrinking the pool does
+// not interrupt the busy workers, they are retired when recycled.
+func (pool *Pool) Resize(limit int) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if limit < 1 {
+		limit = 1
+	} else if limit > cap(pool.workers) {
+		limit = cap(pool.workers)
+	}
+
+	for ; pool.limit < limit; pool.limit++ {
+		if pool.retiring > 0 {
+			pool.retiring--
+			continue
+		}
+		last := len(pool.retired) - 1
+		pool.workers <- pool.retired[last]
+		pool.retired = pool.retired[:last]
+	}
+	for ; pool.limit > limit; pool.limit-- {
+		select {
+		case worker := <-pool.workers:
+			pool.retired = append(pool.retired, worker)
+		default:
+			pool.retiring++
+		}
+	}
+	metric.IdleWorkersGauge.WithLabelValues(pool.name).Set(float64(len(pool.workers)))
+}
+
 func (pool *Pool) Apply() *Worker {
 	start := time.Now()
 	worker := <-pool.workers
@@ -53,6 +116,15 @@ func (pool *Pool) Apply() *Worker {
 }
 
 func (pool *Pool) Recycle(worker *Worker) {
+	pool.lock.Lock()
+	if pool.retiring > 0 {
+		pool.retiring--
+		pool.retired = append(pool.retired, worker)
+		pool.lock.Unlock()
+		return
+	}
+	pool.lock.Unlock()
+
 	pool.workers <- worker
 	metric.IdleWorkersGauge.WithLabelValues(pool.name).Set(float64(len(pool.workers)))
 }
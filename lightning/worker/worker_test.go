@@ -51,3 +51,37 @@ func (s *testWorkerPool) TestApplyRecycle(c *C) {
 
 	c.Assert(pool.HasWorker(), Equals, false)
 }
+
+func (s *testWorkerPool) TestResize(c *C) {
+	pool := worker.NewResizablePool(context.Background(), 2, 4, "test")
+	c.Assert(pool.Limit(), Equals, 2)
+
+	w1, w2 := pool.Apply(), pool.Apply()
+	c.Assert(pool.HasWorker(), Equals, false)
+
+	// growing makes more workers available immediately.
+	pool.Resize(10)
+	c.Assert(pool.Limit(), Equals, 4)
+	w3, w4 := pool.Apply(), pool.Apply()
+	c.Assert(pool.HasWorker(), Equals, false)
+
+	// shrinking retires the busy workers when they are recycled.
+	pool.Resize(1)
+	c.Assert(pool.Limit(), Equals, 1)
+	pool.Recycle(w1)
+	pool.Recycle(w2)
+	pool.Recycle(w3)
+	c.Assert(pool.HasWorker(), Equals, false)
+	pool.Recycle(w4)
+	c.Assert(pool.Apply(), Equals, w4)
+	c.Assert(pool.HasWorker(), Equals, false)
+	pool.Recycle(w4)
+
+	// idle workers are retired immediately.
+	pool.Resize(3)
+	pool.Resize(2)
+	c.Assert(pool.Limit(), Equals, 2)
+	pool.Apply()
+	pool.Apply()
+	c.Assert(pool.HasWorker(), Equals, false)
+}